@@ -0,0 +1,380 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// registry is a concurrency-safe set of resources managed through the admin
+// API, keyed by their client-specified ID
+type registry[T any] struct {
+	mu    sync.RWMutex
+	items map[string]T
+	// writes is held by admin API writes from reading the current item
+	// to storing the new one, see resourceHandler
+	writes sync.Mutex
+}
+
+func newRegistry[T any]() *registry[T] {
+	return &registry[T]{items: make(map[string]T)}
+}
+
+func (r *registry[T]) Get(id string) (T, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	item, ok := r.items[id]
+	return item, ok
+}
+
+// lockWrites takes the admin API write lock and returns its unlock
+func (r *registry[T]) lockWrites() (unlock func()) {
+	r.writes.Lock()
+	return r.writes.Unlock
+}
+
+// Put stores item under id and reports whether it was newly created
+func (r *registry[T]) Put(id string, item T) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, exists := r.items[id]
+	r.items[id] = item
+	return !exists
+}
+
+func (r *registry[T]) Delete(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, exists := r.items[id]
+	delete(r.items, id)
+	return exists
+}
+
+// Update replaces the item under id with what f makes of it, if there is
+// one, and reports whether there was
+func (r *registry[T]) Update(id string, f func(T) T) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	item, exists := r.items[id]
+	if exists {
+		r.items[id] = f(item)
+	}
+	return exists
+}
+
+// Len returns the number of items
+func (r *registry[T]) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.items)
+}
+
+// List returns all items ordered by ID
+func (r *registry[T]) List() []T {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	ids := make([]string, 0, len(r.items))
+	for id := range r.items {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	items := make([]T, 0, len(ids))
+	for _, id := range ids {
+		items = append(items, r.items[id])
+	}
+	return items
+}
+
+// etagFor returns a strong ETag derived from the JSON form of v, so the same
+// resource state always yields the same tag
+func etagFor(v any) string {
+	data, _ := json.Marshal(v)
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// checkPreconditions evaluates If-Match and If-None-Match against the current
+// ETag of a resource ("" if it does not exist). It writes a 412 and returns
+// false when the request must not proceed.
+func checkPreconditions(w http.ResponseWriter, r *http.Request, current string) bool {
+	if match := r.Header.Get("If-Match"); match != "" {
+		if current == "" || (match != "*" && match != current) {
+			http.Error(w, "Precondition failed: resource has changed", http.StatusPreconditionFailed)
+			return false
+		}
+	}
+	if noneMatch := r.Header.Get("If-None-Match"); noneMatch != "" && current != "" {
+		if noneMatch == "*" || noneMatch == current {
+			http.Error(w, "Precondition failed: resource already exists", http.StatusPreconditionFailed)
+			return false
+		}
+	}
+	return true
+}
+
+// writeResource writes v as JSON with its ETag
+func writeResource(w http.ResponseWriter, status int, etag string, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", etag)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// decodeResource reads a JSON resource body for a PUT request
+func decodeResource(r *http.Request, v any) error {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read request body")
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("invalid JSON in request body")
+	}
+	return nil
+}
+
+// resourceHandler implements idempotent GET/PUT/DELETE for a resource kind
+// so infrastructure-as-code tools can manage it declaratively. PUT creates
+// or fully replaces the resource at the client-chosen ID; conditional
+// requests are supported through ETags.
+type resourceHandler[T any] struct {
+	// lock takes the write lock of the store, held by a PUT or DELETE from
+	// evaluating its preconditions until it is done, so two writers sending
+	// the same If-Match cannot both succeed
+	lock func() (unlock func())
+	// get returns the current resource and its ETag
+	get func(id string) (T, string, bool)
+	// put stores the resource and reports whether it was created
+	put func(id string, item T, existing *T) (bool, error)
+	// remove deletes the resource and reports whether it existed
+	remove func(id string) bool
+	// view returns the representation sent back to clients
+	view func(item T) any
+}
+
+func (h resourceHandler[T]) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	var item T
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		// The body is read before taking the lock, so a slow client does
+		// not hold up other writers
+		if err := decodeResource(r, &item); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fallthrough
+	case http.MethodDelete:
+		defer h.lock()()
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	current, etag, exists := h.get(id)
+	if !exists {
+		etag = ""
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if !exists {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		if r.Header.Get("If-None-Match") == etag {
+			w.Header().Set("ETag", etag)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		writeResource(w, http.StatusOK, etag, h.view(current))
+
+	case http.MethodPut:
+		if !checkPreconditions(w, r, etag) {
+			return
+		}
+		var existing *T
+		if exists {
+			existing = &current
+		}
+		created, err := h.put(id, item, existing)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		stored, newETag, _ := h.get(id)
+		status := http.StatusOK
+		if created {
+			status = http.StatusCreated
+		}
+		writeResource(w, status, newETag, h.view(stored))
+
+	case http.MethodDelete:
+		if !checkPreconditions(w, r, etag) {
+			return
+		}
+		if !h.remove(id) {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// keyView is a client key as returned by the admin API, without its secret
+func keyView(key ClientKey) any {
+	key.Key = ""
+	key.KeyHash = ""
+	return key
+}
+
+// keyETag hashes the key's secret rather than embedding it so the ETag
+// still changes when the secret is rotated
+func keyETag(key ClientKey) string {
+	key.Key = key.hash()
+	key.KeyHash = ""
+	return etagFor(key)
+}
+
+func (s *ProxyServer) adminKeyHandler() http.Handler {
+	return resourceHandler[ClientKey]{
+		lock: s.keys.lockWrites,
+		get: func(id string) (ClientKey, string, bool) {
+			key := s.keys.Get(id)
+			if key == nil {
+				return ClientKey{}, "", false
+			}
+			return *key, keyETag(*key), true
+		},
+		put: func(id string, key ClientKey, existing *ClientKey) (bool, error) {
+			if key.ID != "" && key.ID != id {
+				return false, fmt.Errorf("id in body does not match id in path")
+			}
+			if key.Parent != "" || key.ExpiresAt != nil {
+				return false, fmt.Errorf("temporary tokens cannot be provisioned, mint them instead")
+			}
+			key.ID = id
+			if key.Key == "" && key.KeyHash == "" {
+				if existing == nil {
+					return false, fmt.Errorf("key is required when creating a client key")
+				}
+				// Keep the current secret so re-applying a config without it is a no-op
+				key.Key, key.KeyHash = existing.Key, existing.KeyHash
+			}
+			if err := s.upstreamKeys.check(key.Upstream); err != nil {
+				return false, err
+			}
+			created, err := s.keys.Put(key)
+			if err == nil {
+				s.saveKeys()
+			}
+			return created, err
+		},
+		remove: func(id string) bool {
+			key := s.keys.Get(id)
+			if key == nil || key.Parent != "" || !s.keys.Delete(id) {
+				return false
+			}
+			s.saveKeys()
+			return true
+		},
+		view: func(key ClientKey) any { return keyView(key) },
+	}
+}
+
+// Tenant groups client keys and applies limits shared by all of them
+type Tenant struct {
+	ID     string    `json:"id"`
+	Name   string    `json:"name,omitempty"`
+	Limits KeyLimits `json:"limits,omitempty"`
+	// Batch paces the tenant's requests instead of sending them as they come
+	Batch *BatchPacing `json:"batch,omitempty"`
+	// Weight is the tenant's share of upstream slots when requests queue
+	// for them, relative to the default of 1
+	Weight float64 `json:"weight,omitempty"`
+	// CompletionRetry, if set, overrides PROXY_COMPLETION_RETRY for the
+	// tenant
+	CompletionRetry *bool `json:"completion_retry,omitempty"`
+	// AutoContinueTokens, if set, overrides PROXY_AUTO_CONTINUE_TOKENS for
+	// the tenant; 0 turns continuations off
+	AutoContinueTokens *int `json:"auto_continue_tokens,omitempty"`
+}
+
+// validate checks the settings of a tenant
+func (t Tenant) validate() error {
+	if t.Weight < 0 {
+		return fmt.Errorf("weight must not be negative")
+	}
+	if t.AutoContinueTokens != nil && *t.AutoContinueTokens < 0 {
+		return fmt.Errorf("auto_continue_tokens must not be negative")
+	}
+	if t.Batch != nil {
+		return t.Batch.validate()
+	}
+	return nil
+}
+
+func (s *ProxyServer) adminTenantHandler() http.Handler {
+	return resourceHandler[Tenant]{
+		lock: s.tenants.lockWrites,
+		get: func(id string) (Tenant, string, bool) {
+			tenant, ok := s.tenants.Get(id)
+			return tenant, etagFor(tenant), ok
+		},
+		put: func(id string, tenant Tenant, existing *Tenant) (bool, error) {
+			if tenant.ID != "" && tenant.ID != id {
+				return false, fmt.Errorf("id in body does not match id in path")
+			}
+			if existing == nil {
+				if err := s.license.AllowsTenants(s.tenants.Len() + 1); err != nil {
+					return false, err
+				}
+			}
+			if err := tenant.validate(); err != nil {
+				return false, err
+			}
+			tenant.ID = id
+			return s.tenants.Put(id, tenant), nil
+		},
+		remove: s.tenants.Delete,
+		view:   func(tenant Tenant) any { return tenant },
+	}
+}
+
+func (s *ProxyServer) adminRouteHandler() http.Handler {
+	return resourceHandler[RoutingRule]{
+		lock: s.routes.lockWrites,
+		get: func(id string) (RoutingRule, string, bool) {
+			rule, ok := s.routes.Get(id)
+			return rule, etagFor(rule), ok
+		},
+		put: func(id string, rule RoutingRule, _ *RoutingRule) (bool, error) {
+			if rule.ID != "" && rule.ID != id {
+				return false, fmt.Errorf("id in body does not match id in path")
+			}
+			rule.ID = id
+			if rule.Model == "" || rule.TargetModel == "" {
+				return false, fmt.Errorf("routing rule requires model and target_model")
+			}
+			return s.routes.Put(id, rule), nil
+		},
+		remove: s.routes.Delete,
+		view:   func(rule RoutingRule) any { return rule },
+	}
+}
+
+// handleAdminList returns a handler listing every item of a resource kind
+func handleAdminList[T any](name string, list func() []T) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{name: list()})
+	}
+}
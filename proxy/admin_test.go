@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestAdminMux(server *ProxyServer) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/admin/keys/{id}", server.adminKeyHandler())
+	mux.Handle("/admin/tenants/{id}", server.adminTenantHandler())
+	mux.Handle("/admin/routes/{id}", server.adminRouteHandler())
+	mux.HandleFunc("/admin/routes", handleAdminList("routes", server.routes.List))
+	return mux
+}
+
+func adminRequest(mux http.Handler, method, path, body string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	return w
+}
+
+func TestAdmin_PutKey_Idempotent(t *testing.T) {
+	server := NewProxyServer(&MockOpenAIClient{})
+	server.keys = createTestKeyStore(t)
+	mux := newTestAdminMux(server)
+
+	body := `{"key": "sk-ci", "scopes": {"models": ["gpt-4o-mini"]}}`
+	w := adminRequest(mux, "PUT", "/admin/keys/ci", body, nil)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("Expected ETag header")
+	}
+	if bytes.Contains(w.Body.Bytes(), []byte("sk-ci")) {
+		t.Error("Expected secret not to be returned")
+	}
+
+	// Re-applying the same definition is a no-op with a stable ETag
+	w = adminRequest(mux, "PUT", "/admin/keys/ci", body, nil)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	if w.Header().Get("ETag") != etag {
+		t.Errorf("Expected ETag %s to be stable, got %s", etag, w.Header().Get("ETag"))
+	}
+
+	// Omitting the secret on update keeps the existing one
+	w = adminRequest(mux, "PUT", "/admin/keys/ci", `{"scopes": {"models": ["gpt-4o"]}}`, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	key := server.keys.Lookup("sk-ci")
+	if key == nil || !key.AllowsModel("gpt-4o") {
+		t.Errorf("Expected updated scopes with the original secret, got %+v", key)
+	}
+}
+
+func TestAdmin_PutKey_Validation(t *testing.T) {
+	server := NewProxyServer(&MockOpenAIClient{})
+	server.keys = createTestKeyStore(t)
+	mux := newTestAdminMux(server)
+
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"missing secret on create", `{"scopes": {}}`},
+		{"mismatched id", `{"id": "other", "key": "sk-x"}`},
+		{"temporary token", `{"key": "sk-x", "parent": "full"}`},
+		{"invalid json", `{`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := adminRequest(mux, "PUT", "/admin/keys/new", tt.body, nil)
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("Expected status code %d, got %d", http.StatusBadRequest, w.Code)
+			}
+		})
+	}
+}
+
+func TestAdmin_Preconditions(t *testing.T) {
+	server := NewProxyServer(&MockOpenAIClient{})
+	server.keys = createTestKeyStore(t)
+	mux := newTestAdminMux(server)
+
+	w := adminRequest(mux, "PUT", "/admin/tenants/acme", `{"name": "Acme"}`, map[string]string{"If-None-Match": "*"})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status code %d, got %d", http.StatusCreated, w.Code)
+	}
+	etag := w.Header().Get("ETag")
+
+	// Create-only PUT fails once the tenant exists
+	w = adminRequest(mux, "PUT", "/admin/tenants/acme", `{"name": "Acme"}`, map[string]string{"If-None-Match": "*"})
+	if w.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected status code %d, got %d", http.StatusPreconditionFailed, w.Code)
+	}
+
+	// Stale ETags are rejected
+	w = adminRequest(mux, "PUT", "/admin/tenants/acme", `{"name": "Acme Corp"}`, map[string]string{"If-Match": `"stale"`})
+	if w.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected status code %d, got %d", http.StatusPreconditionFailed, w.Code)
+	}
+
+	w = adminRequest(mux, "PUT", "/admin/tenants/acme", `{"name": "Acme Corp"}`, map[string]string{"If-Match": etag})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	newETag := w.Header().Get("ETag")
+	if newETag == etag {
+		t.Error("Expected ETag to change after update")
+	}
+
+	w = adminRequest(mux, "GET", "/admin/tenants/acme", "", map[string]string{"If-None-Match": newETag})
+	if w.Code != http.StatusNotModified {
+		t.Errorf("Expected status code %d, got %d", http.StatusNotModified, w.Code)
+	}
+
+	w = adminRequest(mux, "DELETE", "/admin/tenants/acme", "", map[string]string{"If-Match": etag})
+	if w.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected status code %d, got %d", http.StatusPreconditionFailed, w.Code)
+	}
+	w = adminRequest(mux, "DELETE", "/admin/tenants/acme", "", map[string]string{"If-Match": newETag})
+	if w.Code != http.StatusNoContent {
+		t.Errorf("Expected status code %d, got %d", http.StatusNoContent, w.Code)
+	}
+	w = adminRequest(mux, "GET", "/admin/tenants/acme", "", nil)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d, got %d", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestAdmin_ConcurrentIfMatch(t *testing.T) {
+	tenants := newRegistry[Tenant]()
+	tenants.Put("acme", Tenant{Name: "Acme"})
+	etag := etagFor(Tenant{Name: "Acme"})
+	handler := resourceHandler[Tenant]{
+		lock: tenants.lockWrites,
+		get: func(id string) (Tenant, string, bool) {
+			tenant, ok := tenants.Get(id)
+			// Widen the window between reading the ETag and writing
+			time.Sleep(time.Millisecond)
+			return tenant, etagFor(tenant), ok
+		},
+		put: func(id string, tenant Tenant, _ *Tenant) (bool, error) {
+			return tenants.Put(id, tenant), nil
+		},
+		remove: tenants.Delete,
+		view:   func(tenant Tenant) any { return tenant },
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/admin/tenants/{id}", handler)
+
+	// Every writer sends the same If-Match; only one may win
+	const writers = 20
+	codes := make(chan int, writers)
+	var wg sync.WaitGroup
+	for i := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			body := fmt.Sprintf(`{"name": "Acme %d"}`, i)
+			codes <- adminRequest(mux, "PUT", "/admin/tenants/acme", body, map[string]string{"If-Match": etag}).Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+	won := 0
+	for code := range codes {
+		switch code {
+		case http.StatusOK:
+			won++
+		case http.StatusPreconditionFailed:
+		default:
+			t.Errorf("Expected status code %d or %d, got %d", http.StatusOK, http.StatusPreconditionFailed, code)
+		}
+	}
+	if won != 1 {
+		t.Errorf("Expected exactly one conditional write to succeed, got %d", won)
+	}
+}
+
+func TestAdmin_DeleteKeyRemovesTokens(t *testing.T) {
+	server := NewProxyServer(&MockOpenAIClient{})
+	server.keys = createTestKeyStore(t)
+	mux := newTestAdminMux(server)
+
+	w := mintTestToken(t, server, "full", `{}`)
+	var token MintTokenResponse
+	json.NewDecoder(w.Body).Decode(&token)
+
+	// Temporary tokens are not managed declaratively
+	if w := adminRequest(mux, "DELETE", "/admin/keys/"+token.ID, "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d, got %d", http.StatusNotFound, w.Code)
+	}
+
+	if w := adminRequest(mux, "DELETE", "/admin/keys/full", "", nil); w.Code != http.StatusNoContent {
+		t.Fatalf("Expected status code %d, got %d", http.StatusNoContent, w.Code)
+	}
+	if server.keys.Lookup("sk-full") != nil || server.keys.Lookup(token.Key) != nil {
+		t.Error("Expected key and its tokens to be removed")
+	}
+	if w := adminRequest(mux, "DELETE", "/admin/keys/full", "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d on repeated delete, got %d", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestAdmin_PutRoute(t *testing.T) {
+	server := NewProxyServer(&MockOpenAIClient{})
+	mux := newTestAdminMux(server)
+
+	w := adminRequest(mux, "PUT", "/admin/routes/legacy", `{"model": "gpt-3.5*"}`, nil)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d for incomplete rule, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	w = adminRequest(mux, "PUT", "/admin/routes/legacy", `{"model": "gpt-3.5*", "target_model": "gpt-4o-mini"}`, nil)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+
+	w = adminRequest(mux, "GET", "/admin/routes", "", nil)
+	var list struct {
+		Routes []RoutingRule `json:"routes"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&list); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(list.Routes) != 1 || list.Routes[0].ID != "legacy" {
+		t.Errorf("Expected the legacy route to be listed, got %+v", list.Routes)
+	}
+}
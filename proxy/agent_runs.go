@@ -0,0 +1,283 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Outcomes of an agent run
+const (
+	// The model gave a final reply
+	AgentCompleted = "completed"
+	// The model called one of the client's tools, so the reply went back
+	// to the client
+	AgentClientTools = "client_tools"
+	// The model was still calling builtin tools after toolMaxRounds
+	AgentMaxRounds = "max_rounds"
+	// The upstream failed
+	AgentFailed = "failed"
+)
+
+// AgentRun records a chat completion in which the proxy ran builtin tools:
+// every reply of the model and the tool calls it answered, so the run can
+// be inspected and replayed against another model or configuration
+type AgentRun struct {
+	ID string `json:"id"`
+	// ReplayOf is the run this one replays
+	ReplayOf string    `json:"replay_of,omitempty"`
+	Tenant   string    `json:"tenant,omitempty"`
+	KeyID    string    `json:"key_id,omitempty"`
+	Created  time.Time `json:"created"`
+	// Request is what was first sent upstream, after virtual models and
+	// retrieval augmentation, with the builtin tools declared
+	Request      ChatCompletionRequest `json:"request"`
+	BuiltinTools []string              `json:"builtin_tools"`
+	Steps        []AgentStep           `json:"steps"`
+	Usage        Usage                 `json:"usage"`
+	Outcome      string                `json:"outcome"`
+	Error        string                `json:"error,omitempty"`
+	DurationMS   int64                 `json:"duration_ms"`
+}
+
+// AgentStep is one reply of the model and the builtin tool calls in it
+// the proxy answered
+type AgentStep struct {
+	Round        int       `json:"round"`
+	Model        string    `json:"model"`
+	Reply        Message   `json:"reply"`
+	FinishReason string    `json:"finish_reason,omitempty"`
+	Usage        Usage     `json:"usage"`
+	ToolRuns     []ToolRun `json:"tool_runs,omitempty"`
+}
+
+// agentRunID matches the IDs newAgentRun hands out, so they can safely be
+// file names
+var agentRunID = regexp.MustCompile(`^run_[0-9a-f]{24}$`)
+
+// newAgentRun starts recording a run of req
+func newAgentRun(key *ClientKey, req ChatCompletionRequest, offered map[string]builtinTool) *AgentRun {
+	id := make([]byte, 12)
+	rand.Read(id)
+	run := &AgentRun{ID: "run_" + hex.EncodeToString(id), Created: time.Now().UTC(), Request: req}
+	if key != nil {
+		run.Tenant, run.KeyID = key.Tenant, key.ID
+	}
+	run.Request.Messages = append([]Message(nil), req.Messages...)
+	for name := range offered {
+		run.BuiltinTools = append(run.BuiltinTools, name)
+	}
+	slices.Sort(run.BuiltinTools)
+	return run
+}
+
+// agentRunStore keeps the most recent runs in memory and, with a
+// directory, every run in a JSON file of its own there, so runs survive
+// restarts and are shared by replicas mounting the same volume
+type agentRunStore struct {
+	dir string
+	max int
+
+	mu    sync.Mutex
+	runs  map[string]*AgentRun
+	order []string
+}
+
+func newAgentRunStore(dir string, max int) *agentRunStore {
+	return &agentRunStore{dir: dir, max: max, runs: make(map[string]*AgentRun)}
+}
+
+// agentRunStoreFromEnv configures the store from PROXY_AGENT_RUNS_DIR, the
+// directory runs are written to, and PROXY_AGENT_RUNS_MAX, how many are
+// kept in memory
+func agentRunStoreFromEnv(getenv func(string) string) (*agentRunStore, error) {
+	dir, max := getenv("PROXY_AGENT_RUNS_DIR"), 1000
+	if v := getenv("PROXY_AGENT_RUNS_MAX"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid PROXY_AGENT_RUNS_MAX %q", v)
+		}
+		max = n
+	}
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, fmt.Errorf("invalid PROXY_AGENT_RUNS_DIR %q: %v", dir, err)
+		}
+	}
+	return newAgentRunStore(dir, max), nil
+}
+
+// Save records a finished run. Failing to write it is logged rather than
+// failing the request it belongs to.
+func (s *agentRunStore) Save(run *AgentRun) {
+	s.mu.Lock()
+	if _, ok := s.runs[run.ID]; !ok {
+		s.order = append(s.order, run.ID)
+	}
+	s.runs[run.ID] = run
+	for len(s.order) > s.max {
+		delete(s.runs, s.order[0])
+		s.order = s.order[1:]
+	}
+	s.mu.Unlock()
+
+	if s.dir == "" {
+		return
+	}
+	data, err := json.Marshal(run)
+	if err == nil {
+		path := filepath.Join(s.dir, run.ID+".json")
+		if err = os.WriteFile(path+".tmp", data, 0o644); err == nil {
+			err = os.Rename(path+".tmp", path)
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to persist agent run %s: %v", run.ID, err)
+	}
+}
+
+// Get returns a run from memory or else from the directory
+func (s *agentRunStore) Get(id string) (*AgentRun, bool) {
+	s.mu.Lock()
+	run, ok := s.runs[id]
+	s.mu.Unlock()
+	if ok || s.dir == "" || !agentRunID.MatchString(id) {
+		return run, ok
+	}
+	data, err := os.ReadFile(filepath.Join(s.dir, id+".json"))
+	if err != nil {
+		return nil, false
+	}
+	run = &AgentRun{}
+	if err := json.Unmarshal(data, run); err != nil {
+		log.Printf("Failed to read agent run %s: %v", id, err)
+		return nil, false
+	}
+	return run, true
+}
+
+// agentRunFor looks up a run for the caller. Runs of another tenant are
+// unknown to it.
+func (s *ProxyServer) agentRunFor(r *http.Request) (*AgentRun, bool) {
+	run, ok := s.agentRuns.Get(r.PathValue("id"))
+	if !ok {
+		return nil, false
+	}
+	if key := clientKeyFromContext(r.Context()); key != nil && key.Tenant != run.Tenant {
+		return nil, false
+	}
+	return run, true
+}
+
+func (s *ProxyServer) handleGetAgentRun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	run, ok := s.agentRunFor(r)
+	if !ok {
+		http.Error(w, "Agent run not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(run)
+}
+
+// AgentReplayRequest is the body of /v1/agents/runs/{id}/replay: what to
+// change from the original run, everything else being the same
+type AgentReplayRequest struct {
+	Model       string   `json:"model,omitempty"`
+	Temperature *float64 `json:"temperature,omitempty"`
+	TopP        *float64 `json:"top_p,omitempty"`
+	MaxTokens   *int     `json:"max_tokens,omitempty"`
+	// BuiltinTools replaces the builtin tools offered to the model
+	BuiltinTools []string `json:"builtin_tools,omitempty"`
+}
+
+// handleReplayAgentRun runs the first request of a stored run again, with
+// its builtin tools run again too, and records the result as a new run
+func (s *ProxyServer) handleReplayAgentRun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	original, ok := s.agentRunFor(r)
+	if !ok {
+		http.Error(w, "Agent run not found", http.StatusNotFound)
+		return
+	}
+	var replay AgentReplayRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&replay); err != nil {
+			http.Error(w, "Invalid JSON in request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	req := original.Request
+	req.Messages = append([]Message(nil), original.Request.Messages...)
+	// The builtin tools are declared again as they are now
+	req.Tools = nil
+	for _, tool := range original.Request.Tools {
+		if !slices.Contains(original.BuiltinTools, tool.Function.Name) {
+			req.Tools = append(req.Tools, tool)
+		}
+	}
+	req.BuiltinTools = original.BuiltinTools
+	if replay.BuiltinTools != nil {
+		req.BuiltinTools = replay.BuiltinTools
+	}
+	if replay.Temperature != nil {
+		req.Temperature = replay.Temperature
+	}
+	if replay.TopP != nil {
+		req.TopP = replay.TopP
+	}
+	if replay.MaxTokens != nil {
+		req.MaxTokens = replay.MaxTokens
+	}
+	key := clientKeyFromContext(r.Context())
+	if replay.Model != "" {
+		if key != nil && !key.AllowsModel(replay.Model) {
+			http.Error(w, fmt.Sprintf("API key is not allowed to use model %s", replay.Model), http.StatusForbidden)
+			return
+		}
+		req.Model = replay.Model
+		if err := s.expandModel(&req, original.Tenant, "agents.replay"); err != nil {
+			http.Error(w, err.Error(), expandModelStatus(err))
+			return
+		}
+	}
+	offered, err := s.offerBuiltinTools(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	run := newAgentRun(key, req, offered)
+	run.ReplayOf = original.ID
+	event := newUsageEvent(key, "agents.replay", req.Model)
+	_, err = s.runAgent(r.Context(), req, offered, run)
+	event.LatencyMS = time.Since(event.Time).Milliseconds()
+	s.agentRuns.Save(run)
+	if err != nil {
+		log.Printf("OpenAI API error: %v", err)
+		event.Status = http.StatusInternalServerError
+		s.recordUsage(event)
+		http.Error(w, fmt.Sprintf("Replay %s failed: %v", run.ID, err), http.StatusBadGateway)
+		return
+	}
+	s.recordCompletion(key, event, run.Usage)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(run)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func agentRunRequestAs(server *ProxyServer, key *ClientKey, method, id, body string) *httptest.ResponseRecorder {
+	target := "/v1/agents/runs/" + id
+	if method == http.MethodPost {
+		target += "/replay"
+	}
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.SetPathValue("id", id)
+	if key != nil {
+		req = req.WithContext(context.WithValue(req.Context(), clientKeyContextKey, key))
+	}
+	w := httptest.NewRecorder()
+	if method == http.MethodPost {
+		server.handleReplayAgentRun(w, req)
+	} else {
+		server.handleGetAgentRun(w, req)
+	}
+	return w
+}
+
+func TestProxyServer_AgentRuns(t *testing.T) {
+	client := &toolLoopClient{tool: "echo", rounds: 2}
+	server := NewProxyServer(client)
+	server.builtinTools["echo"] = echoTool{fail: 1}
+	key := &ClientKey{ID: "k1", Tenant: "acme"}
+
+	w := chatRequestAs(server, key, `{"model": "gpt-4o", "messages": [{"role": "user", "content": "Go"}], "builtin_tools": ["echo"]}`)
+	var resp ChatCompletionResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	id := resp.Metadata.AgentRunID
+	if !agentRunID.MatchString(id) {
+		t.Fatalf("Expected the run ID in the metadata, got %+v", resp.Metadata)
+	}
+
+	w = agentRunRequestAs(server, key, http.MethodGet, id, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var run AgentRun
+	json.Unmarshal(w.Body.Bytes(), &run)
+	if run.Outcome != AgentCompleted || len(run.Steps) != 3 || run.Usage.TotalTokens != 96 || run.Tenant != "acme" || run.KeyID != "k1" {
+		t.Errorf("Expected a completed run of 3 steps, got %+v", run)
+	}
+	if steps := run.Steps; steps[0].ToolRuns[0].Error == "" || steps[1].ToolRuns[0].Output != `echo {"n": 2}` || steps[2].Reply.Content != `echo {"n": 2}` {
+		t.Errorf("Expected the tool calls and the final reply in the steps, got %+v", steps)
+	}
+	if len(run.Request.Messages) != 1 || len(run.Request.Tools) != 1 || run.BuiltinTools[0] != "echo" {
+		t.Errorf("Expected the first request upstream recorded, got %+v", run.Request)
+	}
+
+	// Another tenant cannot see the run
+	if w := agentRunRequestAs(server, &ClientKey{ID: "k2", Tenant: "other"}, http.MethodGet, id, ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d for another tenant, got %d", http.StatusNotFound, w.Code)
+	}
+	if w := agentRunRequestAs(server, key, http.MethodGet, "run_missing", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d for an unknown run, got %d", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestProxyServer_ReplayAgentRun(t *testing.T) {
+	client := &toolLoopClient{tool: "echo", rounds: 1}
+	server := NewProxyServer(client)
+	server.builtinTools["echo"] = echoTool{}
+	w := chatRequestAs(server, nil, `{"model": "gpt-4o", "messages": [{"role": "user", "content": "Go"}], "builtin_tools": ["echo"]}`)
+	var resp ChatCompletionResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	original := resp.Metadata.AgentRunID
+
+	client.requests = nil
+	w = agentRunRequestAs(server, nil, http.MethodPost, original, `{"model": "gpt-4o-mini", "temperature": 0}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var run AgentRun
+	json.Unmarshal(w.Body.Bytes(), &run)
+	if run.ReplayOf != original || run.ID == original || run.Outcome != AgentCompleted || len(run.Steps) != 2 {
+		t.Errorf("Expected a new completed run replaying the original, got %+v", run)
+	}
+	req := client.requests[0]
+	if req.Model != "gpt-4o-mini" || req.Temperature == nil || *req.Temperature != 0 || len(req.Tools) != 1 || req.Messages[0].Content != "Go" {
+		t.Errorf("Expected the original request with the overrides, got %+v", req)
+	}
+	if _, ok := server.agentRuns.Get(run.ID); !ok {
+		t.Error("Expected the replay stored as a run")
+	}
+
+	limited := &ClientKey{ID: "k1", Scopes: KeyScopes{Models: []string{"gpt-4o"}}}
+	if w := agentRunRequestAs(server, limited, http.MethodPost, original, `{"model": "gpt-4o-mini"}`); w.Code != http.StatusForbidden {
+		t.Errorf("Expected status code %d for a model the key cannot use, got %d", http.StatusForbidden, w.Code)
+	}
+	if w := agentRunRequestAs(server, nil, http.MethodPost, original, `{"builtin_tools": ["browser"]}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d for an unknown builtin tool, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestAgentRunStore(t *testing.T) {
+	dir := t.TempDir()
+	store := newAgentRunStore(dir, 2)
+	var runs []*AgentRun
+	for range 3 {
+		run := newAgentRun(nil, ChatCompletionRequest{Model: "gpt-4o"}, nil)
+		run.Outcome = AgentCompleted
+		store.Save(run)
+		runs = append(runs, run)
+	}
+	if len(store.runs) != 2 {
+		t.Errorf("Expected 2 runs kept in memory, got %d", len(store.runs))
+	}
+	// Evicted and restarted runs are read back from the directory
+	for _, s := range []*agentRunStore{store, newAgentRunStore(dir, 2)} {
+		if run, ok := s.Get(runs[0].ID); !ok || run.Request.Model != "gpt-4o" || run.Outcome != AgentCompleted {
+			t.Errorf("Expected the run read from the directory, got %+v", run)
+		}
+	}
+	if _, ok := store.Get("../" + runs[0].ID); ok {
+		t.Error("Expected IDs outside the directory rejected")
+	}
+}
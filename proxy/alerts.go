@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Alert is a condition the proxy wants an operator to look at
+type Alert struct {
+	Name     string            `json:"name"`
+	Severity string            `json:"severity"`
+	Summary  string            `json:"summary"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	StartsAt time.Time         `json:"starts_at"`
+	Resolved bool              `json:"resolved,omitempty"`
+}
+
+// alerter tracks active alerts and notifies on transitions only, so a
+// condition that holds for hours produces one notification when it starts
+// and one when it ends. Notifications are logged and, if configured, POSTed
+// as JSON to a webhook such as an Alertmanager or chat integration.
+type alerter struct {
+	webhook string
+	client  *http.Client
+	now     func() time.Time
+
+	mu     sync.Mutex
+	active map[string]Alert
+}
+
+func newAlerter(webhook string) *alerter {
+	return &alerter{
+		webhook: webhook,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		now:     time.Now,
+		active:  make(map[string]Alert),
+	}
+}
+
+// Fire raises alert unless an alert with the same name and severity is
+// already active
+func (a *alerter) Fire(ctx context.Context, alert Alert) {
+	a.mu.Lock()
+	if current, ok := a.active[alert.Name]; ok && current.Severity == alert.Severity {
+		a.mu.Unlock()
+		return
+	}
+	alert.StartsAt = a.now().UTC()
+	a.active[alert.Name] = alert
+	a.mu.Unlock()
+
+	log.Printf("Alert %s (%s): %s", alert.Name, alert.Severity, alert.Summary)
+	a.notify(ctx, alert)
+}
+
+// Resolve clears the alert called name if it is active
+func (a *alerter) Resolve(ctx context.Context, name string) {
+	a.mu.Lock()
+	alert, ok := a.active[name]
+	delete(a.active, name)
+	a.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	alert.Resolved = true
+	log.Printf("Alert %s resolved", name)
+	a.notify(ctx, alert)
+}
+
+func (a *alerter) notify(ctx context.Context, alert Alert) {
+	if a.webhook == "" {
+		return
+	}
+	body, _ := json.Marshal(alert)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.webhook, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Failed to send alert %s: %v", alert.Name, err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := a.client.Do(req)
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode > 299 {
+			err = fmt.Errorf("webhook returned status %d", resp.StatusCode)
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to send alert %s: %v", alert.Name, err)
+	}
+}
+
+// Active returns the active alerts ordered by name
+func (a *alerter) Active() []Alert {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	alerts := make([]Alert, 0, len(a.active))
+	for _, alert := range a.active {
+		alerts = append(alerts, alert)
+	}
+	sort.Slice(alerts, func(i, j int) bool { return alerts[i].Name < alerts[j].Name })
+	return alerts
+}
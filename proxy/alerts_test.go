@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAlerter_NotifiesOnTransitions(t *testing.T) {
+	var notified []Alert
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert Alert
+		json.NewDecoder(r.Body).Decode(&alert)
+		notified = append(notified, alert)
+	}))
+	defer webhook.Close()
+
+	a := newAlerter(webhook.URL)
+	ctx := context.Background()
+	a.Fire(ctx, Alert{Name: "x", Severity: "ticket"})
+	a.Fire(ctx, Alert{Name: "x", Severity: "ticket"})
+	a.Fire(ctx, Alert{Name: "x", Severity: "page"})
+	a.Resolve(ctx, "x")
+	a.Resolve(ctx, "x")
+
+	if len(notified) != 3 {
+		t.Fatalf("Expected 3 notifications, got %+v", notified)
+	}
+	if notified[1].Severity != "page" || notified[2].Resolved != true {
+		t.Errorf("Expected an escalation then a resolution, got %+v", notified)
+	}
+	if active := a.Active(); len(active) != 0 {
+		t.Errorf("Expected no active alerts, got %+v", active)
+	}
+}
+
+func TestAlerter_Active(t *testing.T) {
+	a := newAlerter("")
+	a.Fire(context.Background(), Alert{Name: "b", Severity: "page"})
+	a.Fire(context.Background(), Alert{Name: "a", Severity: "ticket"})
+
+	active := a.Active()
+	if len(active) != 2 || active[0].Name != "a" || active[1].Name != "b" {
+		t.Errorf("Expected alerts a and b in order, got %+v", active)
+	}
+	if active[0].StartsAt.IsZero() {
+		t.Error("Expected StartsAt to be set")
+	}
+}
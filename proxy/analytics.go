@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Single-node deployments can keep usage analytics in the proxy itself
+// instead of a collector. Usage events are rolled up into hourly and daily
+// rows per tenant, key, model and endpoint by a background job, which also
+// drops rows past their retention and saves the tables to one file. The
+// proxy has no dependencies and builds without cgo, so the tables are a
+// JSON file rather than a SQLite database; they are small, since their size
+// depends on the number of keys and models rather than of requests.
+
+// Granularities of the analytics tables
+const (
+	AnalyticsHourly = "hour"
+	AnalyticsDaily  = "day"
+)
+
+// analyticsMaxPending bounds the events waiting for the next rollup; more
+// are dropped, so a stuck job cannot grow memory without bound
+const analyticsMaxPending = 100000
+
+// AnalyticsRow is the usage of one tenant, key, model and endpoint during
+// the hour or day from Start. Rows of a query grouped by fewer fields leave
+// the others empty.
+type AnalyticsRow struct {
+	Start            time.Time `json:"start"`
+	Tenant           string    `json:"tenant,omitempty"`
+	KeyID            string    `json:"key_id,omitempty"`
+	Model            string    `json:"model,omitempty"`
+	Endpoint         string    `json:"endpoint,omitempty"`
+	Requests         int64     `json:"requests"`
+	Errors           int64     `json:"errors"`
+	PromptTokens     int64     `json:"prompt_tokens"`
+	CompletionTokens int64     `json:"completion_tokens"`
+	TotalTokens      int64     `json:"total_tokens"`
+	// LatencyMS is the total latency of the requests; divide by Requests
+	// for the mean
+	LatencyMS int64 `json:"latency_ms"`
+}
+
+func (r *AnalyticsRow) add(o AnalyticsRow) {
+	r.Requests += o.Requests
+	r.Errors += o.Errors
+	r.PromptTokens += o.PromptTokens
+	r.CompletionTokens += o.CompletionTokens
+	r.TotalTokens += o.TotalTokens
+	r.LatencyMS += o.LatencyMS
+}
+
+// analyticsGroupFields are the fields rows can be grouped by
+var analyticsGroupFields = map[string]func(r *AnalyticsRow) *string{
+	"tenant":   func(r *AnalyticsRow) *string { return &r.Tenant },
+	"key":      func(r *AnalyticsRow) *string { return &r.KeyID },
+	"model":    func(r *AnalyticsRow) *string { return &r.Model },
+	"endpoint": func(r *AnalyticsRow) *string { return &r.Endpoint },
+}
+
+// analyticsTables is how the tables are saved
+type analyticsTables struct {
+	Hourly []AnalyticsRow `json:"hourly"`
+	Daily  []AnalyticsRow `json:"daily"`
+}
+
+// usageAnalytics keeps the rollup tables
+type usageAnalytics struct {
+	path            string
+	hourlyRetention time.Duration
+	dailyRetention  time.Duration
+	now             func() time.Time
+
+	mu      sync.Mutex
+	pending []UsageEvent
+	hourly  map[string]*AnalyticsRow
+	daily   map[string]*AnalyticsRow
+}
+
+// openUsageAnalytics loads the tables saved at path, if any
+func openUsageAnalytics(path string) (*usageAnalytics, error) {
+	a := &usageAnalytics{
+		path:            path,
+		hourlyRetention: 14 * 24 * time.Hour,
+		dailyRetention:  400 * 24 * time.Hour,
+		now:             time.Now,
+		hourly:          make(map[string]*AnalyticsRow),
+		daily:           make(map[string]*AnalyticsRow),
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return a, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read analytics file: %w", err)
+	}
+	var tables analyticsTables
+	if err := json.Unmarshal(data, &tables); err != nil {
+		return nil, fmt.Errorf("failed to parse analytics file: %w", err)
+	}
+	for _, row := range tables.Hourly {
+		a.merge(a.hourly, row)
+	}
+	for _, row := range tables.Daily {
+		a.merge(a.daily, row)
+	}
+	return a, nil
+}
+
+func (a *usageAnalytics) merge(table map[string]*AnalyticsRow, row AnalyticsRow) {
+	id := cacheKey([]any{row.Start, row.Tenant, row.KeyID, row.Model, row.Endpoint})
+	if existing, ok := table[id]; ok {
+		existing.add(row)
+		return
+	}
+	table[id] = &row
+}
+
+// Record queues an event for the next rollup
+func (a *usageAnalytics) Record(event UsageEvent) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.pending) < analyticsMaxPending {
+		a.pending = append(a.pending, event)
+	}
+}
+
+// Rollup folds the queued events into the tables, drops expired rows and
+// saves the tables. It is the body of the rollup job.
+func (a *usageAnalytics) Rollup(ctx context.Context) error {
+	a.mu.Lock()
+	changed := len(a.pending) > 0
+	for _, event := range a.pending {
+		row := AnalyticsRow{
+			Tenant: event.Tenant, KeyID: event.KeyID, Model: event.Model, Endpoint: event.Endpoint,
+			Requests:         1,
+			PromptTokens:     int64(event.PromptTokens),
+			CompletionTokens: int64(event.CompletionTokens),
+			TotalTokens:      int64(event.TotalTokens),
+			LatencyMS:        event.LatencyMS,
+		}
+		if event.Status >= 400 {
+			row.Errors = 1
+		}
+		t := event.Time.UTC()
+		row.Start = t.Truncate(time.Hour)
+		a.merge(a.hourly, row)
+		row.Start = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		a.merge(a.daily, row)
+	}
+	a.pending = nil
+	now := a.now()
+	for _, table := range []struct {
+		rows      map[string]*AnalyticsRow
+		retention time.Duration
+	}{{a.hourly, a.hourlyRetention}, {a.daily, a.dailyRetention}} {
+		for id, row := range table.rows {
+			if now.Sub(row.Start) > table.retention {
+				delete(table.rows, id)
+				changed = true
+			}
+		}
+	}
+	if !changed {
+		a.mu.Unlock()
+		return nil
+	}
+	tables := analyticsTables{Hourly: sortedRows(a.hourly), Daily: sortedRows(a.daily)}
+	a.mu.Unlock()
+
+	data, err := json.Marshal(tables)
+	if err != nil {
+		return err
+	}
+	// Write a new file and rename it over the old one, so a crash midway
+	// leaves the previous tables
+	tmp := a.path + ".tmp"
+	if err := os.MkdirAll(filepath.Dir(a.path), 0o755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, a.path)
+}
+
+func sortedRows(table map[string]*AnalyticsRow) []AnalyticsRow {
+	rows := make([]AnalyticsRow, 0, len(table))
+	for _, row := range table {
+		rows = append(rows, *row)
+	}
+	slices.SortFunc(rows, func(a, b AnalyticsRow) int {
+		if c := a.Start.Compare(b.Start); c != 0 {
+			return c
+		}
+		return strings.Compare(
+			strings.Join([]string{a.Tenant, a.KeyID, a.Model, a.Endpoint}, "\x00"),
+			strings.Join([]string{b.Tenant, b.KeyID, b.Model, b.Endpoint}, "\x00"))
+	})
+	return rows
+}
+
+// Query returns the rows of a table starting in [from, to), summed over
+// the fields not in groupBy
+func (a *usageAnalytics) Query(granularity string, from, to time.Time, groupBy []string) ([]AnalyticsRow, error) {
+	for _, field := range groupBy {
+		if analyticsGroupFields[field] == nil {
+			return nil, fmt.Errorf("unknown group_by field %q, expected tenant, key, model or endpoint", field)
+		}
+	}
+	a.mu.Lock()
+	var table map[string]*AnalyticsRow
+	switch granularity {
+	case AnalyticsHourly:
+		table = a.hourly
+	case AnalyticsDaily:
+		table = a.daily
+	default:
+		a.mu.Unlock()
+		return nil, fmt.Errorf("unknown granularity %q, expected hour or day", granularity)
+	}
+	rows := sortedRows(table)
+	a.mu.Unlock()
+
+	grouped := make(map[string]*AnalyticsRow)
+	for _, row := range rows {
+		if row.Start.Before(from) || !row.Start.Before(to) {
+			continue
+		}
+		out := AnalyticsRow{Start: row.Start}
+		for _, field := range groupBy {
+			*analyticsGroupFields[field](&out) = *analyticsGroupFields[field](&row)
+		}
+		out.add(row)
+		a.merge(grouped, out)
+	}
+	return sortedRows(grouped), nil
+}
+
+// handleAdminAnalytics serves GET /admin/analytics
+func (s *ProxyServer) handleAdminAnalytics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	granularity := query.Get("granularity")
+	if granularity == "" {
+		granularity = AnalyticsHourly
+	}
+	from, to := time.Time{}, time.Now().Add(time.Hour)
+	for name, t := range map[string]*time.Time{"from": &from, "to": &to} {
+		v := query.Get(name)
+		if v == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			parsed, err = time.Parse(time.DateOnly, v)
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid %s %q, expected an RFC 3339 time or a date", name, v), http.StatusBadRequest)
+			return
+		}
+		*t = parsed
+	}
+	var groupBy []string
+	if v := query.Get("group_by"); v != "" {
+		groupBy = strings.Split(v, ",")
+	}
+	rows, err := s.analytics.Query(granularity, from, to, groupBy)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"granularity": granularity, "rows": rows})
+}
+
+// analyticsFromEnv opens the tables at PROXY_ANALYTICS_FILE, by default
+// data/analytics.json; "off" disables analytics. WASI builds serve one
+// request per process, which never lives to run a rollup, so they have no
+// analytics.
+func analyticsFromEnv(getenv func(string) string) (*usageAnalytics, error) {
+	path := getenv("PROXY_ANALYTICS_FILE")
+	if path == "off" || runtime.GOOS == "wasip1" {
+		return nil, nil
+	}
+	if path == "" {
+		path = "data/analytics.json"
+	}
+	a, err := openUsageAnalytics(path)
+	if err != nil {
+		return nil, err
+	}
+	if v := getenv("PROXY_ANALYTICS_HOURLY_RETENTION"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid PROXY_ANALYTICS_HOURLY_RETENTION %q", v)
+		}
+		a.hourlyRetention = d
+	}
+	if v := getenv("PROXY_ANALYTICS_DAILY_RETENTION"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid PROXY_ANALYTICS_DAILY_RETENTION %q", v)
+		}
+		a.dailyRetention = d
+	}
+	return a, nil
+}
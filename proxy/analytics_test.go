@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUsageAnalytics_RollupAndQuery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "analytics.json")
+	a, err := openUsageAnalytics(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC)
+	a.now = func() time.Time { return day.Add(24 * time.Hour) }
+	for _, event := range []UsageEvent{
+		{Time: day.Add(9*time.Hour + 5*time.Minute), KeyID: "app", Tenant: "acme", Model: "gpt-4o", Endpoint: "chat", Status: 200, TotalTokens: 100, LatencyMS: 300},
+		{Time: day.Add(9*time.Hour + 50*time.Minute), KeyID: "app", Tenant: "acme", Model: "gpt-4o", Endpoint: "chat", Status: 502, LatencyMS: 100},
+		{Time: day.Add(10 * time.Hour), KeyID: "worker", Tenant: "acme", Model: "gpt-4o-mini", Endpoint: "chat", Status: 200, TotalTokens: 40},
+		// Past the hourly retention, kept in the daily table only
+		{Time: day.Add(-20 * 24 * time.Hour), KeyID: "app", Tenant: "acme", Model: "gpt-4o", Endpoint: "chat", Status: 200, TotalTokens: 7},
+	} {
+		a.Record(event)
+	}
+	if err := a.Rollup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	hourly, err := a.Query(AnalyticsHourly, time.Time{}, day.Add(24*time.Hour), []string{"key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hourly) != 2 || hourly[0].KeyID != "app" || hourly[0].Requests != 2 || hourly[0].Errors != 1 || hourly[0].LatencyMS != 400 || hourly[0].Model != "" {
+		t.Errorf("Unexpected hourly rows %+v", hourly)
+	}
+
+	// The tables are reloaded from the file
+	reopened, err := openUsageAnalytics(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	daily, err := reopened.Query(AnalyticsDaily, time.Time{}, day.Add(24*time.Hour), []string{"tenant"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(daily) != 2 || daily[1].Start != day || daily[1].Requests != 3 || daily[1].TotalTokens != 140 || daily[0].TotalTokens != 7 {
+		t.Errorf("Unexpected daily rows %+v", daily)
+	}
+
+	if _, err := a.Query(AnalyticsHourly, time.Time{}, day, []string{"region"}); err == nil {
+		t.Error("Expected an unknown group_by field to be rejected")
+	}
+}
+
+func TestProxyServer_AdminAnalytics(t *testing.T) {
+	server := NewProxyServer(&MockOpenAIClient{response: createTestChatCompletionResponse()})
+	server.analytics, _ = openUsageAnalytics(filepath.Join(t.TempDir(), "analytics.json"))
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/analytics", server.handleAdminAnalytics)
+
+	key := &ClientKey{ID: "app", Tenant: "acme"}
+	if w := chatRequestAs(server, key, `{"model": "gpt-4o", "messages": [{"role": "user", "content": "Hello"}]}`); w.Code != http.StatusOK {
+		t.Fatalf("Expected status code 200, got %d: %s", w.Code, w.Body.String())
+	}
+	server.analytics.Rollup(context.Background())
+
+	w := adminRequest(mux, "GET", "/admin/analytics?granularity=day&group_by=tenant,model", "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Rows []AnalyticsRow `json:"rows"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if len(resp.Rows) != 1 || resp.Rows[0].Tenant != "acme" || resp.Rows[0].KeyID != "" || resp.Rows[0].Requests != 1 {
+		t.Errorf("Unexpected rows %s", w.Body.String())
+	}
+
+	if w := adminRequest(mux, "GET", "/admin/analytics?granularity=week", "", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code 400, got %d", w.Code)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// anomalySignals are the per-key series checked for anomalies, sampled once
+// per detection interval. Spend is measured in tokens. minStdDev keeps a
+// perfectly steady baseline from turning every small wobble into an
+// anomaly, and minValue ignores spikes too small to matter.
+var anomalySignals = []struct {
+	name      string
+	minStdDev float64
+	minValue  float64
+	value     func(c anomalyCounts) (float64, bool)
+}{
+	{"requests", 2, 10, func(c anomalyCounts) (float64, bool) {
+		return float64(c.requests), true
+	}},
+	{"error_rate", 0.02, 0.1, func(c anomalyCounts) (float64, bool) {
+		// Too few requests make for a meaningless rate
+		if c.requests < 10 {
+			return 0, false
+		}
+		return float64(c.errors) / float64(c.requests), true
+	}},
+	{"tokens", 500, 5000, func(c anomalyCounts) (float64, bool) {
+		return float64(c.tokens), true
+	}},
+}
+
+type anomalyCounts struct {
+	requests, errors, tokens int64
+}
+
+// ewma is an exponentially weighted moving mean and variance
+type ewma struct {
+	mean, variance float64
+	samples        int
+}
+
+func (e *ewma) update(x, alpha float64) {
+	if e.samples == 0 {
+		e.mean = x
+	} else {
+		diff := x - e.mean
+		incr := alpha * diff
+		e.mean += incr
+		e.variance = (1 - alpha) * (e.variance + diff*incr)
+	}
+	e.samples++
+}
+
+// Anomaly is a signal of one key that is far above its usual level
+type Anomaly struct {
+	KeyID    string  `json:"key_id"`
+	Signal   string  `json:"signal"`
+	Value    float64 `json:"value"`
+	Baseline float64 `json:"baseline"`
+	ZScore   float64 `json:"z_score"`
+}
+
+// anomalyDetector flags keys whose request rate, error rate or token spend
+// jumps well above their own moving baseline. Only increases are flagged:
+// a key going quiet is not something to page anyone over.
+type anomalyDetector struct {
+	// alpha weighs each new sample into the baseline; threshold is the
+	// z-score above which a sample is anomalous; warmup is the number of
+	// samples a key needs before it can be flagged
+	alpha     float64
+	threshold float64
+	warmup    int
+
+	mu      sync.Mutex
+	current map[string]*anomalyCounts
+	series  map[string]map[string]*ewma
+	flagged map[string]Anomaly
+}
+
+func newAnomalyDetector(threshold float64) *anomalyDetector {
+	return &anomalyDetector{
+		alpha:     0.05,
+		threshold: threshold,
+		warmup:    30,
+		current:   make(map[string]*anomalyCounts),
+		series:    make(map[string]map[string]*ewma),
+		flagged:   make(map[string]Anomaly),
+	}
+}
+
+// Record counts event towards the current interval
+func (d *anomalyDetector) Record(event UsageEvent) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c, ok := d.current[event.KeyID]
+	if !ok {
+		c = &anomalyCounts{}
+		d.current[event.KeyID] = c
+	}
+	c.requests++
+	if event.Status >= 500 {
+		c.errors++
+	}
+	c.tokens += int64(event.TotalTokens)
+}
+
+// Sample closes the current interval, checks it against every key's
+// baseline and folds it in. It returns the anomalies found in the interval.
+func (d *anomalyDetector) Sample() []Anomaly {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	current := d.current
+	d.current = make(map[string]*anomalyCounts)
+	// Keys that were seen before but are idle now sample as zero
+	for key := range d.series {
+		if _, ok := current[key]; !ok {
+			current[key] = &anomalyCounts{}
+		}
+	}
+
+	d.flagged = make(map[string]Anomaly)
+	for key, counts := range current {
+		series, ok := d.series[key]
+		if !ok {
+			series = make(map[string]*ewma)
+			d.series[key] = series
+		}
+		idle := true
+		for _, signal := range anomalySignals {
+			x, ok := signal.value(*counts)
+			if !ok {
+				continue
+			}
+			e, ok := series[signal.name]
+			if !ok {
+				e = &ewma{}
+				series[signal.name] = e
+			}
+			if e.samples >= d.warmup && x >= signal.minValue {
+				stddev := max(math.Sqrt(e.variance), signal.minStdDev)
+				if z := (x - e.mean) / stddev; z >= d.threshold {
+					d.flagged[key+"/"+signal.name] = Anomaly{KeyID: key, Signal: signal.name, Value: x, Baseline: e.mean, ZScore: z}
+				}
+			}
+			e.update(x, d.alpha)
+			if e.mean >= 0.01 {
+				idle = false
+			}
+		}
+		// Forget keys whose traffic has decayed to nothing
+		if idle && counts.requests == 0 {
+			delete(d.series, key)
+		}
+	}
+	return d.sortedFlagged()
+}
+
+// sortedFlagged returns the anomalies of the last interval ordered by key
+// and signal. Callers must hold d.mu.
+func (d *anomalyDetector) sortedFlagged() []Anomaly {
+	anomalies := make([]Anomaly, 0, len(d.flagged))
+	for _, a := range d.flagged {
+		anomalies = append(anomalies, a)
+	}
+	sort.Slice(anomalies, func(i, j int) bool {
+		if anomalies[i].KeyID != anomalies[j].KeyID {
+			return anomalies[i].KeyID < anomalies[j].KeyID
+		}
+		return anomalies[i].Signal < anomalies[j].Signal
+	})
+	return anomalies
+}
+
+// detectAnomalies samples the detector and raises an alert per anomalous
+// key and signal, resolving those that are back to normal. Like SLOs it
+// runs on every replica over that replica's own traffic.
+func (s *ProxyServer) detectAnomalies(ctx context.Context) error {
+	previous := s.anomalies.flaggedNames()
+	for _, a := range s.anomalies.Sample() {
+		name := anomalyAlertName(a)
+		delete(previous, name)
+		s.alerts.Fire(ctx, Alert{
+			Name:     name,
+			Severity: "ticket",
+			Summary: fmt.Sprintf("Key %s: %s is %s against a baseline of %s (z-score %.1f)",
+				displayKeyID(a.KeyID), a.Signal, formatFloat(a.Value), formatFloat(math.Round(a.Baseline*100)/100), a.ZScore),
+			Labels: map[string]string{"key_id": a.KeyID, "signal": a.Signal},
+		})
+	}
+	for name := range previous {
+		s.alerts.Resolve(ctx, name)
+	}
+	return nil
+}
+
+// flaggedNames returns the alert names of the last interval's anomalies
+func (d *anomalyDetector) flaggedNames() map[string]bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	names := make(map[string]bool, len(d.flagged))
+	for _, a := range d.flagged {
+		names[anomalyAlertName(a)] = true
+	}
+	return names
+}
+
+func anomalyAlertName(a Anomaly) string {
+	return "anomaly:" + a.KeyID + ":" + a.Signal
+}
+
+// displayKeyID names the key of requests made without one when
+// authentication is disabled
+func displayKeyID(id string) string {
+	if id == "" {
+		return "(none)"
+	}
+	return id
+}
+
+// handleAdminAnomalies lists the anomalies found in the last interval
+func (s *ProxyServer) handleAdminAnomalies(w http.ResponseWriter, r *http.Request) {
+	handleAdminList("anomalies", func() []Anomaly {
+		s.anomalies.mu.Lock()
+		defer s.anomalies.mu.Unlock()
+		return s.anomalies.sortedFlagged()
+	})(w, r)
+}
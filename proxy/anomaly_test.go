@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http/httptest"
+	"testing"
+)
+
+// recordMinute feeds one interval of traffic for key into d
+func recordMinute(d *anomalyDetector, key string, requests, errors, tokens int) {
+	for i := 0; i < requests; i++ {
+		event := UsageEvent{KeyID: key, Status: 200, TotalTokens: tokens / requests}
+		if i < errors {
+			event.Status = 500
+		}
+		d.Record(event)
+	}
+}
+
+func TestEWMA(t *testing.T) {
+	var e ewma
+	for i := 0; i < 1000; i++ {
+		e.update(float64(10+2*(i%2)), 0.05)
+	}
+	if math.Abs(e.mean-11) > 0.1 || math.Abs(math.Sqrt(e.variance)-1) > 0.1 {
+		t.Errorf("Expected mean 11 and stddev 1, got %v and %v", e.mean, math.Sqrt(e.variance))
+	}
+}
+
+func TestAnomalyDetector_FlagsSpikes(t *testing.T) {
+	d := newAnomalyDetector(4)
+	for i := 0; i < 60; i++ {
+		recordMinute(d, "cron", 20+i%3, 0, 2000)
+		if anomalies := d.Sample(); len(anomalies) != 0 {
+			t.Fatalf("Minute %d: expected no anomalies for steady traffic, got %+v", i, anomalies)
+		}
+	}
+
+	recordMinute(d, "cron", 400, 0, 40000)
+	anomalies := d.Sample()
+	if len(anomalies) != 2 || anomalies[0].Signal != "requests" || anomalies[1].Signal != "tokens" {
+		t.Fatalf("Expected request and token anomalies, got %+v", anomalies)
+	}
+	if anomalies[0].Value != 400 || math.Abs(anomalies[0].Baseline-21) > 1 {
+		t.Errorf("Unexpected anomaly %+v", anomalies[0])
+	}
+
+	recordMinute(d, "cron", 20, 15, 2000)
+	if anomalies := d.Sample(); len(anomalies) != 1 || anomalies[0].Signal != "error_rate" {
+		t.Errorf("Expected an error rate anomaly, got %+v", anomalies)
+	}
+}
+
+func TestAnomalyDetector_Warmup(t *testing.T) {
+	d := newAnomalyDetector(4)
+	recordMinute(d, "new", 10, 0, 100)
+	d.Sample()
+	recordMinute(d, "new", 1000, 0, 10000)
+	if anomalies := d.Sample(); len(anomalies) != 0 {
+		t.Errorf("Expected new keys not to be flagged before warming up, got %+v", anomalies)
+	}
+}
+
+func TestAnomalyDetector_ForgetsIdleKeys(t *testing.T) {
+	d := newAnomalyDetector(4)
+	recordMinute(d, "gone", 1, 0, 10)
+	for i := 0; i < 200 && len(d.series) > 0; i++ {
+		d.Sample()
+	}
+	if len(d.series) != 0 {
+		t.Errorf("Expected idle keys to be forgotten, got %d", len(d.series))
+	}
+}
+
+func TestProxyServer_DetectAnomalies(t *testing.T) {
+	server := NewProxyServer(&MockOpenAIClient{})
+	ctx := context.Background()
+	for i := 0; i < 40; i++ {
+		recordMinute(server.anomalies, "k", 20, 0, 2000)
+		server.detectAnomalies(ctx)
+	}
+
+	recordMinute(server.anomalies, "k", 400, 0, 2000)
+	server.detectAnomalies(ctx)
+	active := server.alerts.Active()
+	if len(active) != 1 || active[0].Name != "anomaly:k:requests" || active[0].Labels["key_id"] != "k" {
+		t.Fatalf("Expected a request rate alert for k, got %+v", active)
+	}
+
+	w := httptest.NewRecorder()
+	server.handleAdminAnomalies(w, httptest.NewRequest("GET", "/admin/anomalies", nil))
+	var resp struct {
+		Anomalies []Anomaly `json:"anomalies"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if len(resp.Anomalies) != 1 || resp.Anomalies[0].Signal != "requests" {
+		t.Errorf("Unexpected anomalies %s", w.Body.String())
+	}
+
+	recordMinute(server.anomalies, "k", 20, 0, 2000)
+	server.detectAnomalies(ctx)
+	if active := server.alerts.Active(); len(active) != 0 {
+		t.Errorf("Expected the alert to resolve, got %+v", active)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// piiPatterns find personal data and secrets in free text, each replaced by
+// a placeholder naming what was removed. Order matters: secrets and cards
+// are matched before the looser phone pattern could claim their digits.
+var piiPatterns = []struct {
+	// name is the detector name content filters use
+	name        string
+	placeholder string
+	re          *regexp.Regexp
+	// valid, if set, filters matches that only look like the real thing
+	valid func(match string) bool
+}{
+	{"secret", "[SECRET]", regexp.MustCompile(`\b(?:sk|pk|rk)-[A-Za-z0-9_-]{16,}\b|\bxox[abpr]-[A-Za-z0-9-]{10,}\b|\bAKIA[0-9A-Z]{16}\b|\bgh[pousr]_[A-Za-z0-9]{30,}\b`), nil},
+	{"email", "[EMAIL]", regexp.MustCompile(`(?i)\b[a-z0-9._%+-]+@[a-z0-9.-]+\.[a-z]{2,}\b`), nil},
+	{"card", "[CARD]", regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`), luhnValid},
+	{"iban", "[IBAN]", regexp.MustCompile(`\b[A-Z]{2}\d{2}(?: ?[A-Z0-9]{4}){3,7}(?: ?[A-Z0-9]{1,3})?\b`), nil},
+	{"ip", "[IP]", regexp.MustCompile(`\b(?:(?:25[0-5]|2[0-4]\d|1?\d?\d)\.){3}(?:25[0-5]|2[0-4]\d|1?\d?\d)\b`), nil},
+	{"phone", "[PHONE]", regexp.MustCompile(`(?:\+\d{1,3}[ .-]?)?(?:\(\d{2,4}\)[ .-]?\d{3,4}[ .-]\d{3,4}|\b\d{3}[ .-]\d{3,4}[ .-]\d{4})\b`), nil},
+}
+
+// redactPII replaces emails, phone numbers, card numbers, IBANs, IP
+// addresses and API keys in text with placeholders. It is a best-effort
+// pattern match: names, addresses and anything unusual slip through.
+func redactPII(text string) string {
+	for _, p := range piiPatterns {
+		text = p.re.ReplaceAllStringFunc(text, func(match string) string {
+			if p.valid != nil && !p.valid(match) {
+				return match
+			}
+			return p.placeholder
+		})
+	}
+	return text
+}
+
+// luhnValid reports whether the digits in s pass the Luhn checksum used by
+// payment cards
+func luhnValid(s string) bool {
+	digits := strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, s)
+	sum := 0
+	for i := range digits {
+		d := int(digits[len(digits)-1-i] - '0')
+		if i%2 == 1 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return len(digits) >= 13 && sum%10 == 0
+}
+
+// redactMessages returns a copy of messages with PII redacted from their
+// content
+func redactMessages(messages []Message) []Message {
+	redacted := make([]Message, len(messages))
+	for i, m := range messages {
+		redacted[i] = m.mapText(redactPII)
+	}
+	return redacted
+}
+
+// anonymizer is the anonymization pass chosen for one export
+type anonymizer struct {
+	// salt keys the hash that replaces identifiers; nil keeps them as they
+	// are
+	salt []byte
+	// redact strips PII from message content
+	redact bool
+}
+
+// newAnonymizer parses a comma-separated list of what to anonymize: "ids"
+// to hash identifiers, "pii" to redact message content, or "all". The same
+// salt gives the same pseudonyms across exports; without one a random salt
+// is drawn, so the export is consistent in itself but cannot be joined with
+// others.
+func newAnonymizer(options, salt string) (*anonymizer, error) {
+	a := &anonymizer{}
+	hashIDs := false
+	for _, option := range strings.Split(options, ",") {
+		switch strings.TrimSpace(option) {
+		case "":
+		case "ids":
+			hashIDs = true
+		case "pii":
+			a.redact = true
+		case "all":
+			hashIDs, a.redact = true, true
+		default:
+			return nil, fmt.Errorf("unknown anonymization %q, expected ids, pii or all", option)
+		}
+	}
+	if hashIDs {
+		if salt != "" {
+			a.salt = []byte(salt)
+		} else {
+			a.salt = make([]byte, 32)
+			rand.Read(a.salt)
+		}
+	}
+	return a, nil
+}
+
+// ID returns a pseudonym for an identifier such as a key ID or tenant. The
+// hash is keyed, so short identifiers like chat IDs cannot be recovered by
+// hashing every candidate.
+func (a *anonymizer) ID(id string) string {
+	if a.salt == nil || id == "" {
+		return id
+	}
+	mac := hmac.New(sha256.New, a.salt)
+	mac.Write([]byte(id))
+	return "anon-" + hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// SessionID hashes a session ID such as "telegram:42" but keeps the bridge
+// it came from, which identifies no one
+func (a *anonymizer) SessionID(id string) string {
+	if a.salt == nil {
+		return id
+	}
+	if bridge, rest, ok := strings.Cut(id, ":"); ok {
+		return bridge + ":" + a.ID(rest)
+	}
+	return a.ID(id)
+}
+
+// Session returns an anonymized copy of a session
+func (a *anonymizer) Session(session Session) Session {
+	session.ID = a.SessionID(session.ID)
+	if a.redact {
+		session.Messages = redactMessages(session.Messages)
+	}
+	return session
+}
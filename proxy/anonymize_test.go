@@ -0,0 +1,73 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedactPII(t *testing.T) {
+	cases := map[string]string{
+		"Mail me at jane.doe+work@example.co.uk please": "Mail me at [EMAIL] please",
+		"Call +1 415-555-0132 or (020) 7946 0958":       "Call [PHONE] or [PHONE]",
+		"Card 4111 1111 1111 1111 expires soon":         "Card [CARD] expires soon",
+		"Order 1234 5678 9012 3456 shipped":             "Order 1234 5678 9012 3456 shipped",
+		"Key sk-abcdefghijklmnopqrstuv leaked":          "Key [SECRET] leaked",
+		"Server at 10.0.12.7 is down":                   "Server at [IP] is down",
+		"Pay to DE89 3704 0044 0532 0130 00":            "Pay to [IBAN]",
+		"The answer is 42, released in 2024":            "The answer is 42, released in 2024",
+	}
+	for in, want := range cases {
+		if got := redactPII(in); got != want {
+			t.Errorf("redactPII(%q): expected %q, got %q", in, want, got)
+		}
+	}
+}
+
+func TestRedactMessages(t *testing.T) {
+	messages := []Message{{Role: "user", Content: "I'm bob@example.com"}}
+	redacted := redactMessages(messages)
+	if redacted[0].Content != "I'm [EMAIL]" || redacted[0].Role != "user" {
+		t.Errorf("Unexpected redacted message %+v", redacted[0])
+	}
+	if messages[0].Content != "I'm bob@example.com" {
+		t.Error("Expected the original messages to be left alone")
+	}
+}
+
+func TestAnonymizer(t *testing.T) {
+	a, err := newAnonymizer("ids", "secret")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	b, _ := newAnonymizer("ids", "secret")
+	if a.ID("key-1") != b.ID("key-1") || a.ID("key-1") == a.ID("key-2") {
+		t.Error("Expected the same salt to give the same, distinct pseudonyms")
+	}
+	if !strings.HasPrefix(a.ID("key-1"), "anon-") || strings.Contains(a.ID("key-1"), "key-1") {
+		t.Errorf("Unexpected pseudonym %q", a.ID("key-1"))
+	}
+	if id := a.SessionID("telegram:42"); !strings.HasPrefix(id, "telegram:anon-") {
+		t.Errorf("Expected the bridge to be kept, got %q", id)
+	}
+	if other, _ := newAnonymizer("ids", ""); other.ID("key-1") == a.ID("key-1") {
+		t.Error("Expected a random salt without one configured")
+	}
+
+	session := a.Session(Session{ID: "slack:C1", Messages: []Message{{Role: "user", Content: "ann@example.com"}}})
+	if session.Messages[0].Content != "ann@example.com" {
+		t.Error("Expected content to be kept without pii")
+	}
+	none, _ := newAnonymizer("", "")
+	if none.ID("key-1") != "key-1" || none.SessionID("slack:C1") != "slack:C1" {
+		t.Error("Expected identifiers to be kept without ids")
+	}
+
+	all, _ := newAnonymizer("all", "secret")
+	session = all.Session(Session{ID: "slack:C1", Messages: []Message{{Role: "user", Content: "ann@example.com"}}})
+	if session.Messages[0].Content != "[EMAIL]" || session.ID == "slack:C1" {
+		t.Errorf("Expected everything anonymized, got %+v", session)
+	}
+	if _, err := newAnonymizer("names", ""); err == nil {
+		t.Error("Expected an error for an unknown option")
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// Providers attribute abuse to the user field of requests. The proxy can
+// fill it in with a keyed hash of the client key or tenant, so a provider
+// flagging one of them does not get the whole upstream account suspended,
+// and learns nothing about the proxy's keys and tenants. A user the client
+// set, e.g. its own end user, is hashed together with the key or tenant, so
+// end users stay apart but cannot pose as another key.
+
+// User attribution modes, chosen with PROXY_USER_ATTRIBUTION
+const (
+	AttributionOff    = "off"
+	AttributionKey    = "key"
+	AttributionTenant = "tenant"
+)
+
+// userAttribution computes the user field of requests
+type userAttribution struct {
+	mode string
+	salt []byte
+}
+
+// User returns the user field to send for a request of key in which the
+// client set user, or "" to leave it alone
+func (a *userAttribution) User(key *ClientKey, user string) string {
+	if a == nil || key == nil {
+		return ""
+	}
+	id := key.ID
+	if a.mode == AttributionTenant && key.Tenant != "" {
+		id = "tenant:" + key.Tenant
+	}
+	mac := hmac.New(sha256.New, a.salt)
+	mac.Write([]byte(id))
+	if user != "" {
+		mac.Write([]byte{0})
+		mac.Write([]byte(user))
+	}
+	return "user-" + hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// userAttributionFromEnv reads PROXY_USER_ATTRIBUTION, off by default, and
+// the secret PROXY_USER_ATTRIBUTION_SALT keying the hashes, which must stay
+// the same across restarts and replicas for attribution to be useful
+func userAttributionFromEnv(getenv func(string) string) (*userAttribution, error) {
+	mode := getenv("PROXY_USER_ATTRIBUTION")
+	switch mode {
+	case "", AttributionOff:
+		return nil, nil
+	case AttributionKey, AttributionTenant:
+	default:
+		return nil, fmt.Errorf("invalid PROXY_USER_ATTRIBUTION %q, expected off, key or tenant", mode)
+	}
+	salt := getenv("PROXY_USER_ATTRIBUTION_SALT")
+	if salt == "" {
+		return nil, fmt.Errorf("PROXY_USER_ATTRIBUTION_SALT is required with PROXY_USER_ATTRIBUTION")
+	}
+	return &userAttribution{mode: mode, salt: []byte(salt)}, nil
+}
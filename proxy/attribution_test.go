@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestUserAttribution_User(t *testing.T) {
+	byKey := &userAttribution{mode: AttributionKey, salt: []byte("secret")}
+	byTenant := &userAttribution{mode: AttributionTenant, salt: []byte("secret")}
+	web := &ClientKey{ID: "acme-web", Tenant: "acme"}
+	batch := &ClientKey{ID: "acme-batch", Tenant: "acme"}
+
+	if byKey.User(web, "") == byKey.User(batch, "") {
+		t.Error("Expected keys to be told apart")
+	}
+	if byTenant.User(web, "") != byTenant.User(batch, "") {
+		t.Error("Expected keys of a tenant to share a user")
+	}
+	if byKey.User(web, "alice") == byKey.User(web, "bob") || byKey.User(web, "alice") == byKey.User(batch, "alice") {
+		t.Error("Expected end users to be told apart per key")
+	}
+	if user := byKey.User(web, ""); strings.Contains(user, "acme") || user != byKey.User(web, "") {
+		t.Errorf("Expected a stable pseudonym, got %s", user)
+	}
+	if (&userAttribution{mode: AttributionKey, salt: []byte("other")}).User(web, "") == byKey.User(web, "") {
+		t.Error("Expected the salt to key the hash")
+	}
+	var off *userAttribution
+	if off.User(web, "alice") != "" || byKey.User(nil, "alice") != "" {
+		t.Error("Expected no user without attribution or a key")
+	}
+}
+
+func TestUserAttributionFromEnv(t *testing.T) {
+	env := map[string]string{"PROXY_USER_ATTRIBUTION": "tenant"}
+	getenv := func(name string) string { return env[name] }
+	if _, err := userAttributionFromEnv(getenv); err == nil {
+		t.Error("Expected an error without a salt")
+	}
+	env["PROXY_USER_ATTRIBUTION_SALT"] = "secret"
+	if a, err := userAttributionFromEnv(getenv); err != nil || a.mode != AttributionTenant {
+		t.Errorf("Expected tenant attribution, got %+v, %v", a, err)
+	}
+	env["PROXY_USER_ATTRIBUTION"] = "ip"
+	if _, err := userAttributionFromEnv(getenv); err == nil {
+		t.Error("Expected an error for an unknown mode")
+	}
+}
+
+func TestProxyServer_AttributesUser(t *testing.T) {
+	raw := &rawMockOpenAIClient{MockOpenAIClient: MockOpenAIClient{response: createTestChatCompletionResponse()}}
+	decoded := &requestRecorder{OpenAIClient: &MockOpenAIClient{response: createTestChatCompletionResponse()}}
+	sent := map[string]func() string{
+		"raw": func() string {
+			var req ChatCompletionRequest
+			json.Unmarshal(raw.lastRaw, &req)
+			return req.User
+		},
+		"decoded": func() string { return decoded.last.User },
+	}
+	for name, client := range map[string]OpenAIClient{"raw": raw, "decoded": decoded} {
+		server := NewProxyServer(client)
+		server.keys = createTestKeyStore(t)
+		server.attribution = &userAttribution{mode: AttributionKey, salt: []byte("secret")}
+
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "gpt-4o", "messages": [{"role": "user", "content": "Hi"}], "user": "alice"}`))
+		req.Header.Set("Authorization", "Bearer sk-full")
+		server.withAuth(server.handleChatCompletions)(httptest.NewRecorder(), req)
+
+		if want, got := server.attribution.User(&ClientKey{ID: "full"}, "alice"), sent[name](); got != want {
+			t.Errorf("%s: expected user %s, got %q", name, want, got)
+		}
+	}
+}
+
+// requestRecorder remembers the last decoded request it forwards
+type requestRecorder struct {
+	OpenAIClient
+	last ChatCompletionRequest
+}
+
+func (r *requestRecorder) CreateChatCompletion(req ChatCompletionRequest) (*ChatCompletionResponse, error) {
+	r.last = req
+	return r.OpenAIClient.CreateChatCompletion(req)
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Compliance may require a record of everything sent to the model. With
+// PROXY_AUDIT_DIR set, every request that reaches a model and the reply it
+// got are appended to an audit log, along with who sent it, the model, the
+// latency and the tokens used. Like analytics, the log is kept in files
+// rather than a SQLite database, since the proxy builds without cgo: one
+// JSON record per line, in files started every day or once they reach
+// PROXY_AUDIT_MAX_FILE_SIZE and deleted after PROXY_AUDIT_RETENTION, if set.
+// GET /admin/audit searches them.
+
+const (
+	// maxAuditBody bounds the request or reply kept in a record; larger
+	// ones are cut and kept as a string
+	maxAuditBody = 4 << 20
+	// auditFileLayout names audit files by the time they were started, so
+	// they sort in order
+	auditFileLayout = "20060102T150405.000000000Z"
+	// maxAuditQuery bounds the records returned by one query
+	maxAuditQuery = 1000
+)
+
+// AuditRecord is one request and its reply
+type AuditRecord struct {
+	Time       time.Time `json:"time"`
+	RequestID  string    `json:"request_id,omitempty"`
+	KeyID      string    `json:"key_id,omitempty"`
+	Tenant     string    `json:"tenant,omitempty"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Model      string    `json:"model,omitempty"`
+	Status     int       `json:"status"`
+	LatencyMS  int64     `json:"latency_ms"`
+	Usage      Usage     `json:"usage"`
+	// Request and Response are the bodies, as JSON if they are, else as a
+	// string, such as the events of a streamed reply
+	Request  json.RawMessage `json:"request,omitempty"`
+	Response json.RawMessage `json:"response,omitempty"`
+	// Truncated is set if a body was larger than the log keeps
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// auditLog appends records to the files of a directory
+type auditLog struct {
+	dir     string
+	maxSize int64
+	// retention, if set, is how long files are kept after their last record
+	retention time.Duration
+	now       func() time.Time
+
+	mu      sync.Mutex
+	cur     *os.File
+	curSize int64
+	curDay  string
+}
+
+// auditLogFromEnv opens the audit log in PROXY_AUDIT_DIR, or returns nil if
+// it is not set. WASI builds have no audit log, as they cannot keep files.
+func auditLogFromEnv(getenv func(string) string) (*auditLog, error) {
+	dir := getenv("PROXY_AUDIT_DIR")
+	if dir == "" || runtime.GOOS == "wasip1" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("invalid PROXY_AUDIT_DIR %q: %v", dir, err)
+	}
+	a := &auditLog{dir: dir, maxSize: 100 << 20, now: time.Now}
+	if v := getenv("PROXY_AUDIT_MAX_FILE_SIZE"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid PROXY_AUDIT_MAX_FILE_SIZE %q", v)
+		}
+		a.maxSize = n
+	}
+	if v := getenv("PROXY_AUDIT_RETENTION"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid PROXY_AUDIT_RETENTION %q", v)
+		}
+		a.retention = d
+	}
+	return a, nil
+}
+
+// Write appends a record, starting a new file if the current one is full or
+// from an earlier day
+func (a *auditLog) Write(rec AuditRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := a.now().UTC()
+	if a.cur == nil || a.curSize+int64(len(line)) > a.maxSize || now.Format(time.DateOnly) != a.curDay {
+		if err := a.rotate(now); err != nil {
+			return err
+		}
+	}
+	n, err := a.cur.Write(line)
+	a.curSize += int64(n)
+	return err
+}
+
+// rotate starts a new file and deletes those past retention
+func (a *auditLog) rotate(now time.Time) error {
+	if a.cur != nil {
+		a.cur.Close()
+		a.cur = nil
+	}
+	name := filepath.Join(a.dir, "audit-"+now.Format(auditFileLayout)+".jsonl")
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	a.cur, a.curSize, a.curDay = f, 0, now.Format(time.DateOnly)
+	a.prune(now)
+	return nil
+}
+
+// prune deletes the files past retention and returns how many there were
+// and their size. Callers must hold a.mu.
+func (a *auditLog) prune(now time.Time) (int, int64) {
+	if a.retention <= 0 {
+		return 0, 0
+	}
+	var pruned int
+	var size int64
+	// A file's last record is older than the start of the next file
+	files, _ := a.files()
+	for i := 0; i+1 < len(files); i++ {
+		if files[i+1].start.Before(now.Add(-a.retention)) {
+			info, err := os.Stat(files[i].path)
+			if err == nil && os.Remove(files[i].path) == nil {
+				pruned++
+				size += info.Size()
+			}
+		}
+	}
+	return pruned, size
+}
+
+// Prune deletes the files past retention, which are otherwise only deleted
+// when a new file is started
+func (a *auditLog) Prune() (int, int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.prune(a.now().UTC())
+}
+
+// Close closes the current file
+func (a *auditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.cur == nil {
+		return nil
+	}
+	err := a.cur.Close()
+	a.cur = nil
+	return err
+}
+
+type auditFile struct {
+	path  string
+	start time.Time
+}
+
+// files returns the files of the log, oldest first
+func (a *auditLog) files() ([]auditFile, error) {
+	entries, err := os.ReadDir(a.dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []auditFile
+	for _, entry := range entries {
+		stamp, ok := strings.CutPrefix(entry.Name(), "audit-")
+		if !ok {
+			continue
+		}
+		start, err := time.Parse(auditFileLayout, strings.TrimSuffix(stamp, ".jsonl"))
+		if err != nil {
+			continue
+		}
+		files = append(files, auditFile{path: filepath.Join(a.dir, entry.Name()), start: start})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].start.Before(files[j].start) })
+	return files, nil
+}
+
+// AuditQuery selects audit records; empty fields match every record
+type AuditQuery struct {
+	From, To  time.Time
+	KeyID     string
+	Tenant    string
+	Model     string
+	RequestID string
+	Limit     int
+}
+
+func (q AuditQuery) matches(rec AuditRecord) bool {
+	return !rec.Time.Before(q.From) && (q.To.IsZero() || rec.Time.Before(q.To)) &&
+		(q.KeyID == "" || rec.KeyID == q.KeyID) &&
+		(q.Tenant == "" || rec.Tenant == q.Tenant) &&
+		(q.Model == "" || rec.Model == q.Model) &&
+		(q.RequestID == "" || rec.RequestID == q.RequestID)
+}
+
+// Query returns the first records matching q, oldest first, skipping the
+// files that end before q.From or start after q.To
+func (a *auditLog) Query(q AuditQuery) ([]AuditRecord, error) {
+	files, err := a.files()
+	if err != nil {
+		return nil, err
+	}
+	records := []AuditRecord{}
+	for i, file := range files {
+		if i+1 < len(files) && files[i+1].start.Before(q.From) {
+			continue
+		}
+		if !q.To.IsZero() && !file.start.Before(q.To) {
+			break
+		}
+		f, err := os.Open(file.path)
+		if err != nil {
+			return nil, err
+		}
+		r := bufio.NewReader(f)
+		for len(records) < q.Limit {
+			line, err := r.ReadBytes('\n')
+			var rec AuditRecord
+			if len(line) > 0 && json.Unmarshal(line, &rec) == nil && q.matches(rec) {
+				records = append(records, rec)
+			}
+			if err != nil {
+				break
+			}
+		}
+		f.Close()
+		if len(records) >= q.Limit {
+			break
+		}
+	}
+	return records, nil
+}
+
+// handleAdminAudit returns the audit records matching ?from=, ?to=, ?key=,
+// ?tenant=, ?model= and ?request_id=, at most ?limit= of them (100 by
+// default). ?from= and ?to= are RFC 3339 times or dates.
+func (s *ProxyServer) handleAdminAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.audit == nil {
+		http.Error(w, "The audit log is not enabled", http.StatusNotFound)
+		return
+	}
+	query := r.URL.Query()
+	q := AuditQuery{KeyID: query.Get("key"), Tenant: query.Get("tenant"), Model: query.Get("model"), RequestID: query.Get("request_id"), Limit: 100}
+	for name, t := range map[string]*time.Time{"from": &q.From, "to": &q.To} {
+		v := query.Get(name)
+		if v == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			parsed, err = time.Parse(time.DateOnly, v)
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid %s %q, expected an RFC 3339 time or a date", name, v), http.StatusBadRequest)
+			return
+		}
+		*t = parsed
+	}
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxAuditQuery {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxAuditQuery), http.StatusBadRequest)
+			return
+		}
+		q.Limit = n
+	}
+	records, err := s.audit.Query(q)
+	if err != nil {
+		http.Error(w, "Failed to read the audit log", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"records": records})
+}
+
+// withAudit records requests and their replies in the audit log and the
+// mirror, if there are, and passes them to the live feed while anyone
+// watches it. It runs after withAuth, so records name the key of the
+// request.
+func (s *ProxyServer) withAudit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.audit == nil && s.mirror == nil && !s.tail.Active() {
+			next(w, r)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		rec := AuditRecord{
+			Time:       time.Now().UTC(),
+			RequestID:  timelineFromContext(r.Context()).id(),
+			RemoteAddr: r.RemoteAddr,
+			Method:     r.Method,
+			Path:       r.URL.Path,
+		}
+		if key := clientKeyFromContext(r.Context()); key != nil {
+			rec.KeyID, rec.Tenant = key.ID, key.Tenant
+		}
+		scanObject(body, func(key []byte, start, end int) bool {
+			if string(key) != "model" {
+				return true
+			}
+			rec.Model, _ = jsonStringValue(body[start:end])
+			return false
+		})
+
+		counter := &usageCounter{ResponseWriter: w}
+		recorder := &auditRecorder{ResponseWriter: counter}
+		next(recorder, r)
+
+		rec.LatencyMS = time.Since(rec.Time).Milliseconds()
+		rec.Status = recorder.status
+		if rec.Status == 0 {
+			rec.Status = http.StatusOK
+		}
+		rec.Usage = counter.usage
+		rec.Request, rec.Truncated = auditBody(body, len(body) > maxAuditBody)
+		var truncated bool
+		rec.Response, truncated = auditBody(recorder.body.Bytes(), recorder.truncated)
+		rec.Truncated = rec.Truncated || truncated
+		if s.audit != nil {
+			if err := s.audit.Write(rec); err != nil {
+				log.Printf("Failed to write audit record: %v", err)
+			}
+		}
+		s.tail.Publish(tailEventFrom(rec))
+		if s.mirror != nil && s.mirror.Matches(rec) {
+			if err := s.mirror.Write(rec); err != nil {
+				log.Printf("Failed to mirror request: %v", err)
+			}
+		}
+	}
+}
+
+// auditBody returns body as it is kept in a record: as is if it is JSON,
+// else as a string, cut to maxAuditBody
+func auditBody(body []byte, truncated bool) (json.RawMessage, bool) {
+	if len(body) == 0 {
+		return nil, truncated
+	}
+	if len(body) > maxAuditBody {
+		body, truncated = body[:maxAuditBody], true
+	}
+	if !truncated && json.Valid(body) {
+		return json.RawMessage(bytes.TrimSpace(body)), false
+	}
+	quoted, _ := json.Marshal(string(body))
+	return quoted, truncated
+}
+
+// auditRecorder keeps a copy of a reply for the audit log
+type auditRecorder struct {
+	http.ResponseWriter
+	status    int
+	body      bytes.Buffer
+	truncated bool
+}
+
+func (a *auditRecorder) WriteHeader(status int) {
+	if a.status == 0 {
+		a.status = status
+	}
+	a.ResponseWriter.WriteHeader(status)
+}
+
+func (a *auditRecorder) Write(p []byte) (int, error) {
+	if a.status == 0 {
+		a.status = http.StatusOK
+	}
+	if room := maxAuditBody - a.body.Len(); len(p) <= room {
+		a.body.Write(p)
+	} else {
+		a.body.Write(p[:max(room, 0)])
+		a.truncated = true
+	}
+	return a.ResponseWriter.Write(p)
+}
+
+func (a *auditRecorder) Unwrap() http.ResponseWriter {
+	return a.ResponseWriter
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestAuditLog(t *testing.T) *auditLog {
+	a, err := auditLogFromEnv(func(name string) string {
+		if name == "PROXY_AUDIT_DIR" {
+			return t.TempDir()
+		}
+		return ""
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { a.Close() })
+	return a
+}
+
+func TestProxyServer_Audit(t *testing.T) {
+	server := NewProxyServer(&MockOpenAIClient{response: createTestChatCompletionResponse()})
+	server.keys = createTestKeyStore(t)
+	server.submissions = nil
+	server.audit = newTestAuditLog(t)
+	handler := server.Handler()
+	do := func(method, path, secret, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+secret)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do("POST", "/v1/chat/completions", "sk-full", `{"model": "gpt-4o", "messages": [{"role": "user", "content": "Hi"}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the request to succeed, got %d", w.Code)
+	}
+	do("POST", "/v1/chat/completions", "sk-mini", `{"model": "gpt-4o", "messages": [{"role": "user", "content": "Hi"}]}`)
+	// Requests refused before reaching a model are not audited
+	do("POST", "/v1/chat/completions", "sk-nobody", `{"model": "gpt-4o", "messages": [{"role": "user", "content": "Hi"}]}`)
+
+	query := func(params string) []AuditRecord {
+		t.Helper()
+		w := do("GET", "/admin/audit?"+params, "sk-admin-ro", "")
+		var result struct {
+			Records []AuditRecord `json:"records"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("Expected audit records, got %d %s", w.Code, w.Body.String())
+		}
+		return result.Records
+	}
+	records := query("")
+	if len(records) != 2 {
+		t.Fatalf("Expected two audited requests, got %+v", records)
+	}
+	rec := records[0]
+	if rec.KeyID != "full" || rec.Model != "gpt-4o" || rec.Status != http.StatusOK || rec.Usage.TotalTokens != 32 || rec.RequestID != w.Header().Get(requestIDHeader) {
+		t.Errorf("Unexpected record %+v", rec)
+	}
+	if !strings.Contains(string(rec.Request), `"content":"Hi"`) || !strings.Contains(string(rec.Response), `"total_tokens":32`) {
+		t.Errorf("Expected the bodies to be kept, got %s and %s", rec.Request, rec.Response)
+	}
+	if records := query("key=mini-only"); len(records) != 1 || records[0].Status != http.StatusForbidden {
+		t.Errorf("Expected the refused request of the mini key, got %+v", records)
+	}
+	if records := query("from=" + time.Now().Add(time.Hour).Format(time.RFC3339)); len(records) != 0 {
+		t.Errorf("Expected no records from the future, got %d", len(records))
+	}
+	if records := query("limit=1"); len(records) != 1 || records[0].KeyID != "full" {
+		t.Errorf("Expected the oldest record, got %+v", records)
+	}
+	if w := do("GET", "/admin/audit?from=yesterday", "sk-admin-ro", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an invalid time to be rejected, got %d", w.Code)
+	}
+}
+
+func TestAuditLog_Rotation(t *testing.T) {
+	a := newTestAuditLog(t)
+	a.maxSize = 300
+	a.retention = 48 * time.Hour
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	a.now = func() time.Time { return now }
+
+	write := func(model string) {
+		t.Helper()
+		if err := a.Write(AuditRecord{Time: now, Model: model, Path: "/v1/chat/completions"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("a")
+	write("b")
+	// Full, so the next record starts a file
+	now = now.Add(time.Minute)
+	write("c")
+	write("d")
+	// A new day starts a file too
+	now = now.Add(24 * time.Hour)
+	write("e")
+	files, _ := a.files()
+	if len(files) != 3 {
+		t.Fatalf("Expected three files, got %d", len(files))
+	}
+
+	records, _ := a.Query(AuditQuery{From: now.Add(-time.Hour), Limit: 10})
+	if len(records) != 1 || records[0].Model != "e" {
+		t.Errorf("Expected the record of the last day, got %+v", records)
+	}
+
+	// Files whose records are all past retention are deleted
+	now = now.Add(49 * time.Hour)
+	write("f")
+	files, _ = a.files()
+	if len(files) != 2 {
+		t.Errorf("Expected the files of the first day to be deleted, got %d", len(files))
+	}
+	entries, _ := os.ReadDir(a.dir)
+	if records, _ := a.Query(AuditQuery{Limit: 10}); len(records) != 2 || len(entries) != 2 {
+		t.Errorf("Expected the last two records to be kept, got %+v", records)
+	}
+
+	// Pruning deletes files past retention without waiting for a write
+	now = now.Add(49 * time.Hour)
+	if pruned, size := a.Prune(); pruned != 1 || size == 0 {
+		t.Errorf("Expected one file pruned, got %d of %d bytes", pruned, size)
+	}
+	if files, _ = a.files(); len(files) != 1 {
+		t.Errorf("Expected only the current file to be left, got %d", len(files))
+	}
+}
@@ -0,0 +1,278 @@
+//go:build !edge && !wasip1
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// botBridge turns chat bot messages into chat completions. Every chat gets
+// its own session so the bot remembers the conversation, and requests go
+// through the same key scopes, rate limits and usage accounting as API
+// clients, charged to the key the bridge is configured with.
+type botBridge struct {
+	server *ProxyServer
+	// keyID is the client key bot traffic is authorized and charged as;
+	// it is ignored when authentication is disabled
+	keyID  string
+	model  string
+	system string
+	client *http.Client
+
+	// pending tracks replies still being generated; platforms expect the
+	// webhook to be acknowledged right away. It is the server's, so a drain
+	// waits for them.
+	pending *sync.WaitGroup
+}
+
+func newBotBridge(server *ProxyServer, keyID, model, system string) *botBridge {
+	return &botBridge{
+		server:  server,
+		keyID:   keyID,
+		model:   model,
+		system:  system,
+		client:  &http.Client{Timeout: 30 * time.Second},
+		pending: &server.bridgeReplies,
+	}
+}
+
+// reply answers text sent in the chat with the given session ID. Failures
+// are turned into a message for the user rather than an error, since the
+// user is the one waiting for an answer. The upstream call is abandoned
+// when ctx is cancelled.
+func (b *botBridge) reply(ctx context.Context, endpoint, sessionID, text string) string {
+	// In group chats Telegram appends the bot's name to commands
+	command, _, _ := strings.Cut(strings.TrimSpace(text), "@")
+	switch command {
+	case "/reset", "/start":
+		b.server.sessions.Reset(sessionID)
+		return "Starting a new conversation."
+	}
+
+	var key *ClientKey
+	if b.server.keys != nil {
+		key = b.server.keys.Get(b.keyID)
+		if key == nil || key.Expired(time.Now()) {
+			log.Printf("Bot bridge key %q does not exist", b.keyID)
+			return "Sorry, this bot is not configured correctly."
+		}
+		if !key.AllowsModel(b.model) {
+			log.Printf("Bot bridge key %q is not allowed to use model %s", b.keyID, b.model)
+			return "Sorry, this bot is not configured correctly."
+		}
+		if !b.server.terms.Allows(key) {
+			log.Printf("Bot bridge key %q has not accepted the terms of use (version %s)", b.keyID, b.server.terms.version)
+			return "Sorry, this bot is not configured correctly."
+		}
+		var ok bool
+		if ctx, ok = b.server.keyContext(ctx, key); !ok {
+			return "Sorry, this bot is not configured correctly."
+		}
+		if reason, _ := b.server.checkLimits(key); reason != "" {
+			return reason + ", please try again in a minute."
+		}
+		if reason := b.server.overBudget(key); reason != "" {
+			return reason + "."
+		}
+	}
+
+	user := Message{Role: "user", Content: text}
+	var req ChatCompletionRequest
+	if b.system != "" {
+		req.Messages = append(req.Messages, Message{Role: "system", Content: b.system})
+	}
+	req.Messages = append(req.Messages, b.server.sessions.History(sessionID)...)
+	req.Messages = append(req.Messages, user)
+	if err := b.server.filterRequest(&req, endpoint); err != nil {
+		log.Printf("Bot bridge request refused: %v", err)
+		return "Sorry, I can't help with that."
+	}
+	user = req.Messages[len(req.Messages)-1]
+	var tenant string
+	if key != nil {
+		tenant = key.Tenant
+	}
+	req.Model = b.model
+	if err := b.server.expandModel(&req, tenant, endpoint); err != nil {
+		log.Printf("Bot bridge request refused: %v", err)
+		if errors.Is(err, errGuardrailBlocked) {
+			return "Sorry, I can't help with that."
+		}
+		return "Sorry, this bot is not configured correctly."
+	}
+
+	event := newUsageEvent(key, endpoint, req.Model)
+	resp, err := b.server.chatCompletion(ctx, req)
+	event.LatencyMS = time.Since(event.Time).Milliseconds()
+	if err != nil {
+		log.Printf("Bot bridge completion failed: %v", err)
+		event.Status = http.StatusInternalServerError
+		b.server.recordUsage(event)
+		return "Sorry, something went wrong. Please try again."
+	}
+	b.server.recordCompletion(key, event, resp.Usage)
+
+	if len(resp.Choices) == 0 || resp.Choices[0].Message.Content == "" {
+		return "Sorry, I have no answer to that."
+	}
+	answer := resp.Choices[0].Message
+	b.server.sessions.Append(sessionID, user, Message{Role: "assistant", Content: answer.Content})
+	return answer.Content
+}
+
+// async runs fn in the background. The webhook has already been
+// acknowledged, so nothing is tied to the request's context.
+func (b *botBridge) async(fn func(ctx context.Context)) {
+	b.pending.Add(1)
+	go func() {
+		defer b.pending.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		defer cancel()
+		fn(ctx)
+	}()
+}
+
+// postJSON sends v to a bot platform API and decodes the reply into out
+func (b *botBridge) postJSON(ctx context.Context, url, token string, v, out any) error {
+	body, _ := json.Marshal(v)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode > 299 {
+		return fmt.Errorf("%s returned status %d", url, resp.StatusCode)
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+// splitMessage cuts text into chunks of at most limit bytes, preferring line
+// breaks, for platforms that cap the length of a message
+func splitMessage(text string, limit int) []string {
+	var chunks []string
+	for len(text) > limit {
+		cut := strings.LastIndexByte(text[:limit+1], '\n')
+		if cut <= 0 {
+			cut = limit
+			// Do not split a multi-byte character
+			for cut > 0 && text[cut]&0xC0 == 0x80 {
+				cut--
+			}
+		}
+		chunks = append(chunks, text[:cut])
+		text = strings.TrimPrefix(text[cut:], "\n")
+	}
+	return append(chunks, text)
+}
+
+// botBridgesFromEnv configures the chat bot bridges whose tokens are set
+// and returns their webhook handlers by path
+func botBridgesFromEnv(server *ProxyServer, getenv func(string) string) (map[string]http.Handler, error) {
+	handlers := make(map[string]http.Handler)
+	telegramToken, slackToken := getenv("PROXY_TELEGRAM_BOT_TOKEN"), getenv("PROXY_SLACK_BOT_TOKEN")
+	emailKey := getenv("PROXY_EMAIL_SIGNING_KEY")
+	if telegramToken == "" && slackToken == "" && emailKey == "" {
+		return handlers, nil
+	}
+
+	keyID := getenv("PROXY_BRIDGE_KEY_ID")
+	if server.keys != nil && server.keys.Get(keyID) == nil {
+		return nil, fmt.Errorf("PROXY_BRIDGE_KEY_ID must name a configured client key")
+	}
+	model := getenv("PROXY_BRIDGE_MODEL")
+	if model == "" {
+		model = "gpt-4o-mini"
+	}
+	if v := getenv("PROXY_BRIDGE_HISTORY"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid PROXY_BRIDGE_HISTORY %q", v)
+		}
+		server.sessions.maxMessages = n
+	}
+	bridge := newBotBridge(server, keyID, model, getenv("PROXY_BRIDGE_SYSTEM_PROMPT"))
+
+	if telegramToken != "" {
+		secret := getenv("PROXY_TELEGRAM_WEBHOOK_SECRET")
+		if secret == "" {
+			return nil, fmt.Errorf("PROXY_TELEGRAM_WEBHOOK_SECRET is required for the Telegram bridge")
+		}
+		handlers["/bridges/telegram"] = &telegramBridge{botBridge: bridge, token: telegramToken, secret: secret, apiURL: "https://api.telegram.org"}
+	}
+	if slackToken != "" {
+		secret := getenv("PROXY_SLACK_SIGNING_SECRET")
+		if secret == "" {
+			return nil, fmt.Errorf("PROXY_SLACK_SIGNING_SECRET is required for the Slack bridge")
+		}
+		handlers["/bridges/slack"] = &slackBridge{botBridge: bridge, token: slackToken, signingSecret: secret, apiURL: "https://slack.com/api", now: time.Now}
+	}
+	if emailKey != "" {
+		gateway, err := emailGatewayFromEnv(bridge, emailKey, getenv)
+		if err != nil {
+			return nil, err
+		}
+		handlers["/bridges/email"] = gateway
+	}
+	return handlers, nil
+}
+
+func emailGatewayFromEnv(bridge *botBridge, signingKey string, getenv func(string) string) (*emailGateway, error) {
+	var allowed []string
+	for _, sender := range strings.Split(getenv("PROXY_EMAIL_ALLOWED_SENDERS"), ",") {
+		if sender = strings.TrimSpace(sender); sender != "" {
+			allowed = append(allowed, sender)
+		}
+	}
+	if len(allowed) == 0 {
+		return nil, fmt.Errorf("PROXY_EMAIL_ALLOWED_SENDERS is required for the email gateway")
+	}
+	addr, from := getenv("PROXY_SMTP_ADDR"), getenv("PROXY_EMAIL_FROM")
+	if addr == "" || from == "" {
+		return nil, fmt.Errorf("PROXY_SMTP_ADDR and PROXY_EMAIL_FROM are required for the email gateway")
+	}
+	text := getenv("PROXY_EMAIL_TEMPLATE")
+	if text == "" {
+		text = defaultEmailTemplate
+	}
+	tmpl, err := template.New("email").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PROXY_EMAIL_TEMPLATE: %w", err)
+	}
+	fromAddr, err := mail.ParseAddress(from)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PROXY_EMAIL_FROM: %w", err)
+	}
+	return &emailGateway{
+		botBridge:  bridge,
+		signingKey: signingKey,
+		allowed:    allowed,
+		template:   tmpl,
+		from:       from,
+		send:       smtpSender(addr, getenv("PROXY_SMTP_USERNAME"), getenv("PROXY_SMTP_PASSWORD"), fromAddr.Address),
+		now:        time.Now,
+		seen:       make(map[string]time.Time),
+	}, nil
+}
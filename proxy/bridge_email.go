@@ -0,0 +1,229 @@
+//go:build !edge && !wasip1
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"mime/quotedprintable"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// defaultEmailTemplate turns an email into the prompt sent upstream
+const defaultEmailTemplate = "Subject: {{.Subject}}\n\n{{.Body}}"
+
+// emailGateway answers emails forwarded by a Mailgun route (or anything
+// posting the same form fields) and sends the completion back to the
+// sender over SMTP. Replies keep the email thread, and each thread is a
+// session so follow-up emails carry the conversation.
+type emailGateway struct {
+	*botBridge
+	signingKey string
+	// allowed lists the addresses, or domains written as "@example.com",
+	// that may use the gateway
+	allowed  []string
+	template *template.Template
+	from     string
+	send     func(to string, msg []byte) error
+	now      func() time.Time
+
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+// inboundEmail is what the prompt template is executed with
+type inboundEmail struct {
+	From    string
+	Subject string
+	Body    string
+}
+
+// smtpSender delivers mail through an SMTP relay, using STARTTLS when the
+// server offers it
+func smtpSender(addr, username, password, from string) func(to string, msg []byte) error {
+	return func(to string, msg []byte) error {
+		var auth smtp.Auth
+		if username != "" {
+			host, _, _ := strings.Cut(addr, ":")
+			auth = smtp.PlainAuth("", username, password, host)
+		}
+		return smtp.SendMail(addr, auth, from, []string{to}, msg)
+	}
+}
+
+// verify checks the webhook signature, an HMAC of the timestamp and token
+// with the signing key, and rejects stale or replayed requests
+func (g *emailGateway) verify(timestamp, token, signature string) bool {
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || g.now().Sub(time.Unix(ts, 0)).Abs() > 5*time.Minute {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(g.signingKey))
+	mac.Write([]byte(timestamp + token))
+	if !hmac.Equal([]byte(signature), []byte(hex.EncodeToString(mac.Sum(nil)))) {
+		return false
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for t, at := range g.seen {
+		if g.now().Sub(at) > 10*time.Minute {
+			delete(g.seen, t)
+		}
+	}
+	if _, replayed := g.seen[token]; replayed {
+		return false
+	}
+	g.seen[token] = g.now()
+	return true
+}
+
+func (g *emailGateway) allows(address string) bool {
+	address = strings.ToLower(address)
+	for _, a := range g.allowed {
+		a = strings.ToLower(a)
+		if address == a || (strings.HasPrefix(a, "@") && strings.HasSuffix(address, a)) {
+			return true
+		}
+	}
+	return false
+}
+
+// emailHeader returns a header of the forwarded message, from its own form
+// field or the JSON list of all headers
+func emailHeader(r *http.Request, name string) string {
+	if v := r.PostFormValue(name); v != "" {
+		return v
+	}
+	var headers [][2]string
+	json.Unmarshal([]byte(r.PostFormValue("message-headers")), &headers)
+	for _, h := range headers {
+		if strings.EqualFold(h[0], name) {
+			return h[1]
+		}
+	}
+	return ""
+}
+
+func (g *emailGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 10<<20)
+	if err := r.ParseMultipartForm(1 << 20); err != nil && err != http.ErrNotMultipart {
+		http.Error(w, "Invalid form body", http.StatusBadRequest)
+		return
+	}
+	if !g.verify(r.PostFormValue("timestamp"), r.PostFormValue("token"), r.PostFormValue("signature")) {
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return
+	}
+	// Anything other than a 2xx makes the sender retry, so emails that are
+	// ignored are acknowledged too
+	w.WriteHeader(http.StatusOK)
+
+	from, err := mail.ParseAddress(emailHeader(r, "From"))
+	if err != nil {
+		log.Printf("Ignoring email without a valid sender: %v", err)
+		return
+	}
+	if !g.allows(from.Address) {
+		log.Printf("Ignoring email from %s, who is not an allowed sender", from.Address)
+		return
+	}
+	// Never answer auto-replies, bounces or mailing lists, or ourselves,
+	// so two robots cannot keep each other busy
+	if auto := emailHeader(r, "Auto-Submitted"); (auto != "" && auto != "no") || strings.EqualFold(from.Address, g.fromAddress()) {
+		return
+	}
+	switch strings.ToLower(emailHeader(r, "Precedence")) {
+	case "bulk", "list", "junk", "auto_reply":
+		return
+	}
+
+	body := r.PostFormValue("stripped-text")
+	if body == "" {
+		body = r.PostFormValue("body-plain")
+	}
+	email := inboundEmail{From: from.String(), Subject: emailHeader(r, "Subject"), Body: body}
+	var prompt strings.Builder
+	if err := g.template.Execute(&prompt, email); err != nil {
+		log.Printf("Failed to render email prompt: %v", err)
+		return
+	}
+
+	messageID := emailHeader(r, "Message-Id")
+	references := strings.Fields(emailHeader(r, "References"))
+	if inReplyTo := emailHeader(r, "In-Reply-To"); len(references) == 0 && inReplyTo != "" {
+		references = []string{inReplyTo}
+	}
+	thread := messageID
+	if len(references) > 0 {
+		thread = references[0]
+	}
+
+	g.async(func(ctx context.Context) {
+		answer := g.reply(ctx, "bridge.email", "email:"+thread, prompt.String())
+		msg := g.compose(from.Address, email.Subject, messageID, references, answer)
+		if err := g.send(from.Address, msg); err != nil {
+			log.Printf("Failed to send email reply to %s: %v", from.Address, err)
+		}
+	})
+}
+
+func (g *emailGateway) fromAddress() string {
+	if addr, err := mail.ParseAddress(g.from); err == nil {
+		return addr.Address
+	}
+	return g.from
+}
+
+// compose builds the reply so mail clients thread it under the original
+func (g *emailGateway) compose(to, subject, inReplyTo string, references []string, content string) []byte {
+	// Header values copied from the inbound email must not smuggle in
+	// headers of their own
+	clean := strings.NewReplacer("\r", "", "\n", " ")
+	subject = clean.Replace(subject)
+	if !strings.HasPrefix(strings.ToLower(subject), "re:") {
+		subject = "Re: " + subject
+	}
+	var id [12]byte
+	rand.Read(id[:])
+	_, domain, _ := strings.Cut(g.fromAddress(), "@")
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", g.from)
+	fmt.Fprintf(&buf, "To: %s\r\n", to)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", g.now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-Id: <%s@%s>\r\n", hex.EncodeToString(id[:]), domain)
+	if inReplyTo != "" {
+		inReplyTo = clean.Replace(inReplyTo)
+		fmt.Fprintf(&buf, "In-Reply-To: %s\r\n", inReplyTo)
+		fmt.Fprintf(&buf, "References: %s\r\n", clean.Replace(strings.Join(append(references, inReplyTo), " ")))
+	}
+	buf.WriteString("Auto-Submitted: auto-replied\r\n")
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	qp := quotedprintable.NewWriter(&buf)
+	qp.Write([]byte(content))
+	qp.Close()
+	return buf.Bytes()
+}
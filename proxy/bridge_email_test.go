@@ -0,0 +1,150 @@
+//go:build !edge && !wasip1
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+)
+
+type sentEmail struct {
+	to  string
+	msg string
+}
+
+func newTestEmailGateway(t *testing.T) (*emailGateway, *[]sentEmail, *recordingOpenAIClient) {
+	client := &recordingOpenAIClient{MockOpenAIClient: MockOpenAIClient{response: createTestChatCompletionResponse()}}
+	server := NewProxyServer(client)
+	var sent []sentEmail
+	return &emailGateway{
+		botBridge:  newBotBridge(server, "", "gpt-4o-mini", ""),
+		signingKey: "mg-key",
+		allowed:    []string{"@example.com", "boss@partner.org"},
+		template:   template.Must(template.New("email").Parse(defaultEmailTemplate)),
+		from:       "Assistant <assistant@proxy.example.com>",
+		send: func(to string, msg []byte) error {
+			sent = append(sent, sentEmail{to, string(msg)})
+			return nil
+		},
+		now:  time.Now,
+		seen: make(map[string]time.Time),
+	}, &sent, client
+}
+
+func emailRequest(key string, fields map[string]string) *http.Request {
+	form := url.Values{}
+	for k, v := range fields {
+		form.Set(k, v)
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	token := strconv.FormatInt(time.Now().UnixNano(), 36)
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(ts + token))
+	form.Set("timestamp", ts)
+	form.Set("token", token)
+	form.Set("signature", hex.EncodeToString(mac.Sum(nil)))
+	req := httptest.NewRequest("POST", "/bridges/email", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req
+}
+
+func TestEmailGateway_RepliesInThread(t *testing.T) {
+	gateway, sent, client := newTestEmailGateway(t)
+	w := httptest.NewRecorder()
+	gateway.ServeHTTP(w, emailRequest("mg-key", map[string]string{
+		"From":          "Ann <ann@example.com>",
+		"Subject":       "Quarterly numbers",
+		"stripped-text": "Can you summarize them?",
+		"Message-Id":    "<m1@example.com>",
+	}))
+	gateway.pending.Wait()
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	if len(*sent) != 1 || (*sent)[0].to != "ann@example.com" {
+		t.Fatalf("Expected one reply to ann@example.com, got %+v", *sent)
+	}
+	msg := (*sent)[0].msg
+	for _, want := range []string{"Subject: Re: Quarterly numbers\r\n", "In-Reply-To: <m1@example.com>\r\n", "Auto-Submitted: auto-replied\r\n", "Hello!"} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("Expected reply to contain %q, got:\n%s", want, msg)
+		}
+	}
+	if got := client.last.Messages[0].Content; got != "Subject: Quarterly numbers\n\nCan you summarize them?" {
+		t.Errorf("Unexpected prompt %q", got)
+	}
+
+	// A reply to our reply continues the same session
+	gateway.ServeHTTP(httptest.NewRecorder(), emailRequest("mg-key", map[string]string{
+		"From":          "ann@example.com",
+		"Subject":       "Re: Quarterly numbers",
+		"stripped-text": "Shorter please",
+		"Message-Id":    "<m2@example.com>",
+		"References":    "<m1@example.com> <r1@proxy.example.com>",
+	}))
+	gateway.pending.Wait()
+	if len(client.last.Messages) != 3 {
+		t.Errorf("Expected the thread's history to be sent along, got %+v", client.last.Messages)
+	}
+}
+
+func TestEmailGateway_Rejects(t *testing.T) {
+	gateway, sent, _ := newTestEmailGateway(t)
+
+	w := httptest.NewRecorder()
+	gateway.ServeHTTP(w, emailRequest("wrong-key", map[string]string{"From": "ann@example.com", "body-plain": "hi"}))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status code %d for a bad signature, got %d", http.StatusUnauthorized, w.Code)
+	}
+
+	for name, fields := range map[string]map[string]string{
+		"stranger":   {"From": "eve@evil.test", "body-plain": "hi"},
+		"lookalike":  {"From": "eve@notexample.com", "body-plain": "hi"},
+		"auto-reply": {"From": "ann@example.com", "Auto-Submitted": "auto-replied", "body-plain": "Out of office"},
+		"list":       {"From": "ann@example.com", "message-headers": `[["Precedence", "list"]]`, "body-plain": "digest"},
+		"ourselves":  {"From": "assistant@proxy.example.com", "body-plain": "loop"},
+	} {
+		before := len(*sent)
+		gateway.ServeHTTP(httptest.NewRecorder(), emailRequest("mg-key", fields))
+		gateway.pending.Wait()
+		if len(*sent) != before {
+			t.Errorf("%s: expected no reply, got %+v", name, (*sent)[before:])
+		}
+	}
+}
+
+func TestEmailGateway_VerifyRejectsReplays(t *testing.T) {
+	gateway, _, _ := newTestEmailGateway(t)
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte("mg-key"))
+	mac.Write([]byte(ts + "tok"))
+	signature := hex.EncodeToString(mac.Sum(nil))
+
+	if !gateway.verify(ts, "tok", signature) {
+		t.Fatal("Expected a valid signature to verify")
+	}
+	if gateway.verify(ts, "tok", signature) {
+		t.Error("Expected a replayed token to be rejected")
+	}
+	old := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	if gateway.verify(old, "tok2", signature) {
+		t.Error("Expected a stale timestamp to be rejected")
+	}
+}
+
+func TestEmailGateway_ComposeStripsHeaders(t *testing.T) {
+	gateway, _, _ := newTestEmailGateway(t)
+	msg := string(gateway.compose("ann@example.com", "Hi\r\nBcc: eve@evil.test", "<m1@x>", nil, "body"))
+	if strings.Contains(msg, "\r\nBcc:") {
+		t.Errorf("Expected header injection to be neutralized, got:\n%s", msg)
+	}
+}
@@ -0,0 +1,142 @@
+//go:build !edge && !wasip1
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// slackMaxMessage is the message length Slack recommends staying under
+const slackMaxMessage = 4000
+
+// slackBridge receives direct messages and mentions through the Slack
+// Events API and answers in a thread with chat.postMessage
+type slackBridge struct {
+	*botBridge
+	token         string
+	signingSecret string
+	// apiURL is the Web API base URL, replaced in tests
+	apiURL string
+	now    func() time.Time
+}
+
+type slackEnvelope struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Event     struct {
+		Type        string `json:"type"`
+		Subtype     string `json:"subtype"`
+		BotID       string `json:"bot_id"`
+		Channel     string `json:"channel"`
+		ChannelType string `json:"channel_type"`
+		Text        string `json:"text"`
+		TS          string `json:"ts"`
+		ThreadTS    string `json:"thread_ts"`
+	} `json:"event"`
+}
+
+var slackMention = regexp.MustCompile(`<@[A-Z0-9]+>\s*`)
+
+// verify checks the request signature Slack computes with the app's
+// signing secret, rejecting requests older than five minutes
+func (s *slackBridge) verify(r *http.Request, body []byte) bool {
+	ts, err := strconv.ParseInt(r.Header.Get("X-Slack-Request-Timestamp"), 10, 64)
+	if err != nil || s.now().Sub(time.Unix(ts, 0)).Abs() > 5*time.Minute {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(s.signingSecret))
+	fmt.Fprintf(mac, "v0:%d:", ts)
+	mac.Write(body)
+	want := "v0=" + hex.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(r.Header.Get("X-Slack-Signature")), []byte(want))
+}
+
+func (s *slackBridge) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+	if !s.verify(r, body) {
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return
+	}
+	var envelope slackEnvelope
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		http.Error(w, "Invalid JSON in request body", http.StatusBadRequest)
+		return
+	}
+	if envelope.Type == "url_verification" {
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, envelope.Challenge)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+
+	// Slack redelivers events it thinks were not acknowledged in time; the
+	// first delivery is already being answered
+	if r.Header.Get("X-Slack-Retry-Num") != "" {
+		return
+	}
+	event := envelope.Event
+	direct := event.Type == "message" && event.ChannelType == "im"
+	if envelope.Type != "event_callback" || (!direct && event.Type != "app_mention") {
+		return
+	}
+	// Skip the bot's own messages, edits and other message subtypes
+	if event.BotID != "" || event.Subtype != "" {
+		return
+	}
+	text := strings.TrimSpace(slackMention.ReplaceAllString(event.Text, ""))
+	if text == "" {
+		return
+	}
+
+	// Mentions are answered in a thread, which is also the session; a
+	// direct message channel is one conversation
+	thread := event.ThreadTS
+	if thread == "" && !direct {
+		thread = event.TS
+	}
+	sessionID := "slack:" + event.Channel
+	if thread != "" {
+		sessionID += ":" + thread
+	}
+	s.async(func(ctx context.Context) {
+		answer := s.reply(ctx, "bridge.slack", sessionID, text)
+		for _, chunk := range splitMessage(answer, slackMaxMessage) {
+			msg := map[string]string{"channel": event.Channel, "text": chunk}
+			if thread != "" {
+				msg["thread_ts"] = thread
+			}
+			var result struct {
+				OK    bool   `json:"ok"`
+				Error string `json:"error"`
+			}
+			err := s.postJSON(ctx, s.apiURL+"/chat.postMessage", s.token, msg, &result)
+			if err == nil && !result.OK {
+				err = fmt.Errorf("%s", result.Error)
+			}
+			if err != nil {
+				log.Printf("Slack chat.postMessage failed: %v", err)
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,99 @@
+//go:build !edge && !wasip1
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func signedSlackRequest(secret, body string, ts time.Time) *http.Request {
+	req := httptest.NewRequest("POST", "/bridges/slack", strings.NewReader(body))
+	stamp := strconv.FormatInt(ts.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("v0:" + stamp + ":" + body))
+	req.Header.Set("X-Slack-Request-Timestamp", stamp)
+	req.Header.Set("X-Slack-Signature", "v0="+hex.EncodeToString(mac.Sum(nil)))
+	return req
+}
+
+func newTestSlackBridge(t *testing.T) (*slackBridge, *fakeBotAPI) {
+	api := newFakeBotAPI(t, `{"ok": true}`)
+	server := NewProxyServer(&MockOpenAIClient{response: createTestChatCompletionResponse()})
+	return &slackBridge{
+		botBridge:     newBotBridge(server, "", "gpt-4o-mini", ""),
+		token:         "xoxb-test",
+		signingSecret: "signing",
+		apiURL:        api.URL,
+		now:           time.Now,
+	}, api
+}
+
+func TestSlackBridge_Verification(t *testing.T) {
+	bridge, _ := newTestSlackBridge(t)
+	body := `{"type": "url_verification", "challenge": "abc123"}`
+
+	w := httptest.NewRecorder()
+	bridge.ServeHTTP(w, signedSlackRequest("signing", body, time.Now()))
+	if w.Code != http.StatusOK || w.Body.String() != "abc123" {
+		t.Errorf("Expected the challenge to be echoed, got %d %q", w.Code, w.Body.String())
+	}
+
+	for name, req := range map[string]*http.Request{
+		"wrong secret": signedSlackRequest("other", body, time.Now()),
+		"stale":        signedSlackRequest("signing", body, time.Now().Add(-10*time.Minute)),
+	} {
+		w := httptest.NewRecorder()
+		bridge.ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%s: expected status code %d, got %d", name, http.StatusUnauthorized, w.Code)
+		}
+	}
+}
+
+func TestSlackBridge_MentionRepliesInThread(t *testing.T) {
+	bridge, api := newTestSlackBridge(t)
+	body := `{"type": "event_callback", "event": {"type": "app_mention", "channel": "C1", "text": "<@U123> summarize this", "ts": "1700.01"}}`
+
+	w := httptest.NewRecorder()
+	bridge.ServeHTTP(w, signedSlackRequest("signing", body, time.Now()))
+	bridge.pending.Wait()
+
+	posted := api.calls["chat.postMessage"]
+	if len(posted) != 1 || posted[0]["channel"] != "C1" || posted[0]["thread_ts"] != "1700.01" {
+		t.Fatalf("Unexpected chat.postMessage calls %+v", posted)
+	}
+	history := bridge.server.sessions.History("slack:C1:1700.01")
+	if len(history) != 2 || history[0].Content != "summarize this" {
+		t.Errorf("Expected the mention to be stripped and remembered, got %+v", history)
+	}
+}
+
+func TestSlackBridge_IgnoresBotsAndRetries(t *testing.T) {
+	bridge, api := newTestSlackBridge(t)
+	own := `{"type": "event_callback", "event": {"type": "message", "channel_type": "im", "channel": "D1", "bot_id": "B1", "text": "echo"}}`
+	bridge.ServeHTTP(httptest.NewRecorder(), signedSlackRequest("signing", own, time.Now()))
+
+	dm := `{"type": "event_callback", "event": {"type": "message", "channel_type": "im", "channel": "D1", "text": "hello"}}`
+	retry := signedSlackRequest("signing", dm, time.Now())
+	retry.Header.Set("X-Slack-Retry-Num", "1")
+	bridge.ServeHTTP(httptest.NewRecorder(), retry)
+	bridge.pending.Wait()
+	if len(api.calls["chat.postMessage"]) != 0 {
+		t.Fatalf("Expected no replies, got %+v", api.calls["chat.postMessage"])
+	}
+
+	bridge.ServeHTTP(httptest.NewRecorder(), signedSlackRequest("signing", dm, time.Now()))
+	bridge.pending.Wait()
+	posted := api.calls["chat.postMessage"]
+	if len(posted) != 1 || posted[0]["thread_ts"] != nil {
+		t.Errorf("Expected a direct reply outside a thread, got %+v", posted)
+	}
+}
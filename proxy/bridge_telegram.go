@@ -0,0 +1,76 @@
+//go:build !edge && !wasip1
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// telegramMaxMessage is the most Telegram accepts in one message
+const telegramMaxMessage = 4096
+
+// telegramBridge receives messages through a Telegram bot webhook
+// (setWebhook with a secret_token) and answers with sendMessage
+type telegramBridge struct {
+	*botBridge
+	token  string
+	secret string
+	// apiURL is the Bot API base URL, replaced in tests
+	apiURL string
+}
+
+type telegramUpdate struct {
+	UpdateID int64 `json:"update_id"`
+	Message  *struct {
+		MessageID int64 `json:"message_id"`
+		Chat      struct {
+			ID int64 `json:"id"`
+		} `json:"chat"`
+		Text string `json:"text"`
+	} `json:"message"`
+}
+
+func (t *telegramBridge) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	got := r.Header.Get("X-Telegram-Bot-Api-Secret-Token")
+	if subtle.ConstantTimeCompare([]byte(got), []byte(t.secret)) != 1 {
+		http.Error(w, "Invalid secret token", http.StatusUnauthorized)
+		return
+	}
+	var update telegramUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, "Invalid JSON in request body", http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+
+	// Stickers, photos, edits and the like are ignored
+	msg := update.Message
+	if msg == nil || msg.Text == "" {
+		return
+	}
+	t.async(func(ctx context.Context) {
+		call := func(method string, v any) {
+			if err := t.postJSON(ctx, t.apiURL+"/bot"+t.token+"/"+method, "", v, nil); err != nil {
+				log.Printf("Telegram %s failed: %v", method, err)
+			}
+		}
+		call("sendChatAction", map[string]any{"chat_id": msg.Chat.ID, "action": "typing"})
+		answer := t.reply(ctx, "bridge.telegram", "telegram:"+strconv.FormatInt(msg.Chat.ID, 10), msg.Text)
+		for i, chunk := range splitMessage(answer, telegramMaxMessage) {
+			body := map[string]any{"chat_id": msg.Chat.ID, "text": chunk}
+			if i == 0 {
+				body["reply_parameters"] = map[string]any{"message_id": msg.MessageID}
+			}
+			call("sendMessage", body)
+		}
+	})
+}
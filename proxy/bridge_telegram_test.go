@@ -0,0 +1,69 @@
+//go:build !edge && !wasip1
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeBotAPI records the calls a bridge makes to a bot platform
+type fakeBotAPI struct {
+	*httptest.Server
+	mu    sync.Mutex
+	calls map[string][]map[string]any
+}
+
+func newFakeBotAPI(t *testing.T, reply string) *fakeBotAPI {
+	api := &fakeBotAPI{calls: make(map[string][]map[string]any)}
+	api.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		json.NewDecoder(r.Body).Decode(&body)
+		method := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		api.mu.Lock()
+		api.calls[method] = append(api.calls[method], body)
+		api.mu.Unlock()
+		io.WriteString(w, reply)
+	}))
+	t.Cleanup(api.Close)
+	return api
+}
+
+func TestTelegramBridge(t *testing.T) {
+	api := newFakeBotAPI(t, `{"ok": true}`)
+	server := NewProxyServer(&MockOpenAIClient{response: createTestChatCompletionResponse()})
+	bridge := &telegramBridge{botBridge: newBotBridge(server, "", "gpt-4o-mini", ""), token: "123:abc", secret: "s3cret", apiURL: api.URL}
+
+	update := `{"update_id": 1, "message": {"message_id": 7, "chat": {"id": 42}, "text": "Hi bot"}}`
+	req := httptest.NewRequest("POST", "/bridges/telegram", strings.NewReader(update))
+	w := httptest.NewRecorder()
+	bridge.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status code %d without the secret, got %d", http.StatusUnauthorized, w.Code)
+	}
+
+	req = httptest.NewRequest("POST", "/bridges/telegram", strings.NewReader(update))
+	req.Header.Set("X-Telegram-Bot-Api-Secret-Token", "s3cret")
+	w = httptest.NewRecorder()
+	bridge.ServeHTTP(w, req)
+	bridge.pending.Wait()
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+
+	sent := api.calls["sendMessage"]
+	if len(sent) != 1 || sent[0]["chat_id"] != float64(42) || !strings.HasPrefix(sent[0]["text"].(string), "Hello!") {
+		t.Fatalf("Unexpected sendMessage calls %+v", sent)
+	}
+	if len(api.calls["sendChatAction"]) != 1 {
+		t.Errorf("Expected a typing indicator, got %+v", api.calls["sendChatAction"])
+	}
+	if len(server.sessions.History("telegram:42")) != 2 {
+		t.Errorf("Expected the turn to be remembered, got %+v", server.sessions.History("telegram:42"))
+	}
+}
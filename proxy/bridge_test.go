@@ -0,0 +1,183 @@
+//go:build !edge && !wasip1
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBotBridge_ReplyRemembersConversation(t *testing.T) {
+	client := &recordingOpenAIClient{MockOpenAIClient: MockOpenAIClient{response: createTestChatCompletionResponse()}}
+	server := NewProxyServer(client)
+	bridge := newBotBridge(server, "", "gpt-4o-mini", "You are terse.")
+
+	bridge.reply(context.Background(), "bridge.test", "chat-1", "Hi")
+	answer := bridge.reply(context.Background(), "bridge.test", "chat-1", "And again")
+	if !strings.HasPrefix(answer, "Hello!") {
+		t.Errorf("Unexpected answer %q", answer)
+	}
+	roles := make([]string, 0, len(client.last.Messages))
+	for _, m := range client.last.Messages {
+		roles = append(roles, m.Role)
+	}
+	if got := strings.Join(roles, ","); got != "system,user,assistant,user" {
+		t.Errorf("Expected the history to be sent along, got roles %s", got)
+	}
+
+	bridge.reply(context.Background(), "bridge.test", "chat-1", "/reset")
+	bridge.reply(context.Background(), "bridge.test", "chat-1", "Fresh start")
+	if len(client.last.Messages) != 2 {
+		t.Errorf("Expected reset to clear the history, got %+v", client.last.Messages)
+	}
+	if len(server.sessions.History("chat-2")) != 0 {
+		t.Error("Expected chats not to share sessions")
+	}
+}
+
+func TestBotBridge_ReplyEnforcesKey(t *testing.T) {
+	server := NewProxyServer(&MockOpenAIClient{response: createTestChatCompletionResponse()})
+	server.keys = createTestKeyStore(t)
+	server.keys.Put(ClientKey{ID: "bot", Key: "sk-bot", Scopes: KeyScopes{Models: []string{"gpt-4o*"}}, Limits: KeyLimits{RequestsPerMinute: 1}})
+
+	if answer := newBotBridge(server, "bot", "gpt-4o-mini", "").reply(context.Background(), "bridge.test", "c", "Hi"); !strings.HasPrefix(answer, "Hello!") {
+		t.Errorf("Expected an answer, got %q", answer)
+	}
+	if answer := newBotBridge(server, "bot", "gpt-4o-mini", "").reply(context.Background(), "bridge.test", "c", "Hi"); !strings.HasPrefix(answer, "Rate limit exceeded") {
+		t.Errorf("Expected the key's rate limit to apply, got %q", answer)
+	}
+	if answer := newBotBridge(server, "bot", "o1", "").reply(context.Background(), "bridge.test", "c", "Hi"); !strings.Contains(answer, "not configured") {
+		t.Errorf("Expected the key's model scope to apply, got %q", answer)
+	}
+	if answer := newBotBridge(server, "missing", "gpt-4o", "").reply(context.Background(), "bridge.test", "c", "Hi"); !strings.Contains(answer, "not configured") {
+		t.Errorf("Expected an unknown key to be rejected, got %q", answer)
+	}
+}
+
+func TestBotBridge_ReplyEnforcesBudget(t *testing.T) {
+	client := &recordingOpenAIClient{MockOpenAIClient: MockOpenAIClient{response: createTestChatCompletionResponse()}}
+	server := NewProxyServer(client)
+	server.keys, _ = NewKeyStore([]ClientKey{{ID: "bot", Key: "sk-bot", MonthlyBudget: 0.05}})
+	server.costs = newTestCostLedger(t)
+	bridge := newBotBridge(server, "bot", "gpt-3.5-turbo", "")
+
+	if answer := bridge.reply(context.Background(), "bridge.test", "c", "Hi"); !strings.HasPrefix(answer, "Hello!") {
+		t.Fatalf("Expected an answer within the budget, got %q", answer)
+	}
+	client.last = ChatCompletionRequest{}
+	if answer := bridge.reply(context.Background(), "bridge.test", "c", "Hi"); !strings.Contains(answer, "monthly budget") {
+		t.Errorf("Expected the key's budget to apply, got %q", answer)
+	}
+	if client.last.Model != "" {
+		t.Error("Expected nothing to be sent upstream over the budget")
+	}
+}
+
+func TestBotBridge_ReplyActsAsItsKey(t *testing.T) {
+	var auth string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		json.NewEncoder(w).Encode(createTestChatCompletionResponse())
+	}))
+	defer api.Close()
+	client := NewRealOpenAIClient("sk-proxy")
+	client.BaseURL = api.URL
+	client.KeyOverrides = true
+	server := NewProxyServer(client)
+	server.keys, _ = NewKeyStore([]ClientKey{{ID: "bot", Key: "sk-bot", Upstream: "project-a"}})
+	server.upstreamKeys = &upstreamKeySet{keys: map[string]string{"project-a": "sk-project-a"}}
+	bridge := newBotBridge(server, "bot", "gpt-4o-mini", "")
+
+	if answer := bridge.reply(context.Background(), "bridge.test", "c", "Hi"); !strings.HasPrefix(answer, "Hello!") {
+		t.Fatalf("Expected an answer, got %q", answer)
+	}
+	if auth != "Bearer sk-project-a" {
+		t.Errorf("Expected the bridge key's upstream key to be used, got %q", auth)
+	}
+
+	// Keys that have not accepted the terms of use cannot be used by bots
+	auth = ""
+	server.terms = newTestTermsGate(t, t.TempDir(), "2026-01")
+	if answer := bridge.reply(context.Background(), "bridge.test", "c", "Hi"); !strings.Contains(answer, "not configured") || auth != "" {
+		t.Errorf("Expected the terms of use to apply, got %q", answer)
+	}
+}
+
+func TestBotBridge_ReplyUpstreamError(t *testing.T) {
+	server := NewProxyServer(&MockOpenAIClient{shouldError: true, error: errors.New("boom")})
+	bridge := newBotBridge(server, "", "gpt-4o-mini", "")
+	if answer := bridge.reply(context.Background(), "bridge.test", "c", "Hi"); !strings.Contains(answer, "went wrong") {
+		t.Errorf("Unexpected answer %q", answer)
+	}
+	if len(server.sessions.History("c")) != 0 {
+		t.Error("Expected failed turns not to be remembered")
+	}
+}
+
+func TestBotBridge_ReplyAppliesContentFilters(t *testing.T) {
+	client := &recordingOpenAIClient{MockOpenAIClient: MockOpenAIClient{response: createTestChatCompletionResponse()}}
+	server := NewProxyServer(client)
+	server.contentFilters = []ContentFilter{{Name: "cards", Detector: "card", Action: FilterBlock}, {Name: "emails", Detector: "email"}}
+	for i := range server.contentFilters {
+		server.contentFilters[i].compile()
+	}
+	bridge := newBotBridge(server, "", "gpt-4o-mini", "")
+
+	if answer := bridge.reply(context.Background(), "bridge.test", "c", "My card is 4111 1111 1111 1111"); !strings.Contains(answer, "can't help") {
+		t.Errorf("Expected the prompt to be blocked, got %q", answer)
+	}
+	if client.last.Model != "" || len(server.sessions.History("c")) != 0 {
+		t.Error("Expected the blocked prompt neither to go upstream nor to be remembered")
+	}
+
+	bridge.reply(context.Background(), "bridge.test", "c", "Mail jane@example.com")
+	if got := client.last.Messages[0].Content; got != "Mail [EMAIL]" {
+		t.Errorf("Expected the prompt to be redacted upstream, got %q", got)
+	}
+	if history := server.sessions.History("c"); len(history) == 0 || history[0].Content != "Mail [EMAIL]" {
+		t.Errorf("Expected the redacted prompt to be remembered, got %+v", history)
+	}
+}
+
+func TestProxyServer_DrainWaitsForBridgeReplies(t *testing.T) {
+	server := NewProxyServer(&MockOpenAIClient{response: createTestChatCompletionResponse()})
+	bridge := newBotBridge(server, "", "gpt-4o-mini", "")
+	release := make(chan struct{})
+	bridge.async(func(ctx context.Context) { <-release })
+
+	// The drain is bounded by its deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := server.drain(ctx, &http.Server{}, 0); err == nil {
+		t.Error("Expected the drain to report the reply still pending")
+	}
+
+	drained := make(chan error, 1)
+	go func() { drained <- server.drain(context.Background(), &http.Server{}, 0) }()
+	select {
+	case err := <-drained:
+		t.Fatalf("Expected the drain to wait for the pending reply, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if err := <-drained; err != nil {
+		t.Errorf("Expected a clean drain, got %v", err)
+	}
+}
+
+func TestSplitMessage(t *testing.T) {
+	chunks := splitMessage("aaaa\nbbbb\ncc", 9)
+	if len(chunks) != 2 || chunks[0] != "aaaa\nbbbb" || chunks[1] != "cc" {
+		t.Errorf("Unexpected chunks %q", chunks)
+	}
+	chunks = splitMessage(strings.Repeat("é", 5), 5)
+	if len(chunks) != 3 || chunks[0] != "éé" {
+		t.Errorf("Expected characters to stay whole, got %q", chunks)
+	}
+}
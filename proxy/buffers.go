@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// bufferPool recycles the buffers that request and response bodies are read
+// into and assembled in, so steady traffic reuses memory instead of
+// allocating a fresh body per request for the GC to collect
+var bufferPool = sync.Pool{
+	New: func() any { return new(bytes.Buffer) },
+}
+
+// maxPooledBufferSize keeps an occasional huge body from pinning its buffer
+// in the pool for good
+const maxPooledBufferSize = 1 << 20
+
+func getBuffer() *bytes.Buffer {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+// putBuffer returns buf to the pool. Nothing may reference its bytes
+// afterwards.
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBufferSize {
+		return
+	}
+	bufferPool.Put(buf)
+}
+
+// readBody reads r into a pooled buffer, sized up front when the length is
+// known. The caller must putBuffer it once done with the bytes.
+func readBody(r io.Reader, size int64) (*bytes.Buffer, error) {
+	buf := getBuffer()
+	if size > 0 && size <= maxPooledBufferSize {
+		buf.Grow(int(size))
+	}
+	if _, err := buf.ReadFrom(r); err != nil {
+		putBuffer(buf)
+		return nil, err
+	}
+	return buf, nil
+}
+
+// detachableReader reads from a byte slice until Detach is called. The HTTP
+// transport may still read a request body after RoundTrip returns (e.g. when
+// the server answers early), which must not race with the slice's buffer
+// being reused.
+type detachableReader struct {
+	mu       sync.Mutex
+	data     []byte
+	detached bool
+}
+
+func newDetachableReader(data []byte) *detachableReader {
+	return &detachableReader{data: data}
+}
+
+func (r *detachableReader) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.detached || len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+// Detach makes further reads return EOF so the slice can be reused
+func (r *detachableReader) Detach() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.detached = true
+	r.data = nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestReadBody(t *testing.T) {
+	buf, err := readBody(strings.NewReader("hello"), 5)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer putBuffer(buf)
+	if buf.String() != "hello" {
+		t.Errorf("Expected hello, got %q", buf.String())
+	}
+}
+
+func TestGetBuffer_IsEmpty(t *testing.T) {
+	buf := getBuffer()
+	buf.WriteString("leftover")
+	putBuffer(buf)
+	if got := getBuffer(); got.Len() != 0 {
+		t.Errorf("Expected an empty buffer, got %q", got.String())
+	}
+}
+
+func TestPutBuffer_DropsOversizedBuffers(t *testing.T) {
+	buf := getBuffer()
+	buf.Grow(2 * maxPooledBufferSize)
+	putBuffer(buf)
+	// Pools may drop entries at any time, so only check that the oversized
+	// buffer is never handed out again
+	for i := 0; i < 10; i++ {
+		if got := getBuffer(); got == buf {
+			t.Fatal("Expected oversized buffer not to be pooled")
+		}
+	}
+}
+
+func TestDetachableReader(t *testing.T) {
+	r := newDetachableReader([]byte("abcdef"))
+	p := make([]byte, 3)
+	if n, _ := r.Read(p); n != 3 || string(p) != "abc" {
+		t.Errorf("Expected abc, got %q", p[:n])
+	}
+	r.Detach()
+	if n, err := r.Read(p); n != 0 || err != io.EOF {
+		t.Errorf("Expected EOF after Detach, got %d, %v", n, err)
+	}
+}
+
+// largeChatCompletionRequest builds a request with a long conversation,
+// where allocating a fresh body per request hurts the most
+func largeChatCompletionRequest() []byte {
+	req := createTestChatCompletionRequest()
+	for i := 0; i < 200; i++ {
+		req.Messages = append(req.Messages, Message{Role: "user", Content: strings.Repeat("lorem ipsum ", 20)})
+	}
+	data, _ := json.Marshal(req)
+	return data
+}
+
+func BenchmarkReadBody_ReadAll(b *testing.B) {
+	data := largeChatCompletionRequest()
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			body, _ := io.ReadAll(bytes.NewReader(data))
+			_ = body
+		}
+	})
+}
+
+func BenchmarkReadBody_Pooled(b *testing.B) {
+	data := largeChatCompletionRequest()
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			buf, _ := readBody(bytes.NewReader(data), int64(len(data)))
+			putBuffer(buf)
+		}
+	})
+}
+
+func BenchmarkProxyServer_HandleChatCompletionsRaw_Large(b *testing.B) {
+	response, _ := json.Marshal(createTestChatCompletionResponse())
+	server := NewProxyServer(&rawMockOpenAIClient{rawResponse: response})
+	data := largeChatCompletionRequest()
+
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			req := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader(data))
+			server.handleChatCompletions(httptest.NewRecorder(), req)
+		}
+	})
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// lruCache keeps the most recently used values in memory up to a number of
+// entries. Entries older than the TTL are treated as missing and evicted on
+// the next lookup. A cache of size 0 keeps nothing.
+type lruCache[V any] struct {
+	size int
+	ttl  time.Duration
+	now  func() time.Time
+
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type cacheEntry[V any] struct {
+	key     string
+	value   V
+	expires time.Time
+}
+
+func newLRUCache[V any](size int, ttl time.Duration) *lruCache[V] {
+	return &lruCache[V]{size: size, ttl: ttl, now: time.Now, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// Get returns the value for key and marks it as recently used
+func (c *lruCache[V]) Get(key string) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var zero V
+	el, ok := c.entries[key]
+	if !ok {
+		return zero, false
+	}
+	entry := el.Value.(*cacheEntry[V])
+	if c.ttl > 0 && !c.now().Before(entry.expires) {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		return zero, false
+	}
+	c.order.MoveToFront(el)
+	return entry.value, true
+}
+
+// Put stores value under key, evicting the least recently used entry when
+// the cache is full
+func (c *lruCache[V]) Put(key string, value V) {
+	if c.size <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expires := c.now().Add(c.ttl)
+	if el, ok := c.entries[key]; ok {
+		entry := el.Value.(*cacheEntry[V])
+		entry.value, entry.expires = value, expires
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry[V]{key: key, value: value, expires: expires})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry[V]).key)
+	}
+}
+
+// Sweep evicts the expired entries, which lookups would only evict one at
+// a time, and returns how many there were
+func (c *lruCache[V]) Sweep() int {
+	if c.ttl <= 0 {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	swept := 0
+	for el := c.order.Back(); el != nil; {
+		prev := el.Prev()
+		if entry := el.Value.(*cacheEntry[V]); !now.Before(entry.expires) {
+			c.order.Remove(el)
+			delete(c.entries, entry.key)
+			swept++
+		}
+		el = prev
+	}
+	return swept
+}
+
+// Len returns the number of entries, expired or not
+func (c *lruCache[V]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// cacheKey hashes the JSON encoding of v, which must not fail to encode.
+// Map keys encode sorted, so equal values give equal keys.
+func cacheKey(v any) string {
+	data, _ := json.Marshal(v)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLRUCache(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := newLRUCache[string](2, time.Hour)
+	c.now = func() time.Time { return now }
+
+	c.Put("a", "1")
+	c.Put("b", "2")
+	if v, ok := c.Get("a"); !ok || v != "1" {
+		t.Fatalf("Expected a cached, got %q, %v", v, ok)
+	}
+	// b is now the least recently used
+	c.Put("c", "3")
+	if _, ok := c.Get("b"); ok {
+		t.Error("Expected b to be evicted")
+	}
+	if _, ok := c.Get("a"); !ok || c.Len() != 2 {
+		t.Errorf("Expected a and c to be kept, got %d entries", c.Len())
+	}
+
+	now = now.Add(time.Hour)
+	if _, ok := c.Get("a"); ok || c.Len() != 1 {
+		t.Errorf("Expected a to expire, got %d entries", c.Len())
+	}
+}
+
+func TestLRUCache_Sweep(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := newLRUCache[string](10, time.Hour)
+	c.now = func() time.Time { return now }
+	c.Put("a", "1")
+	c.Put("b", "2")
+	now = now.Add(30 * time.Minute)
+	c.Put("c", "3")
+
+	now = now.Add(45 * time.Minute)
+	if swept := c.Sweep(); swept != 2 || c.Len() != 1 {
+		t.Errorf("Expected the two expired entries swept, got %d with %d left", swept, c.Len())
+	}
+	if _, ok := c.Get("c"); !ok {
+		t.Error("Expected c to be kept")
+	}
+}
+
+func TestLRUCache_Disabled(t *testing.T) {
+	c := newLRUCache[int](0, time.Hour)
+	c.Put("a", 1)
+	if _, ok := c.Get("a"); ok {
+		t.Error("Expected a cache of size 0 to keep nothing")
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	a := cacheKey(map[string]string{"x": "1", "y": "2"})
+	b := cacheKey(map[string]string{"y": "2", "x": "1"})
+	if a != b || a == cacheKey(map[string]string{"x": "1"}) {
+		t.Errorf("Expected equal values to give equal keys only, got %s and %s", a, b)
+	}
+}
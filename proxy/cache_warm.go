@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// A launch or a Monday morning starts with a cold completion cache. POST
+// /admin/cache/warm sends a list of chat completion requests, given inline
+// or as a stored prompt set, through the proxy as a client key would and
+// caches the replies, so it can be run off-peak ahead of the traffic. The
+// requests take the same path as the key's own, with its routing rules,
+// scopes and accounting, and their replies are cached where the key's
+// requests will look for them.
+
+// warmConcurrency caps the requests one warm-up sends at once
+const warmConcurrency = 4
+
+// PromptSet is a stored list of chat completion requests, e.g. the prompts
+// a product sends most
+type PromptSet struct {
+	ID       string            `json:"id"`
+	Name     string            `json:"name,omitempty"`
+	Requests []json.RawMessage `json:"requests"`
+}
+
+// validate checks that the requests of a prompt set are chat completions
+func (p PromptSet) validate() error {
+	if len(p.Requests) == 0 {
+		return fmt.Errorf("requests are required")
+	}
+	return validateWarmRequests(p.Requests)
+}
+
+func validateWarmRequests(requests []json.RawMessage) error {
+	for i, raw := range requests {
+		var req ChatCompletionRequest
+		if err := json.Unmarshal(raw, &req); err != nil {
+			return fmt.Errorf("request %d is not a chat completion: %v", i, err)
+		}
+		if req.Model == "" || len(req.Messages) == 0 {
+			return fmt.Errorf("request %d needs a model and messages", i)
+		}
+	}
+	return nil
+}
+
+func (s *ProxyServer) adminPromptSetHandler() http.Handler {
+	return resourceHandler[PromptSet]{
+		lock: s.promptSets.lockWrites,
+		get: func(id string) (PromptSet, string, bool) {
+			set, ok := s.promptSets.Get(id)
+			return set, etagFor(set), ok
+		},
+		put: func(id string, set PromptSet, _ *PromptSet) (bool, error) {
+			if set.ID != "" && set.ID != id {
+				return false, fmt.Errorf("id in body does not match id in path")
+			}
+			set.ID = id
+			if err := set.validate(); err != nil {
+				return false, err
+			}
+			return s.promptSets.Put(id, set), nil
+		},
+		remove: s.promptSets.Delete,
+		view:   func(set PromptSet) any { return set },
+	}
+}
+
+// CacheWarmRequest is the body of POST /admin/cache/warm
+type CacheWarmRequest struct {
+	// Key is the ID of the client key the requests are made as. Replies
+	// are cached for its tenant, or for the key itself without one.
+	Key       string            `json:"key"`
+	Requests  []json.RawMessage `json:"requests,omitempty"`
+	PromptSet string            `json:"prompt_set,omitempty"`
+	// Refresh sends requests that are cached already as well, replacing
+	// their replies
+	Refresh bool `json:"refresh,omitempty"`
+}
+
+// CacheWarmResult counts what happened to the requests of a warm-up
+type CacheWarmResult struct {
+	// Warmed requests were sent upstream and their replies cached
+	Warmed int `json:"warmed"`
+	// Cached requests were in the cache already
+	Cached int `json:"cached"`
+	// Skipped requests cannot be cached, e.g. because they stream or the
+	// cache is turned off for the tenant
+	Skipped int      `json:"skipped"`
+	Failed  int      `json:"failed"`
+	Errors  []string `json:"errors,omitempty"`
+}
+
+// handleAdminWarmCache warms the completion cache with the requests of the
+// body, returning once all of them are done
+func (s *ProxyServer) handleAdminWarmCache(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.completions.size <= 0 {
+		http.Error(w, "The completion cache is not enabled", http.StatusConflict)
+		return
+	}
+	var req CacheWarmRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON in request body", http.StatusBadRequest)
+		return
+	}
+	key := s.keys.Get(req.Key)
+	if key == nil {
+		http.Error(w, fmt.Sprintf("Unknown key %q", req.Key), http.StatusBadRequest)
+		return
+	}
+	requests := req.Requests
+	if req.PromptSet != "" {
+		set, ok := s.promptSets.Get(req.PromptSet)
+		if !ok {
+			http.Error(w, fmt.Sprintf("Unknown prompt set %q", req.PromptSet), http.StatusBadRequest)
+			return
+		}
+		requests = append(requests, set.Requests...)
+	}
+	if len(requests) == 0 {
+		http.Error(w, "requests or prompt_set is required", http.StatusBadRequest)
+		return
+	}
+	if err := validateWarmRequests(requests); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ctx, ok := s.keyContext(r.Context(), key)
+	if !ok {
+		http.Error(w, "The upstream key of this API key is not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.warmCache(ctx, requests, req.Refresh))
+}
+
+// warmCache sends requests with the key of ctx and caches their replies
+func (s *ProxyServer) warmCache(ctx context.Context, requests []json.RawMessage, refresh bool) CacheWarmResult {
+	var (
+		result CacheWarmResult
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+	)
+	sem := make(chan struct{}, warmConcurrency)
+	for i, body := range requests {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			outcome, err := s.warmOne(ctx, body, refresh)
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err != nil:
+				result.Failed++
+				result.Errors = append(result.Errors, fmt.Sprintf("request %d: %v", i, err))
+			case outcome == "warmed":
+				result.Warmed++
+			case outcome == "cached":
+				result.Cached++
+			default:
+				result.Skipped++
+			}
+		}()
+	}
+	wg.Wait()
+	return result
+}
+
+// warmOne sends a request through the chat completions handler unless its
+// reply is cached already, and returns whether it was "warmed", "cached" or
+// "skipped"
+func (s *ProxyServer) warmOne(ctx context.Context, body []byte, refresh bool) (string, error) {
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, "/v1/chat/completions", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set(allowCacheHeader, "true")
+	if refresh {
+		r.Header.Set("Cache-Control", "no-cache")
+	}
+	var req ChatCompletionRequest
+	json.Unmarshal(body, &req)
+	if key := clientKeyFromContext(ctx); !key.AllowsModel(req.Model) {
+		return "", fmt.Errorf("API key is not allowed to use model %s", req.Model)
+	}
+	id, _ := s.completionCacheKey(r, body)
+	if id == "" {
+		return "skipped", nil
+	}
+	if _, ok := s.completions.Get(id); ok && !refresh {
+		return "cached", nil
+	}
+
+	resp := newBufferedResponse()
+	s.handleChatCompletions(resp, r)
+	if resp.status != http.StatusOK {
+		return "", fmt.Errorf("status %d: %s", resp.status, strings.TrimSpace(resp.body.String()))
+	}
+	if _, ok := s.completions.Get(id); !ok {
+		return "skipped", nil
+	}
+	return "warmed", nil
+}
+
+// bufferedResponse is a ResponseWriter keeping the response of a handler
+// called by the proxy itself
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newBufferedResponse() *bufferedResponse {
+	return &bufferedResponse{header: make(http.Header)}
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	return b.body.Write(p)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestProxyServer_WarmCache(t *testing.T) {
+	client := &countingOpenAIClient{}
+	server := NewProxyServer(client)
+	server.keys = createTestKeyStore(t)
+	server.completions.size = 100
+	server.submissions = nil
+	handler := server.Handler()
+	do := func(method, path, secret, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+secret)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	warm := func(body string) CacheWarmResult {
+		t.Helper()
+		w := do("POST", "/admin/cache/warm", "sk-admin-rw", body)
+		var result CacheWarmResult
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("Expected the cache to be warmed, got %d %s", w.Code, w.Body.String())
+		}
+		return result
+	}
+	greeting := `{"model": "gpt-4o", "temperature": 0, "messages": [{"role": "user", "content": "Hi"}]}`
+
+	if w := do("PUT", "/admin/prompt-sets/launch", "sk-admin-rw", `{"requests": [`+greeting+`, {"model": "gpt-4o", "temperature": 0, "messages": [{"role": "user", "content": "What's new?"}]}]}`); w.Code != http.StatusCreated {
+		t.Fatalf("Expected the prompt set to be stored, got %d %s", w.Code, w.Body.String())
+	}
+	result := warm(`{"key": "full", "prompt_set": "launch", "requests": [{"model": "gpt-4o", "stream": true, "messages": [{"role": "user", "content": "Hi"}]}]}`)
+	if result.Warmed != 2 || result.Skipped != 1 || client.calls.Load() != 2 {
+		t.Errorf("Expected two requests to be warmed and the stream skipped, got %+v after %d calls", result, client.calls.Load())
+	}
+
+	if w := do("POST", "/v1/chat/completions", "sk-full", greeting); w.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("Expected the warmed reply to be served, got %s", w.Header().Get("X-Cache"))
+	}
+	if result := warm(`{"key": "full", "prompt_set": "launch"}`); result.Cached != 2 || client.calls.Load() != 2 {
+		t.Errorf("Expected cached requests not to be sent again, got %+v", result)
+	}
+	if result := warm(`{"key": "full", "prompt_set": "launch", "refresh": true}`); result.Warmed != 2 || client.calls.Load() != 4 {
+		t.Errorf("Expected a refresh to send every request, got %+v", result)
+	}
+
+	// Replies are cached where the key's own requests look for them
+	if result := warm(`{"key": "mini-only", "requests": [` + greeting + `]}`); result.Failed != 1 || len(result.Errors) != 1 {
+		t.Errorf("Expected the key's model scopes to apply, got %+v", result)
+	}
+	for body, want := range map[string]int{
+		`{"key": "nobody", "prompt_set": "launch"}`:   http.StatusBadRequest,
+		`{"key": "full", "prompt_set": "missing"}`:    http.StatusBadRequest,
+		`{"key": "full", "requests": [{"model": 1}]}`: http.StatusBadRequest,
+		`{"key": "full"}`: http.StatusBadRequest,
+	} {
+		if w := do("POST", "/admin/cache/warm", "sk-admin-rw", body); w.Code != want {
+			t.Errorf("%s: expected %d, got %d", body, want, w.Code)
+		}
+	}
+	if w := do("POST", "/admin/cache/warm", "sk-admin-ro", `{"key": "full", "prompt_set": "launch"}`); w.Code != http.StatusForbidden {
+		t.Errorf("Expected read-only admin keys to be refused, got %d", w.Code)
+	}
+}
+
+func TestProxyServer_WarmCache_Disabled(t *testing.T) {
+	server := NewProxyServer(&countingOpenAIClient{})
+	server.keys = createTestKeyStore(t)
+	req := httptest.NewRequest("POST", "/admin/cache/warm", strings.NewReader(`{"key": "full", "requests": []}`))
+	req.Header.Set("Authorization", "Bearer sk-admin-rw")
+	w := httptest.NewRecorder()
+	server.Handler().ServeHTTP(w, req)
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected warming to need the cache, got %d", w.Code)
+	}
+}
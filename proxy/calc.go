@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Expressions are limited so a model cannot make the proxy recurse or loop
+// for long
+const (
+	calcMaxLength = 1000
+	calcMaxDepth  = 100
+)
+
+const calcToolParameters = `{
+	"type": "object",
+	"properties": {
+		"expression": {"type": "string", "description": "An arithmetic expression, e.g. (1.5e3 - 20) * 7 / sqrt(2)"}
+	},
+	"required": ["expression"]
+}`
+
+// calcFunctions are the functions expressions can call, by name, with
+// their number of arguments or -1 for one or more
+var calcFunctions = map[string]struct {
+	args int
+	fn   func(args []float64) float64
+}{
+	"sqrt":  {1, func(a []float64) float64 { return math.Sqrt(a[0]) }},
+	"cbrt":  {1, func(a []float64) float64 { return math.Cbrt(a[0]) }},
+	"abs":   {1, func(a []float64) float64 { return math.Abs(a[0]) }},
+	"exp":   {1, func(a []float64) float64 { return math.Exp(a[0]) }},
+	"ln":    {1, func(a []float64) float64 { return math.Log(a[0]) }},
+	"log":   {1, func(a []float64) float64 { return math.Log10(a[0]) }},
+	"log2":  {1, func(a []float64) float64 { return math.Log2(a[0]) }},
+	"sin":   {1, func(a []float64) float64 { return math.Sin(a[0]) }},
+	"cos":   {1, func(a []float64) float64 { return math.Cos(a[0]) }},
+	"tan":   {1, func(a []float64) float64 { return math.Tan(a[0]) }},
+	"asin":  {1, func(a []float64) float64 { return math.Asin(a[0]) }},
+	"acos":  {1, func(a []float64) float64 { return math.Acos(a[0]) }},
+	"atan":  {1, func(a []float64) float64 { return math.Atan(a[0]) }},
+	"floor": {1, func(a []float64) float64 { return math.Floor(a[0]) }},
+	"ceil":  {1, func(a []float64) float64 { return math.Ceil(a[0]) }},
+	"round": {1, func(a []float64) float64 { return math.Round(a[0]) }},
+	"pow":   {2, func(a []float64) float64 { return math.Pow(a[0], a[1]) }},
+	"min": {-1, func(a []float64) float64 {
+		m := a[0]
+		for _, v := range a[1:] {
+			m = math.Min(m, v)
+		}
+		return m
+	}},
+	"max": {-1, func(a []float64) float64 {
+		m := a[0]
+		for _, v := range a[1:] {
+			m = math.Max(m, v)
+		}
+		return m
+	}},
+}
+
+var calcConstants = map[string]float64{"pi": math.Pi, "e": math.E}
+
+// calculator is the calculate builtin tool, so models do not have to do
+// arithmetic themselves
+type calculator struct{}
+
+func (calculator) definition(name string) ToolFunction {
+	return ToolFunction{
+		Name:        name,
+		Description: "Evaluates an arithmetic expression exactly as a calculator would. Supports + - * / % ^, parentheses, pi, e and the functions sqrt, cbrt, abs, exp, ln, log (base 10), log2, sin, cos, tan, asin, acos, atan (in radians), floor, ceil, round, pow, min and max.",
+		Parameters:  json.RawMessage(calcToolParameters),
+	}
+}
+
+func (calculator) call(ctx context.Context, arguments string) (string, error) {
+	var args struct {
+		Expression string `json:"expression"`
+	}
+	if err := json.Unmarshal([]byte(arguments), &args); err != nil || args.Expression == "" {
+		return "", fmt.Errorf(`arguments must be an object with the expression in "expression"`)
+	}
+	result, err := evaluate(args.Expression)
+	if err != nil {
+		return "", err
+	}
+	out, err := json.Marshal(map[string]any{"expression": args.Expression, "result": result})
+	return string(out), err
+}
+
+// evaluate computes an arithmetic expression. The result is rounded to 12
+// significant digits, so 0.1 + 0.2 is 0.3.
+func evaluate(expr string) (float64, error) {
+	if len(expr) > calcMaxLength {
+		return 0, fmt.Errorf("expression is longer than %d characters", calcMaxLength)
+	}
+	p := &exprParser{src: expr}
+	v, err := p.expr()
+	if err != nil {
+		return 0, err
+	}
+	if p.skipSpace(); p.pos < len(p.src) {
+		return 0, p.errorf("unexpected %q", p.src[p.pos])
+	}
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, fmt.Errorf("the result is not a finite number")
+	}
+	return roundSignificant(v, 12), nil
+}
+
+// roundSignificant rounds v to digits significant digits, hiding the
+// binary representation of decimal fractions
+func roundSignificant(v float64, digits int) float64 {
+	rounded, _ := strconv.ParseFloat(strconv.FormatFloat(v, 'g', digits, 64), 64)
+	return rounded
+}
+
+// exprParser is a recursive descent parser evaluating as it goes:
+//
+//	expr    = term {("+" | "-") term}
+//	term    = unary {("*" | "/" | "%") unary}
+//	unary   = ("-" | "+") unary | power
+//	power   = primary [("^" | "**") unary]
+//	primary = number | constant | function "(" expr {"," expr} ")" | "(" expr ")"
+//
+// so powers bind tighter than a leading minus and are right-associative.
+type exprParser struct {
+	src   string
+	pos   int
+	depth int
+}
+
+func (p *exprParser) errorf(format string, args ...any) error {
+	return fmt.Errorf("at position %d: %s", p.pos+1, fmt.Sprintf(format, args...))
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.src) && (p.src[p.pos] == ' ' || p.src[p.pos] == '\t' || p.src[p.pos] == '\n') {
+		p.pos++
+	}
+}
+
+// peek returns the next character after spaces, or 0 at the end
+func (p *exprParser) peek() byte {
+	p.skipSpace()
+	if p.pos < len(p.src) {
+		return p.src[p.pos]
+	}
+	return 0
+}
+
+func (p *exprParser) expr() (float64, error) {
+	if p.depth++; p.depth > calcMaxDepth {
+		return 0, p.errorf("expression is nested too deeply")
+	}
+	defer func() { p.depth-- }()
+	v, err := p.term()
+	for err == nil {
+		op := p.peek()
+		if op != '+' && op != '-' {
+			break
+		}
+		p.pos++
+		var rhs float64
+		if rhs, err = p.term(); op == '+' {
+			v += rhs
+		} else {
+			v -= rhs
+		}
+	}
+	return v, err
+}
+
+func (p *exprParser) term() (float64, error) {
+	v, err := p.unary()
+	for err == nil {
+		op := p.peek()
+		if op != '*' && op != '/' && op != '%' || strings.HasPrefix(p.src[p.pos:], "**") {
+			break
+		}
+		p.pos++
+		var rhs float64
+		if rhs, err = p.unary(); err != nil {
+			break
+		}
+		if op != '*' && rhs == 0 {
+			return 0, p.errorf("division by zero")
+		}
+		switch op {
+		case '*':
+			v *= rhs
+		case '/':
+			v /= rhs
+		case '%':
+			v = math.Mod(v, rhs)
+		}
+	}
+	return v, err
+}
+
+func (p *exprParser) unary() (float64, error) {
+	if p.depth++; p.depth > calcMaxDepth {
+		return 0, p.errorf("expression is nested too deeply")
+	}
+	defer func() { p.depth-- }()
+	switch p.peek() {
+	case '-':
+		p.pos++
+		v, err := p.unary()
+		return -v, err
+	case '+':
+		p.pos++
+		return p.unary()
+	}
+	return p.power()
+}
+
+func (p *exprParser) power() (float64, error) {
+	base, err := p.primary()
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case p.peek() == '^':
+		p.pos++
+	case strings.HasPrefix(p.src[p.pos:], "**"):
+		p.pos += 2
+	default:
+		return base, nil
+	}
+	exp, err := p.unary()
+	return math.Pow(base, exp), err
+}
+
+func (p *exprParser) primary() (float64, error) {
+	c := p.peek()
+	switch {
+	case c == '(':
+		p.pos++
+		v, err := p.expr()
+		if err != nil {
+			return 0, err
+		}
+		if p.peek() != ')' {
+			return 0, p.errorf("missing )")
+		}
+		p.pos++
+		return v, nil
+	case '0' <= c && c <= '9' || c == '.':
+		return p.number()
+	case 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z':
+		return p.identifier()
+	case c == 0:
+		return 0, p.errorf("unexpected end of expression")
+	}
+	return 0, p.errorf("unexpected %q", c)
+}
+
+func (p *exprParser) number() (float64, error) {
+	start := p.pos
+	for p.pos < len(p.src) && ('0' <= p.src[p.pos] && p.src[p.pos] <= '9' || p.src[p.pos] == '.') {
+		p.pos++
+	}
+	// An exponent, like 1.5e-3
+	if p.pos+1 < len(p.src) && (p.src[p.pos] == 'e' || p.src[p.pos] == 'E') {
+		i := p.pos + 1
+		if p.src[i] == '+' || p.src[i] == '-' {
+			i++
+		}
+		if i < len(p.src) && '0' <= p.src[i] && p.src[i] <= '9' {
+			for p.pos = i; p.pos < len(p.src) && '0' <= p.src[p.pos] && p.src[p.pos] <= '9'; p.pos++ {
+			}
+		}
+	}
+	text := p.src[start:p.pos]
+	v, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		p.pos = start
+		return 0, p.errorf("invalid number %q", text)
+	}
+	return v, nil
+}
+
+func (p *exprParser) identifier() (float64, error) {
+	start := p.pos
+	for p.pos < len(p.src) && isIdentByte(p.src[p.pos]) {
+		p.pos++
+	}
+	name := p.src[start:p.pos]
+	fn, ok := calcFunctions[name]
+	if !ok {
+		if v, ok := calcConstants[name]; ok {
+			return v, nil
+		}
+		p.pos = start
+		return 0, p.errorf("unknown name %q", name)
+	}
+	if p.peek() != '(' {
+		return 0, p.errorf("%s needs arguments in parentheses", name)
+	}
+	p.pos++
+	var args []float64
+	for {
+		v, err := p.expr()
+		if err != nil {
+			return 0, err
+		}
+		args = append(args, v)
+		if c := p.peek(); c == ',' {
+			p.pos++
+			continue
+		} else if c != ')' {
+			return 0, p.errorf("missing ) after the arguments of %s", name)
+		}
+		p.pos++
+		break
+	}
+	if fn.args >= 0 && len(args) != fn.args {
+		return 0, fmt.Errorf("%s takes %d argument(s), got %d", name, fn.args, len(args))
+	}
+	return fn.fn(args), nil
+}
+
+func isIdentByte(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '_'
+}
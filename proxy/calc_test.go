@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestEvaluate(t *testing.T) {
+	for expr, want := range map[string]float64{
+		"1 + 2 * 3":                7,
+		"(1 + 2) * 3":              9,
+		"0.1 + 0.2":                0.3,
+		"2 ^ 3 ^ 2":                512,
+		"2 ** 10":                  1024,
+		"-2 ^ 2":                   -4,
+		"2 ^ -1":                   0.5,
+		"10 % 4 - -3":              5,
+		"1.5e3 / 3":                500,
+		"sqrt(16) + abs(-2)":       6,
+		"max(1, 7, 3) - min(4, 2)": 5,
+		"round(pi * 100) / 100":    3.14,
+		"log(1000) + ln(e)":        4,
+		"pow(2, 0.5) * sqrt(2)":    2,
+		"12.5% 5":                  2.5,
+	} {
+		got, err := evaluate(expr)
+		if err != nil || got != want {
+			t.Errorf("Expected %s = %v, got %v (%v)", expr, want, got, err)
+		}
+	}
+}
+
+func TestEvaluateErrors(t *testing.T) {
+	for expr, want := range map[string]string{
+		"1 +":         "end of expression",
+		"1 / (2 - 2)": "division by zero",
+		"sqrt(-1)":    "not a finite number",
+		"foo(1)":      `unknown name "foo"`,
+		"sqrt 4":      "needs arguments",
+		"pow(2)":      "takes 2 argument(s)",
+		"(1 + 2":      "missing )",
+		"1 2":         `unexpected '2'`,
+		"1..2":        "invalid number",
+		"2e":          `unexpected 'e'`,
+		"os.exit(1)":  "unknown name",
+		strings.Repeat("(", 200) + "1" + strings.Repeat(")", 200): "nested too deeply",
+		strings.Repeat("-", 500) + "1":                            "nested too deeply",
+		strings.Repeat("1+", 600) + "1":                           "longer than",
+	} {
+		if _, err := evaluate(expr); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected an error containing %q for %.30s, got %v", want, expr, err)
+		}
+	}
+}
+
+func TestCalculator_Call(t *testing.T) {
+	output, err := calculator{}.call(context.Background(), `{"expression": "19.99 * 3"}`)
+	if err != nil || output != `{"expression":"19.99 * 3","result":59.97}` {
+		t.Errorf("Expected the result as JSON, got %s (%v)", output, err)
+	}
+	if _, err := (calculator{}).call(context.Background(), `{"expr": "1"}`); err == nil {
+		t.Error("Expected an error without an expression")
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"sync"
+)
+
+// Chat completions in flight can be cancelled by request ID from another
+// connection, e.g. when a user clicks "stop" in a UI whose backend did not
+// make the request. The upstream call is abandoned and the request answered
+// and accounted for as cancelled.
+
+// statusClientClosedRequest is the status of cancelled requests, after
+// nginx's 499
+const statusClientClosedRequest = 499
+
+// contextOpenAIClient is implemented by clients that can abandon an
+// upstream call when its context is cancelled
+type contextOpenAIClient interface {
+	CreateChatCompletionContext(ctx context.Context, req ChatCompletionRequest) (*ChatCompletionResponse, error)
+}
+
+// chatCompletion sends req upstream, abandoning the call when ctx is
+// cancelled if the client supports it
+func (s *ProxyServer) chatCompletion(ctx context.Context, req ChatCompletionRequest) (*ChatCompletionResponse, error) {
+	if client, ok := s.client.(contextOpenAIClient); ok {
+		return client.CreateChatCompletionContext(ctx, req)
+	}
+	return s.client.CreateChatCompletion(req)
+}
+
+// inflightCompletion is a chat completion that can be cancelled
+type inflightCompletion struct {
+	key    *ClientKey
+	cancel context.CancelFunc
+}
+
+// inflightCompletions are the chat completions in flight by request ID.
+// Request IDs are chosen by clients, so several keys can use the same one;
+// each key's request is kept apart and only those a key may cancel are
+// ever found by it.
+type inflightCompletions struct {
+	mu       sync.Mutex
+	requests map[string][]*inflightCompletion
+}
+
+func newInflightCompletions() *inflightCompletions {
+	return &inflightCompletions{requests: make(map[string][]*inflightCompletion)}
+}
+
+// Start registers the request with ID id, unless it has none, and returns
+// the context to make it in and a function to call once it is done. It
+// replaces a request key already has in flight with that ID.
+func (c *inflightCompletions) Start(ctx context.Context, id string, key *ClientKey) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	if id == "" {
+		return ctx, cancel
+	}
+	req := &inflightCompletion{key: key, cancel: cancel}
+	c.mu.Lock()
+	others := slices.DeleteFunc(c.requests[id], func(other *inflightCompletion) bool {
+		return sameKey(other.key, key)
+	})
+	c.requests[id] = append(others, req)
+	c.mu.Unlock()
+	return ctx, func() {
+		c.mu.Lock()
+		c.remove(id, func(other *inflightCompletion) bool { return other == req })
+		c.mu.Unlock()
+		cancel()
+	}
+}
+
+// Cancel cancels the requests with ID id on behalf of key and reports
+// whether there was one it may cancel: its own, or one of its tenant's
+func (c *inflightCompletions) Cancel(id string, key *ClientKey) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cancelled := false
+	c.remove(id, func(req *inflightCompletion) bool {
+		if !mayCancel(key, req.key) {
+			return false
+		}
+		req.cancel()
+		cancelled = true
+		return true
+	})
+	return cancelled
+}
+
+// remove drops the requests with ID id matching del. The caller holds c.mu.
+func (c *inflightCompletions) remove(id string, del func(*inflightCompletion) bool) {
+	if left := slices.DeleteFunc(c.requests[id], del); len(left) > 0 {
+		c.requests[id] = left
+	} else {
+		delete(c.requests, id)
+	}
+}
+
+// sameKey reports whether a and b are the same client key, or both none
+func sameKey(a, b *ClientKey) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.ID == b.ID
+}
+
+func mayCancel(key, owner *ClientKey) bool {
+	return sameKey(key, owner) || (key != nil && owner != nil && key.Tenant != "" && key.Tenant == owner.Tenant)
+}
+
+// handleCancelChatCompletion serves POST /v1/chat/completions/{id}/cancel
+func (s *ProxyServer) handleCancelChatCompletion(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	// Requests of other keys are reported as missing, so their IDs cannot
+	// be probed
+	if !s.inflight.Cancel(id, clientKeyFromContext(r.Context())) {
+		http.Error(w, "No chat completion in progress with this ID", http.StatusNotFound)
+		return
+	}
+	if timeline, ok := s.timelines.Get(id); ok {
+		timeline.Add(TimelineCancelled, "")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"id": id, "cancelled": true})
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// blockingOpenAIClient waits for its context to be cancelled
+type blockingOpenAIClient struct {
+	MockOpenAIClient
+	started chan struct{}
+}
+
+func (m *blockingOpenAIClient) CreateChatCompletionContext(ctx context.Context, req ChatCompletionRequest) (*ChatCompletionResponse, error) {
+	close(m.started)
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestProxyServer_CancelChatCompletion(t *testing.T) {
+	client := &blockingOpenAIClient{started: make(chan struct{})}
+	server := NewProxyServer(client)
+	store, _ := NewKeyStore([]ClientKey{
+		{ID: "app", Key: "sk-app", Tenant: "acme"},
+		{ID: "worker", Key: "sk-worker", Tenant: "acme"},
+		{ID: "other", Key: "sk-other", Tenant: "globex"},
+	})
+	server.keys = store
+	handler := server.Handler()
+
+	result := make(chan *httptest.ResponseRecorder)
+	go func() {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "gpt-4o", "messages": [{"role": "user", "content": "Write a novel"}]}`))
+		req.Header.Set("Authorization", "Bearer sk-app")
+		req.Header.Set(requestIDHeader, "gen-1")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		result <- w
+	}()
+	select {
+	case <-client.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The request never reached the upstream")
+	}
+
+	cancel := func(token, id string) int {
+		req := httptest.NewRequest("POST", "/v1/chat/completions/"+id+"/cancel", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+	if code := cancel("sk-other", "gen-1"); code != http.StatusNotFound {
+		t.Errorf("Expected other tenants not to see the request, got %d", code)
+	}
+	if code := cancel("sk-worker", "gen-1"); code != http.StatusOK {
+		t.Fatalf("Expected the tenant's other key to cancel the request, got %d", code)
+	}
+
+	w := <-result
+	if w.Code != statusClientClosedRequest {
+		t.Fatalf("Expected status code %d, got %d: %s", statusClientClosedRequest, w.Code, w.Body.String())
+	}
+	var resp ErrorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Error.Code != "request_cancelled" {
+		t.Errorf("Unexpected error body %s", w.Body.String())
+	}
+	if got := eventNames(timelineOf(t, server, "gen-1")); got != "received,validated,routed,cancelled,completed" {
+		t.Errorf("Unexpected events %s", got)
+	}
+	if code := cancel("sk-app", "gen-1"); code != http.StatusNotFound {
+		t.Errorf("Expected finished requests to be gone, got %d", code)
+	}
+}
+
+func TestInflightCompletions_KeepsKeysApart(t *testing.T) {
+	inflight := newInflightCompletions()
+	app := &ClientKey{ID: "app", Tenant: "acme"}
+	other := &ClientKey{ID: "other", Tenant: "globex"}
+
+	// Another key reusing the ID neither replaces nor finishes the request
+	appCtx, appDone := inflight.Start(context.Background(), "gen-1", app)
+	defer appDone()
+	otherCtx, otherDone := inflight.Start(context.Background(), "gen-1", other)
+	otherDone()
+	if appCtx.Err() != nil {
+		t.Fatal("Expected another key's request to leave the first one running")
+	}
+
+	otherCtx, otherDone = inflight.Start(context.Background(), "gen-1", other)
+	defer otherDone()
+	if !inflight.Cancel("gen-1", other) {
+		t.Fatal("Expected the key to cancel its own request")
+	}
+	if otherCtx.Err() == nil || appCtx.Err() != nil {
+		t.Error("Expected only the cancelling key's request to be cancelled")
+	}
+	if inflight.Cancel("gen-1", other) {
+		t.Error("Expected the other key's request to stay out of reach")
+	}
+	if !inflight.Cancel("gen-1", app) || appCtx.Err() == nil {
+		t.Error("Expected the first key to cancel its request")
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Synthetic monitoring and the same few FAQs make up a share of traffic
+// whose answers never change, yet each one pays for a completion. The
+// answers of PROXY_CANNED_ANSWERS_FILE are served for the prompts they
+// match without calling the upstream.
+
+// CannedAnswer is the reply to chat completions whose last message is a
+// user message matching it
+type CannedAnswer struct {
+	Name string `json:"name"`
+	// Match is a prompt matched whole, ignoring case and surrounding space
+	Match string `json:"match,omitempty"`
+	// Pattern is a regular expression, for answers without a Match
+	Pattern string `json:"pattern,omitempty"`
+	// Models, if set, limits the answer to requests for these models, with
+	// a trailing * matching any
+	Models []string `json:"models,omitempty"`
+	// Tenant, if set, limits the answer to that tenant's keys
+	Tenant string `json:"tenant,omitempty"`
+	Answer string `json:"answer"`
+
+	re *regexp.Regexp
+}
+
+// loadCannedAnswers reads the canned answers of a JSON file
+func loadCannedAnswers(path string) ([]CannedAnswer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read canned answers file: %w", err)
+	}
+	var answers []CannedAnswer
+	if err := json.Unmarshal(data, &answers); err != nil {
+		return nil, fmt.Errorf("failed to parse canned answers file: %w", err)
+	}
+	for i, a := range answers {
+		if a.Name == "" || a.Answer == "" {
+			return nil, fmt.Errorf("canned answer %q requires a name and an answer", a.Name)
+		}
+		if (a.Match == "") == (a.Pattern == "") {
+			return nil, fmt.Errorf("canned answer %s requires either match or pattern", a.Name)
+		}
+		if a.Pattern != "" {
+			if answers[i].re, err = regexp.Compile(a.Pattern); err != nil {
+				return nil, fmt.Errorf("canned answer %s: invalid pattern: %w", a.Name, err)
+			}
+		}
+	}
+	return answers, nil
+}
+
+// Matches reports whether the answer is for a prompt to model
+func (a CannedAnswer) Matches(prompt, model, tenant string) bool {
+	if a.Tenant != "" && a.Tenant != tenant {
+		return false
+	}
+	if len(a.Models) > 0 && !matchAny(a.Models, model) {
+		return false
+	}
+	if a.re != nil {
+		return a.re.MatchString(prompt)
+	}
+	return strings.EqualFold(strings.TrimSpace(prompt), strings.TrimSpace(a.Match))
+}
+
+// withCannedAnswers answers chat completions matching a canned answer
+// without calling the handler, streamed if the request asks for a stream
+func (s *ProxyServer) withCannedAnswers(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Other endpoints share the middleware chain but expect replies of
+		// their own shape
+		if len(s.cannedAnswers) == 0 || r.URL.Path != "/v1/chat/completions" {
+			next(w, r)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		var req struct {
+			Model    string    `json:"model"`
+			Messages []Message `json:"messages"`
+			Stream   *bool     `json:"stream"`
+		}
+		if json.Unmarshal(body, &req) != nil || req.Model == "" || len(req.Messages) == 0 {
+			next(w, r)
+			return
+		}
+		key := clientKeyFromContext(r.Context())
+		var tenant string
+		if key != nil {
+			if !key.AllowsModel(req.Model) {
+				next(w, r)
+				return
+			}
+			tenant = key.Tenant
+		}
+		last := req.Messages[len(req.Messages)-1]
+		if last.Role != "user" {
+			next(w, r)
+			return
+		}
+		var answer *CannedAnswer
+		for i, a := range s.cannedAnswers {
+			if a.Matches(last.Content, req.Model, tenant) {
+				answer = &s.cannedAnswers[i]
+				break
+			}
+		}
+		if answer == nil {
+			next(w, r)
+			return
+		}
+
+		timeline := timelineFromContext(r.Context())
+		timeline.Add(TimelineCanned, answer.Name)
+		s.metrics.cannedAnswers.Add(1, answer.Name)
+		w.Header().Set("X-Canned-Answer", answer.Name)
+		id := "chatcmpl-canned-" + timeline.id()
+		created := time.Now().Unix()
+		if req.Stream == nil || !*req.Stream {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(ChatCompletionResponse{
+				ID:      id,
+				Object:  "chat.completion",
+				Created: created,
+				Model:   req.Model,
+				Choices: []Choice{{Message: Message{Role: "assistant", Content: answer.Answer}, FinishReason: "stop"}},
+			})
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		stop := "stop"
+		for _, choice := range []chunkChoice{
+			{Delta: chunkDelta{Role: "assistant", Content: answer.Answer}},
+			{Delta: chunkDelta{}, FinishReason: &stop},
+		} {
+			data, _ := json.Marshal(chatCompletionChunk{ID: id, Object: "chat.completion.chunk", Created: created, Model: req.Model, Choices: []chunkChoice{choice}})
+			fmt.Fprintf(w, "data: %s\n\n", data)
+		}
+		io.WriteString(w, "data: [DONE]\n\n")
+	}
+}
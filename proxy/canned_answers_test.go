@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeCannedAnswersFile(t *testing.T, answers string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "canned.json")
+	if err := os.WriteFile(path, []byte(answers), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadCannedAnswers(t *testing.T) {
+	for _, invalid := range []string{
+		`[{"match": "ping", "answer": "pong"}]`,
+		`[{"name": "ping", "match": "ping"}]`,
+		`[{"name": "ping", "answer": "pong"}]`,
+		`[{"name": "ping", "match": "ping", "pattern": "ping", "answer": "pong"}]`,
+		`[{"name": "ping", "pattern": "(", "answer": "pong"}]`,
+	} {
+		if _, err := loadCannedAnswers(writeCannedAnswersFile(t, invalid)); err == nil {
+			t.Errorf("Expected an error for %s", invalid)
+		}
+	}
+}
+
+func TestProxyServer_CannedAnswers(t *testing.T) {
+	client := &recordingOpenAIClient{MockOpenAIClient: MockOpenAIClient{response: createTestChatCompletionResponse()}}
+	server := NewProxyServer(client)
+	server.submissions = nil
+	var err error
+	server.cannedAnswers, err = loadCannedAnswers(writeCannedAnswersFile(t, `[
+		{"name": "healthcheck", "match": "Ping", "answer": "pong"},
+		{"name": "hours", "pattern": "(?i)opening hours", "models": ["gpt-4o*"], "answer": "We are open 9 to 5."}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chat := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		server.Handler().ServeHTTP(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body)))
+		return w
+	}
+
+	w := chat(`{"model": "gpt-4o-mini", "messages": [{"role": "system", "content": "Be brief."}, {"role": "user", "content": " ping "}]}`)
+	var resp ChatCompletionResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != http.StatusOK || w.Header().Get("X-Canned-Answer") != "healthcheck" || len(resp.Choices) != 1 || resp.Choices[0].Message.Content != "pong" || resp.Model != "gpt-4o-mini" {
+		t.Errorf("Expected the canned answer, got %d %s", w.Code, w.Body.String())
+	}
+	if client.last.Model != "" {
+		t.Error("Expected nothing to be sent upstream")
+	}
+
+	w = chat(`{"model": "gpt-4o", "stream": true, "messages": [{"role": "user", "content": "What are your opening hours?"}]}`)
+	if w.Header().Get("Content-Type") != "text/event-stream" || !strings.Contains(w.Body.String(), `"content":"We are open 9 to 5."`) || !strings.HasSuffix(w.Body.String(), "data: [DONE]\n\n") {
+		t.Errorf("Expected the canned answer streamed, got %s", w.Body.String())
+	}
+
+	// Other models and prompts go upstream
+	for _, body := range []string{
+		`{"model": "o1", "messages": [{"role": "user", "content": "What are your opening hours?"}]}`,
+		`{"model": "gpt-4o", "messages": [{"role": "user", "content": "ping me later"}]}`,
+	} {
+		client.last = ChatCompletionRequest{}
+		if w := chat(body); w.Header().Get("X-Canned-Answer") != "" || client.last.Model == "" {
+			t.Errorf("Expected %s to go upstream, got %s", body, w.Body.String())
+		}
+	}
+}
+
+func TestProxyServer_CannedAnswersOnlyForChatCompletions(t *testing.T) {
+	server := NewProxyServer(&MockOpenAIClient{response: createTestChatCompletionResponse()})
+	var err error
+	server.cannedAnswers, err = loadCannedAnswers(writeCannedAnswersFile(t, `[{"name": "healthcheck", "match": "Ping", "answer": "pong"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	called := false
+	handler := server.withCannedAnswers(func(w http.ResponseWriter, r *http.Request) { called = true })
+	body := `{"model": "gpt-4o-mini", "messages": [{"role": "user", "content": "Ping"}]}`
+	handler(httptest.NewRecorder(), httptest.NewRequest("POST", "/v1/pipelines/triage/run", strings.NewReader(body)))
+	if !called {
+		t.Error("Expected requests to other endpoints to reach their handler")
+	}
+}
@@ -0,0 +1,217 @@
+//go:build !edge && !wasip1
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Code execution modes, chosen with PROXY_CODE_EXECUTION
+const (
+	CodeExecutionOff = "off"
+	// Code runs in a child process with resource limits, optionally under
+	// a sandbox such as gVisor's runsc given as PROXY_CODE_EXECUTION_COMMAND
+	CodeExecutionSubprocess = "subprocess"
+)
+
+// codeExecMaxOutput caps what is kept of the stdout and of the stderr of a
+// run
+const codeExecMaxOutput = 64 << 10
+
+const codeToolParameters = `{
+	"type": "object",
+	"properties": {
+		"code": {"type": "string", "description": "The complete program. Print what you need to see."}
+	},
+	"required": ["code"]
+}`
+
+// codeExecutor runs the code passed to the run_code and python builtin
+// tools. The child has a temporary working directory, an empty environment
+// and limits on CPU time, memory, file sizes and open files, and its whole
+// process group is killed on timeout. It shares the network and the file
+// system of the proxy, so anything stronger is left to the sandbox command.
+type codeExecutor struct {
+	// command reads the program from stdin and runs it
+	command []string
+	timeout time.Duration
+	// memoryMB limits the address space of the interpreter, 0 for sandboxes
+	// that enforce their own limits
+	memoryMB int
+	// slots limits how many programs run at once
+	slots chan struct{}
+}
+
+func newCodeExecutor(command []string) *codeExecutor {
+	return &codeExecutor{
+		command:  command,
+		timeout:  10 * time.Second,
+		memoryMB: 256,
+		slots:    make(chan struct{}, runtime.NumCPU()),
+	}
+}
+
+// CodeExecResult is what the model sees of a run
+type CodeExecResult struct {
+	Stdout   string `json:"stdout"`
+	Stderr   string `json:"stderr"`
+	ExitCode int    `json:"exit_code"`
+	TimedOut bool   `json:"timed_out,omitempty"`
+	// Truncated is set when the output was longer than the proxy keeps
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+func (e *codeExecutor) definition(name string) ToolFunction {
+	return ToolFunction{
+		Name:        name,
+		Description: "Runs a Python program in a sandbox without user input and returns its stdout, stderr and exit code. Use it for calculations and data processing.",
+		Parameters:  json.RawMessage(codeToolParameters),
+	}
+}
+
+func (e *codeExecutor) call(ctx context.Context, arguments string) (string, error) {
+	var args struct {
+		Code string `json:"code"`
+	}
+	if err := json.Unmarshal([]byte(arguments), &args); err != nil || args.Code == "" {
+		return "", fmt.Errorf(`arguments must be an object with the program in "code"`)
+	}
+	result, err := e.run(ctx, args.Code)
+	if err != nil {
+		return "", err
+	}
+	out, err := json.Marshal(result)
+	return string(out), err
+}
+
+// run executes one program
+func (e *codeExecutor) run(ctx context.Context, code string) (CodeExecResult, error) {
+	select {
+	case e.slots <- struct{}{}:
+		defer func() { <-e.slots }()
+	case <-ctx.Done():
+		return CodeExecResult{}, ctx.Err()
+	}
+	dir, err := os.MkdirTemp("", "vibethon-code-")
+	if err != nil {
+		return CodeExecResult{}, fmt.Errorf("failed to create working directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithTimeout(ctx, e.timeout)
+	defer cancel()
+	// The shell limits itself, then becomes the interpreter. CPU time is
+	// limited as well as the wall clock, for programs that fork. File sizes
+	// are in blocks of 512 or 1024 bytes depending on the shell.
+	limits := []string{
+		"ulimit -t " + strconv.Itoa(int(e.timeout.Seconds())+1),
+		"ulimit -f 32768",
+		"ulimit -n 64",
+	}
+	if e.memoryMB > 0 {
+		limits = append(limits, "ulimit -v "+strconv.Itoa(e.memoryMB<<10))
+	}
+	script := strings.Join(append(limits, `exec "$@"`), " && ")
+	cmd := exec.CommandContext(ctx, "/bin/sh", append([]string{"-c", script, "sh"}, e.command...)...)
+	cmd.Dir = dir
+	cmd.Env = []string{"PATH=/usr/local/bin:/usr/bin:/bin", "HOME=" + dir, "TMPDIR=" + dir, "LANG=C.UTF-8", "PYTHONDONTWRITEBYTECODE=1"}
+	cmd.Stdin = strings.NewReader(code)
+	stdout, stderr := &cappedBuffer{max: codeExecMaxOutput}, &cappedBuffer{max: codeExecMaxOutput}
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	// Kill what the program started too
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error { return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL) }
+	cmd.WaitDelay = time.Second
+
+	err = cmd.Run()
+	result := CodeExecResult{
+		Stdout:    stdout.String(),
+		Stderr:    stderr.String(),
+		Truncated: stdout.truncated || stderr.truncated,
+	}
+	var exitErr *exec.ExitError
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		result.TimedOut, result.ExitCode = true, -1
+	case errors.As(err, &exitErr):
+		// -1 when killed by a signal, e.g. for exceeding the CPU limit
+		result.ExitCode = exitErr.ExitCode()
+	case err != nil:
+		return CodeExecResult{}, fmt.Errorf("failed to run code: %w", err)
+	}
+	return result, nil
+}
+
+// cappedBuffer keeps the first max bytes written to it
+type cappedBuffer struct {
+	max       int
+	buf       []byte
+	truncated bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	keep := min(len(p), b.max-len(b.buf))
+	b.buf = append(b.buf, p[:keep]...)
+	if keep < len(p) {
+		b.truncated = true
+	}
+	return len(p), nil
+}
+
+func (b *cappedBuffer) String() string {
+	return strings.ToValidUTF8(string(b.buf), "�")
+}
+
+// codeExecutorFromEnv configures code execution from PROXY_CODE_EXECUTION.
+// It returns nil when it is off, which is the default.
+func codeExecutorFromEnv(getenv func(string) string) (*codeExecutor, error) {
+	switch mode := getenv("PROXY_CODE_EXECUTION"); mode {
+	case "", CodeExecutionOff:
+		return nil, nil
+	case CodeExecutionSubprocess:
+	default:
+		return nil, fmt.Errorf("invalid PROXY_CODE_EXECUTION %q", mode)
+	}
+	command := []string{"python3", "-I", "-"}
+	if v := getenv("PROXY_CODE_EXECUTION_COMMAND"); v != "" {
+		command = strings.Fields(v)
+	}
+	e := newCodeExecutor(command)
+	if v := getenv("PROXY_CODE_EXECUTION_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < time.Second {
+			return nil, fmt.Errorf("invalid PROXY_CODE_EXECUTION_TIMEOUT %q", v)
+		}
+		e.timeout = d
+	}
+	if v := getenv("PROXY_CODE_EXECUTION_MEMORY_MB"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid PROXY_CODE_EXECUTION_MEMORY_MB %q", v)
+		}
+		e.memoryMB = n
+	}
+	return e, nil
+}
+
+// addCodeExecutor offers the run_code and python tools when code execution
+// is configured
+func (s *ProxyServer) addCodeExecutor(getenv func(string) string) error {
+	executor, err := codeExecutorFromEnv(getenv)
+	if err != nil || executor == nil {
+		return err
+	}
+	s.builtinTools["run_code"] = executor
+	s.builtinTools["python"] = executor
+	return nil
+}
@@ -0,0 +1,95 @@
+//go:build !edge && !wasip1
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The tests run shell scripts, which the shell reads from stdin like the
+// interpreter does
+func TestCodeExecutor_Run(t *testing.T) {
+	e := newCodeExecutor([]string{"/bin/sh"})
+	result, err := e.run(context.Background(), "echo hello; pwd; echo oops >&2; exit 3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(result.Stdout), "\n")
+	if len(lines) != 2 || lines[0] != "hello" || !strings.Contains(lines[1], "vibethon-code-") {
+		t.Errorf("Expected the output from a temporary directory, got %q", result.Stdout)
+	}
+	if result.Stderr != "oops\n" || result.ExitCode != 3 || result.TimedOut {
+		t.Errorf("Expected stderr and exit code 3, got %+v", result)
+	}
+	if _, err := os.Stat(lines[1]); !os.IsNotExist(err) {
+		t.Errorf("Expected the working directory to be removed, got %v", err)
+	}
+
+	// The environment of the proxy is not passed on
+	t.Setenv("OPENAI_API_KEY", "sk-secret")
+	result, _ = e.run(context.Background(), "env")
+	if strings.Contains(result.Stdout, "sk-secret") {
+		t.Errorf("Expected an empty environment, got %q", result.Stdout)
+	}
+}
+
+func TestCodeExecutor_Limits(t *testing.T) {
+	e := newCodeExecutor([]string{"/bin/sh"})
+	e.timeout = 200 * time.Millisecond
+	start := time.Now()
+	// The background sleep shares the process group and is killed too
+	result, err := e.run(context.Background(), "sleep 30 & sleep 30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.TimedOut || time.Since(start) > 5*time.Second {
+		t.Errorf("Expected the run to time out quickly, got %+v after %v", result, time.Since(start))
+	}
+
+	e.timeout = 10 * time.Second
+	result, _ = e.run(context.Background(), "yes | head -c 100000")
+	if !result.Truncated || len(result.Stdout) != codeExecMaxOutput {
+		t.Errorf("Expected the output truncated to %d bytes, got %d", codeExecMaxOutput, len(result.Stdout))
+	}
+	result, _ = e.run(context.Background(), "ulimit -v; ulimit -n")
+	if result.Stdout != "262144\n64\n" {
+		t.Errorf("Expected the memory and file limits, got %q", result.Stdout)
+	}
+}
+
+func TestCodeExecutor_Call(t *testing.T) {
+	e := newCodeExecutor([]string{"/bin/sh"})
+	output, err := e.call(context.Background(), `{"code": "echo 42"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result CodeExecResult
+	if err := json.Unmarshal([]byte(output), &result); err != nil || result.Stdout != "42\n" || result.ExitCode != 0 {
+		t.Errorf("Expected the result as JSON, got %s (%v)", output, err)
+	}
+	if _, err := e.call(context.Background(), `{"source": "echo 42"}`); err == nil {
+		t.Error("Expected an error without code")
+	}
+}
+
+func TestCodeExecutorFromEnv(t *testing.T) {
+	if e, err := codeExecutorFromEnv(os.Getenv); e != nil || err != nil {
+		t.Errorf("Expected code execution off by default, got %v (%v)", e, err)
+	}
+	t.Setenv("PROXY_CODE_EXECUTION", "subprocess")
+	t.Setenv("PROXY_CODE_EXECUTION_COMMAND", "runsc --network=none do python3 -I -")
+	t.Setenv("PROXY_CODE_EXECUTION_MEMORY_MB", "0")
+	e, err := codeExecutorFromEnv(os.Getenv)
+	if err != nil || len(e.command) != 6 || e.memoryMB != 0 || e.timeout != 10*time.Second {
+		t.Errorf("Expected the sandbox command without a memory limit, got %+v (%v)", e, err)
+	}
+	t.Setenv("PROXY_CODE_EXECUTION", "docker")
+	if _, err := codeExecutorFromEnv(os.Getenv); err == nil {
+		t.Error("Expected an error for an unknown mode")
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Deterministic chat completions, those with a temperature of 0 or whose
+// client opts in with X-Allow-Cache, can be answered from a cache of earlier
+// replies, which makes repeated eval runs cheap and fast. Requests are keyed
+// by a hash of everything in them but the stream and user fields, within
+// the tenant or, without one, the key that sent them, so nothing is shared
+// across tenants. Responses say whether they came from the cache in X-Cache.
+
+const (
+	// allowCacheHeader opts a request in to the cache with "true", or out
+	// of it with "false"
+	allowCacheHeader = "X-Allow-Cache"
+	// maxCachedCompletion bounds the replies that are cached
+	maxCachedCompletion = 1 << 20
+)
+
+// cachedCompletion is a reply in the completion cache
+type cachedCompletion struct {
+	body   []byte
+	stored time.Time
+}
+
+// completionCacheKey returns the key a chat completion request is cached
+// under, or "" if it is not cached, and whether the cache may answer it.
+// Clients sending Cache-Control: no-cache get a fresh reply that replaces
+// the cached one.
+func (s *ProxyServer) completionCacheKey(r *http.Request, body []byte) (string, bool) {
+	optIn := r.Header.Get(allowCacheHeader)
+	if s.completions.size <= 0 || optIn == "false" {
+		return "", false
+	}
+	var req map[string]any
+	// Replies to sessions depend on their history, which the body leaves out
+	if err := json.Unmarshal(body, &req); err != nil || req["stream"] == true || req["session"] != nil {
+		return "", false
+	}
+	if temperature, ok := req["temperature"].(float64); optIn != "true" && (!ok || temperature != 0) {
+		return "", false
+	}
+	key := clientKeyFromContext(r.Context())
+	// Cached replies skip the handlers, which check model scopes
+	if model, _ := req["model"].(string); key != nil && !key.AllowsModel(model) {
+		return "", false
+	}
+	scope, tenant := cacheScope(key)
+	if !s.featureEnabled(FeatureCache, "chat.completions", tenant) {
+		return "", false
+	}
+	delete(req, "stream")
+	delete(req, "user")
+	id := cacheKey(struct {
+		Scope   string
+		Request map[string]any
+	}{scope, req})
+	return id, !strings.Contains(r.Header.Get("Cache-Control"), "no-cache")
+}
+
+// cacheScope returns the scope replies to key's requests are cached in, its
+// tenant's or its own, and the tenant
+func cacheScope(key *ClientKey) (string, string) {
+	switch {
+	case key == nil:
+		return "", ""
+	case key.Tenant != "":
+		return "tenant:" + key.Tenant, key.Tenant
+	}
+	return "key:" + key.ID, ""
+}
+
+// serveCachedCompletion answers a request from the cache if it can
+func (s *ProxyServer) serveCachedCompletion(w http.ResponseWriter, id string) bool {
+	entry, ok := s.completions.Get(id)
+	if !ok {
+		s.metrics.cacheLookups.Add(1, "chat.completions", "miss")
+		return false
+	}
+	s.metrics.cacheLookups.Add(1, "chat.completions", "hit")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Cache", "HIT")
+	w.Header().Set("Age", strconv.Itoa(int(time.Since(entry.stored).Seconds())))
+	w.Write(entry.body)
+	return true
+}
+
+// completionRecorder keeps a copy of a successful reply for the cache
+type completionRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (c *completionRecorder) WriteHeader(status int) {
+	if c.status == 0 {
+		c.status = status
+	}
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *completionRecorder) Write(p []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	if c.status == http.StatusOK && c.body.Len()+len(p) <= maxCachedCompletion {
+		c.body.Write(p)
+	} else {
+		c.status = -1
+	}
+	return c.ResponseWriter.Write(p)
+}
+
+func (c *completionRecorder) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+// store caches the recorded reply, if it was a complete JSON one
+func (c *completionRecorder) store(cache *lruCache[cachedCompletion], id string) {
+	if c.status != http.StatusOK || !strings.HasPrefix(c.Header().Get("Content-Type"), "application/json") {
+		return
+	}
+	cache.Put(id, cachedCompletion{body: c.body.Bytes(), stored: time.Now()})
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+type countingOpenAIClient struct {
+	calls atomic.Int32
+}
+
+func (c *countingOpenAIClient) CreateChatCompletion(req ChatCompletionRequest) (*ChatCompletionResponse, error) {
+	c.calls.Add(1)
+	return createTestChatCompletionResponse(), nil
+}
+
+func newCachingProxy(t *testing.T) (*countingOpenAIClient, http.Handler) {
+	t.Helper()
+	client := &countingOpenAIClient{}
+	server := NewProxyServer(client)
+	server.keys = createTestKeyStore(t)
+	server.keys.Add(ClientKey{ID: "other", Key: "sk-other"})
+	server.completions.size = 100
+	// Identical requests in a row would be collapsed as duplicates
+	server.submissions = nil
+	return client, server.Handler()
+}
+
+func postCached(handler http.Handler, secret, body string, headers ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+secret)
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func TestProxyServer_CompletionCache(t *testing.T) {
+	client, handler := newCachingProxy(t)
+	deterministic := `{"model": "gpt-4o", "temperature": 0, "messages": [{"role": "user", "content": "Hi"}]}`
+
+	first := postCached(handler, "sk-full", deterministic)
+	if first.Code != http.StatusOK || first.Header().Get("X-Cache") != "MISS" {
+		t.Fatalf("Expected a miss, got %d %s", first.Code, first.Header().Get("X-Cache"))
+	}
+	// Whitespace, field order and the user field do not change the key
+	second := postCached(handler, "sk-full", `{"messages":[{"role":"user","content":"Hi"}],"model":"gpt-4o","temperature":0,"user":"u1"}`)
+	if second.Header().Get("X-Cache") != "HIT" || second.Body.String() != first.Body.String() {
+		t.Errorf("Expected the cached reply, got %s %s", second.Header().Get("X-Cache"), second.Body.String())
+	}
+	if n := client.calls.Load(); n != 1 {
+		t.Errorf("Expected one upstream call, got %d", n)
+	}
+
+	// Other keys do not share the cache, and no-cache refreshes it
+	if w := postCached(handler, "sk-other", deterministic); w.Header().Get("X-Cache") != "MISS" {
+		t.Errorf("Expected keys not to share cached replies, got %s", w.Header().Get("X-Cache"))
+	}
+	if w := postCached(handler, "sk-full", deterministic, "Cache-Control", "no-cache"); w.Header().Get("X-Cache") != "MISS" {
+		t.Errorf("Expected no-cache to skip the cache, got %s", w.Header().Get("X-Cache"))
+	}
+	if n := client.calls.Load(); n != 3 {
+		t.Errorf("Expected three upstream calls, got %d", n)
+	}
+}
+
+func TestProxyServer_CompletionCache_Eligibility(t *testing.T) {
+	client, handler := newCachingProxy(t)
+	sampled := `{"model": "gpt-4o", "temperature": 0.7, "messages": [{"role": "user", "content": "Hi"}]}`
+
+	for i := 0; i < 2; i++ {
+		if w := postCached(handler, "sk-full", sampled); w.Header().Get("X-Cache") != "" {
+			t.Errorf("Expected sampled requests not to be cached, got %s", w.Header().Get("X-Cache"))
+		}
+	}
+	postCached(handler, "sk-full", sampled, allowCacheHeader, "true")
+	if w := postCached(handler, "sk-full", sampled, allowCacheHeader, "true"); w.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("Expected requests that opt in to be cached, got %s", w.Header().Get("X-Cache"))
+	}
+	if n := client.calls.Load(); n != 3 {
+		t.Errorf("Expected three upstream calls, got %d", n)
+	}
+
+	// A cached reply must not let a key use a model outside its scopes
+	deterministic := `{"model": "gpt-4o", "temperature": 0, "messages": [{"role": "user", "content": "Hi"}]}`
+	if w := postCached(handler, "sk-mini", deterministic); w.Code != http.StatusForbidden {
+		t.Errorf("Expected the model scope to be enforced, got %d", w.Code)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// Upstreams now and then return replies that are technically successful
+// but useless: no content at all although the model says it stopped, or
+// JSON cut off before its end in JSON mode. With PROXY_COMPLETION_RETRY=on,
+// or a tenant's completion_retry, such a reply is retried once with
+// adjusted parameters before it is returned, and the response metadata
+// says so.
+
+// retriesCompletions reports whether suspicious replies to key are retried
+func (s *ProxyServer) retriesCompletions(key *ClientKey) bool {
+	if key != nil && key.Tenant != "" {
+		if tenant, ok := s.tenants.Get(key.Tenant); ok && tenant.CompletionRetry != nil {
+			return *tenant.CompletionRetry
+		}
+	}
+	return s.completionRetry
+}
+
+// suspiciousCompletion returns why a reply looks broken, or "" if it does
+// not
+func suspiciousCompletion(req ChatCompletionRequest, resp *ChatCompletionResponse) string {
+	if len(resp.Choices) == 0 {
+		return "no choices"
+	}
+	choice := resp.Choices[0]
+	if len(choice.Message.ToolCalls) > 0 {
+		return ""
+	}
+	content := choice.Message.Content
+	if content == "" && choice.FinishReason == "stop" {
+		return "empty content"
+	}
+	if format := req.ResponseFormat; format != nil && (format.Type == "json_object" || format.Type == "json_schema") {
+		if !json.Valid([]byte(stripCodeFence(content))) {
+			return "truncated JSON"
+		}
+	}
+	return ""
+}
+
+// retryParameters adjusts a request for another attempt after a reply that
+// was suspicious for reason: truncated replies get twice the tokens, and
+// empty ones a temperature of at least 0.5 so the model does not repeat
+// itself
+func retryParameters(req ChatCompletionRequest, reason string) ChatCompletionRequest {
+	switch reason {
+	case "truncated JSON":
+		if req.MaxTokens != nil {
+			tokens := *req.MaxTokens * 2
+			req.MaxTokens = &tokens
+		}
+	default:
+		if req.Temperature != nil && *req.Temperature < 0.5 {
+			temperature := 0.5
+			req.Temperature = &temperature
+		}
+	}
+	return req
+}
+
+// createCheckedCompletion is createCompletion, retrying a suspicious reply
+// once. The usage of the response adds up both attempts.
+func (s *ProxyServer) createCheckedCompletion(ctx context.Context, req ChatCompletionRequest) (*ChatCompletionResponse, error) {
+	resp, err := s.createCompletion(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	reason := suspiciousCompletion(req, resp)
+	if reason == "" {
+		return resp, nil
+	}
+	timelineFromContext(ctx).Addf(TimelineRetried, "suspicious completion: %s", reason)
+	retried, err := s.createCompletion(ctx, retryParameters(req, reason))
+	if err != nil {
+		return nil, err
+	}
+	out := *retried
+	out.Usage.PromptTokens += resp.Usage.PromptTokens
+	out.Usage.CompletionTokens += resp.Usage.CompletionTokens
+	out.Usage.TotalTokens += resp.Usage.TotalTokens
+	metadata := ResponseMetadata{}
+	if retried.Metadata != nil {
+		metadata = *retried.Metadata
+	}
+	metadata.CompletionRetries = 1
+	metadata.CompletionRetryReason = reason
+	out.Metadata = &metadata
+	return &out, nil
+}
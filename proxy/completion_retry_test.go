@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestProxyServer_CompletionRetryEmpty(t *testing.T) {
+	client := &scriptedOpenAIClient{replies: []string{"", "Hello!"}}
+	server := NewProxyServer(client)
+	server.completionRetry = true
+
+	w := chatRequestAs(server, nil, `{"model": "gpt-4o", "temperature": 0, "messages": [{"role": "user", "content": "Hi"}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var resp ChatCompletionResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Choices[0].Message.Content != "Hello!" {
+		t.Errorf("Expected the retried reply, got %q", resp.Choices[0].Message.Content)
+	}
+	if resp.Metadata == nil || resp.Metadata.CompletionRetries != 1 || resp.Metadata.CompletionRetryReason != "empty content" {
+		t.Errorf("Expected the retry in the metadata, got %+v", resp.Metadata)
+	}
+	if resp.Usage.TotalTokens != 64 {
+		t.Errorf("Expected the usage of both attempts, got %d", resp.Usage.TotalTokens)
+	}
+	if len(client.requests) != 2 || *client.requests[1].Temperature != 0.5 {
+		t.Errorf("Expected one retry with a higher temperature, got %+v", client.requests)
+	}
+}
+
+func TestProxyServer_CompletionRetryTruncatedJSON(t *testing.T) {
+	client := &scriptedOpenAIClient{replies: []string{`{"name": "A`, `{"name": "Ann"}`}}
+	server := NewProxyServer(client)
+	server.completionRetry = true
+
+	w := chatRequestAs(server, nil, `{"model": "gpt-4o", "max_tokens": 5, "response_format": {"type": "json_object"}, "messages": [{"role": "user", "content": "Who?"}]}`)
+	var resp ChatCompletionResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Metadata == nil || resp.Metadata.CompletionRetryReason != "truncated JSON" {
+		t.Errorf("Expected a retry of the truncated JSON, got %+v", resp.Metadata)
+	}
+	if len(client.requests) != 2 || *client.requests[1].MaxTokens != 10 {
+		t.Errorf("Expected the retry to get more tokens, got %+v", client.requests)
+	}
+}
+
+func TestProxyServer_CompletionRetryPerTenant(t *testing.T) {
+	enabled, disabled := true, false
+	client := &scriptedOpenAIClient{replies: []string{""}}
+	server := NewProxyServer(client)
+	server.completionRetry = true
+	server.tenants.Put("acme", Tenant{ID: "acme", CompletionRetry: &disabled})
+	server.tenants.Put("globex", Tenant{ID: "globex", CompletionRetry: &enabled})
+
+	body := `{"model": "gpt-4o", "messages": [{"role": "user", "content": "Hi"}]}`
+	chatRequestAs(server, &ClientKey{ID: "a", Tenant: "acme"}, body)
+	if len(client.requests) != 1 {
+		t.Errorf("Expected the tenant to opt out of retries, got %d requests", len(client.requests))
+	}
+
+	server.completionRetry = false
+	client.requests = nil
+	chatRequestAs(server, &ClientKey{ID: "g", Tenant: "globex"}, body)
+	if len(client.requests) != 2 {
+		t.Errorf("Expected the tenant to opt into retries, got %d requests", len(client.requests))
+	}
+
+	client.requests = nil
+	chatRequestAs(server, nil, body)
+	if len(client.requests) != 1 {
+		t.Errorf("Expected no retries by default, got %d requests", len(client.requests))
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Instead of environment variables, a deployment can describe itself in
+// the TOML file PROXY_CONFIG_FILE names: where it listens, its upstream,
+// any other setting of this document, and its client keys, tenants and
+// routing rules. Environment variables win over the file, so secrets can
+// stay in the environment. Keys, tenants and routing rules, along with
+// their rate limits, are reloaded when the process gets SIGHUP or, with
+// PROXY_WATCH_INTERVAL, when the file changes; other settings take a
+// restart.
+
+// ConfigFile is the content of PROXY_CONFIG_FILE
+type ConfigFile struct {
+	// Listen is the address to listen on, e.g. ":8080" or "127.0.0.1:8080"
+	Listen   string         `json:"listen,omitempty"`
+	Upstream ConfigUpstream `json:"upstream,omitempty"`
+	// Env sets any other setting by the name of its environment variable
+	Env     map[string]any `json:"env,omitempty"`
+	Keys    []ClientKey    `json:"keys,omitempty"`
+	Tenants []Tenant       `json:"tenants,omitempty"`
+	Routes  []RoutingRule  `json:"routes,omitempty"`
+}
+
+// ConfigUpstream is the [upstream] table of the config file
+type ConfigUpstream struct {
+	BaseURL    string `json:"base_url,omitempty"`
+	APIKey     string `json:"api_key,omitempty"`
+	APIKeyFile string `json:"api_key_file,omitempty"`
+	// Timeout bounds a whole upstream request, e.g. "60s"
+	Timeout string `json:"timeout,omitempty"`
+}
+
+// parseConfigFile parses a config file in TOML, or in JSON if its name ends
+// in .json, and checks its keys, tenants and routing rules
+func parseConfigFile(path string, data []byte) (*ConfigFile, error) {
+	if !strings.HasSuffix(path, ".json") {
+		doc, err := parseTOML(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse config file: %w", err)
+		}
+		if data, err = json.Marshal(doc); err != nil {
+			return nil, err
+		}
+	}
+	var cfg ConfigFile
+	dec := json.NewDecoder(strings.NewReader(string(data)))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	}
+	for _, key := range cfg.Keys {
+		if err := validateClientKey(key); err != nil {
+			return nil, err
+		}
+	}
+	tenants := make(map[string]bool)
+	for _, tenant := range cfg.Tenants {
+		if tenant.ID == "" || tenants[tenant.ID] {
+			return nil, fmt.Errorf("tenant %q needs an id of its own", tenant.ID)
+		}
+		tenants[tenant.ID] = true
+		if err := tenant.validate(); err != nil {
+			return nil, fmt.Errorf("tenant %s: %w", tenant.ID, err)
+		}
+	}
+	routes := make(map[string]bool)
+	for _, rule := range cfg.Routes {
+		if rule.ID == "" || rule.Model == "" || rule.TargetModel == "" || routes[rule.ID] {
+			return nil, fmt.Errorf("routing rule %q requires a unique id, model and target_model", rule.ID)
+		}
+		routes[rule.ID] = true
+	}
+	return &cfg, nil
+}
+
+// settings returns the settings of the file by environment variable name
+func (cfg *ConfigFile) settings() map[string]string {
+	settings := make(map[string]string)
+	for name, v := range cfg.Env {
+		switch v := v.(type) {
+		case string:
+			settings[name] = v
+		case float64:
+			settings[name] = strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			settings[name] = fmt.Sprint(v)
+		}
+	}
+	for name, v := range map[string]string{
+		"PROXY_LISTEN_ADDRESS":   cfg.Listen,
+		"OPENAI_BASE_URL":        cfg.Upstream.BaseURL,
+		"OPENAI_API_KEY":         cfg.Upstream.APIKey,
+		"OPENAI_API_KEY_FILE":    cfg.Upstream.APIKeyFile,
+		"PROXY_UPSTREAM_TIMEOUT": cfg.Upstream.Timeout,
+	} {
+		if v != "" {
+			settings[name] = v
+		}
+	}
+	return settings
+}
+
+// configEnv layers the config file at PROXY_CONFIG_FILE, if set, under
+// getenv, returning the layered getenv and the file
+func configEnv(getenv func(string) string) (func(string) string, *ConfigFile, error) {
+	path := getenv("PROXY_CONFIG_FILE")
+	if path == "" {
+		return getenv, nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	cfg, err := parseConfigFile(path, data)
+	if err != nil {
+		return nil, nil, err
+	}
+	settings := cfg.settings()
+	return func(name string) string {
+		if v := getenv(name); v != "" {
+			return v
+		}
+		return settings[name]
+	}, cfg, nil
+}
+
+// configReloader applies the keys, tenants and routing rules of the config
+// file to a server, replacing those of the previous version of the file
+// and leaving those created through the admin API alone
+type configReloader struct {
+	server *ProxyServer
+	path   string
+	// keys is set if the client keys come from the file rather than
+	// PROXY_KEYS_FILE
+	keys bool
+
+	mu      sync.Mutex
+	tenants map[string]bool
+	routes  map[string]bool
+}
+
+func newConfigReloader(server *ProxyServer, path string) *configReloader {
+	return &configReloader{server: server, path: path, tenants: make(map[string]bool), routes: make(map[string]bool)}
+}
+
+// apply replaces the configured keys, tenants and routing rules with those
+// of cfg
+func (c *configReloader) apply(cfg *ConfigFile) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.server
+	if len(cfg.Keys) > 0 && !c.keys {
+		return fmt.Errorf("client keys can only be set in the config file if it set them at startup, and PROXY_KEYS_FILE is not set")
+	}
+	if c.keys {
+		for _, key := range cfg.Keys {
+			if err := s.upstreamKeys.check(key.Upstream); err != nil {
+				return fmt.Errorf("client key %s: %w", key.ID, err)
+			}
+		}
+		data, _ := json.Marshal(cfg.Keys)
+		if err := s.keys.ReloadFile(data); err != nil {
+			return err
+		}
+	}
+
+	tenants := make(map[string]bool)
+	for _, tenant := range cfg.Tenants {
+		s.tenants.Put(tenant.ID, tenant)
+		tenants[tenant.ID] = true
+	}
+	for id := range c.tenants {
+		if !tenants[id] {
+			s.tenants.Delete(id)
+		}
+	}
+	c.tenants = tenants
+
+	routes := make(map[string]bool)
+	for _, rule := range cfg.Routes {
+		s.routes.Put(rule.ID, rule)
+		routes[rule.ID] = true
+	}
+	for id := range c.routes {
+		if !routes[id] {
+			s.routes.Delete(id)
+		}
+	}
+	c.routes = routes
+	return nil
+}
+
+// Reload reads the config file again and applies it. A file that fails to
+// parse leaves the configuration as it was.
+func (c *configReloader) Reload(data []byte) error {
+	cfg, err := parseConfigFile(c.path, data)
+	if err != nil {
+		return err
+	}
+	return c.apply(cfg)
+}
+
+// ReloadConfig reloads the server's config file, if it has one, logging the
+// outcome
+func (s *ProxyServer) ReloadConfig() {
+	if s.config == nil {
+		return
+	}
+	data, err := os.ReadFile(s.config.path)
+	if err == nil {
+		err = s.config.Reload(data)
+	}
+	if err != nil {
+		log.Printf("Failed to reload %s, keeping previous configuration: %v", s.config.path, err)
+		return
+	}
+	log.Printf("Reloaded %s", s.config.path)
+}
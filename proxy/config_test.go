@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testConfigFile = `
+listen = "127.0.0.1:9090"
+
+[upstream]
+api_key = "sk-upstream"
+base_url = "https://llm.example.com/v1/"
+timeout = "30s"
+
+[env]
+PROXY_PLAYGROUND = "off"
+PROXY_COMPLETION_CACHE_SIZE = 100
+
+[[keys]]
+id = "app"
+key = "sk-app"
+tenant = "acme"
+limits = { requests_per_minute = 60 }
+
+[[tenants]]
+id = "acme"
+weight = 2
+
+[[routes]]
+id = "legacy"
+model = "gpt-3.5*"
+target_model = "gpt-4o-mini"
+`
+
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "proxy.toml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestServerFromEnv_ConfigFile(t *testing.T) {
+	path := writeConfigFile(t, testConfigFile)
+	env := map[string]string{"PROXY_CONFIG_FILE": path, "PROXY_ANALYTICS_FILE": "off", "PROXY_COMPLETION_CACHE_SIZE": "5"}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server, err := serverFromEnv(ctx, func(name string) string { return env[name] }, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := server.client.(*RealOpenAIClient)
+	if server.address != "127.0.0.1:9090" || client.BaseURL != "https://llm.example.com/v1" || client.HTTPClient.Timeout.String() != "30s" || server.playground {
+		t.Errorf("Expected the settings of the file, got %s %s %v %v", server.address, client.BaseURL, client.HTTPClient.Timeout, server.playground)
+	}
+	if server.completions.size != 5 {
+		t.Errorf("Expected the environment to win over the file, got %d", server.completions.size)
+	}
+	if key := server.keys.Get("app"); key == nil || key.Limits.RequestsPerMinute != 60 {
+		t.Errorf("Expected the key of the file, got %+v", key)
+	}
+	if tenant, ok := server.tenants.Get("acme"); !ok || tenant.Weight != 2 {
+		t.Errorf("Expected the tenant of the file, got %+v", tenant)
+	}
+	if _, ok := server.routes.Get("legacy"); !ok {
+		t.Error("Expected the routing rule of the file")
+	}
+
+	// Keys and rules created through the admin API survive reloads
+	server.keys.Add(ClientKey{ID: "admin-made", Key: "sk-admin-made"})
+	server.routes.Put("manual", RoutingRule{ID: "manual", Model: "a", TargetModel: "b"})
+	updated := strings.Replace(testConfigFile, "requests_per_minute = 60", "requests_per_minute = 5", 1)
+	updated = strings.Replace(updated, `id = "legacy"`, `id = "modern"`, 1)
+	os.WriteFile(path, []byte(updated), 0o600)
+	server.ReloadConfig()
+	if key := server.keys.Get("app"); key == nil || key.Limits.RequestsPerMinute != 5 {
+		t.Errorf("Expected the key's new limits, got %+v", key)
+	}
+	_, legacy := server.routes.Get("legacy")
+	_, modern := server.routes.Get("modern")
+	_, manual := server.routes.Get("manual")
+	if legacy || !modern || !manual {
+		t.Errorf("Expected the renamed rule to replace the old one, got legacy %v, modern %v, manual %v", legacy, modern, manual)
+	}
+	if server.keys.Get("admin-made") == nil {
+		t.Error("Expected keys created through the admin API to be kept")
+	}
+
+	// A broken file keeps the configuration as it was
+	os.WriteFile(path, []byte("[[routes]\n"), 0o600)
+	server.ReloadConfig()
+	if _, ok := server.routes.Get("modern"); !ok {
+		t.Error("Expected a broken file to be ignored")
+	}
+
+	req := httptest.NewRequest("GET", "/admin/keys", nil)
+	req.Header.Set("Authorization", "Bearer sk-app")
+	w := httptest.NewRecorder()
+	server.Handler().ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected the file's key to authenticate without admin access, got %d", w.Code)
+	}
+}
+
+func TestParseConfigFile_Errors(t *testing.T) {
+	for name, content := range map[string]string{
+		"unknown setting":    `listne = ":8080"`,
+		"key without secret": "[[keys]]\nid = \"a\"",
+		"negative weight":    "[[tenants]]\nid = \"a\"\nweight = -1",
+		"incomplete rule":    "[[routes]]\nid = \"a\"\nmodel = \"gpt-4o\"",
+	} {
+		if _, err := parseConfigFile("proxy.toml", []byte(content)); err == nil {
+			t.Errorf("%s: expected the file to be rejected", name)
+		}
+	}
+	if cfg, err := parseConfigFile("proxy.json", []byte(`{"listen": ":9000"}`)); err != nil || cfg.Listen != ":9000" {
+		t.Errorf("Expected JSON config files to be read, got %+v %v", cfg, err)
+	}
+}
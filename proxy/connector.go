@@ -0,0 +1,402 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// connectorMaxBytes caps the size of one document read from a source
+const connectorMaxBytes = 10 << 20
+
+// Connector keeps a knowledge base up to date with an external source:
+// exactly one of an S3 bucket prefix, a Google Drive folder or a Postgres
+// table. Every sync only fetches and embeds what changed since the last
+// one, and removes the documents whose source is gone.
+type Connector struct {
+	ID            string `json:"id"`
+	KnowledgeBase string `json:"knowledge_base"`
+	// Interval between syncs, e.g. "1h" (default 15m)
+	Interval string          `json:"interval,omitempty"`
+	Paused   bool            `json:"paused,omitempty"`
+	S3       *S3Source       `json:"s3,omitempty"`
+	Drive    *DriveSource    `json:"google_drive,omitempty"`
+	Postgres *PostgresSource `json:"postgres,omitempty"`
+}
+
+// interval parses the sync interval
+func (c Connector) interval() (time.Duration, error) {
+	if c.Interval == "" {
+		return 15 * time.Minute, nil
+	}
+	d, err := time.ParseDuration(c.Interval)
+	if err != nil || d < time.Minute {
+		return 0, fmt.Errorf("interval must be a duration of at least 1m")
+	}
+	return d, nil
+}
+
+// sourceItem is a document as listed by a source. Version changes whenever
+// the document does, e.g. an ETag or a modification time.
+type sourceItem struct {
+	ID      string
+	Version string
+	Title   string
+	Source  string
+	// kind is what the source needs to fetch the item, e.g. a MIME type
+	kind string
+}
+
+// connectorSource lists and reads the documents of an external source.
+// Sources holding a connection also implement io.Closer.
+type connectorSource interface {
+	list(ctx context.Context) ([]sourceItem, error)
+	fetch(ctx context.Context, item sourceItem) (string, error)
+}
+
+// ConnectorSync is the outcome of one sync of a connector
+type ConnectorSync struct {
+	Time      time.Time `json:"time"`
+	Added     int       `json:"added"`
+	Updated   int       `json:"updated"`
+	Deleted   int       `json:"deleted"`
+	Unchanged int       `json:"unchanged"`
+	Failed    int       `json:"failed"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// connectorSyncer syncs the connectors that are due. Knowledge bases are
+// kept per replica, so it is driven by a job that runs on every replica.
+type connectorSyncer struct {
+	client *http.Client
+	now    func() time.Time
+	// driveAPI is the base URL of the Google Drive API
+	driveAPI string
+
+	mu      sync.Mutex
+	syncs   map[string]ConnectorSync
+	running map[string]bool
+}
+
+func newConnectorSyncer() *connectorSyncer {
+	return &connectorSyncer{
+		client:   &http.Client{Timeout: time.Minute},
+		now:      time.Now,
+		driveAPI: "https://www.googleapis.com",
+		syncs:    make(map[string]ConnectorSync),
+		running:  make(map[string]bool),
+	}
+}
+
+func (cs *connectorSyncer) last(id string) (ConnectorSync, bool) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	sync, ok := cs.syncs[id]
+	return sync, ok
+}
+
+// source returns the source of a connector, or an error if it does not
+// configure exactly one
+func (cs *connectorSyncer) source(c Connector) (connectorSource, error) {
+	var sources []connectorSource
+	if c.S3 != nil {
+		sources = append(sources, &s3Source{S3Source: *c.S3, client: cs.client, now: cs.now})
+	}
+	if c.Drive != nil {
+		sources = append(sources, &driveSource{DriveSource: *c.Drive, client: cs.client, apiURL: cs.driveAPI, now: cs.now})
+	}
+	if c.Postgres != nil {
+		sources = append(sources, &postgresSource{PostgresSource: *c.Postgres})
+	}
+	if len(sources) != 1 {
+		return nil, fmt.Errorf("connector requires exactly one of s3, google_drive and postgres")
+	}
+	if v, ok := sources[0].(interface{ validate() error }); ok {
+		if err := v.validate(); err != nil {
+			return nil, err
+		}
+	}
+	return sources[0], nil
+}
+
+// readText reads a document body, which must be UTF-8 text of at most
+// connectorMaxBytes
+func readText(r io.Reader) (string, error) {
+	data, err := io.ReadAll(io.LimitReader(r, connectorMaxBytes+1))
+	if err != nil {
+		return "", err
+	}
+	if len(data) > connectorMaxBytes {
+		return "", fmt.Errorf("document is larger than %d bytes", connectorMaxBytes)
+	}
+	if !utf8.Valid(data) {
+		return "", fmt.Errorf("document is not UTF-8 text")
+	}
+	return string(data), nil
+}
+
+// syncConnector brings the knowledge base of a connector in line with its
+// source. Documents are identified as "<connector>:<item>" and remember the
+// version they were indexed at, so unchanged ones are skipped and ones the
+// source no longer lists are deleted. An item that fails keeps its previous
+// version and is retried on the next sync; a listing that fails changes
+// nothing, so an outage of the source never empties the knowledge base.
+func (s *ProxyServer) syncConnector(ctx context.Context, c Connector) ConnectorSync {
+	result := ConnectorSync{Time: s.syncer.now().UTC()}
+	s.syncer.mu.Lock()
+	if s.syncer.running[c.ID] {
+		s.syncer.mu.Unlock()
+		result.Error = "a sync is already running"
+		return result
+	}
+	s.syncer.running[c.ID] = true
+	s.syncer.mu.Unlock()
+	defer func() {
+		s.syncer.mu.Lock()
+		defer s.syncer.mu.Unlock()
+		delete(s.syncer.running, c.ID)
+		s.syncer.syncs[c.ID] = result
+	}()
+
+	err := s.syncItems(ctx, c, &result)
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
+
+func (s *ProxyServer) syncItems(ctx context.Context, c Connector, result *ConnectorSync) error {
+	kb, ok := s.knowledgeBases.Get(c.KnowledgeBase)
+	if !ok {
+		return fmt.Errorf("unknown knowledge base %s", c.KnowledgeBase)
+	}
+	source, err := s.syncer.source(c)
+	if err != nil {
+		return err
+	}
+	if closer, ok := source.(io.Closer); ok {
+		defer closer.Close()
+	}
+	items, err := source.list(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list documents: %w", err)
+	}
+
+	indexed := make(map[string]string)
+	for _, doc := range kb.docs.List() {
+		if doc.Connector == c.ID {
+			indexed[doc.ID] = doc.Version
+		}
+	}
+	var failed []string
+	listed := make(map[string]bool, len(items))
+	for _, item := range items {
+		id := c.ID + ":" + item.ID
+		listed[id] = true
+		version, known := indexed[id]
+		if known && version == item.Version {
+			result.Unchanged++
+			continue
+		}
+		text, err := source.fetch(ctx, item)
+		var doc RAGDocument
+		if err == nil {
+			doc, err = s.indexDocument(kb, RAGDocument{ID: id, Title: item.Title, Source: item.Source, Text: text, Connector: c.ID, Version: item.Version})
+		}
+		if err != nil {
+			result.Failed++
+			failed = append(failed, fmt.Sprintf("%s: %v", item.ID, err))
+			continue
+		}
+		kb.docs.Put(id, doc)
+		if known {
+			result.Updated++
+		} else {
+			result.Added++
+		}
+	}
+	for id := range indexed {
+		if !listed[id] && kb.docs.Delete(id) {
+			result.Deleted++
+		}
+	}
+	if result.Added+result.Updated+result.Deleted > 0 {
+		kb.stats.touch(false)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d documents failed: %s", len(failed), strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// syncDueConnectors syncs every connector whose interval has passed since
+// its last sync, or that was never synced on this replica
+func (s *ProxyServer) syncDueConnectors(ctx context.Context) error {
+	now := s.syncer.now()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var failed []string
+	for _, c := range s.connectors.List() {
+		interval, err := c.interval()
+		if err != nil || c.Paused {
+			continue
+		}
+		if last, ok := s.syncer.last(c.ID); ok && now.Sub(last.Time) < interval {
+			continue
+		}
+		wg.Add(1)
+		go func(c Connector) {
+			defer wg.Done()
+			if result := s.syncConnector(ctx, c); result.Error != "" {
+				mu.Lock()
+				failed = append(failed, fmt.Sprintf("%s: %s", c.ID, result.Error))
+				mu.Unlock()
+			}
+		}(c)
+	}
+	wg.Wait()
+	if len(failed) > 0 {
+		return fmt.Errorf("%d connectors failed: %s", len(failed), strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// connectorView is a connector as returned by the admin API, without its
+// credentials and with the outcome of its last sync on this replica
+type connectorView struct {
+	Connector
+	LastSync *ConnectorSync `json:"last_sync,omitempty"`
+}
+
+func (s *ProxyServer) viewConnector(c Connector) any {
+	if c.S3 != nil {
+		s3 := *c.S3
+		s3.SecretAccessKey = ""
+		c.S3 = &s3
+	}
+	if c.Drive != nil {
+		drive := *c.Drive
+		drive.Credentials = nil
+		c.Drive = &drive
+	}
+	if c.Postgres != nil {
+		pg := *c.Postgres
+		pg.Password = ""
+		c.Postgres = &pg
+	}
+	view := connectorView{Connector: c}
+	if last, ok := s.syncer.last(c.ID); ok {
+		view.LastSync = &last
+	}
+	return view
+}
+
+func (s *ProxyServer) listConnectors() []any {
+	connectors := s.connectors.List()
+	views := make([]any, 0, len(connectors))
+	for _, c := range connectors {
+		views = append(views, s.viewConnector(c))
+	}
+	return views
+}
+
+// adminConnectorHandler manages connectors. Credentials left out of a PUT
+// are kept, so re-applying a config without them is a no-op. Deleting a
+// connector deletes the documents it indexed.
+func (s *ProxyServer) adminConnectorHandler() http.Handler {
+	return resourceHandler[Connector]{
+		lock: s.connectors.lockWrites,
+		get: func(id string) (Connector, string, bool) {
+			c, ok := s.connectors.Get(id)
+			return c, etagFor(c), ok
+		},
+		put: func(id string, c Connector, existing *Connector) (bool, error) {
+			if c.ID != "" && c.ID != id {
+				return false, fmt.Errorf("id in body does not match id in path")
+			}
+			c.ID = id
+			if existing != nil {
+				keepCredentials(&c, *existing)
+			}
+			if _, ok := s.knowledgeBases.Get(c.KnowledgeBase); !ok {
+				return false, fmt.Errorf("unknown knowledge base %q", c.KnowledgeBase)
+			}
+			if _, err := c.interval(); err != nil {
+				return false, err
+			}
+			if _, err := s.syncer.source(c); err != nil {
+				return false, err
+			}
+			if existing != nil && existing.KnowledgeBase != c.KnowledgeBase {
+				s.removeConnectorDocuments(*existing)
+			}
+			return s.connectors.Put(id, c), nil
+		},
+		remove: func(id string) bool {
+			c, ok := s.connectors.Get(id)
+			if !ok || !s.connectors.Delete(id) {
+				return false
+			}
+			s.removeConnectorDocuments(c)
+			return true
+		},
+		view: s.viewConnector,
+	}
+}
+
+func keepCredentials(c *Connector, existing Connector) {
+	if c.S3 != nil && c.S3.SecretAccessKey == "" && existing.S3 != nil {
+		c.S3.SecretAccessKey = existing.S3.SecretAccessKey
+	}
+	if c.Drive != nil && c.Drive.Credentials == nil && existing.Drive != nil {
+		c.Drive.Credentials = existing.Drive.Credentials
+	}
+	if c.Postgres != nil && c.Postgres.Password == "" && existing.Postgres != nil {
+		c.Postgres.Password = existing.Postgres.Password
+	}
+}
+
+// removeConnectorDocuments deletes the documents a connector indexed
+func (s *ProxyServer) removeConnectorDocuments(c Connector) {
+	kb, ok := s.knowledgeBases.Get(c.KnowledgeBase)
+	if !ok {
+		return
+	}
+	var removed bool
+	for _, doc := range kb.docs.List() {
+		if doc.Connector == c.ID && kb.docs.Delete(doc.ID) {
+			removed = true
+		}
+	}
+	if removed {
+		kb.stats.touch(false)
+	}
+}
+
+// handleAdminSyncConnector syncs a connector immediately, whether or not it
+// is paused, and returns the outcome
+func (s *ProxyServer) handleAdminSyncConnector(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	c, ok := s.connectors.Get(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	result := s.syncConnector(r.Context(), c)
+	status := http.StatusOK
+	if result.Error != "" {
+		status = http.StatusBadGateway
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(result)
+}
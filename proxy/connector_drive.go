@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DriveSource is a Google Drive folder, read with a service account the
+// folder is shared with. Subfolders are not descended into.
+type DriveSource struct {
+	FolderID string `json:"folder_id"`
+	// Credentials is the JSON key of the service account
+	Credentials json.RawMessage `json:"credentials,omitempty"`
+}
+
+// driveExports are the formats Google Workspace files are exported as;
+// other files are downloaded if they are text
+var driveExports = map[string]string{
+	"application/vnd.google-apps.document":     "text/plain",
+	"application/vnd.google-apps.presentation": "text/plain",
+	"application/vnd.google-apps.spreadsheet":  "text/csv",
+}
+
+type driveSource struct {
+	DriveSource
+	client *http.Client
+	apiURL string
+	now    func() time.Time
+
+	// token is fetched by list and reused by fetch within one sync
+	token string
+}
+
+type serviceAccountKey struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+func (src *driveSource) key() (serviceAccountKey, *rsa.PrivateKey, error) {
+	var key serviceAccountKey
+	if err := json.Unmarshal(src.Credentials, &key); err != nil || key.ClientEmail == "" || key.TokenURI == "" {
+		return key, nil, fmt.Errorf("google_drive credentials must be a service account key")
+	}
+	block, _ := pem.Decode([]byte(key.PrivateKey))
+	if block == nil {
+		return key, nil, fmt.Errorf("google_drive credentials have no private key")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return key, nil, fmt.Errorf("invalid private key: %w", err)
+	}
+	rsaKey, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return key, nil, fmt.Errorf("private key is not an RSA key")
+	}
+	return key, rsaKey, nil
+}
+
+func (src *driveSource) validate() error {
+	if src.FolderID == "" {
+		return fmt.Errorf("google_drive requires folder_id")
+	}
+	_, _, err := src.key()
+	return err
+}
+
+// authenticate exchanges a JWT signed with the service account key for an
+// access token (RFC 7523)
+func (src *driveSource) authenticate(ctx context.Context) error {
+	key, rsaKey, err := src.key()
+	if err != nil {
+		return err
+	}
+	now := src.now()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]any{
+		"iss":   key.ClientEmail,
+		"scope": "https://www.googleapis.com/auth/drive.readonly",
+		"aud":   key.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(nil, rsaKey, crypto.SHA256, digest[:])
+	if err != nil {
+		return err
+	}
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, key.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := src.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil || resp.StatusCode != http.StatusOK || token.AccessToken == "" {
+		return fmt.Errorf("token request returned status %d", resp.StatusCode)
+	}
+	src.token = token.AccessToken
+	return nil
+}
+
+func (src *driveSource) get(ctx context.Context, path string, query url.Values) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, src.apiURL+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+src.token)
+	resp, err := src.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("drive returned status %d", resp.StatusCode)
+	}
+	return resp, nil
+}
+
+// list returns the text files and Google Workspace documents of the folder,
+// taking their modification time as version
+func (src *driveSource) list(ctx context.Context) ([]sourceItem, error) {
+	if err := src.authenticate(ctx); err != nil {
+		return nil, err
+	}
+	var items []sourceItem
+	query := url.Values{
+		"q":        {fmt.Sprintf("'%s' in parents and trashed = false", strings.ReplaceAll(src.FolderID, "'", `\'`))},
+		"fields":   {"nextPageToken, files(id, name, mimeType, modifiedTime, webViewLink)"},
+		"pageSize": {"1000"},
+	}
+	for {
+		resp, err := src.get(ctx, "/drive/v3/files", query)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			NextPageToken string `json:"nextPageToken"`
+			Files         []struct {
+				ID           string `json:"id"`
+				Name         string `json:"name"`
+				MimeType     string `json:"mimeType"`
+				ModifiedTime string `json:"modifiedTime"`
+				WebViewLink  string `json:"webViewLink"`
+			} `json:"files"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("invalid listing: %w", err)
+		}
+		for _, f := range page.Files {
+			if _, ok := driveExports[f.MimeType]; !ok && !strings.HasPrefix(f.MimeType, "text/") && f.MimeType != "application/json" {
+				continue
+			}
+			items = append(items, sourceItem{ID: f.ID, Version: f.ModifiedTime, Title: f.Name, Source: f.WebViewLink, kind: f.MimeType})
+		}
+		if page.NextPageToken == "" {
+			return items, nil
+		}
+		query.Set("pageToken", page.NextPageToken)
+	}
+}
+
+func (src *driveSource) fetch(ctx context.Context, item sourceItem) (string, error) {
+	path, query := "/drive/v3/files/"+url.PathEscape(item.ID), url.Values{"alt": {"media"}}
+	if export, ok := driveExports[item.kind]; ok {
+		path, query = path+"/export", url.Values{"mimeType": {export}}
+	}
+	resp, err := src.get(ctx, path, query)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	return readText(resp.Body)
+}
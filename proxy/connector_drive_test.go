@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDriveSource(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		parts := strings.Split(r.Form.Get("assertion"), ".")
+		if len(parts) != 3 || r.Form.Get("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		if rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature) != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		claims, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		if !strings.Contains(string(claims), `"iss":"indexer@example.iam.gserviceaccount.com"`) || !strings.Contains(string(claims), "drive.readonly") {
+			t.Errorf("Expected the service account and scope in the claims, got %s", claims)
+		}
+		w.Write([]byte(`{"access_token": "ya29.token", "expires_in": 3600}`))
+	})
+	mux.HandleFunc("/drive/v3/files", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer ya29.token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if q := r.URL.Query().Get("q"); q != "'folder1' in parents and trashed = false" {
+			t.Errorf("Expected the folder query, got %s", q)
+		}
+		if r.URL.Query().Get("pageToken") == "" {
+			w.Write([]byte(`{"nextPageToken": "p2", "files": [
+				{"id": "doc1", "name": "Refunds", "mimeType": "application/vnd.google-apps.document", "modifiedTime": "2026-01-01T00:00:00Z", "webViewLink": "https://docs.google.com/document/d/doc1"},
+				{"id": "img1", "name": "logo.png", "mimeType": "image/png", "modifiedTime": "2026-01-01T00:00:00Z"}]}`))
+			return
+		}
+		w.Write([]byte(`{"files": [{"id": "txt1", "name": "notes.txt", "mimeType": "text/plain", "modifiedTime": "2026-01-02T00:00:00Z"}]}`))
+	})
+	mux.HandleFunc("/drive/v3/files/doc1/export", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("mimeType") != "text/plain" {
+			t.Errorf("Expected a plain text export, got %s", r.URL.RawQuery)
+		}
+		w.Write([]byte("Refunds take 14 days."))
+	})
+	mux.HandleFunc("/drive/v3/files/txt1", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("alt") != "media" {
+			t.Errorf("Expected a download, got %s", r.URL.RawQuery)
+		}
+		w.Write([]byte("Some notes."))
+	})
+	upstream := httptest.NewServer(mux)
+	defer upstream.Close()
+
+	credentials, _ := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"client_email": "indexer@example.iam.gserviceaccount.com",
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"token_uri":    upstream.URL + "/token",
+	})
+	src := &driveSource{
+		DriveSource: DriveSource{FolderID: "folder1", Credentials: credentials},
+		client:      upstream.Client(),
+		apiURL:      upstream.URL,
+		now:         time.Now,
+	}
+	if err := src.validate(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	items, err := src.list(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(items) != 2 || items[0].ID != "doc1" || items[0].Version != "2026-01-01T00:00:00Z" || items[0].Source != "https://docs.google.com/document/d/doc1" || items[1].ID != "txt1" {
+		t.Fatalf("Expected the document and the text file, got %+v", items)
+	}
+	for i, want := range []string{"Refunds take 14 days.", "Some notes."} {
+		if text, err := src.fetch(context.Background(), items[i]); err != nil || text != want {
+			t.Errorf("Expected %q, got %q, %v", want, text, err)
+		}
+	}
+}
+
+func TestDriveSource_InvalidCredentials(t *testing.T) {
+	for _, credentials := range []string{`"not an object"`, `{"client_email": "a@b", "token_uri": "https://oauth2.googleapis.com/token", "private_key": "nope"}`} {
+		src := &driveSource{DriveSource: DriveSource{FolderID: "f", Credentials: json.RawMessage(credentials)}}
+		if err := src.validate(); err == nil {
+			t.Errorf("Expected an error for %s", credentials)
+		}
+	}
+}
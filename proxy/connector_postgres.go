@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// PostgresSource is a table with one document per row
+type PostgresSource struct {
+	// URL is a postgres:// connection URL
+	URL string `json:"url"`
+	// Password, if set, overrides the one in URL, so URL can be shown
+	Password string `json:"password,omitempty"`
+	Table    string `json:"table"`
+	// IDColumn (default id) identifies rows and TextColumn (default
+	// content) holds the text. VersionColumn (default updated_at) must
+	// change whenever a row does, e.g. a timestamp set by a trigger.
+	IDColumn      string `json:"id_column,omitempty"`
+	TextColumn    string `json:"text_column,omitempty"`
+	TitleColumn   string `json:"title_column,omitempty"`
+	VersionColumn string `json:"version_column,omitempty"`
+	// Where, if set, is an SQL condition rows must meet to be indexed
+	Where string `json:"where,omitempty"`
+}
+
+type postgresSource struct {
+	PostgresSource
+
+	// conn is opened by list and reused by fetch within one sync
+	conn *pgConn
+}
+
+func (src *postgresSource) validate() error {
+	if src.URL == "" || src.Table == "" {
+		return fmt.Errorf("postgres requires url and table")
+	}
+	if !strings.HasPrefix(src.URL, "postgres://") && !strings.HasPrefix(src.URL, "postgresql://") {
+		return fmt.Errorf("postgres url must be a postgres:// URL")
+	}
+	return nil
+}
+
+func (src *postgresSource) column(name, fallback string) string {
+	if name == "" {
+		name = fallback
+	}
+	return pgIdentifier(name)
+}
+
+// list selects the ID, version and title of every row
+func (src *postgresSource) list(ctx context.Context) ([]sourceItem, error) {
+	conn, err := pgConnect(ctx, src.URL, src.Password)
+	if err != nil {
+		return nil, err
+	}
+	src.conn = conn
+
+	title := "''"
+	if src.TitleColumn != "" {
+		title = pgIdentifier(src.TitleColumn) + "::text"
+	}
+	query := fmt.Sprintf("SELECT %s::text, %s::text, %s FROM %s",
+		src.column(src.IDColumn, "id"), src.column(src.VersionColumn, "updated_at"), title, pgIdentifier(src.Table))
+	if src.Where != "" {
+		query += " WHERE " + src.Where
+	}
+	_, rows, err := conn.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	items := make([]sourceItem, 0, len(rows))
+	for _, row := range rows {
+		items = append(items, sourceItem{ID: row[0], Version: row[1], Title: row[2], Source: src.Table + "/" + row[0]})
+	}
+	return items, nil
+}
+
+func (src *postgresSource) Close() error {
+	if src.conn == nil {
+		return nil
+	}
+	return src.conn.Close()
+}
+
+func (src *postgresSource) fetch(ctx context.Context, item sourceItem) (string, error) {
+	if src.conn == nil {
+		return "", fmt.Errorf("not connected")
+	}
+	_, rows, err := src.conn.Query(fmt.Sprintf("SELECT %s::text FROM %s WHERE %s::text = %s",
+		src.column(src.TextColumn, "content"), pgIdentifier(src.Table), src.column(src.IDColumn, "id"), pgLiteral(item.ID)))
+	if err != nil {
+		return "", err
+	}
+	if len(rows) == 0 {
+		return "", fmt.Errorf("row no longer exists")
+	}
+	return rows[0][0], nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestPostgresSource(t *testing.T) {
+	pg := startFakePostgres(t, "s3cret")
+	pg.set("it's", "v1", "Title", "Hello.")
+
+	src := &postgresSource{PostgresSource: PostgresSource{
+		URL:      strings.Replace(pg.url(), "reader@", "reader:s3cret@", 1),
+		Table:    "public.articles",
+		Where:    "published",
+		IDColumn: "id", TitleColumn: "title", TextColumn: "body", VersionColumn: "revision",
+	}}
+	if err := src.validate(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	items, err := src.list(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer src.Close()
+	if len(items) != 1 || items[0].ID != "it's" || items[0].Version != "v1" || items[0].Title != "Title" {
+		t.Fatalf("Expected the row, got %+v", items)
+	}
+	text, err := src.fetch(context.Background(), items[0])
+	if err != nil || text != "Hello." {
+		t.Errorf("Expected the row's text, got %q, %v", text, err)
+	}
+	if _, err := src.fetch(context.Background(), sourceItem{ID: "gone"}); err == nil {
+		t.Errorf("Expected an error for a row that no longer exists")
+	}
+
+	want := []string{
+		`SELECT "id"::text, "revision"::text, "title"::text FROM "public"."articles" WHERE published`,
+		`SELECT "body"::text FROM "public"."articles" WHERE "id"::text = 'it''s'`,
+	}
+	for i, query := range want {
+		if pg.queries[i] != query {
+			t.Errorf("Expected query %s, got %s", query, pg.queries[i])
+		}
+	}
+}
+
+func TestPostgresSource_Validate(t *testing.T) {
+	for _, src := range []PostgresSource{{Table: "t"}, {URL: "postgres://localhost/db"}, {URL: "mysql://localhost/db", Table: "t"}} {
+		if err := (&postgresSource{PostgresSource: src}).validate(); err == nil {
+			t.Errorf("Expected an error for %+v", src)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3Source is a prefix of an S3 bucket, or of a bucket of any S3-compatible
+// store such as MinIO or R2 through Endpoint
+type S3Source struct {
+	Bucket string `json:"bucket"`
+	Prefix string `json:"prefix,omitempty"`
+	// Region defaults to us-east-1
+	Region string `json:"region,omitempty"`
+	// Endpoint, if set, is used with path-style URLs instead of AWS
+	Endpoint string `json:"endpoint,omitempty"`
+	// AccessKeyID and SecretAccessKey default to AWS_ACCESS_KEY_ID and
+	// AWS_SECRET_ACCESS_KEY
+	AccessKeyID     string `json:"access_key_id,omitempty"`
+	SecretAccessKey string `json:"secret_access_key,omitempty"`
+}
+
+type s3Source struct {
+	S3Source
+	client *http.Client
+	now    func() time.Time
+}
+
+func (src *s3Source) validate() error {
+	if src.Bucket == "" {
+		return fmt.Errorf("s3 requires bucket")
+	}
+	if src.Endpoint != "" && !strings.HasPrefix(src.Endpoint, "http://") && !strings.HasPrefix(src.Endpoint, "https://") {
+		return fmt.Errorf("s3 endpoint must be an http(s) URL")
+	}
+	return nil
+}
+
+func (src *s3Source) region() string {
+	if src.Region == "" {
+		return "us-east-1"
+	}
+	return src.Region
+}
+
+// objectURL is the URL of key in the bucket, or of the bucket if key is
+// empty
+func (src *s3Source) objectURL(key string) string {
+	escaped := s3Escape(key, false)
+	if src.Endpoint != "" {
+		return strings.TrimSuffix(src.Endpoint, "/") + "/" + src.Bucket + "/" + escaped
+	}
+	return "https://" + src.Bucket + ".s3." + src.region() + ".amazonaws.com/" + escaped
+}
+
+func (src *s3Source) get(ctx context.Context, rawURL string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	accessKey, secret := src.AccessKeyID, src.SecretAccessKey
+	if accessKey == "" {
+		accessKey, secret = os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	if accessKey != "" {
+		signS3(req, src.region(), accessKey, secret, src.now())
+	}
+	resp, err := src.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		var s3Err struct {
+			Code    string
+			Message string
+		}
+		xml.NewDecoder(resp.Body).Decode(&s3Err)
+		if s3Err.Code != "" {
+			return nil, fmt.Errorf("s3 error %s: %s", s3Err.Code, s3Err.Message)
+		}
+		return nil, fmt.Errorf("s3 returned status %d", resp.StatusCode)
+	}
+	return resp, nil
+}
+
+// list pages through ListObjectsV2, taking an object's ETag as its version.
+// Keys ending in a slash are folder markers and skipped.
+func (src *s3Source) list(ctx context.Context) ([]sourceItem, error) {
+	var items []sourceItem
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}}
+		if src.Prefix != "" {
+			query.Set("prefix", src.Prefix)
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := src.get(ctx, src.objectURL("")+"?"+s3Query(query))
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Contents []struct {
+				Key  string
+				ETag string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("invalid listing: %w", err)
+		}
+		for _, obj := range page.Contents {
+			if strings.HasSuffix(obj.Key, "/") {
+				continue
+			}
+			items = append(items, sourceItem{
+				ID:      obj.Key,
+				Version: strings.Trim(obj.ETag, `"`),
+				Title:   path.Base(obj.Key),
+				Source:  "s3://" + src.Bucket + "/" + obj.Key,
+			})
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return items, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+func (src *s3Source) fetch(ctx context.Context, item sourceItem) (string, error) {
+	resp, err := src.get(ctx, src.objectURL(item.ID))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	return readText(resp.Body)
+}
+
+// s3Escape percent-encodes everything but unreserved characters, and
+// slashes unless slash is set, as Signature Version 4 requires
+func s3Escape(s string, slash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~", c) >= 0 || (c == '/' && !slash) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3Query encodes a query string in the canonical order and escaping
+func s3Query(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// signS3 signs a request without a body with AWS Signature Version 4. The
+// URL must already be in canonical form, as built by objectURL and s3Query.
+func signS3(req *http.Request, region, accessKey, secret string, now time.Time) {
+	now = now.UTC()
+	amzDate, date := now.Format("20060102T150405Z"), now.Format("20060102")
+	payloadHash := hex.EncodeToString(sha256.New().Sum(nil))
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	canonicalURI := req.URL.EscapedPath()
+	if canonicalURI == "" {
+		canonicalURI = "/"
+	}
+	// Sorting the parameters again covers valueless ones such as ?lifecycle
+	query, _ := url.ParseQuery(req.URL.RawQuery)
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		req.Method,
+		canonicalURI,
+		s3Query(query),
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secret), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", accessKey, scope, signedHeaders, signature))
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func connectorMux(server *ProxyServer) *http.ServeMux {
+	mux := knowledgeBaseMux(server)
+	mux.HandleFunc("/admin/connectors", handleAdminList("connectors", server.listConnectors))
+	mux.HandleFunc("/admin/connectors/{id}", server.adminConnectorHandler().ServeHTTP)
+	mux.HandleFunc("/admin/connectors/{id}/sync", server.handleAdminSyncConnector)
+	return mux
+}
+
+func newConnectorServer(t *testing.T) (*ProxyServer, *http.ServeMux, *fakePostgres) {
+	t.Helper()
+	server := NewProxyServer(&ragClient{})
+	mux := connectorMux(server)
+	adminRequest(mux, http.MethodPut, "/admin/knowledge-bases/docs", `{}`, nil)
+	pg := startFakePostgres(t, "s3cret")
+	body := `{"knowledge_base": "docs", "postgres": {"url": "` + pg.url() + `", "password": "s3cret", "table": "articles", "title_column": "title"}}`
+	if w := adminRequest(mux, http.MethodPut, "/admin/connectors/articles", body, nil); w.Code != http.StatusCreated {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	return server, mux, pg
+}
+
+func syncNow(t *testing.T, mux *http.ServeMux) ConnectorSync {
+	t.Helper()
+	w := adminRequest(mux, http.MethodPost, "/admin/connectors/articles/sync", "", nil)
+	var result ConnectorSync
+	json.Unmarshal(w.Body.Bytes(), &result)
+	return result
+}
+
+func TestConnector_IncrementalSync(t *testing.T) {
+	server, mux, pg := newConnectorServer(t)
+	client := server.client.(*ragClient)
+	pg.set("1", "2026-01-01", "Refunds", "Refunds take 14 days.")
+	pg.set("2", "2026-01-01", "Shipping", "Shipping takes 3 days.")
+
+	if got := syncNow(t, mux); got.Added != 2 || got.Error != "" {
+		t.Fatalf("Expected 2 documents added, got %+v", got)
+	}
+	kb, _ := server.knowledgeBases.Get("docs")
+	doc, ok := kb.docs.Get("articles:1")
+	if !ok || doc.Title != "Refunds" || doc.Connector != "articles" || doc.Version != "2026-01-01" || doc.Source != "articles/1" {
+		t.Errorf("Expected the row as a document, got %+v", doc)
+	}
+
+	// Only the changed row is fetched and embedded again
+	client.models = nil
+	pg.set("1", "2026-02-01", "Refunds", "Refunds take 30 days.")
+	if got := syncNow(t, mux); got.Updated != 1 || got.Unchanged != 1 || got.Added != 0 {
+		t.Errorf("Expected 1 document updated and 1 unchanged, got %+v", got)
+	}
+	if len(client.models) != 1 {
+		t.Errorf("Expected one document to be embedded, got %d", len(client.models))
+	}
+	if doc, _ := kb.docs.Get("articles:1"); doc.Text != "Refunds take 30 days." {
+		t.Errorf("Expected the new text, got %q", doc.Text)
+	}
+
+	// Rows that are gone are deleted; documents of others are kept
+	adminRequest(mux, http.MethodPut, "/admin/knowledge-bases/docs/documents/manual", `{"text": "A manual upload."}`, nil)
+	pg.set("2")
+	if got := syncNow(t, mux); got.Deleted != 1 || got.Unchanged != 1 {
+		t.Errorf("Expected 1 document deleted, got %+v", got)
+	}
+	if _, ok := kb.docs.Get("articles:2"); ok {
+		t.Errorf("Expected the deleted row's document to be removed")
+	}
+	if _, ok := kb.docs.Get("manual"); !ok {
+		t.Errorf("Expected the document stored by hand to be kept")
+	}
+
+	// A listing that fails leaves the knowledge base alone
+	pg.ln.Close()
+	if got := syncNow(t, mux); got.Error == "" || got.Deleted != 0 {
+		t.Errorf("Expected the sync to fail without deleting, got %+v", got)
+	}
+	if kb.docs.Len() != 2 {
+		t.Errorf("Expected 2 documents after the failed sync, got %d", kb.docs.Len())
+	}
+
+	var view struct {
+		Postgres PostgresSource `json:"postgres"`
+		LastSync ConnectorSync  `json:"last_sync"`
+	}
+	w := adminRequest(mux, http.MethodGet, "/admin/connectors/articles", "", nil)
+	json.Unmarshal(w.Body.Bytes(), &view)
+	if view.Postgres.Password != "" {
+		t.Errorf("Expected the password to be hidden")
+	}
+	if !strings.Contains(view.LastSync.Error, "failed to list documents") {
+		t.Errorf("Expected the last sync's error, got %+v", view.LastSync)
+	}
+
+	// Deleting the connector deletes its documents
+	adminRequest(mux, http.MethodDelete, "/admin/connectors/articles", "", nil)
+	if _, ok := kb.docs.Get("articles:1"); ok || kb.docs.Len() != 1 {
+		t.Errorf("Expected only the manual document to remain, got %d documents", kb.docs.Len())
+	}
+}
+
+func TestConnector_FailedItemsAreRetried(t *testing.T) {
+	server, mux, pg := newConnectorServer(t)
+	pg.set("1", "v1", "", "Fine.")
+	pg.set("2", "v1", "", "")
+
+	got := syncNow(t, mux)
+	if got.Added != 1 || got.Failed != 1 || !strings.Contains(got.Error, "2: document requires text") {
+		t.Errorf("Expected the empty row to fail, got %+v", got)
+	}
+	pg.set("2", "v1", "", "Fixed.")
+	if got := syncNow(t, mux); got.Added != 1 || got.Unchanged != 1 || got.Error != "" {
+		t.Errorf("Expected the row to be retried, got %+v", got)
+	}
+	kb, _ := server.knowledgeBases.Get("docs")
+	if kb.docs.Len() != 2 {
+		t.Errorf("Expected 2 documents, got %d", kb.docs.Len())
+	}
+}
+
+func TestAdminConnector_Validation(t *testing.T) {
+	server, mux, _ := newConnectorServer(t)
+
+	for name, body := range map[string]string{
+		"unknown knowledge base": `{"knowledge_base": "missing", "postgres": {"url": "postgres://localhost/db", "table": "t"}}`,
+		"no source":              `{"knowledge_base": "docs"}`,
+		"two sources":            `{"knowledge_base": "docs", "postgres": {"url": "postgres://localhost/db", "table": "t"}, "s3": {"bucket": "b"}}`,
+		"short interval":         `{"knowledge_base": "docs", "interval": "10s", "s3": {"bucket": "b"}}`,
+		"drive without key":      `{"knowledge_base": "docs", "google_drive": {"folder_id": "f"}}`,
+	} {
+		if w := adminRequest(mux, http.MethodPut, "/admin/connectors/bad", body, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status code %d, got %d", name, http.StatusBadRequest, w.Code)
+		}
+	}
+
+	// Re-applying a config without the password keeps it
+	existing, _ := server.connectors.Get("articles")
+	body := `{"knowledge_base": "docs", "interval": "1h", "postgres": {"url": "` + existing.Postgres.URL + `", "table": "articles"}}`
+	if w := adminRequest(mux, http.MethodPut, "/admin/connectors/articles", body, nil); w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if c, _ := server.connectors.Get("articles"); c.Postgres.Password != "s3cret" {
+		t.Errorf("Expected the password to be kept, got %q", c.Postgres.Password)
+	}
+}
+
+func TestSyncDueConnectors(t *testing.T) {
+	server, mux, pg := newConnectorServer(t)
+	pg.set("1", "v1", "", "Hello.")
+	adminRequest(mux, http.MethodPut, "/admin/connectors/paused", `{"knowledge_base": "docs", "paused": true, "postgres": {"url": "`+pg.url()+`", "password": "s3cret", "table": "articles"}}`, nil)
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	server.syncer.now = func() time.Time { return now }
+
+	if err := server.syncDueConnectors(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	first, ok := server.syncer.last("articles")
+	if !ok || first.Added != 1 {
+		t.Fatalf("Expected a first sync on startup, got %+v", first)
+	}
+	if _, ok := server.syncer.last("paused"); ok {
+		t.Errorf("Expected the paused connector not to sync")
+	}
+
+	now = now.Add(10 * time.Minute)
+	server.syncDueConnectors(context.Background())
+	if last, _ := server.syncer.last("articles"); !last.Time.Equal(first.Time) {
+		t.Errorf("Expected no sync before the interval passed")
+	}
+	now = now.Add(5 * time.Minute)
+	server.syncDueConnectors(context.Background())
+	if last, _ := server.syncer.last("articles"); !last.Time.After(first.Time) || last.Unchanged != 1 {
+		t.Errorf("Expected a sync once the interval passed, got %+v", last)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Vision and audio requests send the content of a message as a list of
+// parts rather than a string:
+//
+//	{"role": "user", "content": [{"type": "text", "text": "What is this?"},
+//	  {"type": "image_url", "image_url": {"url": "https://example.com/cat.png"}}]}
+//
+// Such a message keeps its parts in Parts and is sent on in the same form,
+// while Content holds the text of its text parts, so guardrails, token
+// counts, retrieval and the rest read it like any other message.
+
+// Content part types
+const (
+	PartText       = "text"
+	PartImageURL   = "image_url"
+	PartInputAudio = "input_audio"
+)
+
+// ContentPart is one part of the content of a message. Parts of types the
+// proxy does not know are passed on as they came.
+type ContentPart struct {
+	Type       string      `json:"type"`
+	Text       string      `json:"text,omitempty"`
+	ImageURL   *ImageURL   `json:"image_url,omitempty"`
+	InputAudio *InputAudio `json:"input_audio,omitempty"`
+
+	// raw is the part as it came, if of an unknown type
+	raw json.RawMessage
+}
+
+// ImageURL is an image by URL, which may be a data: URL
+type ImageURL struct {
+	URL string `json:"url"`
+	// Detail is low, high or auto
+	Detail string `json:"detail,omitempty"`
+}
+
+// InputAudio is a base64-encoded audio clip
+type InputAudio struct {
+	Data string `json:"data"`
+	// Format is wav or mp3
+	Format string `json:"format"`
+}
+
+func (p *ContentPart) UnmarshalJSON(data []byte) error {
+	type plain ContentPart
+	*p = ContentPart{}
+	if err := json.Unmarshal(data, (*plain)(p)); err != nil {
+		return err
+	}
+	switch p.Type {
+	case PartText, PartImageURL, PartInputAudio:
+	default:
+		p.raw = append(json.RawMessage(nil), data...)
+	}
+	return nil
+}
+
+func (p ContentPart) MarshalJSON() ([]byte, error) {
+	if p.raw != nil {
+		return p.raw, nil
+	}
+	type plain ContentPart
+	return json.Marshal(plain(p))
+}
+
+// contentText joins the text parts of content
+func contentText(parts []ContentPart) string {
+	var texts []string
+	for _, part := range parts {
+		if part.Type == PartText {
+			texts = append(texts, part.Text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+// mapText returns the message with f applied to its text, in Content and
+// in its text parts alike
+func (m Message) mapText(f func(string) string) Message {
+	m.Content = f(m.Content)
+	if m.Parts != nil {
+		parts := make([]ContentPart, len(m.Parts))
+		for i, part := range m.Parts {
+			if part.Type == PartText {
+				part.Text = f(part.Text)
+			}
+			parts[i] = part
+		}
+		m.Parts = parts
+	}
+	return m
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Raw customer data must not reach the upstream unchecked. The filters of
+// PROXY_CONTENT_FILTERS_FILE scan every string of the body of requests to
+// a model, such as messages, embedding inputs and texts to summarize, for
+// personal data, secrets or patterns of their own, and redact what they
+// find, block the request or log that they found it. Unlike guardrail
+// profiles, which belong to virtual models, they apply to every request.
+
+// Content filter actions
+const (
+	FilterRedact = "redact"
+	FilterBlock  = "block"
+	FilterLog    = "log"
+)
+
+// contentFilterSkipped are the members of request bodies that are never
+// prompts and are left unscanned
+var contentFilterSkipped = map[string]bool{"model": true, "role": true, "type": true}
+
+// ContentFilter finds text with a built-in detector or a pattern of its own
+type ContentFilter struct {
+	Name string `json:"name"`
+	// Detector is one of email, phone, card, iban, ip or secret
+	Detector string `json:"detector,omitempty"`
+	// Pattern is a regular expression, for filters without a detector
+	Pattern string `json:"pattern,omitempty"`
+	// Action is redact (default), block or log
+	Action string `json:"action,omitempty"`
+	// Replacement is what redacted matches become, by default the
+	// detector's placeholder, e.g. [EMAIL], or [REDACTED]
+	Replacement string `json:"replacement,omitempty"`
+
+	re *regexp.Regexp
+	// valid, if set, filters matches that only look like the real thing
+	valid func(match string) bool
+}
+
+// compile validates the filter and prepares its pattern
+func (f *ContentFilter) compile() error {
+	if f.Name == "" {
+		return fmt.Errorf("content filter requires a name")
+	}
+	switch f.Action {
+	case "":
+		f.Action = FilterRedact
+	case FilterRedact, FilterBlock, FilterLog:
+	default:
+		return fmt.Errorf("content filter %s: unknown action %q", f.Name, f.Action)
+	}
+	if (f.Detector == "") == (f.Pattern == "") {
+		return fmt.Errorf("content filter %s requires either a detector or a pattern", f.Name)
+	}
+	if f.Pattern != "" {
+		re, err := regexp.Compile(f.Pattern)
+		if err != nil {
+			return fmt.Errorf("content filter %s: invalid pattern: %w", f.Name, err)
+		}
+		f.re = re
+		if f.Replacement == "" {
+			f.Replacement = "[REDACTED]"
+		}
+		return nil
+	}
+	for _, p := range piiPatterns {
+		if p.name == f.Detector {
+			f.re, f.valid = p.re, p.valid
+			if f.Replacement == "" {
+				f.Replacement = p.placeholder
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("content filter %s: unknown detector %q", f.Name, f.Detector)
+}
+
+// loadContentFilters reads the content filters of a JSON file
+func loadContentFilters(path string) ([]ContentFilter, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read content filters file: %w", err)
+	}
+	var filters []ContentFilter
+	if err := json.Unmarshal(data, &filters); err != nil {
+		return nil, fmt.Errorf("failed to parse content filters file: %w", err)
+	}
+	for i := range filters {
+		if err := filters[i].compile(); err != nil {
+			return nil, err
+		}
+	}
+	return filters, nil
+}
+
+// filterText applies the filters to text, counting their matches in hits
+// by filter, and returns it with the matches of redacting filters replaced
+func filterText(filters []ContentFilter, text string, hits []int) string {
+	for i, f := range filters {
+		text = f.re.ReplaceAllStringFunc(text, func(match string) string {
+			if f.valid != nil && !f.valid(match) {
+				return match
+			}
+			hits[i]++
+			if f.Action == FilterRedact {
+				return f.Replacement
+			}
+			return match
+		})
+	}
+	return text
+}
+
+// filterValue applies the filters to the strings of a decoded JSON value,
+// in place, and returns the value
+func filterValue(filters []ContentFilter, v any, hits []int) any {
+	switch v := v.(type) {
+	case string:
+		return filterText(filters, v, hits)
+	case map[string]any:
+		for key, member := range v {
+			if !contentFilterSkipped[key] {
+				v[key] = filterValue(filters, member, hits)
+			}
+		}
+	case []any:
+		for i, item := range v {
+			v[i] = filterValue(filters, item, hits)
+		}
+	}
+	return v
+}
+
+// contentFilterError is the error of a request that blocking filters
+// matched
+type contentFilterError struct {
+	filters []string
+}
+
+func (e *contentFilterError) Error() string {
+	return "The request was blocked by content filter " + strings.Join(e.filters, ", ")
+}
+
+// applyContentFilters applies the content filters to a decoded request
+// body, counting and logging their matches, and returns it with the matches
+// of redacting filters replaced and whether there were any. It returns a
+// *contentFilterError if a blocking filter matched. source names where the
+// request came from in logs. Every prompt bound upstream goes through here,
+// whether it came in over HTTP or from a bridge or schedule.
+func (s *ProxyServer) applyContentFilters(doc any, timeline *requestTimeline, source string) (any, bool, error) {
+	hits := make([]int, len(s.contentFilters))
+	doc = filterValue(s.contentFilters, doc, hits)
+	var blocked []string
+	redacted := false
+	for i, n := range hits {
+		if n == 0 {
+			continue
+		}
+		f := s.contentFilters[i]
+		s.metrics.contentFilterMatches.Add(float64(n), f.Name, f.Action)
+		timeline.Addf(TimelineFiltered, "%s: %s %d", f.Name, f.Action, n)
+		switch f.Action {
+		case FilterBlock:
+			blocked = append(blocked, f.Name)
+		case FilterRedact:
+			redacted = true
+		case FilterLog:
+			if id := timeline.id(); id != "" {
+				source = "request " + id + " to " + source
+			}
+			log.Printf("Content filter %s matched %d times in %s", f.Name, n, source)
+		}
+	}
+	if len(blocked) > 0 {
+		return doc, redacted, &contentFilterError{filters: blocked}
+	}
+	return doc, redacted, nil
+}
+
+// filterRequest applies the content filters to a chat completion request
+// built by the proxy itself, such as those of bridges and schedules, which
+// reach the upstream without passing withContentFilters
+func (s *ProxyServer) filterRequest(req *ChatCompletionRequest, source string) error {
+	if len(s.contentFilters) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		return err
+	}
+	doc, redacted, err := s.applyContentFilters(doc, nil, source)
+	if err != nil || !redacted {
+		return err
+	}
+	if data, err = json.Marshal(doc); err != nil {
+		return err
+	}
+	var filtered ChatCompletionRequest
+	if err := json.Unmarshal(data, &filtered); err != nil {
+		return err
+	}
+	*req = filtered
+	return nil
+}
+
+// withContentFilters applies the content filters to the request body
+// before the request goes on
+func (s *ProxyServer) withContentFilters(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(s.contentFilters) == 0 {
+			next(w, r)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.UseNumber()
+		var doc any
+		if dec.Decode(&doc) != nil {
+			// The handler reports the body as invalid
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			next(w, r)
+			return
+		}
+
+		doc, redacted, err := s.applyContentFilters(doc, timelineFromContext(r.Context()), r.URL.Path)
+		if err != nil {
+			var resp ErrorResponse
+			resp.Error.Message = err.Error()
+			resp.Error.Type = "invalid_request_error"
+			resp.Error.Code = "content_filtered"
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(resp)
+			return
+		}
+		if redacted {
+			var out bytes.Buffer
+			enc := json.NewEncoder(&out)
+			enc.SetEscapeHTML(false)
+			if err := enc.Encode(doc); err == nil {
+				body = out.Bytes()
+			}
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+		next(w, r)
+	}
+}
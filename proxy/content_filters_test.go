@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newContentFilterServer(t *testing.T, filters ...ContentFilter) (*recordingOpenAIClient, http.Handler) {
+	t.Helper()
+	for i := range filters {
+		if err := filters[i].compile(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	client := &recordingOpenAIClient{MockOpenAIClient: MockOpenAIClient{response: createTestChatCompletionResponse()}}
+	server := NewProxyServer(client)
+	server.keys = createTestKeyStore(t)
+	server.submissions = nil
+	server.contentFilters = filters
+	return client, server.Handler()
+}
+
+func postFiltered(handler http.Handler, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer sk-full")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func TestContentFilter_Compile(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter ContentFilter
+		ok     bool
+	}{
+		{"detector", ContentFilter{Name: "emails", Detector: "email"}, true},
+		{"pattern", ContentFilter{Name: "tickets", Pattern: `TICKET-\d+`, Action: FilterLog}, true},
+		{"no name", ContentFilter{Detector: "email"}, false},
+		{"unknown detector", ContentFilter{Name: "x", Detector: "passport"}, false},
+		{"unknown action", ContentFilter{Name: "x", Detector: "email", Action: "drop"}, false},
+		{"both", ContentFilter{Name: "x", Detector: "email", Pattern: "a"}, false},
+		{"neither", ContentFilter{Name: "x"}, false},
+		{"invalid pattern", ContentFilter{Name: "x", Pattern: "("}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.filter.compile(); (err == nil) != tt.ok {
+				t.Errorf("Expected ok=%v, got %v", tt.ok, err)
+			}
+		})
+	}
+
+	f := ContentFilter{Name: "emails", Detector: "email"}
+	f.compile()
+	if f.Action != FilterRedact || f.Replacement != "[EMAIL]" {
+		t.Errorf("Expected to redact with [EMAIL] by default, got %+v", f)
+	}
+}
+
+func TestLoadContentFilters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "filters.json")
+	os.WriteFile(path, []byte(`[{"name": "cards", "detector": "card", "action": "block"}, {"name": "codenames", "pattern": "(?i)project falcon"}]`), 0o600)
+	filters, err := loadContentFilters(path)
+	if err != nil || len(filters) != 2 || filters[1].Replacement != "[REDACTED]" {
+		t.Fatalf("Expected two filters, got %+v and %v", filters, err)
+	}
+	os.WriteFile(path, []byte(`[{"name": "cards", "detector": "cards"}]`), 0o600)
+	if _, err := loadContentFilters(path); err == nil {
+		t.Error("Expected an error for an unknown detector")
+	}
+}
+
+func TestProxyServer_ContentFilterRedacts(t *testing.T) {
+	client, handler := newContentFilterServer(t,
+		ContentFilter{Name: "emails", Detector: "email"},
+		ContentFilter{Name: "codenames", Pattern: `(?i)project falcon`, Replacement: "<codename>"},
+	)
+	w := postFiltered(handler, `{"model": "gpt-4o", "messages": [{"role": "user", "content": [{"type": "text", "text": "Mail jane@example.com about Project Falcon"}]}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the request to succeed, got %d %s", w.Code, w.Body.String())
+	}
+	got := client.last.Messages[0]
+	if got.Content != "Mail [EMAIL] about <codename>" || got.Parts[0].Text != got.Content {
+		t.Errorf("Expected the prompt redacted before going upstream, got %q and %+v", got.Content, got.Parts)
+	}
+	if client.last.Model != "gpt-4o" {
+		t.Errorf("Expected the model to be left alone, got %q", client.last.Model)
+	}
+}
+
+func TestProxyServer_ContentFilterBlocks(t *testing.T) {
+	client, handler := newContentFilterServer(t,
+		ContentFilter{Name: "cards", Detector: "card", Action: FilterBlock},
+	)
+	w := postFiltered(handler, `{"model": "gpt-4o", "messages": [{"role": "user", "content": "My card is 4111 1111 1111 1111"}]}`)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected the request to be blocked, got %d", w.Code)
+	}
+	var resp ErrorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Error.Code != "content_filtered" || !strings.Contains(resp.Error.Message, "cards") {
+		t.Errorf("Expected a content_filtered error naming the filter, got %s", w.Body.String())
+	}
+	if client.last.Model != "" {
+		t.Error("Expected the blocked request not to go upstream")
+	}
+
+	// Numbers failing the checksum only look like cards
+	w = postFiltered(handler, `{"model": "gpt-4o", "messages": [{"role": "user", "content": "Order 1234 5678 9012 3456"}]}`)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected a number that is not a card to pass, got %d", w.Code)
+	}
+}
+
+func TestProxyServer_ContentFilterLogs(t *testing.T) {
+	client, handler := newContentFilterServer(t,
+		ContentFilter{Name: "tickets", Pattern: `TICKET-\d+`, Action: FilterLog},
+	)
+	w := postFiltered(handler, `{"model": "gpt-4o", "messages": [{"role": "user", "content": "Close TICKET-42"}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the request to succeed, got %d", w.Code)
+	}
+	if got := client.last.Messages[0].Content; got != "Close TICKET-42" {
+		t.Errorf("Expected the prompt to go upstream unchanged, got %q", got)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+const visionMessage = `{"role": "user", "content": [{"type": "text", "text": "What is this?"}, {"type": "image_url", "image_url": {"url": "https://example.com/cat.png", "detail": "low"}}, {"type": "input_audio", "input_audio": {"data": "UklGRg==", "format": "wav"}}, {"type": "file", "file": {"file_id": "file-1"}}]}`
+
+func TestMessage_ContentParts(t *testing.T) {
+	var m Message
+	if err := json.Unmarshal([]byte(visionMessage), &m); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if m.Content != "What is this?" || len(m.Parts) != 4 {
+		t.Fatalf("Expected the text and four parts, got %q and %+v", m.Content, m.Parts)
+	}
+	if image := m.Parts[1].ImageURL; image == nil || image.URL != "https://example.com/cat.png" || image.Detail != "low" {
+		t.Errorf("Unexpected image part %+v", m.Parts[1])
+	}
+	if audio := m.Parts[2].InputAudio; audio == nil || audio.Format != "wav" {
+		t.Errorf("Unexpected audio part %+v", m.Parts[2])
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	var got, want any
+	json.Unmarshal(data, &got)
+	json.Unmarshal([]byte(visionMessage), &want)
+	if gotJSON, wantJSON := mustJSON(got), mustJSON(want); gotJSON != wantJSON {
+		t.Errorf("Expected the parts to round-trip, got %s, want %s", gotJSON, wantJSON)
+	}
+
+	// Plain strings stay strings, and reusing a message clears its parts
+	if err := json.Unmarshal([]byte(`{"role": "user", "content": "Hi"}`), &m); err != nil || m.Content != "Hi" || m.Parts != nil {
+		t.Errorf("Expected plain content, got %+v and %v", m, err)
+	}
+	if data, _ := json.Marshal(m); !strings.Contains(string(data), `"content":"Hi"`) {
+		t.Errorf("Expected string content, got %s", data)
+	}
+	if err := json.Unmarshal([]byte(`{"role": "user", "content": 42}`), &m); err == nil {
+		t.Error("Expected an error for content that is neither a string nor parts")
+	}
+}
+
+func mustJSON(v any) string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+func TestMessage_MapTextRedactsParts(t *testing.T) {
+	var m Message
+	json.Unmarshal([]byte(`{"role": "user", "content": [{"type": "text", "text": "Mail jane@example.com"}, {"type": "image_url", "image_url": {"url": "https://example.com/a.png"}}]}`), &m)
+	redacted := redactMessages([]Message{m})[0]
+	if strings.Contains(redacted.Content, "jane@") || strings.Contains(redacted.Parts[0].Text, "jane@") {
+		t.Errorf("Expected the address redacted from the text and its part, got %+v", redacted)
+	}
+	if m.Parts[0].Text != "Mail jane@example.com" || redacted.Parts[1].ImageURL.URL != "https://example.com/a.png" {
+		t.Errorf("Expected the original left alone and the image kept, got %+v and %+v", m, redacted)
+	}
+}
+
+func TestProxyServer_ForwardsContentParts(t *testing.T) {
+	upstream := newRecordingUpstream(t)
+	client := NewRealOpenAIClient("sk-test")
+	client.BaseURL = upstream.URL
+	server := NewProxyServer(client)
+
+	w := chatRequestAs(server, nil, `{"model": "gpt-4o", "messages": [`+visionMessage+`]}`)
+	if w.Code != 200 {
+		t.Fatalf("Expected status code 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var sent struct {
+		Messages []map[string]any `json:"messages"`
+	}
+	json.Unmarshal([]byte(upstream.body), &sent)
+	if len(sent.Messages) != 1 {
+		t.Fatalf("Expected one message upstream, got %s", upstream.body)
+	}
+	parts, ok := sent.Messages[0]["content"].([]any)
+	if !ok || len(parts) != 4 || !strings.Contains(upstream.body, "https://example.com/cat.png") || !strings.Contains(upstream.body, "file-1") {
+		t.Errorf("Expected the content parts sent upstream as they came, got %s", upstream.body)
+	}
+}
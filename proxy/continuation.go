@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"strings"
+)
+
+// A reply cut off by max_tokens ends with finish_reason "length", and every
+// client wanting the whole answer has to ask the model to go on and stitch
+// the parts together. With PROXY_AUTO_CONTINUE_TOKENS, or a tenant's
+// auto_continue_tokens, the proxy does it: it asks for the rest until the
+// model stops on its own or the completion tokens of all parts reach the
+// budget, and returns one combined reply.
+
+// maxContinuations bounds the continuation requests of one reply
+const maxContinuations = 8
+
+// continuePrompt asks the model for the rest of a cut-off reply
+const continuePrompt = "Continue exactly where you stopped, without repeating anything."
+
+// continuationBudget returns the completion tokens a reply to key may add
+// up to across continuations, or 0 if replies are not continued
+func (s *ProxyServer) continuationBudget(key *ClientKey) int {
+	if key != nil && key.Tenant != "" {
+		if tenant, ok := s.tenants.Get(key.Tenant); ok && tenant.AutoContinueTokens != nil {
+			return *tenant.AutoContinueTokens
+		}
+	}
+	return s.autoContinueTokens
+}
+
+// inspectsCompletions reports whether replies to key are retried or
+// continued, which takes decoding them
+func (s *ProxyServer) inspectsCompletions(key *ClientKey) bool {
+	return s.retriesCompletions(key) || s.continuationBudget(key) > 0
+}
+
+// continueCompletion asks for the rest of a reply cut off by max_tokens
+// until the model stops, budget completion tokens are used or
+// maxContinuations requests are made. The parts are joined into one reply
+// whose usage adds up every request.
+func (s *ProxyServer) continueCompletion(ctx context.Context, req ChatCompletionRequest, resp *ChatCompletionResponse, budget int) (*ChatCompletionResponse, error) {
+	if len(resp.Choices) == 0 || resp.Choices[0].FinishReason != "length" || len(resp.Choices[0].Message.ToolCalls) > 0 {
+		return resp, nil
+	}
+	out := *resp
+	out.Choices = append([]Choice(nil), resp.Choices...)
+	var content strings.Builder
+	content.WriteString(resp.Choices[0].Message.Content)
+	continuations := 0
+	for out.Choices[0].FinishReason == "length" && continuations < maxContinuations {
+		remaining := budget - out.Usage.CompletionTokens
+		if remaining <= 0 {
+			break
+		}
+		next := req
+		if next.MaxTokens == nil || *next.MaxTokens > remaining {
+			next.MaxTokens = &remaining
+		}
+		next.Messages = append(append([]Message(nil), req.Messages...),
+			Message{Role: "assistant", Content: content.String()},
+			Message{Role: "user", Content: continuePrompt},
+		)
+		timelineFromContext(ctx).Addf(TimelineRetried, "continuing a reply cut off after %d completion tokens", out.Usage.CompletionTokens)
+		part, err := s.createCompletion(ctx, next)
+		if err != nil {
+			return nil, err
+		}
+		continuations++
+		out.Usage.PromptTokens += part.Usage.PromptTokens
+		out.Usage.CompletionTokens += part.Usage.CompletionTokens
+		out.Usage.TotalTokens += part.Usage.TotalTokens
+		if len(part.Choices) == 0 {
+			break
+		}
+		content.WriteString(part.Choices[0].Message.Content)
+		out.Choices[0].FinishReason = part.Choices[0].FinishReason
+	}
+	out.Choices[0].Message.Content = content.String()
+	if continuations > 0 {
+		metadata := ResponseMetadata{}
+		if out.Metadata != nil {
+			metadata = *out.Metadata
+		}
+		metadata.Continuations = continuations
+		out.Metadata = &metadata
+	}
+	return &out, nil
+}
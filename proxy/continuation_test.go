@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// continuingClient answers with one part of a reply after the other, each
+// cut off by max_tokens but the last
+type continuingClient struct {
+	parts    []string
+	requests []ChatCompletionRequest
+}
+
+func (c *continuingClient) CreateChatCompletion(req ChatCompletionRequest) (*ChatCompletionResponse, error) {
+	c.requests = append(c.requests, req)
+	i := min(len(c.requests), len(c.parts)) - 1
+	resp := createTestChatCompletionResponse()
+	resp.Choices[0].Message.Content = c.parts[i]
+	if i < len(c.parts)-1 {
+		resp.Choices[0].FinishReason = "length"
+	}
+	resp.Usage = Usage{PromptTokens: 5, CompletionTokens: 10, TotalTokens: 15}
+	return resp, nil
+}
+
+func TestProxyServer_AutoContinue(t *testing.T) {
+	client := &continuingClient{parts: []string{"Once upon ", "a time ", "the end."}}
+	server := NewProxyServer(client)
+	server.autoContinueTokens = 100
+
+	w := chatRequestAs(server, nil, `{"model": "gpt-4o", "max_tokens": 10, "messages": [{"role": "user", "content": "Tell a story"}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var resp ChatCompletionResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if got := resp.Choices[0].Message.Content; got != "Once upon a time the end." || resp.Choices[0].FinishReason != "stop" {
+		t.Errorf("Expected the parts stitched together, got %q (%s)", got, resp.Choices[0].FinishReason)
+	}
+	if resp.Usage.TotalTokens != 45 || resp.Usage.CompletionTokens != 30 {
+		t.Errorf("Expected the usage of every part, got %+v", resp.Usage)
+	}
+	if resp.Metadata == nil || resp.Metadata.Continuations != 2 {
+		t.Errorf("Expected two continuations in the metadata, got %+v", resp.Metadata)
+	}
+	last := client.requests[2].Messages
+	if len(last) != 3 || last[1].Role != "assistant" || last[1].Content != "Once upon a time " || last[2].Content != continuePrompt {
+		t.Errorf("Expected the continuation to carry the reply so far, got %+v", last)
+	}
+}
+
+func TestProxyServer_AutoContinueBudget(t *testing.T) {
+	client := &continuingClient{parts: []string{"a", "b", "c", "d"}}
+	server := NewProxyServer(client)
+	server.autoContinueTokens = 25
+	budget := 0
+	server.tenants.Put("acme", Tenant{ID: "acme", AutoContinueTokens: &budget})
+
+	w := chatRequestAs(server, nil, `{"model": "gpt-4o", "messages": [{"role": "user", "content": "Go"}]}`)
+	var resp ChatCompletionResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Choices[0].Message.Content != "abc" || resp.Choices[0].FinishReason != "length" {
+		t.Errorf("Expected continuations to stop at the budget, got %q (%s)", resp.Choices[0].Message.Content, resp.Choices[0].FinishReason)
+	}
+	if len(client.requests) != 3 || *client.requests[2].MaxTokens != 5 {
+		t.Errorf("Expected the last continuation to get the rest of the budget, got %d requests", len(client.requests))
+	}
+
+	client.requests = nil
+	chatRequestAs(server, &ClientKey{ID: "k", Tenant: "acme"}, `{"model": "gpt-4o", "messages": [{"role": "user", "content": "Go"}]}`)
+	if len(client.requests) != 1 {
+		t.Errorf("Expected the tenant to turn continuations off, got %d requests", len(client.requests))
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With prices for the models in PROXY_PRICING_FILE, the proxy tracks what
+// each client key spends: every request's token usage is multiplied by the
+// price of its model and added to the key's spend of the calendar month
+// (UTC). A key with a monthly_budget is rejected with 402 Payment Required
+// once its spend reaches the budget, until the month is over. Temporary
+// tokens spend from the budget of the key they were minted from. Spend is
+// saved to PROXY_COSTS_FILE every minute, so it survives restarts; each
+// replica keeps its own.
+
+// ModelPrice is the price of a model in USD per million tokens
+type ModelPrice struct {
+	Input  float64 `json:"input"`
+	Output float64 `json:"output"`
+}
+
+// pricing maps models to their prices. A trailing "*" matches a prefix,
+// and the longest match wins.
+type pricing map[string]ModelPrice
+
+func (p pricing) price(model string) (ModelPrice, bool) {
+	if price, ok := p[model]; ok {
+		return price, true
+	}
+	var best ModelPrice
+	longest := -1
+	for pattern, price := range p {
+		prefix, ok := strings.CutSuffix(pattern, "*")
+		if ok && strings.HasPrefix(model, prefix) && len(prefix) > longest {
+			best, longest = price, len(prefix)
+		}
+	}
+	return best, longest >= 0
+}
+
+// cost is the price in USD of usage of model, 0 for models without a price
+func (p pricing) cost(model string, usage Usage) float64 {
+	price, ok := p.price(model)
+	if !ok {
+		return 0
+	}
+	return (float64(usage.PromptTokens)*price.Input + float64(usage.CompletionTokens)*price.Output) / 1e6
+}
+
+// costLedger holds the spend of every key by month
+type costLedger struct {
+	prices pricing
+	// path, if set, is the file spend is saved to
+	path string
+	now  func() time.Time
+
+	mu sync.Mutex
+	// spend is in USD by month ("2006-01") and key ID
+	spend map[string]map[string]float64
+	dirty bool
+}
+
+// costLedgerFromEnv reads the prices of PROXY_PRICING_FILE and the spend
+// saved to PROXY_COSTS_FILE, by default data/costs.json. It returns nil
+// without prices.
+func costLedgerFromEnv(getenv func(string) string) (*costLedger, error) {
+	pricesPath := getenv("PROXY_PRICING_FILE")
+	if pricesPath == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(pricesPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pricing file: %w", err)
+	}
+	c := &costLedger{now: time.Now, spend: make(map[string]map[string]float64)}
+	if err := json.Unmarshal(data, &c.prices); err != nil {
+		return nil, fmt.Errorf("failed to parse pricing file: %w", err)
+	}
+	// WASI builds serve one request per process and keep nothing
+	if runtime.GOOS == "wasip1" {
+		return c, nil
+	}
+	c.path = getenv("PROXY_COSTS_FILE")
+	if c.path == "" {
+		c.path = "data/costs.json"
+	}
+	data, err = os.ReadFile(c.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read costs file: %w", err)
+	}
+	if err := json.Unmarshal(data, &c.spend); err != nil {
+		return nil, fmt.Errorf("failed to parse costs file: %w", err)
+	}
+	return c, nil
+}
+
+func (c *costLedger) month() string {
+	return c.now().UTC().Format("2006-01")
+}
+
+// Add adds usd to the spend of key this month
+func (c *costLedger) Add(keyID string, usd float64) {
+	if usd <= 0 {
+		return
+	}
+	month := c.month()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.spend[month] == nil {
+		c.spend[month] = make(map[string]float64)
+	}
+	c.spend[month][keyID] += usd
+	c.dirty = true
+}
+
+// Spent returns the spend of key this month
+func (c *costLedger) Spent(keyID string) float64 {
+	month := c.month()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.spend[month][keyID]
+}
+
+// Month returns a copy of the spend of every key in month
+func (c *costLedger) Month(month string) map[string]float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	spend := make(map[string]float64, len(c.spend[month]))
+	for id, usd := range c.spend[month] {
+		spend[id] = usd
+	}
+	return spend
+}
+
+// Save writes the spend to the costs file if it changed
+func (c *costLedger) Save(ctx context.Context) error {
+	c.mu.Lock()
+	if c.path == "" || !c.dirty {
+		c.mu.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(c.spend)
+	c.dirty = false
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	// Write a new file and rename it over the old one, so a crash midway
+	// leaves the previous spend
+	tmp := c.path + ".tmp"
+	if err := os.MkdirAll(filepath.Dir(c.path), 0o755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
+
+// budgetOwner returns the key whose budget key spends from: its own, or
+// that of the key a temporary token was minted from
+func (s *ProxyServer) budgetOwner(key *ClientKey) *ClientKey {
+	if key.Parent != "" && s.keys != nil {
+		if parent := s.keys.Get(key.Parent); parent != nil {
+			return parent
+		}
+	}
+	return key
+}
+
+// recordCost adds the cost of usage of model to the spend of key and
+// returns it
+func (s *ProxyServer) recordCost(key *ClientKey, model string, usage Usage) float64 {
+	if s.costs == nil || key == nil {
+		return 0
+	}
+	cost := s.costs.prices.cost(model, usage)
+	s.costs.Add(s.budgetOwner(key).ID, cost)
+	return cost
+}
+
+// overBudget returns why key may not spend more this month, or "" if it is
+// within its monthly budget
+func (s *ProxyServer) overBudget(key *ClientKey) string {
+	if s.costs == nil {
+		return ""
+	}
+	owner := s.budgetOwner(key)
+	if owner.MonthlyBudget <= 0 {
+		return ""
+	}
+	spent := s.costs.Spent(owner.ID)
+	if spent < owner.MonthlyBudget {
+		return ""
+	}
+	return fmt.Sprintf("API key %s has spent $%.2f of its monthly budget of $%.2f", owner.ID, spent, owner.MonthlyBudget)
+}
+
+// checkBudget rejects a request of a key over its monthly budget and
+// reports whether it may proceed
+func (s *ProxyServer) checkBudget(w http.ResponseWriter, key *ClientKey) bool {
+	reason := s.overBudget(key)
+	if reason == "" {
+		return true
+	}
+	var resp ErrorResponse
+	resp.Error.Message = reason
+	resp.Error.Type = "insufficient_quota"
+	resp.Error.Code = "budget_exceeded"
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusPaymentRequired)
+	json.NewEncoder(w).Encode(resp)
+	return false
+}
+
+// KeyCost is the spend of a key in a month
+type KeyCost struct {
+	KeyID string  `json:"key_id"`
+	Spend float64 `json:"spend"`
+	// Budget and Remaining are set for keys with a monthly budget
+	Budget    float64  `json:"budget,omitempty"`
+	Remaining *float64 `json:"remaining,omitempty"`
+}
+
+// handleAdminCosts serves GET /admin/costs, the spend of every key in the
+// month of ?month= (e.g. 2026-01), by default the current one, most
+// spending first
+func (s *ProxyServer) handleAdminCosts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	month := r.URL.Query().Get("month")
+	if month == "" {
+		month = s.costs.month()
+	} else if _, err := time.Parse("2006-01", month); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid month %q, expected e.g. 2026-01", month), http.StatusBadRequest)
+		return
+	}
+	spend := s.costs.Month(month)
+	costs := []KeyCost{}
+	total := 0.0
+	for _, key := range s.keys.List() {
+		if key.Parent != "" {
+			continue
+		}
+		usd, ok := spend[key.ID]
+		delete(spend, key.ID)
+		if !ok && key.MonthlyBudget <= 0 {
+			continue
+		}
+		cost := KeyCost{KeyID: key.ID, Spend: usd, Budget: key.MonthlyBudget}
+		if key.MonthlyBudget > 0 {
+			remaining := max(0, key.MonthlyBudget-usd)
+			cost.Remaining = &remaining
+		}
+		costs = append(costs, cost)
+		total += usd
+	}
+	// Keys deleted since keep their spend
+	for id, usd := range spend {
+		costs = append(costs, KeyCost{KeyID: id, Spend: usd})
+		total += usd
+	}
+	sort.Slice(costs, func(i, j int) bool {
+		if costs[i].Spend != costs[j].Spend {
+			return costs[i].Spend > costs[j].Spend
+		}
+		return costs[i].KeyID < costs[j].KeyID
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"month": month, "total": total, "keys": costs})
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPricing_Cost(t *testing.T) {
+	prices := pricing{
+		"gpt-4o":       {Input: 2.5, Output: 10},
+		"gpt-4o*":      {Input: 5, Output: 15},
+		"gpt-4o-mini*": {Input: 0.15, Output: 0.6},
+		"claude-3-5-*": {Input: 3, Output: 15},
+	}
+	usage := Usage{PromptTokens: 1_000_000, CompletionTokens: 500_000}
+	tests := []struct {
+		model string
+		want  float64
+	}{
+		{"gpt-4o", 7.5},
+		{"gpt-4o-2024-08-06", 12.5},
+		{"gpt-4o-mini-2024-07-18", 0.45},
+		{"claude-3-5-sonnet", 10.5},
+		{"llama-3", 0},
+	}
+	for _, tt := range tests {
+		if got := prices.cost(tt.model, usage); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("cost(%s) = %v, want %v", tt.model, got, tt.want)
+		}
+	}
+}
+
+// newTestCostLedger prices gpt-3.5-turbo so that the test completion costs
+// $0.052
+func newTestCostLedger(t *testing.T) *costLedger {
+	t.Helper()
+	dir := t.TempDir()
+	pricesPath := filepath.Join(dir, "pricing.json")
+	os.WriteFile(pricesPath, []byte(`{"gpt-3.5*": {"input": 1000, "output": 2000}}`), 0o644)
+	costs, err := costLedgerFromEnv(func(name string) string {
+		return map[string]string{
+			"PROXY_PRICING_FILE": pricesPath,
+			"PROXY_COSTS_FILE":   filepath.Join(dir, "costs.json"),
+		}[name]
+	})
+	if err != nil {
+		t.Fatalf("Failed to open cost ledger: %v", err)
+	}
+	return costs
+}
+
+func TestProxyServer_MonthlyBudget(t *testing.T) {
+	server := NewProxyServer(&MockOpenAIClient{response: createTestChatCompletionResponse()})
+	server.submissions = nil
+	server.keys, _ = NewKeyStore([]ClientKey{{ID: "full", Key: "sk-full", MonthlyBudget: 0.1}})
+	server.costs = newTestCostLedger(t)
+	handler := server.withAuth(server.handleChatCompletions)
+	body, _ := json.Marshal(createTestChatCompletionRequest())
+
+	send := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer sk-full")
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w
+	}
+	for i := 0; i < 2; i++ {
+		if w := send(); w.Code != http.StatusOK {
+			t.Fatalf("Expected request %d within budget to succeed, got %d: %s", i+1, w.Code, w.Body.String())
+		}
+	}
+	w := send()
+	if w.Code != http.StatusPaymentRequired {
+		t.Fatalf("Expected status code %d over budget, got %d", http.StatusPaymentRequired, w.Code)
+	}
+	var resp ErrorResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Error.Code != "budget_exceeded" {
+		t.Errorf("Expected code budget_exceeded, got %+v", resp.Error)
+	}
+
+	// The spend of a new month starts from nothing
+	server.costs.now = func() time.Time { return time.Now().AddDate(0, 1, 0) }
+	if w := send(); w.Code != http.StatusOK {
+		t.Errorf("Expected the budget to reset in a new month, got %d", w.Code)
+	}
+}
+
+func TestProxyServer_HandleAdminCosts(t *testing.T) {
+	server := NewProxyServer(&MockOpenAIClient{})
+	server.keys, _ = NewKeyStore([]ClientKey{
+		{ID: "full", Key: "sk-full"},
+		{ID: "mini-only", Key: "sk-mini", MonthlyBudget: 5},
+		{ID: "unused", Key: "sk-unused"},
+	})
+	server.costs = newTestCostLedger(t)
+	server.costs.Add("full", 1.5)
+	server.costs.Add("deleted", 0.25)
+
+	w := httptest.NewRecorder()
+	server.handleAdminCosts(w, httptest.NewRequest("GET", "/admin/costs", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	var resp struct {
+		Month string    `json:"month"`
+		Total float64   `json:"total"`
+		Keys  []KeyCost `json:"keys"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Month != time.Now().UTC().Format("2006-01") || resp.Total != 1.75 {
+		t.Errorf("Expected this month's total of 1.75, got %s %v", resp.Month, resp.Total)
+	}
+	if len(resp.Keys) != 3 || resp.Keys[0].KeyID != "full" || resp.Keys[1].KeyID != "deleted" || resp.Keys[2].KeyID != "mini-only" {
+		t.Fatalf("Expected full, deleted and mini-only by spend, got %+v", resp.Keys)
+	}
+	if mini := resp.Keys[2]; mini.Budget != 5 || mini.Remaining == nil || *mini.Remaining != 5 {
+		t.Errorf("Expected the budget of mini-only untouched, got %+v", mini)
+	}
+
+	w = httptest.NewRecorder()
+	server.handleAdminCosts(w, httptest.NewRequest("GET", "/admin/costs?month=last", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d for an invalid month, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestCostLedger_Save(t *testing.T) {
+	costs := newTestCostLedger(t)
+	costs.Add("full", 0.5)
+	if err := costs.Save(context.Background()); err != nil {
+		t.Fatalf("Failed to save costs: %v", err)
+	}
+	data, err := os.ReadFile(costs.path)
+	if err != nil {
+		t.Fatalf("Failed to read costs file: %v", err)
+	}
+	var spend map[string]map[string]float64
+	json.Unmarshal(data, &spend)
+	if spend[costs.month()]["full"] != 0.5 {
+		t.Errorf("Expected the spend of full saved, got %s", data)
+	}
+}
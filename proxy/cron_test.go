@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron_Next(t *testing.T) {
+	// Wednesday
+	from := time.Date(2024, 5, 15, 10, 7, 30, 0, time.UTC)
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2024, 5, 15, 10, 8, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, 5, 15, 10, 15, 0, 0, time.UTC)},
+		{"0 9 * * *", time.Date(2024, 5, 16, 9, 0, 0, 0, time.UTC)},
+		{"30 8 * * mon-fri", time.Date(2024, 5, 16, 8, 30, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2024, 5, 19, 0, 0, 0, 0, time.UTC)},
+		{"0 12 1,15 * *", time.Date(2024, 5, 15, 12, 0, 0, 0, time.UTC)},
+		{"0 8 1,15 * *", time.Date(2024, 6, 1, 8, 0, 0, 0, time.UTC)},
+		// Either day field matches when both are restricted
+		{"0 12 1 * fri", time.Date(2024, 5, 17, 12, 0, 0, 0, time.UTC)},
+		{"0 0 29 feb *", time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"5/20 10 * * *", time.Date(2024, 5, 15, 10, 25, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		cron, err := parseCron(tt.expr, time.UTC)
+		if err != nil {
+			t.Errorf("parseCron(%q): %v", tt.expr, err)
+			continue
+		}
+		if got := cron.Next(from); !got.Equal(tt.want) {
+			t.Errorf("%q: expected %v, got %v", tt.expr, tt.want, got)
+		}
+	}
+}
+
+func TestParseCron_Timezone(t *testing.T) {
+	loc := time.FixedZone("UTC+5:30", 5*3600+1800)
+	cron, _ := parseCron("0 9 * * *", loc)
+	got := cron.Next(time.Date(2024, 5, 15, 0, 0, 0, 0, time.UTC))
+	if want := time.Date(2024, 5, 15, 3, 30, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("Expected %v, got %v", want, got.UTC())
+	}
+}
+
+func TestParseCron_Invalid(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "* * * foo *"} {
+		if _, err := parseCron(expr, time.UTC); err == nil {
+			t.Errorf("Expected %q to be invalid", expr)
+		}
+	}
+	cron, _ := parseCron("0 0 30 feb *", time.UTC)
+	if next := cron.Next(time.Now()); !next.IsZero() {
+		t.Errorf("Expected no run for February 30th, got %v", next)
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ConversationRecord is one logged conversation as read by the dataset
+// tooling. Sessions exported with ?format=json decode into it as well, their
+// "updated" standing in for the time.
+type ConversationRecord struct {
+	ID       string    `json:"id"`
+	Time     time.Time `json:"time"`
+	Tenant   string    `json:"tenant,omitempty"`
+	KeyID    string    `json:"key_id,omitempty"`
+	Model    string    `json:"model,omitempty"`
+	Messages []Message `json:"messages"`
+	// Feedback is the rating the conversation received, if any. Scores are
+	// whatever scale the client rates on; -min-feedback compares against it
+	// as is.
+	Feedback *float64 `json:"feedback,omitempty"`
+}
+
+// datasetFilter selects the conversations that go into a dataset
+type datasetFilter struct {
+	// MinFeedback, if set, drops conversations rated below it as well as
+	// those that were never rated
+	MinFeedback *float64
+	Tenants     map[string]bool
+	Since       time.Time
+	Until       time.Time
+}
+
+func (f datasetFilter) matches(record ConversationRecord) bool {
+	if f.MinFeedback != nil && (record.Feedback == nil || *record.Feedback < *f.MinFeedback) {
+		return false
+	}
+	if len(f.Tenants) > 0 && !f.Tenants[record.Tenant] {
+		return false
+	}
+	if !f.Since.IsZero() && record.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !record.Time.Before(f.Until) {
+		return false
+	}
+	return true
+}
+
+// DatasetStats counts what happened to the conversations read while
+// building a dataset
+type DatasetStats struct {
+	Read       int `json:"read"`
+	Filtered   int `json:"filtered"`
+	Unanswered int `json:"unanswered"`
+	Duplicates int `json:"duplicates"`
+	Train      int `json:"train"`
+	Validation int `json:"validation"`
+}
+
+// datasetBuilder turns conversation records into fine-tuning examples
+type datasetBuilder struct {
+	filter datasetFilter
+	// validation is the share of conversations held out, between 0 and 1
+	validation float64
+	// seed changes which conversations are held out without changing how
+	// many
+	seed       string
+	deidentify bool
+
+	seen  map[uint64]bool
+	stats DatasetStats
+}
+
+// add writes record to train or validation, or drops it. The split hashes
+// the record ID, so a conversation stays on the same side when the dataset
+// is rebuilt from a larger log.
+func (b *datasetBuilder) add(record ConversationRecord, train, validation *json.Encoder) error {
+	b.stats.Read++
+	if !b.filter.matches(record) {
+		b.stats.Filtered++
+		return nil
+	}
+	messages := fineTuneMessages(record.Messages)
+	if len(messages) == 0 {
+		b.stats.Unanswered++
+		return nil
+	}
+	if b.deidentify {
+		messages = redactMessages(messages)
+	}
+
+	// Drop conversations that are identical after redaction, such as the
+	// same canned prompt sent by a scheduled job every day
+	content := fnv.New64a()
+	for _, m := range messages {
+		fmt.Fprintf(content, "%s\x00%s\x00", m.Role, m.Content)
+	}
+	sum := content.Sum64()
+	if b.seen[sum] {
+		b.stats.Duplicates++
+		return nil
+	}
+	b.seen[sum] = true
+
+	split := fnv.New64a()
+	io.WriteString(split, b.seed+"\x00"+record.ID)
+	example := map[string][]Message{"messages": messages}
+	if float64(split.Sum64()%10000) < b.validation*10000 {
+		b.stats.Validation++
+		return validation.Encode(example)
+	}
+	b.stats.Train++
+	return train.Encode(example)
+}
+
+// readConversations decodes a stream of JSON values, one conversation per
+// value as in a JSON Lines log, or {"sessions": [...]} as written by the
+// session export, and calls fn for each conversation
+func readConversations(r io.Reader, fn func(ConversationRecord) error) error {
+	dec := json.NewDecoder(r)
+	for {
+		var value struct {
+			ConversationRecord
+			Updated  time.Time `json:"updated"`
+			Sessions []struct {
+				ConversationRecord
+				Updated time.Time `json:"updated"`
+			} `json:"sessions"`
+		}
+		if err := dec.Decode(&value); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if value.Sessions != nil {
+			for _, session := range value.Sessions {
+				if session.Time.IsZero() {
+					session.Time = session.Updated
+				}
+				if err := fn(session.ConversationRecord); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if value.Time.IsZero() {
+			value.Time = value.Updated
+		}
+		if err := fn(value.ConversationRecord); err != nil {
+			return err
+		}
+	}
+}
+
+// parseDatasetTime accepts a date, taken as midnight UTC, or an RFC 3339
+// time
+func parseDatasetTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+const datasetUsage = `Usage: proxy dataset build [flags] [file ...]
+
+Reads conversations from the files given, or from standard input, filters
+and de-identifies them, and writes train.jsonl and validation.jsonl in the
+chat fine-tuning format.
+
+Flags:
+`
+
+// runDatasetCommand runs "proxy dataset <args>" and reports a summary to
+// stdout
+func runDatasetCommand(args []string, stdin io.Reader, stdout io.Writer) error {
+	if len(args) == 0 || args[0] != "build" {
+		return errors.New("usage: proxy dataset build [flags] [file ...]")
+	}
+	flags := flag.NewFlagSet("dataset build", flag.ContinueOnError)
+	flags.SetOutput(stdout)
+	flags.Usage = func() {
+		fmt.Fprint(stdout, datasetUsage)
+		flags.PrintDefaults()
+	}
+	outDir := flags.String("out", ".", "directory to write train.jsonl and validation.jsonl to")
+	minFeedback := flags.String("min-feedback", "", "keep only conversations rated at least this")
+	tenants := flags.String("tenant", "", "comma-separated tenants to keep")
+	since := flags.String("since", "", "keep conversations from this date or RFC 3339 time on")
+	until := flags.String("until", "", "keep conversations before this date or RFC 3339 time")
+	validation := flags.Float64("validation", 0.1, "share of conversations held out for validation")
+	seed := flags.String("seed", "", "changes which conversations are held out")
+	deidentify := flags.Bool("deidentify", true, "redact emails, phone numbers, card numbers and keys")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	b := &datasetBuilder{validation: *validation, seed: *seed, deidentify: *deidentify, seen: make(map[uint64]bool)}
+	if b.validation < 0 || b.validation > 1 {
+		return errors.New("-validation must be between 0 and 1")
+	}
+	if *minFeedback != "" {
+		var score float64
+		if _, err := fmt.Sscan(*minFeedback, &score); err != nil {
+			return fmt.Errorf("invalid -min-feedback: %w", err)
+		}
+		b.filter.MinFeedback = &score
+	}
+	if *tenants != "" {
+		b.filter.Tenants = make(map[string]bool)
+		for _, tenant := range strings.Split(*tenants, ",") {
+			b.filter.Tenants[strings.TrimSpace(tenant)] = true
+		}
+	}
+	var err error
+	if b.filter.Since, err = parseDatasetTime(*since); err != nil {
+		return fmt.Errorf("invalid -since: %w", err)
+	}
+	if b.filter.Until, err = parseDatasetTime(*until); err != nil {
+		return fmt.Errorf("invalid -until: %w", err)
+	}
+
+	if err := os.MkdirAll(*outDir, 0o755); err != nil {
+		return err
+	}
+	trainFile, err := os.Create(filepath.Join(*outDir, "train.jsonl"))
+	if err != nil {
+		return err
+	}
+	defer trainFile.Close()
+	validationFile, err := os.Create(filepath.Join(*outDir, "validation.jsonl"))
+	if err != nil {
+		return err
+	}
+	defer validationFile.Close()
+	train, held := json.NewEncoder(trainFile), json.NewEncoder(validationFile)
+	add := func(record ConversationRecord) error { return b.add(record, train, held) }
+
+	if flags.NArg() == 0 {
+		if err := readConversations(stdin, add); err != nil {
+			return fmt.Errorf("stdin: %w", err)
+		}
+	}
+	for _, name := range flags.Args() {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		err = readConversations(f, add)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	if err := trainFile.Close(); err != nil {
+		return err
+	}
+	if err := validationFile.Close(); err != nil {
+		return err
+	}
+
+	s := b.stats
+	fmt.Fprintf(stdout, "Read %d conversations: %d filtered out, %d unanswered, %d duplicates\n", s.Read, s.Filtered, s.Unanswered, s.Duplicates)
+	fmt.Fprintf(stdout, "Wrote %d training and %d validation examples to %s\n", s.Train, s.Validation, *outDir)
+	return nil
+}
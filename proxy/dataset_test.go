@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func readExamples(t *testing.T, path string) [][]Message {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", path, err)
+	}
+	var examples [][]Message
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if line == "" {
+			continue
+		}
+		var example struct {
+			Messages []Message `json:"messages"`
+		}
+		if err := json.Unmarshal([]byte(line), &example); err != nil {
+			t.Fatalf("Invalid line %q: %v", line, err)
+		}
+		examples = append(examples, example.Messages)
+	}
+	return examples
+}
+
+func TestDatasetBuild_FiltersAndDeidentifies(t *testing.T) {
+	log := strings.Join([]string{
+		`{"id":"1","time":"2026-03-02T10:00:00Z","tenant":"acme","feedback":5,"messages":[{"role":"user","content":"I'm ann@example.com"},{"role":"assistant","content":"Hi Ann"}]}`,
+		`{"id":"2","time":"2026-03-02T11:00:00Z","tenant":"acme","feedback":1,"messages":[{"role":"user","content":"Bad"},{"role":"assistant","content":"Sorry"}]}`,
+		`{"id":"3","time":"2026-03-02T12:00:00Z","tenant":"globex","feedback":5,"messages":[{"role":"user","content":"Other tenant"},{"role":"assistant","content":"Yes"}]}`,
+		`{"id":"4","time":"2026-02-01T12:00:00Z","tenant":"acme","feedback":5,"messages":[{"role":"user","content":"Too old"},{"role":"assistant","content":"Yes"}]}`,
+		`{"id":"5","time":"2026-03-03T12:00:00Z","tenant":"acme","messages":[{"role":"user","content":"Unrated"},{"role":"assistant","content":"Yes"}]}`,
+		`{"id":"6","time":"2026-03-03T12:00:00Z","tenant":"acme","feedback":4,"messages":[{"role":"user","content":"Unanswered"}]}`,
+		`{"id":"7","time":"2026-03-04T12:00:00Z","tenant":"acme","feedback":4,"messages":[{"role":"user","content":"I'm bob@example.com"},{"role":"assistant","content":"Hi Ann"}]}`,
+	}, "\n")
+	dir := t.TempDir()
+	var out bytes.Buffer
+	args := []string{"build", "-out", dir, "-min-feedback", "4", "-tenant", "acme", "-since", "2026-03-01", "-validation", "0"}
+	if err := runDatasetCommand(args, strings.NewReader(log), &out); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	train := readExamples(t, filepath.Join(dir, "train.jsonl"))
+	if len(train) != 1 {
+		t.Fatalf("Expected one training example, got %+v", train)
+	}
+	if train[0][0].Content != "I'm [EMAIL]" {
+		t.Errorf("Expected the email to be redacted, got %q", train[0][0].Content)
+	}
+	if held := readExamples(t, filepath.Join(dir, "validation.jsonl")); len(held) != 0 {
+		t.Errorf("Expected no validation examples, got %+v", held)
+	}
+	if !strings.Contains(out.String(), "Read 7 conversations: 4 filtered out, 1 unanswered, 1 duplicates") {
+		t.Errorf("Unexpected summary %q", out.String())
+	}
+}
+
+func TestDatasetBuild_SplitIsStable(t *testing.T) {
+	var log strings.Builder
+	for i := 0; i < 200; i++ {
+		fmt.Fprintf(&log, `{"id":"c%d","messages":[{"role":"user","content":"Question %d"},{"role":"assistant","content":"Answer"}]}`+"\n", i, i)
+	}
+	build := func(input string) ([][]Message, [][]Message) {
+		dir := t.TempDir()
+		if err := runDatasetCommand([]string{"build", "-out", dir, "-validation", "0.25"}, strings.NewReader(input), &bytes.Buffer{}); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		return readExamples(t, filepath.Join(dir, "train.jsonl")), readExamples(t, filepath.Join(dir, "validation.jsonl"))
+	}
+
+	train, held := build(log.String())
+	if len(train)+len(held) != 200 {
+		t.Fatalf("Expected 200 examples, got %d", len(train)+len(held))
+	}
+	if len(held) < 30 || len(held) > 70 {
+		t.Errorf("Expected about a quarter held out, got %d", len(held))
+	}
+
+	// The same conversations land on the same side with more data around
+	// them
+	fmt.Fprintf(&log, `{"id":"extra","messages":[{"role":"user","content":"New"},{"role":"assistant","content":"Answer"}]}`+"\n")
+	_, heldAgain := build(log.String())
+	inHeld := make(map[string]bool)
+	for _, example := range heldAgain {
+		inHeld[example[0].Content] = true
+	}
+	for _, example := range held {
+		if !inHeld[example[0].Content] {
+			t.Errorf("Expected %q to stay in validation", example[0].Content)
+		}
+	}
+}
+
+func TestDatasetBuild_ReadsSessionExport(t *testing.T) {
+	export := `{"sessions":[{"id":"slack:C1","messages":[{"role":"user","content":"Hi"},{"role":"assistant","content":"Hello!"}],"updated":"2026-03-02T10:00:00Z"}]}`
+	dir := t.TempDir()
+	path := filepath.Join(dir, "sessions.json")
+	os.WriteFile(path, []byte(export), 0o644)
+	if err := runDatasetCommand([]string{"build", "-out", dir, "-since", "2026-03-02", "-validation", "0", path}, nil, &bytes.Buffer{}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if train := readExamples(t, filepath.Join(dir, "train.jsonl")); len(train) != 1 {
+		t.Errorf("Expected the exported session as an example, got %+v", train)
+	}
+}
+
+func TestDatasetBuild_InvalidArguments(t *testing.T) {
+	for _, args := range [][]string{
+		{},
+		{"publish"},
+		{"build", "-validation", "2"},
+		{"build", "-since", "yesterday"},
+		{"build", "-min-feedback", "good"},
+	} {
+		if err := runDatasetCommand(args, strings.NewReader(""), &bytes.Buffer{}); err == nil {
+			t.Errorf("Expected an error for %q", args)
+		}
+	}
+}
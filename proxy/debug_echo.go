@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// What reaches the model is rarely what the client sent: virtual models add
+// system prompts, retrieval adds context, content filters redact, providers
+// translate the request to their own API. A request with X-Debug-Echo: true
+// goes through all of that, but instead of being sent upstream, the proxy
+// answers with the upstream requests it would have made, so prompt
+// engineers can check the final payload without paying for a completion.
+
+const debugEchoHeader = "X-Debug-Echo"
+
+// errUpstreamEchoed is the error of upstream calls in debug echo mode. It
+// counts as a cancellation, so the request is not retried and is recorded
+// like one the client gave up on.
+var errUpstreamEchoed = fmt.Errorf("not sent upstream in debug echo mode: %w", context.Canceled)
+
+// secretHeaders are the headers of upstream requests left out of echoes
+var secretHeaders = map[string]bool{"Authorization": true, "Api-Key": true, "X-Api-Key": true}
+
+// UpstreamRequest is a request the proxy would have sent upstream
+type UpstreamRequest struct {
+	Method  string            `json:"method"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+	// Body is JSON if it is, else a string
+	Body json.RawMessage `json:"body"`
+}
+
+// debugEcho collects the upstream requests of a request in echo mode
+type debugEcho struct {
+	mu       sync.Mutex
+	requests []UpstreamRequest
+}
+
+const debugEchoContextKey contextKey = spanContextKey + 1
+
+// debugEchoFromContext returns the echo of a request in echo mode, or nil
+func debugEchoFromContext(ctx context.Context) *debugEcho {
+	e, _ := ctx.Value(debugEchoContextKey).(*debugEcho)
+	return e
+}
+
+// capture records an upstream request instead of sending it, leaving out
+// its credentials
+func (e *debugEcho) capture(req *http.Request, body []byte) {
+	up := UpstreamRequest{Method: req.Method, URL: req.URL.String(), Headers: map[string]string{}}
+	for name, values := range req.Header {
+		if !secretHeaders[name] {
+			up.Headers[name] = strings.Join(values, ", ")
+		}
+	}
+	up.Body, _ = auditBody(body, false)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.requests = append(e.requests, up)
+}
+
+// echoRecorder holds back the reply of a request in echo mode, which is
+// only sent if the request never got as far as the upstream
+type echoRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (e *echoRecorder) Header() http.Header { return e.header }
+
+func (e *echoRecorder) WriteHeader(status int) {
+	if e.status == 0 {
+		e.status = status
+	}
+}
+
+func (e *echoRecorder) Write(p []byte) (int, error) {
+	if e.status == 0 {
+		e.status = http.StatusOK
+	}
+	return e.body.Write(p)
+}
+
+// withDebugEcho answers requests with X-Debug-Echo: true with the upstream
+// requests they would have made. Keys need the debug scope or admin access,
+// as echoes show the prompts of virtual models and guardrails.
+func (s *ProxyServer) withDebugEcho(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !strings.EqualFold(r.Header.Get(debugEchoHeader), "true") {
+			next(w, r)
+			return
+		}
+		// Other endpoints make some of their upstream calls outside the
+		// request, where they could not be held back
+		if r.URL.Path != "/v1/chat/completions" {
+			http.Error(w, debugEchoHeader+" is only supported for chat completions", http.StatusBadRequest)
+			return
+		}
+		if key := clientKeyFromContext(r.Context()); key != nil && !key.Scopes.Debug && key.Scopes.Admin == "" {
+			http.Error(w, "API key is not allowed to use "+debugEchoHeader, http.StatusForbidden)
+			return
+		}
+		// An echo is of the request as it is now, not a reply cached or
+		// in progress for an identical one
+		r.Header.Set("Cache-Control", "no-cache")
+		r.Header.Set(allowDuplicateHeader, "true")
+
+		echo := &debugEcho{}
+		rec := &echoRecorder{header: http.Header{}}
+		next(rec, r.WithContext(context.WithValue(r.Context(), debugEchoContextKey, echo)))
+
+		w.Header().Set(debugEchoHeader, "true")
+		if len(echo.requests) == 0 {
+			// Answered without going upstream, e.g. rejected: pass the
+			// reply on as it is
+			for name, values := range rec.header {
+				w.Header()[name] = values
+			}
+			w.Header().Set(debugEchoHeader, "none")
+			w.WriteHeader(max(rec.status, http.StatusOK))
+			w.Write(rec.body.Bytes())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"upstream_requests": echo.requests})
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newDebugEchoServer(t *testing.T) (*recordingUpstream, http.Handler) {
+	t.Helper()
+	upstream := newRecordingUpstream(t)
+	client := NewRealOpenAIClient("sk-upstream")
+	client.BaseURL = upstream.URL
+	server := NewProxyServer(client)
+	keys, err := NewKeyStore([]ClientKey{
+		{ID: "app", Key: "sk-app"},
+		{ID: "prompts", Key: "sk-prompts", Scopes: KeyScopes{Debug: true}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.keys = keys
+	server.virtualModels.Put("support", VirtualModel{ID: "support", Model: "gpt-4o-mini", System: "You are a support agent."})
+	return upstream, server.Handler()
+}
+
+func echoRequest(handler http.Handler, path, secret, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+secret)
+	req.Header.Set(debugEchoHeader, "true")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func TestProxyServer_DebugEcho(t *testing.T) {
+	for _, stream := range []bool{false, true} {
+		upstream, handler := newDebugEchoServer(t)
+		body := `{"model": "support", "messages": [{"role": "user", "content": "Where is my order?"}]}`
+		if stream {
+			body = `{"model": "support", "stream": true, "messages": [{"role": "user", "content": "Where is my order?"}]}`
+		}
+		w := echoRequest(handler, "/v1/chat/completions", "sk-prompts", body)
+		if w.Code != http.StatusOK || w.Header().Get(debugEchoHeader) != "true" {
+			t.Fatalf("Expected an echo, got %d %s", w.Code, w.Body.String())
+		}
+		if upstream.last != nil {
+			t.Fatal("Expected nothing to be sent upstream")
+		}
+		var echo struct {
+			UpstreamRequests []UpstreamRequest `json:"upstream_requests"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &echo); err != nil || len(echo.UpstreamRequests) != 1 {
+			t.Fatalf("Expected one upstream request, got %s", w.Body.String())
+		}
+		up := echo.UpstreamRequests[0]
+		if up.Method != "POST" || up.URL != upstream.URL+"/chat/completions" || up.Headers["Content-Type"] != "application/json" {
+			t.Errorf("Expected the upstream request line and headers, got %+v", up)
+		}
+		if _, ok := up.Headers["Authorization"]; ok {
+			t.Error("Expected the upstream key to be left out")
+		}
+		var sent ChatCompletionRequest
+		json.Unmarshal(up.Body, &sent)
+		if sent.Model != "gpt-4o-mini" || len(sent.Messages) != 2 || sent.Messages[0].Content != "You are a support agent." {
+			t.Errorf("Expected the request as the virtual model rewrote it, got %s", up.Body)
+		}
+		if stream != (sent.Stream != nil && *sent.Stream) {
+			t.Errorf("Expected stream=%v in the echoed body, got %s", stream, up.Body)
+		}
+	}
+}
+
+func TestProxyServer_DebugEchoRefused(t *testing.T) {
+	upstream, handler := newDebugEchoServer(t)
+	chat := `{"model": "gpt-4o", "messages": [{"role": "user", "content": "Hi"}]}`
+	if w := echoRequest(handler, "/v1/chat/completions", "sk-app", chat); w.Code != http.StatusForbidden {
+		t.Errorf("Expected keys without the debug scope to be refused, got %d", w.Code)
+	}
+	if w := echoRequest(handler, "/v1/embeddings", "sk-prompts", `{"model": "text-embedding-3-small", "input": "Hi"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected echoes of other endpoints to be refused, got %d", w.Code)
+	}
+
+	// Requests rejected before going upstream get their rejection
+	w := echoRequest(handler, "/v1/chat/completions", "sk-prompts", `{"model": "gpt-4o", "messages": []}`)
+	if w.Code != http.StatusBadRequest || w.Header().Get(debugEchoHeader) != "none" || !strings.Contains(w.Body.String(), "Messages field is required") {
+		t.Errorf("Expected the validation error, got %d %q %s", w.Code, w.Header().Get(debugEchoHeader), w.Body.String())
+	}
+	if upstream.last != nil {
+		t.Error("Expected nothing to be sent upstream")
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Deduplication limits: texts are embedded in one upstream call, so there
+// are at most as many as OpenAI accepts per call
+const (
+	dedupeMaxTexts         = 2048
+	dedupeDefaultThreshold = 0.9
+)
+
+// DedupeRequest is the body of /v1/dedupe
+type DedupeRequest struct {
+	// Model is the embedding model, by default the one of retrieval
+	// augmentation
+	Model string   `json:"model,omitempty"`
+	Texts []string `json:"texts"`
+	// Threshold is the cosine similarity from which two texts count as
+	// duplicates (default 0.9)
+	Threshold float64 `json:"threshold,omitempty"`
+}
+
+// DedupeCluster is a group of near-duplicate texts. Its representative is
+// the first of them in the request.
+type DedupeCluster struct {
+	Representative int            `json:"representative"`
+	Text           string         `json:"text"`
+	Members        []DedupeMember `json:"members"`
+}
+
+// DedupeMember is a text of a cluster with its similarity to the
+// representative
+type DedupeMember struct {
+	Index      int     `json:"index"`
+	Similarity float64 `json:"similarity"`
+}
+
+type DedupeResponse struct {
+	Model    string          `json:"model"`
+	Clusters []DedupeCluster `json:"clusters"`
+	Usage    Usage           `json:"usage"`
+}
+
+// clusterDuplicates groups texts greedily in order: each joins the cluster
+// whose representative it is most similar to, if at least threshold, or
+// starts a new one. Comparing against representatives only, rather than
+// any member, keeps chains of small changes from merging unrelated texts.
+// Identical texts share their embedding and always end up together.
+func clusterDuplicates(texts []string, vectors [][]float64, threshold float64) []DedupeCluster {
+	var clusters []DedupeCluster
+	var reps [][]float64
+	for i, vector := range vectors {
+		best, bestScore := -1, threshold
+		for c, rep := range reps {
+			score := 1.0
+			if texts[i] != clusters[c].Text {
+				score = cosineSimilarity(vector, rep)
+			}
+			if score >= bestScore && (best < 0 || score > bestScore) {
+				best, bestScore = c, score
+			}
+		}
+		if best < 0 {
+			clusters = append(clusters, DedupeCluster{Representative: i, Text: texts[i], Members: []DedupeMember{{Index: i, Similarity: 1}}})
+			reps = append(reps, vector)
+			continue
+		}
+		clusters[best].Members = append(clusters[best].Members, DedupeMember{Index: i, Similarity: bestScore})
+	}
+	return clusters
+}
+
+func (s *ProxyServer) handleDedupe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	buf, err := readBody(r.Body, r.ContentLength)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+	defer putBuffer(buf)
+
+	var req DedupeRequest
+	if err := json.Unmarshal(buf.Bytes(), &req); err != nil {
+		http.Error(w, "Invalid JSON in request body", http.StatusBadRequest)
+		return
+	}
+	if len(req.Texts) == 0 {
+		http.Error(w, "Texts field is required and cannot be empty", http.StatusBadRequest)
+		return
+	}
+	if len(req.Texts) > dedupeMaxTexts {
+		http.Error(w, fmt.Sprintf("At most %d texts can be deduplicated at once", dedupeMaxTexts), http.StatusBadRequest)
+		return
+	}
+	if req.Threshold == 0 {
+		req.Threshold = dedupeDefaultThreshold
+	}
+	if req.Threshold < 0 || req.Threshold > 1 {
+		http.Error(w, "threshold must be between 0 and 1", http.StatusBadRequest)
+		return
+	}
+	if req.Model == "" {
+		req.Model = s.ragEmbeddingModel
+	}
+	key := clientKeyFromContext(r.Context())
+	if key != nil && !key.AllowsModel(req.Model) {
+		http.Error(w, fmt.Sprintf("API key is not allowed to use model %s", req.Model), http.StatusForbidden)
+		return
+	}
+	var tenant string
+	if key != nil {
+		tenant = key.Tenant
+	}
+	model := s.resolveModel(req.Model, tenant)
+
+	// Identical texts are embedded once
+	var unique []string
+	position := make(map[string]int)
+	for _, text := range req.Texts {
+		if _, ok := position[text]; !ok {
+			position[text] = len(unique)
+			unique = append(unique, text)
+		}
+	}
+	event := newUsageEvent(key, "dedupe", model)
+	embedded, _, usage, err := s.embed(model, unique)
+	event.LatencyMS = time.Since(event.Time).Milliseconds()
+	if errors.Is(err, errRetrievalUnsupported) {
+		http.Error(w, "Embeddings are not supported by the upstream client", http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		log.Printf("OpenAI API error: %v", err)
+		event.Status = upstreamErrorStatus(err)
+		s.recordUsage(event)
+		writeUpstreamError(w, err)
+		return
+	}
+	s.recordCompletion(key, event, usage)
+
+	vectors := make([][]float64, len(req.Texts))
+	for i, text := range req.Texts {
+		vectors[i] = embedded[position[text]]
+	}
+	resp := DedupeResponse{Model: req.Model, Clusters: clusterDuplicates(req.Texts, vectors, req.Threshold), Usage: usage}
+
+	out := getBuffer()
+	defer putBuffer(out)
+	if err := json.NewEncoder(out).Encode(resp); err != nil {
+		log.Printf("Failed to encode response: %v", err)
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(out.Bytes())
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func dedupe(server *ProxyServer, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/v1/dedupe", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	server.handleDedupe(w, req)
+	return w
+}
+
+func TestProxyServer_Dedupe(t *testing.T) {
+	client := &ragClient{}
+	server := NewProxyServer(client)
+
+	w := dedupe(server, `{"texts": ["Refund please", "I want a refund", "Shipping is slow", "Refund please", "Refund and shipping"]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var resp DedupeResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if len(resp.Clusters) != 3 {
+		t.Fatalf("Expected three clusters, got %+v", resp.Clusters)
+	}
+	refunds := resp.Clusters[0]
+	if refunds.Representative != 0 || refunds.Text != "Refund please" || len(refunds.Members) != 3 || refunds.Members[1].Index != 1 || refunds.Members[2].Index != 3 {
+		t.Errorf("Expected the refund requests together, got %+v", refunds)
+	}
+	if refunds.Members[1].Similarity < 0.9 || refunds.Members[2].Similarity != 1 {
+		t.Errorf("Expected the similarities to the representative, got %+v", refunds.Members)
+	}
+	if resp.Clusters[1].Representative != 2 || resp.Clusters[2].Representative != 4 {
+		t.Errorf("Expected shipping and the mixed text on their own, got %+v", resp.Clusters[1:])
+	}
+	if resp.Model != "text-embedding-3-small" || resp.Usage.PromptTokens != 2+4+3+3 {
+		t.Errorf("Expected the identical text to be embedded once, got %+v", resp)
+	}
+
+	// A lower threshold merges the mixed text into the refunds
+	w = dedupe(server, `{"texts": ["Refund please", "Shipping is slow", "Refund and shipping"], "threshold": 0.7}`)
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if len(resp.Clusters) != 2 || len(resp.Clusters[0].Members) != 2 {
+		t.Errorf("Expected two clusters, got %+v", resp.Clusters)
+	}
+}
+
+func TestProxyServer_DedupeErrors(t *testing.T) {
+	server := NewProxyServer(&ragClient{})
+	for _, body := range []string{`{}`, `{"texts": ["a"], "threshold": 1.5}`, `{"texts": [` + strings.Repeat(`"a",`, dedupeMaxTexts) + `"a"]}`} {
+		if w := dedupe(server, body); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status code %d, got %d: %s", http.StatusBadRequest, w.Code, w.Body.String())
+		}
+	}
+	if w := dedupe(NewProxyServer(&MockOpenAIClient{}), `{"texts": ["a"]}`); w.Code != http.StatusNotImplemented {
+		t.Errorf("Expected status code %d without embeddings, got %d", http.StatusNotImplemented, w.Code)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Providers retire models on their own schedule, and client apps pinned to
+// one break the day it goes. PROXY_MODEL_DEPRECATIONS maps retired models
+// to their replacements, so requests for them keep working while the
+// replies tell the apps to move on. PROXY_DEFAULT_MODEL serves chat
+// completions that name no model at all.
+
+// ModelDeprecation replaces a model, or those matching a pattern with a
+// trailing *, with another
+type ModelDeprecation struct {
+	Model       string
+	Replacement string
+}
+
+// defaultModelPaths are the routes PROXY_DEFAULT_MODEL applies to, which
+// take chat completion requests
+var defaultModelPaths = map[string]bool{"/v1/chat/completions": true, "/v1/tokenize/chat": true}
+
+// parseModelDeprecations reads deprecations as comma-separated pairs, e.g.
+// "gpt-3.5-turbo-0613=gpt-4o-mini,gpt-4-32k*=gpt-4o"
+func parseModelDeprecations(v string) ([]ModelDeprecation, error) {
+	var deprecations []ModelDeprecation
+	for _, pair := range strings.Split(v, ",") {
+		model, replacement, ok := strings.Cut(pair, "=")
+		model, replacement = strings.TrimSpace(model), strings.TrimSpace(replacement)
+		if !ok || model == "" || replacement == "" {
+			return nil, fmt.Errorf("invalid PROXY_MODEL_DEPRECATIONS %q, expected model=replacement pairs", v)
+		}
+		deprecations = append(deprecations, ModelDeprecation{Model: model, Replacement: replacement})
+	}
+	return deprecations, nil
+}
+
+// replacementFor returns the model a deprecated one is replaced with, by
+// the first deprecation matching it
+func (s *ProxyServer) replacementFor(model string) (string, bool) {
+	for _, d := range s.deprecations {
+		if matchAny([]string{d.Model}, model) {
+			return d.Replacement, true
+		}
+	}
+	return "", false
+}
+
+// withModelDefaults sets the default model on chat completions without one
+// and replaces deprecated models, warning the client. Only the model of
+// the body is touched, the rest is passed on byte for byte.
+func (s *ProxyServer) withModelDefaults(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.defaultModel == "" && len(s.deprecations) == 0 {
+			next(w, r)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+		var model string
+		start, end := -1, -1
+		object := json.Valid(body) && scanObject(body, func(key []byte, from, to int) bool {
+			if string(key) == "model" {
+				start, end = from, to
+				model, _ = jsonStringValue(body[from:to])
+				return false
+			}
+			return true
+		}) == nil
+
+		timeline := timelineFromContext(r.Context())
+		switch {
+		case model == "" && s.defaultModel != "" && defaultModelPaths[r.URL.Path] && object:
+			body = setJSONMember(body, "model", s.defaultModel)
+			timeline.Addf(TimelineRewritten, "default model: %s", s.defaultModel)
+		case model != "":
+			replacement, ok := s.replacementFor(model)
+			if !ok || replacement == model {
+				break
+			}
+			body = replaceJSONValue(body, start, end, replacement)
+			s.metrics.deprecatedModels.Add(1, model, replacement)
+			timeline.Addf(TimelineDeprecated, "%s -> %s", model, replacement)
+			w.Header().Set("Deprecation", "true")
+			w.Header().Add("Warning", fmt.Sprintf(`299 - "Model %s is deprecated and was replaced with %s"`, model, replacement))
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+		next(w, r)
+	}
+}
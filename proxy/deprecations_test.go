@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseModelDeprecations(t *testing.T) {
+	deprecations, err := parseModelDeprecations("gpt-3.5-turbo-0613=gpt-4o-mini, gpt-4-32k*=gpt-4o")
+	if err != nil || len(deprecations) != 2 || deprecations[1] != (ModelDeprecation{Model: "gpt-4-32k*", Replacement: "gpt-4o"}) {
+		t.Errorf("Expected two deprecations, got %+v and %v", deprecations, err)
+	}
+	for _, invalid := range []string{"gpt-3.5-turbo-0613", "=gpt-4o", "gpt-4-32k=", "a=b,"} {
+		if _, err := parseModelDeprecations(invalid); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestProxyServer_ModelDeprecations(t *testing.T) {
+	upstream := newRecordingUpstream(t)
+	client := NewRealOpenAIClient("sk-test")
+	client.BaseURL = upstream.URL
+	server := NewProxyServer(client)
+	server.submissions = nil
+	server.deprecations, _ = parseModelDeprecations("gpt-3.5-turbo-0613=gpt-4o-mini,gpt-4-32k*=gpt-4o")
+
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"gpt-4-32k-0613","temperature":0.5,"messages":[{"role":"user","content":"Hi"}]}`))
+	w := httptest.NewRecorder()
+	server.Handler().ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if upstream.body != `{"model":"gpt-4o","temperature":0.5,"messages":[{"role":"user","content":"Hi"}]}` {
+		t.Errorf("Expected only the model to be replaced, got %s", upstream.body)
+	}
+	if w.Header().Get("Deprecation") != "true" || !strings.Contains(w.Header().Get("Warning"), "gpt-4-32k-0613 is deprecated") {
+		t.Errorf("Expected a deprecation warning, got %v", w.Header())
+	}
+
+	// Current models pass untouched
+	req = httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"gpt-4o","messages":[{"role":"user","content":"Hi"}]}`))
+	w = httptest.NewRecorder()
+	server.Handler().ServeHTTP(w, req)
+	if w.Header().Get("Deprecation") != "" || !strings.Contains(upstream.body, `"model":"gpt-4o"`) {
+		t.Errorf("Expected no deprecation, got %v %s", w.Header(), upstream.body)
+	}
+}
+
+func TestProxyServer_DefaultModel(t *testing.T) {
+	client := &recordingOpenAIClient{MockOpenAIClient: MockOpenAIClient{response: createTestChatCompletionResponse()}}
+	server := NewProxyServer(client)
+	server.submissions = nil
+	server.defaultModel = "gpt-4o-mini"
+
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"messages": [{"role": "user", "content": "Hi"}]}`))
+	w := httptest.NewRecorder()
+	server.Handler().ServeHTTP(w, req)
+	if w.Code != http.StatusOK || client.last.Model != "gpt-4o-mini" {
+		t.Errorf("Expected the default model, got %d %q", w.Code, client.last.Model)
+	}
+
+	// Token breakdowns are of the request as it would be sent
+	w, resp := promptTokensRequest(server.Handler(), `{"messages": [{"role": "user", "content": "Hi"}]}`)
+	if w.Code != http.StatusOK || resp.UpstreamModel != "gpt-4o-mini" {
+		t.Errorf("Expected the default model, got %d %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A slow or failing resolver would otherwise add its latency to, or fail,
+// every request that opens an upstream connection. Upstream hostnames are
+// resolved in process and cached for the TTL of their records, a background
+// job resolves them again before they expire, and the addresses last
+// resolved keep being used while the resolver fails. Hosts can also be
+// pinned to fixed addresses. The TTLs come from a minimal DNS client over
+// UDP, since the standard resolver does not report them; names it cannot
+// resolve, such as those of /etc/hosts or needing a search domain, go
+// through the standard resolver and are kept for the minimum TTL.
+
+// dnsRefreshInterval is how often the refresh job runs; entries expiring
+// before the next run are resolved again
+const dnsRefreshInterval = 10 * time.Second
+
+// dnsIdleTimeout is how long an entry is kept and refreshed without being
+// looked up
+const dnsIdleTimeout = 10 * time.Minute
+
+type dnsEntry struct {
+	ips      []net.IP
+	expires  time.Time
+	lastUsed time.Time
+}
+
+// dnsCache resolves and caches upstream hostnames
+type dnsCache struct {
+	minTTL  time.Duration
+	maxTTL  time.Duration
+	pins    map[string][]net.IP
+	resolve func(ctx context.Context, host string) ([]net.IP, time.Duration, error)
+	now     func() time.Time
+	metrics *proxyMetrics
+
+	mu      sync.Mutex
+	entries map[string]*dnsEntry
+}
+
+func newDNSCache(metrics *proxyMetrics) *dnsCache {
+	c := &dnsCache{
+		minTTL:  5 * time.Second,
+		maxTTL:  5 * time.Minute,
+		pins:    make(map[string][]net.IP),
+		now:     time.Now,
+		metrics: metrics,
+		entries: make(map[string]*dnsEntry),
+	}
+	servers := resolvConfServers("/etc/resolv.conf")
+	c.resolve = func(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+		ips, ttl, err := queryDNS(ctx, servers, host)
+		if err == nil {
+			return ips, ttl, nil
+		}
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+		return ips, 0, nil
+	}
+	return c
+}
+
+// Lookup returns the addresses of host: pinned, cached or resolved anew.
+// When resolving fails, the addresses last resolved are used however old.
+func (c *dnsCache) Lookup(ctx context.Context, host string) ([]net.IP, error) {
+	if ips, ok := c.pins[host]; ok {
+		c.metrics.dnsLookups.Add(1, "pinned")
+		return ips, nil
+	}
+	c.mu.Lock()
+	entry := c.entries[host]
+	if entry != nil {
+		entry.lastUsed = c.now()
+		if c.now().Before(entry.expires) {
+			c.mu.Unlock()
+			c.metrics.dnsLookups.Add(1, "hit")
+			return entry.ips, nil
+		}
+	}
+	c.mu.Unlock()
+
+	ips, err := c.refresh(ctx, host)
+	switch {
+	case err == nil:
+		c.metrics.dnsLookups.Add(1, "miss")
+		return ips, nil
+	case entry != nil:
+		c.metrics.dnsLookups.Add(1, "stale")
+		return entry.ips, nil
+	}
+	c.metrics.dnsLookups.Add(1, "error")
+	return nil, err
+}
+
+// refresh resolves host and caches its addresses
+func (c *dnsCache) refresh(ctx context.Context, host string) ([]net.IP, error) {
+	ips, ttl, err := c.resolve(ctx, host)
+	if err == nil && len(ips) == 0 {
+		err = fmt.Errorf("no addresses for %s", host)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ttl = min(max(ttl, c.minTTL), c.maxTTL)
+	now := c.now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := c.entries[host]
+	if entry == nil {
+		entry = &dnsEntry{lastUsed: now}
+		c.entries[host] = entry
+	}
+	entry.ips, entry.expires = ips, now.Add(ttl)
+	return ips, nil
+}
+
+// Refresh resolves the hosts expiring before its next run again, so
+// lookups keep finding them cached, and forgets hosts no longer looked up.
+// It is the body of the refresh job.
+func (c *dnsCache) Refresh(ctx context.Context) error {
+	now := c.now()
+	var due []string
+	c.mu.Lock()
+	for host, entry := range c.entries {
+		switch {
+		case now.Sub(entry.lastUsed) > dnsIdleTimeout:
+			delete(c.entries, host)
+		case entry.expires.Before(now.Add(2 * dnsRefreshInterval)):
+			due = append(due, host)
+		}
+	}
+	c.mu.Unlock()
+	var errs []error
+	for _, host := range due {
+		if _, err := c.refresh(ctx, host); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// DialContext dials addr through the cache. Hosts with both IPv4 and IPv6
+// addresses are dialed with happy eyeballs; a network of tcp4 or tcp6 only
+// dials addresses of that family.
+func (c *dnsCache) DialContext(dialer *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || net.ParseIP(host) != nil {
+			return dialer.DialContext(ctx, network, addr)
+		}
+		ips, err := c.Lookup(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		addrs := happyEyeballsOrder(ips, network)
+		if len(addrs) == 0 {
+			return nil, fmt.Errorf("no %s addresses for %s", ipFamilyName(network), host)
+		}
+		for i, ip := range addrs {
+			addrs[i] = net.JoinHostPort(ip, port)
+		}
+		return dialHappyEyeballs(ctx, dialer, network, addrs, happyEyeballsDelay)
+	}
+}
+
+// happyEyeballsDelay is how long a connection attempt gets before the next
+// address is tried alongside it, as recommended by RFC 8305
+const happyEyeballsDelay = 250 * time.Millisecond
+
+// happyEyeballsOrder returns the addresses of ips that network can dial,
+// alternating between IPv6 and IPv4 starting with IPv6
+func happyEyeballsOrder(ips []net.IP, network string) []string {
+	var v6, v4 []string
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			if network != "tcp6" {
+				v4 = append(v4, ip.String())
+			}
+		} else if network != "tcp4" {
+			v6 = append(v6, ip.String())
+		}
+	}
+	out := make([]string, 0, len(v6)+len(v4))
+	for i := 0; i < max(len(v6), len(v4)); i++ {
+		if i < len(v6) {
+			out = append(out, v6[i])
+		}
+		if i < len(v4) {
+			out = append(out, v4[i])
+		}
+	}
+	return out
+}
+
+func ipFamilyName(network string) string {
+	switch network {
+	case "tcp4":
+		return "IPv4"
+	case "tcp6":
+		return "IPv6"
+	}
+	return "IP"
+}
+
+// dialHappyEyeballs dials addrs in order, starting the next attempt when
+// the previous one fails or after delay, whichever comes first, and returns
+// the first connection made. A family that is broken, e.g. IPv4 routes in
+// an IPv6-only network, then costs delay instead of a dial timeout.
+func dialHappyEyeballs(ctx context.Context, dialer *net.Dialer, network string, addrs []string, delay time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(addrs))
+	next, pending := 0, 0
+	start := func() {
+		addr := addrs[next]
+		next++
+		pending++
+		go func() {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			results <- result{conn, err}
+		}()
+	}
+	start()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	var firstErr error
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// Attempts still running are cancelled; any that connect
+				// anyway are closed
+				go func(n int) {
+					for range n {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+		case <-timer.C:
+		}
+		if next < len(addrs) {
+			start()
+			timer.Reset(delay)
+		}
+	}
+	return nil, firstErr
+}
+
+// parseDNSPins parses PROXY_DNS_PINS, comma-separated host=ip pairs; a host
+// pinned to several addresses is repeated
+func parseDNSPins(v string) (map[string][]net.IP, error) {
+	pins := make(map[string][]net.IP)
+	for _, pair := range strings.Split(v, ",") {
+		host, addr, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		ip := net.ParseIP(addr)
+		if !ok || host == "" || ip == nil {
+			return nil, fmt.Errorf("invalid PROXY_DNS_PINS entry %q, expected host=ip", pair)
+		}
+		pins[host] = append(pins[host], ip)
+	}
+	return pins, nil
+}
+
+// resolvConfServers returns the nameservers of a resolv.conf file
+func resolvConfServers(path string) []string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var servers []string
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "nameserver" && net.ParseIP(fields[1]) != nil {
+			servers = append(servers, net.JoinHostPort(fields[1], "53"))
+		}
+	}
+	return servers
+}
+
+// DNS record types the client asks for
+const (
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+)
+
+// queryDNS asks servers in turn for the A and AAAA records of host and
+// returns their addresses, IPv4 first, with the lowest TTL of the answers
+func queryDNS(ctx context.Context, servers []string, host string) ([]net.IP, time.Duration, error) {
+	if len(servers) == 0 {
+		return nil, 0, errors.New("no nameservers")
+	}
+	var lastErr error
+	for _, server := range servers {
+		var ips []net.IP
+		ttl := time.Duration(-1)
+		for _, qtype := range []uint16{dnsTypeA, dnsTypeAAAA} {
+			found, t, err := exchangeDNS(ctx, server, host, qtype)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			ips = append(ips, found...)
+			if len(found) > 0 && (ttl < 0 || t < ttl) {
+				ttl = t
+			}
+		}
+		if len(ips) > 0 {
+			return ips, ttl, nil
+		}
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no addresses for %s", host)
+	}
+	return nil, 0, lastErr
+}
+
+// exchangeDNS sends one query over UDP and parses the answer
+func exchangeDNS(ctx context.Context, server, host string, qtype uint16) ([]net.IP, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", server)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	id := uint16(rand.IntN(1 << 16))
+	query, err := dnsQuery(id, host, qtype)
+	if err != nil {
+		return nil, 0, err
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, 0, err
+	}
+	buf := make([]byte, 1232)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, 0, err
+		}
+		ips, ttl, err := parseDNSResponse(buf[:n], id, qtype)
+		// Answers to other queries are ignored, as resolvers do
+		if errors.Is(err, errDNSMismatch) {
+			continue
+		}
+		return ips, ttl, err
+	}
+}
+
+// dnsQuery encodes a recursive query for one record type of host
+func dnsQuery(id uint16, host string, qtype uint16) ([]byte, error) {
+	msg := binary.BigEndian.AppendUint16(nil, id)
+	// Recursion desired, one question
+	msg = append(msg, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0)
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("invalid hostname %q", host)
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, qtype)
+	return binary.BigEndian.AppendUint16(msg, 1), nil
+}
+
+var (
+	errDNSMismatch  = errors.New("DNS response to another query")
+	errDNSMalformed = errors.New("malformed DNS response")
+)
+
+// parseDNSResponse returns the addresses of type qtype in a response and
+// the lowest TTL of its answers
+func parseDNSResponse(msg []byte, id, qtype uint16) ([]net.IP, time.Duration, error) {
+	if len(msg) < 12 {
+		return nil, 0, errDNSMalformed
+	}
+	flags := binary.BigEndian.Uint16(msg[2:])
+	if binary.BigEndian.Uint16(msg) != id || flags&0x8000 == 0 {
+		return nil, 0, errDNSMismatch
+	}
+	if flags&0x0200 != 0 {
+		return nil, 0, errors.New("truncated DNS response")
+	}
+	if rcode := flags & 0x000f; rcode != 0 {
+		return nil, 0, fmt.Errorf("DNS server returned rcode %d", rcode)
+	}
+	questions := int(binary.BigEndian.Uint16(msg[4:]))
+	answers := int(binary.BigEndian.Uint16(msg[6:]))
+	off := 12
+	for range questions {
+		var ok bool
+		if off, ok = skipDNSName(msg, off); !ok || off+4 > len(msg) {
+			return nil, 0, errDNSMalformed
+		}
+		off += 4
+	}
+	var ips []net.IP
+	ttl := time.Duration(-1)
+	for range answers {
+		var ok bool
+		if off, ok = skipDNSName(msg, off); !ok || off+10 > len(msg) {
+			return nil, 0, errDNSMalformed
+		}
+		rtype := binary.BigEndian.Uint16(msg[off:])
+		rttl := time.Duration(binary.BigEndian.Uint32(msg[off+4:])) * time.Second
+		rdlen := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+rdlen > len(msg) {
+			return nil, 0, errDNSMalformed
+		}
+		if ttl < 0 || rttl < ttl {
+			ttl = rttl
+		}
+		if rtype == qtype && (rtype == dnsTypeA && rdlen == 4 || rtype == dnsTypeAAAA && rdlen == 16) {
+			ips = append(ips, net.IP(append([]byte(nil), msg[off:off+rdlen]...)))
+		}
+		off += rdlen
+	}
+	return ips, max(ttl, 0), nil
+}
+
+// skipDNSName returns the offset after the possibly compressed name at off
+func skipDNSName(msg []byte, off int) (int, bool) {
+	for off < len(msg) {
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			return off + 1, true
+		case n&0xc0 == 0xc0:
+			return off + 2, off+2 <= len(msg)
+		}
+		off += 1 + n
+	}
+	return 0, false
+}
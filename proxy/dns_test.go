@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveDNS answers every A query for its name with ip and every AAAA query
+// with nothing
+func serveDNS(t *testing.T, ip net.IP, ttl uint32) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			query := buf[:n]
+			resp := append([]byte(nil), query...)
+			resp[2] |= 0x80
+			qtype := binary.BigEndian.Uint16(query[n-4:])
+			if qtype == dnsTypeA {
+				binary.BigEndian.PutUint16(resp[6:], 1)
+				// The answer's name points back to the question's
+				resp = append(resp, 0xc0, 12, 0, dnsTypeA, 0, 1)
+				resp = binary.BigEndian.AppendUint32(resp, ttl)
+				resp = append(resp, 0, 4)
+				resp = append(resp, ip.To4()...)
+			}
+			conn.WriteTo(resp, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestQueryDNS(t *testing.T) {
+	server := serveDNS(t, net.ParseIP("192.0.2.10"), 60)
+	ips, ttl, err := queryDNS(context.Background(), []string{server}, "api.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.ParseIP("192.0.2.10")) || ttl != time.Minute {
+		t.Errorf("Expected 192.0.2.10 for 1m, got %v for %s", ips, ttl)
+	}
+}
+
+func TestDNSCache(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	cache := newDNSCache(newProxyMetrics())
+	cache.now = func() time.Time { return now }
+	cache.pins["pinned.example.com"] = []net.IP{net.ParseIP("192.0.2.99")}
+	var lookups int
+	var failing bool
+	cache.resolve = func(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+		lookups++
+		if failing {
+			return nil, 0, errors.New("resolver unavailable")
+		}
+		return []net.IP{net.ParseIP("192.0.2.1")}, 30 * time.Second, nil
+	}
+	lookup := func(host string) ([]net.IP, error) {
+		return cache.Lookup(context.Background(), host)
+	}
+
+	lookup("api.example.com")
+	lookup("api.example.com")
+	if lookups != 1 {
+		t.Errorf("Expected the second lookup to be cached, got %d resolutions", lookups)
+	}
+
+	// The refresh job resolves entries about to expire before they do
+	now = now.Add(15 * time.Second)
+	cache.Refresh(context.Background())
+	if lookups != 2 {
+		t.Errorf("Expected the refresh job to resolve the host again, got %d resolutions", lookups)
+	}
+
+	// Once the resolver fails, the last addresses are used past their TTL
+	failing = true
+	now = now.Add(time.Hour)
+	if ips, err := lookup("api.example.com"); err != nil || !ips[0].Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("Expected the stale address, got %v, %v", ips, err)
+	}
+	if _, err := lookup("new.example.com"); err == nil {
+		t.Error("Expected a host never resolved to fail")
+	}
+
+	if ips, _ := lookup("pinned.example.com"); !ips[0].Equal(net.ParseIP("192.0.2.99")) {
+		t.Errorf("Expected the pinned address, got %v", ips)
+	}
+}
+
+func TestParseDNSPins(t *testing.T) {
+	pins, err := parseDNSPins("api.openai.com=192.0.2.1, api.openai.com=2001:db8::1,llm.internal=10.0.0.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pins["api.openai.com"]) != 2 || !pins["llm.internal"][0].Equal(net.ParseIP("10.0.0.5")) {
+		t.Errorf("Unexpected pins %v", pins)
+	}
+	if _, err := parseDNSPins("api.openai.com=not-an-ip"); err == nil {
+		t.Error("Expected an invalid address to be rejected")
+	}
+}
+
+func TestHappyEyeballsOrder(t *testing.T) {
+	ips := []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2"), net.ParseIP("2001:db8::1")}
+	if got := happyEyeballsOrder(ips, "tcp"); strings.Join(got, " ") != "2001:db8::1 192.0.2.1 192.0.2.2" {
+		t.Errorf("Expected families to alternate starting with IPv6, got %v", got)
+	}
+	if got := happyEyeballsOrder(ips, "tcp6"); strings.Join(got, " ") != "2001:db8::1" {
+		t.Errorf("Expected IPv6 only, got %v", got)
+	}
+}
+
+func TestDialHappyEyeballs(t *testing.T) {
+	for _, loopback := range []string{"127.0.0.1", "::1"} {
+		listener, err := net.Listen("tcp", net.JoinHostPort(loopback, "0"))
+		if err != nil {
+			t.Logf("Skipping %s: %v", loopback, err)
+			continue
+		}
+		defer listener.Close()
+		_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+		// The first address never answers, as in a network without routes
+		// for its family; the second is tried after the delay
+		start := time.Now()
+		conn, err := dialHappyEyeballs(context.Background(), &net.Dialer{}, "tcp", []string{net.JoinHostPort("192.0.2.1", port), listener.Addr().String()}, 50*time.Millisecond)
+		if err != nil {
+			t.Fatalf("Expected to connect to %s, got %v", loopback, err)
+		}
+		conn.Close()
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("Expected the fallback to be tried after the delay, took %s", elapsed)
+		}
+	}
+}
+
+func TestDNSCache_DialFamily(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	cache := newDNSCache(newProxyMetrics())
+	cache.pins["llm.internal"] = []net.IP{net.ParseIP("127.0.0.1")}
+	dial := cache.DialContext(&net.Dialer{})
+
+	conn, err := dial(context.Background(), "tcp4", "llm.internal:"+port)
+	if err != nil {
+		t.Fatalf("Expected to connect over IPv4, got %v", err)
+	}
+	conn.Close()
+	if _, err := dial(context.Background(), "tcp6", "llm.internal:"+port); err == nil || !strings.Contains(err.Error(), "no IPv6 addresses") {
+		t.Errorf("Expected no IPv6 address to dial, got %v", err)
+	}
+}
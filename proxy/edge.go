@@ -0,0 +1,48 @@
+//go:build edge || wasip1
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Builds with the edge tag, and every WASI build, leave out the subsystems
+// edge runtimes cannot host: code execution, which starts processes, the
+// chat bot bridges, which answer after their webhook has returned, and the
+// Redis and Kubernetes clients coordinating replicas. Configuring one of
+// them is an error rather than silently doing nothing.
+
+func (s *ProxyServer) addCodeExecutor(getenv func(string) string) error {
+	if mode := getenv("PROXY_CODE_EXECUTION"); mode != "" && mode != "off" {
+		return notInEdgeBuild("PROXY_CODE_EXECUTION")
+	}
+	return nil
+}
+
+func botBridgesFromEnv(server *ProxyServer, getenv func(string) string) (map[string]http.Handler, error) {
+	for _, name := range []string{"PROXY_TELEGRAM_BOT_TOKEN", "PROXY_SLACK_BOT_TOKEN", "PROXY_EMAIL_SIGNING_KEY"} {
+		if getenv(name) != "" {
+			return nil, notInEdgeBuild(name)
+		}
+	}
+	return nil, nil
+}
+
+func (s *ProxyServer) shareRateLimits(getenv func(string) string) error {
+	if getenv("PROXY_RATE_LIMIT_REDIS_ADDR") != "" {
+		return notInEdgeBuild("PROXY_RATE_LIMIT_REDIS_ADDR")
+	}
+	return nil
+}
+
+func leaderElectorFromEnv(getenv func(string) string) (*leaderElector, error) {
+	if getenv("PROXY_LEADER_ELECTION") != "" {
+		return nil, notInEdgeBuild("PROXY_LEADER_ELECTION")
+	}
+	return nil, nil
+}
+
+func notInEdgeBuild(setting string) error {
+	return fmt.Errorf("%s is not supported by edge builds", setting)
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"time"
+)
+
+// EmbeddingRequest mirrors the OpenAI embeddings request. Input may be a
+// single string or an array of strings.
+type EmbeddingRequest struct {
+	Model          string         `json:"model"`
+	Input          EmbeddingInput `json:"input"`
+	EncodingFormat string         `json:"encoding_format,omitempty"`
+	Dimensions     int            `json:"dimensions,omitempty"`
+	User           string         `json:"user,omitempty"`
+}
+
+// EmbeddingInput accepts both forms of the input field and always encodes
+// as an array
+type EmbeddingInput []string
+
+func (in *EmbeddingInput) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*in = EmbeddingInput{single}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return fmt.Errorf("input must be a string or an array of strings")
+	}
+	*in = many
+	return nil
+}
+
+type Embedding struct {
+	Object    string    `json:"object"`
+	Index     int       `json:"index"`
+	Embedding []float64 `json:"embedding"`
+	// base64 encodes the embedding as base64 of little-endian float32s, as
+	// OpenAI does for an encoding_format of base64
+	base64 bool
+}
+
+func (e Embedding) MarshalJSON() ([]byte, error) {
+	type plain Embedding
+	if !e.base64 {
+		return json.Marshal(plain(e))
+	}
+	raw := make([]byte, 4*len(e.Embedding))
+	for i, v := range e.Embedding {
+		binary.LittleEndian.PutUint32(raw[4*i:], math.Float32bits(float32(v)))
+	}
+	return json.Marshal(struct {
+		Object    string `json:"object"`
+		Index     int    `json:"index"`
+		Embedding string `json:"embedding"`
+	}{e.Object, e.Index, base64.StdEncoding.EncodeToString(raw)})
+}
+
+// UnmarshalJSON accepts embeddings as arrays of numbers and as base64
+func (e *Embedding) UnmarshalJSON(data []byte) error {
+	var in struct {
+		Object    string          `json:"object"`
+		Index     int             `json:"index"`
+		Embedding json.RawMessage `json:"embedding"`
+	}
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+	*e = Embedding{Object: in.Object, Index: in.Index}
+	var encoded string
+	if err := json.Unmarshal(in.Embedding, &encoded); err != nil {
+		return json.Unmarshal(in.Embedding, &e.Embedding)
+	}
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(raw)%4 != 0 {
+		return fmt.Errorf("embedding is not valid base64 of float32s")
+	}
+	e.Embedding = make([]float64, len(raw)/4)
+	for i := range e.Embedding {
+		e.Embedding[i] = float64(math.Float32frombits(binary.LittleEndian.Uint32(raw[4*i:])))
+	}
+	e.base64 = true
+	return nil
+}
+
+type EmbeddingResponse struct {
+	Object string      `json:"object"`
+	Data   []Embedding `json:"data"`
+	Model  string      `json:"model"`
+	Usage  Usage       `json:"usage"`
+}
+
+// embeddingsClient is implemented by upstream clients that support the
+// embeddings API
+type embeddingsClient interface {
+	CreateEmbeddings(req EmbeddingRequest) (*EmbeddingResponse, error)
+}
+
+// contextEmbeddingsClient is implemented by embeddings clients that carry
+// the request's context, and with it the upstream key of its client key
+type contextEmbeddingsClient interface {
+	CreateEmbeddingsContext(ctx context.Context, req EmbeddingRequest) (*EmbeddingResponse, error)
+}
+
+func (c *RealOpenAIClient) CreateEmbeddings(req EmbeddingRequest) (*EmbeddingResponse, error) {
+	return c.CreateEmbeddingsContext(context.Background(), req)
+}
+
+func (c *RealOpenAIClient) CreateEmbeddingsContext(ctx context.Context, req EmbeddingRequest) (*EmbeddingResponse, error) {
+	jsonData, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+	body := getBuffer()
+	defer putBuffer(body)
+	if err := c.postValidated(ctx, "/embeddings", jsonData, embeddingsSchema, body); err != nil {
+		return nil, err
+	}
+
+	var embResp EmbeddingResponse
+	if err := json.Unmarshal(body.Bytes(), &embResp); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+	return &embResp, nil
+}
+
+func (s *ProxyServer) handleEmbeddings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	client, ok := s.client.(embeddingsClient)
+	if !ok {
+		http.Error(w, "Embeddings are not supported by the upstream client", http.StatusNotImplemented)
+		return
+	}
+
+	buf, err := readBody(r.Body, r.ContentLength)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+	defer putBuffer(buf)
+
+	var req EmbeddingRequest
+	if err := json.Unmarshal(buf.Bytes(), &req); err != nil {
+		http.Error(w, "Invalid JSON in request body", http.StatusBadRequest)
+		return
+	}
+	if req.Model == "" {
+		http.Error(w, "Model field is required", http.StatusBadRequest)
+		return
+	}
+	if len(req.Input) == 0 {
+		http.Error(w, "Input field is required and cannot be empty", http.StatusBadRequest)
+		return
+	}
+	if req.EncodingFormat != "" && req.EncodingFormat != "float" && req.EncodingFormat != "base64" {
+		http.Error(w, fmt.Sprintf("encoding_format must be float or base64, got %q", req.EncodingFormat), http.StatusBadRequest)
+		return
+	}
+	if req.Dimensions < 0 {
+		http.Error(w, "dimensions must be positive", http.StatusBadRequest)
+		return
+	}
+	key := clientKeyFromContext(r.Context())
+	if key != nil && !key.AllowsModel(req.Model) {
+		http.Error(w, fmt.Sprintf("API key is not allowed to use model %s", req.Model), http.StatusForbidden)
+		return
+	}
+	var tenant string
+	if key != nil {
+		tenant = key.Tenant
+	}
+	req.Model = s.resolveModel(req.Model, tenant)
+	dimensions := req.Dimensions
+	if !s.shortensEmbeddings(req.Model) {
+		req.Dimensions = 0
+	}
+
+	event := newUsageEvent(key, "embeddings", req.Model)
+	var resp *EmbeddingResponse
+	contextClient, hasContext := client.(contextEmbeddingsClient)
+	switch {
+	case upstreamKeyFromContext(r.Context()) != "" && hasContext:
+		// Batches share one upstream key, so keys with their own skip them
+		resp, err = contextClient.CreateEmbeddingsContext(r.Context(), req)
+	case s.batcher != nil:
+		resp, err = s.batcher.Submit(req)
+	default:
+		resp, err = client.CreateEmbeddings(req)
+	}
+	event.LatencyMS = time.Since(event.Time).Milliseconds()
+	if err != nil {
+		log.Printf("OpenAI API error: %v", err)
+		event.Status = upstreamErrorStatus(err)
+		s.recordUsage(event)
+		writeUpstreamError(w, err)
+		return
+	}
+
+	s.recordCompletion(key, event, resp.Usage)
+
+	// Embeddings come back in the format asked for, whatever the upstream
+	// answered with
+	data := make([]Embedding, len(resp.Data))
+	for i, e := range resp.Data {
+		e.base64 = req.EncodingFormat == "base64"
+		if dimensions > 0 {
+			if e.Embedding, err = reduceEmbedding(e.Embedding, dimensions); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		data[i] = e
+	}
+	out := getBuffer()
+	defer putBuffer(out)
+	if err := json.NewEncoder(out).Encode(EmbeddingResponse{Object: resp.Object, Data: data, Model: resp.Model, Usage: resp.Usage}); err != nil {
+		log.Printf("Failed to encode response: %v", err)
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(out.Bytes())
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// embeddingBatcher merges embedding requests that arrive within a short
+// window into a single upstream call and splits the result back up. Unlike
+// coalescing identical requests, it combines distinct inputs, so it pays off
+// for high-QPS traffic of small inputs where per-call overhead dominates.
+//
+// Only requests with the same model and options are merged. Each caller
+// waits at most one window for its batch to be sent; a batch that reaches
+// maxInputs is sent right away.
+type embeddingBatcher struct {
+	client    embeddingsClient
+	window    time.Duration
+	maxInputs int
+
+	mu      sync.Mutex
+	pending map[embeddingBatchKey]*embeddingBatch
+}
+
+// embeddingBatchKey holds everything but the input that must match for two
+// requests to share an upstream call
+type embeddingBatchKey struct {
+	model          string
+	encodingFormat string
+	dimensions     int
+	user           string
+}
+
+type embeddingBatch struct {
+	key     embeddingBatchKey
+	inputs  []string
+	waiters []*embeddingWaiter
+	timer   *time.Timer
+}
+
+type embeddingWaiter struct {
+	offset int
+	count  int
+	done   chan embeddingResult
+}
+
+type embeddingResult struct {
+	resp *EmbeddingResponse
+	err  error
+}
+
+func newEmbeddingBatcher(client embeddingsClient, window time.Duration, maxInputs int) *embeddingBatcher {
+	return &embeddingBatcher{
+		client:    client,
+		window:    window,
+		maxInputs: maxInputs,
+		pending:   make(map[embeddingBatchKey]*embeddingBatch),
+	}
+}
+
+// Submit adds req to the open batch for its options and waits for the
+// batch's result
+func (b *embeddingBatcher) Submit(req EmbeddingRequest) (*EmbeddingResponse, error) {
+	// Requests too large to share a call are sent on their own
+	if len(req.Input) >= b.maxInputs {
+		return b.client.CreateEmbeddings(req)
+	}
+
+	key := embeddingBatchKey{req.Model, req.EncodingFormat, req.Dimensions, req.User}
+	waiter := &embeddingWaiter{count: len(req.Input), done: make(chan embeddingResult, 1)}
+
+	b.mu.Lock()
+	batch := b.pending[key]
+	if batch != nil && len(batch.inputs)+len(req.Input) > b.maxInputs {
+		b.detach(batch)
+		go b.send(batch)
+		batch = nil
+	}
+	if batch == nil {
+		batch = &embeddingBatch{key: key}
+		b.pending[key] = batch
+		batch.timer = time.AfterFunc(b.window, func() {
+			b.mu.Lock()
+			sent := b.pending[key] != batch
+			b.detach(batch)
+			b.mu.Unlock()
+			if !sent {
+				b.send(batch)
+			}
+		})
+	}
+	waiter.offset = len(batch.inputs)
+	batch.inputs = append(batch.inputs, req.Input...)
+	batch.waiters = append(batch.waiters, waiter)
+	if len(batch.inputs) == b.maxInputs {
+		b.detach(batch)
+		go b.send(batch)
+	}
+	b.mu.Unlock()
+
+	result := <-waiter.done
+	return result.resp, result.err
+}
+
+// detach closes batch to new requests. Callers must hold b.mu.
+func (b *embeddingBatcher) detach(batch *embeddingBatch) {
+	if b.pending[batch.key] == batch {
+		delete(b.pending, batch.key)
+		batch.timer.Stop()
+	}
+}
+
+// send makes the upstream call for a detached batch and hands every waiter
+// its share of the result
+func (b *embeddingBatcher) send(batch *embeddingBatch) {
+	resp, err := b.client.CreateEmbeddings(EmbeddingRequest{
+		Model:          batch.key.model,
+		Input:          batch.inputs,
+		EncodingFormat: batch.key.encodingFormat,
+		Dimensions:     batch.key.dimensions,
+		User:           batch.key.user,
+	})
+	if err == nil && len(resp.Data) != len(batch.inputs) {
+		err = fmt.Errorf("upstream returned %d embeddings for %d inputs", len(resp.Data), len(batch.inputs))
+	}
+	if err != nil {
+		for _, w := range batch.waiters {
+			w.done <- embeddingResult{err: err}
+		}
+		return
+	}
+
+	// Order by index in case upstream does not return data in input order
+	byIndex := make([]Embedding, len(resp.Data))
+	for _, e := range resp.Data {
+		if e.Index >= 0 && e.Index < len(byIndex) {
+			byIndex[e.Index] = e
+		}
+	}
+
+	totalChars := 0
+	for _, in := range batch.inputs {
+		totalChars += len(in)
+	}
+	for _, w := range batch.waiters {
+		data := make([]Embedding, w.count)
+		chars := 0
+		for i := range data {
+			data[i] = byIndex[w.offset+i]
+			data[i].Index = i
+			chars += len(batch.inputs[w.offset+i])
+		}
+		w.done <- embeddingResult{resp: &EmbeddingResponse{
+			Object: resp.Object,
+			Data:   data,
+			Model:  resp.Model,
+			Usage:  apportionUsage(resp.Usage, chars, totalChars),
+		}}
+	}
+}
+
+// apportionUsage splits a batch's token usage by each request's share of
+// the input length, since upstream only reports the total
+func apportionUsage(usage Usage, chars, totalChars int) Usage {
+	if totalChars == 0 {
+		return Usage{}
+	}
+	prompt := usage.PromptTokens * chars / totalChars
+	return Usage{PromptTokens: prompt, TotalTokens: prompt}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func submitAll(b *embeddingBatcher, reqs []EmbeddingRequest) ([]*EmbeddingResponse, []error) {
+	resps := make([]*EmbeddingResponse, len(reqs))
+	errs := make([]error, len(reqs))
+	var wg sync.WaitGroup
+	for i, req := range reqs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resps[i], errs[i] = b.Submit(req)
+		}()
+	}
+	wg.Wait()
+	return resps, errs
+}
+
+func TestEmbeddingBatcher_MergesAndSplits(t *testing.T) {
+	client := &mockEmbeddingsClient{}
+	b := newEmbeddingBatcher(client, 50*time.Millisecond, 100)
+
+	reqs := []EmbeddingRequest{
+		{Model: "m", Input: EmbeddingInput{"a", "bb"}},
+		{Model: "m", Input: EmbeddingInput{"cccc"}},
+	}
+	resps, errs := submitAll(b, reqs)
+
+	if n := client.callCount(); n != 1 {
+		t.Fatalf("Expected 1 upstream call, got %d", n)
+	}
+	if len(client.calls[0].Input) != 3 {
+		t.Errorf("Expected 3 merged inputs, got %v", client.calls[0].Input)
+	}
+	for i, req := range reqs {
+		if errs[i] != nil {
+			t.Fatalf("Request %d: expected no error, got %v", i, errs[i])
+		}
+		if len(resps[i].Data) != len(req.Input) {
+			t.Fatalf("Request %d: expected %d embeddings, got %d", i, len(req.Input), len(resps[i].Data))
+		}
+		for j, e := range resps[i].Data {
+			if e.Index != j || e.Embedding[0] != float64(len(req.Input[j])) {
+				t.Errorf("Request %d: embedding %d does not match its input: %+v", i, j, e)
+			}
+		}
+	}
+	if resps[0].Usage.PromptTokens != 3 || resps[1].Usage.PromptTokens != 4 {
+		t.Errorf("Expected usage to be apportioned 3/4, got %d/%d", resps[0].Usage.PromptTokens, resps[1].Usage.PromptTokens)
+	}
+}
+
+func TestEmbeddingBatcher_SeparatesOptions(t *testing.T) {
+	client := &mockEmbeddingsClient{}
+	b := newEmbeddingBatcher(client, 50*time.Millisecond, 100)
+
+	submitAll(b, []EmbeddingRequest{
+		{Model: "m", Input: EmbeddingInput{"a"}},
+		{Model: "m", Input: EmbeddingInput{"b"}, Dimensions: 256},
+		{Model: "other", Input: EmbeddingInput{"c"}},
+	})
+	if n := client.callCount(); n != 3 {
+		t.Errorf("Expected requests with different options not to be merged, got %d calls", n)
+	}
+}
+
+func TestEmbeddingBatcher_FlushesFullBatch(t *testing.T) {
+	client := &mockEmbeddingsClient{}
+	// A window this long would time the test out if full batches waited
+	b := newEmbeddingBatcher(client, time.Hour, 2)
+
+	_, errs := submitAll(b, []EmbeddingRequest{
+		{Model: "m", Input: EmbeddingInput{"a"}},
+		{Model: "m", Input: EmbeddingInput{"b"}},
+	})
+	if errs[0] != nil || errs[1] != nil {
+		t.Fatalf("Expected no errors, got %v", errs)
+	}
+	if n := client.callCount(); n != 1 {
+		t.Errorf("Expected 1 upstream call, got %d", n)
+	}
+}
+
+func TestEmbeddingBatcher_LargeRequestBypassesBatching(t *testing.T) {
+	client := &mockEmbeddingsClient{}
+	b := newEmbeddingBatcher(client, time.Hour, 2)
+
+	resp, err := b.Submit(EmbeddingRequest{Model: "m", Input: EmbeddingInput{"a", "b", "c"}})
+	if err != nil || len(resp.Data) != 3 {
+		t.Errorf("Expected the request to be sent directly, got %v (%v)", resp, err)
+	}
+}
+
+func TestEmbeddingBatcher_PropagatesErrors(t *testing.T) {
+	client := &mockEmbeddingsClient{err: errors.New("upstream down")}
+	b := newEmbeddingBatcher(client, 10*time.Millisecond, 100)
+
+	_, errs := submitAll(b, []EmbeddingRequest{
+		{Model: "m", Input: EmbeddingInput{"a"}},
+		{Model: "m", Input: EmbeddingInput{"b"}},
+	})
+	for i, err := range errs {
+		if err == nil {
+			t.Errorf("Request %d: expected an error", i)
+		}
+	}
+}
+
+func BenchmarkEmbeddingBatcher_Parallel(b *testing.B) {
+	client := &mockEmbeddingsClient{}
+	batcher := newEmbeddingBatcher(client, time.Millisecond, 256)
+	req := EmbeddingRequest{Model: "m", Input: EmbeddingInput{"hello world"}}
+
+	// Simulate many concurrent clients per CPU
+	b.SetParallelism(64)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			batcher.Submit(req)
+		}
+	})
+	b.ReportMetric(float64(b.N)/float64(client.callCount()), "inputs/call")
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// Embeddings can be asked for with fewer dimensions than their model
+// produces. Models that shorten embeddings themselves, those matching
+// PROXY_NATIVE_DIMENSIONS_MODELS (by default text-embedding-3*), get the
+// dimensions parameter; for other models, and whenever an upstream ignores
+// it, the proxy keeps the first dimensions of each embedding and scales it
+// back to unit length, so clients get vectors of the same size from every
+// backend. Truncation rather than PCA keeps the vectors of separate
+// requests comparable, as a projection fitted to each request's inputs
+// would not be.
+
+// defaultNativeDimensionsModels are the models the dimensions parameter is
+// sent to by default
+var defaultNativeDimensionsModels = []string{"text-embedding-3*"}
+
+// shortensEmbeddings reports whether the upstream of model shortens
+// embeddings itself
+func (s *ProxyServer) shortensEmbeddings(model string) bool {
+	return matchAny(s.nativeDimensionsModels, model)
+}
+
+// reduceEmbedding returns the first n dimensions of v normalized to unit
+// length, or an error if v has fewer
+func reduceEmbedding(v []float64, n int) ([]float64, error) {
+	if len(v) < n {
+		return nil, fmt.Errorf("the model's embeddings have %d dimensions, fewer than the %d requested", len(v), n)
+	}
+	if len(v) == n {
+		return v, nil
+	}
+	reduced := append([]float64(nil), v[:n]...)
+	var norm float64
+	for _, x := range reduced {
+		norm += x * x
+	}
+	if norm = math.Sqrt(norm); norm > 0 {
+		for i := range reduced {
+			reduced[i] /= norm
+		}
+	}
+	return reduced, nil
+}
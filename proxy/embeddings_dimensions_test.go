@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fixedEmbeddingsClient embeds every input as vector, whatever the
+// dimensions asked for
+type fixedEmbeddingsClient struct {
+	MockOpenAIClient
+	vector []float64
+	calls  []EmbeddingRequest
+}
+
+func (c *fixedEmbeddingsClient) CreateEmbeddings(req EmbeddingRequest) (*EmbeddingResponse, error) {
+	c.calls = append(c.calls, req)
+	resp := &EmbeddingResponse{Object: "list", Model: req.Model}
+	for i := range req.Input {
+		resp.Data = append(resp.Data, Embedding{Object: "embedding", Index: i, Embedding: c.vector})
+	}
+	return resp, nil
+}
+
+func TestReduceEmbedding(t *testing.T) {
+	got, err := reduceEmbedding([]float64{3, 4, 12}, 2)
+	if err != nil || len(got) != 2 || math.Abs(got[0]-0.6) > 1e-9 || math.Abs(got[1]-0.8) > 1e-9 {
+		t.Errorf("Expected the first two dimensions at unit length, got %v %v", got, err)
+	}
+	if _, err := reduceEmbedding([]float64{1, 0}, 3); err == nil {
+		t.Error("Expected more dimensions than the embedding has to be rejected")
+	}
+}
+
+func TestProxyServer_HandleEmbeddings_Dimensions(t *testing.T) {
+	client := &fixedEmbeddingsClient{vector: []float64{3, 4, 12, 84}}
+	server := NewProxyServer(client)
+	send := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		server.handleEmbeddings(w, httptest.NewRequest("POST", "/v1/embeddings", strings.NewReader(body)))
+		return w
+	}
+
+	// Models that do not shorten embeddings themselves are not asked to
+	w := send(`{"model": "nomic-embed-text", "input": "hello", "dimensions": 2}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var resp EmbeddingResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if got := resp.Data[0].Embedding; len(got) != 2 || math.Abs(got[0]-0.6) > 1e-9 {
+		t.Errorf("Expected the embedding reduced to two dimensions, got %v", got)
+	}
+	if client.calls[0].Dimensions != 0 {
+		t.Errorf("Expected dimensions not to be sent upstream, got %d", client.calls[0].Dimensions)
+	}
+
+	// Native models get the parameter, and are reduced anyway if their
+	// upstream ignored it
+	w = send(`{"model": "text-embedding-3-small", "input": "hello", "dimensions": 3}`)
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if client.calls[1].Dimensions != 3 || len(resp.Data[0].Embedding) != 3 {
+		t.Errorf("Expected dimensions sent upstream and honored, got %d and %v", client.calls[1].Dimensions, resp.Data[0].Embedding)
+	}
+
+	if w := send(`{"model": "nomic-embed-text", "input": "hello", "dimensions": 8}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected more dimensions than the model has to fail, got %d", w.Code)
+	}
+	if w := send(`{"model": "nomic-embed-text", "input": "hello", "dimensions": -1}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected negative dimensions to fail, got %d", w.Code)
+	}
+}
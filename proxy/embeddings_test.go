@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Mock client for embeddings. Each input's embedding is its length, and
+// every input character counts as one prompt token.
+type mockEmbeddingsClient struct {
+	MockOpenAIClient
+
+	mu    sync.Mutex
+	calls []EmbeddingRequest
+	err   error
+}
+
+func (m *mockEmbeddingsClient) CreateEmbeddings(req EmbeddingRequest) (*EmbeddingResponse, error) {
+	m.mu.Lock()
+	m.calls = append(m.calls, req)
+	m.mu.Unlock()
+	if m.err != nil {
+		return nil, m.err
+	}
+	resp := &EmbeddingResponse{Object: "list", Model: req.Model}
+	for i, in := range req.Input {
+		resp.Data = append(resp.Data, Embedding{Object: "embedding", Index: i, Embedding: []float64{float64(len(in))}})
+		resp.Usage.PromptTokens += len(in)
+	}
+	resp.Usage.TotalTokens = resp.Usage.PromptTokens
+	return resp, nil
+}
+
+func (m *mockEmbeddingsClient) callCount() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.calls)
+}
+
+func TestEmbeddingInput_UnmarshalJSON(t *testing.T) {
+	var req EmbeddingRequest
+	if err := json.Unmarshal([]byte(`{"model":"m","input":"hello"}`), &req); err != nil || len(req.Input) != 1 || req.Input[0] != "hello" {
+		t.Errorf("Expected a single input, got %v (%v)", req.Input, err)
+	}
+	if err := json.Unmarshal([]byte(`{"model":"m","input":["a","b"]}`), &req); err != nil || len(req.Input) != 2 {
+		t.Errorf("Expected two inputs, got %v (%v)", req.Input, err)
+	}
+	if err := json.Unmarshal([]byte(`{"model":"m","input":[1,2]}`), &req); err == nil {
+		t.Error("Expected an error for token arrays")
+	}
+}
+
+func TestProxyServer_HandleEmbeddings_Success(t *testing.T) {
+	server := NewProxyServer(&mockEmbeddingsClient{})
+
+	body := `{"model":"text-embedding-3-small","input":["hi","there"]}`
+	req := httptest.NewRequest("POST", "/v1/embeddings", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	server.handleEmbeddings(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var resp EmbeddingResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if len(resp.Data) != 2 || resp.Data[1].Embedding[0] != 5 {
+		t.Errorf("Unexpected response %+v", resp)
+	}
+	if resp.Usage.PromptTokens != 7 {
+		t.Errorf("Expected 7 prompt tokens, got %d", resp.Usage.PromptTokens)
+	}
+}
+
+func TestProxyServer_HandleEmbeddings_Validation(t *testing.T) {
+	server := NewProxyServer(&mockEmbeddingsClient{})
+
+	tests := []struct {
+		body string
+		want string
+	}{
+		{`{"input":"hi"}`, "Model field is required"},
+		{`{"model":"m","input":[]}`, "Input field is required and cannot be empty"},
+		{`{"model":"m","input":{}}`, "Invalid JSON in request body"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", "/v1/embeddings", strings.NewReader(tt.body))
+		w := httptest.NewRecorder()
+		server.handleEmbeddings(w, req)
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), tt.want) {
+			t.Errorf("%s: expected 400 %q, got %d %q", tt.body, tt.want, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestProxyServer_HandleEmbeddings_UnsupportedClient(t *testing.T) {
+	server := NewProxyServer(&MockOpenAIClient{})
+
+	req := httptest.NewRequest("POST", "/v1/embeddings", strings.NewReader(`{"model":"m","input":"hi"}`))
+	w := httptest.NewRecorder()
+	server.handleEmbeddings(w, req)
+	if w.Code != http.StatusNotImplemented {
+		t.Errorf("Expected status code %d, got %d", http.StatusNotImplemented, w.Code)
+	}
+}
+
+func TestProxyServer_HandleEmbeddings_UpstreamError(t *testing.T) {
+	server := NewProxyServer(&mockEmbeddingsClient{err: errors.New("upstream down")})
+
+	req := httptest.NewRequest("POST", "/v1/embeddings", strings.NewReader(`{"model":"m","input":"hi"}`))
+	w := httptest.NewRecorder()
+	server.handleEmbeddings(w, req)
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected status code %d, got %d", http.StatusInternalServerError, w.Code)
+	}
+}
+
+func TestRealOpenAIClient_CreateEmbeddings(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/embeddings" || r.Header.Get("Authorization") != "Bearer sk-test" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var req EmbeddingRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		json.NewEncoder(w).Encode(EmbeddingResponse{Object: "list", Model: req.Model, Data: []Embedding{{Index: 0, Embedding: []float64{0.5}}}})
+	}))
+	defer upstream.Close()
+
+	client := NewRealOpenAIClient("sk-test")
+	client.BaseURL = upstream.URL
+	resp, err := client.CreateEmbeddings(EmbeddingRequest{Model: "m", Input: EmbeddingInput{"hi"}})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(resp.Data) != 1 || resp.Data[0].Embedding[0] != 0.5 {
+		t.Errorf("Unexpected response %+v", resp)
+	}
+}
+
+func TestProxyServer_HandleEmbeddings_Batched(t *testing.T) {
+	client := &mockEmbeddingsClient{}
+	server := NewProxyServer(client)
+	server.batcher = newEmbeddingBatcher(client, 50*time.Millisecond, 100)
+
+	var wg sync.WaitGroup
+	for _, in := range []string{"a", "bb", "ccc"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			body, _ := json.Marshal(map[string]string{"model": "m", "input": in})
+			w := httptest.NewRecorder()
+			server.handleEmbeddings(w, httptest.NewRequest("POST", "/v1/embeddings", bytes.NewReader(body)))
+			var resp EmbeddingResponse
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			if len(resp.Data) != 1 || resp.Data[0].Embedding[0] != float64(len(in)) {
+				t.Errorf("Input %s: unexpected response %s", in, w.Body.String())
+			}
+		}()
+	}
+	wg.Wait()
+	if n := client.callCount(); n != 1 {
+		t.Errorf("Expected 1 upstream call, got %d", n)
+	}
+}
+
+func TestProxyServer_HandleEmbeddings_Base64(t *testing.T) {
+	// 1.5 and -2 as little-endian float32s
+	const encoded = "AADAPwAAAMA="
+	var upstreamReq EmbeddingRequest
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&upstreamReq)
+		w.Write([]byte(`{"object": "list", "model": "text-embedding-3-small", "data": [{"object": "embedding", "index": 0, "embedding": "` + encoded + `"}], "usage": {"prompt_tokens": 1, "total_tokens": 1}}`))
+	}))
+	defer upstream.Close()
+	client := NewRealOpenAIClient("sk")
+	client.BaseURL = upstream.URL
+	server := NewProxyServer(client)
+
+	post := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		server.handleEmbeddings(w, httptest.NewRequest("POST", "/v1/embeddings", strings.NewReader(body)))
+		return w
+	}
+	w := post(`{"model": "text-embedding-3-small", "input": "hi", "encoding_format": "base64"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if upstreamReq.EncodingFormat != "base64" {
+		t.Errorf("Expected encoding_format to be forwarded, got %q", upstreamReq.EncodingFormat)
+	}
+	var raw struct {
+		Data []struct {
+			Embedding string `json:"embedding"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &raw); err != nil || len(raw.Data) != 1 || raw.Data[0].Embedding != encoded {
+		t.Errorf("Expected the base64 embedding back, got %s", w.Body.String())
+	}
+
+	// Floats are asked for without encoding_format and decoded either way
+	var resp EmbeddingResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if len(resp.Data) != 1 || len(resp.Data[0].Embedding) != 2 || resp.Data[0].Embedding[0] != 1.5 || resp.Data[0].Embedding[1] != -2 {
+		t.Errorf("Expected the base64 embedding to decode, got %+v", resp.Data)
+	}
+	w = post(`{"model": "text-embedding-3-small", "input": "hi"}`)
+	if !strings.Contains(w.Body.String(), `"embedding":[1.5,-2]`) {
+		t.Errorf("Expected float embeddings for clients that did not ask for base64, got %s", w.Body.String())
+	}
+
+	if w := post(`{"model": "text-embedding-3-small", "input": "hi", "encoding_format": "binary"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected unknown encoding formats to be rejected, got %d", w.Code)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// When the upstream of a model fails, a request can be served by another
+// model instead, from the same provider or another one. PROXY_FALLBACKS
+// lists the models tried in turn for each model, e.g.
+// "gpt-4o=claude-3-5-sonnet-latest,llama3.1". A request fails over when
+// its upstream answers 429 or a 5xx once its retries are used up, cannot
+// be reached or times out; other errors, such as a request the upstream
+// rejects, are the client's to fix and are returned as they are. Replies
+// say what served them in X-Served-By.
+
+const servedByHeader = "X-Served-By"
+
+// fallbackChain is the models tried in turn when the upstream of the
+// models matching model fails
+type fallbackChain struct {
+	model     string
+	fallbacks []string
+}
+
+// fallbacksFromEnv parses PROXY_FALLBACKS: chains separated by ";", each a
+// model, or a prefix ending in "*", followed by "=" and the comma-separated
+// models tried after it
+func fallbacksFromEnv(getenv func(string) string) ([]fallbackChain, error) {
+	v := getenv("PROXY_FALLBACKS")
+	var chains []fallbackChain
+	for _, entry := range strings.Split(v, ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		model, list, ok := strings.Cut(entry, "=")
+		chain := fallbackChain{model: strings.TrimSpace(model)}
+		for _, fallback := range strings.Split(list, ",") {
+			if fallback = strings.TrimSpace(fallback); fallback != "" {
+				chain.fallbacks = append(chain.fallbacks, fallback)
+			}
+		}
+		if !ok || chain.model == "" || len(chain.fallbacks) == 0 {
+			return nil, fmt.Errorf("invalid PROXY_FALLBACKS %q", v)
+		}
+		chains = append(chains, chain)
+	}
+	return chains, nil
+}
+
+// models returns the models a request for model is tried with, in order
+func (p *providerRouter) models(model string) []string {
+	for _, chain := range p.fallbacks {
+		if matchAny([]string{chain.model}, model) {
+			return append([]string{model}, chain.fallbacks...)
+		}
+	}
+	return []string{model}
+}
+
+// failsOver reports whether a request that failed with err is tried with
+// the next model. Requests the client gave up on are not, nor are echoed
+// ones.
+func failsOver(ctx context.Context, err error) bool {
+	if ctx.Err() != nil || errors.Is(err, errUpstreamEchoed) {
+		return false
+	}
+	var apiErr *upstreamAPIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Status == http.StatusTooManyRequests || apiErr.Status >= 500
+	}
+	return true
+}
+
+// failover tries a request with each model in turn until one succeeds or
+// fails in a way another model would not help with
+func (p *providerRouter) failover(ctx context.Context, model string, try func(model string, provider routedProvider) error) error {
+	models := p.models(model)
+	timeline := timelineFromContext(ctx)
+	var err error
+	for i, m := range models {
+		provider := p.route(m)
+		if err = try(m, provider); err == nil {
+			if len(models) > 1 {
+				timeline.setServedBy(provider.name + "/" + m)
+			}
+			return nil
+		}
+		if !failsOver(ctx, err) {
+			return err
+		}
+		if i < len(models)-1 {
+			timeline.Addf(TimelineFailedOver, "%s: %v, trying %s", m, err, models[i+1])
+		}
+	}
+	return err
+}
+
+func (p *providerRouter) CreateChatCompletionContext(ctx context.Context, req ChatCompletionRequest) (*ChatCompletionResponse, error) {
+	var resp *ChatCompletionResponse
+	err := p.failover(ctx, req.Model, func(model string, provider routedProvider) error {
+		req.Model = model
+		var err error
+		if provider.quirks != nil {
+			resp, err = createWithQuirks(ctx, provider.backend, provider.quirks, req)
+		} else {
+			resp, err = provider.backend.CreateChatCompletionContext(ctx, req)
+		}
+		return err
+	})
+	return resp, err
+}
+
+func (p *providerRouter) CreateChatCompletionRaw(ctx context.Context, body []byte, out *bytes.Buffer) error {
+	model := scanModel(body)
+	start := out.Len()
+	return p.failover(ctx, model, func(m string, provider routedProvider) error {
+		// The reply of a model that failed is no part of the next one's
+		out.Truncate(start)
+		body := body
+		if m != model {
+			body = setJSONMember(body, "model", m)
+		}
+		if provider.quirks != nil {
+			var err error
+			if body, err = provider.quirks.apply(body); err != nil {
+				return err
+			}
+		}
+		return provider.backend.CreateChatCompletionRaw(ctx, body, out)
+	})
+}
+
+// CreateChatCompletionStream fails over until a stream starts, but not once
+// it has
+func (p *providerRouter) CreateChatCompletionStream(ctx context.Context, body []byte) (io.ReadCloser, error) {
+	model := scanModel(body)
+	var stream io.ReadCloser
+	err := p.failover(ctx, model, func(m string, provider routedProvider) error {
+		body := body
+		if m != model {
+			body = setJSONMember(body, "model", m)
+		}
+		if provider.quirks != nil {
+			var err error
+			if body, err = provider.quirks.apply(body); err != nil {
+				return err
+			}
+		}
+		var err error
+		stream, err = provider.backend.CreateChatCompletionStream(ctx, body)
+		return err
+	})
+	return stream, err
+}
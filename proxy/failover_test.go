@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// failingUpstream answers every request with status
+func failingUpstream(t *testing.T, status int, calls *atomic.Int32) *httptest.Server {
+	t.Helper()
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(status)
+		fmt.Fprintf(w, `{"error":{"message":"status %d","type":"server_error"}}`, status)
+	}))
+	t.Cleanup(api.Close)
+	return api
+}
+
+func TestProviderRouter_FailsOver(t *testing.T) {
+	var calls atomic.Int32
+	openai := failingUpstream(t, http.StatusServiceUnavailable, &calls)
+	ollama := newRecordingUpstream(t)
+	path := writeProvidersFile(t, `[{"name": "local", "type": "ollama", "base_url": "`+ollama.URL+`", "models": ["llama3*"]}]`)
+	env := map[string]string{"PROXY_PROVIDERS_FILE": path, "PROXY_FALLBACKS": "gpt-4o*=gpt-4o-mini,llama3.1"}
+	fallback := NewRealOpenAIClient("sk-openai")
+	fallback.BaseURL = openai.URL
+	router, err := providerRouterFromEnv(fallback, func(name string) string { return env[name] })
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	server := NewProxyServer(router)
+	server.submissions = nil
+	handler := server.Handler()
+
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "gpt-4o", "messages": [{"role": "user", "content": "Hi"}]}`))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the fallback to serve the request, got %d: %s", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get(servedByHeader); got != "local/llama3.1" {
+		t.Errorf("Expected the reply to be served by local/llama3.1, got %q", got)
+	}
+	if calls.Load() != 2 {
+		t.Errorf("Expected gpt-4o and gpt-4o-mini to be tried first, got %d upstream calls", calls.Load())
+	}
+	if !strings.Contains(ollama.body, `"model": "llama3.1"`) {
+		t.Errorf("Expected the request to be sent for llama3.1, got %s", ollama.body)
+	}
+	timeline, _ := server.timelines.Get(w.Header().Get(requestIDHeader))
+	failovers := 0
+	for _, event := range timeline.snapshot().Events {
+		if event.Event == TimelineFailedOver {
+			failovers++
+		}
+	}
+	if failovers != 2 {
+		t.Errorf("Expected two failovers on the timeline, got %d", failovers)
+	}
+
+	// The typed path fails over the same way
+	resp, err := router.CreateChatCompletionContext(context.Background(), ChatCompletionRequest{Model: "gpt-4o", Messages: []Message{{Role: "user", Content: "Hi"}}})
+	if err != nil || resp == nil {
+		t.Errorf("Expected the fallback to serve the typed request, got %v", err)
+	}
+
+	// Models without fallbacks are not annotated
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "llama3", "messages": [{"role": "user", "content": "Hi"}]}`)))
+	if w.Code != http.StatusOK || w.Header().Get(servedByHeader) != "" {
+		t.Errorf("Expected no annotation without fallbacks, got %d %q", w.Code, w.Header().Get(servedByHeader))
+	}
+}
+
+func TestProviderRouter_DoesNotFailOverClientErrors(t *testing.T) {
+	var calls atomic.Int32
+	openai := failingUpstream(t, http.StatusBadRequest, &calls)
+	fallback := NewRealOpenAIClient("sk-openai")
+	fallback.BaseURL = openai.URL
+	router, err := providerRouterFromEnv(fallback, func(name string) string {
+		return map[string]string{"PROXY_FALLBACKS": "gpt-4o=gpt-4o-mini"}[name]
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, err := router.CreateChatCompletionContext(context.Background(), ChatCompletionRequest{Model: "gpt-4o"}); err == nil || calls.Load() != 1 {
+		t.Errorf("Expected a rejected request to be returned without failing over, got %v after %d calls", err, calls.Load())
+	}
+}
+
+func TestFallbacksFromEnv(t *testing.T) {
+	chains, err := fallbacksFromEnv(func(string) string { return "gpt-4o = claude-3-5-sonnet-latest, llama3.1; gpt-4o-mini=llama3.1" })
+	if err != nil || len(chains) != 2 || chains[0].model != "gpt-4o" || len(chains[0].fallbacks) != 2 || chains[0].fallbacks[1] != "llama3.1" {
+		t.Errorf("Unexpected chains %+v %v", chains, err)
+	}
+	for _, v := range []string{"gpt-4o", "gpt-4o=", "=llama3.1"} {
+		if _, err := fallbacksFromEnv(func(string) string { return v }); err == nil {
+			t.Errorf("Expected %q to be rejected", v)
+		}
+	}
+}
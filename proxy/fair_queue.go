@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// With PROXY_MAX_CONCURRENT_REQUESTS the proxy sends at most that many
+// requests upstream at once, and the others wait for a slot. Waiting
+// requests are not served in arrival order, which would let a tenant that
+// sends a burst hold up everyone behind it, but by weighted fair queuing:
+// each tenant's requests are stamped with a virtual finish time that
+// advances by 1/weight per request, and the lowest stamp gets the next free
+// slot. Tenants then share the slots in proportion to their weight, and a
+// burst only delays the tenant that sent it.
+
+// fairWaiter is a request waiting for a slot
+type fairWaiter struct {
+	flow string
+	// tag is the virtual finish time of the request, seq breaks ties in
+	// arrival order
+	tag   float64
+	seq   uint64
+	ready chan struct{}
+}
+
+// fairQueue hands out a fixed number of slots across flows by weighted
+// fair queuing
+type fairQueue struct {
+	mu    sync.Mutex
+	slots int
+	inUse int
+	// vtime is the tag of the request that got the last slot
+	vtime   float64
+	finish  map[string]float64
+	waiting []*fairWaiter
+	seq     uint64
+}
+
+func newFairQueue(slots int) *fairQueue {
+	return &fairQueue{slots: slots, finish: make(map[string]float64)}
+}
+
+// fairQueueFromEnv limits concurrent upstream requests to
+// PROXY_MAX_CONCURRENT_REQUESTS, if set
+func fairQueueFromEnv(getenv func(string) string) (*fairQueue, error) {
+	v := getenv("PROXY_MAX_CONCURRENT_REQUESTS")
+	if v == "" {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid PROXY_MAX_CONCURRENT_REQUESTS %q", v)
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	return newFairQueue(n), nil
+}
+
+// enqueue takes a slot for flow if one is free and nobody is waiting, and
+// returns nil. Otherwise it queues the request and returns its waiter,
+// whose ready channel is closed once a slot is handed to it.
+func (q *fairQueue) enqueue(flow string, weight float64) *fairWaiter {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.inUse < q.slots && len(q.waiting) == 0 {
+		q.inUse++
+		return nil
+	}
+	if weight <= 0 {
+		weight = 1
+	}
+	tag := max(q.vtime, q.finish[flow]) + 1/weight
+	q.finish[flow] = tag
+	q.seq++
+	w := &fairWaiter{flow: flow, tag: tag, seq: q.seq, ready: make(chan struct{})}
+	q.waiting = append(q.waiting, w)
+	return w
+}
+
+// Acquire waits for a slot for flow and reports whether it had to queue.
+// It fails only if ctx is done first.
+func (q *fairQueue) Acquire(ctx context.Context, flow string, weight float64) (bool, error) {
+	w := q.enqueue(flow, weight)
+	if w == nil {
+		return false, nil
+	}
+	select {
+	case <-w.ready:
+		return true, nil
+	case <-ctx.Done():
+	}
+	q.mu.Lock()
+	removed := q.remove(w)
+	q.mu.Unlock()
+	if !removed {
+		// The slot was handed over as the request gave up
+		q.Release()
+	}
+	return true, ctx.Err()
+}
+
+// remove drops w from the waiting requests and reports whether it was
+// still waiting
+func (q *fairQueue) remove(w *fairWaiter) bool {
+	for i, other := range q.waiting {
+		if other == w {
+			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Release frees a slot, handing it to the waiting request with the lowest
+// virtual finish time if there is one
+func (q *fairQueue) Release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.waiting) == 0 {
+		q.inUse--
+		return
+	}
+	next := 0
+	for i, w := range q.waiting[1:] {
+		if w.tag < q.waiting[next].tag || w.tag == q.waiting[next].tag && w.seq < q.waiting[next].seq {
+			next = i + 1
+		}
+	}
+	w := q.waiting[next]
+	q.waiting = append(q.waiting[:next], q.waiting[next+1:]...)
+	q.vtime = w.tag
+	if len(q.waiting) == 0 {
+		// Nobody is behind, so no flow has tags past vtime to remember
+		clear(q.finish)
+	}
+	close(w.ready)
+}
+
+// samples reports the slots in use and the requests waiting for one
+func (q *fairQueue) samples() []gaugeSample {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return []gaugeSample{
+		{metric: "vibethon_concurrent_requests", value: float64(q.inUse)},
+		{metric: "vibethon_queued_requests", value: float64(len(q.waiting))},
+	}
+}
+
+// withFairQueue holds requests until the fair queue gives them a slot. It
+// must run inside withAuth.
+func (s *ProxyServer) withFairQueue(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.queue == nil {
+			next(w, r)
+			return
+		}
+		flow, weight := "", 1.0
+		if key := clientKeyFromContext(r.Context()); key != nil {
+			flow = "key:" + key.ID
+			if tenant, ok := s.tenants.Get(key.Tenant); ok {
+				flow = "tenant:" + tenant.ID
+				if tenant.Weight > 0 {
+					weight = tenant.Weight
+				}
+			}
+		}
+		start := time.Now()
+		queued, err := s.queue.Acquire(r.Context(), flow, weight)
+		if err != nil {
+			return
+		}
+		defer s.queue.Release()
+		if queued {
+			timelineFromContext(r.Context()).Add(TimelineQueued, time.Since(start).String())
+		}
+		next(w, r)
+	}
+}
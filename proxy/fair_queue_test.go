@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// grantOrder fills the queue's slots, queues the requests of flows in the
+// order given and returns the flows in the order they get a slot
+func grantOrder(q *fairQueue, weights map[string]float64, arrivals ...string) string {
+	for i := 0; i < q.slots; i++ {
+		q.enqueue("busy", 1)
+	}
+	var waiters []*fairWaiter
+	for _, flow := range arrivals {
+		waiters = append(waiters, q.enqueue(flow, weights[flow]))
+	}
+	var order []string
+	for range waiters {
+		q.Release()
+		for i, w := range waiters {
+			select {
+			case <-w.ready:
+				order = append(order, w.flow)
+				waiters[i] = &fairWaiter{ready: make(chan struct{})}
+			default:
+			}
+		}
+	}
+	return strings.Join(order, "")
+}
+
+func TestFairQueue_BurstDelaysOnlyItsTenant(t *testing.T) {
+	// Tenant a sends a burst of six before b's two requests arrive; b is
+	// served as if a had sent no more than b
+	q := newFairQueue(1)
+	if got := grantOrder(q, nil, "a", "a", "a", "a", "a", "a", "b", "b"); got != "ababaaaa" {
+		t.Errorf("Expected the burst to be interleaved with b, got %s", got)
+	}
+}
+
+func TestFairQueue_SharesByWeight(t *testing.T) {
+	q := newFairQueue(1)
+	arrivals := strings.Split(strings.Repeat("a", 12)+strings.Repeat("b", 12), "")
+	got := grantOrder(q, map[string]float64{"a": 1, "b": 3}, arrivals...)
+	if first := got[:8]; strings.Count(first, "b") != 6 {
+		t.Errorf("Expected b to get three slots for each of a's, got %s", got)
+	}
+}
+
+func TestFairQueue_IdleTenantsGetNoCredit(t *testing.T) {
+	// A tenant that was idle while others queued cannot claim the slots it
+	// did not use all at once
+	q := newFairQueue(1)
+	grantOrder(q, nil, "a", "a", "a", "b", "b", "b")
+	q.Release()
+	if got := grantOrder(q, nil, "a", "a", "a", "c", "c", "c"); got != "acacac" {
+		t.Errorf("Expected a and c to alternate, got %s", got)
+	}
+}
+
+func TestFairQueue_CancelledWaiter(t *testing.T) {
+	q := newFairQueue(1)
+	if queued, err := q.Acquire(context.Background(), "a", 1); queued || err != nil {
+		t.Fatalf("Expected a free slot, got %v %v", queued, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := q.Acquire(ctx, "b", 1); err == nil {
+		t.Fatal("Expected the wait to be cancelled")
+	}
+	q.Release()
+	if queued, err := q.Acquire(context.Background(), "c", 1); queued || err != nil {
+		t.Errorf("Expected the cancelled waiter to have left the queue, got %v %v", queued, err)
+	}
+}
+
+func TestProxyServer_FairQueue(t *testing.T) {
+	release := make(chan struct{})
+	client := &turnstileOpenAIClient{release: release, started: make(chan struct{}, 10)}
+	server := NewProxyServer(client)
+	server.keys = createTestKeyStore(t)
+	server.keys.Add(ClientKey{ID: "bulk", Key: "sk-bulk", Tenant: "bulk"})
+	server.keys.Add(ClientKey{ID: "app", Key: "sk-app", Tenant: "app"})
+	server.tenants.Put("bulk", Tenant{ID: "bulk"})
+	server.tenants.Put("app", Tenant{ID: "app", Weight: 2})
+	server.submissions = nil
+	server.queue = newFairQueue(1)
+	handler := server.Handler()
+
+	var mu sync.Mutex
+	var done []string
+	var wg sync.WaitGroup
+	send := func(secret string) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "gpt-4o", "messages": [{"role": "user", "content": "Hi"}]}`))
+			req.Header.Set("Authorization", "Bearer "+secret)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				t.Errorf("Expected the request to succeed, got %d", w.Code)
+			}
+			mu.Lock()
+			done = append(done, secret)
+			mu.Unlock()
+		}()
+	}
+	waitQueued := func(n int) {
+		for server.queue.samples()[1].value != float64(n) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	send("sk-bulk")
+	<-client.started
+	for i := 0; i < 4; i++ {
+		send("sk-bulk")
+		waitQueued(i + 1)
+	}
+	send("sk-app")
+	waitQueued(5)
+	release <- struct{}{}
+	<-client.started
+	release <- struct{}{}
+	<-client.started
+	close(release)
+	wg.Wait()
+
+	// The app request arrived last but is served right after the one in
+	// flight
+	if len(done) != 6 || done[0] != "sk-app" && done[1] != "sk-app" {
+		t.Errorf("Expected the app request to skip the bulk backlog, got %v", done)
+	}
+}
+
+// turnstileOpenAIClient answers a request each time release is signalled
+type turnstileOpenAIClient struct {
+	release chan struct{}
+	started chan struct{}
+}
+
+func (c *turnstileOpenAIClient) CreateChatCompletion(req ChatCompletionRequest) (*ChatCompletionResponse, error) {
+	c.started <- struct{}{}
+	<-c.release
+	return createTestChatCompletionResponse(), nil
+}
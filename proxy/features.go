@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"os"
+	"slices"
+)
+
+// Features that feature flags can roll out gradually
+const (
+	// FeatureRAG is retrieval augmentation, in chat completions and the
+	// retrieve steps of pipelines
+	FeatureRAG = "rag"
+	// FeatureGuardrails is the checks of guardrail profiles, for virtual
+	// models and the guardrail steps of pipelines
+	FeatureGuardrails = "guardrails"
+	// FeatureCache is the response caches, of chat completions and
+	// translations
+	FeatureCache = "cache"
+)
+
+var knownFeatures = []string{FeatureRAG, FeatureGuardrails, FeatureCache}
+
+// errFeatureDisabled is wrapped by errors for requests using a feature
+// that is not rolled out to them
+var errFeatureDisabled = errors.New("feature is not enabled")
+
+// FeatureFlag decides who gets a feature. Features without a flag are on for
+// everyone, as are endpoints the flag does not name.
+type FeatureFlag struct {
+	// ID is the feature the flag gates
+	ID string `json:"id"`
+	// Endpoints limits the flag to requests for these endpoints, named as
+	// in usage events (e.g. chat.completions, pipelines, translate)
+	Endpoints []string `json:"endpoints,omitempty"`
+	// Tenants always have the feature and ExcludedTenants never do
+	Tenants         []string `json:"tenants,omitempty"`
+	ExcludedTenants []string `json:"excluded_tenants,omitempty"`
+	// Percentage of the other tenants that have the feature, from 0 to 100.
+	// Tenants are picked by a hash of their name, so raising it only adds
+	// tenants.
+	Percentage float64 `json:"percentage"`
+}
+
+func (f FeatureFlag) validate() error {
+	if !slices.Contains(knownFeatures, f.ID) {
+		return fmt.Errorf("unknown feature %q, expected one of %v", f.ID, knownFeatures)
+	}
+	if f.Percentage < 0 || f.Percentage > 100 {
+		return fmt.Errorf("percentage must be between 0 and 100")
+	}
+	return nil
+}
+
+// enabled evaluates the flag for a request of tenant to endpoint
+func (f FeatureFlag) enabled(endpoint, tenant string) bool {
+	switch {
+	case len(f.Endpoints) > 0 && !slices.Contains(f.Endpoints, endpoint):
+		return true
+	case slices.Contains(f.ExcludedTenants, tenant):
+		return false
+	case slices.Contains(f.Tenants, tenant):
+		return true
+	}
+	return rolloutBucket(f.ID, tenant) < f.Percentage
+}
+
+// rolloutBucket places tenant in [0, 100) for a feature. Each feature
+// orders tenants differently, so the same few are not always first.
+func rolloutBucket(feature, tenant string) float64 {
+	h := fnv.New64a()
+	h.Write([]byte(feature + "\x00" + tenant))
+	return float64(h.Sum64()%10000) / 100
+}
+
+// featureEnabled reports whether tenant gets feature on endpoint. An
+// external flag service is asked first when one is configured; the proxy's
+// own flags decide when it has no answer.
+func (s *ProxyServer) featureEnabled(feature, endpoint, tenant string) bool {
+	if s.flagProvider != nil {
+		if on, ok := flagBool(s.flagProvider, feature, flagTarget{Endpoint: endpoint, Tenant: tenant}); ok {
+			return on
+		}
+	}
+	flag, ok := s.featureFlags.Get(feature)
+	if !ok {
+		return true
+	}
+	return flag.enabled(endpoint, tenant)
+}
+
+// loadFeatureFlags reads a JSON list of flags into the registry
+func (s *ProxyServer) loadFeatureFlags(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read feature flags file: %w", err)
+	}
+	var flags []FeatureFlag
+	if err := json.Unmarshal(data, &flags); err != nil {
+		return fmt.Errorf("failed to parse feature flags file: %w", err)
+	}
+	for _, flag := range flags {
+		if err := flag.validate(); err != nil {
+			return fmt.Errorf("feature flag %s: %w", flag.ID, err)
+		}
+		s.featureFlags.Put(flag.ID, flag)
+	}
+	return nil
+}
+
+func (s *ProxyServer) adminFeatureFlagHandler() http.Handler {
+	return resourceHandler[FeatureFlag]{
+		lock: s.featureFlags.lockWrites,
+		get: func(id string) (FeatureFlag, string, bool) {
+			flag, ok := s.featureFlags.Get(id)
+			return flag, etagFor(flag), ok
+		},
+		put: func(id string, flag FeatureFlag, _ *FeatureFlag) (bool, error) {
+			if flag.ID != "" && flag.ID != id {
+				return false, fmt.Errorf("id in body does not match id in path")
+			}
+			flag.ID = id
+			if err := flag.validate(); err != nil {
+				return false, err
+			}
+			return s.featureFlags.Put(id, flag), nil
+		},
+		remove: s.featureFlags.Delete,
+		view:   func(flag FeatureFlag) any { return flag },
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFeatureFlag_Enabled(t *testing.T) {
+	flag := FeatureFlag{ID: FeatureRAG, Endpoints: []string{"chat.completions"}, Tenants: []string{"beta"}, ExcludedTenants: []string{"bank"}, Percentage: 0}
+	if !flag.enabled("pipelines", "acme") {
+		t.Error("Endpoints the flag does not name should keep the feature")
+	}
+	if !flag.enabled("chat.completions", "beta") || flag.enabled("chat.completions", "acme") {
+		t.Error("Expected only the listed tenant at 0%")
+	}
+	flag.Percentage = 100
+	if !flag.enabled("chat.completions", "acme") || flag.enabled("chat.completions", "bank") {
+		t.Error("Expected everyone but the excluded tenant at 100%")
+	}
+
+	// Raising the percentage only ever adds tenants
+	enabled := make(map[string]bool)
+	for _, percentage := range []float64{10, 25, 50, 75} {
+		flag := FeatureFlag{ID: FeatureCache, Percentage: percentage}
+		count := 0
+		for i := 0; i < 1000; i++ {
+			tenant := fmt.Sprintf("tenant-%d", i)
+			on := flag.enabled("translate", tenant)
+			if enabled[tenant] && !on {
+				t.Fatalf("%s lost the feature at %v%%", tenant, percentage)
+			}
+			enabled[tenant] = on
+			if on {
+				count++
+			}
+		}
+		if want := int(percentage * 10); count < want-60 || count > want+60 {
+			t.Errorf("Expected about %d of 1000 tenants at %v%%, got %d", want, percentage, count)
+		}
+	}
+}
+
+func TestProxyServer_RAGFeatureFlag(t *testing.T) {
+	server, _ := newRAGServer(t, "Within 14 days.")
+	server.featureFlags.Put(FeatureRAG, FeatureFlag{ID: FeatureRAG, Tenants: []string{"beta"}})
+	body := `{"model": "gpt-4o", "messages": [{"role": "user", "content": "How do I get a refund?"}], "rag": {}}`
+
+	if w := chatRequestAs(server, &ClientKey{ID: "acme", Tenant: "acme"}, body); w.Code != http.StatusForbidden {
+		t.Errorf("Expected status code %d, got %d: %s", http.StatusForbidden, w.Code, w.Body.String())
+	}
+	if w := chatRequestAs(server, &ClientKey{ID: "beta", Tenant: "beta"}, body); w.Code != http.StatusOK {
+		t.Errorf("Expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+}
+
+func TestProxyServer_GuardrailsFeatureFlag(t *testing.T) {
+	mockClient := &recordingOpenAIClient{MockOpenAIClient: MockOpenAIClient{response: createTestChatCompletionResponse()}}
+	server := NewProxyServer(mockClient)
+	profile := GuardrailProfile{ID: "strict", RedactPII: true}
+	profile.compile()
+	server.guardrails.Put("strict", profile)
+	server.virtualModels.Put("support", VirtualModel{ID: "support", Model: "gpt-4o", Guardrails: "strict"})
+	server.featureFlags.Put(FeatureGuardrails, FeatureFlag{ID: FeatureGuardrails, Tenants: []string{"beta"}})
+	body := `{"model": "support", "messages": [{"role": "user", "content": "Call me on 415-555-0132"}]}`
+
+	for tenant, want := range map[string]string{"acme": "Call me on 415-555-0132", "beta": "Call me on [PHONE]"} {
+		if w := chatRequestAs(server, &ClientKey{ID: tenant, Tenant: tenant}, body); w.Code != http.StatusOK {
+			t.Fatalf("Expected status code %d, got %d", http.StatusOK, w.Code)
+		}
+		if got := mockClient.last.Messages[0].Content; got != want {
+			t.Errorf("%s: expected %q upstream, got %q", tenant, want, got)
+		}
+	}
+}
+
+// stubFlagProvider answers for the flags it has
+type stubFlagProvider map[string]any
+
+func (p stubFlagProvider) Value(flag string, target flagTarget) (any, bool) {
+	value, ok := p[flag]
+	return value, ok
+}
+
+func TestProxyServer_FeatureEnabled_Provider(t *testing.T) {
+	server := NewProxyServer(&MockOpenAIClient{})
+	server.featureFlags.Put(FeatureRAG, FeatureFlag{ID: FeatureRAG})
+	server.featureFlags.Put(FeatureCache, FeatureFlag{ID: FeatureCache})
+	server.flagProvider = stubFlagProvider{FeatureRAG: true}
+
+	if !server.featureEnabled(FeatureRAG, "chat.completions", "acme") {
+		t.Error("Expected the provider to decide the flags it has")
+	}
+	if server.featureEnabled(FeatureCache, "translate", "acme") {
+		t.Error("Expected the proxy's own flag to decide when the provider has no answer")
+	}
+	if !server.featureEnabled(FeatureGuardrails, "chat.completions", "acme") {
+		t.Error("Expected features without a flag to stay on")
+	}
+}
+
+func TestAdmin_FeatureFlags(t *testing.T) {
+	server := NewProxyServer(&MockOpenAIClient{})
+	mux := http.NewServeMux()
+	mux.Handle("/admin/flags/{id}", server.adminFeatureFlagHandler())
+
+	if w := adminRequest(mux, http.MethodPut, "/admin/flags/rag", `{"percentage": 25, "tenants": ["beta"]}`, nil); w.Code != http.StatusCreated {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	if flag, ok := server.featureFlags.Get(FeatureRAG); !ok || flag.Percentage != 25 {
+		t.Errorf("Unexpected flag %+v", flag)
+	}
+	for path, body := range map[string]string{
+		"/admin/flags/semantic-cache": `{}`,
+		"/admin/flags/cache":          `{"percentage": 150}`,
+	} {
+		if w := adminRequest(mux, http.MethodPut, path, body, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("%s %s: expected status code %d, got %d", path, body, http.StatusBadRequest, w.Code)
+		}
+	}
+}
+
+func TestProxyServer_LoadFeatureFlags(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "flags.json")
+	os.WriteFile(path, []byte(`[{"id": "cache", "endpoints": ["translate"], "percentage": 10}]`), 0o644)
+	server := NewProxyServer(&MockOpenAIClient{})
+	if err := server.loadFeatureFlags(path); err != nil {
+		t.Fatal(err)
+	}
+	if flag, ok := server.featureFlags.Get(FeatureCache); !ok || flag.Percentage != 10 {
+		t.Errorf("Unexpected flag %+v", flag)
+	}
+	os.WriteFile(path, []byte(`[{"id": "everything"}]`), 0o644)
+	if err := server.loadFeatureFlags(path); err == nil {
+		t.Error("Expected unknown features to be rejected")
+	}
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+)
+
+// Fetch limits: what is returned to the model is capped separately from
+// what is downloaded, since markup makes up much of a page
+const (
+	fetchDefaultMaxBytes = 2 << 20
+	fetchMaxText         = 50000
+	fetchMaxRedirects    = 5
+	robotsMaxBytes       = 500 << 10
+)
+
+// fetchUserAgent identifies the proxy to the sites it fetches, and
+// robotsAgent is the token their robots.txt can address it with
+const (
+	fetchUserAgent = "VibethonProxy/1.0 (fetch_url tool)"
+	robotsAgent    = "vibethonproxy"
+)
+
+const fetchToolParameters = `{
+	"type": "object",
+	"properties": {
+		"url": {"type": "string", "description": "The http or https URL of the page"}
+	},
+	"required": ["url"]
+}`
+
+// errFetchDenied is wrapped by errors for URLs the fetcher may not access
+var errFetchDenied = errors.New("not allowed")
+
+// urlFetcher is the fetch_url builtin tool. It only fetches from allowed
+// hosts, follows their robots.txt and never connects to private addresses
+// unless allowPrivate is set, also after a redirect.
+type urlFetcher struct {
+	client *http.Client
+	// allowed are host names, "*.example.com" for the subdomains of a
+	// domain or "*" for any host
+	allowed      []string
+	allowPrivate bool
+	maxBytes     int64
+	robots       *lruCache[robotsRules]
+}
+
+func newURLFetcher(allowed []string) *urlFetcher {
+	f := &urlFetcher{
+		allowed:  allowed,
+		maxBytes: fetchDefaultMaxBytes,
+		robots:   newLRUCache[robotsRules](1000, time.Hour),
+	}
+	dialer := &net.Dialer{Timeout: 10 * time.Second, Control: f.checkAddress}
+	f.client = &http.Client{
+		Timeout:   20 * time.Second,
+		Transport: &http.Transport{DialContext: dialer.DialContext, TLSHandshakeTimeout: 10 * time.Second},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= fetchMaxRedirects {
+				return fmt.Errorf("stopped after %d redirects", fetchMaxRedirects)
+			}
+			return f.checkURL(req.Context(), req.URL)
+		},
+	}
+	return f
+}
+
+// FetchResult is what the model sees of a page
+type FetchResult struct {
+	// URL is where the page was found, after redirects
+	URL         string `json:"url"`
+	Status      int    `json:"status"`
+	ContentType string `json:"content_type"`
+	Title       string `json:"title,omitempty"`
+	Text        string `json:"text"`
+	Truncated   bool   `json:"truncated,omitempty"`
+}
+
+func (f *urlFetcher) definition(name string) ToolFunction {
+	return ToolFunction{
+		Name:        name,
+		Description: "Fetches a web page and returns its text, without markup. Only some sites can be fetched.",
+		Parameters:  json.RawMessage(fetchToolParameters),
+	}
+}
+
+func (f *urlFetcher) call(ctx context.Context, arguments string) (string, error) {
+	var args struct {
+		URL string `json:"url"`
+	}
+	if err := json.Unmarshal([]byte(arguments), &args); err != nil || args.URL == "" {
+		return "", fmt.Errorf(`arguments must be an object with the page in "url"`)
+	}
+	result, err := f.fetch(ctx, args.URL)
+	if err != nil {
+		return "", err
+	}
+	out, err := json.Marshal(result)
+	return string(out), err
+}
+
+// fetch retrieves a page and converts it to text
+func (f *urlFetcher) fetch(ctx context.Context, rawURL string) (FetchResult, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return FetchResult{}, fmt.Errorf("invalid URL: %v", err)
+	}
+	if err := f.checkURL(ctx, u); err != nil {
+		return FetchResult{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return FetchResult{}, err
+	}
+	req.Header.Set("User-Agent", fetchUserAgent)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml,text/plain;q=0.9,*/*;q=0.5")
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return FetchResult{}, fmt.Errorf("failed to fetch %s: %w", u, err)
+	}
+	defer resp.Body.Close()
+
+	result := FetchResult{URL: resp.Request.URL.String(), Status: resp.StatusCode}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	result.ContentType = mediaType
+	text := mediaType == "" || strings.HasPrefix(mediaType, "text/") || mediaType == "application/json" ||
+		mediaType == "application/xml" || mediaType == "application/xhtml+xml" || strings.HasSuffix(mediaType, "+json")
+	if !text {
+		return FetchResult{}, fmt.Errorf("%s is %s, not a page with text", result.URL, mediaType)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, f.maxBytes+1))
+	if err != nil {
+		return FetchResult{}, fmt.Errorf("failed to read %s: %w", result.URL, err)
+	}
+	if int64(len(body)) > f.maxBytes {
+		body, result.Truncated = body[:f.maxBytes], true
+	}
+	content := strings.ToValidUTF8(string(body), "�")
+	if mediaType == "text/html" || mediaType == "application/xhtml+xml" || (mediaType == "" && strings.Contains(content[:min(len(content), 1024)], "<")) {
+		result.Title, content = htmlToText(content)
+	}
+	if len(content) > fetchMaxText {
+		cut := fetchMaxText
+		for cut > 0 && !utf8.RuneStart(content[cut]) {
+			cut--
+		}
+		content, result.Truncated = content[:cut], true
+	}
+	result.Text = content
+	return result, nil
+}
+
+// checkURL checks that u may be fetched: an http or https URL of an
+// allowed host whose robots.txt does not disallow it
+func (f *urlFetcher) checkURL(ctx context.Context, u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%w: only http and https URLs can be fetched", errFetchDenied)
+	}
+	if !f.allowsHost(u.Hostname()) {
+		return fmt.Errorf("%w: host %s is not in the allowlist", errFetchDenied, u.Hostname())
+	}
+	// robots.txt itself can always be fetched, also when redirected
+	if u.Path == "/robots.txt" {
+		return nil
+	}
+	rules, err := f.robotsFor(ctx, u)
+	if err != nil {
+		return err
+	}
+	if !rules.allows(u.RequestURI()) {
+		return fmt.Errorf("%w: %s is disallowed by robots.txt", errFetchDenied, u)
+	}
+	return nil
+}
+
+// allowsHost matches host against the allowlist
+func (f *urlFetcher) allowsHost(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range f.allowed {
+		pattern = strings.ToLower(pattern)
+		if pattern == "*" || pattern == host {
+			return true
+		}
+		if suffix, ok := strings.CutPrefix(pattern, "*."); ok && strings.HasSuffix(host, "."+suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAddress refuses connections to loopback, private and link-local
+// addresses, checked on the resolved address so DNS cannot bypass it
+func (f *urlFetcher) checkAddress(network, address string, _ syscall.RawConn) error {
+	if f.allowPrivate {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+		return fmt.Errorf("%w: %s is a private address", errFetchDenied, host)
+	}
+	return nil
+}
+
+// robotsRules are the Allow and Disallow rules of a robots.txt that apply
+// to the proxy
+type robotsRules struct {
+	rules []robotsRule
+	// disallowAll is set when robots.txt could not be fetched, as if it
+	// disallowed everything
+	disallowAll bool
+}
+
+type robotsRule struct {
+	allow bool
+	// length is that of the pattern, the more specific the longer
+	length int
+	match  *regexp.Regexp
+}
+
+// robotsFor returns the robots.txt rules of the origin of u, cached per
+// origin. It only fails when the origin may not be accessed at all.
+func (f *urlFetcher) robotsFor(ctx context.Context, u *url.URL) (robotsRules, error) {
+	origin := u.Scheme + "://" + u.Host
+	if rules, ok := f.robots.Get(origin); ok {
+		return rules, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, origin+"/robots.txt", nil)
+	if err != nil {
+		return robotsRules{}, err
+	}
+	req.Header.Set("User-Agent", fetchUserAgent)
+	resp, err := f.client.Do(req)
+	if errors.Is(err, errFetchDenied) {
+		return robotsRules{}, err
+	}
+	// An unreachable robots.txt disallows everything, and is tried again
+	// on the next fetch
+	if err != nil {
+		return robotsRules{disallowAll: true}, nil
+	}
+	defer resp.Body.Close()
+	var rules robotsRules
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		rules = parseRobots(io.LimitReader(resp.Body, robotsMaxBytes), robotsAgent)
+	case resp.StatusCode >= 500:
+		return robotsRules{disallowAll: true}, nil
+	}
+	// Other statuses, e.g. 404 for no robots.txt, allow everything
+	f.robots.Put(origin, rules)
+	return rules, nil
+}
+
+// parseRobots reads the rules of a robots.txt for agent, following RFC
+// 9309: the groups naming the agent apply, or else those for *
+func parseRobots(r io.Reader, agent string) robotsRules {
+	var own, anyAgent []robotsRule
+	matchesOwn, matchesAny, inRules := false, false, false
+	ownFound := false
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		field, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		field, value = strings.ToLower(strings.TrimSpace(field)), strings.TrimSpace(value)
+		switch field {
+		case "user-agent":
+			// Consecutive user-agent lines share a group
+			if inRules {
+				matchesOwn, matchesAny, inRules = false, false, false
+			}
+			name := strings.ToLower(value)
+			if name == "*" {
+				matchesAny = true
+			} else if name == agent {
+				matchesOwn, ownFound = true, true
+			}
+		case "allow", "disallow":
+			inRules = true
+			if value == "" {
+				// An empty Disallow allows everything
+				continue
+			}
+			rule := robotsRule{allow: field == "allow", length: len(value), match: robotsPattern(value)}
+			if matchesOwn {
+				own = append(own, rule)
+			}
+			if matchesAny {
+				anyAgent = append(anyAgent, rule)
+			}
+		}
+	}
+	if ownFound {
+		return robotsRules{rules: own}
+	}
+	return robotsRules{rules: anyAgent}
+}
+
+// allows reports whether a path, with its query, may be fetched: the
+// longest matching rule decides, and Allow wins a tie
+func (r robotsRules) allows(path string) bool {
+	if r.disallowAll {
+		return false
+	}
+	allowed, longest := true, -1
+	for _, rule := range r.rules {
+		if !rule.match.MatchString(path) {
+			continue
+		}
+		if rule.length > longest || (rule.length == longest && rule.allow) {
+			allowed, longest = rule.allow, rule.length
+		}
+	}
+	return allowed
+}
+
+// robotsPattern compiles a robots.txt path pattern, where * matches any
+// characters and a trailing $ the end of the path
+func robotsPattern(pattern string) *regexp.Regexp {
+	anchored := strings.HasSuffix(pattern, "$")
+	pattern = regexp.QuoteMeta(strings.TrimSuffix(pattern, "$"))
+	pattern = "^" + strings.ReplaceAll(pattern, `\*`, ".*")
+	if anchored {
+		pattern += "$"
+	}
+	return regexp.MustCompile(pattern)
+}
+
+// urlFetcherFromEnv configures fetch_url from PROXY_FETCH_ALLOWED_HOSTS.
+// It returns nil when no hosts are allowed, which is the default.
+func urlFetcherFromEnv(getenv func(string) string) (*urlFetcher, error) {
+	hosts := getenv("PROXY_FETCH_ALLOWED_HOSTS")
+	if hosts == "" {
+		return nil, nil
+	}
+	var allowed []string
+	for _, host := range strings.Split(hosts, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			allowed = append(allowed, host)
+		}
+	}
+	f := newURLFetcher(allowed)
+	if v := getenv("PROXY_FETCH_MAX_BYTES"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid PROXY_FETCH_MAX_BYTES %q", v)
+		}
+		f.maxBytes = n
+	}
+	if v := getenv("PROXY_FETCH_ALLOW_PRIVATE"); v != "" {
+		allow, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PROXY_FETCH_ALLOW_PRIVATE %q", v)
+		}
+		f.allowPrivate = allow
+	}
+	return f, nil
+}
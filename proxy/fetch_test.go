@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// newFetchSite serves a small site with a robots.txt
+func newFetchSite(t *testing.T, robots string) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/robots.txt", func(w http.ResponseWriter, r *http.Request) {
+		if robots == "" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(robots))
+	})
+	mux.HandleFunc("/page", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("User-Agent") != fetchUserAgent {
+			t.Errorf("Expected the proxy's user agent, got %q", r.Header.Get("User-Agent"))
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(`<html><head><title>Docs</title></head><body><p>Hello <b>world</b></p></body></html>`))
+	})
+	mux.HandleFunc("/big", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(strings.Repeat("a", 5000)))
+	})
+	mux.HandleFunc("/image", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte{0x89, 'P', 'N', 'G'})
+	})
+	mux.HandleFunc("/away", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://elsewhere.test/page", http.StatusFound)
+	})
+	mux.HandleFunc("/home", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/page", http.StatusFound)
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestURLFetcher_Fetch(t *testing.T) {
+	site := newFetchSite(t, "")
+	f := newURLFetcher([]string{"127.0.0.1"})
+	f.allowPrivate = true
+
+	output, err := f.call(context.Background(), `{"url": "`+site.URL+`/home"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result FetchResult
+	json.Unmarshal([]byte(output), &result)
+	if result.URL != site.URL+"/page" || result.Status != 200 || result.Title != "Docs" || result.Text != "Hello world" || result.ContentType != "text/html" {
+		t.Errorf("Expected the text of the page after the redirect, got %+v", result)
+	}
+
+	f.maxBytes = 1000
+	if result, err := f.fetch(context.Background(), site.URL+"/big"); err != nil || len(result.Text) != 1000 || !result.Truncated {
+		t.Errorf("Expected the page cut at 1000 bytes, got %d bytes (%v)", len(result.Text), err)
+	}
+	if _, err := f.fetch(context.Background(), site.URL+"/image"); err == nil {
+		t.Error("Expected an error for an image")
+	}
+}
+
+func TestURLFetcher_Denied(t *testing.T) {
+	site := newFetchSite(t, "User-agent: *\nDisallow: /page\n")
+	f := newURLFetcher([]string{"127.0.0.1"})
+	f.allowPrivate = true
+
+	for _, rawURL := range []string{
+		site.URL + "/page",
+		site.URL + "/away",
+		"http://example.com/",
+		"file:///etc/passwd",
+	} {
+		if _, err := f.fetch(context.Background(), rawURL); !errors.Is(err, errFetchDenied) {
+			t.Errorf("Expected %s to be denied, got %v", rawURL, err)
+		}
+	}
+	if _, err := f.fetch(context.Background(), site.URL+"/big"); err != nil {
+		t.Errorf("Expected paths robots.txt allows to be fetched, got %v", err)
+	}
+
+	// Private addresses are refused unless allowed, whatever the allowlist
+	f = newURLFetcher([]string{"*"})
+	if _, err := f.fetch(context.Background(), site.URL+"/big"); !errors.Is(err, errFetchDenied) || !strings.Contains(err.Error(), "private address") {
+		t.Errorf("Expected a private address to be denied, got %v", err)
+	}
+}
+
+func TestURLFetcher_AllowsHost(t *testing.T) {
+	f := newURLFetcher([]string{"docs.example.com", "*.wikipedia.org"})
+	for host, want := range map[string]bool{
+		"docs.example.com":    true,
+		"DOCS.example.com.":   true,
+		"example.com":         false,
+		"en.wikipedia.org":    true,
+		"wikipedia.org":       false,
+		"evilwikipedia.org":   false,
+		"docs.example.com.io": false,
+	} {
+		if got := f.allowsHost(host); got != want {
+			t.Errorf("Expected allowsHost(%s) to be %v", host, want)
+		}
+	}
+}
+
+func TestParseRobots(t *testing.T) {
+	robots := `# Example
+User-agent: Googlebot
+Disallow: /
+
+User-agent: *
+Disallow: /private
+Allow: /private/public
+Disallow: /*.pdf$
+Disallow:
+
+User-agent: VibethonProxy
+User-agent: other
+Disallow: /drafts # work in progress
+`
+	rules := parseRobots(strings.NewReader(robots), robotsAgent)
+	for path, want := range map[string]bool{
+		"/":              true,
+		"/drafts/a":      false,
+		"/private":       true,
+		"/private/page":  true,
+		"/manual.pdf":    true,
+		"/docs?page=two": true,
+	} {
+		if got := rules.allows(path); got != want {
+			t.Errorf("Expected allows(%s) to be %v for the proxy's group", path, want)
+		}
+	}
+
+	rules = parseRobots(strings.NewReader(robots), "otherbot")
+	for path, want := range map[string]bool{
+		"/":                     true,
+		"/private/x":            false,
+		"/private/public/x":     true,
+		"/manual.pdf":           false,
+		"/manual.pdf?download":  true,
+		"/drafts":               true,
+		"/private/public/a.pdf": true,
+	} {
+		if got := rules.allows(path); got != want {
+			t.Errorf("Expected allows(%s) to be %v for *", path, want)
+		}
+	}
+	if (robotsRules{disallowAll: true}).allows("/") {
+		t.Error("Expected an unreachable robots.txt to disallow everything")
+	}
+}
+
+func TestURLFetcher_RobotsCached(t *testing.T) {
+	var fetches int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/robots.txt" {
+			fetches++
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+	f := newURLFetcher([]string{"*"})
+	f.allowPrivate = true
+	u, _ := url.Parse(server.URL + "/a")
+	f.checkURL(context.Background(), u)
+	f.checkURL(context.Background(), u)
+	if fetches != 1 {
+		t.Errorf("Expected robots.txt fetched once, got %d", fetches)
+	}
+}
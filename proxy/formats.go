@@ -0,0 +1,447 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// xmlValue parses an XML document into the JSON-like value clients get as
+// "parsed": {"root": ...}. An element with neither attributes nor child
+// elements becomes its text; others become objects with attributes as
+// "@name", child elements by name (a list if repeated) and any text as
+// "#text". If root is set, the document element must have that name.
+func xmlValue(content, root string) (any, error) {
+	type element struct {
+		name  string
+		value map[string]any
+		text  strings.Builder
+	}
+	dec := xml.NewDecoder(strings.NewReader(content))
+	var stack []*element
+	var doc map[string]any
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("the reply is not well-formed XML: %v", err)
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if len(stack) == 0 && doc != nil {
+				return nil, fmt.Errorf("the reply has more than one root element")
+			}
+			if len(stack) == 0 && root != "" && t.Name.Local != root {
+				return nil, fmt.Errorf("the root element must be <%s>, got <%s>", root, t.Name.Local)
+			}
+			el := &element{name: t.Name.Local, value: make(map[string]any)}
+			for _, attr := range t.Attr {
+				el.value["@"+attr.Name.Local] = attr.Value
+			}
+			stack = append(stack, el)
+		case xml.EndElement:
+			el := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			var value any = el.value
+			text := strings.TrimSpace(el.text.String())
+			switch {
+			case len(el.value) == 0:
+				value = text
+			case text != "":
+				el.value["#text"] = text
+			}
+			if len(stack) == 0 {
+				doc = map[string]any{el.name: value}
+				continue
+			}
+			parent := stack[len(stack)-1]
+			// Values of elements are never lists, so a list means the element
+			// was repeated
+			switch existing := parent.value[el.name].(type) {
+			case nil:
+				parent.value[el.name] = value
+			case []any:
+				parent.value[el.name] = append(existing, value)
+			default:
+				parent.value[el.name] = []any{existing, value}
+			}
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].text.Write(t)
+			} else if strings.TrimSpace(string(t)) != "" {
+				return nil, fmt.Errorf("the reply has text outside the root element")
+			}
+		}
+	}
+	if doc == nil {
+		return nil, fmt.Errorf("the reply is not an XML document")
+	}
+	return doc, nil
+}
+
+// yamlValue parses the subset of YAML models reply with into the value it
+// encodes as JSON: block mappings and sequences, flow collections, plain and
+// quoted scalars, literal and folded block scalars, and comments. Anchors,
+// tags and multi-document streams are not supported. Scalars become null,
+// booleans or numbers where YAML 1.2 says so, and strings otherwise.
+func yamlValue(content string) (any, error) {
+	p := &yamlParser{}
+	for i, raw := range strings.Split(strings.ReplaceAll(content, "\r\n", "\n"), "\n") {
+		text := strings.TrimLeft(raw, " ")
+		if strings.HasPrefix(text, "\t") {
+			return nil, fmt.Errorf("line %d: tabs are not allowed for indentation", i+1)
+		}
+		p.lines = append(p.lines, yamlLine{num: i + 1, indent: len(raw) - len(text), text: text})
+	}
+	p.skipBlank()
+	if p.pos < len(p.lines) && p.lines[p.pos].text == "---" {
+		p.pos++
+	}
+	value, err := p.node(0)
+	if err != nil {
+		return nil, err
+	}
+	p.skipBlank()
+	if p.pos < len(p.lines) && p.lines[p.pos].text != "..." {
+		line := p.lines[p.pos]
+		return nil, fmt.Errorf("line %d: unexpected %q", line.num, line.text)
+	}
+	return value, nil
+}
+
+type yamlLine struct {
+	num    int
+	indent int
+	text   string
+}
+
+func (l yamlLine) blank() bool {
+	return l.text == "" || strings.HasPrefix(l.text, "#")
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+func (p *yamlParser) skipBlank() {
+	for p.pos < len(p.lines) && p.lines[p.pos].blank() {
+		p.pos++
+	}
+}
+
+// node parses the node starting at the next line indented at least min
+func (p *yamlParser) node(min int) (any, error) {
+	p.skipBlank()
+	if p.pos >= len(p.lines) || p.lines[p.pos].indent < min {
+		return nil, nil
+	}
+	line := p.lines[p.pos]
+	if line.text == "-" || strings.HasPrefix(line.text, "- ") {
+		return p.sequence(line.indent)
+	}
+	if _, _, ok := splitYAMLKey(line.text); ok {
+		return p.mapping(line.indent)
+	}
+	p.pos++
+	return parseYAMLFlow(line.text, line.num)
+}
+
+func (p *yamlParser) sequence(indent int) (any, error) {
+	items := []any{}
+	for p.skipBlank(); p.pos < len(p.lines); p.skipBlank() {
+		line := p.lines[p.pos]
+		if line.indent != indent || (line.text != "-" && !strings.HasPrefix(line.text, "- ")) {
+			if line.indent > indent {
+				return nil, fmt.Errorf("line %d: unexpected indentation", line.num)
+			}
+			break
+		}
+		rest := strings.TrimLeft(strings.TrimPrefix(line.text, "-"), " ")
+		var item any
+		var err error
+		if rest == "" || strings.HasPrefix(rest, "#") {
+			p.pos++
+			item, err = p.node(indent + 1)
+		} else {
+			// Parse the rest as a node of its own, indented where it starts,
+			// so "- name: a" can continue with "  age: 1" on the next line
+			p.lines[p.pos] = yamlLine{num: line.num, indent: line.indent + len(line.text) - len(rest), text: rest}
+			item, err = p.node(0)
+		}
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+func (p *yamlParser) mapping(indent int) (any, error) {
+	object := map[string]any{}
+	for p.skipBlank(); p.pos < len(p.lines); p.skipBlank() {
+		line := p.lines[p.pos]
+		if line.indent < indent {
+			break
+		}
+		if line.indent > indent {
+			return nil, fmt.Errorf("line %d: unexpected indentation", line.num)
+		}
+		key, rest, ok := splitYAMLKey(line.text)
+		if !ok {
+			if line.text == "-" || strings.HasPrefix(line.text, "- ") {
+				break
+			}
+			return nil, fmt.Errorf("line %d: expected a key, got %q", line.num, line.text)
+		}
+		if _, dup := object[key]; dup {
+			return nil, fmt.Errorf("line %d: duplicate key %q", line.num, key)
+		}
+		p.pos++
+		var value any
+		var err error
+		switch {
+		case rest == "" || strings.HasPrefix(rest, "#"):
+			p.skipBlank()
+			if p.pos < len(p.lines) && p.lines[p.pos].indent == indent && (p.lines[p.pos].text == "-" || strings.HasPrefix(p.lines[p.pos].text, "- ")) {
+				// A sequence may sit at the same indentation as its key
+				value, err = p.sequence(indent)
+			} else {
+				value, err = p.node(indent + 1)
+			}
+		case rest[0] == '|' || rest[0] == '>':
+			value, err = p.blockScalar(indent, rest, line.num)
+		default:
+			value, err = parseYAMLFlow(rest, line.num)
+		}
+		if err != nil {
+			return nil, err
+		}
+		object[key] = value
+	}
+	return object, nil
+}
+
+// blockScalar reads the lines of a | or > scalar more indented than its key
+func (p *yamlParser) blockScalar(indent int, header string, num int) (any, error) {
+	header = strings.TrimSpace(strings.SplitN(header, " #", 2)[0])
+	folded, chomp := header[0] == '>', header[1:]
+	if chomp != "" && chomp != "-" && chomp != "+" {
+		return nil, fmt.Errorf("line %d: unsupported block scalar header %q", num, header)
+	}
+	var lines []string
+	content := -1
+	for ; p.pos < len(p.lines); p.pos++ {
+		line := p.lines[p.pos]
+		if line.text == "" {
+			lines = append(lines, "")
+			continue
+		}
+		if content < 0 {
+			content = line.indent
+		}
+		if line.indent <= indent || line.indent < content {
+			break
+		}
+		lines = append(lines, strings.Repeat(" ", line.indent-content)+line.text)
+	}
+	var trailing int
+	for trailing < len(lines) && lines[len(lines)-1-trailing] == "" {
+		trailing++
+	}
+	body := lines[:len(lines)-trailing]
+	var b strings.Builder
+	for i, line := range body {
+		switch {
+		case i == 0:
+		case !folded || line == "" || body[i-1] == "" || strings.HasPrefix(line, " "):
+			b.WriteByte('\n')
+		default:
+			b.WriteByte(' ')
+		}
+		b.WriteString(line)
+	}
+	text := b.String()
+	switch {
+	case chomp == "-" || len(body) == 0:
+	case chomp == "+":
+		text += strings.Repeat("\n", trailing+1)
+	default:
+		text += "\n"
+	}
+	return text, nil
+}
+
+// splitYAMLKey splits "key: value" into the key and the rest, if the line
+// is a mapping entry
+func splitYAMLKey(text string) (string, string, bool) {
+	if text == "" || strings.ContainsRune("[{#", rune(text[0])) || text == "-" || strings.HasPrefix(text, "- ") {
+		return "", "", false
+	}
+	if text[0] == '"' || text[0] == '\'' {
+		key, n, err := parseYAMLQuoted(text)
+		if err != nil {
+			return "", "", false
+		}
+		rest := strings.TrimLeft(text[n:], " ")
+		if !strings.HasPrefix(rest, ":") {
+			return "", "", false
+		}
+		return key, strings.TrimSpace(rest[1:]), true
+	}
+	for i := 0; i < len(text); i++ {
+		if text[i] == ':' && (i == len(text)-1 || text[i+1] == ' ') {
+			return strings.TrimSpace(text[:i]), strings.TrimSpace(text[i+1:]), true
+		}
+		if text[i] == '#' && i > 0 && text[i-1] == ' ' {
+			break
+		}
+	}
+	return "", "", false
+}
+
+// parseYAMLFlow parses a value on a single line: a flow collection, a
+// quoted or a plain scalar, followed by an optional comment
+func parseYAMLFlow(text string, num int) (any, error) {
+	value, n, err := parseYAMLFlowValue(text, 0, false)
+	if err != nil {
+		return nil, fmt.Errorf("line %d: %v", num, err)
+	}
+	if rest := strings.TrimSpace(text[n:]); rest != "" && !strings.HasPrefix(rest, "#") {
+		return nil, fmt.Errorf("line %d: unexpected %q after the value", num, rest)
+	}
+	return value, nil
+}
+
+var errYAMLFlowEnd = errors.New("unterminated flow collection")
+
+// parseYAMLFlowValue parses one value at text[i:] and returns it with the
+// offset after it. Inside a flow collection, plain scalars end at , ] }.
+func parseYAMLFlowValue(text string, i int, inFlow bool) (any, int, error) {
+	for i < len(text) && text[i] == ' ' {
+		i++
+	}
+	if i >= len(text) {
+		return nil, i, nil
+	}
+	switch text[i] {
+	case '"', '\'':
+		s, n, err := parseYAMLQuoted(text[i:])
+		return s, i + n, err
+	case '[':
+		items := []any{}
+		i++
+		for {
+			i = skipSpaces(text, i)
+			if i >= len(text) {
+				return nil, i, errYAMLFlowEnd
+			}
+			if text[i] == ']' {
+				return items, i + 1, nil
+			}
+			item, n, err := parseYAMLFlowValue(text, i, true)
+			if err != nil {
+				return nil, n, err
+			}
+			items = append(items, item)
+			if i = skipSpaces(text, n); i < len(text) && text[i] == ',' {
+				i++
+			}
+		}
+	case '{':
+		object := map[string]any{}
+		i++
+		for {
+			i = skipSpaces(text, i)
+			if i >= len(text) {
+				return nil, i, errYAMLFlowEnd
+			}
+			if text[i] == '}' {
+				return object, i + 1, nil
+			}
+			key, n, err := parseYAMLFlowValue(text, i, true)
+			if err != nil {
+				return nil, n, err
+			}
+			if i = skipSpaces(text, n); i >= len(text) || text[i] != ':' {
+				return nil, i, fmt.Errorf("expected : after the key %v", key)
+			}
+			value, n, err := parseYAMLFlowValue(text, i+1, true)
+			if err != nil {
+				return nil, n, err
+			}
+			object[fmt.Sprint(key)] = value
+			if i = skipSpaces(text, n); i < len(text) && text[i] == ',' {
+				i++
+			}
+		}
+	}
+	end := i
+	for end < len(text) {
+		c := text[end]
+		if inFlow && (c == ',' || c == ']' || c == '}' || c == ':' && (end+1 == len(text) || strings.ContainsRune(" ,]}", rune(text[end+1])))) {
+			break
+		}
+		if c == '#' && end > i && text[end-1] == ' ' {
+			break
+		}
+		end++
+	}
+	return yamlScalar(strings.TrimSpace(text[i:end])), end, nil
+}
+
+func skipSpaces(text string, i int) int {
+	for i < len(text) && text[i] == ' ' {
+		i++
+	}
+	return i
+}
+
+// parseYAMLQuoted parses the quoted scalar text starts with and returns it
+// with its length in text
+func parseYAMLQuoted(text string) (string, int, error) {
+	quote := text[0]
+	for i := 1; i < len(text); i++ {
+		switch {
+		case quote == '\'' && text[i] == '\'' && i+1 < len(text) && text[i+1] == '\'':
+			i++
+		case quote == '"' && text[i] == '\\':
+			i++
+		case text[i] == quote:
+			if quote == '\'' {
+				return strings.ReplaceAll(text[1:i], "''", "'"), i + 1, nil
+			}
+			var s string
+			if err := json.Unmarshal([]byte(text[:i+1]), &s); err != nil {
+				return "", 0, fmt.Errorf("invalid escape in %s", text[:i+1])
+			}
+			return s, i + 1, nil
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated quoted string")
+}
+
+var yamlNumber = regexp.MustCompile(`^-?(?:0|[1-9][0-9]*)(?:\.[0-9]+)?(?:[eE][-+]?[0-9]+)?$`)
+
+// yamlScalar resolves a plain scalar with the YAML 1.2 core schema, limited
+// to numbers JSON can represent
+func yamlScalar(s string) any {
+	switch s {
+	case "", "~", "null", "Null", "NULL":
+		return nil
+	case "true", "True", "TRUE":
+		return true
+	case "false", "False", "FALSE":
+		return false
+	}
+	if yamlNumber.MatchString(s) {
+		return json.Number(s)
+	}
+	return s
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestXMLValue(t *testing.T) {
+	value, err := xmlValue(`<?xml version="1.0"?>
+<order id="7">
+  <item sku="a1">Pen</item>
+  <item>Ink</item>
+  <note>Gift <b>wrap</b></note>
+  <total>3.50</total>
+</order>`, "order")
+	if err != nil {
+		t.Fatalf("Expected the document to parse, got %v", err)
+	}
+	got, _ := json.Marshal(value)
+	want := `{"order":{"@id":"7","item":[{"#text":"Pen","@sku":"a1"},"Ink"],"note":{"#text":"Gift","b":"wrap"},"total":"3.50"}}`
+	if string(got) != want {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+
+	for doc, want := range map[string]string{
+		`<a><b></a>`:          "not well-formed",
+		`<a/><b/>`:            "more than one root",
+		`hello <a/>`:          "text outside",
+		``:                    "not an XML document",
+		`<invoice></invoice>`: "root element must be <order>",
+	} {
+		root := ""
+		if strings.HasPrefix(doc, "<invoice") {
+			root = "order"
+		}
+		if _, err := xmlValue(doc, root); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected an error containing %q for %q, got %v", want, doc, err)
+		}
+	}
+}
+
+func TestYAMLValue(t *testing.T) {
+	value, err := yamlValue(`---
+# a person
+name: Ann Lee
+age: 42
+height: 1.7
+admin: false
+nickname: ~
+zip: "01234"
+motto: 'it''s fine' # a comment
+tags: [a, "b c", {k: v}]
+address:
+  city: Oslo
+  lines:
+  - Main St 1
+  - "Floor 2"
+pets:
+  - name: Rex
+    kind: dog
+  -
+    name: Tom
+bio: |
+  Line one
+  Line two
+
+summary: >-
+  folded
+  text
+`)
+	if err != nil {
+		t.Fatalf("Expected the document to parse, got %v", err)
+	}
+	got, _ := json.Marshal(value)
+	want := `{"address":{"city":"Oslo","lines":["Main St 1","Floor 2"]},"admin":false,"age":42,"bio":"Line one\nLine two\n","height":1.7,"motto":"it's fine","name":"Ann Lee","nickname":null,"pets":[{"kind":"dog","name":"Rex"},{"name":"Tom"}],"summary":"folded text","tags":["a","b c",{"k":"v"}],"zip":"01234"}`
+	if string(got) != want {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+
+	if value, err := yamlValue("- 1\n- [2, 3]\n"); err != nil {
+		t.Errorf("Expected a top-level sequence to parse, got %v", err)
+	} else if got, _ := json.Marshal(value); string(got) != `[1,[2,3]]` {
+		t.Errorf("Expected [1,[2,3]], got %s", got)
+	}
+
+	for doc, want := range map[string]string{
+		"a: 1\na: 2":         "duplicate key",
+		"a: 1\n   b: 2":      "unexpected indentation",
+		"a: [1, 2":           "unterminated",
+		"a: \"open":          "unterminated quoted string",
+		"a:\n\tb: 1":         "tabs",
+		"just text\nmore: 1": "unexpected",
+	} {
+		if _, err := yamlValue(doc); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected an error containing %q for %q, got %v", want, doc, err)
+		}
+	}
+}
+
+func TestProxyServer_YAMLResponseFormat(t *testing.T) {
+	client := &scriptedOpenAIClient{replies: []string{"name: [", "```yaml\nname: Ann\nage: 42\n```"}}
+	server := NewProxyServer(client)
+
+	w := chatRequestAs(server, nil, `{"model": "gpt-4o", "messages": [{"role": "user", "content": "Who?"}],
+		"response_format": {"type": "yaml", "json_schema": {"name": "person", "schema": {"type": "object", "required": ["name", "age"]}}}}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var resp ChatCompletionResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	message := resp.Choices[0].Message
+	if message.Content != "name: Ann\nage: 42" {
+		t.Errorf("Expected the raw YAML without its code fence, got %q", message.Content)
+	}
+	if string(message.Parsed) != `{"age":42,"name":"Ann"}` {
+		t.Errorf("Expected the parsed reply, got %s", message.Parsed)
+	}
+	if resp.Metadata == nil || resp.Metadata.OutputRetries != 1 {
+		t.Errorf("Expected one retry for the invalid YAML, got %+v", resp.Metadata)
+	}
+	first := client.requests[0]
+	if first.ResponseFormat != nil {
+		t.Error("Expected the yaml response format to be emulated")
+	}
+	if last := first.Messages[len(first.Messages)-1]; last.Role != "system" || !strings.Contains(last.Content, "YAML") {
+		t.Errorf("Expected YAML instructions, got %+v", last)
+	}
+}
+
+func TestProxyServer_XMLResponseFormat(t *testing.T) {
+	resp := *createTestChatCompletionResponse()
+	resp.Choices = append([]Choice(nil), resp.Choices...)
+	resp.Choices[0].Message.Content = `<answer lang="en">Hello</answer>`
+	client := &recordingOpenAIClient{MockOpenAIClient: MockOpenAIClient{response: &resp}}
+	server := NewProxyServer(client)
+
+	body := `{"model": "gpt-4o", "messages": [{"role": "user", "content": "Hi"}], "response_format": {"type": "xml", "root": "answer"}}`
+	if !server.mustDecode([]byte(body)) {
+		t.Error("Expected the xml response format to skip the passthrough path")
+	}
+	w := chatRequestAs(server, nil, body)
+	var out ChatCompletionResponse
+	json.Unmarshal(w.Body.Bytes(), &out)
+	if string(out.Choices[0].Message.Parsed) != `{"answer":{"#text":"Hello","@lang":"en"}}` {
+		t.Errorf("Expected the parsed reply, got %s", out.Choices[0].Message.Parsed)
+	}
+	if last := client.last.Messages[len(client.last.Messages)-1]; !strings.Contains(last.Content, "<answer>") {
+		t.Errorf("Expected the root element in the instructions, got %+v", last)
+	}
+}
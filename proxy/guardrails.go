@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+)
+
+// errGuardrailBlocked is wrapped by errors for requests a guardrail profile
+// refuses
+var errGuardrailBlocked = errors.New("request blocked by guardrail profile")
+
+// GuardrailProfile is a named set of checks applied to the messages of
+// requests for the virtual models that use it
+type GuardrailProfile struct {
+	ID string `json:"id"`
+	// RedactPII replaces personal data in messages with placeholders before
+	// they are sent upstream
+	RedactPII bool `json:"redact_pii,omitempty"`
+	// BlockPatterns are regular expressions; requests with a message
+	// matching any of them are rejected
+	BlockPatterns []string `json:"block_patterns,omitempty"`
+
+	blocked []*regexp.Regexp
+}
+
+// compile validates the profile and prepares its patterns
+func (p *GuardrailProfile) compile() error {
+	p.blocked = make([]*regexp.Regexp, 0, len(p.BlockPatterns))
+	for _, pattern := range p.BlockPatterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid block pattern %q: %w", pattern, err)
+		}
+		p.blocked = append(p.blocked, re)
+	}
+	return nil
+}
+
+// apply checks messages against the profile and returns them as they
+// should be sent upstream
+func (p GuardrailProfile) apply(messages []Message) ([]Message, error) {
+	for _, m := range messages {
+		for i, re := range p.blocked {
+			if re.MatchString(m.Content) {
+				return nil, fmt.Errorf("%w %s (pattern %d)", errGuardrailBlocked, p.ID, i+1)
+			}
+		}
+	}
+	if p.RedactPII {
+		messages = redactMessages(messages)
+	}
+	return messages, nil
+}
+
+func (s *ProxyServer) adminGuardrailHandler() http.Handler {
+	return resourceHandler[GuardrailProfile]{
+		lock: s.guardrails.lockWrites,
+		get: func(id string) (GuardrailProfile, string, bool) {
+			profile, ok := s.guardrails.Get(id)
+			return profile, etagFor(profile), ok
+		},
+		put: func(id string, profile GuardrailProfile, _ *GuardrailProfile) (bool, error) {
+			if profile.ID != "" && profile.ID != id {
+				return false, fmt.Errorf("id in body does not match id in path")
+			}
+			profile.ID = id
+			if err := profile.compile(); err != nil {
+				return false, err
+			}
+			return s.guardrails.Put(id, profile), nil
+		},
+		remove: s.guardrails.Delete,
+		view:   func(profile GuardrailProfile) any { return profile },
+	}
+}
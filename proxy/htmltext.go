@@ -0,0 +1,158 @@
+package main
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+// htmlSkipped are elements whose content is not text to read
+var htmlSkipped = map[string]bool{
+	"script": true, "style": true, "noscript": true, "template": true,
+	"svg": true, "title": true, "iframe": true, "object": true, "select": true,
+}
+
+// htmlBlocks are elements that start on a new line, and htmlParagraphs
+// those also set off by a blank line
+var (
+	htmlBlocks = map[string]bool{
+		"div": true, "tr": true, "dt": true, "dd": true, "figcaption": true,
+		"nav": true, "form": true, "main": true, "aside": true, "caption": true,
+	}
+	htmlParagraphs = map[string]bool{
+		"p": true, "ul": true, "ol": true, "dl": true, "table": true, "blockquote": true,
+		"pre": true, "section": true, "article": true, "header": true, "footer": true, "figure": true,
+		"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	}
+)
+
+var (
+	htmlTitle  = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+	blankLines = regexp.MustCompile(`\n{3,}`)
+)
+
+// htmlToText extracts the title and the readable text of an HTML document:
+// scripts, styles and markup are dropped, entities decoded and whitespace
+// collapsed except in <pre>, with blocks on lines of their own, headings
+// marked with # and list items with -. It is lenient like a browser, not a
+// full HTML parser.
+func htmlToText(doc string) (title, text string) {
+	if m := htmlTitle.FindStringSubmatch(doc); m != nil {
+		title = strings.Join(strings.Fields(html.UnescapeString(m[1])), " ")
+	}
+	var out strings.Builder
+	newline := func(n int) {
+		s := out.String()
+		trailing := len(s) - len(strings.TrimRight(s, "\n"))
+		if out.Len() > 0 && trailing < n {
+			out.WriteString(strings.Repeat("\n", n-trailing))
+		}
+	}
+	write := func(s string, pre bool) {
+		if pre {
+			out.WriteString(s)
+			return
+		}
+		for _, r := range s {
+			if r == ' ' || r == '\t' || r == '\n' || r == '\r' || r == '\f' {
+				// One space between words, none at the start of a line
+				if str := out.String(); str != "" && !strings.HasSuffix(str, " ") && !strings.HasSuffix(str, "\n") {
+					out.WriteByte(' ')
+				}
+				continue
+			}
+			out.WriteRune(r)
+		}
+	}
+
+	skip, pre := "", 0
+	for i := 0; i < len(doc); {
+		if doc[i] != '<' || !startsTag(doc[i+1:]) {
+			end := strings.IndexByte(doc[i+1:], '<') + 1
+			if end == 0 {
+				end = len(doc) - i
+			}
+			if skip == "" {
+				write(html.UnescapeString(doc[i:i+end]), pre > 0)
+			}
+			i += end
+			continue
+		}
+		if strings.HasPrefix(doc[i:], "<!--") {
+			end := strings.Index(doc[i+4:], "-->")
+			if end < 0 {
+				break
+			}
+			i += 4 + end + 3
+			continue
+		}
+		end := strings.IndexByte(doc[i:], '>')
+		if end < 0 {
+			break
+		}
+		tag := doc[i+1 : i+end]
+		i += end + 1
+
+		closing := strings.HasPrefix(tag, "/")
+		name := strings.ToLower(strings.TrimPrefix(tag, "/"))
+		if n := strings.IndexFunc(name, func(r rune) bool { return !('a' <= r && r <= 'z' || '0' <= r && r <= '9') }); n >= 0 {
+			name = name[:n]
+		}
+		if skip != "" {
+			if closing && name == skip {
+				skip = ""
+			}
+			continue
+		}
+		switch {
+		case name == "":
+			// A doctype or processing instruction
+		case htmlSkipped[name]:
+			if !closing && !strings.HasSuffix(tag, "/") {
+				skip = name
+			}
+		case name == "br" || name == "hr":
+			newline(1)
+		case name == "li":
+			newline(1)
+			if !closing {
+				out.WriteString("- ")
+			}
+		case name == "td" || name == "th":
+			if closing {
+				write(" ", false)
+			}
+		case htmlParagraphs[name]:
+			newline(2)
+			if name == "pre" {
+				if closing {
+					pre = max(pre-1, 0)
+				} else {
+					pre++
+				}
+			}
+			if !closing && len(name) == 2 && name[0] == 'h' {
+				out.WriteString(strings.Repeat("#", int(name[1]-'0')) + " ")
+			}
+		case htmlBlocks[name]:
+			newline(1)
+		}
+	}
+
+	lines := strings.Split(out.String(), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t")
+	}
+	text = blankLines.ReplaceAllString(strings.Join(lines, "\n"), "\n\n")
+	return title, strings.Trim(text, "\n")
+}
+
+// startsTag reports whether what follows a < makes it markup rather than
+// text
+func startsTag(s string) bool {
+	if s == "" {
+		return false
+	}
+	c := s[0] | 0x20
+	return 'a' <= c && c <= 'z' || s[0] == '/' || s[0] == '!' || s[0] == '?'
+}
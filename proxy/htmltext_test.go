@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestHTMLToText(t *testing.T) {
+	doc := `<!DOCTYPE html>
+<html><head><title>Refunds &amp; returns</title>
+<style>body { color: red }</style><script>var x = "<p>not text</p>";</script></head>
+<body>
+<!-- navigation -->
+<h1>Refund   policy</h1>
+<p>Refunds are paid
+   within <b>14&nbsp;days</b>.<br>Contact us.</p>
+<ul><li>Store credit</li><li>Cash</li></ul>
+<table><tr><th>Item</th><th>Days</th></tr><tr><td>Shoes</td><td>30</td></tr></table>
+<pre>line 1
+  indented</pre>
+<svg/><p>After the icon</p>
+</body></html>`
+	title, text := htmlToText(doc)
+	if title != "Refunds & returns" {
+		t.Errorf("Expected the title, got %q", title)
+	}
+	want := "# Refund policy\n\nRefunds are paid within 14 days.\nContact us.\n\n- Store credit\n- Cash\n\nItem Days\nShoes 30\n\nline 1\n  indented\n\nAfter the icon"
+	if text != want {
+		t.Errorf("Expected:\n%s\ngot:\n%s", want, text)
+	}
+
+	if _, text := htmlToText("Plain <i>text</i>, 1 < 2 &lt; 3 and <unclosed"); text != "Plain text, 1 < 2 < 3 and" {
+		t.Errorf("Expected a lone < kept as text, got %q", text)
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// End users of consumer apps see the proxy's errors as they are, so error
+// messages are translated into the language the client asks for with
+// Accept-Language. Catalogs map English messages to their translation, one
+// JSON file per language; messages with values in them are matched as
+// templates, with %s (or %d, %v, %q) standing for the values. Messages
+// missing from a catalog stay in English, as do responses to clients that
+// do not ask for another language.
+
+//go:embed locales
+var builtinLocales embed.FS
+
+// maxLocalizedErrorBody bounds the error bodies held back for translation;
+// larger ones are passed on as they are
+const maxLocalizedErrorBody = 64 << 10
+
+// messageVerb matches the placeholders of catalog messages
+var messageVerb = regexp.MustCompile(`%(\[\d+\])?[sdvq]`)
+
+type messageTemplate struct {
+	pattern     *regexp.Regexp
+	translation string
+}
+
+// messageCatalog is the translations of one language
+type messageCatalog struct {
+	exact     map[string]string
+	templates []messageTemplate
+}
+
+// errorCatalog holds the translations of error messages by language tag
+type errorCatalog struct {
+	languages map[string]*messageCatalog
+}
+
+// builtinErrorCatalog is the catalog shipped with the proxy
+var builtinErrorCatalog = func() *errorCatalog {
+	c, err := newErrorCatalog(builtinLocaleFiles())
+	if err != nil {
+		panic(err)
+	}
+	return c
+}()
+
+func builtinLocaleFiles() fs.FS {
+	locales, _ := fs.Sub(builtinLocales, "locales")
+	return locales
+}
+
+// errorCatalogFromEnv adds the catalogs of PROXY_LOCALES_DIR, which can add
+// languages or override messages, to the built-in ones
+func errorCatalogFromEnv(getenv func(string) string) (*errorCatalog, error) {
+	dir := getenv("PROXY_LOCALES_DIR")
+	if dir == "" {
+		return builtinErrorCatalog, nil
+	}
+	return newErrorCatalog(builtinLocaleFiles(), os.DirFS(dir))
+}
+
+// newErrorCatalog reads the <language>.json files of each of dirs in turn,
+// later ones adding to and overriding the messages of earlier ones
+func newErrorCatalog(dirs ...fs.FS) (*errorCatalog, error) {
+	messages := make(map[string]map[string]string)
+	for _, fsys := range dirs {
+		files, err := fs.Glob(fsys, "*.json")
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			data, err := fs.ReadFile(fsys, file)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read error catalog: %w", err)
+			}
+			var catalog map[string]string
+			if err := json.Unmarshal(data, &catalog); err != nil {
+				return nil, fmt.Errorf("failed to parse error catalog %s: %w", file, err)
+			}
+			lang := strings.ToLower(strings.TrimSuffix(path.Base(file), ".json"))
+			if messages[lang] == nil {
+				messages[lang] = make(map[string]string)
+			}
+			for message, translation := range catalog {
+				messages[lang][message] = translation
+			}
+		}
+	}
+
+	c := &errorCatalog{languages: make(map[string]*messageCatalog)}
+	for lang, catalog := range messages {
+		compiled := &messageCatalog{exact: make(map[string]string)}
+		for message, translation := range catalog {
+			verbs := messageVerb.FindAllStringIndex(message, -1)
+			if len(messageVerb.FindAllString(translation, -1)) > len(verbs) {
+				return nil, fmt.Errorf("error catalog %s: translation of %q has more values than the message", lang, message)
+			}
+			if len(verbs) == 0 {
+				compiled.exact[message] = translation
+				continue
+			}
+			var pattern strings.Builder
+			pattern.WriteString("^")
+			last := 0
+			for _, verb := range verbs {
+				pattern.WriteString(regexp.QuoteMeta(message[last:verb[0]]))
+				pattern.WriteString("(.+?)")
+				last = verb[1]
+			}
+			pattern.WriteString(regexp.QuoteMeta(message[last:]) + "$")
+			compiled.templates = append(compiled.templates, messageTemplate{
+				pattern: regexp.MustCompile(pattern.String()),
+				// Values are inserted as the text they were formatted to
+				translation: messageVerb.ReplaceAllString(translation, "%${1}s"),
+			})
+		}
+		// The most specific templates are tried first
+		sort.Slice(compiled.templates, func(i, j int) bool {
+			a, b := compiled.templates[i].pattern.String(), compiled.templates[j].pattern.String()
+			return len(a) > len(b) || len(a) == len(b) && a < b
+		})
+		c.languages[lang] = compiled
+	}
+	return c, nil
+}
+
+// Language returns the catalog language best matching an Accept-Language
+// header, or "" to answer in English
+func (c *errorCatalog) Language(header string) string {
+	if c == nil || header == "" {
+		return ""
+	}
+	type weighted struct {
+		tag string
+		q   float64
+	}
+	var ranges []weighted
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			var err error
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if tag = strings.ToLower(strings.TrimSpace(tag)); tag != "" && q > 0 {
+			ranges = append(ranges, weighted{tag, q})
+		}
+	}
+	sort.SliceStable(ranges, func(i, j int) bool { return ranges[i].q > ranges[j].q })
+	for _, r := range ranges {
+		primary, _, _ := strings.Cut(r.tag, "-")
+		if primary == "en" || r.tag == "*" {
+			return ""
+		}
+		if c.languages[r.tag] != nil {
+			return r.tag
+		}
+		if c.languages[primary] != nil {
+			return primary
+		}
+	}
+	return ""
+}
+
+// Translate returns message in lang, or message itself if the catalog has
+// no translation for it
+func (c *errorCatalog) Translate(lang, message string) string {
+	catalog := c.languages[lang]
+	if catalog == nil {
+		return message
+	}
+	if translation, ok := catalog.exact[message]; ok {
+		return translation
+	}
+	for _, t := range catalog.templates {
+		match := t.pattern.FindStringSubmatch(message)
+		if match == nil {
+			continue
+		}
+		values := make([]any, len(match)-1)
+		for i, v := range match[1:] {
+			values[i] = v
+		}
+		return fmt.Sprintf(t.translation, values...)
+	}
+	return message
+}
+
+// translateBody translates the message of a plain text or JSON error body
+func (c *errorCatalog) translateBody(lang, contentType string, body []byte) []byte {
+	if strings.HasPrefix(contentType, "text/plain") {
+		message := strings.TrimSuffix(string(body), "\n")
+		if translated := c.Translate(lang, message); translated != message {
+			return []byte(translated + "\n")
+		}
+		return body
+	}
+	var resp map[string]any
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return body
+	}
+	detail, _ := resp["error"].(map[string]any)
+	message, _ := detail["message"].(string)
+	translated := c.Translate(lang, message)
+	if translated == message {
+		return body
+	}
+	detail["message"] = translated
+	var out bytes.Buffer
+	if err := json.NewEncoder(&out).Encode(resp); err != nil {
+		return body
+	}
+	return out.Bytes()
+}
+
+// withLocalizedErrors translates the error responses of next into the
+// language of the request
+func (s *ProxyServer) withLocalizedErrors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lang := s.errorCatalog.Language(r.Header.Get("Accept-Language"))
+		if lang == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		lw := &localizingWriter{ResponseWriter: w, catalog: s.errorCatalog, lang: lang}
+		next.ServeHTTP(lw, r)
+		lw.finish()
+	})
+}
+
+// localizingWriter holds back error bodies until the handler is done so
+// their message can be translated
+type localizingWriter struct {
+	http.ResponseWriter
+	catalog *errorCatalog
+	lang    string
+
+	wroteHeader bool
+	status      int
+	// held is the error body being held back, if any
+	held *bytes.Buffer
+}
+
+func (lw *localizingWriter) WriteHeader(status int) {
+	if lw.wroteHeader {
+		return
+	}
+	lw.wroteHeader = true
+	contentType := lw.Header().Get("Content-Type")
+	if status >= 400 && (strings.HasPrefix(contentType, "text/plain") || strings.HasPrefix(contentType, "application/json")) {
+		lw.status = status
+		lw.held = new(bytes.Buffer)
+		return
+	}
+	lw.ResponseWriter.WriteHeader(status)
+}
+
+func (lw *localizingWriter) Write(p []byte) (int, error) {
+	if !lw.wroteHeader {
+		lw.WriteHeader(http.StatusOK)
+	}
+	if lw.held == nil {
+		return lw.ResponseWriter.Write(p)
+	}
+	if lw.held.Len()+len(p) > maxLocalizedErrorBody {
+		// Too large to be a message; pass it on untranslated
+		lw.ResponseWriter.WriteHeader(lw.status)
+		held := lw.held
+		lw.held = nil
+		if _, err := lw.ResponseWriter.Write(held.Bytes()); err != nil {
+			return 0, err
+		}
+		return lw.ResponseWriter.Write(p)
+	}
+	return lw.held.Write(p)
+}
+
+// FlushError flushes responses that are not held back
+func (lw *localizingWriter) FlushError() error {
+	if !lw.wroteHeader {
+		lw.WriteHeader(http.StatusOK)
+	}
+	if lw.held != nil {
+		return nil
+	}
+	return http.NewResponseController(lw.ResponseWriter).Flush()
+}
+
+func (lw *localizingWriter) Unwrap() http.ResponseWriter {
+	return lw.ResponseWriter
+}
+
+// finish writes the held back error body, translated
+func (lw *localizingWriter) finish() {
+	if lw.held == nil {
+		return
+	}
+	body := lw.catalog.translateBody(lw.lang, lw.Header().Get("Content-Type"), lw.held.Bytes())
+	header := lw.Header()
+	header.Del("Content-Length")
+	header.Add("Vary", "Accept-Language")
+	if !bytes.Equal(body, lw.held.Bytes()) {
+		header.Set("Content-Language", lw.lang)
+	}
+	lw.ResponseWriter.WriteHeader(lw.status)
+	lw.ResponseWriter.Write(body)
+}
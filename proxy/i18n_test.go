@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestErrorCatalog_Language(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"", ""},
+		{"de-DE,de;q=0.9,en;q=0.8", "de"},
+		{"en-US,de;q=0.5", ""},
+		{"pt-BR", "pt"},
+		{"nl, fr;q=0.7", "fr"},
+		{"fr;q=0.2, ja;q=0.8", "ja"},
+		{"de;q=0", ""},
+		{"*", ""},
+	}
+	for _, tt := range tests {
+		if got := builtinErrorCatalog.Language(tt.header); got != tt.want {
+			t.Errorf("Language(%q): expected %q, got %q", tt.header, tt.want, got)
+		}
+	}
+}
+
+func TestErrorCatalog_Translate(t *testing.T) {
+	tests := []struct {
+		lang, message, want string
+	}{
+		{"de", "Invalid or missing API key", "Ungültiger oder fehlender API-Schlüssel"},
+		{"es", "API key is not allowed to use model gpt-4o", "La clave de API no tiene permiso para usar el modelo gpt-4o"},
+		{"fr", "request blocked by guardrail profile strict (pattern 2)", "Requête bloquée par le profil de protection strict (motif 2)"},
+		{"de", "Something nobody translated", "Something nobody translated"},
+		{"xx", "Invalid or missing API key", "Invalid or missing API key"},
+	}
+	for _, tt := range tests {
+		if got := builtinErrorCatalog.Translate(tt.lang, tt.message); got != tt.want {
+			t.Errorf("Translate(%s, %q): expected %q, got %q", tt.lang, tt.message, tt.want, got)
+		}
+	}
+}
+
+func TestErrorCatalog_OverridesFromDirectory(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "de.json"), []byte(`{"Rate limit exceeded": "Zu viele Anfragen"}`), 0o600)
+	os.WriteFile(filepath.Join(dir, "nl.json"), []byte(`{"API key is not allowed to use model %s": "Model %[1]s is niet toegestaan voor deze API-sleutel"}`), 0o600)
+	catalog, err := errorCatalogFromEnv(func(string) string { return dir })
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if got := catalog.Translate("de", "Rate limit exceeded"); got != "Zu viele Anfragen" {
+		t.Errorf("Expected the override, got %q", got)
+	}
+	if got := catalog.Translate("de", "Not found"); got != "Nicht gefunden" {
+		t.Errorf("Expected the built-in messages to remain, got %q", got)
+	}
+	if got := catalog.Translate("nl", "API key is not allowed to use model gpt-4o"); got != "Model gpt-4o is niet toegestaan voor deze API-sleutel" {
+		t.Errorf("Expected the added language, got %q", got)
+	}
+
+	os.WriteFile(filepath.Join(dir, "nl.json"), []byte(`{"Not found": "%s niet gevonden"}`), 0o600)
+	if _, err := errorCatalogFromEnv(func(string) string { return dir }); err == nil {
+		t.Error("Expected a translation with values the message does not have to be rejected")
+	}
+}
+
+func TestProxyServer_LocalizedErrors(t *testing.T) {
+	server := NewProxyServer(&MockOpenAIClient{shouldError: true, error: errors.New("upstream unavailable")})
+	server.keys = createTestKeyStore(t)
+	handler := server.Handler()
+	do := func(secret, language, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+secret)
+		req.Header.Set("Accept-Language", language)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do("sk-mini", "de-CH, en;q=0.5", `{"model": "gpt-4o", "messages": [{"role": "user", "content": "Hi"}]}`)
+	if w.Code != http.StatusForbidden || w.Body.String() != "Der API-Schlüssel darf das Modell gpt-4o nicht verwenden\n" {
+		t.Errorf("Expected the error in German, got %d %q", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Content-Language") != "de" || w.Header().Get("Vary") != "Accept-Language" {
+		t.Errorf("Expected Content-Language and Vary headers, got %v", w.Header())
+	}
+
+	w = do("sk-mini", "en-US", `{"model": "gpt-4o", "messages": [{"role": "user", "content": "Hi"}]}`)
+	if w.Body.String() != "API key is not allowed to use model gpt-4o\n" {
+		t.Errorf("Expected the error in English, got %q", w.Body.String())
+	}
+
+	w = do("sk-full", "es", `{"model": "gpt-4o", "messages": []}`)
+	if w.Code != http.StatusBadRequest || w.Body.String() != "El campo messages es obligatorio y no puede estar vacío\n" {
+		t.Errorf("Expected the error in Spanish, got %d %q", w.Code, w.Body.String())
+	}
+
+	w = do("sk-full", "ja", `{"model": "gpt-4o", "messages": [{"role": "user", "content": "Hi"}]}`)
+	if w.Body.String() != "OpenAI API エラー: upstream unavailable\n" {
+		t.Errorf("Expected the upstream error in Japanese, got %q", w.Body.String())
+	}
+}
+
+func TestErrorCatalog_TranslatesJSONErrors(t *testing.T) {
+	body := []byte(`{"error":{"message":"The request was cancelled","type":"cancelled","code":"request_cancelled"}}`)
+	var resp ErrorResponse
+	if err := json.Unmarshal(builtinErrorCatalog.translateBody("fr", "application/json", body), &resp); err != nil {
+		t.Fatalf("Expected JSON, got %v", err)
+	}
+	if resp.Error.Message != "La requête a été annulée" || resp.Error.Code != "request_cancelled" {
+		t.Errorf("Expected the message to be translated and the rest kept, got %+v", resp.Error)
+	}
+}
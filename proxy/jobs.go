@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Locker grants a named, expiring lease to one holder at a time. It backs
+// leader election when several replicas of the proxy run side by side.
+type Locker interface {
+	// Acquire takes the lease for holder, or renews it if holder already
+	// owns it, and reports whether holder owns it afterwards
+	Acquire(ctx context.Context, name, holder string, ttl time.Duration) (bool, error)
+	// Release gives up the lease if holder owns it
+	Release(ctx context.Context, name, holder string) error
+}
+
+// localLocker always grants the lease; it is used for single-replica
+// deployments where there is nobody to coordinate with
+type localLocker struct{}
+
+func (localLocker) Acquire(ctx context.Context, name, holder string, ttl time.Duration) (bool, error) {
+	return true, nil
+}
+
+func (localLocker) Release(ctx context.Context, name, holder string) error {
+	return nil
+}
+
+// leaderElector keeps trying to hold a lease and reports whether this
+// replica currently leads. Leadership is only assumed until the last
+// successful renewal's TTL runs out, so a replica that loses contact with
+// the lock backend steps down before another one can take over.
+type leaderElector struct {
+	locker   Locker
+	name     string
+	identity string
+	ttl      time.Duration
+	now      func() time.Time
+
+	mu          sync.Mutex
+	leaderUntil time.Time
+}
+
+func newLeaderElector(locker Locker, name, identity string, ttl time.Duration) *leaderElector {
+	return &leaderElector{locker: locker, name: name, identity: identity, ttl: ttl, now: time.Now}
+}
+
+func (e *leaderElector) IsLeader() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.now().Before(e.leaderUntil)
+}
+
+// tryAcquire makes one acquisition or renewal attempt
+func (e *leaderElector) tryAcquire(ctx context.Context) {
+	start := e.now()
+	ok, err := e.locker.Acquire(ctx, e.name, e.identity, e.ttl)
+	if err != nil {
+		log.Printf("Leader election for %s failed: %v", e.name, err)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	wasLeader := e.now().Before(e.leaderUntil)
+	if ok && err == nil {
+		e.leaderUntil = start.Add(e.ttl)
+		if !wasLeader {
+			log.Printf("Acquired leadership of %s as %s", e.name, e.identity)
+		}
+	} else if err == nil {
+		e.leaderUntil = time.Time{}
+		if wasLeader {
+			log.Printf("Lost leadership of %s", e.name)
+		}
+	}
+}
+
+// Run renews the lease every third of its TTL until ctx is cancelled, then
+// releases it so another replica can take over immediately
+func (e *leaderElector) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.ttl / 3)
+	defer ticker.Stop()
+	for {
+		e.tryAcquire(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			e.mu.Lock()
+			e.leaderUntil = time.Time{}
+			e.mu.Unlock()
+			releaseCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			if err := e.locker.Release(releaseCtx, e.name, e.identity); err != nil {
+				log.Printf("Failed to release leadership of %s: %v", e.name, err)
+			}
+			cancel()
+			return
+		}
+	}
+}
+
+// JobStatus describes a background job for the admin API
+type JobStatus struct {
+	Name      string    `json:"name"`
+	Interval  string    `json:"interval"`
+	Singleton bool      `json:"singleton"`
+	Runs      int       `json:"runs"`
+	LastRun   time.Time `json:"last_run,omitempty"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+type job struct {
+	name      string
+	interval  time.Duration
+	singleton bool
+	run       func(ctx context.Context) error
+
+	mu      sync.Mutex
+	runs    int
+	lastRun time.Time
+	lastErr string
+}
+
+// jobRunner runs periodic background jobs. Singleton jobs touch state
+// shared by all replicas and only run on the elected leader; other jobs
+// maintain per-replica state and run everywhere.
+type jobRunner struct {
+	elector *leaderElector
+
+	mu   sync.Mutex
+	jobs []*job
+}
+
+func newJobRunner(elector *leaderElector) *jobRunner {
+	return &jobRunner{elector: elector}
+}
+
+func (r *jobRunner) Add(name string, interval time.Duration, singleton bool, run func(ctx context.Context) error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.jobs = append(r.jobs, &job{name: name, interval: interval, singleton: singleton, run: run})
+}
+
+// runOnce executes j unless it is a singleton and this replica is not the
+// leader, and reports whether it ran
+func (r *jobRunner) runOnce(ctx context.Context, j *job) bool {
+	if j.singleton && !r.elector.IsLeader() {
+		return false
+	}
+	err := j.run(ctx)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.runs++
+	j.lastRun = time.Now()
+	j.lastErr = ""
+	if err != nil {
+		j.lastErr = err.Error()
+		log.Printf("Job %s failed: %v", j.name, err)
+	}
+	return true
+}
+
+// Start launches the leader elector and one ticker per job; everything
+// stops when ctx is cancelled
+func (r *jobRunner) Start(ctx context.Context) {
+	go r.elector.Run(ctx)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, j := range r.jobs {
+		go func(j *job) {
+			ticker := time.NewTicker(j.interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					r.runOnce(ctx, j)
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(j)
+	}
+}
+
+func (r *jobRunner) Status() []JobStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	statuses := make([]JobStatus, 0, len(r.jobs))
+	for _, j := range r.jobs {
+		j.mu.Lock()
+		statuses = append(statuses, JobStatus{
+			Name:      j.name,
+			Interval:  j.interval.String(),
+			Singleton: j.singleton,
+			Runs:      j.runs,
+			LastRun:   j.lastRun,
+			LastError: j.lastErr,
+		})
+		j.mu.Unlock()
+	}
+	return statuses
+}
+
+// handleAdminJobs reports the background jobs and whether this replica is
+// the leader
+func (s *ProxyServer) handleAdminJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"identity": s.jobs.elector.identity,
+		"leader":   s.jobs.elector.IsLeader(),
+		"jobs":     s.jobs.Status(),
+	})
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Locker for tests whose answers are controlled by the test
+type fakeLocker struct {
+	mu      sync.Mutex
+	holder  string
+	err     error
+	release int
+}
+
+func (l *fakeLocker) Acquire(ctx context.Context, name, holder string, ttl time.Duration) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err != nil {
+		return false, l.err
+	}
+	if l.holder == "" {
+		l.holder = holder
+	}
+	return l.holder == holder, nil
+}
+
+func (l *fakeLocker) Release(ctx context.Context, name, holder string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.holder == holder {
+		l.holder = ""
+		l.release++
+	}
+	return nil
+}
+
+func TestLeaderElector_SingleLeader(t *testing.T) {
+	locker := &fakeLocker{}
+	a := newLeaderElector(locker, "proxy", "a", time.Minute)
+	b := newLeaderElector(locker, "proxy", "b", time.Minute)
+
+	a.tryAcquire(context.Background())
+	b.tryAcquire(context.Background())
+
+	if !a.IsLeader() {
+		t.Error("Expected a to be leader")
+	}
+	if b.IsLeader() {
+		t.Error("Expected b not to be leader while a holds the lease")
+	}
+
+	locker.Release(context.Background(), "proxy", "a")
+	b.tryAcquire(context.Background())
+	if !b.IsLeader() {
+		t.Error("Expected b to take over after a released the lease")
+	}
+}
+
+func TestLeaderElector_StepsDownWhenRenewalsFail(t *testing.T) {
+	locker := &fakeLocker{}
+	now := time.Unix(1700000000, 0)
+	elector := newLeaderElector(locker, "proxy", "a", 15*time.Second)
+	elector.now = func() time.Time { return now }
+
+	elector.tryAcquire(context.Background())
+	if !elector.IsLeader() {
+		t.Fatal("Expected elector to be leader")
+	}
+
+	// While the backend is unreachable leadership lasts until the lease
+	// would have expired for everyone else
+	locker.err = errors.New("connection refused")
+	now = now.Add(10 * time.Second)
+	elector.tryAcquire(context.Background())
+	if !elector.IsLeader() {
+		t.Error("Expected elector to stay leader before its lease runs out")
+	}
+
+	now = now.Add(6 * time.Second)
+	if elector.IsLeader() {
+		t.Error("Expected elector to step down once its lease ran out")
+	}
+}
+
+func TestLeaderElector_ReleasesOnShutdown(t *testing.T) {
+	locker := &fakeLocker{}
+	elector := newLeaderElector(locker, "proxy", "a", time.Minute)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		elector.Run(ctx)
+		close(done)
+	}()
+	for !elector.IsLeader() {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	if elector.IsLeader() || locker.release != 1 {
+		t.Error("Expected lease to be released on shutdown")
+	}
+}
+
+func TestJobRunner_SingletonOnlyOnLeader(t *testing.T) {
+	locker := &fakeLocker{holder: "someone-else"}
+	runner := newJobRunner(newLeaderElector(locker, "proxy", "a", time.Minute))
+
+	var localRuns, singletonRuns int
+	runner.Add("local", time.Minute, false, func(ctx context.Context) error { localRuns++; return nil })
+	runner.Add("singleton", time.Minute, true, func(ctx context.Context) error { singletonRuns++; return nil })
+
+	runner.elector.tryAcquire(context.Background())
+	for _, j := range runner.jobs {
+		runner.runOnce(context.Background(), j)
+	}
+	if localRuns != 1 || singletonRuns != 0 {
+		t.Errorf("Expected only the local job to run on a follower, got local=%d singleton=%d", localRuns, singletonRuns)
+	}
+
+	locker.holder = ""
+	runner.elector.tryAcquire(context.Background())
+	for _, j := range runner.jobs {
+		runner.runOnce(context.Background(), j)
+	}
+	if localRuns != 2 || singletonRuns != 1 {
+		t.Errorf("Expected both jobs to run on the leader, got local=%d singleton=%d", localRuns, singletonRuns)
+	}
+}
+
+func TestJobRunner_Status(t *testing.T) {
+	runner := newJobRunner(newLeaderElector(localLocker{}, "proxy", "a", time.Minute))
+	runner.Add("broken", time.Minute, false, func(ctx context.Context) error { return errors.New("boom") })
+	runner.runOnce(context.Background(), runner.jobs[0])
+
+	status := runner.Status()
+	if len(status) != 1 || status[0].Runs != 1 || status[0].LastError != "boom" {
+		t.Errorf("Unexpected job status: %+v", status)
+	}
+}
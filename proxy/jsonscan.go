@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// A minimal JSON scanner for the passthrough path. It locates top-level
+// members of an object by byte offsets without decoding anything, so the
+// proxy can read the few fields it needs (model, messages, usage) and
+// forward everything else untouched. Input is expected to be valid JSON,
+// checked separately with json.Valid.
+
+// scanObject calls fn for each top-level member of the object in data with
+// the member's key and the offsets of its value. Keys with escapes are
+// decoded, so "mod\u0065l" is seen as model just as upstreams see it.
+// Scanning stops early when fn returns false.
+func scanObject(data []byte, fn func(key []byte, start, end int) bool) error {
+	i := skipSpace(data, 0)
+	if i >= len(data) || data[i] != '{' {
+		return fmt.Errorf("expected a JSON object")
+	}
+	i = skipSpace(data, i+1)
+	if i < len(data) && data[i] == '}' {
+		return nil
+	}
+	for i < len(data) {
+		if data[i] != '"' {
+			return fmt.Errorf("expected object key at offset %d", i)
+		}
+		keyEnd, err := skipString(data, i)
+		if err != nil {
+			return err
+		}
+		key := data[i+1 : keyEnd-1]
+		if bytes.IndexByte(key, '\\') >= 0 {
+			var decoded string
+			if err := json.Unmarshal(data[i:keyEnd], &decoded); err != nil {
+				return fmt.Errorf("invalid object key at offset %d", i)
+			}
+			key = []byte(decoded)
+		}
+		i = skipSpace(data, keyEnd)
+		if i >= len(data) || data[i] != ':' {
+			return fmt.Errorf("expected ':' at offset %d", i)
+		}
+		start := skipSpace(data, i+1)
+		end, err := skipValue(data, start)
+		if err != nil {
+			return err
+		}
+		if !fn(key, start, end) {
+			return nil
+		}
+		i = skipSpace(data, end)
+		if i >= len(data) {
+			break
+		}
+		switch data[i] {
+		case ',':
+			i = skipSpace(data, i+1)
+		case '}':
+			return nil
+		default:
+			return fmt.Errorf("expected ',' or '}' at offset %d", i)
+		}
+	}
+	return fmt.Errorf("unexpected end of JSON object")
+}
+
+func skipSpace(data []byte, i int) int {
+	for i < len(data) {
+		switch data[i] {
+		case ' ', '\t', '\n', '\r':
+			i++
+		default:
+			return i
+		}
+	}
+	return i
+}
+
+// skipString returns the offset just past the string starting at data[i]
+func skipString(data []byte, i int) (int, error) {
+	for j := i + 1; j < len(data); j++ {
+		switch data[j] {
+		case '\\':
+			j++
+		case '"':
+			return j + 1, nil
+		}
+	}
+	return 0, fmt.Errorf("unterminated string at offset %d", i)
+}
+
+// skipValue returns the offset just past the value starting at data[i]
+func skipValue(data []byte, i int) (int, error) {
+	if i >= len(data) {
+		return 0, fmt.Errorf("unexpected end of JSON")
+	}
+	switch data[i] {
+	case '"':
+		return skipString(data, i)
+	case '{', '[':
+		depth := 0
+		for j := i; j < len(data); j++ {
+			switch data[j] {
+			case '"':
+				end, err := skipString(data, j)
+				if err != nil {
+					return 0, err
+				}
+				j = end - 1
+			case '{', '[':
+				depth++
+			case '}', ']':
+				depth--
+				if depth == 0 {
+					return j + 1, nil
+				}
+			}
+		}
+		return 0, fmt.Errorf("unterminated value at offset %d", i)
+	default:
+		// Numbers, true, false and null run until a delimiter
+		j := i
+		for j < len(data) {
+			switch data[j] {
+			case ',', '}', ']', ' ', '\t', '\n', '\r':
+				return j, nil
+			}
+			j++
+		}
+		return j, nil
+	}
+}
+
+// jsonStringValue returns the string held by a raw JSON value. Strings
+// without escapes are converted directly; others go through encoding/json.
+func jsonStringValue(raw []byte) (string, bool) {
+	if len(raw) < 2 || raw[0] != '"' {
+		return "", false
+	}
+	for _, c := range raw[1 : len(raw)-1] {
+		if c == '\\' {
+			var s string
+			if err := json.Unmarshal(raw, &s); err != nil {
+				return "", false
+			}
+			return s, true
+		}
+	}
+	return string(raw[1 : len(raw)-1]), true
+}
+
+// jsonArrayNonEmpty reports whether raw is an array with at least one element
+func jsonArrayNonEmpty(raw []byte) bool {
+	if len(raw) < 2 || raw[0] != '[' {
+		return false
+	}
+	i := skipSpace(raw, 1)
+	return i < len(raw) && raw[i] != ']'
+}
+
+// scanUsage extracts token counts from the usage member of a completion
+// response
+func scanUsage(data []byte) Usage {
+	var usage Usage
+	scanObject(data, func(key []byte, start, end int) bool {
+		if string(key) != "usage" {
+			return true
+		}
+		raw := data[start:end]
+		scanObject(raw, func(key []byte, start, end int) bool {
+			n, _ := strconv.Atoi(string(raw[start:end]))
+			switch string(key) {
+			case "prompt_tokens":
+				usage.PromptTokens = n
+			case "completion_tokens":
+				usage.CompletionTokens = n
+			case "total_tokens":
+				usage.TotalTokens = n
+			}
+			return true
+		})
+		return false
+	})
+	return usage
+}
+
+// replaceJSONValue returns a copy of data with the value at [start, end)
+// replaced by value encoded as a JSON string
+func replaceJSONValue(data []byte, start, end int, value string) []byte {
+	quoted, _ := json.Marshal(value)
+	out := make([]byte, 0, len(data)-(end-start)+len(quoted))
+	out = append(out, data[:start]...)
+	out = append(out, quoted...)
+	return append(out, data[end:]...)
+}
+
+// setJSONMember returns a copy of the object in data with its member name
+// set to value encoded as a JSON string, added first if it has none
+func setJSONMember(data []byte, name, value string) []byte {
+	quoted, _ := json.Marshal(value)
+	return setJSONRawMember(data, name, quoted)
+}
+
+// setJSONRawMember is setJSONMember for a value that is encoded already
+func setJSONRawMember(data []byte, name string, value []byte) []byte {
+	start, end := -1, -1
+	scanObject(data, func(key []byte, s, e int) bool {
+		if string(key) == name {
+			start, end = s, e
+			return false
+		}
+		return true
+	})
+	if start >= 0 {
+		out := make([]byte, 0, len(data)-(end-start)+len(value))
+		out = append(out, data[:start]...)
+		out = append(out, value...)
+		return append(out, data[end:]...)
+	}
+	open := skipSpace(data, 0) + 1
+	quotedName, _ := json.Marshal(name)
+	out := make([]byte, 0, len(data)+len(quotedName)+len(value)+2)
+	out = append(out, data[:open]...)
+	out = append(out, quotedName...)
+	out = append(out, ':')
+	out = append(out, value...)
+	if rest := skipSpace(data, open); rest < len(data) && data[rest] != '}' {
+		out = append(out, ',')
+	}
+	return append(out, data[open:]...)
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// jsonSchema is the subset of JSON Schema used by structured outputs:
+// types, object properties, arrays, enums, numeric and length bounds,
+// patterns, combinators and local $refs. Keywords outside it, such as
+// format, are accepted and ignored.
+type jsonSchema struct {
+	Type                 jsonTypes              `json:"type"`
+	Properties           map[string]*jsonSchema `json:"properties"`
+	Required             []string               `json:"required"`
+	AdditionalProperties *jsonSchemaOrBool      `json:"additionalProperties"`
+	Items                *jsonSchema            `json:"items"`
+	Enum                 []json.RawMessage      `json:"enum"`
+	Const                json.RawMessage        `json:"const"`
+	Minimum              *float64               `json:"minimum"`
+	Maximum              *float64               `json:"maximum"`
+	ExclusiveMinimum     *float64               `json:"exclusiveMinimum"`
+	ExclusiveMaximum     *float64               `json:"exclusiveMaximum"`
+	MinLength            *int                   `json:"minLength"`
+	MaxLength            *int                   `json:"maxLength"`
+	Pattern              string                 `json:"pattern"`
+	MinItems             *int                   `json:"minItems"`
+	MaxItems             *int                   `json:"maxItems"`
+	AnyOf                []*jsonSchema          `json:"anyOf"`
+	OneOf                []*jsonSchema          `json:"oneOf"`
+	AllOf                []*jsonSchema          `json:"allOf"`
+	Ref                  string                 `json:"$ref"`
+	Defs                 map[string]*jsonSchema `json:"$defs"`
+	Definitions          map[string]*jsonSchema `json:"definitions"`
+
+	pattern *regexp.Regexp
+}
+
+// jsonTypes is a schema's "type", either one name or a list of them
+type jsonTypes []string
+
+func (t *jsonTypes) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*t = jsonTypes{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return fmt.Errorf("type must be a string or a list of strings")
+	}
+	*t = many
+	return nil
+}
+
+// jsonSchemaOrBool is additionalProperties: false, true or a schema
+type jsonSchemaOrBool struct {
+	Allowed bool
+	Schema  *jsonSchema
+}
+
+func (s *jsonSchemaOrBool) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &s.Allowed); err == nil {
+		return nil
+	}
+	s.Allowed = true
+	return json.Unmarshal(data, &s.Schema)
+}
+
+// compiledSchema is a parsed schema ready to validate documents
+type compiledSchema struct {
+	root *jsonSchema
+}
+
+// compileJSONSchema parses a schema and its patterns
+func compileJSONSchema(data []byte) (*compiledSchema, error) {
+	var root jsonSchema
+	if err := json.Unmarshal(data, &root); err != nil {
+		return nil, fmt.Errorf("invalid JSON schema: %w", err)
+	}
+	if err := root.compilePatterns(); err != nil {
+		return nil, err
+	}
+	return &compiledSchema{root: &root}, nil
+}
+
+func (s *jsonSchema) compilePatterns() error {
+	if s == nil {
+		return nil
+	}
+	if s.Pattern != "" {
+		re, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", s.Pattern, err)
+		}
+		s.pattern = re
+	}
+	children := []*jsonSchema{s.Items}
+	if s.AdditionalProperties != nil {
+		children = append(children, s.AdditionalProperties.Schema)
+	}
+	for _, m := range []map[string]*jsonSchema{s.Properties, s.Defs, s.Definitions} {
+		for _, child := range m {
+			children = append(children, child)
+		}
+	}
+	children = append(children, s.AnyOf...)
+	children = append(children, s.OneOf...)
+	children = append(children, s.AllOf...)
+	for _, child := range children {
+		if err := child.compilePatterns(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Validate checks a JSON document against the schema and describes the
+// first violation found
+func (c *compiledSchema) Validate(doc []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(doc))
+	dec.UseNumber()
+	var value any
+	if err := dec.Decode(&value); err != nil {
+		return fmt.Errorf("not valid JSON: %w", err)
+	}
+	if dec.More() {
+		return fmt.Errorf("not valid JSON: unexpected data after the value")
+	}
+	return c.validate(c.root, value, "")
+}
+
+// resolve follows a local reference such as "#/$defs/address"
+func (c *compiledSchema) resolve(ref string) (*jsonSchema, error) {
+	for _, prefix := range []string{"#/$defs/", "#/definitions/"} {
+		if name, ok := strings.CutPrefix(ref, prefix); ok {
+			defs := c.root.Defs
+			if prefix == "#/definitions/" {
+				defs = c.root.Definitions
+			}
+			if def, ok := defs[name]; ok {
+				return def, nil
+			}
+		}
+	}
+	if ref == "#" {
+		return c.root, nil
+	}
+	return nil, fmt.Errorf("unsupported $ref %q", ref)
+}
+
+func (c *compiledSchema) validate(s *jsonSchema, value any, path string) error {
+	if s == nil {
+		return nil
+	}
+	at := path
+	if at == "" {
+		at = "the value"
+	}
+	if s.Ref != "" {
+		target, err := c.resolve(s.Ref)
+		if err != nil {
+			return err
+		}
+		return c.validate(target, value, path)
+	}
+
+	if len(s.Type) > 0 && !slicesContainType(s.Type, value) {
+		return fmt.Errorf("%s must be of type %s, got %s", at, strings.Join(s.Type, " or "), jsonTypeOf(value))
+	}
+	if s.Const != nil && !jsonEqual(s.Const, value) {
+		return fmt.Errorf("%s must be %s", at, s.Const)
+	}
+	if len(s.Enum) > 0 {
+		found := false
+		for _, option := range s.Enum {
+			if jsonEqual(option, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			options := make([]string, len(s.Enum))
+			for i, option := range s.Enum {
+				options[i] = string(option)
+			}
+			return fmt.Errorf("%s must be one of %s", at, strings.Join(options, ", "))
+		}
+	}
+
+	switch v := value.(type) {
+	case string:
+		n := utf8.RuneCountInString(v)
+		if s.MinLength != nil && n < *s.MinLength {
+			return fmt.Errorf("%s must be at least %d characters long", at, *s.MinLength)
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			return fmt.Errorf("%s must be at most %d characters long", at, *s.MaxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			return fmt.Errorf("%s must match the pattern %s", at, s.Pattern)
+		}
+	case json.Number:
+		f, _ := v.Float64()
+		if s.Minimum != nil && f < *s.Minimum {
+			return fmt.Errorf("%s must be at least %v", at, *s.Minimum)
+		}
+		if s.Maximum != nil && f > *s.Maximum {
+			return fmt.Errorf("%s must be at most %v", at, *s.Maximum)
+		}
+		if s.ExclusiveMinimum != nil && f <= *s.ExclusiveMinimum {
+			return fmt.Errorf("%s must be greater than %v", at, *s.ExclusiveMinimum)
+		}
+		if s.ExclusiveMaximum != nil && f >= *s.ExclusiveMaximum {
+			return fmt.Errorf("%s must be less than %v", at, *s.ExclusiveMaximum)
+		}
+	case []any:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			return fmt.Errorf("%s must have at least %d items", at, *s.MinItems)
+		}
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			return fmt.Errorf("%s must have at most %d items", at, *s.MaxItems)
+		}
+		for i, item := range v {
+			if err := c.validate(s.Items, item, path+"/"+strconv.Itoa(i)); err != nil {
+				return err
+			}
+		}
+	case map[string]any:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				return fmt.Errorf("%s is missing the required property %q", at, name)
+			}
+		}
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			child := path + "/" + name
+			if prop, ok := s.Properties[name]; ok {
+				if err := c.validate(prop, v[name], child); err != nil {
+					return err
+				}
+				continue
+			}
+			if extra := s.AdditionalProperties; extra != nil {
+				if !extra.Allowed {
+					return fmt.Errorf("%s has the unexpected property %q", at, name)
+				}
+				if err := c.validate(extra.Schema, v[name], child); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	for _, sub := range s.AllOf {
+		if err := c.validate(sub, value, path); err != nil {
+			return err
+		}
+	}
+	if len(s.AnyOf) > 0 {
+		var first error
+		for _, sub := range s.AnyOf {
+			err := c.validate(sub, value, path)
+			if err == nil {
+				first = nil
+				break
+			}
+			if first == nil {
+				first = err
+			}
+		}
+		if first != nil {
+			return fmt.Errorf("%s matches none of the allowed schemas: %w", at, first)
+		}
+	}
+	if len(s.OneOf) > 0 {
+		matches := 0
+		for _, sub := range s.OneOf {
+			if c.validate(sub, value, path) == nil {
+				matches++
+			}
+		}
+		if matches != 1 {
+			return fmt.Errorf("%s must match exactly one of the allowed schemas, matches %d", at, matches)
+		}
+	}
+	return nil
+}
+
+func slicesContainType(types []string, value any) bool {
+	actual := jsonTypeOf(value)
+	for _, t := range types {
+		if t == actual || (t == "number" && actual == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+func jsonTypeOf(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case json.Number:
+		if f, err := v.Float64(); err == nil && f == math.Trunc(f) {
+			return "integer"
+		}
+		return "number"
+	case []any:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+// jsonEqual compares a raw JSON value from a schema with a decoded one
+func jsonEqual(raw json.RawMessage, value any) bool {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var want any
+	if dec.Decode(&want) != nil {
+		return false
+	}
+	a, _ := json.Marshal(want)
+	b, _ := json.Marshal(value)
+	return bytes.Equal(a, b)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestJSONSchema_Validate(t *testing.T) {
+	schema, err := compileJSONSchema([]byte(`{
+		"type": "object",
+		"properties": {
+			"name": {"type": "string", "minLength": 1, "pattern": "^[A-Z]"},
+			"age": {"type": "integer", "minimum": 0, "maximum": 150},
+			"tags": {"type": "array", "items": {"enum": ["a", "b"]}, "maxItems": 2},
+			"address": {"$ref": "#/$defs/address"},
+			"contact": {"anyOf": [{"type": "string"}, {"type": "null"}]}
+		},
+		"required": ["name", "age"],
+		"additionalProperties": false,
+		"$defs": {"address": {"type": "object", "properties": {"zip": {"type": "string"}}, "required": ["zip"]}}
+	}`))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	tests := []struct {
+		doc  string
+		want string
+	}{
+		{`{"name": "Ann", "age": 30, "tags": ["a"], "address": {"zip": "10115"}, "contact": null}`, ""},
+		{`{"name": "Ann", "age": 30.0}`, ""},
+		{`{"name": "Ann"}`, `missing the required property "age"`},
+		{`{"name": "ann", "age": 30}`, "/name must match the pattern"},
+		{`{"name": "Ann", "age": 30.5}`, "/age must be of type integer, got number"},
+		{`{"name": "Ann", "age": -1}`, "/age must be at least 0"},
+		{`{"name": "Ann", "age": 1, "tags": ["c"]}`, `/tags/0 must be one of "a", "b"`},
+		{`{"name": "Ann", "age": 1, "tags": ["a", "b", "a"]}`, "/tags must have at most 2 items"},
+		{`{"name": "Ann", "age": 1, "address": {}}`, `/address is missing the required property "zip"`},
+		{`{"name": "Ann", "age": 1, "contact": 5}`, "/contact matches none of the allowed schemas"},
+		{`{"name": "Ann", "age": 1, "extra": true}`, `unexpected property "extra"`},
+		{`[1, 2]`, "the value must be of type object, got array"},
+		{`{"name": "Ann", "age": 1} trailing`, "not valid JSON"},
+	}
+	for _, tt := range tests {
+		err := schema.Validate([]byte(tt.doc))
+		if tt.want == "" {
+			if err != nil {
+				t.Errorf("Validate(%s): expected no error, got %v", tt.doc, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("Validate(%s): expected error containing %q, got %v", tt.doc, tt.want, err)
+		}
+	}
+}
+
+func TestJSONSchema_Compile(t *testing.T) {
+	for _, schema := range []string{`{"type": 5}`, `{"pattern": "("}`, `not json`} {
+		if _, err := compileJSONSchema([]byte(schema)); err == nil {
+			t.Errorf("Expected an error for %s", schema)
+		}
+	}
+	schema, _ := compileJSONSchema([]byte(`{"oneOf": [{"type": "number"}, {"type": "integer"}]}`))
+	if err := schema.Validate([]byte(`3`)); err == nil {
+		t.Error("Expected integers to match both oneOf branches")
+	}
+	if err := schema.Validate([]byte(`3.5`)); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+}
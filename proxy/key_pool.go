@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A single upstream key runs into the rate limits of its organization long
+// before the proxy runs out of capacity. With several keys in
+// OPENAI_API_KEYS, requests are spread across them, in turn or to the key
+// with the fewest requests in flight (PROXY_KEY_BALANCING=least-loaded). A
+// key the upstream answers with 429 or an authentication error is set
+// aside for PROXY_KEY_COOLDOWN, or as long as Retry-After asks if that is
+// longer, and the request is sent again at once with another key. Should
+// every key be set aside, the one that comes back first is used anyway.
+
+const (
+	balanceRoundRobin  = "round-robin"
+	balanceLeastLoaded = "least-loaded"
+)
+
+// upstreamKeyPool balances requests across the upstream keys
+type upstreamKeyPool struct {
+	strategy string
+	cooldown time.Duration
+	now      func() time.Time
+
+	mu   sync.Mutex
+	keys []*pooledKey
+	next int
+}
+
+// pooledKey is an upstream key of the pool with its load and health
+type pooledKey struct {
+	key      string
+	inFlight int
+	requests int64
+	failures int64
+	// until is when a key set aside comes back, and reason why it was set
+	// aside
+	until  time.Time
+	reason string
+}
+
+// PooledKeyStatus is a key of the pool as GET /admin/upstream-keys shows it
+type PooledKeyStatus struct {
+	// Key is the end of the key, enough to tell it apart
+	Key      string `json:"key"`
+	InFlight int    `json:"in_flight"`
+	Requests int64  `json:"requests"`
+	Failures int64  `json:"failures"`
+	// SetAsideUntil and Reason are set while the key is set aside
+	SetAsideUntil *time.Time `json:"set_aside_until,omitempty"`
+	Reason        string     `json:"reason,omitempty"`
+}
+
+// keyPoolFromEnv reads the comma-separated keys of OPENAI_API_KEYS,
+// balanced by PROXY_KEY_BALANCING (default round-robin) and set aside for
+// PROXY_KEY_COOLDOWN (default 1m) after a failure. It returns nil without
+// keys.
+func keyPoolFromEnv(getenv func(string) string) (*upstreamKeyPool, error) {
+	var keys []string
+	for _, key := range strings.Split(getenv("OPENAI_API_KEYS"), ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	strategy := balanceRoundRobin
+	if v := getenv("PROXY_KEY_BALANCING"); v != "" {
+		if v != balanceRoundRobin && v != balanceLeastLoaded {
+			return nil, fmt.Errorf("invalid PROXY_KEY_BALANCING %q", v)
+		}
+		strategy = v
+	}
+	cooldown := time.Minute
+	if v := getenv("PROXY_KEY_COOLDOWN"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid PROXY_KEY_COOLDOWN %q", v)
+		}
+		cooldown = d
+	}
+	return newUpstreamKeyPool(keys, strategy, cooldown), nil
+}
+
+func newUpstreamKeyPool(keys []string, strategy string, cooldown time.Duration) *upstreamKeyPool {
+	p := &upstreamKeyPool{strategy: strategy, cooldown: cooldown, now: time.Now}
+	for _, key := range keys {
+		p.keys = append(p.keys, &pooledKey{key: key})
+	}
+	return p
+}
+
+// acquire picks the key of the next request, which must be released
+func (p *upstreamKeyPool) acquire() *pooledKey {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := p.now()
+	picked := -1
+	// Keys are considered from the one next in turn, which wins ties
+	for i := range p.keys {
+		j := (p.next + i) % len(p.keys)
+		if picked < 0 || p.better(p.keys[j], p.keys[picked], now) {
+			picked = j
+		}
+	}
+	p.next = (picked + 1) % len(p.keys)
+	k := p.keys[picked]
+	k.inFlight++
+	k.requests++
+	return k
+}
+
+// better reports whether a is a better pick than b: any key beats one set
+// aside, of those set aside the one back soonest wins, and least-loaded
+// balancing prefers the key with fewer requests in flight
+func (p *upstreamKeyPool) better(a, b *pooledKey, now time.Time) bool {
+	aReady, bReady := !now.Before(a.until), !now.Before(b.until)
+	switch {
+	case aReady != bReady:
+		return aReady
+	case !aReady:
+		return a.until.Before(b.until)
+	}
+	return p.strategy == balanceLeastLoaded && a.inFlight < b.inFlight
+}
+
+// release ends a request made with k
+func (p *upstreamKeyPool) release(k *pooledKey) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	k.inFlight--
+}
+
+// setsAside reports whether a reply with status sets its key aside
+func setsAside(status int) bool {
+	return status == http.StatusTooManyRequests || status == http.StatusUnauthorized || status == http.StatusForbidden
+}
+
+// observe sets k aside if the upstream answered it with resp, and reports
+// whether another key that is not set aside could be tried instead
+func (p *upstreamKeyPool) observe(k *pooledKey, resp *http.Response) bool {
+	if !setsAside(resp.StatusCode) {
+		return false
+	}
+	now := p.now()
+	cooldown := p.cooldown
+	if after, ok := retryAfter(resp.Header.Get("Retry-After"), now); ok && after > cooldown {
+		cooldown = after
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	k.failures++
+	k.until = now.Add(cooldown)
+	k.reason = fmt.Sprintf("upstream status %d", resp.StatusCode)
+	for _, other := range p.keys {
+		if !now.Before(other.until) {
+			return true
+		}
+	}
+	return false
+}
+
+// Status lists the keys of the pool
+func (p *upstreamKeyPool) Status() []PooledKeyStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := p.now()
+	status := make([]PooledKeyStatus, 0, len(p.keys))
+	for _, k := range p.keys {
+		s := PooledKeyStatus{Key: keyHint(k.key), InFlight: k.inFlight, Requests: k.requests, Failures: k.failures}
+		if now.Before(k.until) {
+			until := k.until.UTC()
+			s.SetAsideUntil, s.Reason = &until, k.reason
+		}
+		status = append(status, s)
+	}
+	return status
+}
+
+// keyHint shows the last four characters of a key
+func keyHint(key string) string {
+	if len(key) <= 8 {
+		return "..."
+	}
+	return "..." + key[len(key)-4:]
+}
+
+// releasingBody releases the key of a request once its reply has been
+// read, so streamed replies count as in flight until they end
+type releasingBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	b.once.Do(b.release)
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUpstreamKeyPool_Balancing(t *testing.T) {
+	pool := newUpstreamKeyPool([]string{"a", "b", "c"}, balanceRoundRobin, time.Minute)
+	var picked []string
+	for i := 0; i < 4; i++ {
+		k := pool.acquire()
+		picked = append(picked, k.key)
+		pool.release(k)
+	}
+	if got := strings.Join(picked, ""); got != "abca" {
+		t.Errorf("Expected the keys in turn, got %s", got)
+	}
+
+	pool = newUpstreamKeyPool([]string{"a", "b", "c"}, balanceLeastLoaded, time.Minute)
+	a, b := pool.acquire(), pool.acquire()
+	pool.release(a)
+	if k := pool.acquire(); k.key != "c" {
+		t.Errorf("Expected the idle key c, got %s", k.key)
+	}
+	if k := pool.acquire(); k != a {
+		t.Errorf("Expected the released key a, got %s", k.key)
+	}
+	pool.release(b)
+}
+
+func TestUpstreamKeyPool_SetsAsideFailingKeys(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	pool := newUpstreamKeyPool([]string{"sk-aaaaaaaa1111", "sk-bbbbbbbb2222"}, balanceRoundRobin, time.Minute)
+	pool.now = func() time.Time { return now }
+
+	a := pool.acquire()
+	resp := &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": {"120"}}}
+	if !pool.observe(a, resp) {
+		t.Error("Expected another key to be available")
+	}
+	pool.release(a)
+	for i := 0; i < 2; i++ {
+		k := pool.acquire()
+		if k == a {
+			t.Fatal("Expected the rate limited key to be set aside")
+		}
+		pool.release(k)
+	}
+	status := pool.Status()
+	if status[0].Key != "...1111" || status[0].SetAsideUntil == nil || !status[0].SetAsideUntil.Equal(now.Add(2*time.Minute)) || status[0].Failures != 1 {
+		t.Errorf("Expected the first key set aside for as long as Retry-After asked, got %+v", status[0])
+	}
+
+	// With every key set aside, the one back soonest is used
+	b := pool.acquire()
+	if pool.observe(b, &http.Response{StatusCode: http.StatusUnauthorized, Header: http.Header{}}) {
+		t.Error("Expected no other key to be available")
+	}
+	pool.release(b)
+	if k := pool.acquire(); k != b {
+		t.Errorf("Expected the key back soonest, got %s", k.key)
+	}
+
+	now = now.Add(3 * time.Minute)
+	if status := pool.Status(); status[0].SetAsideUntil != nil || status[1].SetAsideUntil != nil {
+		t.Errorf("Expected the keys back after their cooldown, got %+v", status)
+	}
+}
+
+func TestProxyServer_KeyPoolSwitchesKeys(t *testing.T) {
+	var mu sync.Mutex
+	var used []string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		mu.Lock()
+		used = append(used, key)
+		mu.Unlock()
+		if key == "sk-limited" {
+			w.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprint(w, `{"error":{"message":"rate limit reached for organization","type":"requests"}}`)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(createTestChatCompletionResponse())
+	}))
+	defer api.Close()
+
+	pool, err := keyPoolFromEnv(func(name string) string {
+		return map[string]string{"OPENAI_API_KEYS": "sk-limited, sk-spare"}[name]
+	})
+	if err != nil {
+		t.Fatalf("Failed to create key pool: %v", err)
+	}
+	client := NewRealOpenAIClient("sk-limited")
+	client.BaseURL = api.URL
+	client.Keys = pool
+	server := NewProxyServer(client)
+	server.keyPool = pool
+	server.submissions = nil
+	handler := server.Handler()
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "gpt-4o", "messages": [{"role": "user", "content": "Hi"}]}`))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected the request to succeed with the spare key, got %d: %s", w.Code, w.Body.String())
+		}
+	}
+	if got := strings.Join(used, ","); got != "sk-limited,sk-spare,sk-spare" {
+		t.Errorf("Expected the limited key to be set aside after its 429, got %s", got)
+	}
+	for _, k := range pool.Status() {
+		if k.InFlight != 0 {
+			t.Errorf("Expected every key released, got %+v", k)
+		}
+	}
+}
+
+func TestKeyPoolFromEnv(t *testing.T) {
+	if pool, err := keyPoolFromEnv(func(string) string { return "" }); pool != nil || err != nil {
+		t.Errorf("Expected no pool without keys, got %v %v", pool, err)
+	}
+	env := map[string]string{"OPENAI_API_KEYS": "sk-a,sk-b", "PROXY_KEY_BALANCING": "random"}
+	if _, err := keyPoolFromEnv(func(name string) string { return env[name] }); err == nil {
+		t.Error("Expected an unknown balancing strategy to be rejected")
+	}
+}
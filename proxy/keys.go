@@ -0,0 +1,500 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Admin access levels a client key can be granted
+const (
+	AdminNone  = ""
+	AdminRead  = "read"
+	AdminWrite = "write"
+)
+
+// KeyScopes restricts what a client key may be used for. An empty list
+// means "no restriction" for that dimension. Model and endpoint entries may
+// end in "*" to match a prefix (e.g. "gpt-4o*" or "/v1/*").
+type KeyScopes struct {
+	Models    []string `json:"models,omitempty"`
+	Endpoints []string `json:"endpoints,omitempty"`
+	Methods   []string `json:"methods,omitempty"`
+	Admin     string   `json:"admin,omitempty"`
+	// Debug allows requests to be echoed instead of sent upstream
+	Debug bool `json:"debug,omitempty"`
+}
+
+// ClientKey is a credential issued by the proxy to one of its clients.
+// Temporary keys minted from another key record it as their Parent and stop
+// working once ExpiresAt has passed.
+type ClientKey struct {
+	ID  string `json:"id"`
+	Key string `json:"key,omitempty"`
+	// KeyHash is the hex SHA-256 of the secret, for keys configured or
+	// stored without their plaintext secret
+	KeyHash string    `json:"key_hash,omitempty"`
+	Name    string    `json:"name,omitempty"`
+	Tenant  string    `json:"tenant,omitempty"`
+	Scopes  KeyScopes `json:"scopes"`
+	Limits  KeyLimits `json:"limits,omitempty"`
+	// Upstream names the upstream key requests with this key are made
+	// with, instead of the proxy's own
+	Upstream  string     `json:"upstream,omitempty"`
+	Parent    string     `json:"parent,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// MonthlyBudget, if set, is the spend in USD per calendar month past
+	// which requests are refused
+	MonthlyBudget float64 `json:"monthly_budget,omitempty"`
+}
+
+// hash returns the hash the key's secret is indexed by
+func (k *ClientKey) hash() string {
+	if k.Key == "" {
+		return strings.ToLower(k.KeyHash)
+	}
+	return hashKey(k.Key)
+}
+
+// Expired reports whether a temporary key is past its expiry time
+func (k *ClientKey) Expired(now time.Time) bool {
+	return k.ExpiresAt != nil && !now.Before(*k.ExpiresAt)
+}
+
+func (k *ClientKey) AllowsModel(model string) bool {
+	return len(k.Scopes.Models) == 0 || matchAny(k.Scopes.Models, model)
+}
+
+func (k *ClientKey) AllowsEndpoint(path string) bool {
+	return len(k.Scopes.Endpoints) == 0 || matchAny(k.Scopes.Endpoints, path)
+}
+
+func (k *ClientKey) AllowsMethod(method string) bool {
+	if len(k.Scopes.Methods) == 0 {
+		return true
+	}
+	for _, m := range k.Scopes.Methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsAdmin reports whether the key may perform an admin request with the
+// given HTTP method. Read-only admins may only use GET and HEAD.
+func (k *ClientKey) AllowsAdmin(method string) bool {
+	switch k.Scopes.Admin {
+	case AdminWrite:
+		return true
+	case AdminRead:
+		return method == http.MethodGet || method == http.MethodHead
+	default:
+		return false
+	}
+}
+
+// matchAny reports whether value matches one of the patterns, where a
+// trailing "*" matches any suffix
+func matchAny(patterns []string, value string) bool {
+	for _, p := range patterns {
+		if p == "*" || p == value {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(p, "*"); ok && strings.HasPrefix(value, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// KeyStore holds the client keys accepted by the proxy. Keys are indexed by
+// a SHA-256 hash of their secret so plaintext secrets are not kept as map keys.
+type KeyStore struct {
+	mu     sync.RWMutex
+	byHash map[string]*ClientKey
+	byID   map[string]*ClientKey
+	// fromFile tracks the IDs loaded from the keys file so a reload can
+	// tell them apart from keys created through the admin API
+	fromFile map[string]bool
+	// path, if set, is the file keys created through the admin API are
+	// saved to
+	path   string
+	saveMu sync.Mutex
+	// writes is held by admin API writes, see resourceHandler
+	writes sync.Mutex
+}
+
+func NewKeyStore(keys []ClientKey) (*KeyStore, error) {
+	store := &KeyStore{
+		byHash:   make(map[string]*ClientKey),
+		byID:     make(map[string]*ClientKey),
+		fromFile: make(map[string]bool),
+	}
+	for i := range keys {
+		if err := store.Add(keys[i]); err != nil {
+			return nil, err
+		}
+	}
+	return store, nil
+}
+
+// LoadKeyStore reads a JSON array of client keys from path
+func LoadKeyStore(path string) (*KeyStore, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keys file: %w", err)
+	}
+	keys, err := parseKeysFile(data)
+	if err != nil {
+		return nil, err
+	}
+	store, err := NewKeyStore(keys)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		store.fromFile[k.ID] = true
+	}
+	return store, nil
+}
+
+func parseKeysFile(data []byte) ([]ClientKey, error) {
+	var keys []ClientKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("failed to parse keys file: %w", err)
+	}
+	for _, k := range keys {
+		if err := validateClientKey(k); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// ReloadFile replaces the keys that came from the keys file with a new set.
+// Keys created through the admin API and temporary tokens of keys that are
+// still present are left alone. The new file is validated in full, secrets
+// clashing with the keys left alone included, before any key is changed.
+func (s *KeyStore) ReloadFile(data []byte) error {
+	keys, err := parseKeysFile(data)
+	if err != nil {
+		return err
+	}
+	seen := make(map[string]bool)
+	secrets := make(map[string]string)
+	for _, k := range keys {
+		if seen[k.ID] {
+			return fmt.Errorf("duplicate client key id %s", k.ID)
+		}
+		if _, exists := secrets[k.hash()]; exists {
+			return fmt.Errorf("client key %s reuses another key's secret", k.ID)
+		}
+		seen[k.ID] = true
+		secrets[k.hash()] = k.ID
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// replaced are the keys the reload drops or overwrites: those of the
+	// previous file, those the new file redefines and the temporary tokens
+	// of keys that are dropped
+	replaced := func(k *ClientKey) bool {
+		return s.fromFile[k.ID] || seen[k.ID] || s.fromFile[k.Parent] && !seen[k.Parent]
+	}
+	for hash, k := range s.byHash {
+		if id, clash := secrets[hash]; clash && !replaced(k) {
+			return fmt.Errorf("client key %s reuses the secret of key %s", id, k.ID)
+		}
+	}
+	for hash, k := range s.byHash {
+		if replaced(k) {
+			delete(s.byHash, hash)
+			delete(s.byID, k.ID)
+		}
+	}
+	for i := range keys {
+		k := keys[i]
+		s.byHash[k.hash()] = &k
+		s.byID[k.ID] = &k
+	}
+	s.fromFile = seen
+	return nil
+}
+
+func hashKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func validateClientKey(key ClientKey) error {
+	if key.ID == "" || key.Key == "" && key.KeyHash == "" {
+		return fmt.Errorf("client key requires both id and key")
+	}
+	if key.Key == "" && len(key.KeyHash) != sha256.Size*2 {
+		return fmt.Errorf("client key %s: key_hash must be a hex SHA-256", key.ID)
+	}
+	switch key.Scopes.Admin {
+	case AdminNone, AdminRead, AdminWrite:
+	default:
+		return fmt.Errorf("client key %s: invalid admin scope %q", key.ID, key.Scopes.Admin)
+	}
+	if key.MonthlyBudget < 0 {
+		return fmt.Errorf("client key %s: monthly_budget must not be negative", key.ID)
+	}
+	return nil
+}
+
+func (s *KeyStore) Add(key ClientKey) error {
+	if err := validateClientKey(key); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.byID[key.ID]; exists {
+		return fmt.Errorf("duplicate client key id %s", key.ID)
+	}
+	hash := key.hash()
+	if _, exists := s.byHash[hash]; exists {
+		return fmt.Errorf("client key %s reuses another key's secret", key.ID)
+	}
+	k := key
+	s.byHash[hash] = &k
+	s.byID[k.ID] = &k
+	return nil
+}
+
+// Lookup returns the key matching the given secret, or nil if there is no
+// such key or it has expired
+func (s *KeyStore) Lookup(secret string) *ClientKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	key := s.byHash[hashKey(secret)]
+	if key == nil || key.Expired(time.Now()) {
+		return nil
+	}
+	return key
+}
+
+// Get returns the key with the given ID, or nil
+func (s *KeyStore) Get(id string) *ClientKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.byID[id]
+}
+
+// Put creates or replaces the key with key.ID and reports whether it was
+// newly created
+// lockWrites takes the admin API write lock and returns its unlock
+func (s *KeyStore) lockWrites() (unlock func()) {
+	s.writes.Lock()
+	return s.writes.Unlock
+}
+
+func (s *KeyStore) Put(key ClientKey) (bool, error) {
+	if err := validateClientKey(key); err != nil {
+		return false, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hash := key.hash()
+	if other, exists := s.byHash[hash]; exists && other.ID != key.ID {
+		return false, fmt.Errorf("client key %s reuses another key's secret", key.ID)
+	}
+	old, exists := s.byID[key.ID]
+	if exists {
+		delete(s.byHash, old.hash())
+	}
+	k := key
+	s.byHash[hash] = &k
+	s.byID[k.ID] = &k
+	return !exists, nil
+}
+
+// Delete removes the key with the given ID along with any temporary tokens
+// minted from it, and reports whether the key existed
+func (s *KeyStore) Delete(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.byID[id]; !exists {
+		return false
+	}
+	for hash, key := range s.byHash {
+		if key.ID == id || key.Parent == id {
+			delete(s.byHash, hash)
+			delete(s.byID, key.ID)
+		}
+	}
+	return true
+}
+
+// RemoveExpired deletes temporary keys that expired before now and returns
+// their IDs
+func (s *KeyStore) RemoveExpired(now time.Time) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var removed []string
+	for hash, key := range s.byHash {
+		if key.Expired(now) {
+			delete(s.byHash, hash)
+			delete(s.byID, key.ID)
+			removed = append(removed, key.ID)
+		}
+	}
+	return removed
+}
+
+// List returns all keys with their secrets removed
+func (s *KeyStore) List() []ClientKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys := make([]ClientKey, 0, len(s.byID))
+	for _, k := range s.byID {
+		redacted := *k
+		redacted.Key = ""
+		redacted.KeyHash = ""
+		keys = append(keys, redacted)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID < keys[j].ID })
+	return keys
+}
+
+type contextKey int
+
+const clientKeyContextKey contextKey = iota
+
+// clientKeyFromContext returns the authenticated key for a request, or nil
+// when authentication is disabled
+func clientKeyFromContext(ctx context.Context) *ClientKey {
+	key, _ := ctx.Value(clientKeyContextKey).(*ClientKey)
+	return key
+}
+
+// bearerToken extracts the token from an "Authorization: Bearer" header
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if token, ok := strings.CutPrefix(auth, "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	return ""
+}
+
+// withAuth authenticates the request against the key store and enforces
+// the key's endpoint, method and admin scopes as well as its rate limits.
+// Model scopes are checked by the handlers once the request body has been
+// parsed. When no key store is configured all requests are allowed,
+// matching the proxy's original behavior, within the per-address limits if
+// there are any.
+func (s *ProxyServer) withAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.keys == nil {
+			if s.addressLimits != nil {
+				s.limitByAddress(w, r, next)
+				return
+			}
+			next(w, r)
+			return
+		}
+
+		key := s.keys.Lookup(bearerToken(r))
+		if key == nil {
+			http.Error(w, "Invalid or missing API key", http.StatusUnauthorized)
+			return
+		}
+		if !key.AllowsEndpoint(r.URL.Path) {
+			http.Error(w, "API key is not allowed to access this endpoint", http.StatusForbidden)
+			return
+		}
+		if !key.AllowsMethod(r.Method) {
+			http.Error(w, "API key is not allowed to use this method", http.StatusForbidden)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/admin/") && !key.AllowsAdmin(r.Method) {
+			http.Error(w, "API key does not have admin access", http.StatusForbidden)
+			return
+		}
+
+		if !s.terms.Allows(key) {
+			http.Error(w, fmt.Sprintf("API key cannot be used until the terms of use (version %s) are accepted; ask an administrator for a link", s.terms.version), http.StatusForbidden)
+			return
+		}
+
+		ctx, ok := s.keyContext(r.Context(), key)
+		if !ok {
+			http.Error(w, "The upstream key of this API key is not configured", http.StatusServiceUnavailable)
+			return
+		}
+
+		reason, limits := s.checkLimits(key)
+		setRateLimitHeaders(w.Header(), limits)
+		if reason != "" {
+			http.Error(w, reason, http.StatusTooManyRequests)
+			return
+		}
+		if !strings.HasPrefix(r.URL.Path, "/admin/") && !s.checkBudget(w, key) {
+			return
+		}
+
+		timelineFromContext(r.Context()).setKey(key)
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// keyContext returns ctx for requests made with key, or false if the key
+// maps to an upstream key that is not configured
+func (s *ProxyServer) keyContext(ctx context.Context, key *ClientKey) (context.Context, bool) {
+	ctx = context.WithValue(ctx, clientKeyContextKey, key)
+	if key.Upstream == "" {
+		return ctx, true
+	}
+	upstreamKey, ok := s.upstreamKeys.Get(key.Upstream)
+	if !ok {
+		log.Printf("Client key %s maps to unknown upstream key %s", key.ID, key.Upstream)
+		return ctx, false
+	}
+	return context.WithValue(ctx, upstreamKeyContextKey, upstreamKey), true
+}
+
+// checkLimits counts a request against the key's and its tenant's rate
+// limits and returns why it must be rejected, or "" if it may proceed,
+// along with the tighter of the two limits' states
+func (s *ProxyServer) checkLimits(key *ClientKey) (string, rateLimitState) {
+	state, ok := s.limiter.Check(key.ID, key.Limits)
+	if !ok {
+		return "Rate limit exceeded", state
+	}
+	if tenant, found := s.tenants.Get(key.Tenant); found {
+		tenantState, ok := s.limiter.Check("tenant:"+tenant.ID, tenant.Limits)
+		if !ok {
+			return "Tenant rate limit exceeded", tenantState
+		}
+		state = state.tighter(tenantState)
+	}
+	return "", state
+}
+
+// handleAdminKeys lists the configured client keys without their secrets
+func (s *ProxyServer) handleAdminKeys(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.keys == nil {
+		http.Error(w, "Key management is not enabled", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"keys": s.keys.List()})
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func createTestKeyStore(t *testing.T) *KeyStore {
+	t.Helper()
+	store, err := NewKeyStore([]ClientKey{
+		{ID: "full", Key: "sk-full"},
+		{ID: "mini-only", Key: "sk-mini", Scopes: KeyScopes{Models: []string{"gpt-4o-mini"}}},
+		{ID: "embeddings-only", Key: "sk-embed", Scopes: KeyScopes{Endpoints: []string{"/v1/embeddings"}}},
+		{ID: "get-only", Key: "sk-get", Scopes: KeyScopes{Methods: []string{"GET"}}},
+		{ID: "admin-ro", Key: "sk-admin-ro", Scopes: KeyScopes{Admin: AdminRead}},
+		{ID: "admin-rw", Key: "sk-admin-rw", Scopes: KeyScopes{Admin: AdminWrite}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create key store: %v", err)
+	}
+	return store
+}
+
+func TestMatchAny(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		value    string
+		want     bool
+	}{
+		{[]string{"gpt-4o-mini"}, "gpt-4o-mini", true},
+		{[]string{"gpt-4o-mini"}, "gpt-4o", false},
+		{[]string{"gpt-4o*"}, "gpt-4o-mini", true},
+		{[]string{"/v1/*"}, "/v1/chat/completions", true},
+		{[]string{"/v1/*"}, "/admin/keys", false},
+		{[]string{"*"}, "anything", true},
+	}
+
+	for _, tt := range tests {
+		if got := matchAny(tt.patterns, tt.value); got != tt.want {
+			t.Errorf("matchAny(%v, %s): expected %v, got %v", tt.patterns, tt.value, tt.want, got)
+		}
+	}
+}
+
+func TestClientKey_AllowsAdmin(t *testing.T) {
+	readOnly := &ClientKey{Scopes: KeyScopes{Admin: AdminRead}}
+	if !readOnly.AllowsAdmin(http.MethodGet) {
+		t.Error("Expected read-only admin to allow GET")
+	}
+	if readOnly.AllowsAdmin(http.MethodPost) {
+		t.Error("Expected read-only admin to reject POST")
+	}
+
+	none := &ClientKey{}
+	if none.AllowsAdmin(http.MethodGet) {
+		t.Error("Expected key without admin scope to reject admin requests")
+	}
+}
+
+func TestNewKeyStore_RejectsInvalidKeys(t *testing.T) {
+	if _, err := NewKeyStore([]ClientKey{{ID: "a"}}); err == nil {
+		t.Error("Expected error for key without secret")
+	}
+	if _, err := NewKeyStore([]ClientKey{{ID: "a", Key: "x"}, {ID: "a", Key: "y"}}); err == nil {
+		t.Error("Expected error for duplicate id")
+	}
+	if _, err := NewKeyStore([]ClientKey{{ID: "a", Key: "x"}, {ID: "b", Key: "x"}}); err == nil {
+		t.Error("Expected error for duplicate secret")
+	}
+	if _, err := NewKeyStore([]ClientKey{{ID: "a", Key: "x", Scopes: KeyScopes{Admin: "root"}}}); err == nil {
+		t.Error("Expected error for invalid admin scope")
+	}
+}
+
+func TestLoadKeyStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	data := `[{"id": "team-a", "key": "sk-team-a", "scopes": {"models": ["gpt-4o-mini"]}}]`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatalf("Failed to write keys file: %v", err)
+	}
+
+	store, err := LoadKeyStore(path)
+	if err != nil {
+		t.Fatalf("Failed to load key store: %v", err)
+	}
+
+	key := store.Lookup("sk-team-a")
+	if key == nil {
+		t.Fatal("Expected key to be found")
+	}
+	if key.ID != "team-a" || !key.AllowsModel("gpt-4o-mini") || key.AllowsModel("gpt-4o") {
+		t.Errorf("Unexpected key loaded: %+v", key)
+	}
+}
+
+func TestProxyServer_WithAuth(t *testing.T) {
+	server := NewProxyServer(&MockOpenAIClient{response: createTestChatCompletionResponse()})
+	server.keys = createTestKeyStore(t)
+	handler := server.withAuth(func(w http.ResponseWriter, r *http.Request) {
+		if clientKeyFromContext(r.Context()) == nil {
+			t.Error("Expected authenticated key in request context")
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		want   int
+	}{
+		{"missing key", "POST", "/v1/chat/completions", "", http.StatusUnauthorized},
+		{"unknown key", "POST", "/v1/chat/completions", "sk-unknown", http.StatusUnauthorized},
+		{"unrestricted key", "POST", "/v1/chat/completions", "sk-full", http.StatusOK},
+		{"endpoint allowed", "POST", "/v1/embeddings", "sk-embed", http.StatusOK},
+		{"endpoint denied", "POST", "/v1/chat/completions", "sk-embed", http.StatusForbidden},
+		{"method denied", "POST", "/v1/chat/completions", "sk-get", http.StatusForbidden},
+		{"admin without scope", "GET", "/admin/keys", "sk-full", http.StatusForbidden},
+		{"read-only admin read", "GET", "/admin/keys", "sk-admin-ro", http.StatusOK},
+		{"read-only admin write", "POST", "/admin/keys", "sk-admin-ro", http.StatusForbidden},
+		{"admin write", "POST", "/admin/keys", "sk-admin-rw", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+
+			handler(w, req)
+
+			if w.Code != tt.want {
+				t.Errorf("Expected status code %d, got %d", tt.want, w.Code)
+			}
+		})
+	}
+}
+
+func TestProxyServer_HandleChatCompletions_ModelScope(t *testing.T) {
+	server := NewProxyServer(&MockOpenAIClient{response: createTestChatCompletionResponse()})
+	server.keys = createTestKeyStore(t)
+	handler := server.withAuth(server.handleChatCompletions)
+
+	reqBody := createTestChatCompletionRequest()
+	jsonData, _ := json.Marshal(reqBody)
+
+	// gpt-3.5-turbo is outside the mini-only key's model scope
+	req := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewBuffer(jsonData))
+	req.Header.Set("Authorization", "Bearer sk-mini")
+	w := httptest.NewRecorder()
+	handler(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected status code %d, got %d", http.StatusForbidden, w.Code)
+	}
+
+	req = httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewBuffer(jsonData))
+	req.Header.Set("Authorization", "Bearer sk-full")
+	w = httptest.NewRecorder()
+	handler(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+}
+
+func TestProxyServer_HandleAdminKeys(t *testing.T) {
+	server := NewProxyServer(&MockOpenAIClient{})
+	server.keys = createTestKeyStore(t)
+
+	req := httptest.NewRequest("GET", "/admin/keys", nil)
+	w := httptest.NewRecorder()
+	server.handleAdminKeys(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+
+	var response struct {
+		Keys []ClientKey `json:"keys"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(response.Keys) != 6 {
+		t.Errorf("Expected 6 keys, got %d", len(response.Keys))
+	}
+	for _, k := range response.Keys {
+		if k.Key != "" {
+			t.Errorf("Expected secret of key %s to be redacted", k.ID)
+		}
+	}
+}
+
+func TestKeyStore_ReloadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	os.WriteFile(path, []byte(`[{"id": "a", "key": "sk-a"}, {"id": "b", "key": "sk-b"}]`), 0o600)
+	store, err := LoadKeyStore(path)
+	if err != nil {
+		t.Fatalf("Failed to load key store: %v", err)
+	}
+	store.Put(ClientKey{ID: "admin-made", Key: "sk-admin-made"})
+
+	err = store.ReloadFile([]byte(`[{"id": "a", "key": "sk-a2"}, {"id": "c", "key": "sk-c"}]`))
+	if err != nil {
+		t.Fatalf("Failed to reload keys: %v", err)
+	}
+
+	if store.Lookup("sk-a") != nil || store.Lookup("sk-a2") == nil {
+		t.Error("Expected key a to be rotated")
+	}
+	if store.Get("b") != nil {
+		t.Error("Expected key b to be removed")
+	}
+	if store.Get("c") == nil {
+		t.Error("Expected key c to be added")
+	}
+	if store.Get("admin-made") == nil {
+		t.Error("Expected keys created through the admin API to survive a reload")
+	}
+
+	if err := store.ReloadFile([]byte(`[{"id": "a"}]`)); err == nil {
+		t.Error("Expected invalid keys file to be rejected")
+	}
+	if store.Lookup("sk-a2") == nil {
+		t.Error("Expected keys to be unchanged after a rejected reload")
+	}
+
+	// A secret clashing with a key of the admin API is caught before
+	// anything changes
+	err = store.ReloadFile([]byte(`[{"id": "a", "key": "sk-a3"}, {"id": "d", "key": "sk-admin-made"}]`))
+	if err == nil || !strings.Contains(err.Error(), "admin-made") {
+		t.Errorf("Expected the clash with admin-made to be rejected, got %v", err)
+	}
+	if store.Lookup("sk-a2") == nil || store.Get("c") == nil || store.Get("d") != nil {
+		t.Error("Expected keys to be unchanged after a conflicting reload")
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// defaultKnowledgeBase is searched by requests that do not name one
+const defaultKnowledgeBase = "default"
+
+// KnowledgeBase is a named collection of documents with its own embedding
+// model and retrieval settings
+type KnowledgeBase struct {
+	ID string `json:"id"`
+	// Tenant, if set, limits retrieval to that tenant's keys
+	Tenant      string `json:"tenant,omitempty"`
+	Description string `json:"description,omitempty"`
+	// EmbeddingModel embeds documents and queries, by default the one set
+	// with PROXY_RAG_EMBEDDING_MODEL
+	EmbeddingModel string `json:"embedding_model,omitempty"`
+	// Retrieval overrides the configured retrieval settings where set
+	Retrieval RetrievalConfig `json:"retrieval"`
+
+	// docs and stats are shared by every copy of the knowledge base, so
+	// changing its settings keeps its documents
+	docs  *registry[RAGDocument]
+	stats *knowledgeBaseStats
+}
+
+type knowledgeBaseStats struct {
+	mu      sync.Mutex
+	updated time.Time
+	indexed time.Time
+}
+
+func (st *knowledgeBaseStats) touch(indexed bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.updated = time.Now().UTC()
+	if indexed {
+		st.indexed = st.updated
+	}
+}
+
+// KnowledgeBaseView is a knowledge base as returned by the admin API, with
+// its statistics
+type KnowledgeBaseView struct {
+	KnowledgeBase
+	Documents int `json:"documents"`
+	Chunks    int `json:"chunks"`
+	// Updated is when a document was last stored or removed, or the
+	// knowledge base reindexed
+	Updated *time.Time `json:"updated,omitempty"`
+	// Reindexed is when every document was last embedded again
+	Reindexed *time.Time `json:"reindexed,omitempty"`
+	// EmbeddingModels counts the documents by the model that embedded
+	// them, which is more than one until a reindex finishes
+	EmbeddingModels map[string]int `json:"embedding_models,omitempty"`
+}
+
+func (kb KnowledgeBase) view() KnowledgeBaseView {
+	v := KnowledgeBaseView{KnowledgeBase: kb}
+	for _, doc := range kb.docs.List() {
+		v.Documents++
+		v.Chunks += len(doc.chunks)
+		if doc.EmbeddingModel != "" {
+			if v.EmbeddingModels == nil {
+				v.EmbeddingModels = make(map[string]int)
+			}
+			v.EmbeddingModels[doc.EmbeddingModel]++
+		}
+	}
+	kb.stats.mu.Lock()
+	defer kb.stats.mu.Unlock()
+	if !kb.stats.updated.IsZero() {
+		updated := kb.stats.updated
+		v.Updated = &updated
+	}
+	if !kb.stats.indexed.IsZero() {
+		indexed := kb.stats.indexed
+		v.Reindexed = &indexed
+	}
+	return v
+}
+
+// embeddingModel is the model the knowledge base is embedded with
+func (s *ProxyServer) embeddingModel(kb KnowledgeBase) string {
+	if kb.EmbeddingModel != "" {
+		return kb.EmbeddingModel
+	}
+	return s.ragEmbeddingModel
+}
+
+// retrievalConfig merges the settings of the knowledge base over the
+// configured ones
+func (s *ProxyServer) retrievalConfig(kb KnowledgeBase) RetrievalConfig {
+	config := s.ragRetrieval
+	if kb.Retrieval.Mode != "" {
+		config.Mode = kb.Retrieval.Mode
+	}
+	if kb.Retrieval.Fusion != "" {
+		config.Fusion = kb.Retrieval.Fusion
+	}
+	if kb.Retrieval.VectorWeight != nil {
+		config.VectorWeight = kb.Retrieval.VectorWeight
+	}
+	return config
+}
+
+// knowledgeBaseFor returns the knowledge base a request may search. One of
+// another tenant is reported as unknown, so tenants cannot probe for each
+// other's knowledge bases.
+func (s *ProxyServer) knowledgeBaseFor(id, tenant string) (KnowledgeBase, error) {
+	if id == "" {
+		id = defaultKnowledgeBase
+	}
+	kb, ok := s.knowledgeBases.Get(id)
+	if !ok || (kb.Tenant != "" && kb.Tenant != tenant) {
+		return KnowledgeBase{}, fmt.Errorf("%w: unknown knowledge base %s", errBadRetrieval, id)
+	}
+	return kb, nil
+}
+
+// indexDocument chunks and embeds a document for the knowledge base
+func (s *ProxyServer) indexDocument(kb KnowledgeBase, doc RAGDocument) (RAGDocument, error) {
+	texts := chunkDocument(doc.Text)
+	if len(texts) == 0 {
+		return doc, fmt.Errorf("document requires text")
+	}
+	vectors, model, _, err := s.embed(s.embeddingModel(kb), texts)
+	if err != nil {
+		return doc, fmt.Errorf("failed to embed document: %w", err)
+	}
+	doc.EmbeddingModel = model
+	doc.chunks = make([]ragChunk, len(texts))
+	for i, text := range texts {
+		terms, length := termCounts(text)
+		doc.chunks[i] = ragChunk{text: text, vector: vectors[i], terms: terms, length: length}
+	}
+	doc.Chunks = len(doc.chunks)
+	return doc, nil
+}
+
+// reindex embeds every document of the knowledge base again, e.g. after
+// its embedding model changed. If any document fails, none is changed, so
+// all chunks are always embedded with the same model.
+func (s *ProxyServer) reindex(kb KnowledgeBase) error {
+	docs := kb.docs.List()
+	for i, doc := range docs {
+		indexed, err := s.indexDocument(kb, doc)
+		if err != nil {
+			return fmt.Errorf("document %s: %w", doc.ID, err)
+		}
+		docs[i] = indexed
+	}
+	for _, doc := range docs {
+		kb.docs.Put(doc.ID, doc)
+	}
+	kb.stats.touch(true)
+	return nil
+}
+
+// compactVectors copies the chunk vectors of every knowledge base that take
+// more memory than their dimensions need, as vectors decoded from upstream
+// replies do, and returns how many there were and the bytes freed
+func (s *ProxyServer) compactVectors() (int, int64) {
+	var compacted int
+	var freed int64
+	for _, kb := range s.knowledgeBases.List() {
+		for _, doc := range kb.docs.List() {
+			kb.docs.Update(doc.ID, func(doc RAGDocument) RAGDocument {
+				var chunks []ragChunk
+				for i, chunk := range doc.chunks {
+					if spare := cap(chunk.vector) - len(chunk.vector); spare > 0 {
+						if chunks == nil {
+							// Searches may be reading the old chunks
+							chunks = slices.Clone(doc.chunks)
+						}
+						chunks[i].vector = make([]float64, len(chunk.vector))
+						copy(chunks[i].vector, chunk.vector)
+						compacted++
+						freed += int64(spare) * 8
+					}
+				}
+				if chunks != nil {
+					doc.chunks = chunks
+				}
+				return doc
+			})
+		}
+	}
+	return compacted, freed
+}
+
+// handleAdminKnowledgeBases lists knowledge bases with their statistics,
+// optionally only those of ?tenant=
+func (s *ProxyServer) handleAdminKnowledgeBases(w http.ResponseWriter, r *http.Request) {
+	tenant := r.URL.Query().Get("tenant")
+	handleAdminList("knowledge_bases", func() []KnowledgeBaseView {
+		views := []KnowledgeBaseView{}
+		for _, kb := range s.knowledgeBases.List() {
+			if tenant == "" || kb.Tenant == tenant {
+				views = append(views, kb.view())
+			}
+		}
+		return views
+	})(w, r)
+}
+
+// adminKnowledgeBaseHandler manages knowledge bases. Changing the embedding
+// model of one reindexes its documents; deleting it deletes them.
+func (s *ProxyServer) adminKnowledgeBaseHandler() resourceHandler[KnowledgeBase] {
+	return resourceHandler[KnowledgeBase]{
+		lock: s.knowledgeBases.lockWrites,
+		get: func(id string) (KnowledgeBase, string, bool) {
+			kb, ok := s.knowledgeBases.Get(id)
+			return kb, etagFor(kb), ok
+		},
+		put: func(id string, kb KnowledgeBase, existing *KnowledgeBase) (bool, error) {
+			if kb.ID != "" && kb.ID != id {
+				return false, fmt.Errorf("id in body does not match id in path")
+			}
+			kb.ID = id
+			// Validate a copy, so settings left unset keep following the
+			// configured ones
+			check := kb.Retrieval
+			if err := check.validate(); err != nil {
+				return false, err
+			}
+			if existing == nil {
+				kb.docs, kb.stats = newRegistry[RAGDocument](), &knowledgeBaseStats{}
+				return s.knowledgeBases.Put(id, kb), nil
+			}
+			kb.docs, kb.stats = existing.docs, existing.stats
+			if s.embeddingModel(kb) != s.embeddingModel(*existing) {
+				if err := s.reindex(kb); err != nil {
+					return false, err
+				}
+			}
+			return s.knowledgeBases.Put(id, kb), nil
+		},
+		remove: s.knowledgeBases.Delete,
+		view:   func(kb KnowledgeBase) any { return kb.view() },
+	}
+}
+
+// handleAdminReindex embeds every document of a knowledge base again
+func (s *ProxyServer) handleAdminReindex(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	kb, ok := s.knowledgeBases.Get(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if err := s.reindex(kb); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	writeResource(w, http.StatusOK, etagFor(kb), kb.view())
+}
+
+// handleAdminKnowledgeBaseDocuments serves the documents of the knowledge
+// base in the path: the list, or one of them by ID
+func (s *ProxyServer) handleAdminKnowledgeBaseDocuments(w http.ResponseWriter, r *http.Request) {
+	kb, ok := s.knowledgeBases.Get(r.PathValue("kb"))
+	if !ok {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if r.PathValue("id") == "" {
+		handleAdminList("documents", kb.docs.List)(w, r)
+		return
+	}
+	s.knowledgeBaseDocumentResource(kb).ServeHTTP(w, r)
+}
+
+// knowledgeBaseDocumentResource manages the documents of a knowledge base.
+// Storing a document embeds its chunks, so PUT fails if the upstream does.
+func (s *ProxyServer) knowledgeBaseDocumentResource(kb KnowledgeBase) resourceHandler[RAGDocument] {
+	return resourceHandler[RAGDocument]{
+		lock: kb.docs.lockWrites,
+		get: func(id string) (RAGDocument, string, bool) {
+			doc, ok := kb.docs.Get(id)
+			return doc, etagFor(doc), ok
+		},
+		put: func(id string, doc RAGDocument, _ *RAGDocument) (bool, error) {
+			if doc.ID != "" && doc.ID != id {
+				return false, fmt.Errorf("id in body does not match id in path")
+			}
+			doc.ID = id
+			// A document stored by hand is no longer the connector's
+			doc.Connector, doc.Version = "", ""
+			doc, err := s.indexDocument(kb, doc)
+			if err != nil {
+				return false, err
+			}
+			created := kb.docs.Put(id, doc)
+			kb.stats.touch(false)
+			return created, nil
+		},
+		remove: func(id string) bool {
+			if !kb.docs.Delete(id) {
+				return false
+			}
+			kb.stats.touch(false)
+			return true
+		},
+		view: func(doc RAGDocument) any { return doc },
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func knowledgeBaseMux(server *ProxyServer) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/knowledge-bases", server.handleAdminKnowledgeBases)
+	mux.HandleFunc("/admin/knowledge-bases/{id}", server.adminKnowledgeBaseHandler().ServeHTTP)
+	mux.HandleFunc("/admin/knowledge-bases/{id}/reindex", server.handleAdminReindex)
+	mux.HandleFunc("/admin/knowledge-bases/{kb}/documents", server.handleAdminKnowledgeBaseDocuments)
+	mux.HandleFunc("/admin/knowledge-bases/{kb}/documents/{id}", server.handleAdminKnowledgeBaseDocuments)
+	return mux
+}
+
+func TestAdminKnowledgeBases(t *testing.T) {
+	client := &ragClient{}
+	server := NewProxyServer(client)
+	mux := knowledgeBaseMux(server)
+
+	w := adminRequest(mux, http.MethodPut, "/admin/knowledge-bases/acme-docs", `{"tenant": "acme", "description": "Product manuals"}`, nil)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	adminRequest(mux, http.MethodPut, "/admin/knowledge-bases/globex-docs", `{"tenant": "globex"}`, nil)
+	if w := adminRequest(mux, http.MethodPut, "/admin/knowledge-bases/bad", `{"retrieval": {"mode": "fuzzy"}}`, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d for an invalid retrieval mode, got %d", http.StatusBadRequest, w.Code)
+	}
+	if w := adminRequest(mux, http.MethodPut, "/admin/knowledge-bases/missing/documents/a", `{"text": "x"}`, nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d for documents of an unknown knowledge base, got %d", http.StatusNotFound, w.Code)
+	}
+
+	for id, text := range map[string]string{"manual": "Reset the password with the red button.", "faq": "Shipping takes 3 days.\n\nRefunds take 14 days."} {
+		if w := adminRequest(mux, http.MethodPut, "/admin/knowledge-bases/acme-docs/documents/"+id, `{"text": "`+strings.ReplaceAll(text, "\n", `\n`)+`"}`, nil); w.Code != http.StatusCreated {
+			t.Fatalf("Expected status code %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+		}
+	}
+
+	var view KnowledgeBaseView
+	w = adminRequest(mux, http.MethodGet, "/admin/knowledge-bases/acme-docs", "", nil)
+	json.Unmarshal(w.Body.Bytes(), &view)
+	if view.Documents != 2 || view.Chunks != 2 || view.Updated == nil || view.Reindexed != nil {
+		t.Errorf("Expected stats for 2 documents and 2 chunks, got %+v", view)
+	}
+
+	var list struct {
+		KnowledgeBases []KnowledgeBaseView `json:"knowledge_bases"`
+	}
+	w = adminRequest(mux, http.MethodGet, "/admin/knowledge-bases?tenant=globex", "", nil)
+	json.Unmarshal(w.Body.Bytes(), &list)
+	if len(list.KnowledgeBases) != 1 || list.KnowledgeBases[0].ID != "globex-docs" {
+		t.Errorf("Expected only the globex knowledge base, got %+v", list.KnowledgeBases)
+	}
+	var docs struct {
+		Documents []RAGDocument `json:"documents"`
+	}
+	w = adminRequest(mux, http.MethodGet, "/admin/knowledge-bases/acme-docs/documents", "", nil)
+	json.Unmarshal(w.Body.Bytes(), &docs)
+	if len(docs.Documents) != 2 || docs.Documents[0].ID != "faq" {
+		t.Errorf("Expected both documents, got %+v", docs.Documents)
+	}
+
+	// Changing the embedding model reindexes, keeping the documents
+	client.models = nil
+	w = adminRequest(mux, http.MethodPut, "/admin/knowledge-bases/acme-docs", `{"tenant": "acme", "embedding_model": "text-embedding-3-large"}`, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	json.Unmarshal(w.Body.Bytes(), &view)
+	if view.Documents != 2 || view.Reindexed == nil || len(client.models) != 2 || client.models[0] != "text-embedding-3-large" {
+		t.Errorf("Expected both documents to be embedded again with the new model, got %+v and %v", view, client.models)
+	}
+	client.models = nil
+	if w := adminRequest(mux, http.MethodPost, "/admin/knowledge-bases/acme-docs/reindex", "", nil); w.Code != http.StatusOK || len(client.models) != 2 {
+		t.Errorf("Expected a reindex of both documents, got %d and %v", w.Code, client.models)
+	}
+
+	if w := adminRequest(mux, http.MethodDelete, "/admin/knowledge-bases/acme-docs/documents/faq", "", nil); w.Code != http.StatusNoContent {
+		t.Errorf("Expected status code %d, got %d", http.StatusNoContent, w.Code)
+	}
+	w = adminRequest(mux, http.MethodGet, "/admin/knowledge-bases/acme-docs", "", nil)
+	json.Unmarshal(w.Body.Bytes(), &view)
+	if view.Documents != 1 {
+		t.Errorf("Expected 1 document after the delete, got %d", view.Documents)
+	}
+}
+
+func TestProxyServer_KnowledgeBaseIsolation(t *testing.T) {
+	client := &ragClient{reply: "Hello"}
+	server := NewProxyServer(client)
+	mux := knowledgeBaseMux(server)
+	adminRequest(mux, http.MethodPut, "/admin/knowledge-bases/acme-docs", `{"tenant": "acme", "retrieval": {"mode": "keyword"}}`, nil)
+	adminRequest(mux, http.MethodPut, "/admin/knowledge-bases/acme-docs/documents/refunds", `{"text": "A refund needs the receipt."}`, nil)
+
+	body := `{"model": "gpt-4o", "messages": [{"role": "user", "content": "Where is my receipt?"}], "rag": {"knowledge_base": "acme-docs"}}`
+	w := chatRequestAs(server, &ClientKey{ID: "globex-app", Tenant: "globex"}, body)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "unknown knowledge base") {
+		t.Errorf("Expected another tenant's knowledge base to look unknown, got %d: %s", w.Code, w.Body.String())
+	}
+
+	client.models = nil
+	w = chatRequestAs(server, &ClientKey{ID: "acme-app", Tenant: "acme"}, body)
+	var resp ChatCompletionResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Metadata == nil || len(resp.Metadata.Citations) != 1 || resp.Metadata.Citations[0].KnowledgeBase != "acme-docs" {
+		t.Fatalf("Expected a citation from the tenant's knowledge base, got %s", w.Body.String())
+	}
+	if len(client.models) != 0 {
+		t.Errorf("Expected the knowledge base's keyword mode to skip embedding the query, got %v", client.models)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Callers with a deadline of their own can send X-Latency-Budget-Ms. When
+// the time the request has already spent in the proxy plus the latency
+// expected of its upstream model exceeds the budget, the request is
+// rejected at once, so the caller can fall back instead of waiting for it
+// to time out.
+
+const latencyBudgetHeader = "X-Latency-Budget-Ms"
+
+// latencyWindow is how many of the latest successful requests per endpoint
+// and model the expected latency is estimated from, and latencyMinSamples
+// how many it takes before requests are rejected at all
+const (
+	latencyWindow     = 256
+	latencyMinSamples = 20
+)
+
+// recentLatencies keeps the latency of the latest successful requests per
+// endpoint and model. Unlike the latency histograms, which count from
+// startup, they follow the upstream as it speeds up or slows down.
+type recentLatencies struct {
+	// quantile of the recent latencies that is expected of a request
+	quantile float64
+
+	mu     sync.Mutex
+	series map[string]*latencyRing
+}
+
+type latencyRing struct {
+	samples []int64
+	next    int
+}
+
+func newRecentLatencies(quantile float64) *recentLatencies {
+	return &recentLatencies{quantile: quantile, series: make(map[string]*latencyRing)}
+}
+
+// Observe records the latency of a successful request
+func (l *recentLatencies) Observe(endpoint, model string, latencyMS int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	key := seriesKey([]string{endpoint, model})
+	ring, ok := l.series[key]
+	if !ok {
+		ring = &latencyRing{}
+		l.series[key] = ring
+	}
+	if len(ring.samples) < latencyWindow {
+		ring.samples = append(ring.samples, latencyMS)
+		return
+	}
+	ring.samples[ring.next] = latencyMS
+	ring.next = (ring.next + 1) % latencyWindow
+}
+
+// Expected returns the expected latency of a request for endpoint and
+// model, and false while too few have been seen to tell
+func (l *recentLatencies) Expected(endpoint, model string) (time.Duration, bool) {
+	l.mu.Lock()
+	ring, ok := l.series[seriesKey([]string{endpoint, model})]
+	var samples []int64
+	if ok {
+		samples = slices.Clone(ring.samples)
+	}
+	l.mu.Unlock()
+	if len(samples) < latencyMinSamples {
+		return 0, false
+	}
+	slices.Sort(samples)
+	i := min(int(l.quantile*float64(len(samples))), len(samples)-1)
+	return time.Duration(samples[i]) * time.Millisecond, true
+}
+
+// checkLatencyBudget rejects a request for model whose budget cannot be
+// met and reports whether it may proceed. Requests without a budget always
+// may.
+func (s *ProxyServer) checkLatencyBudget(w http.ResponseWriter, r *http.Request, endpoint, model string) bool {
+	v := r.Header.Get(latencyBudgetHeader)
+	if v == "" {
+		return true
+	}
+	budgetMS, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || budgetMS <= 0 {
+		http.Error(w, fmt.Sprintf("Invalid %s header %q, expected a positive number of milliseconds", latencyBudgetHeader, v), http.StatusBadRequest)
+		return false
+	}
+	expected, ok := s.latencies.Expected(endpoint, model)
+	if !ok {
+		return true
+	}
+	waited := timelineFromContext(r.Context()).elapsed()
+	estimate := waited + expected
+	if estimate <= time.Duration(budgetMS)*time.Millisecond {
+		return true
+	}
+	var resp ErrorResponse
+	resp.Error.Message = fmt.Sprintf("Expected latency of %s is %dms (%dms waited, %dms upstream), over the budget of %dms",
+		model, estimate.Milliseconds(), waited.Milliseconds(), expected.Milliseconds(), budgetMS)
+	resp.Error.Type = "latency_budget_error"
+	resp.Error.Code = "latency_budget_exceeded"
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Latency-Estimate-Ms", strconv.FormatInt(estimate.Milliseconds(), 10))
+	w.WriteHeader(http.StatusGatewayTimeout)
+	json.NewEncoder(w).Encode(resp)
+	return false
+}
+
+// latencyQuantileFromEnv parses PROXY_LATENCY_BUDGET_QUANTILE, the quantile
+// of recent latencies a request is expected to take
+func latencyQuantileFromEnv(getenv func(string) string) (float64, error) {
+	v := getenv("PROXY_LATENCY_BUDGET_QUANTILE")
+	if v == "" {
+		return 0.5, nil
+	}
+	q, err := strconv.ParseFloat(v, 64)
+	if err != nil || q <= 0 || q > 1 {
+		return 0, fmt.Errorf("invalid PROXY_LATENCY_BUDGET_QUANTILE %q, expected a quantile between 0 and 1", v)
+	}
+	return q, nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecentLatencies_Expected(t *testing.T) {
+	l := newRecentLatencies(0.5)
+	for i := 0; i < latencyMinSamples-1; i++ {
+		l.Observe("chat.completions", "gpt-4o", 100)
+	}
+	if _, ok := l.Expected("chat.completions", "gpt-4o"); ok {
+		t.Error("Expected no estimate from too few samples")
+	}
+	l.Observe("chat.completions", "gpt-4o", 100)
+	if d, ok := l.Expected("chat.completions", "gpt-4o"); !ok || d != 100*time.Millisecond {
+		t.Errorf("Expected 100ms, got %v %v", d, ok)
+	}
+
+	// Only the latest samples count
+	for i := 0; i < latencyWindow; i++ {
+		l.Observe("chat.completions", "gpt-4o", 2000)
+	}
+	if d, _ := l.Expected("chat.completions", "gpt-4o"); d != 2*time.Second {
+		t.Errorf("Expected the estimate to follow the upstream, got %v", d)
+	}
+	if _, ok := l.Expected("chat.completions", "gpt-4o-mini"); ok {
+		t.Error("Expected models to be estimated separately")
+	}
+}
+
+func TestProxyServer_LatencyBudget(t *testing.T) {
+	server := NewProxyServer(&MockOpenAIClient{response: createTestChatCompletionResponse()})
+	for i := 0; i < latencyMinSamples; i++ {
+		server.latencies.Observe("chat.completions", "gpt-4o", 3000)
+	}
+	send := func(model, budget string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "`+model+`", "messages": [{"role": "user", "content": "Hi"}]}`))
+		req.Header.Set(latencyBudgetHeader, budget)
+		w := httptest.NewRecorder()
+		server.Handler().ServeHTTP(w, req)
+		return w
+	}
+
+	w := send("gpt-4o", "1000")
+	if w.Code != http.StatusGatewayTimeout {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusGatewayTimeout, w.Code, w.Body.String())
+	}
+	var resp ErrorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Error.Code != "latency_budget_exceeded" {
+		t.Errorf("Unexpected error body %s", w.Body.String())
+	}
+	if estimate, _ := strconv.Atoi(w.Header().Get("X-Latency-Estimate-Ms")); estimate < 3000 {
+		t.Errorf("Expected the estimate in the reply, got %q", w.Header().Get("X-Latency-Estimate-Ms"))
+	}
+
+	for budget, want := range map[string]int{"10000": http.StatusOK, "soon": http.StatusBadRequest} {
+		if w := send("gpt-4o", budget); w.Code != want {
+			t.Errorf("Budget %s: expected status code %d, got %d", budget, want, w.Code)
+		}
+	}
+	if w := send("gpt-4o-mini", "1000"); w.Code != http.StatusOK {
+		t.Errorf("Expected models without recent latencies to be let through, got %d", w.Code)
+	}
+}
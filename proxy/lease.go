@@ -0,0 +1,250 @@
+//go:build !edge && !wasip1
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// Kubernetes serializes Lease timestamps as MicroTime
+const microTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+// kubeLease is the subset of a coordination.k8s.io/v1 Lease the proxy uses
+type kubeLease struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name            string `json:"name"`
+		Namespace       string `json:"namespace,omitempty"`
+		ResourceVersion string `json:"resourceVersion,omitempty"`
+	} `json:"metadata"`
+	Spec struct {
+		HolderIdentity       string `json:"holderIdentity,omitempty"`
+		LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+		AcquireTime          string `json:"acquireTime,omitempty"`
+		RenewTime            string `json:"renewTime,omitempty"`
+		LeaseTransitions     int    `json:"leaseTransitions,omitempty"`
+	} `json:"spec"`
+}
+
+// kubeLeaseLocker implements Locker on top of Kubernetes Leases, the same
+// mechanism controllers use for leader election. Updates carry the Lease's
+// resourceVersion, so two replicas racing for an expired Lease cannot both
+// win: the API server rejects the slower write with 409 Conflict.
+type kubeLeaseLocker struct {
+	baseURL   string
+	namespace string
+	token     func() (string, error)
+	client    *http.Client
+	now       func() time.Time
+}
+
+// newInClusterLeaseLocker configures the locker from the pod's service
+// account, as mounted by Kubernetes
+func newInClusterLeaseLocker(namespace string) (*kubeLeaseLocker, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a Kubernetes cluster")
+	}
+	if namespace == "" {
+		data, err := os.ReadFile(serviceAccountDir + "/namespace")
+		if err != nil {
+			return nil, fmt.Errorf("failed to read pod namespace: %w", err)
+		}
+		namespace = strings.TrimSpace(string(data))
+	}
+	ca, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cluster CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca)
+
+	return &kubeLeaseLocker{
+		baseURL:   "https://" + strings.Trim(host, "[]") + ":" + port,
+		namespace: namespace,
+		// Service account tokens are rotated, so read it for every request
+		token: func() (string, error) { return readSecretFile(serviceAccountDir + "/token") },
+		client: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+		now: time.Now,
+	}, nil
+}
+
+func (l *kubeLeaseLocker) leaseURL(name string) string {
+	url := fmt.Sprintf("%s/apis/coordination.k8s.io/v1/namespaces/%s/leases", l.baseURL, l.namespace)
+	if name != "" {
+		url += "/" + name
+	}
+	return url
+}
+
+// do sends a request to the API server and decodes a Lease from a 2xx
+// response. It returns the status code so callers can react to 404 and 409.
+func (l *kubeLeaseLocker) do(ctx context.Context, method, url string, body *kubeLease) (*kubeLease, int, error) {
+	var payload io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, 0, err
+		}
+		payload = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, payload)
+	if err != nil {
+		return nil, 0, err
+	}
+	token, err := l.token()
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read service account token: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, resp.StatusCode, nil
+	}
+	var lease kubeLease
+	if err := json.Unmarshal(data, &lease); err != nil {
+		return nil, resp.StatusCode, fmt.Errorf("failed to parse lease: %w", err)
+	}
+	return &lease, resp.StatusCode, nil
+}
+
+func (l *kubeLeaseLocker) expired(lease *kubeLease) bool {
+	if lease.Spec.HolderIdentity == "" {
+		return true
+	}
+	renewed, err := time.Parse(microTimeFormat, lease.Spec.RenewTime)
+	if err != nil {
+		return true
+	}
+	return l.now().After(renewed.Add(time.Duration(lease.Spec.LeaseDurationSeconds) * time.Second))
+}
+
+func (l *kubeLeaseLocker) Acquire(ctx context.Context, name, holder string, ttl time.Duration) (bool, error) {
+	now := l.now().UTC().Format(microTimeFormat)
+	seconds := int(ttl.Round(time.Second) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	lease, status, err := l.do(ctx, http.MethodGet, l.leaseURL(name), nil)
+	if err != nil {
+		return false, err
+	}
+	switch {
+	case status == http.StatusNotFound:
+		lease = &kubeLease{APIVersion: "coordination.k8s.io/v1", Kind: "Lease"}
+		lease.Metadata.Name = name
+		lease.Spec.HolderIdentity = holder
+		lease.Spec.LeaseDurationSeconds = seconds
+		lease.Spec.AcquireTime = now
+		lease.Spec.RenewTime = now
+		_, status, err = l.do(ctx, http.MethodPost, l.leaseURL(""), lease)
+		if err != nil {
+			return false, err
+		}
+		if status == http.StatusConflict {
+			return false, nil
+		}
+		if status < 200 || status > 299 {
+			return false, fmt.Errorf("failed to create lease: status %d", status)
+		}
+		return true, nil
+	case status != http.StatusOK:
+		return false, fmt.Errorf("failed to get lease: status %d", status)
+	}
+
+	if lease.Spec.HolderIdentity != holder {
+		if !l.expired(lease) {
+			return false, nil
+		}
+		lease.Spec.HolderIdentity = holder
+		lease.Spec.AcquireTime = now
+		lease.Spec.LeaseTransitions++
+	}
+	lease.Spec.LeaseDurationSeconds = seconds
+	lease.Spec.RenewTime = now
+
+	_, status, err = l.do(ctx, http.MethodPut, l.leaseURL(name), lease)
+	if err != nil {
+		return false, err
+	}
+	if status == http.StatusConflict {
+		return false, nil
+	}
+	if status != http.StatusOK {
+		return false, fmt.Errorf("failed to update lease: status %d", status)
+	}
+	return true, nil
+}
+
+// Release clears the holder so another replica can take over without
+// waiting for the lease to expire
+func (l *kubeLeaseLocker) Release(ctx context.Context, name, holder string) error {
+	lease, status, err := l.do(ctx, http.MethodGet, l.leaseURL(name), nil)
+	if err != nil || status != http.StatusOK || lease.Spec.HolderIdentity != holder {
+		return err
+	}
+	lease.Spec.HolderIdentity = ""
+	_, status, err = l.do(ctx, http.MethodPut, l.leaseURL(name), lease)
+	if err == nil && status != http.StatusOK && status != http.StatusConflict {
+		err = fmt.Errorf("failed to release lease: status %d", status)
+	}
+	return err
+}
+
+// leaderElectorFromEnv configures leader election from PROXY_LEADER_ELECTION.
+// It returns nil when the proxy runs as a single replica.
+func leaderElectorFromEnv(getenv func(string) string) (*leaderElector, error) {
+	identity := getenv("POD_NAME")
+	if identity == "" {
+		identity, _ = os.Hostname()
+	}
+	name := getenv("PROXY_LEASE_NAME")
+	if name == "" {
+		name = "vibethon-proxy"
+	}
+	ttl := 15 * time.Second
+
+	switch backend := getenv("PROXY_LEADER_ELECTION"); backend {
+	case "":
+		return nil, nil
+	case "redis":
+		addr := getenv("PROXY_REDIS_ADDR")
+		if addr == "" {
+			return nil, fmt.Errorf("PROXY_REDIS_ADDR is required for redis leader election")
+		}
+		client := newRedisClient(addr, getenv("PROXY_REDIS_PASSWORD"))
+		return newLeaderElector(newRedisLocker(client), name, identity, ttl), nil
+	case "kubernetes":
+		locker, err := newInClusterLeaseLocker(getenv("PROXY_LEASE_NAMESPACE"))
+		if err != nil {
+			return nil, err
+		}
+		return newLeaderElector(locker, name, identity, ttl), nil
+	default:
+		return nil, fmt.Errorf("unknown PROXY_LEADER_ELECTION backend %q", backend)
+	}
+}
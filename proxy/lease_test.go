@@ -0,0 +1,128 @@
+//go:build !edge && !wasip1
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeLeaseAPI emulates the Kubernetes Lease API, including optimistic
+// concurrency on resourceVersion
+type fakeLeaseAPI struct {
+	mu      sync.Mutex
+	lease   *kubeLease
+	version int
+}
+
+func (f *fakeLeaseAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.Header.Get("Authorization") != "Bearer test-token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, "/apis/coordination.k8s.io/v1/namespaces/proxy/leases") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if f.lease == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(f.lease)
+	case http.MethodPost, http.MethodPut:
+		var lease kubeLease
+		json.NewDecoder(r.Body).Decode(&lease)
+		if r.Method == http.MethodPost && f.lease != nil {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		if r.Method == http.MethodPut && lease.Metadata.ResourceVersion != strconv.Itoa(f.version) {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		f.version++
+		lease.Metadata.ResourceVersion = strconv.Itoa(f.version)
+		f.lease = &lease
+		json.NewEncoder(w).Encode(f.lease)
+	}
+}
+
+func newTestLeaseLocker(url string, now *time.Time) *kubeLeaseLocker {
+	return &kubeLeaseLocker{
+		baseURL:   url,
+		namespace: "proxy",
+		token:     func() (string, error) { return "test-token", nil },
+		client:    http.DefaultClient,
+		now:       func() time.Time { return *now },
+	}
+}
+
+func TestKubeLeaseLocker(t *testing.T) {
+	api := &fakeLeaseAPI{}
+	ts := httptest.NewServer(api)
+	defer ts.Close()
+
+	now := time.Now()
+	locker := newTestLeaseLocker(ts.URL, &now)
+	ctx := context.Background()
+
+	if ok, err := locker.Acquire(ctx, "vibethon-proxy", "pod-a", 15*time.Second); err != nil || !ok {
+		t.Fatalf("Expected pod-a to create and acquire the lease, got %v, %v", ok, err)
+	}
+	if ok, err := locker.Acquire(ctx, "vibethon-proxy", "pod-b", 15*time.Second); err != nil || ok {
+		t.Errorf("Expected pod-b not to acquire a held lease, got %v, %v", ok, err)
+	}
+	if ok, _ := locker.Acquire(ctx, "vibethon-proxy", "pod-a", 15*time.Second); !ok {
+		t.Error("Expected pod-a to renew its lease")
+	}
+
+	// Once pod-a stops renewing, pod-b takes over
+	now = now.Add(20 * time.Second)
+	if ok, err := locker.Acquire(ctx, "vibethon-proxy", "pod-b", 15*time.Second); err != nil || !ok {
+		t.Fatalf("Expected pod-b to acquire the expired lease, got %v, %v", ok, err)
+	}
+	if api.lease.Spec.HolderIdentity != "pod-b" || api.lease.Spec.LeaseTransitions != 1 {
+		t.Errorf("Unexpected lease after takeover: %+v", api.lease.Spec)
+	}
+
+	if err := locker.Release(ctx, "vibethon-proxy", "pod-b"); err != nil {
+		t.Fatalf("Failed to release lease: %v", err)
+	}
+	if ok, _ := locker.Acquire(ctx, "vibethon-proxy", "pod-a", 15*time.Second); !ok {
+		t.Error("Expected pod-a to acquire the released lease immediately")
+	}
+}
+
+func TestKubeLeaseLocker_Conflict(t *testing.T) {
+	api := &fakeLeaseAPI{}
+	ts := httptest.NewServer(api)
+	defer ts.Close()
+
+	now := time.Now()
+	locker := newTestLeaseLocker(ts.URL, &now)
+	locker.Acquire(context.Background(), "vibethon-proxy", "pod-a", 15*time.Second)
+
+	// Simulate another replica winning the race for the expired lease: the
+	// version pod-b read is stale by the time its update arrives
+	api.lease.Spec.RenewTime = now.Add(-time.Minute).UTC().Format(microTimeFormat)
+	api.version++
+	ok, err := locker.Acquire(context.Background(), "vibethon-proxy", "pod-b", 15*time.Second)
+	if err != nil {
+		t.Fatalf("Expected conflict to be handled, got %v", err)
+	}
+	if ok {
+		t.Error("Expected pod-b to lose the race on a conflicting update")
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Commercial deployments run under an entitlement file signed by the
+// vendor: it names the customer, the features they bought, how many tenants
+// they may create and when it expires. The file is checked at startup and
+// its expiry every hour, and a missing, tampered or expired one never stops
+// the proxy: an expired license keeps everything working for a grace
+// period, after which, as with an invalid one, only the core proxy runs and
+// licensed features stop, without waiting for a restart.
+//
+// Only release builds check licenses. They embed the vendor's public key,
+// and without PROXY_LICENSE_FILE they run in restricted mode, as with an
+// invalid file. Builds from source without the key have nothing to check a
+// file against and are not restricted at all.
+
+// licensePublicKey is the base64 Ed25519 key entitlements are signed with.
+// Release builds embed it with -ldflags "-X main.licensePublicKey=...", as
+// the Dockerfile does with its LICENSE_PUBLIC_KEY build argument. It is
+// never read from the environment, where whoever runs the proxy could
+// swap in a key of their own.
+var licensePublicKey string
+
+// Licensed features, named in entitlements
+const (
+	LicensedProviders = "providers"
+	LicensedAnalytics = "analytics"
+	LicensedUsageSink = "usage_sink"
+	LicensedBridges   = "bridges"
+)
+
+// License states
+const (
+	LicenseValid   = "valid"
+	LicenseGrace   = "grace"
+	LicenseExpired = "expired"
+	LicenseInvalid = "invalid"
+)
+
+// defaultLicenseGrace is how long an expired license keeps working unless
+// the entitlement says otherwise
+const defaultLicenseGrace = 14 * 24 * time.Hour
+
+// Entitlement is the signed content of an entitlement file
+type Entitlement struct {
+	Customer string `json:"customer"`
+	// MaxTenants caps the tenants of the admin API, 0 for no limit
+	MaxTenants int `json:"max_tenants,omitempty"`
+	// Features are the licensed features, or "*" for all of them
+	Features  []string  `json:"features"`
+	IssuedAt  time.Time `json:"issued_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// GraceDays is how long the license keeps working after it expires. It
+	// defaults to 14.
+	GraceDays int `json:"grace_days,omitempty"`
+}
+
+// entitlementFile is the format of PROXY_LICENSE_FILE. The signature covers
+// the exact bytes of the entitlement member, so nothing is canonicalized.
+type entitlementFile struct {
+	Entitlement json.RawMessage `json:"entitlement"`
+	Signature   string          `json:"signature"`
+}
+
+// license is the entitlement the proxy runs under
+type license struct {
+	path string
+
+	mu          sync.Mutex
+	entitlement Entitlement
+	// problem is why the license is invalid, if it is
+	problem string
+	status  string
+}
+
+// licenseFromEnv reads the entitlement file named by PROXY_LICENSE_FILE. It
+// returns nil, for no restrictions, when neither the file nor a public key
+// is configured. Problems with the file, or a release build without one,
+// are logged rather than returned, so they put the proxy in restricted mode
+// instead of stopping it.
+func licenseFromEnv(getenv func(string) string, now time.Time) *license {
+	path := getenv("PROXY_LICENSE_FILE")
+	if path == "" && licensePublicKey == "" {
+		return nil
+	}
+	l := &license{path: path}
+	entitlement, err := readEntitlement(path, licensePublicKey)
+	if err != nil {
+		l.problem = err.Error()
+	}
+	l.entitlement = entitlement
+	l.Check(now)
+	return l
+}
+
+// readEntitlement reads and verifies an entitlement file
+func readEntitlement(path, publicKey string) (Entitlement, error) {
+	var entitlement Entitlement
+	key, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return entitlement, fmt.Errorf("this build has no valid license public key")
+	}
+	if path == "" {
+		return entitlement, fmt.Errorf("no license file is configured (PROXY_LICENSE_FILE)")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return entitlement, fmt.Errorf("failed to read license file: %w", err)
+	}
+	var file entitlementFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return entitlement, fmt.Errorf("failed to parse license file: %w", err)
+	}
+	signature, err := base64.StdEncoding.DecodeString(file.Signature)
+	if err != nil || !ed25519.Verify(ed25519.PublicKey(key), file.Entitlement, signature) {
+		return entitlement, fmt.Errorf("license signature does not match")
+	}
+	if err := json.Unmarshal(file.Entitlement, &entitlement); err != nil {
+		return entitlement, fmt.Errorf("failed to parse entitlement: %w", err)
+	}
+	if entitlement.ExpiresAt.IsZero() {
+		return Entitlement{}, fmt.Errorf("entitlement has no expiry")
+	}
+	return entitlement, nil
+}
+
+// graceUntil is when an expired license stops working
+func (l *license) graceUntil() time.Time {
+	grace := defaultLicenseGrace
+	if l.entitlement.GraceDays > 0 {
+		grace = time.Duration(l.entitlement.GraceDays) * 24 * time.Hour
+	}
+	return l.entitlement.ExpiresAt.Add(grace)
+}
+
+// Check updates the state of the license at now and logs it when it
+// changed, or every time while the license is in its grace period
+func (l *license) Check(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	status := LicenseValid
+	switch {
+	case l.problem != "":
+		status = LicenseInvalid
+	case !now.Before(l.graceUntil()):
+		status = LicenseExpired
+	case !now.Before(l.entitlement.ExpiresAt):
+		status = LicenseGrace
+	}
+	if status == l.status && status != LicenseGrace {
+		return
+	}
+	l.status = status
+	switch status {
+	case LicenseValid:
+		log.Printf("Licensed to %s until %s", l.entitlement.Customer, l.entitlement.ExpiresAt.Format(time.DateOnly))
+	case LicenseGrace:
+		log.Printf("Warning: the license of %s expired on %s; licensed features stop working on %s",
+			l.entitlement.Customer, l.entitlement.ExpiresAt.Format(time.DateOnly), l.graceUntil().Format(time.DateOnly))
+	case LicenseExpired:
+		log.Printf("Warning: the license of %s has expired; running in restricted mode", l.entitlement.Customer)
+	case LicenseInvalid:
+		log.Printf("Warning: %s; running in restricted mode", l.problem)
+	}
+}
+
+// usable reports whether the entitlement is honored. The caller holds l.mu.
+func (l *license) usable() bool {
+	return l.status == LicenseValid || l.status == LicenseGrace
+}
+
+// Allows reports whether feature is licensed
+func (l *license) Allows(feature string) bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.usable() && (slices.Contains(l.entitlement.Features, feature) || slices.Contains(l.entitlement.Features, "*"))
+}
+
+// Enable reports whether a configured feature may be used, and logs that it
+// stays off when it is not licensed
+func (l *license) Enable(feature string) bool {
+	if l.Allows(feature) {
+		return true
+	}
+	log.Printf("Warning: %s is configured but not licensed; it stays disabled", feature)
+	return false
+}
+
+// withLicense refuses requests to a licensed feature the license does not
+// allow anymore, e.g. once its grace period has run out
+func (s *ProxyServer) withLicense(feature string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.license.Allows(feature) {
+			http.Error(w, fmt.Sprintf("%s is not licensed", feature), http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// AllowsTenants reports whether count tenants are within the license. Past
+// the grace period no tenants can be added, but existing ones keep working.
+func (l *license) AllowsTenants(count int) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.usable() {
+		return fmt.Errorf("the license is %s; no tenants can be added", l.status)
+	}
+	if l.entitlement.MaxTenants > 0 && count > l.entitlement.MaxTenants {
+		return fmt.Errorf("the license allows at most %d tenants", l.entitlement.MaxTenants)
+	}
+	return nil
+}
+
+// handleAdminLicense serves GET /admin/license
+func (s *ProxyServer) handleAdminLicense(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	l := s.license
+	l.mu.Lock()
+	status := map[string]any{
+		"status":  l.status,
+		"tenants": s.tenants.Len(),
+	}
+	if l.problem != "" {
+		status["error"] = l.problem
+	} else {
+		status["entitlement"] = l.entitlement
+		status["grace_until"] = l.graceUntil()
+	}
+	l.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setTestLicenseKey stands in for the public key release builds embed
+func setTestLicenseKey(t *testing.T, publicKey ed25519.PublicKey) {
+	t.Helper()
+	previous := licensePublicKey
+	licensePublicKey = base64.StdEncoding.EncodeToString(publicKey)
+	t.Cleanup(func() { licensePublicKey = previous })
+}
+
+// writeTestLicense signs entitlement with a new key, embeds the key, and
+// returns the environment reading the file
+func writeTestLicense(t *testing.T, entitlement Entitlement) map[string]string {
+	t.Helper()
+	publicKey, privateKey, _ := ed25519.GenerateKey(nil)
+	setTestLicenseKey(t, publicKey)
+	data, _ := json.Marshal(entitlement)
+	file, _ := json.Marshal(entitlementFile{
+		Entitlement: data,
+		Signature:   base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, data)),
+	})
+	path := filepath.Join(t.TempDir(), "license.json")
+	os.WriteFile(path, file, 0o600)
+	return map[string]string{"PROXY_LICENSE_FILE": path}
+}
+
+func TestLicense_Lifecycle(t *testing.T) {
+	expires := time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)
+	env := writeTestLicense(t, Entitlement{
+		Customer:  "Acme",
+		Features:  []string{LicensedAnalytics},
+		ExpiresAt: expires,
+		GraceDays: 7,
+	})
+	l := licenseFromEnv(func(name string) string { return env[name] }, expires.Add(-time.Hour))
+
+	if l.status != LicenseValid || !l.Allows(LicensedAnalytics) || l.Allows(LicensedBridges) {
+		t.Errorf("Expected a valid license with analytics only, got %s", l.status)
+	}
+	l.Check(expires.Add(time.Hour))
+	if l.status != LicenseGrace || !l.Allows(LicensedAnalytics) {
+		t.Errorf("Expected licensed features to keep working in the grace period, got %s", l.status)
+	}
+	l.Check(expires.Add(8 * 24 * time.Hour))
+	if l.status != LicenseExpired || l.Allows(LicensedAnalytics) {
+		t.Errorf("Expected licensed features to stop after the grace period, got %s", l.status)
+	}
+	if err := l.AllowsTenants(1); err == nil {
+		t.Error("Expected no tenants to be added after the grace period")
+	}
+}
+
+func TestLicense_InvalidSignature(t *testing.T) {
+	env := writeTestLicense(t, Entitlement{Customer: "Acme", Features: []string{"*"}, ExpiresAt: time.Now().Add(time.Hour)})
+	otherKey, _, _ := ed25519.GenerateKey(nil)
+	setTestLicenseKey(t, otherKey)
+
+	l := licenseFromEnv(func(name string) string { return env[name] }, time.Now())
+	if l.status != LicenseInvalid || l.Allows(LicensedProviders) {
+		t.Errorf("Expected a license with a foreign signature to be invalid, got %s", l.status)
+	}
+	if !strings.Contains(l.problem, "signature") {
+		t.Errorf("Expected the problem to name the signature, got %q", l.problem)
+	}
+}
+
+func TestLicense_Unlicensed(t *testing.T) {
+	var l *license
+	if l = licenseFromEnv(func(string) string { return "" }, time.Now()); l != nil {
+		t.Fatal("Expected no license in a build without a public key")
+	}
+	if !l.Allows(LicensedProviders) || l.AllowsTenants(1000) != nil {
+		t.Error("Expected builds without a public key to be unrestricted")
+	}
+
+	// A release build without a license file runs in restricted mode
+	publicKey, _, _ := ed25519.GenerateKey(nil)
+	setTestLicenseKey(t, publicKey)
+	l = licenseFromEnv(func(string) string { return "" }, time.Now())
+	if l == nil || l.status != LicenseInvalid || l.Allows(LicensedProviders) || l.AllowsTenants(1) == nil {
+		t.Fatal("Expected a release build without PROXY_LICENSE_FILE to be restricted")
+	}
+	if !strings.Contains(l.problem, "PROXY_LICENSE_FILE") {
+		t.Errorf("Expected the problem to name PROXY_LICENSE_FILE, got %q", l.problem)
+	}
+}
+
+func TestLicense_IgnoresPublicKeyFromEnv(t *testing.T) {
+	env := writeTestLicense(t, Entitlement{Customer: "Acme", Features: []string{"*"}, ExpiresAt: time.Now().Add(time.Hour)})
+	publicKey := licensePublicKey
+	licensePublicKey = ""
+	env["PROXY_LICENSE_PUBLIC_KEY"] = publicKey
+
+	l := licenseFromEnv(func(name string) string { return env[name] }, time.Now())
+	if l.status != LicenseInvalid || l.Allows(LicensedProviders) {
+		t.Errorf("Expected a license checked against a key from the environment to be invalid, got %s", l.status)
+	}
+}
+
+func TestProxyServer_LicenseLimitsTenants(t *testing.T) {
+	env := writeTestLicense(t, Entitlement{Customer: "Acme", MaxTenants: 1, ExpiresAt: time.Now().Add(24 * time.Hour)})
+	server := NewProxyServer(&MockOpenAIClient{})
+	server.keys = createTestKeyStore(t)
+	server.license = licenseFromEnv(func(name string) string { return env[name] }, time.Now())
+	handler := server.Handler()
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer sk-admin-rw")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	if w := do("PUT", "/admin/tenants/acme", `{"name": "Acme"}`); w.Code != http.StatusCreated {
+		t.Fatalf("Expected the first tenant to be created, got %d %s", w.Code, w.Body.String())
+	}
+	if w := do("PUT", "/admin/tenants/acme", `{"name": "Acme Corp"}`); w.Code != http.StatusOK {
+		t.Errorf("Expected existing tenants to stay editable, got %d %s", w.Code, w.Body.String())
+	}
+	if w := do("PUT", "/admin/tenants/globex", `{"name": "Globex"}`); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "at most 1") {
+		t.Errorf("Expected the second tenant to be refused, got %d %s", w.Code, w.Body.String())
+	}
+
+	w := do("GET", "/admin/license", "")
+	var status struct {
+		Status      string      `json:"status"`
+		Tenants     int         `json:"tenants"`
+		Entitlement Entitlement `json:"entitlement"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Expected the license status, got %d %s", w.Code, w.Body.String())
+	}
+	if status.Status != LicenseValid || status.Tenants != 1 || status.Entitlement.Customer != "Acme" {
+		t.Errorf("Expected a valid license for Acme with one tenant, got %+v", status)
+	}
+}
+
+func TestProxyServer_LicenseExpiresWhileRunning(t *testing.T) {
+	expires := time.Now().Add(time.Hour)
+	env := writeTestLicense(t, Entitlement{Customer: "Acme", Features: []string{"*"}, ExpiresAt: expires, GraceDays: 1})
+	server := NewProxyServer(&MockOpenAIClient{})
+	server.license = licenseFromEnv(func(name string) string { return env[name] }, time.Now())
+	server.bridges = map[string]http.Handler{"/bridges/test": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+	anthropic := NewRealOpenAIClient("sk-anthropic")
+	router := &providerRouter{
+		providers: []routedProvider{{name: "anthropic", models: []string{"claude-*"}, backend: anthropic}},
+		fallback:  NewRealOpenAIClient("sk-openai"),
+		license:   server.license,
+	}
+	handler := server.Handler()
+	bridge := func() int {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("POST", "/bridges/test", nil))
+		return w.Code
+	}
+
+	if bridge() != http.StatusOK || router.backend("claude-sonnet-4") != chatBackend(anthropic) {
+		t.Fatal("Expected licensed features to work")
+	}
+	// Past the grace period the features stop without a restart
+	server.license.Check(expires.Add(48 * time.Hour))
+	if code := bridge(); code != http.StatusForbidden {
+		t.Errorf("Expected the bridge to be refused, got %d", code)
+	}
+	if router.backend("claude-sonnet-4") != chatBackend(router.fallback) {
+		t.Error("Expected every model to go to the fallback")
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// KeyLimits caps the traffic a client key may send. Zero values mean unlimited.
+type KeyLimits struct {
+	RequestsPerMinute int `json:"requests_per_minute,omitempty"`
+	TokensPerMinute   int `json:"tokens_per_minute,omitempty"`
+}
+
+// counterStore holds the counters behind rate limiting. Counter keys embed
+// the window they count, so each window starts from zero and stores are
+// free to drop counters once their window is over.
+type counterStore interface {
+	// Add increments the counter by n
+	Add(key string, n int64)
+	// Get returns the counter's current value
+	Get(key string) int64
+}
+
+// rateLimiter enforces KeyLimits over one-minute windows aligned to the
+// clock, so every replica sharing a counterStore agrees on window bounds.
+// Usage does not reset on the minute but fades out over the next one, like
+// a token bucket refilling at the limit per minute: a request is counted
+// against everything of the current window and the share of the previous
+// window the last sixty seconds still overlap, so a client cannot send
+// twice its limit across a window boundary.
+type rateLimiter struct {
+	mu       sync.Mutex
+	counters counterStore
+	now      func() time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return newRateLimiterWithStore(newLocalCounters())
+}
+
+func newRateLimiterWithStore(counters counterStore) *rateLimiter {
+	return &rateLimiter{counters: counters, now: time.Now}
+}
+
+// windowKeys returns the request and token counter keys for id in the
+// current window
+func (l *rateLimiter) windowKeys(id string) (string, string) {
+	return windowKeysAt(id, l.now().Truncate(time.Minute))
+}
+
+// windowKeysAt returns the request and token counter keys for id in the
+// window starting at window
+func windowKeysAt(id string, window time.Time) (string, string) {
+	start := strconv.FormatInt(window.Unix(), 10)
+	return id + ":req:" + start, id + ":tok:" + start
+}
+
+// rateLimitStatus is where a client stands against one of its limits
+type rateLimitStatus struct {
+	// Limit is 0 if the client is not limited
+	Limit     int
+	Remaining int
+	// Reset is how long until the client has its whole allowance again
+	Reset time.Duration
+	// wait is how long until a rejected request would be admitted
+	wait time.Duration
+}
+
+// rateLimitState is where a client stands against its request and token
+// limits
+type rateLimitState struct {
+	Requests rateLimitStatus
+	Tokens   rateLimitStatus
+}
+
+// RetryAfter is how long a rejected client should wait before retrying
+func (s rateLimitState) RetryAfter() time.Duration {
+	return max(s.Requests.wait, s.Tokens.wait)
+}
+
+// tighter combines two states, keeping for each limit the one with the
+// least remaining
+func (s rateLimitState) tighter(other rateLimitState) rateLimitState {
+	pick := func(a, b rateLimitStatus) rateLimitStatus {
+		if a.Limit == 0 || b.Limit > 0 && b.Remaining < a.Remaining {
+			return b
+		}
+		return a
+	}
+	return rateLimitState{Requests: pick(s.Requests, other.Requests), Tokens: pick(s.Tokens, other.Tokens)}
+}
+
+// sliding computes the status of a limit from the counts of the previous
+// and current windows, elapsed into the current one
+func sliding(limit int, previous, current int64, elapsed time.Duration) rateLimitStatus {
+	fading := float64(previous) * (1 - elapsed.Seconds()/60)
+	used := fading + float64(current)
+	status := rateLimitStatus{Limit: limit, Remaining: max(0, limit-int(math.Ceil(used)))}
+	// The previous window is gone by the end of this one, and this one a
+	// minute after that
+	if current > 0 {
+		status.Reset = 2*time.Minute - elapsed
+	} else if previous > 0 {
+		status.Reset = time.Minute - elapsed
+	}
+	if used < float64(limit) {
+		return status
+	}
+	// The previous window fades out until the end of this one, after which
+	// this one does
+	excess := used - float64(limit) + 1
+	if previous > 0 && excess <= fading {
+		status.wait = time.Duration(excess / float64(previous) * float64(time.Minute))
+	} else {
+		status.wait = time.Minute - elapsed + time.Duration((excess-fading)/float64(max(current, 1))*float64(time.Minute))
+	}
+	return status
+}
+
+// setRateLimitHeaders reports state in the X-RateLimit-* headers OpenAI
+// sends, plus Retry-After if the request was rejected
+func setRateLimitHeaders(h http.Header, state rateLimitState) {
+	for name, status := range map[string]rateLimitStatus{"Requests": state.Requests, "Tokens": state.Tokens} {
+		if status.Limit == 0 {
+			continue
+		}
+		h.Set("X-RateLimit-Limit-"+name, strconv.Itoa(status.Limit))
+		h.Set("X-RateLimit-Remaining-"+name, strconv.Itoa(status.Remaining))
+		h.Set("X-RateLimit-Reset-"+name, status.Reset.Round(time.Second).String())
+	}
+	if wait := state.RetryAfter(); wait > 0 {
+		h.Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	}
+}
+
+// Allow counts a request against id and reports whether it is within limits.
+// Token limits are checked against tokens already recorded.
+func (l *rateLimiter) Allow(id string, limits KeyLimits) bool {
+	_, ok := l.Check(id, limits)
+	return ok
+}
+
+// Check is Allow, also returning where id stands against its limits
+func (l *rateLimiter) Check(id string, limits KeyLimits) (rateLimitState, bool) {
+	if limits.RequestsPerMinute <= 0 && limits.TokensPerMinute <= 0 {
+		return rateLimitState{}, true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	window := now.Truncate(time.Minute)
+	elapsed := now.Sub(window)
+	requests, tokens := windowKeysAt(id, window)
+	previousRequests, previousTokens := windowKeysAt(id, window.Add(-time.Minute))
+
+	var state rateLimitState
+	if limits.TokensPerMinute > 0 {
+		state.Tokens = sliding(limits.TokensPerMinute, l.counters.Get(previousTokens), l.counters.Get(tokens), elapsed)
+	}
+	if limits.RequestsPerMinute > 0 {
+		state.Requests = sliding(limits.RequestsPerMinute, l.counters.Get(previousRequests), l.counters.Get(requests), elapsed)
+	}
+	if state.Requests.wait > 0 || state.Tokens.wait > 0 {
+		return state, false
+	}
+	l.counters.Add(requests, 1)
+	if state.Requests.Limit > 0 {
+		state.Requests.Remaining--
+		state.Requests.Reset = 2*time.Minute - elapsed
+	}
+	return state, true
+}
+
+// RecordTokens adds the tokens used by a completed request to id's window
+func (l *rateLimiter) RecordTokens(id string, tokens int) {
+	if tokens <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, key := l.windowKeys(id)
+	l.counters.Add(key, int64(tokens))
+}
+
+// counterTTL is how long counters are kept; one extra window covers
+// requests that straddle a window boundary
+const counterTTL = 2 * time.Minute
+
+// localCounters keeps counters in process memory for single-replica
+// deployments
+type localCounters struct {
+	mu        sync.Mutex
+	values    map[string]localCounter
+	now       func() time.Time
+	nextSweep time.Time
+}
+
+type localCounter struct {
+	value   int64
+	expires time.Time
+}
+
+func newLocalCounters() *localCounters {
+	return &localCounters{values: make(map[string]localCounter), now: time.Now}
+}
+
+func (c *localCounters) Add(key string, n int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	if now.After(c.nextSweep) {
+		for k, v := range c.values {
+			if now.After(v.expires) {
+				delete(c.values, k)
+			}
+		}
+		c.nextSweep = now.Add(counterTTL)
+	}
+	counter := c.values[key]
+	if counter.expires.IsZero() {
+		counter.expires = now.Add(counterTTL)
+	}
+	counter.value += n
+	c.values[key] = counter
+}
+
+func (c *localCounters) Get(key string) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[key].value
+}
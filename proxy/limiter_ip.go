@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Deployments without client keys cannot tell their clients apart by key,
+// so the limits of PROXY_IP_REQUESTS_PER_MINUTE and
+// PROXY_IP_TOKENS_PER_MINUTE apply to each client address instead. Behind a
+// load balancer the address is taken from PROXY_IP_HEADER, e.g.
+// X-Forwarded-For, whose last entry is the one the load balancer added.
+
+// addressLimits are the rate limits of clients without a key, by address
+type addressLimits struct {
+	limits KeyLimits
+	// header, if set, names the request header the client address is taken
+	// from
+	header string
+}
+
+// addressLimitsFromEnv reads the per-address limits, or returns nil if none
+// are configured
+func addressLimitsFromEnv(getenv func(string) string) (*addressLimits, error) {
+	a := &addressLimits{header: getenv("PROXY_IP_HEADER")}
+	for name, limit := range map[string]*int{
+		"PROXY_IP_REQUESTS_PER_MINUTE": &a.limits.RequestsPerMinute,
+		"PROXY_IP_TOKENS_PER_MINUTE":   &a.limits.TokensPerMinute,
+	} {
+		if v := getenv(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid %s %q", name, v)
+			}
+			*limit = n
+		}
+	}
+	if a.limits.RequestsPerMinute == 0 && a.limits.TokensPerMinute == 0 {
+		return nil, nil
+	}
+	return a, nil
+}
+
+// clientAddress returns the address r is counted against
+func (a *addressLimits) clientAddress(r *http.Request) string {
+	if a.header != "" {
+		if v := r.Header.Values(a.header); len(v) > 0 {
+			entries := strings.Split(v[len(v)-1], ",")
+			if addr := strings.TrimSpace(entries[len(entries)-1]); addr != "" {
+				return addr
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// limitByAddress serves a request without a key within the limits of its
+// client address, counting the tokens of its reply against them
+func (s *ProxyServer) limitByAddress(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	id := "ip:" + s.addressLimits.clientAddress(r)
+	state, ok := s.limiter.Check(id, s.addressLimits.limits)
+	setRateLimitHeaders(w.Header(), state)
+	if !ok {
+		http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+		return
+	}
+	if s.addressLimits.limits.TokensPerMinute == 0 {
+		next(w, r)
+		return
+	}
+	counter := &usageCounter{ResponseWriter: w}
+	next(counter, r)
+	s.limiter.RecordTokens(id, counter.usage.TotalTokens)
+}
+
+// usageCounter is a ResponseWriter picking the token usage out of the
+// reply it writes, whether a JSON body or the events of a stream
+type usageCounter struct {
+	http.ResponseWriter
+	usage Usage
+	// pending is an incomplete line of a streamed reply
+	pending []byte
+}
+
+func (c *usageCounter) Write(b []byte) (int, error) {
+	c.pending = append(c.pending, b...)
+	for {
+		i := bytes.IndexByte(c.pending, '\n')
+		if i < 0 {
+			break
+		}
+		c.scan(c.pending[:i])
+		c.pending = c.pending[i+1:]
+	}
+	// A JSON body without newlines is scanned once it is complete
+	if bytes.HasSuffix(bytes.TrimSpace(c.pending), []byte("}")) {
+		c.scan(c.pending)
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+func (c *usageCounter) scan(line []byte) {
+	line = bytes.TrimPrefix(bytes.TrimSpace(line), []byte("data:"))
+	if !bytes.Contains(line, []byte(`"usage"`)) {
+		return
+	}
+	if usage := scanUsage(bytes.TrimSpace(line)); usage.TotalTokens > 0 {
+		c.usage = usage
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, e.g. to
+// flush streamed replies
+func (c *usageCounter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAddressLimitsFromEnv(t *testing.T) {
+	if a, err := addressLimitsFromEnv(func(string) string { return "" }); a != nil || err != nil {
+		t.Errorf("Expected no limits by default, got %+v %v", a, err)
+	}
+	env := map[string]string{"PROXY_IP_REQUESTS_PER_MINUTE": "30", "PROXY_IP_HEADER": "X-Forwarded-For"}
+	a, err := addressLimitsFromEnv(func(name string) string { return env[name] })
+	if err != nil || a.limits.RequestsPerMinute != 30 || a.header != "X-Forwarded-For" {
+		t.Errorf("Expected the configured limits, got %+v %v", a, err)
+	}
+	env["PROXY_IP_TOKENS_PER_MINUTE"] = "lots"
+	if _, err := addressLimitsFromEnv(func(name string) string { return env[name] }); err == nil {
+		t.Error("Expected an invalid limit to be rejected")
+	}
+}
+
+func TestAddressLimits_ClientAddress(t *testing.T) {
+	req := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+	req.RemoteAddr = "10.0.0.1:4242"
+	req.Header.Set("X-Forwarded-For", "203.0.113.9, 198.51.100.7")
+	if got := (&addressLimits{}).clientAddress(req); got != "10.0.0.1" {
+		t.Errorf("Expected the remote address, got %s", got)
+	}
+	if got := (&addressLimits{header: "X-Forwarded-For"}).clientAddress(req); got != "198.51.100.7" {
+		t.Errorf("Expected the address the load balancer added, got %s", got)
+	}
+}
+
+func TestProxyServer_LimitsClientsByAddress(t *testing.T) {
+	server := NewProxyServer(&MockOpenAIClient{response: createTestChatCompletionResponse()})
+	server.submissions = nil
+	server.addressLimits = &addressLimits{limits: KeyLimits{TokensPerMinute: 50}}
+	handler := server.Handler()
+	do := func(addr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "gpt-4o", "messages": [{"role": "user", "content": "Hi"}]}`))
+		req.RemoteAddr = addr
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	// Each reply uses 32 tokens, so the second one is over the limit
+	if w := do("10.0.0.1:1000"); w.Code != http.StatusOK || w.Header().Get("X-RateLimit-Remaining-Tokens") != "50" {
+		t.Fatalf("Expected the first request to pass, got %d %v", w.Code, w.Header())
+	}
+	if w := do("10.0.0.1:1001"); w.Code != http.StatusOK || w.Header().Get("X-RateLimit-Remaining-Tokens") != "18" {
+		t.Fatalf("Expected the second request to pass, got %d %v", w.Code, w.Header())
+	}
+	w := do("10.0.0.1:1002")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected the address to be limited, got %d %v", w.Code, w.Header())
+	}
+	if w := do("10.0.0.2:1000"); w.Code != http.StatusOK {
+		t.Errorf("Expected other addresses to have their own limits, got %d", w.Code)
+	}
+}
+
+func TestProxyServer_RateLimitHeaders(t *testing.T) {
+	server := NewProxyServer(&MockOpenAIClient{response: createTestChatCompletionResponse()})
+	server.keys = createTestKeyStore(t)
+	server.keys.Add(ClientKey{ID: "limited", Key: "sk-limited", Tenant: "acme", Limits: KeyLimits{RequestsPerMinute: 5}})
+	server.tenants.Put("acme", Tenant{ID: "acme", Limits: KeyLimits{RequestsPerMinute: 2}})
+	server.submissions = nil
+	handler := server.Handler()
+	do := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "gpt-4o", "messages": [{"role": "user", "content": "Hi"}]}`))
+		req.Header.Set("Authorization", "Bearer sk-limited")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	// The tenant's limit is the tighter one
+	if w := do(); w.Header().Get("X-RateLimit-Limit-Requests") != "2" || w.Header().Get("X-RateLimit-Remaining-Requests") != "1" {
+		t.Errorf("Expected the tenant's limit to be reported, got %v", w.Header())
+	}
+	do()
+	w := do()
+	if w.Code != http.StatusTooManyRequests || !strings.Contains(w.Body.String(), "Tenant rate limit exceeded") || w.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected the tenant limit to reject the request, got %d %v %s", w.Code, w.Header(), w.Body.String())
+	}
+}
@@ -0,0 +1,228 @@
+//go:build !edge && !wasip1
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// counterBackend is the shared store behind shardedCounters
+type counterBackend interface {
+	// IncrBy adds n to key and (re)sets its expiry to ttl
+	IncrBy(ctx context.Context, key string, n int64, ttl time.Duration) error
+	// Get returns the value of key, or zero if it does not exist
+	Get(ctx context.Context, key string) (int64, error)
+}
+
+// shardedCounters shares rate-limit counters between replicas without a
+// round trip to Redis on the request path.
+//
+// Every logical counter is split into a fixed number of shard keys whose
+// hash tags place them in different Redis Cluster slots, so the write load
+// of a hot key is spread across nodes. Each replica writes only to its own
+// shard. Requests are admitted against a locally cached view: the cluster
+// total as of the last sync plus what this replica has counted since. A
+// periodic Sync flushes local deltas to this replica's shard and re-reads
+// all shards.
+//
+// The trade-off is accuracy: between two syncs a replica does not see the
+// other replicas' traffic, so a counter can overshoot its limit by roughly
+// what the other replicas admit within one sync interval. If the backend is
+// unreachable, deltas are kept and retried and each replica keeps enforcing
+// limits on its stale view, degrading towards per-replica limiting rather
+// than failing requests.
+type shardedCounters struct {
+	backend counterBackend
+	prefix  string
+	shards  int
+	shard   int
+	now     func() time.Time
+
+	// syncMu serializes Sync calls
+	syncMu sync.Mutex
+
+	mu sync.Mutex
+	// global is the cluster-wide total per counter as of the last sync
+	global map[string]int64
+	// inflight holds deltas being flushed by a running Sync; they are not
+	// part of global yet but must keep counting against limits
+	inflight map[string]int64
+	// pending holds deltas counted locally since the last flush
+	pending map[string]int64
+	// touched records when each counter was last used, so counters of past
+	// windows stop being synced
+	touched map[string]time.Time
+}
+
+func newShardedCounters(backend counterBackend, shards, shard int) *shardedCounters {
+	return &shardedCounters{
+		backend:  backend,
+		prefix:   "vibethon:rl:",
+		shards:   shards,
+		shard:    shard % shards,
+		now:      time.Now,
+		global:   make(map[string]int64),
+		inflight: make(map[string]int64),
+		pending:  make(map[string]int64),
+		touched:  make(map[string]time.Time),
+	}
+}
+
+// shardKey names one shard of a counter. The whole "{counter#shard}" part
+// is the hash tag, so shards of the same counter map to different slots.
+func (c *shardedCounters) shardKey(key string, shard int) string {
+	return fmt.Sprintf("%s{%s#%d}", c.prefix, key, shard)
+}
+
+func (c *shardedCounters) Add(key string, n int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pending[key] += n
+	c.touched[key] = c.now()
+}
+
+func (c *shardedCounters) Get(key string) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.touched[key] = c.now()
+	return c.global[key] + c.inflight[key] + c.pending[key]
+}
+
+// Sync flushes local deltas to this replica's shard and refreshes the
+// cluster-wide totals of all recently used counters
+func (c *shardedCounters) Sync(ctx context.Context) error {
+	c.syncMu.Lock()
+	defer c.syncMu.Unlock()
+
+	c.mu.Lock()
+	c.inflight, c.pending = c.pending, make(map[string]int64)
+	flush := c.inflight
+	cutoff := c.now().Add(-counterTTL)
+	var keys []string
+	for key, at := range c.touched {
+		if at.Before(cutoff) {
+			delete(c.touched, key)
+			delete(c.global, key)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	c.mu.Unlock()
+
+	for key, delta := range flush {
+		if err := c.backend.IncrBy(ctx, c.shardKey(key, c.shard), delta, counterTTL); err != nil {
+			c.restore(flush)
+			return fmt.Errorf("failed to flush rate limit counters: %w", err)
+		}
+		c.mu.Lock()
+		c.global[key] += delta
+		delete(flush, key)
+		c.mu.Unlock()
+	}
+
+	totals := make(map[string]int64, len(keys))
+	for _, key := range keys {
+		var total int64
+		for shard := 0; shard < c.shards; shard++ {
+			n, err := c.backend.Get(ctx, c.shardKey(key, shard))
+			if err != nil {
+				c.restore(nil)
+				return fmt.Errorf("failed to read rate limit counters: %w", err)
+			}
+			total += n
+		}
+		totals[key] = total
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, total := range totals {
+		c.global[key] = total
+	}
+	c.inflight = make(map[string]int64)
+	return nil
+}
+
+// restore moves deltas that failed to flush back to pending so the next
+// Sync retries them
+func (c *shardedCounters) restore(unflushed map[string]int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, delta := range unflushed {
+		c.pending[key] += delta
+	}
+	c.inflight = make(map[string]int64)
+}
+
+// Increments a counter and sets its expiry in one atomic step
+const redisIncrExpireScript = `local v = redis.call("INCRBY", KEYS[1], ARGV[1]) redis.call("PEXPIRE", KEYS[1], ARGV[2]) return v`
+
+// redisCounterBackend stores counter shards in Redis or Redis Cluster
+type redisCounterBackend struct {
+	cluster *redisCluster
+}
+
+func (b *redisCounterBackend) IncrBy(ctx context.Context, key string, n int64, ttl time.Duration) error {
+	_, err := b.cluster.Do(ctx, key, "EVAL", redisIncrExpireScript, "1", key,
+		strconv.FormatInt(n, 10), strconv.FormatInt(ttl.Milliseconds(), 10))
+	return err
+}
+
+func (b *redisCounterBackend) Get(ctx context.Context, key string) (int64, error) {
+	reply, err := b.cluster.Do(ctx, key, "GET", key)
+	if err != nil || reply == nil {
+		return 0, err
+	}
+	s, _ := reply.(string)
+	return strconv.ParseInt(s, 10, 64)
+}
+
+// shardedCountersFromEnv configures Redis-backed rate-limit counters and
+// returns them with their sync interval
+func shardedCountersFromEnv(addr string, getenv func(string) string) (*shardedCounters, time.Duration, error) {
+	shards := 8
+	if v := getenv("PROXY_RATE_LIMIT_SHARDS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, 0, fmt.Errorf("invalid PROXY_RATE_LIMIT_SHARDS %q", v)
+		}
+		shards = n
+	}
+	interval := 250 * time.Millisecond
+	if v := getenv("PROXY_RATE_LIMIT_SYNC_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, 0, fmt.Errorf("invalid PROXY_RATE_LIMIT_SYNC_INTERVAL %q", v)
+		}
+		interval = d
+	}
+
+	// Spread replicas over the shards by identity
+	identity := getenv("POD_NAME")
+	if identity == "" {
+		identity, _ = os.Hostname()
+	}
+	backend := &redisCounterBackend{cluster: newRedisCluster(addr, getenv("PROXY_REDIS_PASSWORD"))}
+	return newShardedCounters(backend, shards, int(crc16(identity))), interval, nil
+}
+
+// shareRateLimits shares the rate-limit counters of the server with the
+// other replicas through Redis at PROXY_RATE_LIMIT_REDIS_ADDR, if set
+func (s *ProxyServer) shareRateLimits(getenv func(string) string) error {
+	addr := getenv("PROXY_RATE_LIMIT_REDIS_ADDR")
+	if addr == "" {
+		return nil
+	}
+	counters, interval, err := shardedCountersFromEnv(addr, getenv)
+	if err != nil {
+		return err
+	}
+	s.limiter = newRateLimiterWithStore(counters)
+	s.jobs.Add("sync-rate-limits", interval, false, counters.Sync)
+	return nil
+}
@@ -0,0 +1,165 @@
+//go:build !edge && !wasip1
+
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// In-memory counterBackend shared by several replicas in a test
+type memoryCounterBackend struct {
+	mu     sync.Mutex
+	values map[string]int64
+	fail   bool
+}
+
+func newMemoryCounterBackend() *memoryCounterBackend {
+	return &memoryCounterBackend{values: make(map[string]int64)}
+}
+
+func (b *memoryCounterBackend) IncrBy(ctx context.Context, key string, n int64, ttl time.Duration) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.fail {
+		return errors.New("backend unavailable")
+	}
+	b.values[key] += n
+	return nil
+}
+
+func (b *memoryCounterBackend) Get(ctx context.Context, key string) (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.fail {
+		return 0, errors.New("backend unavailable")
+	}
+	return b.values[key], nil
+}
+
+func TestShardedCounters_Sync(t *testing.T) {
+	backend := newMemoryCounterBackend()
+	a := newShardedCounters(backend, 4, 0)
+	b := newShardedCounters(backend, 4, 1)
+	ctx := context.Background()
+
+	a.Add("k", 5)
+	b.Add("k", 3)
+	if a.Get("k") != 5 || b.Get("k") != 3 {
+		t.Fatalf("Expected replicas to only see local counts before syncing, got %d and %d", a.Get("k"), b.Get("k"))
+	}
+
+	if err := a.Sync(ctx); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	if err := b.Sync(ctx); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	if b.Get("k") != 8 {
+		t.Errorf("Expected b to see the cluster total of 8, got %d", b.Get("k"))
+	}
+	// a synced before b flushed, so it catches up on its next sync
+	if a.Get("k") != 5 {
+		t.Errorf("Expected a to still see 5, got %d", a.Get("k"))
+	}
+	a.Sync(ctx)
+	if a.Get("k") != 8 {
+		t.Errorf("Expected a to see 8 after syncing again, got %d", a.Get("k"))
+	}
+
+	// Each replica only wrote its own shard
+	if backend.values[a.shardKey("k", 0)] != 5 || backend.values[a.shardKey("k", 1)] != 3 {
+		t.Errorf("Unexpected shard values: %v", backend.values)
+	}
+}
+
+func TestShardedCounters_ShardsUseDifferentSlots(t *testing.T) {
+	c := newShardedCounters(newMemoryCounterBackend(), 8, 0)
+	slots := make(map[uint16]bool)
+	for shard := 0; shard < 8; shard++ {
+		slots[redisKeySlot(c.shardKey("hot-key:req:1700000000", shard))] = true
+	}
+	if len(slots) < 6 {
+		t.Errorf("Expected shards to spread over slots, got %d distinct slots for 8 shards", len(slots))
+	}
+}
+
+func TestShardedCounters_BackendOutage(t *testing.T) {
+	backend := newMemoryCounterBackend()
+	c := newShardedCounters(backend, 2, 0)
+	ctx := context.Background()
+
+	backend.fail = true
+	c.Add("k", 4)
+	if err := c.Sync(ctx); err == nil {
+		t.Fatal("Expected sync to fail while the backend is down")
+	}
+	// Local counts keep being enforced and are not lost
+	if c.Get("k") != 4 {
+		t.Errorf("Expected local count of 4 during the outage, got %d", c.Get("k"))
+	}
+
+	backend.fail = false
+	if err := c.Sync(ctx); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	if backend.values[c.shardKey("k", 0)] != 4 || c.Get("k") != 4 {
+		t.Errorf("Expected the retained delta to be flushed exactly once, got backend=%v local=%d", backend.values, c.Get("k"))
+	}
+}
+
+// The consistency model: with R replicas each admitting up to A requests
+// per sync interval, a limit can be exceeded by at most (R-1)*A.
+func TestShardedCounters_OvershootBound(t *testing.T) {
+	backend := newMemoryCounterBackend()
+	now := time.Unix(1700000040, 0)
+	const replicas, limit = 3, 30
+
+	limiters := make([]*rateLimiter, replicas)
+	counters := make([]*shardedCounters, replicas)
+	for i := range limiters {
+		counters[i] = newShardedCounters(backend, 4, i)
+		limiters[i] = newRateLimiterWithStore(counters[i])
+		limiters[i].now = func() time.Time { return now }
+	}
+
+	// Each replica receives 5 requests per sync interval
+	admitted := 0
+	for round := 0; round < 10; round++ {
+		for _, l := range limiters {
+			for j := 0; j < 5; j++ {
+				if l.Allow("key", KeyLimits{RequestsPerMinute: limit}) {
+					admitted++
+				}
+			}
+		}
+		for _, c := range counters {
+			c.Sync(context.Background())
+		}
+	}
+
+	if admitted < limit {
+		t.Errorf("Expected at least the limit of %d requests to be admitted, got %d", limit, admitted)
+	}
+	if maxAdmitted := limit + (replicas-1)*5; admitted > maxAdmitted {
+		t.Errorf("Expected at most %d admitted requests, got %d", maxAdmitted, admitted)
+	}
+}
+
+func TestRedisCounterBackend(t *testing.T) {
+	server := startFakeRedis(t)
+	backend := &redisCounterBackend{cluster: newRedisCluster(server.addr(), "")}
+	ctx := context.Background()
+
+	if n, err := backend.Get(ctx, "missing"); err != nil || n != 0 {
+		t.Errorf("Expected 0 for a missing counter, got %d, %v", n, err)
+	}
+	backend.IncrBy(ctx, "k", 3, time.Minute)
+	backend.IncrBy(ctx, "k", 4, time.Minute)
+	if n, err := backend.Get(ctx, "k"); err != nil || n != 7 {
+		t.Errorf("Expected 7, got %d, %v", n, err)
+	}
+}
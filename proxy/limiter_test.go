@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter_RequestsPerMinute(t *testing.T) {
+	limiter := newRateLimiter()
+	now := time.Unix(1700000000, 0)
+	limiter.now = func() time.Time { return now }
+	limits := KeyLimits{RequestsPerMinute: 2}
+
+	if !limiter.Allow("a", limits) || !limiter.Allow("a", limits) {
+		t.Fatal("Expected first two requests to be allowed")
+	}
+	if limiter.Allow("a", limits) {
+		t.Error("Expected third request in the same minute to be rejected")
+	}
+	if !limiter.Allow("b", limits) {
+		t.Error("Expected other keys to have their own window")
+	}
+
+	now = now.Add(time.Minute)
+	if !limiter.Allow("a", limits) {
+		t.Error("Expected request in the next minute to be allowed")
+	}
+}
+
+func TestRateLimiter_TokensPerMinute(t *testing.T) {
+	limiter := newRateLimiter()
+	now := time.Unix(1700000000, 0)
+	limiter.now = func() time.Time { return now }
+	limits := KeyLimits{TokensPerMinute: 100}
+
+	if !limiter.Allow("a", limits) {
+		t.Fatal("Expected first request to be allowed")
+	}
+	limiter.RecordTokens("a", 120)
+	if limiter.Allow("a", limits) {
+		t.Error("Expected request to be rejected once the token limit is used up")
+	}
+
+	now = now.Add(time.Minute)
+	if !limiter.Allow("a", limits) {
+		t.Error("Expected token usage to reset in the next minute")
+	}
+}
+
+func TestRateLimiter_Unlimited(t *testing.T) {
+	limiter := newRateLimiter()
+	for i := 0; i < 1000; i++ {
+		if !limiter.Allow("a", KeyLimits{}) {
+			t.Fatal("Expected keys without limits to always be allowed")
+		}
+	}
+}
+
+func TestRateLimiter_UsageFadesAcrossWindows(t *testing.T) {
+	limiter := newRateLimiter()
+	now := time.Unix(1700000040, 0) // on the minute
+	limiter.now = func() time.Time { return now }
+	limits := KeyLimits{RequestsPerMinute: 10}
+
+	now = now.Add(50 * time.Second)
+	for i := 0; i < 10; i++ {
+		limiter.Allow("a", limits)
+	}
+	// As the next window starts the burst still counts fully
+	now = now.Add(10 * time.Second)
+	state, ok := limiter.Check("a", limits)
+	if ok {
+		t.Fatalf("Expected a burst at the end of a window to count in the next, got %+v", state)
+	}
+	if wait := state.RetryAfter(); wait < 5*time.Second || wait > 7*time.Second {
+		t.Errorf("Expected to wait about six seconds for a request to fade, got %v", wait)
+	}
+
+	now = now.Add(30 * time.Second)
+	state, ok = limiter.Check("a", limits)
+	if !ok || state.Requests.Remaining != 4 || state.Requests.Limit != 10 {
+		t.Errorf("Expected the burst to have half faded, got %v %+v", ok, state)
+	}
+}
+
+func TestRateLimitState_Headers(t *testing.T) {
+	limiter := newRateLimiter()
+	now := time.Unix(1700000040, 0)
+	limiter.now = func() time.Time { return now }
+	limits := KeyLimits{RequestsPerMinute: 2, TokensPerMinute: 1000}
+
+	state, _ := limiter.Check("a", limits)
+	h := http.Header{}
+	setRateLimitHeaders(h, state)
+	if h.Get("X-RateLimit-Remaining-Requests") != "1" || h.Get("X-RateLimit-Limit-Tokens") != "1000" || h.Get("X-RateLimit-Reset-Requests") != "2m0s" || h.Get("Retry-After") != "" {
+		t.Errorf("Unexpected headers %v", h)
+	}
+
+	// Both requests fade out over the next window, one of them halfway
+	// through it
+	limiter.Check("a", limits)
+	state, ok := limiter.Check("a", limits)
+	h = http.Header{}
+	setRateLimitHeaders(h, state)
+	if ok || h.Get("X-RateLimit-Remaining-Requests") != "0" || h.Get("Retry-After") != "90" {
+		t.Errorf("Expected the rejection to say when to retry, got %v", h)
+	}
+}
@@ -2,18 +2,85 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // OpenAI API structures based on the official specification
 type Message struct {
 	Role    string `json:"role"`
 	Content string `json:"content"`
+	// Parts is the content of a message sent as a list of parts, such as
+	// text and images, of which Content holds the text
+	Parts []ContentPart `json:"-"`
+
+	// Name tells participants of the same role apart, and names the
+	// function of legacy function messages
+	Name       string     `json:"name,omitempty"`
+	ToolCalls  []ToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string     `json:"tool_call_id,omitempty"`
+	// FunctionCall is the legacy form of a single tool call
+	FunctionCall *ToolCallFunction `json:"function_call,omitempty"`
+	// Parsed is set by the proxy on xml and yaml replies, to the reply
+	// converted to JSON
+	Parsed json.RawMessage `json:"parsed,omitempty"`
+}
+
+// MarshalJSON encodes content in the form it came in, as a list of parts or
+// a string. The empty content of messages calling tools is encoded as null,
+// as OpenAI does.
+func (m Message) MarshalJSON() ([]byte, error) {
+	type message Message
+	if m.Parts != nil {
+		return json.Marshal(struct {
+			message
+			Content []ContentPart `json:"content"`
+		}{message(m), m.Parts})
+	}
+	if m.Content != "" || (len(m.ToolCalls) == 0 && m.FunctionCall == nil) {
+		return json.Marshal(message(m))
+	}
+	return json.Marshal(struct {
+		message
+		Content *string `json:"content"`
+	}{message: message(m)})
+}
+
+// UnmarshalJSON takes content as a string or a list of parts
+func (m *Message) UnmarshalJSON(data []byte) error {
+	type message Message
+	msg := struct {
+		*message
+		Content json.RawMessage `json:"content"`
+	}{message: (*message)(m)}
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return err
+	}
+	m.Content, m.Parts = "", nil
+	switch content := bytes.TrimSpace(msg.Content); {
+	case len(content) == 0 || string(content) == "null":
+	case content[0] == '[':
+		if err := json.Unmarshal(content, &m.Parts); err != nil {
+			return fmt.Errorf("invalid message content: %w", err)
+		}
+		m.Content = contentText(m.Parts)
+	default:
+		if err := json.Unmarshal(content, &m.Content); err != nil {
+			return fmt.Errorf("invalid message content: %w", err)
+		}
+	}
+	return nil
 }
 
 type ChatCompletionRequest struct {
@@ -23,6 +90,33 @@ type ChatCompletionRequest struct {
 	MaxTokens   *int      `json:"max_tokens,omitempty"`
 	TopP        *float64  `json:"top_p,omitempty"`
 	Stream      *bool     `json:"stream,omitempty"`
+	// StreamOptions asks for the usage of streamed replies
+	StreamOptions *StreamOptions `json:"stream_options,omitempty"`
+
+	ResponseFormat *ResponseFormat `json:"response_format,omitempty"`
+	Tools          []Tool          `json:"tools,omitempty"`
+	ToolChoice     json.RawMessage `json:"tool_choice,omitempty"`
+	// ParallelToolCalls allows several tool calls in one reply
+	ParallelToolCalls *bool `json:"parallel_tool_calls,omitempty"`
+	// Functions and FunctionCall are the legacy forms of Tools and
+	// ToolChoice
+	Functions    []ToolFunction  `json:"functions,omitempty"`
+	FunctionCall json.RawMessage `json:"function_call,omitempty"`
+	// RAG is a proxy extension, removed before the request is sent upstream
+	RAG *RAGOptions `json:"rag,omitempty"`
+	// PostProcess names the post-processors to run over the reply, also a
+	// proxy extension
+	PostProcess []string `json:"post_process,omitempty"`
+	// BuiltinTools names the tools the proxy runs itself to offer the model
+	BuiltinTools []string `json:"builtin_tools,omitempty"`
+	// Session names the conversation the proxy keeps for the client, also
+	// a proxy extension
+	Session string `json:"session,omitempty"`
+	User    string `json:"user,omitempty"`
+}
+
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage,omitempty"`
 }
 
 type Choice struct {
@@ -44,6 +138,8 @@ type ChatCompletionResponse struct {
 	Model   string   `json:"model"`
 	Choices []Choice `json:"choices"`
 	Usage   Usage    `json:"usage"`
+
+	Metadata *ResponseMetadata `json:"metadata,omitempty"`
 }
 
 type ErrorResponse struct {
@@ -63,64 +159,414 @@ type OpenAIClient interface {
 type RealOpenAIClient struct {
 	APIKey  string
 	BaseURL string
+	// HTTPClient sends the upstream requests
+	HTTPClient *http.Client
+	// Quarantine keeps copies of malformed responses, if set
+	Quarantine *responseQuarantine
+	// APIVersion, when set, is sent as the api-version query parameter and
+	// the key in an api-key header instead, as Azure OpenAI expects
+	APIVersion string
+	// KeyOverrides lets requests be made with the upstream key of their
+	// client key instead of APIKey
+	KeyOverrides bool
+	// Retry is how requests the upstream answers with 429 or a 5xx are
+	// retried
+	Retry RetryPolicy
+	// Keys, if set, are the upstream keys requests are balanced across
+	// instead of APIKey
+	Keys *upstreamKeyPool
+
+	mu sync.RWMutex
+}
+
+// SetAPIKey swaps the upstream API key, e.g. after a mounted Secret changes
+func (c *RealOpenAIClient) SetAPIKey(apiKey string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.APIKey = apiKey
+}
+
+func (c *RealOpenAIClient) apiKey() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.APIKey
 }
 
+// upstreamTransport, when set, carries the requests of upstream clients
+// instead of the default transport. Edge runtimes without sockets offer
+// outbound HTTP through APIs of their own, which a file built into the
+// proxy for that runtime sets here from an init function.
+var upstreamTransport http.RoundTripper
+
 func NewRealOpenAIClient(apiKey string) *RealOpenAIClient {
 	return &RealOpenAIClient{
-		APIKey:  apiKey,
-		BaseURL: "https://api.openai.com/v1",
+		APIKey:     apiKey,
+		BaseURL:    "https://api.openai.com/v1",
+		HTTPClient: &http.Client{Transport: upstreamTransport},
 	}
 }
 
 func (c *RealOpenAIClient) CreateChatCompletion(req ChatCompletionRequest) (*ChatCompletionResponse, error) {
+	return c.CreateChatCompletionContext(context.Background(), req)
+}
+
+// CreateChatCompletionContext is CreateChatCompletion, abandoning the
+// upstream call when ctx is cancelled
+func (c *RealOpenAIClient) CreateChatCompletionContext(ctx context.Context, req ChatCompletionRequest) (*ChatCompletionResponse, error) {
 	jsonData, err := json.Marshal(req)
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal request: %w", err)
 	}
 
-	httpReq, err := http.NewRequest("POST", c.BaseURL+"/chat/completions", bytes.NewBuffer(jsonData))
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
+	body := getBuffer()
+	defer putBuffer(body)
+	if err := c.CreateChatCompletionRaw(ctx, jsonData, body); err != nil {
+		return nil, err
 	}
 
-	httpReq.Header.Set("Content-Type", "application/json")
-	httpReq.Header.Set("Authorization", "Bearer "+c.APIKey)
+	var chatResp ChatCompletionResponse
+	if err := json.Unmarshal(body.Bytes(), &chatResp); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+
+	return &chatResp, nil
+}
+
+// CreateChatCompletionRaw sends an already encoded request and appends the
+// encoded response to out, for the passthrough path
+func (c *RealOpenAIClient) CreateChatCompletionRaw(ctx context.Context, jsonData []byte, out *bytes.Buffer) error {
+	return c.postValidated(ctx, "/chat/completions", jsonData, chatCompletionSchema, out)
+}
 
-	client := &http.Client{}
-	resp, err := client.Do(httpReq)
+// postValidated posts jsonData to path and appends the response to out once
+// it matches schema. A malformed response is quarantined and the request
+// sent once more before giving up.
+func (c *RealOpenAIClient) postValidated(ctx context.Context, path string, jsonData []byte, schema *compiledSchema, out *bytes.Buffer) error {
+	start := out.Len()
+	for attempt := 0; ; attempt++ {
+		if err := c.post(ctx, path, jsonData, out); err != nil {
+			return err
+		}
+		err := schema.Validate(out.Bytes()[start:])
+		if err == nil {
+			return nil
+		}
+		c.Quarantine.Add(path, out.Bytes()[start:], err)
+		out.Truncate(start)
+		if attempt > 0 {
+			return &malformedResponseError{path: path, err: err}
+		}
+	}
+}
+
+// post sends an encoded request to path and appends the response to out.
+// Cancelling ctx abandons the request.
+func (c *RealOpenAIClient) post(ctx context.Context, path string, jsonData []byte, out *bytes.Buffer) error {
+	resp, err := c.send(ctx, path, jsonData, nil)
 	if err != nil {
-		return nil, fmt.Errorf("failed to send request: %w", err)
+		return err
 	}
 	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read response: %w", err)
+	start := out.Len()
+	if _, err := out.ReadFrom(resp.Body); err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		var errorResp ErrorResponse
-		if err := json.Unmarshal(body, &errorResp); err != nil {
-			return nil, fmt.Errorf("API error (status %d): %s", resp.StatusCode, string(body))
-		}
-		return nil, fmt.Errorf("API error: %s", errorResp.Error.Message)
+		return apiError(resp.StatusCode, out.Bytes()[start:])
 	}
 
-	var chatResp ChatCompletionResponse
-	if err := json.Unmarshal(body, &chatResp); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal response: %w", err)
+	return nil
+}
+
+// newRequest creates an authenticated POST of a JSON body of size bytes to
+// path
+func (c *RealOpenAIClient) newRequest(ctx context.Context, path string, body io.Reader, size int) (*http.Request, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", c.BaseURL+path, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	httpReq.ContentLength = int64(size)
+	httpReq.Header.Set("Content-Type", "application/json")
+	key := c.apiKey()
+	if override := upstreamKeyFromContext(ctx); override != "" && c.KeyOverrides {
+		key = override
+	}
+	if c.APIVersion != "" {
+		httpReq.URL.RawQuery = "api-version=" + url.QueryEscape(c.APIVersion)
 	}
+	c.authorize(httpReq, key)
+	return httpReq, nil
+}
 
-	return &chatResp, nil
+// authorize sets the upstream key of a request
+func (c *RealOpenAIClient) authorize(httpReq *http.Request, key string) {
+	switch {
+	case c.APIVersion != "":
+		httpReq.Header.Set("api-key", key)
+	case key != "":
+		httpReq.Header.Set("Authorization", "Bearer "+key)
+	}
+}
+
+// pooledKey picks the key of a request from the pool, or returns nil if
+// the request is not balanced
+func (c *RealOpenAIClient) pooledKey(ctx context.Context) *pooledKey {
+	if c.Keys == nil || c.KeyOverrides && upstreamKeyFromContext(ctx) != "" {
+		return nil
+	}
+	return c.Keys.acquire()
+}
+
+// apiError is the error for an upstream reply with a status other than 200
+func apiError(status int, body []byte) error {
+	err := &upstreamAPIError{Status: status}
+	if json.Unmarshal(body, &err.Response) != nil {
+		err.Response.Error.Message = string(body)
+		err.raw = true
+	}
+	return err
+}
+
+// upstreamAPIError is an error reply of the upstream
+type upstreamAPIError struct {
+	Status   int
+	Response ErrorResponse
+	// raw is set if the reply was not an OpenAI error object
+	raw bool
+}
+
+func (e *upstreamAPIError) Error() string {
+	if e.raw {
+		return fmt.Sprintf("API error (status %d): %s", e.Status, e.Response.Error.Message)
+	}
+	return fmt.Sprintf("API error: %s", e.Response.Error.Message)
 }
 
 // Proxy server
 type ProxyServer struct {
-	client OpenAIClient
+	client  OpenAIClient
+	keys    *KeyStore
+	tenants *registry[Tenant]
+	routes  *registry[RoutingRule]
+	limiter *rateLimiter
+	jobs    *jobRunner
+	usage   *walQueue
+	memory  *memoryGuard
+	batcher *embeddingBatcher
+	metrics *proxyMetrics
+	// upstream names the provider requests are sent to, for metrics
+	upstream   string
+	slos       *registry[SLO]
+	sloTracker *sloTracker
+	alerts     *alerter
+	anomalies  *anomalyDetector
+	schedules  *registry[Schedule]
+	scheduler  *scheduler
+	// connectors keep knowledge bases in sync with external sources
+	connectors *registry[Connector]
+	syncer     *connectorSyncer
+	sessions   *sessionStore
+	// virtualModels are client-facing model names expanded in front of
+	// routing rules
+	virtualModels *registry[VirtualModel]
+	modelHistory  *modelHistory
+	guardrails    *registry[GuardrailProfile]
+	// featureFlags roll features out gradually, unless flagProvider
+	// decides first
+	featureFlags *registry[FeatureFlag]
+	flagProvider flagProvider
+	// structuredOutput is how response formats are enforced, and
+	// outputRetries how often an invalid reply is retried
+	structuredOutput string
+	outputRetries    int
+	// toolCallValidation is how the arguments of tool calls are checked
+	toolCallValidation string
+	// builtinTools are the tools the proxy runs itself, by name, for up to
+	// toolMaxRounds replies of the model per request
+	builtinTools  map[string]builtinTool
+	toolMaxRounds int
+	// agentRuns records the requests that ran builtin tools, for
+	// /v1/agents/runs/{id}
+	agentRuns *agentRunStore
+	// knowledgeBases are what retrieval augmentation draws from, embedded
+	// with ragEmbeddingModel and searched with ragRetrieval unless they
+	// set their own. ragModelMismatch is what a search does with documents
+	// embedded by another model than its query.
+	knowledgeBases    *registry[KnowledgeBase]
+	ragEmbeddingModel string
+	ragRetrieval      RetrievalConfig
+	ragModelMismatch  string
+	// pipelines are multi-step runs served at /v1/pipelines/{name}/run
+	pipelines *registry[Pipeline]
+	// rerankBackend is how /v1/rerank scores documents
+	rerankBackend string
+	// summarizeChunkModel summarizes the chunks of /v1/summarize when the
+	// request does not name a model for them
+	summarizeChunkModel string
+	// completions caches the replies to deterministic chat completions
+	completions *lruCache[cachedCompletion]
+	// translateModel serves /v1/translate requests that name no model, and
+	// translations caches their results
+	translateModel string
+	translations   *lruCache[TranslateResponse]
+	// promptDiffJudge compares the outputs of /v1/prompts/diff when the
+	// request does not name a judge
+	promptDiffJudge string
+	// tokenizers serve /v1/tokenize, /v1/detokenize and /v1/tokenize/chat
+	tokenizers *tokenizers
+	// anonymizeSalt keys the pseudonyms of anonymized exports, so they stay
+	// the same from one export to the next
+	anonymizeSalt string
+	// bridges are the bot bridge webhooks by path, and playground whether
+	// /playground is served
+	bridges    map[string]http.Handler
+	playground bool
+	// quarantine keeps the malformed responses of the upstream
+	quarantine *responseQuarantine
+	// timelines are those of the latest requests, by request ID
+	timelines *lruCache[*requestTimeline]
+	// latencies are those of recent requests, for latency budgets
+	latencies *recentLatencies
+	// inflight are the chat completions that can be cancelled
+	inflight *inflightCompletions
+	// submissions collapse duplicate submissions, if set
+	submissions *submissionGuard
+	// analytics are the hourly and daily usage rollups, if enabled
+	analytics *usageAnalytics
+	// attribution fills in the user field of chat completions, if set
+	attribution *userAttribution
+	// terms, if set, refuses keys whose owner has not accepted the terms
+	terms *termsGate
+	// upstreamKeys are the upstream keys client keys can be served with
+	upstreamKeys *upstreamKeySet
+	// errorCatalog translates error messages for Accept-Language
+	errorCatalog *errorCatalog
+	// license, if set, limits the features and tenants of the deployment
+	license *license
+	// pacer holds back the requests of batch tenants
+	pacer *batchPacer
+	// queue, if set, limits concurrent upstream requests and shares them
+	// fairly across tenants
+	queue *fairQueue
+	// promptSets are the stored requests the completion cache can be
+	// warmed with
+	promptSets *registry[PromptSet]
+	// addressLimits, if set, rate limit clients by address when no client
+	// keys are configured
+	addressLimits *addressLimits
+	// failures remembers the errors chat completions get every time they
+	// are sent
+	failures *lruCache[cachedFailure]
+	// audit, if set, records every request to a model and its reply
+	audit *auditLog
+	// address is where the server listens
+	address string
+	// config, if set, reloads the keys, tenants and routing rules of the
+	// config file
+	config *configReloader
+	// completionRetry retries empty and truncated replies once, unless a
+	// tenant says otherwise
+	completionRetry bool
+	// modelsCache remembers the models of the upstreams for GET /v1/models,
+	// and modelAllowlist narrows them
+	modelsCache    *lruCache[[]Model]
+	modelAllowlist []string
+	// autoContinueTokens is the completion budget replies cut off by
+	// max_tokens are continued up to, unless a tenant says otherwise
+	autoContinueTokens int
+	// costs, if pricing is configured, tracks the spend of each key
+	costs *costLedger
+	// keyPool, if set, balances requests across several upstream keys
+	keyPool *upstreamKeyPool
+	// nativeDimensionsModels are the models whose embeddings the upstream
+	// shortens to the dimensions asked for
+	nativeDimensionsModels []string
+	// draining is set once the process is shutting down, failing the
+	// health check
+	draining atomic.Bool
+	// bridgeReplies tracks bot bridge replies still being generated after
+	// their webhook returned, which a drain waits for
+	bridgeReplies sync.WaitGroup
+	// maintenance keeps the last run of each maintenance task
+	maintenance *maintenanceRuns
+	// contentFilters scan the requests to models before they go upstream
+	contentFilters []ContentFilter
+	// mirror, if set, tees matching requests and their replies to files
+	mirror *requestMirror
+	// tail passes requests to the clients watching the live feed
+	tail *requestTail
+	// tracer, if set, traces requests and exports the spans over OTLP
+	tracer *tracer
+	// rewrites change the requests to routes before anything reads them
+	rewrites []RewriteRule
+	// defaultModel serves chat completions without a model, and
+	// deprecations replace retired models
+	defaultModel string
+	deprecations []ModelDeprecation
+	// cannedAnswers are served for the prompts they match
+	cannedAnswers []CannedAnswer
 }
 
 func NewProxyServer(client OpenAIClient) *ProxyServer {
-	return &ProxyServer{client: client}
+	hostname, _ := os.Hostname()
+	s := &ProxyServer{
+		client:     client,
+		tenants:    newRegistry[Tenant](),
+		routes:     newRegistry[RoutingRule](),
+		limiter:    newRateLimiter(),
+		jobs:       newJobRunner(newLeaderElector(localLocker{}, "vibethon-proxy", hostname, 15*time.Second)),
+		metrics:    newProxyMetrics(),
+		upstream:   "openai",
+		slos:       newRegistry[SLO](),
+		sloTracker: newSLOTracker(),
+		alerts:     newAlerter(""),
+		anomalies:  newAnomalyDetector(4),
+		schedules:  newRegistry[Schedule](),
+		scheduler:  newScheduler(),
+		connectors: newRegistry[Connector](),
+		syncer:     newConnectorSyncer(),
+		sessions:   newSessionStore(20, 24*time.Hour),
+
+		virtualModels: newRegistry[VirtualModel](),
+		modelHistory:  newModelHistory(),
+
+		structuredOutput:   StructuredOutputNative,
+		outputRetries:      2,
+		toolCallValidation: ToolCallsUnchecked,
+		builtinTools:       make(map[string]builtinTool),
+		toolMaxRounds:      8,
+		agentRuns:          newAgentRunStore("", 1000),
+		guardrails:         newRegistry[GuardrailProfile](),
+		featureFlags:       newRegistry[FeatureFlag](),
+		knowledgeBases:     newRegistry[KnowledgeBase](),
+		ragEmbeddingModel:  "text-embedding-3-small",
+		pipelines:          newRegistry[Pipeline](),
+		rerankBackend:      RerankAPI,
+		completions:        newLRUCache[cachedCompletion](0, time.Hour),
+		translations:       newLRUCache[TranslateResponse](10000, 24*time.Hour),
+		tokenizers:         newTokenizers(""),
+		quarantine:         newResponseQuarantine("", 100),
+		timelines:          newLRUCache[*requestTimeline](1000, 0),
+		latencies:          newRecentLatencies(0.5),
+		inflight:           newInflightCompletions(),
+		submissions:        newSubmissionGuard(2 * time.Second),
+		errorCatalog:       builtinErrorCatalog,
+		pacer:              newBatchPacer(),
+		promptSets:         newRegistry[PromptSet](),
+		failures:           newLRUCache[cachedFailure](negativeCacheSize, 30*time.Second),
+		modelsCache:        newLRUCache[[]Model](1, modelsCacheTTL),
+
+		nativeDimensionsModels: defaultNativeDimensionsModels,
+		maintenance:            &maintenanceRuns{last: make(map[string]MaintenanceRun)},
+		tail:                   newRequestTail(),
+	}
+	newGaugeFunc(s.metrics.registry, map[string]string{
+		"vibethon_slo_error_budget_remaining": "Fraction of the SLO error budget left in its window.",
+		"vibethon_slo_burn_rate":              "Rate at which the SLO error budget is spent, by window.",
+	}, s.sloSamples)
+	return s
 }
 
 func (s *ProxyServer) handleChatCompletions(w http.ResponseWriter, r *http.Request) {
@@ -130,13 +576,44 @@ func (s *ProxyServer) handleChatCompletions(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	// Read request body
-	body, err := io.ReadAll(r.Body)
+	// Read request body into a pooled buffer
+	buf, err := readBody(r.Body, r.ContentLength)
 	if err != nil {
 		http.Error(w, "Failed to read request body", http.StatusBadRequest)
 		return
 	}
+	defer putBuffer(buf)
 	defer r.Body.Close()
+	body := buf.Bytes()
+
+	// Requests that fail the same way every time are answered with the
+	// error they got
+	if failureID, lookup := s.failureCacheKey(r, body); failureID != "" {
+		if lookup && s.serveCachedFailure(w, failureID) {
+			return
+		}
+		recorder := &failureRecorder{ResponseWriter: w}
+		defer recorder.store(s.failures, failureID)
+		w = recorder
+	}
+
+	// Deterministic requests can be answered from the completion cache
+	if cacheID, lookup := s.completionCacheKey(r, body); cacheID != "" {
+		if lookup && s.serveCachedCompletion(w, cacheID) {
+			return
+		}
+		w.Header().Set("X-Cache", "MISS")
+		recorder := &completionRecorder{ResponseWriter: w}
+		defer recorder.store(s.completions, cacheID)
+		w = recorder
+	}
+
+	// Clients that accept raw bodies skip decoding the full request, unless
+	// the proxy has to rewrite it or check the reply
+	if raw, ok := s.client.(rawOpenAIClient); ok && !s.mustDecode(body) && !s.inspectsCompletions(clientKeyFromContext(r.Context())) {
+		s.handleChatCompletionsRaw(w, r, raw, body)
+		return
+	}
 
 	// Parse request
 	var req ChatCompletionRequest
@@ -145,24 +622,122 @@ func (s *ProxyServer) handleChatCompletions(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	// Validate required fields
-	if req.Model == "" {
-		http.Error(w, "Model field is required", http.StatusBadRequest)
+	sessionID, sent, err := s.sessionMessages(&req, clientKeyFromContext(r.Context()))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := validateChatRequest(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	key := clientKeyFromContext(r.Context())
+	if key != nil && !key.AllowsModel(req.Model) {
+		http.Error(w, fmt.Sprintf("API key is not allowed to use model %s", req.Model), http.StatusForbidden)
+		return
+	}
+	timeline := timelineFromContext(r.Context())
+	timeline.Add(TimelineValidated, "")
+	var tenant string
+	if key != nil {
+		tenant = key.Tenant
+	}
+	requested := req.Model
+	if err := s.expandModel(&req, tenant, "chat.completions"); err != nil {
+		http.Error(w, err.Error(), expandModelStatus(err))
+		return
+	}
+	timeline.Addf(TimelineRouted, "%s -> %s", requested, req.Model)
+	if user := s.attribution.User(key, req.User); user != "" {
+		req.User = user
+	}
+	if !s.checkLatencyBudget(w, r, "chat.completions", req.Model) {
+		return
+	}
+	stream, streaming := s.client.(streamingOpenAIClient)
+	streaming = streaming && req.Stream != nil && *req.Stream
+	if conflict := s.streamConflict(&req); streaming && conflict != "" {
+		http.Error(w, fmt.Sprintf("%s cannot be combined with stream", conflict), http.StatusBadRequest)
+		return
+	}
+	req.Session = ""
+	processors, err := parsePostProcessors(req.PostProcess)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.PostProcess = nil
+	builtins, err := s.offerBuiltinTools(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	inlineCitations := req.RAG != nil && req.RAG.InlineCitations
+	citations, err := s.augment(&req, key)
+	if err != nil {
+		if status := augmentStatus(err); status != http.StatusInternalServerError {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		log.Printf("Retrieval failed: %v", err)
+		http.Error(w, fmt.Sprintf("Retrieval failed: %v", err), http.StatusInternalServerError)
 		return
 	}
-	if len(req.Messages) == 0 {
-		http.Error(w, "Messages field is required and cannot be empty", http.StatusBadRequest)
+
+	if streaming {
+		jsonData, err := json.Marshal(req)
+		if err != nil {
+			http.Error(w, "Failed to encode request", http.StatusInternalServerError)
+			return
+		}
+		s.streamChatCompletion(w, r, stream, jsonData, key, req.Model)
 		return
 	}
 
 	// Forward request to OpenAI API
-	resp, err := s.client.CreateChatCompletion(req)
+	ctx, done := s.inflight.Start(r.Context(), timeline.id(), key)
+	defer done()
+	event := newUsageEvent(key, "chat.completions", req.Model)
+	var resp *ChatCompletionResponse
+	if len(builtins) > 0 {
+		run := newAgentRun(key, req, builtins)
+		resp, err = s.runAgent(ctx, req, builtins, run)
+		s.agentRuns.Save(run)
+	} else if s.retriesCompletions(key) {
+		resp, err = s.createCheckedCompletion(ctx, req)
+	} else {
+		resp, err = s.createCompletion(ctx, req)
+	}
+	if budget := s.continuationBudget(key); err == nil && len(builtins) == 0 && budget > 0 {
+		resp, err = s.continueCompletion(ctx, req, resp, budget)
+	}
+	if err == nil {
+		timeline.Add(TimelineFirstToken, "")
+		resp = s.checkToolCalls(ctx, req, resp)
+		if citations != nil {
+			resp = withCitations(resp, citations, inlineCitations)
+		}
+		resp = postProcess(resp, processors)
+	}
+	event.LatencyMS = time.Since(event.Time).Milliseconds()
 	if err != nil {
 		log.Printf("OpenAI API error: %v", err)
-		http.Error(w, fmt.Sprintf("OpenAI API error: %v", err), http.StatusInternalServerError)
+		event.Status = upstreamErrorStatus(err)
+		s.recordUsage(event)
+		writeUpstreamError(w, err)
 		return
 	}
 
+	s.recordCompletion(key, event, resp.Usage)
+	if sessionID != "" && len(resp.Choices) > 0 {
+		if len(sent) == 0 {
+			s.sessions.Regenerate(sessionID, resp.Choices[0].Message)
+		} else {
+			s.sessions.Append(sessionID, append(sent, resp.Choices[0].Message)...)
+		}
+	}
+
 	// Return response
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(resp); err != nil {
@@ -174,37 +749,714 @@ func (s *ProxyServer) handleChatCompletions(w http.ResponseWriter, r *http.Reque
 
 func (s *ProxyServer) handleHealth(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
+	if s.draining.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{"status": "draining"})
+		return
+	}
 	json.NewEncoder(w).Encode(map[string]string{"status": "healthy"})
 }
 
-func main() {
-	// Get OpenAI API key from environment variable
-	apiKey := os.Getenv("OPENAI_API_KEY")
-	if apiKey == "" {
-		log.Fatal("OPENAI_API_KEY environment variable is required")
+// chain wraps a handler of requests to models in the middleware they all go
+// through, outermost first: the timeline, load shedding, authentication,
+// content filters, model defaults, rewrites, the audit log, canned answers,
+// debug echoes, the duplicate guard, pacing and the fair queue
+func (s *ProxyServer) chain(h http.HandlerFunc) http.HandlerFunc {
+	return s.withTimeline(s.withLoadShedding(s.withAuth(s.withContentFilters(s.withModelDefaults(s.withRewrites(s.withAudit(s.withCannedAnswers(s.withDebugEcho(s.withDuplicateGuard(s.withPacing(s.withFairQueue(h))))))))))))
+}
+
+// Handler returns the routes of the server on a mux of its own, so several
+// servers can run in one process. The admin API is only served when client
+// keys are configured.
+func (s *ProxyServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	if s.keys != nil {
+		mux.HandleFunc("/admin/keys", s.withAuth(s.handleAdminKeys))
+		mux.HandleFunc("POST /admin/keys", s.withAuth(s.handleAdminCreateKey))
+		mux.HandleFunc("/admin/keys/{id}", s.withAuth(s.adminKeyHandler().ServeHTTP))
+		mux.HandleFunc("POST /admin/keys/{id}/tokens", s.withAuth(s.handleMintToken))
+		mux.HandleFunc("/admin/tenants", s.withAuth(handleAdminList("tenants", s.tenants.List)))
+		mux.HandleFunc("/admin/tenants/{id}", s.withAuth(s.adminTenantHandler().ServeHTTP))
+		mux.HandleFunc("/admin/routes", s.withAuth(handleAdminList("routes", s.routes.List)))
+		mux.HandleFunc("/admin/routes/{id}", s.withAuth(s.adminRouteHandler().ServeHTTP))
+		mux.HandleFunc("/admin/models", s.withAuth(handleAdminList("models", s.virtualModels.List)))
+		mux.HandleFunc("/admin/models/{id}", s.withAuth(s.adminVirtualModelHandler().ServeHTTP))
+		mux.HandleFunc("/admin/models/{id}/versions", s.withAuth(s.handleAdminModelVersions))
+		mux.HandleFunc("/admin/models/{id}/rollback", s.withAuth(s.handleAdminRollbackModel))
+		mux.HandleFunc("/admin/models/{id}/pins/{tenant}", s.withAuth(s.handleAdminModelPin))
+		mux.HandleFunc("/admin/guardrails", s.withAuth(handleAdminList("guardrails", s.guardrails.List)))
+		mux.HandleFunc("/admin/guardrails/{id}", s.withAuth(s.adminGuardrailHandler().ServeHTTP))
+		mux.HandleFunc("/admin/flags", s.withAuth(handleAdminList("flags", s.featureFlags.List)))
+		mux.HandleFunc("/admin/flags/{id}", s.withAuth(s.adminFeatureFlagHandler().ServeHTTP))
+		mux.HandleFunc("/admin/pipelines", s.withAuth(handleAdminList("pipelines", s.pipelines.List)))
+		mux.HandleFunc("/admin/pipelines/{id}", s.withAuth(s.adminPipelineHandler().ServeHTTP))
+		mux.HandleFunc("/admin/knowledge-bases", s.withAuth(s.handleAdminKnowledgeBases))
+		mux.HandleFunc("/admin/knowledge-bases/{id}", s.withAuth(s.adminKnowledgeBaseHandler().ServeHTTP))
+		mux.HandleFunc("/admin/knowledge-bases/{id}/reindex", s.withAuth(s.handleAdminReindex))
+		mux.HandleFunc("/admin/knowledge-bases/{kb}/documents", s.withAuth(s.handleAdminKnowledgeBaseDocuments))
+		mux.HandleFunc("/admin/knowledge-bases/{kb}/documents/{id}", s.withAuth(s.handleAdminKnowledgeBaseDocuments))
+		mux.HandleFunc("/admin/connectors", s.withAuth(handleAdminList("connectors", s.listConnectors)))
+		mux.HandleFunc("/admin/connectors/{id}", s.withAuth(s.adminConnectorHandler().ServeHTTP))
+		mux.HandleFunc("/admin/connectors/{id}/sync", s.withAuth(s.handleAdminSyncConnector))
+		mux.HandleFunc("/admin/prompt-sets", s.withAuth(handleAdminList("prompt_sets", s.promptSets.List)))
+		mux.HandleFunc("/admin/prompt-sets/{id}", s.withAuth(s.adminPromptSetHandler().ServeHTTP))
+		mux.HandleFunc("/admin/cache/warm", s.withAuth(s.handleAdminWarmCache))
+		mux.HandleFunc("/admin/audit", s.withAuth(s.handleAdminAudit))
+		mux.HandleFunc("/admin/tail", s.withAuth(s.handleAdminTail))
+		mux.HandleFunc("/admin/jobs", s.withAuth(s.handleAdminJobs))
+		mux.HandleFunc("/admin/maintenance", s.withAuth(s.handleAdminMaintenance))
+		mux.HandleFunc("POST /admin/maintenance/{task}", s.withAuth(s.handleAdminRunMaintenance))
+		mux.HandleFunc("/admin/latency", s.withAuth(s.handleAdminLatency))
+		mux.HandleFunc("/admin/requests/{id}/timeline", s.withAuth(s.handleAdminRequestTimeline))
+		mux.HandleFunc("/admin/quarantine", s.withAuth(handleAdminList("responses", s.quarantine.List)))
+		mux.HandleFunc("/admin/slos", s.withAuth(handleAdminList("slos", s.slos.List)))
+		mux.HandleFunc("/admin/slos/{id}", s.withAuth(s.adminSLOHandler().ServeHTTP))
+		mux.HandleFunc("/admin/slo-status", s.withAuth(s.handleAdminSLOStatus))
+		mux.HandleFunc("/admin/alerts", s.withAuth(handleAdminList("alerts", s.alerts.Active)))
+		mux.HandleFunc("/admin/anomalies", s.withAuth(s.handleAdminAnomalies))
+		mux.HandleFunc("/admin/schedules", s.withAuth(handleAdminList("schedules", s.listSchedules)))
+		mux.HandleFunc("/admin/schedules/{id}", s.withAuth(s.adminScheduleHandler().ServeHTTP))
+		mux.HandleFunc("/admin/schedules/{id}/run", s.withAuth(s.handleAdminRunSchedule))
+		mux.HandleFunc("/admin/sessions", s.withAuth(handleAdminList("sessions", s.listSessions)))
+		mux.HandleFunc("/admin/sessions/export", s.withAuth(s.handleAdminExportSessions))
+		mux.HandleFunc("/admin/sessions/{id}/export", s.withAuth(s.handleAdminExportSessions))
+		if s.usage != nil {
+			mux.HandleFunc("/admin/usage/queue", s.withAuth(s.handleAdminUsageQueue))
+		}
+		if s.analytics != nil {
+			mux.HandleFunc("/admin/analytics", s.withAuth(s.withLicense(LicensedAnalytics, s.handleAdminAnalytics)))
+		}
+		if s.costs != nil {
+			mux.HandleFunc("/admin/costs", s.withAuth(s.handleAdminCosts))
+		}
+		if s.keyPool != nil {
+			mux.HandleFunc("/admin/upstream-keys", s.withAuth(handleAdminList("keys", s.keyPool.Status)))
+		}
+		if s.license != nil {
+			mux.HandleFunc("/admin/license", s.withAuth(s.handleAdminLicense))
+		}
+		if s.terms != nil {
+			mux.HandleFunc("POST /admin/keys/{id}/terms-link", s.withAuth(s.handleAdminTermsLink))
+			mux.HandleFunc("/admin/terms", s.withAuth(handleAdminList("acknowledgements", s.terms.List)))
+			mux.HandleFunc("/terms/{token}", s.handleTerms)
+		}
+	}
+	for path, handler := range s.bridges {
+		mux.HandleFunc(path, s.withLicense(LicensedBridges, handler.ServeHTTP))
+	}
+
+	// Mimicking OpenAI API structure
+	mux.HandleFunc("/v1/chat/completions", s.chain(s.handleChatCompletions))
+	mux.HandleFunc("POST /v1/chat/completions/{id}/cancel", s.withTimeline(s.withAuth(s.handleCancelChatCompletion)))
+	mux.HandleFunc("/v1/embeddings", s.chain(s.handleEmbeddings))
+	mux.HandleFunc("/v1/rerank", s.chain(s.handleRerank))
+	mux.HandleFunc("/v1/summarize", s.chain(s.handleSummarize))
+	mux.HandleFunc("/v1/translate", s.chain(s.handleTranslate))
+	mux.HandleFunc("/v1/dedupe", s.chain(s.handleDedupe))
+	mux.HandleFunc("/v1/prompts/diff", s.chain(s.handlePromptDiff))
+	mux.HandleFunc("GET /v1/sessions/{id}", s.withTimeline(s.withAuth(s.handleGetSession)))
+	mux.HandleFunc("POST /v1/sessions/{id}/fork", s.withTimeline(s.withAuth(s.handleForkSession)))
+	mux.HandleFunc("GET /v1/sessions/{id}/branches", s.withTimeline(s.withAuth(s.handleSessionBranches)))
+	mux.HandleFunc("POST /v1/sessions/{id}/drafts/select", s.withTimeline(s.withAuth(s.handleSelectDraft)))
+	mux.HandleFunc("GET /v1/models", s.withTimeline(s.withAuth(s.handleListModels)))
+	mux.HandleFunc("GET /v1/models/{id}", s.withTimeline(s.withAuth(s.handleGetModel)))
+	mux.HandleFunc("/v1/tokenize", s.withTimeline(s.withAuth(s.handleTokenize)))
+	mux.HandleFunc("/v1/detokenize", s.withTimeline(s.withAuth(s.handleDetokenize)))
+	mux.HandleFunc("/v1/tokenize/chat", s.withTimeline(s.withAuth(s.withModelDefaults(s.handlePromptTokens))))
+	mux.HandleFunc("/v1/pipelines/{name}/run", s.chain(s.handleRunPipeline))
+	mux.HandleFunc("/v1/agents/runs/{id}", s.withTimeline(s.withLoadShedding(s.withAuth(s.handleGetAgentRun))))
+	mux.HandleFunc("/v1/agents/runs/{id}/replay", s.chain(s.handleReplayAgentRun))
+	mux.HandleFunc("/health", s.handleHealth)
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	if s.playground {
+		mux.Handle("/playground", playgroundHandler())
+		mux.Handle("/playground/", playgroundHandler())
+	}
+	return s.withLocalizedErrors(mux)
+}
+
+// HTTPServer returns an *http.Server serving Handler on addr
+func (s *ProxyServer) HTTPServer(addr string) *http.Server {
+	return &http.Server{Addr: addr, Handler: s.Handler()}
+}
+
+// readSecretFile reads a secret such as an API key from a mounted file
+func readSecretFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// serverFromEnv configures a proxy server from the settings getenv returns,
+// sharing the process-wide memory guard. Its background work stops with ctx.
+func serverFromEnv(ctx context.Context, getenv func(string) string, memory *memoryGuard) (*ProxyServer, error) {
+	// Settings can come from a config file as well as the environment
+	getenv, config, err := configEnv(getenv)
+	if err != nil {
+		return nil, err
+	}
+
+	// Get OpenAI API key from environment variable, or from a mounted
+	// Secret file when running in Kubernetes
+	apiKey := getenv("OPENAI_API_KEY")
+	apiKeyFile := getenv("OPENAI_API_KEY_FILE")
+	if apiKeyFile != "" {
+		key, err := readSecretFile(apiKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read OPENAI_API_KEY_FILE: %v", err)
+		}
+		apiKey = key
+	}
+	// Or several keys requests are balanced across
+	keyPool, err := keyPoolFromEnv(getenv)
+	if err != nil {
+		return nil, err
+	}
+	if apiKey == "" && keyPool != nil {
+		apiKey = keyPool.keys[0].key
+	}
+	// Replaying recorded replies needs no upstream, nor a key for it
+	recorder, err := recordingsFromEnv(getenv)
+	if err != nil {
+		return nil, err
+	}
+	replaying := recorder != nil && recorder.mode == RecordingReplay
+	if apiKey == "" && !replaying {
+		return nil, fmt.Errorf("OPENAI_API_KEY, OPENAI_API_KEY_FILE or OPENAI_API_KEYS is required")
 	}
 
 	// Create OpenAI client
+	retry, err := retryPolicyFromEnv(getenv)
+	if err != nil {
+		return nil, err
+	}
 	client := NewRealOpenAIClient(apiKey)
+	client.Retry = retry
+	client.Keys = keyPool
+	if v := getenv("OPENAI_BASE_URL"); v != "" {
+		client.BaseURL = strings.TrimSuffix(v, "/")
+	}
+	if v := getenv("PROXY_UPSTREAM_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid PROXY_UPSTREAM_TIMEOUT %q", v)
+		}
+		client.HTTPClient.Timeout = d
+	}
 
 	// Create proxy server
 	server := NewProxyServer(client)
+	server.memory = memory
+	server.keyPool = keyPool
+	server.address = listenAddress(getenv)
+	// Commercial deployments check their entitlement before anything it
+	// covers is configured
+	server.license = licenseFromEnv(getenv, time.Now())
+	if server.license != nil {
+		server.jobs.Add("check-license", time.Hour, false, func(ctx context.Context) error {
+			server.license.Check(time.Now())
+			return nil
+		})
+	}
+	if err := metricsFromEnv(server.metrics, getenv); err != nil {
+		return nil, err
+	}
+	quarantine, err := quarantineFromEnv(getenv)
+	if err != nil {
+		return nil, err
+	}
+	server.quarantine = quarantine
+	client.Quarantine = quarantine
+	if !replaying {
+		if err := server.configureUpstream(ctx, client, getenv); err != nil {
+			return nil, err
+		}
+	}
+	if recorder != nil {
+		client.HTTPClient.Transport = recorder.wrap(client.HTTPClient.Transport)
+	}
+	// Models can be served by Anthropic, Azure OpenAI or Ollama instead, and
+	// fail over to other models
+	if router, err := providerRouterFromEnv(client, getenv); err != nil {
+		return nil, err
+	} else if router != nil && (len(router.providers) == 0 || server.license.Enable(LicensedProviders)) {
+		router.license = server.license
+		server.client = router
+	}
+	if server.timelines, err = timelinesFromEnv(getenv); err != nil {
+		return nil, err
+	}
+	if server.latencies.quantile, err = latencyQuantileFromEnv(getenv); err != nil {
+		return nil, err
+	}
+	if server.submissions, err = submissionGuardFromEnv(getenv); err != nil {
+		return nil, err
+	}
+	if server.audit, err = auditLogFromEnv(getenv); err != nil {
+		return nil, err
+	}
+	if server.mirror, err = requestMirrorFromEnv(getenv); err != nil {
+		return nil, err
+	}
+	if server.tracer, err = tracerFromEnv(getenv); err != nil {
+		return nil, err
+	}
+	if server.tracer != nil {
+		server.jobs.Add("export-traces", traceExportInterval, false, server.tracer.Export)
+	}
+	if server.failures, err = negativeCacheFromEnv(getenv); err != nil {
+		return nil, err
+	}
+	if server.addressLimits, err = addressLimitsFromEnv(getenv); err != nil {
+		return nil, err
+	}
+	if server.queue, err = fairQueueFromEnv(getenv); err != nil {
+		return nil, err
+	}
+	if server.queue != nil {
+		newGaugeFunc(server.metrics.registry, map[string]string{
+			"vibethon_concurrent_requests": "Requests holding one of the PROXY_MAX_CONCURRENT_REQUESTS upstream slots.",
+			"vibethon_queued_requests":     "Requests waiting for an upstream slot.",
+		}, server.queue.samples)
+	}
+	if server.analytics, err = analyticsFromEnv(getenv); err != nil {
+		return nil, err
+	}
+	if server.analytics != nil && !server.license.Enable(LicensedAnalytics) {
+		server.analytics = nil
+	}
+	if server.attribution, err = userAttributionFromEnv(getenv); err != nil {
+		return nil, err
+	}
+	if server.errorCatalog, err = errorCatalogFromEnv(getenv); err != nil {
+		return nil, err
+	}
+	if server.analytics != nil {
+		server.jobs.Add("rollup-usage", time.Minute, false, server.analytics.Rollup)
+	}
+	if server.costs, err = costLedgerFromEnv(getenv); err != nil {
+		return nil, err
+	}
+	if server.costs != nil {
+		server.jobs.Add("save-costs", time.Minute, false, server.costs.Save)
+	}
+
+	// Rate-limit counters can be shared between replicas through Redis
+	if err := server.shareRateLimits(getenv); err != nil {
+		return nil, err
+	}
+
+	// Mounted ConfigMaps and Secrets can optionally be watched for changes
+	var watcher *fileWatcher
+	if interval := getenv("PROXY_WATCH_INTERVAL"); interval != "" {
+		d, err := time.ParseDuration(interval)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid PROXY_WATCH_INTERVAL %q", interval)
+		}
+		watcher = newFileWatcher(d)
+	}
+	if watcher != nil && apiKeyFile != "" {
+		err := watcher.Watch(apiKeyFile, func(data []byte) error {
+			key := strings.TrimSpace(string(data))
+			if key == "" {
+				return fmt.Errorf("upstream API key file is empty")
+			}
+			client.SetAPIKey(key)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Client keys are optional; without them the proxy accepts every request
+	keysFile := getenv("PROXY_KEYS_FILE")
+	if config != nil {
+		server.config = newConfigReloader(server, getenv("PROXY_CONFIG_FILE"))
+		if len(config.Keys) > 0 {
+			if keysFile != "" {
+				return nil, fmt.Errorf("client keys can be set in PROXY_KEYS_FILE or the config file, not both")
+			}
+			server.config.keys = true
+		}
+	}
+	if keysFile != "" || server.config != nil && server.config.keys {
+		keys, err := NewKeyStore(nil)
+		if keysFile != "" {
+			keys, err = LoadKeyStore(keysFile)
+		}
+		if err != nil {
+			return nil, err
+		}
+		server.keys = keys
+		if watcher != nil && keysFile != "" {
+			if err := watcher.Watch(keysFile, keys.ReloadFile); err != nil {
+				return nil, err
+			}
+		}
+		// Keys created through the admin API survive restarts in a store
+		// file, and keys can be served with upstream keys of their own
+		if path := getenv("PROXY_KEYS_STORE_FILE"); path != "" {
+			if err := keys.LoadStore(path); err != nil {
+				return nil, err
+			}
+		}
+		if path := getenv("PROXY_UPSTREAM_KEYS_FILE"); path != "" {
+			if server.upstreamKeys, err = loadUpstreamKeys(path); err != nil {
+				return nil, err
+			}
+			client.KeyOverrides = true
+			if watcher != nil {
+				if err := watcher.Watch(path, server.upstreamKeys.ReloadFile); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if server.config != nil {
+			if err := server.config.apply(config); err != nil {
+				return nil, err
+			}
+		}
+		for _, key := range keys.List() {
+			if err := server.upstreamKeys.check(key.Upstream); err != nil {
+				return nil, fmt.Errorf("client key %s: %w", key.ID, err)
+			}
+		}
+		server.anonymizeSalt = getenv("PROXY_ANONYMIZE_SALT")
+		if server.terms, err = termsGateFromEnv(getenv); err != nil {
+			return nil, err
+		}
+		server.jobs.Add("expire-tokens", time.Minute, false, server.sweepExpiredKeys)
+	} else if server.config != nil {
+		if err := server.config.apply(config); err != nil {
+			return nil, err
+		}
+	}
+	if server.config != nil && watcher != nil {
+		if err := watcher.Watch(server.config.path, server.config.Reload); err != nil {
+			return nil, err
+		}
+	}
+
+	// Usage events go through a local write-ahead queue so a slow or
+	// unavailable collector never blocks requests or loses accounting data
+	if target := getenv("PROXY_USAGE_SINK"); target != "" && server.license.Enable(LicensedUsageSink) {
+		dir := getenv("PROXY_WAL_DIR")
+		if dir == "" {
+			dir = "data/usage-wal"
+		}
+		maxBytes := int64(256 << 20)
+		if v := getenv("PROXY_WAL_MAX_BYTES"); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("invalid PROXY_WAL_MAX_BYTES %q", v)
+			}
+			maxBytes = n
+		}
+		sink, err := eventSinkFromTarget(target, getenv("PROXY_USAGE_SINK_TOKEN"))
+		if err != nil {
+			return nil, err
+		}
+		queue, err := openWALQueue(dir, sink, maxBytes)
+		if err != nil {
+			return nil, err
+		}
+		if v := getenv("PROXY_WAL_BATCH_SIZE"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("invalid PROXY_WAL_BATCH_SIZE %q", v)
+			}
+			queue.batchSize = n
+		}
+		server.usage = queue
+		go queue.Run(ctx)
+	}
+
+	// Replies to response_format requests can be checked by the proxy for
+	// upstreams that do not enforce it
+	if mode := getenv("PROXY_STRUCTURED_OUTPUT"); mode != "" {
+		switch mode {
+		case StructuredOutputNative, StructuredOutputCheck, StructuredOutputEmulate:
+			server.structuredOutput = mode
+		default:
+			return nil, fmt.Errorf("invalid PROXY_STRUCTURED_OUTPUT %q", mode)
+		}
+	}
+	if v := getenv("PROXY_MODELS"); v != "" {
+		for _, model := range strings.Split(v, ",") {
+			if model = strings.TrimSpace(model); model != "" {
+				server.modelAllowlist = append(server.modelAllowlist, model)
+			}
+		}
+	}
+	if v := getenv("PROXY_NATIVE_DIMENSIONS_MODELS"); v != "" {
+		server.nativeDimensionsModels = nil
+		for _, model := range strings.Split(v, ",") {
+			if model = strings.TrimSpace(model); model != "" && model != "none" {
+				server.nativeDimensionsModels = append(server.nativeDimensionsModels, model)
+			}
+		}
+	}
+	if v := getenv("PROXY_AUTO_CONTINUE_TOKENS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid PROXY_AUTO_CONTINUE_TOKENS %q", v)
+		}
+		server.autoContinueTokens = n
+	}
+	switch v := getenv("PROXY_COMPLETION_RETRY"); v {
+	case "", "off":
+	case "on":
+		server.completionRetry = true
+	default:
+		return nil, fmt.Errorf("invalid PROXY_COMPLETION_RETRY %q", v)
+	}
+	if v := getenv("PROXY_STRUCTURED_OUTPUT_RETRIES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid PROXY_STRUCTURED_OUTPUT_RETRIES %q", v)
+		}
+		server.outputRetries = n
+	}
+	if model := getenv("PROXY_RAG_EMBEDDING_MODEL"); model != "" {
+		server.ragEmbeddingModel = model
+	}
+	switch v := getenv("PROXY_RAG_MODEL_MISMATCH"); v {
+	case "", MismatchReject:
+	case MismatchReembed:
+		server.ragModelMismatch = v
+	default:
+		return nil, fmt.Errorf("invalid PROXY_RAG_MODEL_MISMATCH %q", v)
+	}
+	server.ragRetrieval = RetrievalConfig{Mode: getenv("PROXY_RAG_RETRIEVAL"), Fusion: getenv("PROXY_RAG_FUSION")}
+	if v := getenv("PROXY_RAG_VECTOR_WEIGHT"); v != "" {
+		weight, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PROXY_RAG_VECTOR_WEIGHT %q", v)
+		}
+		server.ragRetrieval.VectorWeight = &weight
+	}
+	if err := server.ragRetrieval.validate(); err != nil {
+		return nil, err
+	}
+	if mode := getenv("PROXY_TOOL_CALL_VALIDATION"); mode != "" {
+		switch mode {
+		case ToolCallsUnchecked, ToolCallsValidate, ToolCallsRepair:
+			server.toolCallValidation = mode
+		default:
+			return nil, fmt.Errorf("invalid PROXY_TOOL_CALL_VALIDATION %q", mode)
+		}
+	}
+	if path := getenv("PROXY_CONTENT_FILTERS_FILE"); path != "" {
+		if server.contentFilters, err = loadContentFilters(path); err != nil {
+			return nil, err
+		}
+	}
+	server.defaultModel = getenv("PROXY_DEFAULT_MODEL")
+	if v := getenv("PROXY_MODEL_DEPRECATIONS"); v != "" {
+		if server.deprecations, err = parseModelDeprecations(v); err != nil {
+			return nil, err
+		}
+	}
+	if path := getenv("PROXY_CANNED_ANSWERS_FILE"); path != "" {
+		if server.cannedAnswers, err = loadCannedAnswers(path); err != nil {
+			return nil, err
+		}
+	}
+	if path := getenv("PROXY_REWRITES_FILE"); path != "" {
+		if server.rewrites, err = loadRewrites(path); err != nil {
+			return nil, err
+		}
+	}
+	if path := getenv("PROXY_ROUTES_FILE"); path != "" {
+		if err := server.loadRoutes(path); err != nil {
+			return nil, err
+		}
+	}
+	// Features can be rolled out gradually with the proxy's own flags, or
+	// flags kept in an OpenFeature or LaunchDarkly service, which routing
+	// rules and virtual models can consult too
+	if path := getenv("PROXY_FEATURE_FLAGS_FILE"); path != "" {
+		if err := server.loadFeatureFlags(path); err != nil {
+			return nil, err
+		}
+	}
+	if provider, err := flagProviderFromEnv(getenv); err != nil {
+		return nil, err
+	} else if provider != nil {
+		server.flagProvider = provider
+	}
+	// Builtin tools that reach outside the proxy are off unless configured
+	converter := &unitConverter{}
+	if source := getenv("PROXY_CURRENCY_RATES"); source != "" {
+		converter.rates = newCurrencyRates(source)
+		if v := getenv("PROXY_CURRENCY_RATES_INTERVAL"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < time.Minute {
+				return nil, fmt.Errorf("invalid PROXY_CURRENCY_RATES_INTERVAL %q", v)
+			}
+			converter.rates.interval = d
+		}
+	}
+	server.builtinTools["calculate"] = calculator{}
+	server.builtinTools["convert"] = converter
+	if err := server.addCodeExecutor(getenv); err != nil {
+		return nil, err
+	}
+	if fetcher, err := urlFetcherFromEnv(getenv); err != nil {
+		return nil, err
+	} else if fetcher != nil {
+		server.builtinTools["fetch_url"] = fetcher
+	}
+	if v := getenv("PROXY_TOOL_MAX_ROUNDS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid PROXY_TOOL_MAX_ROUNDS %q", v)
+		}
+		server.toolMaxRounds = n
+	}
+	if store, err := agentRunStoreFromEnv(getenv); err != nil {
+		return nil, err
+	} else {
+		server.agentRuns = store
+	}
+	if backend := getenv("PROXY_RERANK_BACKEND"); backend != "" {
+		if backend != RerankAPI && backend != RerankChat {
+			return nil, fmt.Errorf("invalid PROXY_RERANK_BACKEND %q", backend)
+		}
+		server.rerankBackend = backend
+	}
+	server.summarizeChunkModel = getenv("PROXY_SUMMARIZE_CHUNK_MODEL")
+	server.translateModel = getenv("PROXY_TRANSLATE_MODEL")
+	server.tokenizers = newTokenizers(getenv("PROXY_TOKENIZER_DIR"))
+	server.promptDiffJudge = getenv("PROXY_PROMPT_DIFF_JUDGE")
+	if size := getenv("PROXY_COMPLETION_CACHE_SIZE"); size != "" {
+		n, err := strconv.Atoi(size)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid PROXY_COMPLETION_CACHE_SIZE %q", size)
+		}
+		server.completions.size = n
+	}
+	if ttl := getenv("PROXY_COMPLETION_CACHE_TTL"); ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid PROXY_COMPLETION_CACHE_TTL %q", ttl)
+		}
+		server.completions.ttl = d
+	}
+	if size := getenv("PROXY_TRANSLATE_CACHE_SIZE"); size != "" {
+		n, err := strconv.Atoi(size)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid PROXY_TRANSLATE_CACHE_SIZE %q", size)
+		}
+		server.translations.size = n
+	}
+	if ttl := getenv("PROXY_TRANSLATE_CACHE_TTL"); ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid PROXY_TRANSLATE_CACHE_TTL %q", ttl)
+		}
+		server.translations.ttl = d
+	}
+
+	// Small embedding requests can be merged into fewer upstream calls
+	if window := getenv("PROXY_EMBEDDINGS_BATCH_WINDOW"); window != "" {
+		d, err := time.ParseDuration(window)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid PROXY_EMBEDDINGS_BATCH_WINDOW %q", window)
+		}
+		maxInputs := 2048
+		if v := getenv("PROXY_EMBEDDINGS_BATCH_MAX_INPUTS"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid PROXY_EMBEDDINGS_BATCH_MAX_INPUTS %q", v)
+			}
+			maxInputs = n
+		}
+		server.batcher = newEmbeddingBatcher(server.client.(embeddingsClient), d, maxInputs)
+	}
 
-	// Set up routes - mimicking OpenAI API structure
-	http.HandleFunc("/v1/chat/completions", server.handleChatCompletions)
-	http.HandleFunc("/health", server.handleHealth)
+	// SLO burn-rate and anomaly alerts are logged and optionally sent to a
+	// webhook
+	server.alerts.webhook = getenv("PROXY_ALERT_WEBHOOK")
+	server.jobs.Add("evaluate-slos", time.Minute, false, server.evaluateSLOs)
+	maintenanceInterval := defaultMaintenanceInterval
+	if v := getenv("PROXY_MAINTENANCE_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid PROXY_MAINTENANCE_INTERVAL %q", v)
+		}
+		maintenanceInterval = d
+	}
+	if maintenanceInterval > 0 {
+		server.addMaintenanceJobs(maintenanceInterval)
+	}
+	if v := getenv("PROXY_ANOMALY_THRESHOLD"); v != "" {
+		threshold, err := strconv.ParseFloat(v, 64)
+		if err != nil || threshold <= 0 {
+			return nil, fmt.Errorf("invalid PROXY_ANOMALY_THRESHOLD %q", v)
+		}
+		server.anomalies.threshold = threshold
+	}
+	server.jobs.Add("detect-anomalies", time.Minute, false, server.detectAnomalies)
+	// Scheduled prompts run on the leader only so each fires once
+	server.jobs.Add("run-schedules", 15*time.Second, true, server.runDueSchedules)
+	// Knowledge bases are per replica, so every replica syncs its connectors
+	server.jobs.Add("sync-connectors", 15*time.Second, false, server.syncDueConnectors)
 
-	// Get port from environment or default to 8080
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	// Chat bots on Telegram or Slack and an email gateway can talk to
+	// models through the proxy
+	bridges, err := botBridgesFromEnv(server, getenv)
+	if err != nil {
+		return nil, err
+	}
+	if len(bridges) > 0 && !server.license.Enable(LicensedBridges) {
+		bridges = nil
+	}
+	server.bridges = bridges
+	for path := range bridges {
+		log.Printf("Bot bridge enabled at %s", path)
 	}
+	server.jobs.Add("expire-sessions", time.Minute, false, func(ctx context.Context) error {
+		server.sessions.RemoveExpired()
+		return nil
+	})
 
-	log.Printf("Starting OpenAI proxy server on port %s", port)
-	log.Printf("Chat completions endpoint: http://localhost:%s/v1/chat/completions", port)
-	log.Printf("Health check endpoint: http://localhost:%s/health", port)
-	
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
-		log.Fatal("Server failed to start:", err)
+	// With several replicas, singleton jobs are coordinated through a lease
+	if elector, err := leaderElectorFromEnv(getenv); err != nil {
+		return nil, err
+	} else if elector != nil {
+		server.jobs.elector = elector
+	}
+	server.jobs.Start(ctx)
+
+	if watcher != nil {
+		go watcher.Run(ctx.Done())
+	}
+
+	server.playground = getenv("PROXY_PLAYGROUND") != "off"
+	return server, nil
+}
+
+// runOfflineCommand runs the offline tooling named by args instead of the
+// server, if there is one, and reports whether it did
+func runOfflineCommand(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	var run func(args []string, stdin io.Reader, stdout io.Writer) error
+	switch args[0] {
+	case "dataset":
+		run = runDatasetCommand
+	case "usage":
+		run = runUsageCommand
+	default:
+		return false
+	}
+	if err := run(args[1:], os.Stdin, os.Stdout); err != nil {
+		log.Fatal(err)
 	}
+	return true
 }
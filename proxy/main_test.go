@@ -390,4 +390,51 @@ func TestProxyServer_Integration(t *testing.T) {
 	if len(response.Choices) == 0 {
 		t.Error("Expected at least one choice in response")
 	}
-} 
\ No newline at end of file
+}
+
+func TestProxyServer_HandlersAreIndependent(t *testing.T) {
+	first := NewProxyServer(&MockOpenAIClient{response: createTestChatCompletionResponse()})
+	first.playground = true
+	other := createTestChatCompletionResponse()
+	other.Model = "gpt-4o"
+	second := NewProxyServer(&MockOpenAIClient{response: other})
+
+	ts1 := httptest.NewServer(first.Handler())
+	defer ts1.Close()
+	ts2 := httptest.NewServer(second.Handler())
+	defer ts2.Close()
+
+	jsonData, _ := json.Marshal(createTestChatCompletionRequest())
+	for _, tc := range []struct {
+		url   string
+		model string
+	}{{ts1.URL, "gpt-3.5-turbo"}, {ts2.URL, "gpt-4o"}} {
+		resp, err := http.Post(tc.url+"/v1/chat/completions", "application/json", bytes.NewReader(jsonData))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body ChatCompletionResponse
+		json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if body.Model != tc.model {
+			t.Errorf("%s answered with model %q, want %q", tc.url, body.Model, tc.model)
+		}
+	}
+
+	for url, want := range map[string]int{ts1.URL: http.StatusOK, ts2.URL: http.StatusNotFound} {
+		resp, err := http.Get(url + "/playground/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("%s/playground/ returned %d, want %d", url, resp.StatusCode, want)
+		}
+	}
+	if resp, err := http.Get(ts1.URL + "/admin/keys"); err == nil {
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("admin API served without client keys: %d", resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Some space is only reclaimed in passing: caches evict expired entries
+// when they are looked up, the audit log deletes files past retention when
+// it starts a new one, and vectors decoded from upstream replies keep spare
+// capacity. Maintenance tasks reclaim it on a schedule, every
+// PROXY_MAINTENANCE_INTERVAL, and on demand through the admin API. The
+// proxy keeps no database of its own, so there is nothing to vacuum.
+
+// Maintenance tasks
+const (
+	MaintenanceSweepCaches    = "sweep-caches"
+	MaintenancePruneAuditLog  = "prune-audit-log"
+	MaintenanceCompactVectors = "compact-vectors"
+)
+
+// defaultMaintenanceInterval is how often maintenance tasks run
+const defaultMaintenanceInterval = time.Hour
+
+// MaintenanceRun is the outcome of the last run of a maintenance task
+type MaintenanceRun struct {
+	Task string    `json:"task"`
+	Time time.Time `json:"time"`
+	// Removed counts the cache entries, files or vectors removed or
+	// compacted
+	Removed int `json:"removed"`
+	// ReclaimedBytes is the memory or disk freed, where known
+	ReclaimedBytes int64 `json:"reclaimed_bytes"`
+	DurationMS     int64 `json:"duration_ms"`
+}
+
+// maintenanceRuns keeps the last run of each task
+type maintenanceRuns struct {
+	mu   sync.Mutex
+	last map[string]MaintenanceRun
+}
+
+// maintenanceTasks returns the tasks that have something to maintain, each
+// returning what it removed and the bytes it freed
+func (s *ProxyServer) maintenanceTasks() map[string]func() (int, int64) {
+	tasks := map[string]func() (int, int64){
+		MaintenanceSweepCaches: func() (int, int64) {
+			swept := s.completions.Sweep() + s.translations.Sweep() + s.failures.Sweep() + s.modelsCache.Sweep()
+			return swept, 0
+		},
+		MaintenanceCompactVectors: s.compactVectors,
+	}
+	if s.audit != nil && s.audit.retention > 0 {
+		tasks[MaintenancePruneAuditLog] = s.audit.Prune
+	}
+	return tasks
+}
+
+// runMaintenance runs a task and records the outcome
+func (s *ProxyServer) runMaintenance(name string, task func() (int, int64)) MaintenanceRun {
+	start := time.Now()
+	removed, reclaimed := task()
+	run := MaintenanceRun{Task: name, Time: start.UTC(), Removed: removed, ReclaimedBytes: reclaimed, DurationMS: time.Since(start).Milliseconds()}
+
+	s.metrics.maintenanceRuns.Add(1, name)
+	s.metrics.maintenanceDuration.Observe(time.Since(start).Seconds(), name)
+	s.metrics.maintenanceRemoved.Add(float64(removed), name)
+	s.metrics.maintenanceReclaimed.Add(float64(reclaimed), name)
+	s.maintenance.mu.Lock()
+	s.maintenance.last[name] = run
+	s.maintenance.mu.Unlock()
+	return run
+}
+
+// addMaintenanceJobs schedules every maintenance task as a background job
+func (s *ProxyServer) addMaintenanceJobs(interval time.Duration) {
+	for name, task := range s.maintenanceTasks() {
+		s.jobs.Add(name, interval, false, func(context.Context) error {
+			s.runMaintenance(name, task)
+			return nil
+		})
+	}
+}
+
+// handleAdminMaintenance lists the maintenance tasks with their last run
+func (s *ProxyServer) handleAdminMaintenance(w http.ResponseWriter, r *http.Request) {
+	handleAdminList("tasks", func() []MaintenanceRun {
+		tasks := s.maintenanceTasks()
+		runs := []MaintenanceRun{}
+		s.maintenance.mu.Lock()
+		defer s.maintenance.mu.Unlock()
+		for _, name := range []string{MaintenanceSweepCaches, MaintenancePruneAuditLog, MaintenanceCompactVectors} {
+			if tasks[name] == nil {
+				continue
+			}
+			run, ok := s.maintenance.last[name]
+			if !ok {
+				run = MaintenanceRun{Task: name}
+			}
+			runs = append(runs, run)
+		}
+		return runs
+	})(w, r)
+}
+
+// handleAdminRunMaintenance runs the maintenance task in the path at once
+func (s *ProxyServer) handleAdminRunMaintenance(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("task")
+	task, ok := s.maintenanceTasks()[name]
+	if !ok {
+		http.Error(w, "Unknown maintenance task "+name, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.runMaintenance(name, task))
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProxyServer_CompactVectors(t *testing.T) {
+	server := NewProxyServer(&MockOpenAIClient{response: createTestChatCompletionResponse()})
+	kb := KnowledgeBase{ID: "default", docs: newRegistry[RAGDocument](), stats: &knowledgeBaseStats{}}
+	server.knowledgeBases.Put(kb.ID, kb)
+	padded := make([]float64, 3, 8)
+	kb.docs.Put("a", RAGDocument{ID: "a", chunks: []ragChunk{{text: "x", vector: padded}, {text: "y", vector: []float64{1, 2}}}})
+	before, _ := kb.docs.Get("a")
+
+	if compacted, freed := server.compactVectors(); compacted != 1 || freed != 5*8 {
+		t.Errorf("Expected one vector compacted freeing 40 bytes, got %d and %d", compacted, freed)
+	}
+	doc, _ := kb.docs.Get("a")
+	if v := doc.chunks[0].vector; len(v) != 3 || cap(v) != 3 {
+		t.Errorf("Expected the vector reallocated to its length, got len %d cap %d", len(v), cap(v))
+	}
+	if cap(before.chunks[0].vector) != 8 {
+		t.Error("Expected chunks read before compaction to be left alone")
+	}
+	if compacted, _ := server.compactVectors(); compacted != 0 {
+		t.Errorf("Expected nothing left to compact, got %d", compacted)
+	}
+}
+
+func TestProxyServer_AdminMaintenance(t *testing.T) {
+	server := NewProxyServer(&MockOpenAIClient{response: createTestChatCompletionResponse()})
+	server.keys = createTestKeyStore(t)
+	handler := server.Handler()
+	now := time.Now()
+	server.translations.now = func() time.Time { return now }
+	server.translations.Put("a", TranslateResponse{})
+	now = now.Add(48 * time.Hour)
+
+	admin := func(method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer sk-admin-rw")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	w := admin(http.MethodPost, "/admin/maintenance/"+MaintenanceSweepCaches)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var run MaintenanceRun
+	json.Unmarshal(w.Body.Bytes(), &run)
+	if run.Task != MaintenanceSweepCaches || run.Removed != 1 {
+		t.Errorf("Expected the expired translation swept, got %+v", run)
+	}
+	if w := admin(http.MethodPost, "/admin/maintenance/"+MaintenancePruneAuditLog); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d without an audit log, got %d", http.StatusNotFound, w.Code)
+	}
+
+	var list struct {
+		Tasks []MaintenanceRun `json:"tasks"`
+	}
+	json.Unmarshal(admin(http.MethodGet, "/admin/maintenance").Body.Bytes(), &list)
+	if len(list.Tasks) != 2 || list.Tasks[0].Removed != 1 || list.Tasks[1].Task != MaintenanceCompactVectors || !list.Tasks[1].Time.IsZero() {
+		t.Errorf("Expected both tasks with the last run of the sweep, got %+v", list.Tasks)
+	}
+	metrics := httptest.NewRecorder()
+	server.handleMetrics(metrics, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.Contains(metrics.Body.String(), `vibethon_maintenance_removed_total{task="sweep-caches"} 1`) {
+		t.Errorf("Expected the swept entry in the metrics, got %s", metrics.Body.String())
+	}
+}
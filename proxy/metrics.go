@@ -0,0 +1,550 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A small Prometheus-compatible metrics registry, enough for counters and
+// histograms with labels in the text exposition format without pulling in
+// the client library.
+
+// Latency buckets in seconds, from fast cache hits to long generations
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// Inter-token gaps are much shorter than whole requests
+var interTokenBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.02, 0.035, 0.05, 0.075, 0.1, 0.15, 0.25, 0.5, 1}
+
+type metric interface {
+	writeTo(w io.Writer)
+}
+
+type metricsRegistry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+func (r *metricsRegistry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+// Write writes all metrics in the Prometheus text format
+func (r *metricsRegistry) Write(w io.Writer) {
+	r.mu.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.mu.Unlock()
+	for _, m := range metrics {
+		m.writeTo(w)
+	}
+}
+
+// seriesKey joins label values into a map key
+func seriesKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string, extra ...string) string {
+	var b strings.Builder
+	pair := func(name, value string) {
+		if b.Len() > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name + `="` + labelEscaper.Replace(value) + `"`)
+	}
+	for i, name := range names {
+		pair(name, values[i])
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pair(extra[i], extra[i+1])
+	}
+	if b.Len() == 0 {
+		return ""
+	}
+	return "{" + b.String() + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// counterVec is a monotonically increasing counter per label combination
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	series map[string]*counterSeries
+}
+
+type counterSeries struct {
+	values []string
+	value  float64
+}
+
+func newCounterVec(r *metricsRegistry, name, help string, labels ...string) *counterVec {
+	c := &counterVec{name: name, help: help, labels: labels, series: make(map[string]*counterSeries)}
+	r.register(c)
+	return c
+}
+
+func (c *counterVec) Add(v float64, values ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := seriesKey(values)
+	s, ok := c.series[key]
+	if !ok {
+		s = &counterSeries{values: append([]string(nil), values...)}
+		c.series[key] = s
+	}
+	s.value += v
+}
+
+func (c *counterVec) writeTo(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.series) {
+		s := c.series[key]
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, s.values), formatFloat(s.value))
+	}
+}
+
+// histogramVec counts observations into fixed buckets per label combination
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	values []string
+	// counts[i] counts observations <= buckets[i]; the last entry counts
+	// observations above every bucket
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogramVec(r *metricsRegistry, name, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*histogramSeries)}
+	r.register(h)
+	return h
+}
+
+func (h *histogramVec) Observe(v float64, values ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := seriesKey(values)
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{values: append([]string(nil), values...), counts: make([]uint64, len(h.buckets)+1)}
+		h.series[key] = s
+	}
+	s.counts[sort.SearchFloat64s(h.buckets, v)]++
+	s.sum += v
+	s.count++
+}
+
+func (h *histogramVec) writeTo(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		var cumulative uint64
+		for i, n := range s.counts {
+			cumulative += n
+			le := math.Inf(1)
+			if i < len(h.buckets) {
+				le = h.buckets[i]
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, s.values, "le", formatFloat(le)), cumulative)
+		}
+		labels := formatLabels(h.labels, s.values)
+		fmt.Fprintf(w, "%s_sum%s %s\n%s_count%s %d\n", h.name, labels, formatFloat(s.sum), h.name, labels, s.count)
+	}
+}
+
+// gaugeSample is one value of a gauge computed at scrape time. labels
+// alternates label names and values.
+type gaugeSample struct {
+	metric string
+	labels []string
+	value  float64
+}
+
+// gaugeFunc exports gauges whose values are derived from other state when
+// scraped, such as SLO burn rates
+type gaugeFunc struct {
+	help    map[string]string
+	collect func() []gaugeSample
+}
+
+func newGaugeFunc(r *metricsRegistry, help map[string]string, collect func() []gaugeSample) *gaugeFunc {
+	g := &gaugeFunc{help: help, collect: collect}
+	r.register(g)
+	return g
+}
+
+func (g *gaugeFunc) writeTo(w io.Writer) {
+	byMetric := make(map[string][]gaugeSample)
+	var names []string
+	for _, sample := range g.collect() {
+		if _, ok := byMetric[sample.metric]; !ok {
+			names = append(names, sample.metric)
+		}
+		byMetric[sample.metric] = append(byMetric[sample.metric], sample)
+	}
+	for _, name := range names {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, g.help[name], name)
+		for _, sample := range byMetric[name] {
+			fmt.Fprintf(w, "%s%s %s\n", name, formatLabels(nil, nil, sample.labels...), formatFloat(sample.value))
+		}
+	}
+}
+
+// LatencySummary condenses one histogram series for the dashboard
+type LatencySummary struct {
+	Count uint64  `json:"count"`
+	Mean  float64 `json:"mean_seconds"`
+	P50   float64 `json:"p50_seconds"`
+	P95   float64 `json:"p95_seconds"`
+	P99   float64 `json:"p99_seconds"`
+}
+
+// summaries returns a summary per series keyed by its label values
+func (h *histogramVec) summaries() map[string]LatencySummary {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out := make(map[string]LatencySummary, len(h.series))
+	for key, s := range h.series {
+		out[key] = LatencySummary{
+			Count: s.count,
+			Mean:  s.sum / float64(s.count),
+			P50:   h.quantile(s, 0.5),
+			P95:   h.quantile(s, 0.95),
+			P99:   h.quantile(s, 0.99),
+		}
+	}
+	return out
+}
+
+// quantile estimates a quantile by linear interpolation within its bucket,
+// like Prometheus' histogram_quantile. Callers must hold h.mu.
+func (h *histogramVec) quantile(s *histogramSeries, q float64) float64 {
+	rank := q * float64(s.count)
+	var cumulative uint64
+	for i, n := range s.counts {
+		if float64(cumulative+n) < rank || n == 0 {
+			cumulative += n
+			continue
+		}
+		if i == len(h.buckets) {
+			// Above the last bucket there is no upper bound to interpolate to
+			return h.buckets[len(h.buckets)-1]
+		}
+		lower := 0.0
+		if i > 0 {
+			lower = h.buckets[i-1]
+		}
+		return lower + (h.buckets[i]-lower)*(rank-float64(cumulative))/float64(n)
+	}
+	return 0
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Request metrics can be labelled by these properties of a request. Each
+// label multiplies the number of series, so per-key labels are opt-in.
+const (
+	MetricLabelEndpoint = "endpoint"
+	MetricLabelModel    = "model"
+	MetricLabelTenant   = "tenant"
+	MetricLabelKey      = "key"
+)
+
+// otherLabelValue replaces label values past the limit of their label
+const otherLabelValue = "other"
+
+// labelLimiter bounds the distinct values of each label. Clients choose
+// model names and operators add keys, so without a bound a label could
+// grow the series Prometheus has to keep without limit. The first values
+// seen of a label keep series of their own and later ones, the rare ones
+// in a proxy that has been up for a while, are collapsed into "other".
+type labelLimiter struct {
+	max       int
+	collapsed *counterVec
+
+	mu     sync.Mutex
+	values map[string]map[string]bool
+}
+
+// value returns v, or "other" if label already has its maximum of values.
+// A max of 0 leaves values alone.
+func (l *labelLimiter) value(label, v string) string {
+	if l.max <= 0 || v == "" {
+		return v
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	seen := l.values[label]
+	if seen == nil {
+		seen = make(map[string]bool)
+		l.values[label] = seen
+	}
+	if !seen[v] {
+		if len(seen) >= l.max {
+			l.collapsed.Add(1, label)
+			return otherLabelValue
+		}
+		seen[v] = true
+	}
+	return v
+}
+
+// proxyMetrics are the metrics the proxy exports
+type proxyMetrics struct {
+	registry *metricsRegistry
+	limiter  *labelLimiter
+
+	// The request labels of each metric, in front of its own labels
+	requestLabels  []string
+	durationLabels []string
+	tokenLabels    []string
+
+	requests         *counterVec
+	requestDuration  *histogramVec
+	tokens           *counterVec
+	timeToFirstToken *histogramVec
+	interTokenDelay  *histogramVec
+	cacheLookups     *counterVec
+	// Upstream connections taken for requests, and TLS handshakes of the
+	// new ones
+	upstreamConnections *counterVec
+	tlsHandshakes       *counterVec
+	dnsLookups          *counterVec
+
+	// Maintenance task runs, how long they took and what they freed
+	maintenanceRuns      *counterVec
+	maintenanceDuration  *histogramVec
+	maintenanceRemoved   *counterVec
+	maintenanceReclaimed *counterVec
+
+	// contentFilterMatches counts what content filters found, by filter
+	// and action
+	contentFilterMatches *counterVec
+	// rewrites counts requests rewrite rules changed, by rule
+	rewrites *counterVec
+	// deprecatedModels counts requests for deprecated models, by model and
+	// replacement
+	deprecatedModels *counterVec
+	// cannedAnswers counts chat completions served a canned answer, by
+	// answer
+	cannedAnswers *counterVec
+}
+
+func newProxyMetrics() *proxyMetrics {
+	r := &metricsRegistry{}
+	return &proxyMetrics{
+		registry:            r,
+		limiter:             &labelLimiter{max: 100, collapsed: newCounterVec(r, "vibethon_metric_label_values_collapsed_total", "Observations whose label value was collapsed into \"other\", by label.", "label"), values: make(map[string]map[string]bool)},
+		requestLabels:       []string{MetricLabelEndpoint},
+		durationLabels:      []string{MetricLabelEndpoint, MetricLabelModel},
+		tokenLabels:         []string{MetricLabelModel},
+		requests:            newCounterVec(r, "vibethon_requests_total", "Requests sent upstream by endpoint and status.", "endpoint", "status"),
+		requestDuration:     newHistogramVec(r, "vibethon_request_duration_seconds", "Upstream request latency.", latencyBuckets, "endpoint", "model", "upstream"),
+		tokens:              newCounterVec(r, "vibethon_tokens_total", "Tokens used by model and kind.", "model", "kind"),
+		timeToFirstToken:    newHistogramVec(r, "vibethon_time_to_first_token_seconds", "Time until the first token of a streamed response.", latencyBuckets, "model", "upstream"),
+		interTokenDelay:     newHistogramVec(r, "vibethon_inter_token_latency_seconds", "Time between consecutive tokens of a streamed response.", interTokenBuckets, "model", "upstream"),
+		cacheLookups:        newCounterVec(r, "vibethon_cache_lookups_total", "Lookups in the proxy's response caches by cache and result.", "cache", "result"),
+		upstreamConnections: newCounterVec(r, "vibethon_upstream_connections_total", "Upstream connections taken for requests, by whether they were reused.", "upstream", "reused"),
+		tlsHandshakes:       newCounterVec(r, "vibethon_upstream_tls_handshakes_total", "TLS handshakes with the upstream, by whether they resumed a session.", "upstream", "resumed"),
+		dnsLookups:          newCounterVec(r, "vibethon_dns_lookups_total", "Lookups of upstream hostnames by result.", "result"),
+
+		maintenanceRuns:      newCounterVec(r, "vibethon_maintenance_runs_total", "Maintenance task runs by task.", "task"),
+		maintenanceDuration:  newHistogramVec(r, "vibethon_maintenance_duration_seconds", "Duration of maintenance task runs.", latencyBuckets, "task"),
+		maintenanceRemoved:   newCounterVec(r, "vibethon_maintenance_removed_total", "Cache entries, files and vectors removed or compacted by maintenance tasks.", "task"),
+		maintenanceReclaimed: newCounterVec(r, "vibethon_maintenance_reclaimed_bytes_total", "Bytes of memory or disk reclaimed by maintenance tasks.", "task"),
+
+		contentFilterMatches: newCounterVec(r, "vibethon_content_filter_matches_total", "Matches of content filters in requests, by filter and action.", "filter", "action"),
+		rewrites:             newCounterVec(r, "vibethon_rewrites_total", "Requests changed by rewrite rules, by rule.", "rule"),
+		deprecatedModels:     newCounterVec(r, "vibethon_deprecated_model_requests_total", "Requests for deprecated models, by model and the replacement they were sent to.", "model", "replacement"),
+		cannedAnswers:        newCounterVec(r, "vibethon_canned_answers_total", "Chat completions served a canned answer instead of calling the upstream, by answer.", "answer"),
+	}
+}
+
+// setRequestLabels labels the requests, request duration and tokens metrics
+// by labels instead of their defaults. It must be called before anything is
+// observed.
+func (m *proxyMetrics) setRequestLabels(labels []string) {
+	m.requestLabels, m.durationLabels, m.tokenLabels = labels, labels, labels
+	m.requests.labels = append(slices.Clone(labels), "status")
+	m.requestDuration.labels = append(slices.Clone(labels), "upstream")
+	m.tokens.labels = append(slices.Clone(labels), "kind")
+}
+
+// labelValues returns the values of labels for event, followed by extra
+func (m *proxyMetrics) labelValues(labels []string, event UsageEvent, extra string) []string {
+	values := make([]string, 0, len(labels)+1)
+	for _, label := range labels {
+		var v string
+		switch label {
+		case MetricLabelEndpoint:
+			v = event.Endpoint
+		case MetricLabelModel:
+			v = event.Model
+		case MetricLabelTenant:
+			v = event.Tenant
+		case MetricLabelKey:
+			v = event.KeyID
+		}
+		values = append(values, m.limiter.value(label, v))
+	}
+	return append(values, extra)
+}
+
+// observe records a finished upstream request
+func (m *proxyMetrics) observe(event UsageEvent, upstream string) {
+	m.requests.Add(1, m.labelValues(m.requestLabels, event, strconv.Itoa(event.Status))...)
+	m.requestDuration.Observe(float64(event.LatencyMS)/1000, m.labelValues(m.durationLabels, event, upstream)...)
+	if event.PromptTokens > 0 {
+		m.tokens.Add(float64(event.PromptTokens), m.labelValues(m.tokenLabels, event, "prompt")...)
+	}
+	if event.CompletionTokens > 0 {
+		m.tokens.Add(float64(event.CompletionTokens), m.labelValues(m.tokenLabels, event, "completion")...)
+	}
+}
+
+// metricsFromEnv labels request metrics by PROXY_METRICS_LABELS, a comma
+// separated list of endpoint, model, tenant and key, and bounds the values
+// of each label to PROXY_METRICS_MAX_LABEL_VALUES, 100 by default
+func metricsFromEnv(m *proxyMetrics, getenv func(string) string) error {
+	if v := getenv("PROXY_METRICS_LABELS"); v != "" {
+		var labels []string
+		for _, label := range strings.Split(v, ",") {
+			label = strings.TrimSpace(label)
+			switch label {
+			case MetricLabelEndpoint, MetricLabelModel, MetricLabelTenant, MetricLabelKey:
+			default:
+				return fmt.Errorf("invalid PROXY_METRICS_LABELS %q, expected endpoint, model, tenant or key", v)
+			}
+			if slices.Contains(labels, label) {
+				return fmt.Errorf("invalid PROXY_METRICS_LABELS %q, %s is repeated", v, label)
+			}
+			labels = append(labels, label)
+		}
+		m.setRequestLabels(labels)
+	}
+	if v := getenv("PROXY_METRICS_MAX_LABEL_VALUES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid PROXY_METRICS_MAX_LABEL_VALUES %q", v)
+		}
+		m.limiter.max = n
+	}
+	return nil
+}
+
+// streamTimer measures the interactive latency of a streamed response: the
+// time to the first token and the gaps between tokens. Total latency hides
+// both, since a slow but steady stream and a long stall before a burst can
+// take the same time overall. Each content chunk counts as one token, which
+// is how OpenAI-compatible upstreams stream.
+type streamTimer struct {
+	metrics  *proxyMetrics
+	model    string
+	upstream string
+	now      func() time.Time
+	start    time.Time
+	last     time.Time
+}
+
+func (m *proxyMetrics) newStreamTimer(model, upstream string) *streamTimer {
+	return &streamTimer{metrics: m, model: m.limiter.value(MetricLabelModel, model), upstream: upstream, now: time.Now, start: time.Now()}
+}
+
+// Token records the arrival of a content chunk
+func (t *streamTimer) Token() {
+	now := t.now()
+	if t.last.IsZero() {
+		t.metrics.timeToFirstToken.Observe(now.Sub(t.start).Seconds(), t.model, t.upstream)
+	} else {
+		t.metrics.interTokenDelay.Observe(now.Sub(t.last).Seconds(), t.model, t.upstream)
+	}
+	t.last = now
+}
+
+func (s *ProxyServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	s.metrics.registry.Write(w)
+}
+
+// StreamingLatency is the dashboard view of one model and upstream
+type StreamingLatency struct {
+	Model            string          `json:"model"`
+	Upstream         string          `json:"upstream"`
+	TimeToFirstToken *LatencySummary `json:"time_to_first_token,omitempty"`
+	InterToken       *LatencySummary `json:"inter_token,omitempty"`
+}
+
+// handleAdminLatency summarizes streaming latency per model and upstream
+// for the dashboard
+func (s *ProxyServer) handleAdminLatency(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ttft := s.metrics.timeToFirstToken.summaries()
+	itl := s.metrics.interTokenDelay.summaries()
+	byKey := make(map[string]*StreamingLatency)
+	entry := func(key string) *StreamingLatency {
+		if e, ok := byKey[key]; ok {
+			return e
+		}
+		values := strings.Split(key, "\xff")
+		e := &StreamingLatency{Model: values[0], Upstream: values[1]}
+		byKey[key] = e
+		return e
+	}
+	for key, summary := range ttft {
+		entry(key).TimeToFirstToken = &summary
+	}
+	for key, summary := range itl {
+		entry(key).InterToken = &summary
+	}
+
+	out := make([]*StreamingLatency, 0, len(byKey))
+	for _, key := range sortedKeys(byKey) {
+		out = append(out, byKey[key])
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"latency": out})
+}
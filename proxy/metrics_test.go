@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCounterVec_Write(t *testing.T) {
+	r := &metricsRegistry{}
+	c := newCounterVec(r, "test_total", "A test counter.", "code")
+	c.Add(1, "200")
+	c.Add(2, "200")
+	c.Add(1, `quo"te`)
+
+	var buf bytes.Buffer
+	r.Write(&buf)
+	out := buf.String()
+	for _, want := range []string{
+		"# TYPE test_total counter\n",
+		`test_total{code="200"} 3` + "\n",
+		`test_total{code="quo\"te"} 1` + "\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected output to contain %q, got:\n%s", want, out)
+		}
+	}
+}
+
+func TestHistogramVec_Write(t *testing.T) {
+	r := &metricsRegistry{}
+	h := newHistogramVec(r, "test_seconds", "A test histogram.", []float64{0.1, 1}, "model")
+	h.Observe(0.05, "m")
+	h.Observe(0.5, "m")
+	h.Observe(5, "m")
+
+	var buf bytes.Buffer
+	r.Write(&buf)
+	out := buf.String()
+	for _, want := range []string{
+		`test_seconds_bucket{model="m",le="0.1"} 1`,
+		`test_seconds_bucket{model="m",le="1"} 2`,
+		`test_seconds_bucket{model="m",le="+Inf"} 3`,
+		`test_seconds_sum{model="m"} 5.55`,
+		`test_seconds_count{model="m"} 3`,
+	} {
+		if !strings.Contains(out, want+"\n") {
+			t.Errorf("Expected output to contain %q, got:\n%s", want, out)
+		}
+	}
+}
+
+func TestHistogramVec_Quantiles(t *testing.T) {
+	h := newHistogramVec(&metricsRegistry{}, "q", "", []float64{1, 2, 3, 4}, "l")
+	for i := 0; i < 100; i++ {
+		h.Observe(float64(i%4)+0.5, "x")
+	}
+	s := h.summaries()[seriesKey([]string{"x"})]
+	if s.Count != 100 || math.Abs(s.Mean-2) > 1e-9 {
+		t.Errorf("Expected 100 observations with mean 2, got %+v", s)
+	}
+	if math.Abs(s.P50-2) > 1e-9 {
+		t.Errorf("Expected p50 of 2, got %v", s.P50)
+	}
+	if s.P99 <= 3 || s.P99 > 4 {
+		t.Errorf("Expected p99 in the last bucket, got %v", s.P99)
+	}
+}
+
+func TestStreamTimer(t *testing.T) {
+	m := newProxyMetrics()
+	timer := m.newStreamTimer("gpt-4o", "openai")
+	start := timer.start
+	offsets := []time.Duration{400 * time.Millisecond, 420 * time.Millisecond, 450 * time.Millisecond}
+	for _, offset := range offsets {
+		timer.now = func() time.Time { return start.Add(offset) }
+		timer.Token()
+	}
+
+	key := seriesKey([]string{"gpt-4o", "openai"})
+	ttft := m.timeToFirstToken.summaries()[key]
+	if ttft.Count != 1 || math.Abs(ttft.Mean-0.4) > 1e-9 {
+		t.Errorf("Expected one TTFT observation of 0.4s, got %+v", ttft)
+	}
+	itl := m.interTokenDelay.summaries()[key]
+	if itl.Count != 2 || math.Abs(itl.Mean-0.025) > 1e-9 {
+		t.Errorf("Expected two inter-token observations averaging 25ms, got %+v", itl)
+	}
+}
+
+func TestProxyServer_HandleMetrics(t *testing.T) {
+	server := NewProxyServer(&MockOpenAIClient{response: createTestChatCompletionResponse()})
+
+	jsonData, _ := json.Marshal(createTestChatCompletionRequest())
+	server.handleChatCompletions(httptest.NewRecorder(), httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader(jsonData)))
+
+	w := httptest.NewRecorder()
+	server.handleMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+	out := w.Body.String()
+	for _, want := range []string{
+		`vibethon_requests_total{endpoint="chat.completions",status="200"} 1`,
+		`vibethon_request_duration_seconds_count{endpoint="chat.completions",model="gpt-3.5-turbo",upstream="openai"} 1`,
+		`vibethon_tokens_total{model="gpt-3.5-turbo",kind="prompt"} 12`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", want, out)
+		}
+	}
+}
+
+func TestProxyServer_HandleAdminLatency(t *testing.T) {
+	server := NewProxyServer(&MockOpenAIClient{})
+	timer := server.metrics.newStreamTimer("gpt-4o", "openai")
+	timer.Token()
+	timer.Token()
+
+	w := httptest.NewRecorder()
+	server.handleAdminLatency(w, httptest.NewRequest("GET", "/admin/latency", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	var resp struct {
+		Latency []StreamingLatency `json:"latency"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if len(resp.Latency) != 1 || resp.Latency[0].Model != "gpt-4o" || resp.Latency[0].TimeToFirstToken == nil || resp.Latency[0].InterToken == nil {
+		t.Errorf("Unexpected latency summary %s", w.Body.String())
+	}
+}
+
+func TestProxyMetrics_RequestLabels(t *testing.T) {
+	t.Setenv("PROXY_METRICS_LABELS", "tenant,key")
+	t.Setenv("PROXY_METRICS_MAX_LABEL_VALUES", "2")
+	m := newProxyMetrics()
+	if err := metricsFromEnv(m, os.Getenv); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"web", "batch", "web", "ci", "cron"} {
+		m.observe(UsageEvent{Endpoint: "chat.completions", Model: "gpt-4o", Tenant: "acme", KeyID: key, Status: 200, PromptTokens: 10}, "openai")
+	}
+
+	var b strings.Builder
+	m.registry.Write(&b)
+	out := b.String()
+	for _, want := range []string{
+		`vibethon_requests_total{tenant="acme",key="web",status="200"} 2`,
+		`vibethon_requests_total{tenant="acme",key="other",status="200"} 2`,
+		`vibethon_tokens_total{tenant="acme",key="batch",kind="prompt"} 10`,
+		`vibethon_request_duration_seconds_count{tenant="acme",key="other",upstream="openai"} 2`,
+		`vibethon_metric_label_values_collapsed_total{label="key"} 6`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, `key="ci"`) {
+		t.Errorf("Expected keys past the limit to be collapsed, got:\n%s", out)
+	}
+
+	t.Setenv("PROXY_METRICS_LABELS", "model,route")
+	if err := metricsFromEnv(newProxyMetrics(), os.Getenv); err == nil {
+		t.Error("Expected an unknown label to be rejected")
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The audit log keeps everything, searchable and for as long as compliance
+// asks. For a quick look at real traffic, such as the requests of one model
+// or those that failed, PROXY_MIRROR_DIR tees the requests matching
+// PROXY_MIRROR_FILTER and their replies to JSONL files, optionally gzipped,
+// to read offline with jq or a notebook. Mirrored records leave out client
+// addresses and have personal data and secrets in the bodies redacted, so
+// the files can be handed around more freely than the audit log.
+
+// mirrorFileLayout names mirror files by the time they were started, so
+// they sort in order
+const mirrorFileLayout = "20060102T150405.000000000Z"
+
+// mirrorCondition is one condition of a mirror filter, e.g. status>=500
+type mirrorCondition struct {
+	field string
+	op    string
+	// values are the patterns of string fields, where a trailing "*"
+	// matches any suffix
+	values []string
+	number float64
+}
+
+// mirrorFields are the fields a mirror filter can test, numeric or not
+var mirrorFields = map[string]bool{
+	"path": false, "method": false, "model": false, "key": false, "tenant": false,
+	"status": true, "latency_ms": true, "tokens": true,
+}
+
+// parseMirrorFilter parses a filter of space-separated conditions, all of
+// which a request must meet, such as
+//
+//	model=gpt-4o*,o1* status>=400 latency_ms>2000
+//
+// String fields are tested with = or != against comma-separated patterns,
+// numeric ones with =, !=, <, <=, > or >=.
+func parseMirrorFilter(expr string) ([]mirrorCondition, error) {
+	var conds []mirrorCondition
+	for _, term := range strings.Fields(expr) {
+		i := strings.IndexAny(term, "=!<>")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid condition %q", term)
+		}
+		field, rest := term[:i], term[i:]
+		numeric, ok := mirrorFields[field]
+		if !ok {
+			return nil, fmt.Errorf("unknown field %q", field)
+		}
+		cond := mirrorCondition{field: field}
+		for _, op := range []string{"!=", "<=", ">=", "=", "<", ">"} {
+			if value, ok := strings.CutPrefix(rest, op); ok {
+				cond.op, rest = op, value
+				break
+			}
+		}
+		if cond.op == "" || rest == "" {
+			return nil, fmt.Errorf("invalid condition %q", term)
+		}
+		if !numeric {
+			if cond.op != "=" && cond.op != "!=" {
+				return nil, fmt.Errorf("invalid condition %q: %s only supports = and !=", term, field)
+			}
+			cond.values = strings.Split(rest, ",")
+		} else {
+			n, err := strconv.ParseFloat(rest, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid condition %q: %s takes a number", term, field)
+			}
+			cond.number = n
+		}
+		conds = append(conds, cond)
+	}
+	return conds, nil
+}
+
+// matches reports whether rec meets the condition
+func (c mirrorCondition) matches(rec AuditRecord) bool {
+	var number float64
+	var value string
+	switch c.field {
+	case "path":
+		value = rec.Path
+	case "method":
+		value = rec.Method
+	case "model":
+		value = rec.Model
+	case "key":
+		value = rec.KeyID
+	case "tenant":
+		value = rec.Tenant
+	case "status":
+		number = float64(rec.Status)
+	case "latency_ms":
+		number = float64(rec.LatencyMS)
+	case "tokens":
+		number = float64(rec.Usage.TotalTokens)
+	}
+	if c.values != nil {
+		return matchAny(c.values, value) == (c.op == "=")
+	}
+	switch c.op {
+	case "=":
+		return number == c.number
+	case "!=":
+		return number != c.number
+	case "<":
+		return number < c.number
+	case "<=":
+		return number <= c.number
+	case ">":
+		return number > c.number
+	default:
+		return number >= c.number
+	}
+}
+
+// requestMirror appends sanitized records to rotated files of a directory
+type requestMirror struct {
+	dir      string
+	filter   []mirrorCondition
+	gzip     bool
+	maxSize  int64
+	maxFiles int
+	now      func() time.Time
+
+	mu      sync.Mutex
+	file    *os.File
+	w       io.Writer
+	gz      *gzip.Writer
+	curSize int64
+}
+
+// requestMirrorFromEnv opens the mirror in PROXY_MIRROR_DIR, or returns nil
+// if it is not set
+func requestMirrorFromEnv(getenv func(string) string) (*requestMirror, error) {
+	dir := getenv("PROXY_MIRROR_DIR")
+	if dir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("invalid PROXY_MIRROR_DIR %q: %v", dir, err)
+	}
+	m := &requestMirror{dir: dir, maxSize: 100 << 20, maxFiles: 10, now: time.Now}
+	if v := getenv("PROXY_MIRROR_FILTER"); v != "" {
+		filter, err := parseMirrorFilter(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PROXY_MIRROR_FILTER: %v", err)
+		}
+		m.filter = filter
+	}
+	if v := getenv("PROXY_MIRROR_GZIP"); v != "" {
+		gz, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PROXY_MIRROR_GZIP %q", v)
+		}
+		m.gzip = gz
+	}
+	if v := getenv("PROXY_MIRROR_MAX_FILE_SIZE"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid PROXY_MIRROR_MAX_FILE_SIZE %q", v)
+		}
+		m.maxSize = n
+	}
+	if v := getenv("PROXY_MIRROR_MAX_FILES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid PROXY_MIRROR_MAX_FILES %q", v)
+		}
+		m.maxFiles = n
+	}
+	return m, nil
+}
+
+// Matches reports whether rec meets every condition of the filter
+func (m *requestMirror) Matches(rec AuditRecord) bool {
+	for _, c := range m.filter {
+		if !c.matches(rec) {
+			return false
+		}
+	}
+	return true
+}
+
+// sanitizeMirrorRecord drops the client address of rec and redacts
+// personal data and secrets in its bodies
+func sanitizeMirrorRecord(rec AuditRecord) AuditRecord {
+	rec.RemoteAddr = ""
+	rec.Request = redactRawJSON(rec.Request)
+	rec.Response = redactRawJSON(rec.Response)
+	return rec
+}
+
+// piiFilters redact everything the built-in detectors find
+var piiFilters = func() []ContentFilter {
+	filters := make([]ContentFilter, len(piiPatterns))
+	for i, p := range piiPatterns {
+		filters[i] = ContentFilter{Name: p.name, Detector: p.name}
+		filters[i].compile()
+	}
+	return filters
+}()
+
+// redactRawJSON redacts personal data and secrets in the strings of a JSON
+// value, leaving its other members as they are
+func redactRawJSON(raw json.RawMessage) json.RawMessage {
+	if raw == nil {
+		return nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var v any
+	if dec.Decode(&v) != nil {
+		return raw
+	}
+	hits := make([]int, len(piiFilters))
+	v = filterValue(piiFilters, v, hits)
+	if slices.Max(hits) == 0 {
+		return raw
+	}
+	var out bytes.Buffer
+	enc := json.NewEncoder(&out)
+	enc.SetEscapeHTML(false)
+	if enc.Encode(v) != nil {
+		return raw
+	}
+	return bytes.TrimSpace(out.Bytes())
+}
+
+// Write appends the sanitized record, starting a new file if the current
+// one is full
+func (m *requestMirror) Write(rec AuditRecord) error {
+	line, err := json.Marshal(sanitizeMirrorRecord(rec))
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.file == nil || m.curSize+int64(len(line)) > m.maxSize {
+		if err := m.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := m.w.Write(line)
+	m.curSize += int64(n)
+	if err == nil && m.gz != nil {
+		// Flushed so a file can be read up to its last record while it is
+		// still being written
+		err = m.gz.Flush()
+	}
+	return err
+}
+
+// rotate starts a new file and deletes the oldest beyond maxFiles. Callers
+// must hold m.mu.
+func (m *requestMirror) rotate() error {
+	m.close()
+	name := "mirror-" + m.now().UTC().Format(mirrorFileLayout) + ".jsonl"
+	if m.gzip {
+		name += ".gz"
+	}
+	f, err := os.OpenFile(filepath.Join(m.dir, name), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open mirror file: %w", err)
+	}
+	m.file, m.w, m.curSize = f, f, 0
+	if m.gzip {
+		m.gz = gzip.NewWriter(f)
+		m.w = m.gz
+	}
+
+	files, _ := filepath.Glob(filepath.Join(m.dir, "mirror-*.jsonl*"))
+	slices.Sort(files)
+	for len(files) > m.maxFiles {
+		os.Remove(files[0])
+		files = files[1:]
+	}
+	return nil
+}
+
+// close finishes the current file. Callers must hold m.mu.
+func (m *requestMirror) close() error {
+	if m.file == nil {
+		return nil
+	}
+	var err error
+	if m.gz != nil {
+		err = m.gz.Close()
+		m.gz = nil
+	}
+	if cerr := m.file.Close(); err == nil {
+		err = cerr
+	}
+	m.file, m.w = nil, nil
+	return err
+}
+
+// Close finishes the current file
+func (m *requestMirror) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.close()
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestMirror(t *testing.T, env map[string]string) *requestMirror {
+	t.Helper()
+	dir := t.TempDir()
+	m, err := requestMirrorFromEnv(func(name string) string {
+		if name == "PROXY_MIRROR_DIR" {
+			return dir
+		}
+		return env[name]
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.Close() })
+	return m
+}
+
+func readMirror(t *testing.T, m *requestMirror) []AuditRecord {
+	t.Helper()
+	files, _ := filepath.Glob(filepath.Join(m.dir, "mirror-*"))
+	var records []AuditRecord
+	for _, path := range files {
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		var r *bufio.Scanner
+		if strings.HasSuffix(path, ".gz") {
+			gz, err := gzip.NewReader(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r = bufio.NewScanner(gz)
+		} else {
+			r = bufio.NewScanner(f)
+		}
+		for r.Scan() {
+			var rec AuditRecord
+			if err := json.Unmarshal(r.Bytes(), &rec); err != nil {
+				t.Fatalf("Invalid mirror record %q: %v", r.Text(), err)
+			}
+			records = append(records, rec)
+		}
+	}
+	return records
+}
+
+func TestParseMirrorFilter(t *testing.T) {
+	rec := AuditRecord{Path: "/v1/chat/completions", Method: "POST", Model: "gpt-4o-mini", Tenant: "acme", Status: 502, LatencyMS: 2500, Usage: Usage{TotalTokens: 40}}
+	tests := []struct {
+		expr    string
+		matches bool
+	}{
+		{"", true},
+		{"model=gpt-4o*", true},
+		{"model=o1*,gpt-4o-mini", true},
+		{"model!=gpt-4o*", false},
+		{"status>=500 latency_ms>2000", true},
+		{"status>=500 tenant=globex", false},
+		{"tokens<40", false},
+		{"tokens<=40 path=/v1/chat/*", true},
+	}
+	for _, tt := range tests {
+		filter, err := parseMirrorFilter(tt.expr)
+		if err != nil {
+			t.Fatalf("Failed to parse %q: %v", tt.expr, err)
+		}
+		m := &requestMirror{filter: filter}
+		if got := m.Matches(rec); got != tt.matches {
+			t.Errorf("%q: expected %v, got %v", tt.expr, tt.matches, got)
+		}
+	}
+
+	for _, expr := range []string{"model", "colour=red", "status>=high", "model<gpt", "=gpt-4o", "status>="} {
+		if _, err := parseMirrorFilter(expr); err == nil {
+			t.Errorf("Expected an error for %q", expr)
+		}
+	}
+}
+
+func TestRequestMirror_Sanitizes(t *testing.T) {
+	m := newTestMirror(t, nil)
+	err := m.Write(AuditRecord{
+		RemoteAddr: "203.0.113.7:5123",
+		Path:       "/v1/chat/completions",
+		Request:    json.RawMessage(`{"model":"gpt-4o","max_tokens":12345678901,"messages":[{"role":"user","content":"I am jane@example.com"}]}`),
+		Response:   json.RawMessage(`"plain text reply"`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := readMirror(t, m)
+	if len(records) != 1 {
+		t.Fatalf("Expected one record, got %d", len(records))
+	}
+	rec := records[0]
+	if rec.RemoteAddr != "" {
+		t.Errorf("Expected the client address to be left out, got %q", rec.RemoteAddr)
+	}
+	if got := string(rec.Request); strings.Contains(got, "jane@example.com") || !strings.Contains(got, "[EMAIL]") || !strings.Contains(got, "12345678901") {
+		t.Errorf("Expected the email redacted and the rest kept, got %s", got)
+	}
+	if got := string(rec.Response); got != `"plain text reply"` {
+		t.Errorf("Expected the reply unchanged, got %s", got)
+	}
+}
+
+func TestRequestMirror_RotatesAndKeepsMaxFiles(t *testing.T) {
+	m := newTestMirror(t, map[string]string{"PROXY_MIRROR_GZIP": "true", "PROXY_MIRROR_MAX_FILE_SIZE": "100", "PROXY_MIRROR_MAX_FILES": "2"})
+	now := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+	m.now = func() time.Time { now = now.Add(time.Second); return now }
+	for i := 0; i < 4; i++ {
+		if err := m.Write(AuditRecord{Path: "/v1/embeddings", Request: json.RawMessage(`{"input":"` + strings.Repeat("x", 60) + `"}`)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, _ := filepath.Glob(filepath.Join(m.dir, "mirror-*.jsonl.gz"))
+	if len(files) != 2 {
+		t.Fatalf("Expected the two newest files to be kept, got %v", files)
+	}
+	// The current file is readable before it is closed
+	if got := len(readMirror(t, m)); got != 2 {
+		t.Errorf("Expected two records in the files kept, got %d", got)
+	}
+}
+
+func TestProxyServer_MirrorFilter(t *testing.T) {
+	server := NewProxyServer(&MockOpenAIClient{response: createTestChatCompletionResponse()})
+	server.keys = createTestKeyStore(t)
+	server.submissions = nil
+	server.mirror = newTestMirror(t, map[string]string{"PROXY_MIRROR_FILTER": "model=gpt-4o-mini"})
+	handler := server.Handler()
+	for _, model := range []string{"gpt-4o", "gpt-4o-mini"} {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "`+model+`", "messages": [{"role": "user", "content": "Hi"}]}`))
+		req.Header.Set("Authorization", "Bearer sk-full")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected the request to succeed, got %d", w.Code)
+		}
+	}
+	records := readMirror(t, server.mirror)
+	if len(records) != 1 || records[0].Model != "gpt-4o-mini" || records[0].KeyID != "full" || len(records[0].Response) == 0 {
+		t.Errorf("Expected only the gpt-4o-mini request mirrored with its reply, got %+v", records)
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// VirtualModelVersion is one numbered definition of a virtual model
+type VirtualModelVersion struct {
+	Version    int          `json:"version"`
+	Time       time.Time    `json:"time"`
+	Actor      string       `json:"actor,omitempty"`
+	Definition VirtualModel `json:"definition"`
+}
+
+// ModelChange is an entry of a virtual model's change history
+type ModelChange struct {
+	Time  time.Time `json:"time"`
+	Actor string    `json:"actor,omitempty"`
+	// Action is create, update, rollback, delete, pin or unpin
+	Action string `json:"action"`
+	// Version is the version the change created, or the one pinned
+	Version int    `json:"version,omitempty"`
+	Tenant  string `json:"tenant,omitempty"`
+	// From is the version a rollback restored
+	From int `json:"from,omitempty"`
+}
+
+// ModelPin holds a tenant to one version of a virtual model
+type ModelPin struct {
+	Tenant  string `json:"tenant"`
+	Version int    `json:"version"`
+}
+
+// modelHistory keeps every definition of each virtual model, the tenants
+// pinned to one of them and a log of who changed what. Changes go through
+// it so the registry of current definitions and the history never disagree.
+type modelHistory struct {
+	now func() time.Time
+
+	mu       sync.Mutex
+	versions map[string][]VirtualModelVersion
+	changes  map[string][]ModelChange
+	pins     map[string]map[string]int
+}
+
+func newModelHistory() *modelHistory {
+	return &modelHistory{
+		now:      time.Now,
+		versions: make(map[string][]VirtualModelVersion),
+		changes:  make(map[string][]ModelChange),
+		pins:     make(map[string]map[string]int),
+	}
+}
+
+// commit records vm as the next version of its virtual model, unless it is
+// the current definition already, and calls apply with the numbered
+// definition to store it. from is the version restored by a rollback, or 0.
+func (h *modelHistory) commit(vm VirtualModel, actor string, from int, apply func(VirtualModel)) VirtualModel {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	versions := h.versions[vm.ID]
+	changes := h.changes[vm.ID]
+	vm.Version = 0
+	if n := len(versions); n > 0 && (len(changes) == 0 || changes[len(changes)-1].Action != "delete") {
+		current := versions[n-1].Definition
+		current.Version = 0
+		if etagFor(current) == etagFor(vm) {
+			vm.Version = versions[n-1].Version
+			apply(vm)
+			return vm
+		}
+	}
+
+	vm.Version = len(versions) + 1
+	now := h.now().UTC()
+	h.versions[vm.ID] = append(versions, VirtualModelVersion{Version: vm.Version, Time: now, Actor: actor, Definition: vm})
+	action := "update"
+	switch {
+	case from > 0:
+		action = "rollback"
+	case len(changes) == 0 || changes[len(changes)-1].Action == "delete":
+		action = "create"
+	}
+	h.changes[vm.ID] = append(changes, ModelChange{Time: now, Actor: actor, Action: action, Version: vm.Version, From: from})
+	apply(vm)
+	return vm
+}
+
+// deleted records that the virtual model was removed and drops its pins.
+// Its versions are kept, so it can be restored by a rollback.
+func (h *modelHistory) deleted(id, actor string, apply func() bool) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !apply() {
+		return false
+	}
+	delete(h.pins, id)
+	h.changes[id] = append(h.changes[id], ModelChange{Time: h.now().UTC(), Actor: actor, Action: "delete"})
+	return true
+}
+
+// Version returns one version of a virtual model
+func (h *modelHistory) Version(id string, version int) (VirtualModel, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	versions := h.versions[id]
+	if version < 1 || version > len(versions) {
+		return VirtualModel{}, false
+	}
+	return versions[version-1].Definition, true
+}
+
+// Versions returns every version of a virtual model, oldest first
+func (h *modelHistory) Versions(id string) []VirtualModelVersion {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]VirtualModelVersion{}, h.versions[id]...)
+}
+
+// Changes returns the change history of a virtual model, oldest first
+func (h *modelHistory) Changes(id string) []ModelChange {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]ModelChange{}, h.changes[id]...)
+}
+
+// Pin holds tenant to a version of the virtual model
+func (h *modelHistory) Pin(id, tenant string, version int, actor string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if version < 1 || version > len(h.versions[id]) {
+		return fmt.Errorf("virtual model %s has no version %d", id, version)
+	}
+	if h.pins[id] == nil {
+		h.pins[id] = make(map[string]int)
+	}
+	h.pins[id][tenant] = version
+	h.changes[id] = append(h.changes[id], ModelChange{Time: h.now().UTC(), Actor: actor, Action: "pin", Version: version, Tenant: tenant})
+	return nil
+}
+
+// Unpin lets tenant follow the current version again and reports whether
+// it was pinned
+func (h *modelHistory) Unpin(id, tenant, actor string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.pins[id][tenant]; !ok {
+		return false
+	}
+	delete(h.pins[id], tenant)
+	h.changes[id] = append(h.changes[id], ModelChange{Time: h.now().UTC(), Actor: actor, Action: "unpin", Tenant: tenant})
+	return true
+}
+
+// Pins returns the tenants pinned to a version of the virtual model
+func (h *modelHistory) Pins(id string) []ModelPin {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	pins := make([]ModelPin, 0, len(h.pins[id]))
+	for tenant, version := range h.pins[id] {
+		pins = append(pins, ModelPin{Tenant: tenant, Version: version})
+	}
+	sort.Slice(pins, func(i, j int) bool { return pins[i].Tenant < pins[j].Tenant })
+	return pins
+}
+
+// Pinned returns the definition tenant is pinned to, if any
+func (h *modelHistory) Pinned(id, tenant string) (VirtualModel, bool) {
+	h.mu.Lock()
+	version, ok := h.pins[id][tenant]
+	h.mu.Unlock()
+	if !ok {
+		return VirtualModel{}, false
+	}
+	return h.Version(id, version)
+}
+
+// adminActor names who made an admin request, for the change history
+func adminActor(r *http.Request) string {
+	if key := clientKeyFromContext(r.Context()); key != nil {
+		return key.ID
+	}
+	return ""
+}
+
+// handleAdminModelVersions lists the versions, pins and change history of
+// a virtual model
+func (s *ProxyServer) handleAdminModelVersions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.PathValue("id")
+	versions := s.modelHistory.Versions(id)
+	if len(versions) == 0 {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"versions": versions,
+		"pins":     s.modelHistory.Pins(id),
+		"history":  s.modelHistory.Changes(id),
+	})
+}
+
+// handleAdminRollbackModel makes an earlier version of a virtual model the
+// current one again. The restored definition becomes a new version, so the
+// history only ever grows.
+func (s *ProxyServer) handleAdminRollbackModel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var body struct {
+		Version int `json:"version"`
+	}
+	if err := decodeResource(r, &body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	id := r.PathValue("id")
+	vm, ok := s.modelHistory.Version(id, body.Version)
+	if !ok {
+		http.Error(w, fmt.Sprintf("virtual model %s has no version %d", id, body.Version), http.StatusNotFound)
+		return
+	}
+	if _, ok := s.guardrails.Get(vm.Guardrails); vm.Guardrails != "" && !ok {
+		http.Error(w, fmt.Sprintf("unknown guardrail profile %s", vm.Guardrails), http.StatusConflict)
+		return
+	}
+	vm = s.modelHistory.commit(vm, adminActor(r), body.Version, func(vm VirtualModel) { s.virtualModels.Put(id, vm) })
+	writeResource(w, http.StatusOK, etagFor(vm), vm)
+}
+
+// handleAdminModelPin pins a tenant to a version of a virtual model with
+// PUT {"version": n}, or lets it follow the current version with DELETE
+func (s *ProxyServer) handleAdminModelPin(w http.ResponseWriter, r *http.Request) {
+	id, tenant := r.PathValue("id"), r.PathValue("tenant")
+	if _, ok := s.virtualModels.Get(id); !ok {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		var pin ModelPin
+		if err := decodeResource(r, &pin); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		pin.Tenant = tenant
+		if err := s.modelHistory.Pin(id, tenant, pin.Version, adminActor(r)); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(pin)
+	case http.MethodDelete:
+		if !s.modelHistory.Unpin(id, tenant, adminActor(r)) {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
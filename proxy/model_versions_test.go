@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newTestModelServer() (*ProxyServer, *http.ServeMux) {
+	server := NewProxyServer(&recordingOpenAIClient{MockOpenAIClient: MockOpenAIClient{response: createTestChatCompletionResponse()}})
+	mux := http.NewServeMux()
+	// Stand in for withAuth so the history records an actor
+	asAdmin := func(h http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			h(w, r.WithContext(context.WithValue(r.Context(), clientKeyContextKey, &ClientKey{ID: "ops"})))
+		}
+	}
+	mux.HandleFunc("/admin/models/{id}", asAdmin(server.adminVirtualModelHandler().ServeHTTP))
+	mux.HandleFunc("/admin/models/{id}/versions", asAdmin(server.handleAdminModelVersions))
+	mux.HandleFunc("/admin/models/{id}/rollback", asAdmin(server.handleAdminRollbackModel))
+	mux.HandleFunc("/admin/models/{id}/pins/{tenant}", asAdmin(server.handleAdminModelPin))
+	return server, mux
+}
+
+type modelVersionsResponse struct {
+	Versions []VirtualModelVersion `json:"versions"`
+	Pins     []ModelPin            `json:"pins"`
+	History  []ModelChange         `json:"history"`
+}
+
+func getModelVersions(t *testing.T, mux *http.ServeMux, id string) modelVersionsResponse {
+	t.Helper()
+	w := adminRequest(mux, "GET", "/admin/models/"+id+"/versions", "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	var resp modelVersionsResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return resp
+}
+
+func TestAdmin_VirtualModelVersions(t *testing.T) {
+	_, mux := newTestModelServer()
+	adminRequest(mux, "PUT", "/admin/models/support", `{"model": "gpt-4o", "system": "v1"}`, nil)
+	// Re-applying the same definition is not a new version
+	w := adminRequest(mux, "PUT", "/admin/models/support", `{"model": "gpt-4o", "system": "v1"}`, nil)
+	if !strings.Contains(w.Body.String(), `"version":1`) {
+		t.Errorf("Expected version 1, got %s", w.Body.String())
+	}
+	w = adminRequest(mux, "PUT", "/admin/models/support", `{"model": "gpt-4o", "system": "v2", "version": 7}`, nil)
+	if !strings.Contains(w.Body.String(), `"version":2`) {
+		t.Errorf("Expected the proxy to number the version, got %s", w.Body.String())
+	}
+
+	resp := getModelVersions(t, mux, "support")
+	if len(resp.Versions) != 2 || resp.Versions[0].Definition.System != "v1" || resp.Versions[1].Actor != "ops" {
+		t.Errorf("Unexpected versions %+v", resp.Versions)
+	}
+	if len(resp.History) != 2 || resp.History[0].Action != "create" || resp.History[1].Action != "update" {
+		t.Errorf("Unexpected history %+v", resp.History)
+	}
+	if w := adminRequest(mux, "GET", "/admin/models/missing/versions", "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d, got %d", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestAdmin_VirtualModelRollback(t *testing.T) {
+	server, mux := newTestModelServer()
+	adminRequest(mux, "PUT", "/admin/models/support", `{"model": "gpt-4o", "system": "good"}`, nil)
+	adminRequest(mux, "PUT", "/admin/models/support", `{"model": "gpt-4o", "system": "broken"}`, nil)
+
+	w := adminRequest(mux, "POST", "/admin/models/support/rollback", `{"version": 1}`, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if vm, _ := server.virtualModels.Get("support"); vm.System != "good" || vm.Version != 3 {
+		t.Errorf("Expected version 1 restored as version 3, got %+v", vm)
+	}
+	history := getModelVersions(t, mux, "support").History
+	if last := history[len(history)-1]; last.Action != "rollback" || last.From != 1 || last.Version != 3 {
+		t.Errorf("Unexpected rollback entry %+v", last)
+	}
+	if w := adminRequest(mux, "POST", "/admin/models/support/rollback", `{"version": 9}`, nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d, got %d", http.StatusNotFound, w.Code)
+	}
+
+	// Deleted models keep their history and can be restored
+	adminRequest(mux, "DELETE", "/admin/models/support", "", nil)
+	if _, ok := server.virtualModels.Get("support"); ok {
+		t.Fatal("Expected the virtual model to be deleted")
+	}
+	adminRequest(mux, "POST", "/admin/models/support/rollback", `{"version": 2}`, nil)
+	if vm, _ := server.virtualModels.Get("support"); vm.System != "broken" {
+		t.Errorf("Expected the model to be restored, got %+v", vm)
+	}
+}
+
+func TestProxyServer_VirtualModelPin(t *testing.T) {
+	server, mux := newTestModelServer()
+	adminRequest(mux, "PUT", "/admin/models/support", `{"model": "gpt-4o", "system": "old"}`, nil)
+	adminRequest(mux, "PUT", "/admin/models/support", `{"model": "gpt-4o", "system": "new"}`, nil)
+	if w := adminRequest(mux, "PUT", "/admin/models/support/pins/acme", `{"version": 1}`, nil); w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	system := func(tenant string) string {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "support", "messages": [{"role": "user", "content": "Hi"}]}`))
+		req = req.WithContext(context.WithValue(req.Context(), clientKeyContextKey, &ClientKey{ID: tenant + "-web", Tenant: tenant}))
+		server.handleChatCompletions(httptest.NewRecorder(), req)
+		return server.client.(*recordingOpenAIClient).last.Messages[0].Content
+	}
+	if got := system("acme"); got != "old" {
+		t.Errorf("Expected the pinned tenant to get version 1, got %q", got)
+	}
+	if got := system("globex"); got != "new" {
+		t.Errorf("Expected other tenants to get the current version, got %q", got)
+	}
+
+	if w := adminRequest(mux, "PUT", "/admin/models/support/pins/acme", `{"version": 5}`, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d, got %d", http.StatusBadRequest, w.Code)
+	}
+	if w := adminRequest(mux, "DELETE", "/admin/models/support/pins/acme", "", nil); w.Code != http.StatusNoContent {
+		t.Errorf("Expected status code %d, got %d", http.StatusNoContent, w.Code)
+	}
+	if got := system("acme"); got != "new" {
+		t.Errorf("Expected the unpinned tenant to follow the current version, got %q", got)
+	}
+	resp := getModelVersions(t, mux, "support")
+	if n := len(resp.History); n != 4 || resp.History[2].Action != "pin" || resp.History[2].Tenant != "acme" || resp.History[3].Action != "unpin" {
+		t.Errorf("Expected pins in the history, got %+v", resp.History)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Clients such as the OpenAI SDKs and LangChain list the models at
+// startup. GET /v1/models answers with the models of every upstream, asked
+// at most every five minutes, plus the virtual models, narrowed to what the
+// client key may use. PROXY_MODELS, a comma-separated list of models where
+// a trailing "*" matches a prefix, narrows the list further; its exact
+// names are listed even if no upstream lists them, so deployments whose
+// upstream keys cannot list models still answer.
+
+// modelsCacheTTL is how long the models of the upstreams are remembered
+const modelsCacheTTL = 5 * time.Minute
+
+// Model is an entry of the models list
+type Model struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Created int64  `json:"created"`
+	OwnedBy string `json:"owned_by"`
+}
+
+// ModelList is the response of GET /v1/models
+type ModelList struct {
+	Object string  `json:"object"`
+	Data   []Model `json:"data"`
+}
+
+// modelLister is an upstream that can list its models
+type modelLister interface {
+	ListModels(ctx context.Context) ([]Model, error)
+}
+
+// ListModels lists the models of an OpenAI-compatible API
+func (c *RealOpenAIClient) ListModels(ctx context.Context) ([]Model, error) {
+	httpReq, err := c.newRequest(ctx, "/models", http.NoBody, 0)
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Method = http.MethodGet
+	httpReq.Header.Del("Content-Type")
+	resp, err := c.HTTPClient.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, apiError(resp.StatusCode, body)
+	}
+	var list ModelList
+	if err := json.Unmarshal(body, &list); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+	return list.Data, nil
+}
+
+// ListModels lists the models of the Azure deployments
+func (a *azureBackend) ListModels(ctx context.Context) ([]Model, error) {
+	var models []Model
+	for model := range a.deployments {
+		models = append(models, Model{ID: model, Object: "model", OwnedBy: "azure"})
+	}
+	return models, nil
+}
+
+// ListModels lists the models of Anthropic's API
+func (c *anthropicClient) ListModels(ctx context.Context) ([]Model, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, "GET", c.BaseURL+"/models?limit=1000", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	httpReq.Header.Set("x-api-key", c.APIKey)
+	httpReq.Header.Set("anthropic-version", c.Version)
+	resp, err := c.HTTPClient.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("API error (status %d): %s", resp.StatusCode, body)
+	}
+	var list struct {
+		Data []struct {
+			ID        string    `json:"id"`
+			CreatedAt time.Time `json:"created_at"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+	models := make([]Model, 0, len(list.Data))
+	for _, m := range list.Data {
+		models = append(models, Model{ID: m.ID, Object: "model", Created: m.CreatedAt.Unix(), OwnedBy: "anthropic"})
+	}
+	return models, nil
+}
+
+// ListModels lists the models of OpenAI and of every provider, keeping the
+// models each provider claims. Exact names a provider claims are listed
+// even if it does not list them.
+func (p *providerRouter) ListModels(ctx context.Context) ([]Model, error) {
+	models, err := p.fallback.ListModels(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// Models a provider claims are not served by OpenAI
+	models = slices.DeleteFunc(models, func(m Model) bool { return p.route(m.ID).backend != chatBackend(p.fallback) })
+	if !p.license.Allows(LicensedProviders) {
+		return models, nil
+	}
+	for _, provider := range p.providers {
+		var listed []Model
+		if lister, ok := provider.backend.(modelLister); ok {
+			if listed, err = lister.ListModels(ctx); err != nil {
+				log.Printf("Failed to list the models of a provider: %v", err)
+			}
+		}
+		for _, m := range listed {
+			if matchAny(provider.models, m.ID) {
+				models = append(models, m)
+			}
+		}
+		for _, pattern := range provider.models {
+			if !strings.HasSuffix(pattern, "*") && !slices.ContainsFunc(models, func(m Model) bool { return m.ID == pattern }) {
+				models = append(models, Model{ID: pattern, Object: "model", OwnedBy: "system"})
+			}
+		}
+	}
+	return models, nil
+}
+
+// upstreamModels returns the models of the upstream, from the cache if they
+// were listed recently
+func (s *ProxyServer) upstreamModels(ctx context.Context) ([]Model, error) {
+	if models, ok := s.modelsCache.Get(""); ok {
+		return models, nil
+	}
+	lister, ok := s.client.(modelLister)
+	if !ok {
+		return nil, nil
+	}
+	models, err := lister.ListModels(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.modelsCache.Put("", models)
+	return models, nil
+}
+
+// models returns the models key may use
+func (s *ProxyServer) models(ctx context.Context, key *ClientKey) ([]Model, error) {
+	upstream, err := s.upstreamModels(ctx)
+	if err != nil && len(s.modelAllowlist) == 0 {
+		return nil, err
+	}
+	if err != nil {
+		log.Printf("Failed to list upstream models: %v", err)
+	}
+	models := slices.Clone(upstream)
+	for _, vm := range s.virtualModels.List() {
+		models = append(models, Model{ID: vm.ID, Object: "model", OwnedBy: "proxy"})
+	}
+	if len(s.modelAllowlist) > 0 {
+		models = slices.DeleteFunc(models, func(m Model) bool { return !matchAny(s.modelAllowlist, m.ID) })
+		for _, pattern := range s.modelAllowlist {
+			if !strings.HasSuffix(pattern, "*") && !slices.ContainsFunc(models, func(m Model) bool { return m.ID == pattern }) {
+				models = append(models, Model{ID: pattern, Object: "model", OwnedBy: "system"})
+			}
+		}
+	}
+	seen := make(map[string]bool)
+	models = slices.DeleteFunc(models, func(m Model) bool {
+		drop := seen[m.ID] || (key != nil && !key.AllowsModel(m.ID))
+		seen[m.ID] = true
+		return drop
+	})
+	slices.SortFunc(models, func(a, b Model) int { return strings.Compare(a.ID, b.ID) })
+	return models, nil
+}
+
+// handleListModels serves GET /v1/models
+func (s *ProxyServer) handleListModels(w http.ResponseWriter, r *http.Request) {
+	models, err := s.models(r.Context(), clientKeyFromContext(r.Context()))
+	if err != nil {
+		log.Printf("Failed to list models: %v", err)
+		writeUpstreamError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ModelList{Object: "list", Data: models})
+}
+
+// handleGetModel serves GET /v1/models/{id}
+func (s *ProxyServer) handleGetModel(w http.ResponseWriter, r *http.Request) {
+	models, err := s.models(r.Context(), clientKeyFromContext(r.Context()))
+	if err != nil {
+		log.Printf("Failed to list models: %v", err)
+		writeUpstreamError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	i := slices.IndexFunc(models, func(m Model) bool { return m.ID == r.PathValue("id") })
+	if i < 0 {
+		var resp ErrorResponse
+		resp.Error.Message = fmt.Sprintf("The model '%s' does not exist", r.PathValue("id"))
+		resp.Error.Type = "invalid_request_error"
+		resp.Error.Code = "model_not_found"
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+	json.NewEncoder(w).Encode(models[i])
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// newModelsUpstream lists models the way the OpenAI API does, counting the
+// requests it gets
+func newModelsUpstream(t *testing.T, ids ...string) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var calls atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if r.Method != http.MethodGet || r.URL.Path != "/models" || r.Header.Get("Authorization") != "Bearer sk-openai" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		list := ModelList{Object: "list"}
+		for _, id := range ids {
+			list.Data = append(list.Data, Model{ID: id, Object: "model", Created: 1700000000, OwnedBy: "openai"})
+		}
+		json.NewEncoder(w).Encode(list)
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream, &calls
+}
+
+func getModels(handler http.Handler, secret, path string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", path, nil)
+	req.Header.Set("Authorization", "Bearer "+secret)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func modelIDs(t *testing.T, w *httptest.ResponseRecorder) []string {
+	t.Helper()
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var list ModelList
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || list.Object != "list" {
+		t.Fatalf("Expected a models list, got %s", w.Body.String())
+	}
+	var ids []string
+	for _, m := range list.Data {
+		ids = append(ids, m.ID)
+	}
+	return ids
+}
+
+func TestProxyServer_ListModels(t *testing.T) {
+	upstream, calls := newModelsUpstream(t, "gpt-4o-mini", "gpt-4o", "text-embedding-3-small")
+	client := NewRealOpenAIClient("sk-openai")
+	client.BaseURL = upstream.URL
+	server := NewProxyServer(client)
+	server.keys = createTestKeyStore(t)
+	server.virtualModels.Put("support", VirtualModel{ID: "support", Model: "gpt-4o"})
+	handler := server.Handler()
+
+	if got := strings.Join(modelIDs(t, getModels(handler, "sk-full", "/v1/models")), ","); got != "gpt-4o,gpt-4o-mini,support,text-embedding-3-small" {
+		t.Errorf("Expected the upstream and virtual models, got %s", got)
+	}
+	if got := strings.Join(modelIDs(t, getModels(handler, "sk-mini", "/v1/models")), ","); got != "gpt-4o-mini" {
+		t.Errorf("Expected the models of the key's scopes, got %s", got)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("Expected the upstream models to be cached, got %d requests", calls.Load())
+	}
+
+	w := getModels(handler, "sk-full", "/v1/models/gpt-4o")
+	var model Model
+	json.Unmarshal(w.Body.Bytes(), &model)
+	if w.Code != http.StatusOK || model.ID != "gpt-4o" || model.OwnedBy != "openai" {
+		t.Errorf("Expected the model, got %d: %s", w.Code, w.Body.String())
+	}
+	w = getModels(handler, "sk-mini", "/v1/models/gpt-4o")
+	var resp ErrorResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != http.StatusNotFound || resp.Error.Code != "model_not_found" {
+		t.Errorf("Expected models outside the key's scopes to be missing, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestProxyServer_ListModelsAllowlist(t *testing.T) {
+	upstream, _ := newModelsUpstream(t, "gpt-4o-mini", "gpt-4o", "dall-e-3")
+	client := NewRealOpenAIClient("sk-openai")
+	client.BaseURL = upstream.URL
+	server := NewProxyServer(client)
+	server.modelAllowlist = []string{"gpt-4o*", "o3"}
+
+	if got := strings.Join(modelIDs(t, getModels(server.Handler(), "", "/v1/models")), ","); got != "gpt-4o,gpt-4o-mini,o3" {
+		t.Errorf("Expected the allowed models, got %s", got)
+	}
+
+	// Upstreams that cannot list their models still answer with the
+	// allowlist
+	client.BaseURL = "http://127.0.0.1:1"
+	server.modelsCache = newLRUCache[[]Model](1, modelsCacheTTL)
+	if got := strings.Join(modelIDs(t, getModels(server.Handler(), "", "/v1/models")), ","); got != "o3" {
+		t.Errorf("Expected the exact names of the allowlist, got %s", got)
+	}
+}
+
+func TestProviderRouter_ListModels(t *testing.T) {
+	openai, _ := newModelsUpstream(t, "gpt-4o", "llama3-openai-hosted")
+	path := writeProvidersFile(t, `[
+		{"name": "azure", "type": "azure", "base_url": "https://azure.invalid", "api_version": "2024-06-01", "deployments": {"gpt-4o-azure": "prod"}},
+		{"name": "local", "type": "ollama", "base_url": "http://127.0.0.1:1", "models": ["llama3*", "qwen2"]}
+	]`)
+	fallback := NewRealOpenAIClient("sk-openai")
+	fallback.BaseURL = openai.URL
+	router, err := providerRouterFromEnv(fallback, func(name string) string {
+		if name == "PROXY_PROVIDERS_FILE" {
+			return path
+		}
+		return ""
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewProxyServer(router)
+	got := strings.Join(modelIDs(t, getModels(server.Handler(), "", "/v1/models")), ",")
+	if got != "gpt-4o,gpt-4o-azure,qwen2" {
+		t.Errorf("Expected the models of every provider, got %s", got)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A misconfigured client retrying in a tight loop sends the same request
+// over and over, and some requests fail the same way every time: a model
+// that does not exist stays missing and a prompt too long for the model
+// stays too long. Such errors are remembered for a short while, within the
+// tenant or key that got them, and identical requests are answered with
+// them again without going upstream.
+
+// negativeCacheSize bounds the failed requests remembered
+const negativeCacheSize = 1000
+
+// deterministicErrorCodes are the upstream error codes a request gets again
+// every time it is sent
+var deterministicErrorCodes = map[string]bool{
+	"model_not_found":         true,
+	"context_length_exceeded": true,
+}
+
+// deterministic reports whether sending the request again fails the same way
+func (e *upstreamAPIError) deterministic() bool {
+	return e.Status >= 400 && e.Status < 500 && deterministicErrorCodes[e.Response.Error.Code]
+}
+
+// cachedFailure is an error reply in the negative cache
+type cachedFailure struct {
+	status int
+	body   []byte
+	stored time.Time
+}
+
+// negativeCacheFromEnv sizes the negative cache, remembering errors for
+// PROXY_NEGATIVE_CACHE_TTL (default 30s); 0 turns it off
+func negativeCacheFromEnv(getenv func(string) string) (*lruCache[cachedFailure], error) {
+	ttl := 30 * time.Second
+	if v := getenv("PROXY_NEGATIVE_CACHE_TTL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid PROXY_NEGATIVE_CACHE_TTL %q", v)
+		}
+		ttl = d
+	}
+	if ttl == 0 {
+		return newLRUCache[cachedFailure](0, 0), nil
+	}
+	return newLRUCache[cachedFailure](negativeCacheSize, ttl), nil
+}
+
+// failureCacheKey returns the key a failed chat completion request is
+// remembered under, or "" if failures are not cached, and whether the
+// cache may answer it. Cache-Control: no-cache sends the request upstream
+// again.
+func (s *ProxyServer) failureCacheKey(r *http.Request, body []byte) (string, bool) {
+	if s.failures.size <= 0 {
+		return "", false
+	}
+	var req map[string]any
+	if err := json.Unmarshal(body, &req); err != nil || req["session"] != nil {
+		return "", false
+	}
+	delete(req, "user")
+	scope, _ := cacheScope(clientKeyFromContext(r.Context()))
+	id := cacheKey(struct {
+		Scope   string
+		Request map[string]any
+	}{scope, req})
+	return id, !strings.Contains(r.Header.Get("Cache-Control"), "no-cache")
+}
+
+// serveCachedFailure answers a request with the error it got before, if it
+// got one
+func (s *ProxyServer) serveCachedFailure(w http.ResponseWriter, id string) bool {
+	entry, ok := s.failures.Get(id)
+	if !ok {
+		s.metrics.cacheLookups.Add(1, "chat.completions.errors", "miss")
+		return false
+	}
+	s.metrics.cacheLookups.Add(1, "chat.completions.errors", "hit")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Cache", "HIT")
+	w.Header().Set("Age", strconv.Itoa(int(time.Since(entry.stored).Seconds())))
+	w.WriteHeader(entry.status)
+	w.Write(entry.body)
+	return true
+}
+
+// failureRecorder keeps a copy of an error reply for the negative cache
+type failureRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (f *failureRecorder) WriteHeader(status int) {
+	if f.status == 0 {
+		f.status = status
+	}
+	f.ResponseWriter.WriteHeader(status)
+}
+
+func (f *failureRecorder) Write(p []byte) (int, error) {
+	if f.status == 0 {
+		f.status = http.StatusOK
+	}
+	if f.status != http.StatusOK && f.body.Len()+len(p) <= maxCachedCompletion {
+		f.body.Write(p)
+	}
+	return f.ResponseWriter.Write(p)
+}
+
+func (f *failureRecorder) Unwrap() http.ResponseWriter {
+	return f.ResponseWriter
+}
+
+// store remembers the recorded reply if it is an error the request will get
+// again
+func (f *failureRecorder) store(cache *lruCache[cachedFailure], id string) {
+	if f.status < 400 || f.status >= 500 {
+		return
+	}
+	var resp ErrorResponse
+	if json.Unmarshal(f.body.Bytes(), &resp) != nil || !deterministicErrorCodes[resp.Error.Code] {
+		return
+	}
+	cache.Put(id, cachedFailure{status: f.status, body: f.body.Bytes(), stored: time.Now()})
+}
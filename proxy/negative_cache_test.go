@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestProxyServer_NegativeCache(t *testing.T) {
+	var calls atomic.Int32
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		body := make([]byte, r.ContentLength)
+		r.Body.Read(body)
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.Contains(string(body), "gpt-9"):
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error":{"message":"The model gpt-9 does not exist","type":"invalid_request_error","code":"model_not_found"}}`)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":{"message":"Invalid value for temperature","type":"invalid_request_error","code":null}}`)
+		}
+	}))
+	defer api.Close()
+
+	client := NewRealOpenAIClient("sk-upstream")
+	client.BaseURL = api.URL
+	server := NewProxyServer(client)
+	server.keys = createTestKeyStore(t)
+	server.keys.Add(ClientKey{ID: "other", Key: "sk-other"})
+	server.submissions = nil
+	handler := server.Handler()
+	do := func(secret, body string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+secret)
+		for i := 0; i < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	missing := `{"model": "gpt-9", "messages": [{"role": "user", "content": "Hi"}]}`
+
+	for i := 0; i < 3; i++ {
+		w := do("sk-full", missing)
+		if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "model_not_found") {
+			t.Fatalf("Expected the upstream error to be passed on, got %d %s", w.Code, w.Body.String())
+		}
+	}
+	if calls.Load() != 1 {
+		t.Errorf("Expected the failure to be sent upstream once, got %d calls", calls.Load())
+	}
+	if w := do("sk-full", missing, "Cache-Control", "no-cache"); w.Code != http.StatusNotFound || calls.Load() != 2 {
+		t.Errorf("Expected no-cache to send the request again, got %d after %d calls", w.Code, calls.Load())
+	}
+	// Other keys get their own failures, since they may use other upstream
+	// keys
+	if do("sk-other", missing); calls.Load() != 3 {
+		t.Errorf("Expected failures not to be shared across keys, got %d calls", calls.Load())
+	}
+
+	// Errors that may go away on their own are not remembered
+	invalid := `{"model": "gpt-4o", "temperature": 5, "messages": [{"role": "user", "content": "Hi"}]}`
+	do("sk-full", invalid)
+	do("sk-full", invalid)
+	if calls.Load() != 5 {
+		t.Errorf("Expected other errors to be sent upstream every time, got %d calls", calls.Load())
+	}
+
+	server.failures.now = func() time.Time { return time.Now().Add(time.Minute) }
+	if do("sk-full", missing); calls.Load() != 6 {
+		t.Errorf("Expected the failure to be forgotten after its TTL, got %d calls", calls.Load())
+	}
+}
+
+func TestNegativeCacheFromEnv(t *testing.T) {
+	cache, err := negativeCacheFromEnv(func(string) string { return "" })
+	if err != nil || cache.size != negativeCacheSize || cache.ttl != 30*time.Second {
+		t.Errorf("Expected the default cache, got %+v %v", cache, err)
+	}
+	cache, err = negativeCacheFromEnv(func(string) string { return "0" })
+	if err != nil || cache.size != 0 {
+		t.Errorf("Expected 0 to turn the cache off, got %+v %v", cache, err)
+	}
+	if _, err := negativeCacheFromEnv(func(string) string { return "soon" }); err == nil {
+		t.Error("Expected an invalid TTL to be rejected")
+	}
+}
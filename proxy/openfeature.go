@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// flagTarget is what a flag is evaluated for. Routing decisions are made
+// for a requested model and have no endpoint.
+type flagTarget struct {
+	Endpoint string
+	Tenant   string
+	Model    string
+}
+
+// flagProvider evaluates flags kept outside the proxy. ok is false when it
+// has no answer, and the proxy falls back to its own configuration.
+type flagProvider interface {
+	Value(flag string, target flagTarget) (value any, ok bool)
+}
+
+// flagSource fetches one flag value from a flag service. found is false
+// for flags the service does not know.
+type flagSource interface {
+	fetch(flag string, target flagTarget) (value any, found bool, err error)
+}
+
+// cachedFlags serves flag values from a source, caching answers so requests
+// do not each wait for the service. It fails open: after a failed fetch the
+// service is left alone for a while and every flag is unanswered, so the
+// proxy's defaults apply.
+type cachedFlags struct {
+	source  flagSource
+	cache   *lruCache[flagAnswer]
+	backoff time.Duration
+	now     func() time.Time
+
+	mu          sync.Mutex
+	failedUntil time.Time
+}
+
+type flagAnswer struct {
+	value any
+	found bool
+}
+
+func newCachedFlags(source flagSource, ttl time.Duration) *cachedFlags {
+	return &cachedFlags{source: source, cache: newLRUCache[flagAnswer](10000, ttl), backoff: 10 * time.Second, now: time.Now}
+}
+
+func (c *cachedFlags) Value(flag string, target flagTarget) (any, bool) {
+	id := cacheKey(struct {
+		Flag string
+		flagTarget
+	}{flag, target})
+	if answer, ok := c.cache.Get(id); ok {
+		return answer.value, answer.found
+	}
+	c.mu.Lock()
+	failing := c.now().Before(c.failedUntil)
+	c.mu.Unlock()
+	if failing {
+		return nil, false
+	}
+	value, found, err := c.source.fetch(flag, target)
+	if err != nil {
+		log.Printf("Evaluating flag %s failed, using defaults: %v", flag, err)
+		c.mu.Lock()
+		c.failedUntil = c.now().Add(c.backoff)
+		c.mu.Unlock()
+		return nil, false
+	}
+	c.cache.Put(id, flagAnswer{value: value, found: found})
+	return value, found
+}
+
+// ofrepSource asks a flag service speaking the OpenFeature Remote
+// Evaluation Protocol (OFREP), such as flagd or GO Feature Flag
+type ofrepSource struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func newOFREPSource(baseURL, token string) *ofrepSource {
+	return &ofrepSource{url: strings.TrimSuffix(baseURL, "/"), token: token, client: &http.Client{Timeout: 2 * time.Second}}
+}
+
+// fetch evaluates flag with the tenant as targeting key
+func (p *ofrepSource) fetch(flag string, target flagTarget) (any, bool, error) {
+	evalContext := map[string]string{"targetingKey": target.Tenant, "tenant": target.Tenant}
+	if target.Endpoint != "" {
+		evalContext["endpoint"] = target.Endpoint
+	}
+	if target.Model != "" {
+		evalContext["model"] = target.Model
+	}
+	body, _ := json.Marshal(map[string]any{"context": evalContext})
+	req, err := http.NewRequest("POST", p.url+"/ofrep/v1/evaluate/flags/"+url.PathEscape(flag), bytes.NewReader(body))
+	if err != nil {
+		return nil, false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.token)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Value     any    `json:"value"`
+		ErrorCode string `json:"errorCode"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	if resp.StatusCode == http.StatusNotFound || result.ErrorCode == "FLAG_NOT_FOUND" {
+		return nil, false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, false, fmt.Errorf("status %d %s", resp.StatusCode, result.ErrorCode)
+	}
+	return result.Value, true, nil
+}
+
+// flagBool reads a boolean flag. Values of another type are logged and
+// left unanswered.
+func flagBool(p flagProvider, flag string, target flagTarget) (bool, bool) {
+	value, ok := p.Value(flag, target)
+	if !ok {
+		return false, false
+	}
+	on, ok := value.(bool)
+	if !ok {
+		log.Printf("Flag %s is %v, expected a boolean", flag, value)
+	}
+	return on, ok
+}
+
+// flagString reads a string flag. Empty strings count as no answer, so a
+// flag can send some targets to the default.
+func flagString(p flagProvider, flag string, target flagTarget) (string, bool) {
+	value, ok := p.Value(flag, target)
+	if !ok {
+		return "", false
+	}
+	s, ok := value.(string)
+	if !ok {
+		log.Printf("Flag %s is %v, expected a string", flag, value)
+	}
+	return s, ok && s != ""
+}
+
+// flagProviderFromEnv configures an external flag service: an OFREP
+// service at PROXY_OPENFEATURE_URL or LaunchDarkly with
+// PROXY_LAUNCHDARKLY_SDK_KEY. It returns nil when neither is set.
+func flagProviderFromEnv(getenv func(string) string) (flagProvider, error) {
+	ttl := 30 * time.Second
+	if v := getenv("PROXY_FLAG_CACHE_TTL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid PROXY_FLAG_CACHE_TTL %q", v)
+		}
+		ttl = d
+	}
+	ofrepURL, ldKey := getenv("PROXY_OPENFEATURE_URL"), getenv("PROXY_LAUNCHDARKLY_SDK_KEY")
+	switch {
+	case ofrepURL != "" && ldKey != "":
+		return nil, fmt.Errorf("PROXY_OPENFEATURE_URL and PROXY_LAUNCHDARKLY_SDK_KEY are exclusive")
+	case ofrepURL != "":
+		return newCachedFlags(newOFREPSource(ofrepURL, getenv("PROXY_OPENFEATURE_TOKEN")), ttl), nil
+	case ldKey != "":
+		return newCachedFlags(newLaunchDarklySource(getenv("PROXY_LAUNCHDARKLY_URL"), ldKey), ttl), nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestOFREPSource(t *testing.T) {
+	var calls atomic.Int32
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if r.Header.Get("Authorization") != "Bearer flags-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var body struct {
+			Context map[string]string `json:"context"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		switch r.URL.Path {
+		case "/ofrep/v1/evaluate/flags/rag":
+			json.NewEncoder(w).Encode(map[string]any{"key": "rag", "value": body.Context["targetingKey"] == "beta"})
+		case "/ofrep/v1/evaluate/flags/support-model":
+			json.NewEncoder(w).Encode(map[string]any{"key": "support-model", "value": body.Context["model"] + "-mini"})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]any{"errorCode": "FLAG_NOT_FOUND"})
+		}
+	}))
+	defer service.Close()
+
+	p := newCachedFlags(newOFREPSource(service.URL+"/", "flags-token"), time.Minute)
+	for _, tc := range []struct {
+		feature, tenant string
+		on, ok          bool
+	}{
+		{FeatureRAG, "beta", true, true},
+		{FeatureRAG, "acme", false, true},
+		{FeatureGuardrails, "acme", false, false},
+	} {
+		on, ok := flagBool(p, tc.feature, flagTarget{Endpoint: "chat.completions", Tenant: tc.tenant})
+		if on != tc.on || ok != tc.ok {
+			t.Errorf("%s for %s: got %v, %v, want %v, %v", tc.feature, tc.tenant, on, ok, tc.on, tc.ok)
+		}
+	}
+	if model, ok := flagString(p, "support-model", flagTarget{Tenant: "acme", Model: "gpt-4o"}); !ok || model != "gpt-4o-mini" {
+		t.Errorf("Expected the string flag to see the model, got %q, %v", model, ok)
+	}
+	if _, ok := flagBool(p, "support-model", flagTarget{Tenant: "acme", Model: "gpt-4o"}); ok {
+		t.Error("Expected a string flag to give no boolean answer")
+	}
+
+	before := calls.Load()
+	flagBool(p, FeatureRAG, flagTarget{Endpoint: "chat.completions", Tenant: "beta"})
+	flagBool(p, FeatureGuardrails, flagTarget{Endpoint: "chat.completions", Tenant: "acme"})
+	if calls.Load() != before {
+		t.Error("Expected answers to be cached")
+	}
+}
+
+// failingFlagSource fails while down is set
+type failingFlagSource struct {
+	down  bool
+	calls int
+}
+
+func (s *failingFlagSource) fetch(flag string, target flagTarget) (any, bool, error) {
+	s.calls++
+	if s.down {
+		return nil, false, errors.New("connection refused")
+	}
+	return "gpt-4o-mini", true, nil
+}
+
+func TestCachedFlags_FailsOpen(t *testing.T) {
+	source := &failingFlagSource{down: true}
+	flags := newCachedFlags(source, time.Minute)
+	now := time.Unix(0, 0)
+	flags.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if _, ok := flags.Value("model", flagTarget{Tenant: "acme"}); ok {
+			t.Fatal("Expected no answer while the service is down")
+		}
+	}
+	if source.calls != 1 {
+		t.Errorf("Expected the service to be left alone after a failure, got %d calls", source.calls)
+	}
+	source.down = false
+	now = now.Add(flags.backoff)
+	if value, ok := flags.Value("model", flagTarget{Tenant: "acme"}); !ok || value != "gpt-4o-mini" {
+		t.Errorf("Expected the service to be asked again after the backoff, got %v, %v", value, ok)
+	}
+}
+
+func TestLaunchDarklySource(t *testing.T) {
+	relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoded, ok := strings.CutPrefix(r.URL.Path, "/sdk/evalx/contexts/")
+		if !ok || r.Header.Get("Authorization") != "sdk-key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		data, _ := base64.RawURLEncoding.DecodeString(encoded)
+		var ldContext map[string]any
+		json.Unmarshal(data, &ldContext)
+		json.NewEncoder(w).Encode(map[string]any{
+			"rag":           map[string]any{"value": ldContext["key"] == "beta", "variation": 0},
+			"support-model": map[string]any{"value": "gpt-4o-mini", "variation": 1},
+		})
+	}))
+	defer relay.Close()
+
+	source := newLaunchDarklySource(relay.URL, "sdk-key")
+	if value, found, err := source.fetch(FeatureRAG, flagTarget{Tenant: "beta"}); err != nil || !found || value != true {
+		t.Errorf("Expected rag on for beta, got %v, %v, %v", value, found, err)
+	}
+	if value, found, err := source.fetch(FeatureRAG, flagTarget{}); err != nil || !found || value != false {
+		t.Errorf("Expected rag off for anonymous requests, got %v, %v, %v", value, found, err)
+	}
+	if _, found, err := source.fetch("unknown", flagTarget{Tenant: "beta"}); err != nil || found {
+		t.Errorf("Expected unknown flags to be unanswered, got %v, %v", found, err)
+	}
+	source.sdkKey = "wrong"
+	if _, _, err := source.fetch(FeatureRAG, flagTarget{Tenant: "beta"}); err == nil {
+		t.Error("Expected an error from a rejected key")
+	}
+}
+
+func TestProxyServer_FlaggedRoutingAndParameters(t *testing.T) {
+	mockClient := &recordingOpenAIClient{MockOpenAIClient: MockOpenAIClient{response: createTestChatCompletionResponse()}}
+	server := NewProxyServer(mockClient)
+	server.routes.Put("experiment", RoutingRule{ID: "experiment", Model: "gpt-4o", TargetModel: "gpt-4o", Flag: "gpt-4o-experiment"})
+	temperature := 0.2
+	server.virtualModels.Put("support", VirtualModel{ID: "support", Model: "gpt-3.5-turbo", Temperature: &temperature, Flag: "support-params"})
+
+	// Without a flag service the configuration applies as is
+	chatRequestAs(server, nil, `{"model": "gpt-4o", "messages": [{"role": "user", "content": "Hi"}]}`)
+	if mockClient.last.Model != "gpt-4o" {
+		t.Errorf("Expected the rule's target, got %s", mockClient.last.Model)
+	}
+
+	server.flagProvider = stubFlagProvider{
+		"gpt-4o-experiment": "gpt-4o-mini",
+		"support-params":    map[string]any{"model": "gpt-4o", "temperature": 0.7, "system": "Be brief."},
+	}
+	chatRequestAs(server, nil, `{"model": "gpt-4o", "messages": [{"role": "user", "content": "Hi"}]}`)
+	if mockClient.last.Model != "gpt-4o-mini" {
+		t.Errorf("Expected the flag to pick the target, got %s", mockClient.last.Model)
+	}
+	chatRequestAs(server, nil, `{"model": "support", "messages": [{"role": "user", "content": "Hi"}]}`)
+	last := mockClient.last
+	if last.Model != "gpt-4o-mini" || last.Temperature == nil || *last.Temperature != 0.7 || last.Messages[0].Content != "Be brief." {
+		t.Errorf("Expected the flag's parameters, then routing, got %+v", last)
+	}
+
+	server.flagProvider = stubFlagProvider{"gpt-4o-experiment": 42, "support-params": "not an object"}
+	chatRequestAs(server, nil, `{"model": "support", "messages": [{"role": "user", "content": "Hi"}]}`)
+	last = mockClient.last
+	if last.Model != "gpt-3.5-turbo" || *last.Temperature != 0.2 {
+		t.Errorf("Expected invalid flag values to be ignored, got %+v", last)
+	}
+}
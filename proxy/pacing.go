@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Batch jobs sharing an upstream key with interactive traffic send their
+// requests as fast as they can, and the bursts push up everyone's latency
+// and use up the key's rate limit. Tenants flagged as batch have their
+// requests paced instead: each tenant has a leaky bucket measured in tokens
+// that drains at the tenant's pace, and a request waits until the tokens
+// before it have drained. Requests are charged a token per four bytes of
+// their body while they wait and run, and the tokens they used once they
+// are done, so a job's long replies slow its next requests.
+
+// defaultBatchMaxWait is how long a paced request waits at most by default
+const defaultBatchMaxWait = time.Minute
+
+// BatchPacing smooths the upstream requests of a batch tenant
+type BatchPacing struct {
+	// TokensPerMinute is the pace the tenant's tokens are sent at
+	TokensPerMinute int `json:"tokens_per_minute"`
+	// MaxWait is how long a request waits to be sent before it is refused
+	// with 429, e.g. "5m" (default 1m)
+	MaxWait string `json:"max_wait,omitempty"`
+}
+
+// validate checks the pacing of a tenant
+func (p BatchPacing) validate() error {
+	if p.TokensPerMinute <= 0 {
+		return fmt.Errorf("batch tokens_per_minute must be positive")
+	}
+	if _, err := p.maxWait(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// maxWait parses MaxWait
+func (p BatchPacing) maxWait() (time.Duration, error) {
+	if p.MaxWait == "" {
+		return defaultBatchMaxWait, nil
+	}
+	d, err := time.ParseDuration(p.MaxWait)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("batch max_wait must be a duration such as 5m")
+	}
+	return d, nil
+}
+
+// leakyBucket is the tokens of a tenant waiting to drain
+type leakyBucket struct {
+	// rate is the tokens drained per second
+	rate float64
+	// level is the tokens of completed requests still draining
+	level float64
+	// pending is the estimated tokens of requests waiting or in flight,
+	// which drain once they complete
+	pending float64
+	last    time.Time
+}
+
+func (b *leakyBucket) drain(now time.Time) {
+	if !b.last.IsZero() {
+		b.level = math.Max(0, b.level-b.rate*now.Sub(b.last).Seconds())
+	}
+	b.last = now
+}
+
+// batchPacer holds the buckets of batch tenants
+type batchPacer struct {
+	mu      sync.Mutex
+	buckets map[string]*leakyBucket
+	now     func() time.Time
+}
+
+func newBatchPacer() *batchPacer {
+	return &batchPacer{buckets: make(map[string]*leakyBucket), now: time.Now}
+}
+
+// Reserve queues a request of an estimated cost in tokens and returns how
+// long it must wait before it is sent. A second's worth of tokens can be
+// sent without waiting. If the wait is longer than maxWait nothing is
+// queued and ok is false.
+func (p *batchPacer) Reserve(tenant string, pacing BatchPacing, maxWait time.Duration, cost int) (wait time.Duration, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	b := p.buckets[tenant]
+	if b == nil {
+		b = &leakyBucket{}
+		p.buckets[tenant] = b
+	}
+	b.rate = float64(pacing.TokensPerMinute) / 60
+	b.drain(p.now())
+	if ahead := b.level + b.pending - b.rate; ahead > 0 {
+		wait = time.Duration(ahead / b.rate * float64(time.Second))
+	}
+	if wait > maxWait {
+		return wait, false
+	}
+	b.pending += float64(cost)
+	return wait, true
+}
+
+// Release removes the estimate of a request that completed or gave up
+func (p *batchPacer) Release(tenant string, cost int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if b := p.buckets[tenant]; b != nil {
+		b.pending = math.Max(0, b.pending-float64(cost))
+	}
+}
+
+// Record adds the tokens a tenant's request used to its bucket, if the
+// tenant is paced
+func (p *batchPacer) Record(tenant string, tokens int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if b := p.buckets[tenant]; b != nil && tokens > 0 {
+		b.drain(p.now())
+		b.level += float64(tokens)
+	}
+}
+
+// withPacing holds back the requests of batch tenants until their bucket
+// has drained. It must run inside withAuth.
+func (s *ProxyServer) withPacing(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := clientKeyFromContext(r.Context())
+		if key == nil || key.Tenant == "" {
+			next(w, r)
+			return
+		}
+		tenant, ok := s.tenants.Get(key.Tenant)
+		if !ok || tenant.Batch == nil {
+			next(w, r)
+			return
+		}
+		maxWait, err := tenant.Batch.maxWait()
+		if err != nil {
+			maxWait = defaultBatchMaxWait
+		}
+		cost := max(1, int(r.ContentLength/4))
+		wait, ok := s.pacer.Reserve(tenant.ID, *tenant.Batch, maxWait, cost)
+		if !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil((wait - maxWait).Seconds()))))
+			http.Error(w, "Batch tenant is ahead of its pace, retry later", http.StatusTooManyRequests)
+			return
+		}
+		defer s.pacer.Release(tenant.ID, cost)
+
+		if wait > 0 {
+			timelineFromContext(r.Context()).Add(TimelinePaced, wait.String())
+			timer := time.NewTimer(wait)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+			case <-r.Context().Done():
+				return
+			}
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBatchPacer_Reserve(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	pacer := newBatchPacer()
+	pacer.now = func() time.Time { return now }
+	pacing := BatchPacing{TokensPerMinute: 600}
+
+	// Ten tokens a second: the first request goes at once and the ones
+	// behind it wait for its tokens to drain
+	if wait, ok := pacer.Reserve("etl", pacing, time.Minute, 100); !ok || wait != 0 {
+		t.Fatalf("Expected the first request to be sent at once, got %v %v", wait, ok)
+	}
+	if wait, _ := pacer.Reserve("etl", pacing, time.Minute, 100); wait != 9*time.Second {
+		t.Errorf("Expected to wait 9s, got %v", wait)
+	}
+	if wait, _ := pacer.Reserve("etl", pacing, time.Minute, 100); wait != 19*time.Second {
+		t.Errorf("Expected to wait 19s, got %v", wait)
+	}
+	if _, ok := pacer.Reserve("etl", pacing, 10*time.Second, 100); ok {
+		t.Error("Expected a request over the maximum wait to be refused")
+	}
+
+	// Completed requests are charged what they used, which drains over time
+	pacer.Release("etl", 100)
+	pacer.Release("etl", 100)
+	pacer.Release("etl", 100)
+	pacer.Record("etl", 310)
+	if wait, _ := pacer.Reserve("etl", pacing, time.Minute, 10); wait != 30*time.Second {
+		t.Errorf("Expected to wait 30s, got %v", wait)
+	}
+	pacer.Release("etl", 10)
+	now = now.Add(30 * time.Second)
+	if wait, _ := pacer.Reserve("etl", pacing, time.Minute, 10); wait != 0 {
+		t.Errorf("Expected the bucket to have drained, got %v", wait)
+	}
+
+	pacer.Record("interactive", 1000000)
+	if wait, _ := pacer.Reserve("other", pacing, time.Minute, 10); wait != 0 {
+		t.Errorf("Expected tenants not to share buckets, got %v", wait)
+	}
+}
+
+func TestProxyServer_BatchTenantPacing(t *testing.T) {
+	server := NewProxyServer(&MockOpenAIClient{response: createTestChatCompletionResponse()})
+	server.keys = createTestKeyStore(t)
+	server.keys.Add(ClientKey{ID: "etl", Key: "sk-etl", Tenant: "etl"})
+	server.keys.Add(ClientKey{ID: "app", Key: "sk-app", Tenant: "app"})
+	server.tenants.Put("etl", Tenant{ID: "etl", Batch: &BatchPacing{TokensPerMinute: 60, MaxWait: "1s"}})
+	server.tenants.Put("app", Tenant{ID: "app"})
+	server.submissions = nil
+	handler := server.Handler()
+	do := func(secret string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "gpt-4o", "messages": [{"role": "user", "content": "Hi"}]}`))
+		req.Header.Set("Authorization", "Bearer "+secret)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := do("sk-etl"); w.Code != http.StatusOK {
+		t.Fatalf("Expected the first request to be sent, got %d %s", w.Code, w.Body.String())
+	}
+	// The 32 tokens of the reply take half a minute to drain at one a second
+	w := do("sk-etl")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected the batch tenant to be held back, got %d %v", w.Code, w.Header())
+	}
+	for i := 0; i < 3; i++ {
+		if w := do("sk-app"); w.Code != http.StatusOK {
+			t.Errorf("Expected interactive tenants not to be paced, got %d", w.Code)
+		}
+	}
+}
+
+func TestAdminTenant_ValidatesBatchPacing(t *testing.T) {
+	server := NewProxyServer(&MockOpenAIClient{})
+	server.keys = createTestKeyStore(t)
+	handler := server.Handler()
+	for body, want := range map[string]int{
+		`{"batch": {"tokens_per_minute": 100000, "max_wait": "5m"}}`: http.StatusCreated,
+		`{"batch": {"tokens_per_minute": 0}}`:                        http.StatusBadRequest,
+		`{"batch": {"tokens_per_minute": 100, "max_wait": "soon"}}`:  http.StatusBadRequest,
+	} {
+		req := httptest.NewRequest("PUT", "/admin/tenants/etl", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer sk-admin-rw")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != want {
+			t.Errorf("PUT %s: expected %d, got %d %s", body, want, w.Code, w.Body.String())
+		}
+		server.tenants.Delete("etl")
+	}
+}
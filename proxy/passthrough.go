@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// rawOpenAIClient is implemented by clients that can forward encoded
+// request bodies as they are. The proxy then only scans the fields it needs
+// instead of decoding and re-encoding the whole request and response.
+type rawOpenAIClient interface {
+	// CreateChatCompletionRaw sends body and appends the encoded response
+	// to out
+	CreateChatCompletionRaw(ctx context.Context, body []byte, out *bytes.Buffer) error
+}
+
+// mustDecode reports whether an encoded chat completion request needs
+// features the passthrough path does not have: expanding a virtual model,
+// a response format the proxy enforces itself, tool calls it validates or
+// retrieval augmentation. Bodies with duplicate keys are decoded too, as
+// the scan and the upstream may not agree on which of them counts.
+func (s *ProxyServer) mustDecode(body []byte) bool {
+	decode := false
+	seen := map[string]bool{}
+	scanObject(body, func(key []byte, start, end int) bool {
+		if seen[string(key)] {
+			decode = true
+			return false
+		}
+		seen[string(key)] = true
+		switch string(key) {
+		case "model":
+			if s.virtualModels.Len() > 0 {
+				model, _ := jsonStringValue(body[start:end])
+				_, decode = s.virtualModels.Get(model)
+			}
+		case "rag", "post_process", "builtin_tools", "session":
+			decode = true
+		case "tools":
+			decode = s.toolCallValidation != ToolCallsUnchecked
+		case "response_format":
+			var format ResponseFormat
+			json.Unmarshal(body[start:end], &format)
+			decode = s.structuredOutput != StructuredOutputNative || proxyOnlyFormat(&format)
+		}
+		return !decode
+	})
+	return decode
+}
+
+// validateChatRequest checks the fields every chat completion request
+// needs. Both the decoded and the passthrough path run it, so a request is
+// accepted or refused the same way whichever path it takes.
+func validateChatRequest(req ChatCompletionRequest) error {
+	if req.Model == "" {
+		return errors.New("Model field is required")
+	}
+	if len(req.Messages) == 0 {
+		return errors.New("Messages field is required and cannot be empty")
+	}
+	if err := validateToolMessages(req); err != nil {
+		return err
+	}
+	_, err := newOutputCheck(req.ResponseFormat)
+	return err
+}
+
+// handleChatCompletionsRaw is the passthrough variant of
+// handleChatCompletions. The request is decoded for validateChatRequest,
+// and the same scopes and routing apply, but the body is forwarded as it
+// came unless a routing rule rewrites the model or attribution sets the
+// user, and the reply is relayed without decoding it. Requests needing
+// anything more take the decoded path, see mustDecode.
+func (s *ProxyServer) handleChatCompletionsRaw(w http.ResponseWriter, r *http.Request, client rawOpenAIClient, body []byte) {
+	var req ChatCompletionRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, "Invalid JSON in request body", http.StatusBadRequest)
+		return
+	}
+	if err := validateChatRequest(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The members the proxy rewrites are located in the body
+	model := req.Model
+	modelStart, modelEnd := -1, -1
+	stream := req.Stream != nil && *req.Stream
+	scanObject(body, func(key []byte, start, end int) bool {
+		if string(key) == "model" {
+			modelStart, modelEnd = start, end
+			return false
+		}
+		return true
+	})
+	key := clientKeyFromContext(r.Context())
+	if key != nil && !key.AllowsModel(model) {
+		http.Error(w, fmt.Sprintf("API key is not allowed to use model %s", model), http.StatusForbidden)
+		return
+	}
+	timeline := timelineFromContext(r.Context())
+	timeline.Add(TimelineValidated, "")
+	var tenant string
+	if key != nil {
+		tenant = key.Tenant
+	}
+	requested := model
+	if target := s.resolveModel(model, tenant); target != model {
+		body = replaceJSONValue(body, modelStart, modelEnd, target)
+		model = target
+	}
+	timeline.Addf(TimelineRouted, "%s -> %s", requested, model)
+	if attributed := s.attribution.User(key, req.User); attributed != "" {
+		body = setJSONMember(body, "user", attributed)
+	}
+	if !s.checkLatencyBudget(w, r, "chat.completions", model) {
+		return
+	}
+
+	if streaming, ok := client.(streamingOpenAIClient); ok && stream {
+		s.streamChatCompletion(w, r, streaming, body, key, model)
+		return
+	}
+
+	ctx, done := s.inflight.Start(r.Context(), timeline.id(), key)
+	defer done()
+	event := newUsageEvent(key, "chat.completions", model)
+	resp := getBuffer()
+	defer putBuffer(resp)
+	err := client.CreateChatCompletionRaw(ctx, body, resp)
+	event.LatencyMS = time.Since(event.Time).Milliseconds()
+	if err != nil {
+		log.Printf("OpenAI API error: %v", err)
+		event.Status = upstreamErrorStatus(err)
+		s.recordUsage(event)
+		writeUpstreamError(w, err)
+		return
+	}
+
+	timeline.Add(TimelineFirstToken, "")
+	s.recordCompletion(key, event, scanUsage(resp.Bytes()))
+
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(resp.Bytes()); err != nil {
+		log.Printf("Failed to write response: %v", err)
+	}
+}
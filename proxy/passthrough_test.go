@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Mock client implementing the passthrough interface
+type rawMockOpenAIClient struct {
+	MockOpenAIClient
+	lastRaw []byte
+	// rawResponse, when set, is returned instead of encoding response
+	rawResponse []byte
+}
+
+func (m *rawMockOpenAIClient) CreateChatCompletionRaw(ctx context.Context, body []byte, out *bytes.Buffer) error {
+	// body is only valid for the duration of the call
+	m.lastRaw = append(m.lastRaw[:0], body...)
+	if m.shouldError {
+		return m.error
+	}
+	if m.rawResponse != nil {
+		out.Write(m.rawResponse)
+		return nil
+	}
+	return json.NewEncoder(out).Encode(m.response)
+}
+
+func TestScanObject(t *testing.T) {
+	data := []byte(` {"model" : "gpt-4o", "nested": {"a": [1, "}"]}, "s": "q\"}", "n": -1.5e3, "ok": true} `)
+	got := map[string]string{}
+	if err := scanObject(data, func(key []byte, start, end int) bool {
+		got[string(key)] = string(data[start:end])
+		return true
+	}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	want := map[string]string{
+		"model":  `"gpt-4o"`,
+		"nested": `{"a": [1, "}"]}`,
+		"s":      `"q\"}"`,
+		"n":      `-1.5e3`,
+		"ok":     `true`,
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("Member %s: expected %s, got %s", k, v, got[k])
+		}
+	}
+	escaped := []byte(`{"mod\u0065l": "gpt-4o"}`)
+	scanObject(escaped, func(key []byte, start, end int) bool {
+		if string(key) != "model" {
+			t.Errorf("Expected the escaped key to be decoded, got %s", key)
+		}
+		return true
+	})
+	if err := scanObject([]byte(`[1]`), func([]byte, int, int) bool { return true }); err == nil {
+		t.Error("Expected an error for a non-object")
+	}
+}
+
+func TestJSONStringValue(t *testing.T) {
+	if s, ok := jsonStringValue([]byte(`"gpt-4o"`)); !ok || s != "gpt-4o" {
+		t.Errorf("Expected gpt-4o, got %q", s)
+	}
+	if s, ok := jsonStringValue([]byte(`"a\u0062"`)); !ok || s != "ab" {
+		t.Errorf("Expected escapes to be decoded, got %q", s)
+	}
+	if _, ok := jsonStringValue([]byte(`42`)); ok {
+		t.Error("Expected a number not to be a string")
+	}
+}
+
+func TestScanUsage(t *testing.T) {
+	data, _ := json.Marshal(createTestChatCompletionResponse())
+	want := createTestChatCompletionResponse().Usage
+	if got := scanUsage(data); got != want {
+		t.Errorf("Expected %+v, got %+v", want, got)
+	}
+}
+
+func TestSetJSONMember(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{`{"model":"gpt-4o","user":"a"}`, `{"model":"gpt-4o","user":"b"}`},
+		{`{"model":"gpt-4o"}`, `{"user":"b","model":"gpt-4o"}`},
+		{` { } `, ` {"user":"b" } `},
+	}
+	for _, tt := range tests {
+		if got := string(setJSONMember([]byte(tt.in), "user", "b")); got != tt.want {
+			t.Errorf("%s: expected %s, got %s", tt.in, tt.want, got)
+		}
+	}
+}
+
+func TestProxyServer_HandleChatCompletionsRaw_ForwardsBody(t *testing.T) {
+	mockClient := &rawMockOpenAIClient{MockOpenAIClient: MockOpenAIClient{response: createTestChatCompletionResponse()}}
+	server := NewProxyServer(mockClient)
+
+	// Unknown fields are forwarded untouched
+	body := `{"model":"gpt-3.5-turbo","messages":[{"role":"user","content":"Hi"}],"seed":7}`
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	server.handleChatCompletions(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	if string(mockClient.lastRaw) != body {
+		t.Errorf("Expected body to be forwarded as is, got %s", mockClient.lastRaw)
+	}
+	var resp ChatCompletionResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.ID != "chatcmpl-test123" {
+		t.Errorf("Expected upstream response to be returned, got %s", w.Body.String())
+	}
+}
+
+func TestProxyServer_HandleChatCompletionsRaw_RewritesRoutedModel(t *testing.T) {
+	mockClient := &rawMockOpenAIClient{MockOpenAIClient: MockOpenAIClient{response: createTestChatCompletionResponse()}}
+	server := NewProxyServer(mockClient)
+	server.routes.Put("legacy", RoutingRule{ID: "legacy", Model: "gpt-3.5-turbo", TargetModel: "gpt-4o-mini"})
+
+	body := `{"model": "gpt-3.5-turbo", "messages": [{"role": "user", "content": "Hi"}]}`
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body))
+	server.handleChatCompletions(httptest.NewRecorder(), req)
+
+	want := `{"model": "gpt-4o-mini", "messages": [{"role": "user", "content": "Hi"}]}`
+	if string(mockClient.lastRaw) != want {
+		t.Errorf("Expected %s, got %s", want, mockClient.lastRaw)
+	}
+}
+
+func TestProxyServer_HandleChatCompletionsRaw_Validation(t *testing.T) {
+	server := NewProxyServer(&rawMockOpenAIClient{MockOpenAIClient: MockOpenAIClient{response: createTestChatCompletionResponse()}})
+
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"invalid JSON", `{"model":`, "Invalid JSON in request body"},
+		{"not an object", `["gpt-4o"]`, "Invalid JSON in request body"},
+		{"missing model", `{"messages":[{"role":"user","content":"Hi"}]}`, "Model field is required"},
+		{"empty messages", `{"model":"gpt-4o","messages":[]}`, "Messages field is required and cannot be empty"},
+		{"invalid content", `{"model":"gpt-4o","messages":[{"role":"user","content":42}]}`, "Invalid JSON in request body"},
+		{"tool turn without call ID", `{"model":"gpt-4o","messages":[{"role":"tool","content":"Sunny"}]}`, "tool_call_id"},
+		{"schema without schema", `{"model":"gpt-4o","messages":[{"role":"user","content":"Hi"}],"response_format":{"type":"json_schema"}}`, "requires a schema"},
+	}
+	// The decoded path refuses the same requests in the same words
+	decoded := NewProxyServer(&MockOpenAIClient{response: createTestChatCompletionResponse()})
+	for _, tt := range tests {
+		for _, s := range []*ProxyServer{server, decoded} {
+			req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(tt.body))
+			w := httptest.NewRecorder()
+			s.handleChatCompletions(w, req)
+			if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), tt.want) {
+				t.Errorf("%s: expected 400 %q, got %d %q", tt.name, tt.want, w.Code, w.Body.String())
+			}
+		}
+	}
+}
+
+func TestProxyServer_HandleChatCompletionsRaw_ModelScopesSeeEveryKey(t *testing.T) {
+	mockClient := &rawMockOpenAIClient{MockOpenAIClient: MockOpenAIClient{response: createTestChatCompletionResponse()}}
+	server := NewProxyServer(mockClient)
+	key := &ClientKey{ID: "mini", Scopes: KeyScopes{Models: []string{"gpt-4o-mini"}}}
+
+	for _, body := range []string{
+		`{"mod\u0065l":"gpt-4o","messages":[{"role":"user","content":"Hi"}]}`,
+		`{"model":"gpt-4o-mini","mod\u0065l":"gpt-4o","messages":[{"role":"user","content":"Hi"}]}`,
+		`{"model":"gpt-4o-mini","model":"gpt-4o","messages":[{"role":"user","content":"Hi"}]}`,
+	} {
+		mockClient.lastRaw = nil
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body))
+		req = req.WithContext(context.WithValue(req.Context(), clientKeyContextKey, key))
+		w := httptest.NewRecorder()
+		server.handleChatCompletions(w, req)
+		if w.Code != http.StatusForbidden || mockClient.lastRaw != nil {
+			t.Errorf("%s: expected 403, got %d %s", body, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestProxyServer_MustDecode_EscapedAndDuplicateKeys(t *testing.T) {
+	server := NewProxyServer(&rawMockOpenAIClient{})
+	for body, want := range map[string]bool{
+		`{"model":"gpt-4o","messages":[]}`:                false,
+		`{"model":"gpt-4o","r\u0061g":{"top_k":3}}`:       true,
+		`{"model":"gpt-4o","stream":false,"stream":true}`: true,
+		`{"model":"gpt-4o","user":"a","us\u0065r":"b"}`:   true,
+	} {
+		if got := server.mustDecode([]byte(body)); got != want {
+			t.Errorf("%s: expected %v, got %v", body, want, got)
+		}
+	}
+}
+
+func TestProxyServer_HandleChatCompletionsRaw_UpstreamError(t *testing.T) {
+	server := NewProxyServer(&rawMockOpenAIClient{MockOpenAIClient: MockOpenAIClient{shouldError: true, error: errors.New("rate limit exceeded")}})
+
+	jsonData, _ := json.Marshal(createTestChatCompletionRequest())
+	req := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader(jsonData))
+	w := httptest.NewRecorder()
+	server.handleChatCompletions(w, req)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected status code %d, got %d", http.StatusInternalServerError, w.Code)
+	}
+}
+
+func TestProxyServer_HandleChatCompletionsRaw_RecordsTokens(t *testing.T) {
+	server := NewProxyServer(&rawMockOpenAIClient{MockOpenAIClient: MockOpenAIClient{response: createTestChatCompletionResponse()}})
+	server.keys = createTestKeyStore(t)
+	handler := server.withAuth(server.handleChatCompletions)
+
+	jsonData, _ := json.Marshal(createTestChatCompletionRequest())
+	req := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader(jsonData))
+	req.Header.Set("Authorization", "Bearer sk-full")
+	handler(httptest.NewRecorder(), req)
+
+	_, tokens := server.limiter.windowKeys("full")
+	want := int64(createTestChatCompletionResponse().Usage.TotalTokens)
+	if got := server.limiter.counters.Get(tokens); got != want {
+		t.Errorf("Expected %d tokens recorded, got %d", want, got)
+	}
+}
+
+func BenchmarkProxyServer_HandleChatCompletionsRaw(b *testing.B) {
+	response, _ := json.Marshal(createTestChatCompletionResponse())
+	server := NewProxyServer(&rawMockOpenAIClient{rawResponse: response})
+	jsonData, _ := json.Marshal(createTestChatCompletionRequest())
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader(jsonData))
+		server.handleChatCompletions(httptest.NewRecorder(), req)
+	}
+}
+
+func BenchmarkScanObject(b *testing.B) {
+	jsonData, _ := json.Marshal(createTestChatCompletionRequest())
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		scanObject(jsonData, func(key []byte, start, end int) bool { return true })
+	}
+}
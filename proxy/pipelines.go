@@ -0,0 +1,414 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Builtin pipeline steps
+const (
+	// Searches a knowledge base with the prompt and outputs the numbered
+	// sources found
+	PipelineRetrieve = "retrieve"
+	// Checks the prompt against a guardrail profile and outputs it,
+	// redacted if the profile says so
+	PipelineGuardrail = "guardrail"
+	// Outputs the rendered prompt
+	PipelineTemplate = "template"
+)
+
+// Pipeline is a named sequence of steps run on one input, e.g. classify,
+// retrieve, answer and check the answer. Each step is a model call or a
+// builtin, and sees the outputs of the steps before it.
+type Pipeline struct {
+	ID          string `json:"id"`
+	Description string `json:"description,omitempty"`
+	// Tenant, if set, limits the pipeline to that tenant's keys
+	Tenant string         `json:"tenant,omitempty"`
+	Steps  []PipelineStep `json:"steps"`
+	// Output is a template for the result of the pipeline, by default the
+	// output of the last step that ran
+	Output string `json:"output,omitempty"`
+}
+
+// PipelineStep is one step of a pipeline. Prompt, System, If and the
+// pipeline's Output are Go templates executed with .Input and .Vars of the
+// run, .Steps, the outputs by step name, and .Prev, the output of the
+// previous step that ran. The functions trim, lower and contains are
+// available.
+type PipelineStep struct {
+	Name string `json:"name"`
+	// Model makes the step a chat completion with Prompt as user message
+	Model       string   `json:"model,omitempty"`
+	System      string   `json:"system,omitempty"`
+	Temperature *float64 `json:"temperature,omitempty"`
+	MaxTokens   *int     `json:"max_tokens,omitempty"`
+	// Builtin makes the step one of retrieve, guardrail or template
+	Builtin       string  `json:"builtin,omitempty"`
+	KnowledgeBase string  `json:"knowledge_base,omitempty"`
+	TopK          int     `json:"top_k,omitempty"`
+	MinScore      float64 `json:"min_score,omitempty"`
+	Guardrails    string  `json:"guardrails,omitempty"`
+	// Prompt is the input of the step, by default .Prev
+	Prompt string `json:"prompt,omitempty"`
+	// If, if set, skips the step unless it renders to something other than
+	// blank, "false" or "no"
+	If string `json:"if,omitempty"`
+}
+
+var pipelineFuncs = template.FuncMap{
+	"trim":     strings.TrimSpace,
+	"lower":    strings.ToLower,
+	"contains": strings.Contains,
+}
+
+// parse checks the pipeline and returns its templates, named after the
+// index of their step, e.g. "0.prompt", and "output"
+func (p Pipeline) parse() (*template.Template, error) {
+	if len(p.Steps) == 0 {
+		return nil, fmt.Errorf("pipeline requires steps")
+	}
+	tmpl := template.New("output").Option("missingkey=error").Funcs(pipelineFuncs)
+	if _, err := tmpl.Parse(p.Output); err != nil {
+		return nil, fmt.Errorf("invalid output template: %w", err)
+	}
+	names := make(map[string]bool, len(p.Steps))
+	for i, step := range p.Steps {
+		if step.Name == "" || names[step.Name] {
+			return nil, fmt.Errorf("step %d requires a unique name", i+1)
+		}
+		names[step.Name] = true
+		switch {
+		case step.Model != "" && step.Builtin != "":
+			return nil, fmt.Errorf("step %s cannot have both a model and a builtin", step.Name)
+		case step.Model != "":
+		case step.Builtin == PipelineRetrieve:
+			if step.TopK < 0 {
+				return nil, fmt.Errorf("step %s: top_k cannot be negative", step.Name)
+			}
+		case step.Builtin == PipelineGuardrail:
+			if step.Guardrails == "" {
+				return nil, fmt.Errorf("step %s requires guardrails", step.Name)
+			}
+		case step.Builtin == PipelineTemplate:
+		default:
+			return nil, fmt.Errorf("step %s requires a model or a builtin of retrieve, guardrail or template", step.Name)
+		}
+		prompt := step.Prompt
+		if prompt == "" {
+			prompt = "{{.Prev}}"
+		}
+		for part, text := range map[string]string{"prompt": prompt, "system": step.System, "if": step.If} {
+			if _, err := tmpl.New(fmt.Sprintf("%d.%s", i, part)).Parse(text); err != nil {
+				return nil, fmt.Errorf("step %s: invalid %s template: %w", step.Name, part, err)
+			}
+		}
+	}
+	return tmpl, nil
+}
+
+// PipelineStepResult is the outcome of one step of a run
+type PipelineStepResult struct {
+	Name string `json:"name"`
+	// Type is "model" or the builtin
+	Type      string `json:"type"`
+	Model     string `json:"model,omitempty"`
+	Skipped   bool   `json:"skipped,omitempty"`
+	Output    string `json:"output"`
+	Usage     *Usage `json:"usage,omitempty"`
+	LatencyMS int64  `json:"latency_ms"`
+}
+
+// PipelineRun is the outcome of a run of a pipeline
+type PipelineRun struct {
+	Pipeline  string               `json:"pipeline"`
+	Output    string               `json:"output"`
+	Steps     []PipelineStepResult `json:"steps"`
+	Citations []Citation           `json:"citations,omitempty"`
+	Usage     Usage                `json:"usage"`
+}
+
+// PipelineEvent is sent for every step that starts and completes when a run
+// is streamed, followed by done or error
+type PipelineEvent struct {
+	Type   string              `json:"type"`
+	Step   string              `json:"step,omitempty"`
+	Result *PipelineStepResult `json:"result,omitempty"`
+	Run    *PipelineRun        `json:"run,omitempty"`
+	Error  string              `json:"error,omitempty"`
+}
+
+// PipelineRunRequest is the body of /v1/pipelines/{name}/run
+type PipelineRunRequest struct {
+	Input     string         `json:"input"`
+	Variables map[string]any `json:"variables,omitempty"`
+	Stream    bool           `json:"stream,omitempty"`
+}
+
+// pipelineStepError is a run that failed at a step
+type pipelineStepError struct {
+	step string
+	err  error
+}
+
+func (e *pipelineStepError) Error() string { return fmt.Sprintf("step %s: %v", e.step, e.err) }
+func (e *pipelineStepError) Unwrap() error { return e.err }
+
+// pipelineStatus is the status code to answer a failed run with
+func pipelineStatus(err error) int {
+	switch {
+	case errors.Is(err, errModelNotAllowed), errors.Is(err, errFeatureDisabled):
+		return http.StatusForbidden
+	case errors.Is(err, errGuardrailBlocked), errors.Is(err, errBadRetrieval):
+		return http.StatusBadRequest
+	case errors.Is(err, errRetrievalUnsupported):
+		return http.StatusNotImplemented
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+// runPipeline runs the steps of p in order, calling emit as they start and
+// complete. The first step that fails ends the run, as does cancelling ctx.
+func (s *ProxyServer) runPipeline(ctx context.Context, p Pipeline, in PipelineRunRequest, key *ClientKey, emit func(PipelineEvent)) (*PipelineRun, error) {
+	tmpl, err := p.parse()
+	if err != nil {
+		return nil, err
+	}
+	var tenant string
+	if key != nil {
+		tenant = key.Tenant
+	}
+	run := &PipelineRun{Pipeline: p.ID, Steps: []PipelineStepResult{}}
+	outputs := make(map[string]string, len(p.Steps))
+	data := map[string]any{"Input": in.Input, "Vars": in.Variables, "Steps": outputs, "Prev": in.Input}
+	render := func(name string) (string, error) {
+		var b strings.Builder
+		err := tmpl.ExecuteTemplate(&b, name, data)
+		return b.String(), err
+	}
+
+	for i, step := range p.Steps {
+		if err := ctx.Err(); err != nil {
+			return run, err
+		}
+		emit(PipelineEvent{Type: "step_started", Step: step.Name})
+		result := PipelineStepResult{Name: step.Name, Type: step.Builtin, Model: step.Model}
+		if step.Model != "" {
+			result.Type = "model"
+		}
+		start := time.Now()
+		err := func() error {
+			cond, err := render(fmt.Sprintf("%d.if", i))
+			if err != nil {
+				return fmt.Errorf("failed to render condition: %w", err)
+			}
+			if step.If != "" {
+				switch strings.ToLower(strings.TrimSpace(cond)) {
+				case "", "false", "no":
+					result.Skipped = true
+					return nil
+				}
+			}
+			prompt, err := render(fmt.Sprintf("%d.prompt", i))
+			if err != nil {
+				return fmt.Errorf("failed to render prompt: %w", err)
+			}
+			system, err := render(fmt.Sprintf("%d.system", i))
+			if err != nil {
+				return fmt.Errorf("failed to render system prompt: %w", err)
+			}
+			switch {
+			case step.Model != "":
+				return s.runModelStep(ctx, step, prompt, system, key, tenant, &result)
+			case step.Builtin == PipelineRetrieve:
+				if !s.featureEnabled(FeatureRAG, "pipelines", tenant) {
+					return fmt.Errorf("%w: retrieval is not available to this tenant yet", errFeatureDisabled)
+				}
+				kb, err := s.knowledgeBaseFor(step.KnowledgeBase, tenant)
+				if err != nil {
+					return err
+				}
+				citations, err := s.search(key, kb, prompt, RAGOptions{TopK: step.TopK, MinScore: step.MinScore})
+				if err != nil {
+					return err
+				}
+				for _, c := range citations {
+					c.Index = len(run.Citations) + 1
+					run.Citations = append(run.Citations, c)
+				}
+				result.Output = sourcesText(run.Citations[len(run.Citations)-len(citations):])
+			case step.Builtin == PipelineGuardrail && !s.featureEnabled(FeatureGuardrails, "pipelines", tenant):
+				result.Output = prompt
+			case step.Builtin == PipelineGuardrail:
+				profile, ok := s.guardrails.Get(step.Guardrails)
+				if !ok {
+					return fmt.Errorf("unknown guardrail profile %s", step.Guardrails)
+				}
+				messages, err := profile.apply([]Message{{Role: "user", Content: prompt}})
+				if err != nil {
+					return err
+				}
+				result.Output = messages[0].Content
+			default:
+				result.Output = prompt
+			}
+			return nil
+		}()
+		result.LatencyMS = time.Since(start).Milliseconds()
+		if err != nil {
+			return run, &pipelineStepError{step: step.Name, err: err}
+		}
+		outputs[step.Name] = result.Output
+		if result.Usage != nil {
+			run.Usage.PromptTokens += result.Usage.PromptTokens
+			run.Usage.CompletionTokens += result.Usage.CompletionTokens
+			run.Usage.TotalTokens += result.Usage.TotalTokens
+		}
+		if !result.Skipped {
+			data["Prev"] = result.Output
+			run.Output = result.Output
+		}
+		run.Steps = append(run.Steps, result)
+		emit(PipelineEvent{Type: "step_completed", Step: step.Name, Result: &result})
+	}
+
+	if p.Output != "" {
+		output, err := render("output")
+		if err != nil {
+			return run, fmt.Errorf("failed to render output: %w", err)
+		}
+		run.Output = output
+	}
+	return run, nil
+}
+
+// runModelStep sends a model step upstream. Model scopes, virtual models
+// and routing rules apply as for chat completions, and the tokens are
+// charged to key.
+func (s *ProxyServer) runModelStep(ctx context.Context, step PipelineStep, prompt, system string, key *ClientKey, tenant string, result *PipelineStepResult) error {
+	if key != nil && !key.AllowsModel(step.Model) {
+		return fmt.Errorf("%w: API key is not allowed to use model %s", errModelNotAllowed, step.Model)
+	}
+	req := ChatCompletionRequest{Model: step.Model, Temperature: step.Temperature, MaxTokens: step.MaxTokens}
+	if system != "" {
+		req.Messages = append(req.Messages, Message{Role: "system", Content: system})
+	}
+	req.Messages = append(req.Messages, Message{Role: "user", Content: prompt})
+	if err := s.expandModel(&req, tenant, "pipelines"); err != nil {
+		return err
+	}
+	result.Model = req.Model
+
+	event := newUsageEvent(key, "pipelines", req.Model)
+	resp, err := s.chatCompletion(ctx, req)
+	event.LatencyMS = time.Since(event.Time).Milliseconds()
+	if err != nil {
+		event.Status = http.StatusInternalServerError
+		s.recordUsage(event)
+		return fmt.Errorf("completion failed: %w", err)
+	}
+	s.recordCompletion(key, event, resp.Usage)
+	usage := resp.Usage
+	result.Usage = &usage
+	if len(resp.Choices) > 0 {
+		result.Output = resp.Choices[0].Message.Content
+	}
+	return nil
+}
+
+// handleRunPipeline runs a pipeline on the input of the request. With
+// "stream": true the steps are sent as server-sent events while they run.
+func (s *ProxyServer) handleRunPipeline(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key := clientKeyFromContext(r.Context())
+	var tenant string
+	if key != nil {
+		tenant = key.Tenant
+	}
+	p, ok := s.pipelines.Get(r.PathValue("name"))
+	if !ok || (p.Tenant != "" && p.Tenant != tenant) {
+		http.Error(w, "Unknown pipeline", http.StatusNotFound)
+		return
+	}
+
+	buf, err := readBody(r.Body, r.ContentLength)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+	defer putBuffer(buf)
+	var req PipelineRunRequest
+	if err := json.Unmarshal(buf.Bytes(), &req); err != nil {
+		http.Error(w, "Invalid JSON in request body", http.StatusBadRequest)
+		return
+	}
+
+	// Runs can be cancelled by request ID like chat completions
+	ctx, done := s.inflight.Start(r.Context(), timelineFromContext(r.Context()).id(), key)
+	defer done()
+	if !req.Stream {
+		run, err := s.runPipeline(ctx, p, req, key, func(PipelineEvent) {})
+		if err != nil {
+			log.Printf("Pipeline %s failed: %v", p.ID, err)
+			http.Error(w, fmt.Sprintf("Pipeline failed: %v", err), pipelineStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(run)
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	send := func(event PipelineEvent) {
+		data, _ := json.Marshal(event)
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+		rc.Flush()
+	}
+	run, err := s.runPipeline(ctx, p, req, key, send)
+	if err != nil {
+		log.Printf("Pipeline %s failed: %v", p.ID, err)
+		event := PipelineEvent{Type: "error", Error: err.Error()}
+		var stepErr *pipelineStepError
+		if errors.As(err, &stepErr) {
+			event.Step = stepErr.step
+		}
+		send(event)
+		return
+	}
+	send(PipelineEvent{Type: "done", Run: run})
+}
+
+func (s *ProxyServer) adminPipelineHandler() http.Handler {
+	return resourceHandler[Pipeline]{
+		lock: s.pipelines.lockWrites,
+		get: func(id string) (Pipeline, string, bool) {
+			p, ok := s.pipelines.Get(id)
+			return p, etagFor(p), ok
+		},
+		put: func(id string, p Pipeline, _ *Pipeline) (bool, error) {
+			if p.ID != "" && p.ID != id {
+				return false, fmt.Errorf("id in body does not match id in path")
+			}
+			p.ID = id
+			if _, err := p.parse(); err != nil {
+				return false, err
+			}
+			return s.pipelines.Put(id, p), nil
+		},
+		remove: s.pipelines.Delete,
+		view:   func(p Pipeline) any { return p },
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// pipelineClient answers chat completions with the reply for their model
+// and embeds like ragClient
+type pipelineClient struct {
+	*ragClient
+	replies  map[string]string
+	requests []ChatCompletionRequest
+}
+
+func (m *pipelineClient) CreateChatCompletion(req ChatCompletionRequest) (*ChatCompletionResponse, error) {
+	m.requests = append(m.requests, req)
+	resp := *createTestChatCompletionResponse()
+	resp.Choices = append([]Choice(nil), resp.Choices...)
+	resp.Choices[0].Message.Content = m.replies[req.Model]
+	return &resp, nil
+}
+
+func runPipelineAs(server *ProxyServer, key *ClientKey, name, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/v1/pipelines/"+name+"/run", strings.NewReader(body))
+	req.SetPathValue("name", name)
+	if key != nil {
+		req = req.WithContext(context.WithValue(req.Context(), clientKeyContextKey, key))
+	}
+	w := httptest.NewRecorder()
+	server.handleRunPipeline(w, req)
+	return w
+}
+
+// supportPipeline classifies the input, answers questions from the
+// knowledge base and redacts the answer
+const supportPipeline = `{"steps": [
+	{"name": "classify", "model": "classifier", "system": "Reply with question or chitchat.", "prompt": "{{.Input}}"},
+	{"name": "retrieve", "builtin": "retrieve", "if": "{{eq (trim (lower .Steps.classify)) \"question\"}}", "prompt": "{{.Input}}", "top_k": 1},
+	{"name": "answer", "model": "gpt-4o", "system": "Answer for {{.Vars.customer}} from these sources:\n{{.Steps.retrieve}}", "prompt": "{{.Input}}"},
+	{"name": "check", "builtin": "guardrail", "guardrails": "pii"}
+]}`
+
+func newPipelineServer(t *testing.T) (*ProxyServer, *pipelineClient) {
+	t.Helper()
+	server, rag := newRAGServer(t, "")
+	client := &pipelineClient{ragClient: rag, replies: map[string]string{
+		"classifier": " Question\n",
+		"gpt-4o":     "Within 14 days [1]. Write to help@example.com.",
+	}}
+	server.client = client
+	profile := GuardrailProfile{ID: "pii", RedactPII: true}
+	profile.compile()
+	server.guardrails.Put("pii", profile)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/pipelines/{id}", server.adminPipelineHandler().ServeHTTP)
+	if w := adminRequest(mux, http.MethodPut, "/admin/pipelines/support", supportPipeline, nil); w.Code != http.StatusCreated {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	return server, client
+}
+
+func TestProxyServer_RunPipeline(t *testing.T) {
+	server, client := newPipelineServer(t)
+
+	w := runPipelineAs(server, nil, "support", `{"input": "How long does a refund take?", "variables": {"customer": "Ann"}}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var run PipelineRun
+	json.Unmarshal(w.Body.Bytes(), &run)
+	if len(run.Steps) != 4 || run.Steps[1].Skipped || run.Steps[1].Type != PipelineRetrieve || run.Steps[0].Type != "model" {
+		t.Fatalf("Expected all four steps to run, got %+v", run.Steps)
+	}
+	if len(run.Citations) != 1 || run.Citations[0].Document != "refunds" {
+		t.Errorf("Expected the refund policy as citation, got %+v", run.Citations)
+	}
+	system := client.requests[1].Messages[0].Content
+	if !strings.Contains(system, "Answer for Ann") || !strings.Contains(system, "[1] Refund policy\nRefunds are paid within 14 days.") {
+		t.Errorf("Expected the sources and variables in the answer's system prompt, got %q", system)
+	}
+	if run.Output != "Within 14 days [1]. Write to [EMAIL]." {
+		t.Errorf("Expected the redacted answer as output, got %q", run.Output)
+	}
+	if run.Usage.TotalTokens != 64 || run.Steps[2].Usage == nil {
+		t.Errorf("Expected the usage of both model steps, got %+v", run.Usage)
+	}
+}
+
+func TestProxyServer_RunPipelineSkipsSteps(t *testing.T) {
+	server, client := newPipelineServer(t)
+	client.replies["classifier"] = "chitchat"
+
+	w := runPipelineAs(server, nil, "support", `{"input": "Hi there", "variables": {"customer": "Ann"}}`)
+	var run PipelineRun
+	json.Unmarshal(w.Body.Bytes(), &run)
+	if len(run.Steps) != 4 || !run.Steps[1].Skipped || len(run.Citations) != 0 {
+		t.Fatalf("Expected retrieval to be skipped, got %+v", run.Steps)
+	}
+	if system := client.requests[1].Messages[0].Content; strings.Contains(system, "[1]") {
+		t.Errorf("Expected no sources in the system prompt, got %q", system)
+	}
+}
+
+func TestProxyServer_RunPipelineStream(t *testing.T) {
+	server, _ := newPipelineServer(t)
+
+	w := runPipelineAs(server, nil, "support", `{"input": "How long does a refund take?", "variables": {"customer": "Ann"}, "stream": true}`)
+	if ct := w.Header().Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Expected an event stream, got %s", ct)
+	}
+	var events []PipelineEvent
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+			var event PipelineEvent
+			json.Unmarshal([]byte(data), &event)
+			events = append(events, event)
+		}
+	}
+	if len(events) != 9 {
+		t.Fatalf("Expected a start and completion per step and done, got %d events", len(events))
+	}
+	if events[0].Type != "step_started" || events[1].Type != "step_completed" || events[1].Result.Output != " Question\n" {
+		t.Errorf("Expected the classification to be streamed, got %+v", events[:2])
+	}
+	if last := events[8]; last.Type != "done" || last.Run == nil || last.Run.Output != "Within 14 days [1]. Write to [EMAIL]." {
+		t.Errorf("Expected done with the run, got %+v", last)
+	}
+}
+
+func TestProxyServer_RunPipelineErrors(t *testing.T) {
+	server, _ := newPipelineServer(t)
+
+	// A missing variable fails the step that uses it
+	w := runPipelineAs(server, nil, "support", `{"input": "How long does a refund take?", "stream": true}`)
+	if !strings.Contains(w.Body.String(), "event: error\ndata: {\"type\":\"error\",\"step\":\"answer\"") {
+		t.Errorf("Expected an error event for the answer step, got %s", w.Body.String())
+	}
+
+	block := GuardrailProfile{ID: "pii", BlockPatterns: []string{`help@`}}
+	block.compile()
+	server.guardrails.Put("pii", block)
+	w = runPipelineAs(server, nil, "support", `{"input": "How long does a refund take?", "variables": {"customer": "Ann"}}`)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "step check") {
+		t.Errorf("Expected a blocked answer to be a bad request, got %d: %s", w.Code, w.Body.String())
+	}
+
+	server.pipelines.Put("acme", Pipeline{ID: "acme", Tenant: "acme", Steps: []PipelineStep{{Name: "echo", Builtin: PipelineTemplate}}})
+	if w := runPipelineAs(server, &ClientKey{ID: "globex-app", Tenant: "globex"}, "acme", `{"input": "x"}`); w.Code != http.StatusNotFound {
+		t.Errorf("Expected another tenant's pipeline to be unknown, got %d", w.Code)
+	}
+	if w := runPipelineAs(server, &ClientKey{ID: "acme-app", Tenant: "acme"}, "acme", `{"input": "x"}`); !strings.Contains(w.Body.String(), `"output":"x"`) {
+		t.Errorf("Expected the tenant's pipeline to run, got %s", w.Body.String())
+	}
+}
+
+func TestProxyServer_RunPipelineModelScopes(t *testing.T) {
+	server, client := newPipelineServer(t)
+
+	key := &ClientKey{ID: "mini", Scopes: KeyScopes{Models: []string{"gpt-4o"}}}
+	w := runPipelineAs(server, key, "support", `{"input": "How long does a refund take?", "variables": {"customer": "Ann"}}`)
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "classifier") || len(client.requests) != 0 {
+		t.Errorf("Expected the classifier step to be refused, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// A cancelled run stops before its next step
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p, _ := server.pipelines.Get("support")
+	if _, err := server.runPipeline(ctx, p, PipelineRunRequest{Input: "Hi"}, nil, func(PipelineEvent) {}); err == nil || len(client.requests) != 0 {
+		t.Errorf("Expected the cancelled run to stop, got %v", err)
+	}
+}
+
+func TestPipeline_Parse(t *testing.T) {
+	for name, p := range map[string]Pipeline{
+		"no steps":          {},
+		"unnamed step":      {Steps: []PipelineStep{{Builtin: PipelineTemplate}}},
+		"duplicate name":    {Steps: []PipelineStep{{Name: "a", Builtin: PipelineTemplate}, {Name: "a", Builtin: PipelineTemplate}}},
+		"model and builtin": {Steps: []PipelineStep{{Name: "a", Model: "gpt-4o", Builtin: PipelineTemplate}}},
+		"unknown builtin":   {Steps: []PipelineStep{{Name: "a", Builtin: "translate"}}},
+		"no profile":        {Steps: []PipelineStep{{Name: "a", Builtin: PipelineGuardrail}}},
+		"bad template":      {Steps: []PipelineStep{{Name: "a", Builtin: PipelineTemplate, Prompt: "{{.Input"}}},
+	} {
+		if _, err := p.parse(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
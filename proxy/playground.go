@@ -0,0 +1,28 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed playground
+var playgroundFiles embed.FS
+
+// playgroundHandler serves the embedded playground page under /playground/.
+// The page itself is public; the chat requests it makes carry the proxy key
+// typed in by the developer and are authenticated like any other client.
+func playgroundHandler() http.Handler {
+	files, _ := fs.Sub(playgroundFiles, "playground")
+	fileServer := http.StripPrefix("/playground/", http.FileServerFS(files))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/playground" {
+			http.Redirect(w, r, "/playground/", http.StatusMovedPermanently)
+			return
+		}
+		w.Header().Set("Content-Security-Policy", "default-src 'self'; frame-ancestors 'none'")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Referrer-Policy", "no-referrer")
+		fileServer.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,182 @@
+"use strict";
+
+// Approximate list prices in USD per million tokens, for estimates only
+const PRICES = {
+  "gpt-4o-mini": [0.15, 0.6],
+  "gpt-4o": [2.5, 10],
+  "gpt-4.1-mini": [0.4, 1.6],
+  "gpt-4.1": [2, 8],
+  "o3-mini": [1.1, 4.4],
+  "gpt-3.5-turbo": [0.5, 1.5],
+};
+
+const $ = (id) => document.getElementById(id);
+const messages = [];
+
+// The key stays in this tab only
+$("key").value = sessionStorage.getItem("proxyKey") || "";
+$("key").addEventListener("change", () => sessionStorage.setItem("proxyKey", $("key").value));
+
+// estimateTokens uses the usual rule of thumb of four characters a token
+function estimateTokens(text) {
+  return Math.ceil(text.length / 4);
+}
+
+function price(model) {
+  const known = Object.keys(PRICES).sort((a, b) => b.length - a.length).find((m) => model.startsWith(m));
+  return known ? PRICES[known] : null;
+}
+
+function formatCost(model, prompt, completion) {
+  const p = price(model);
+  if (!p) {
+    return "";
+  }
+  const usd = (prompt * p[0] + completion * p[1]) / 1e6;
+  return ` · ~$${usd < 0.01 ? usd.toFixed(5) : usd.toFixed(3)}`;
+}
+
+function requestMessages() {
+  const system = $("system").value.trim();
+  return system ? [{ role: "system", content: system }, ...messages] : [...messages];
+}
+
+function updateEstimate() {
+  const pending = $("input").value;
+  const prompt = requestMessages().concat([{ content: pending }]).reduce((n, m) => n + estimateTokens(m.content) + 4, 0);
+  $("estimate").textContent = pending ? `~${prompt} prompt tokens${formatCost($("model").value, prompt, 0)}` : "";
+}
+
+function addEntry(role, text) {
+  const li = document.createElement("li");
+  li.className = role;
+  li.textContent = text;
+  $("transcript").appendChild(li);
+  li.scrollIntoView({ block: "end" });
+  return li;
+}
+
+function addMeta(li, text) {
+  const meta = document.createElement("span");
+  meta.className = "meta";
+  meta.textContent = text;
+  li.appendChild(meta);
+}
+
+// readStream reads server-sent events, appending each content delta to li,
+// and returns the full text and the usage if the server reported it
+async function readStream(resp, li) {
+  const reader = resp.body.getReader();
+  const decoder = new TextDecoder();
+  let buffered = "";
+  let text = "";
+  let usage = null;
+  for (;;) {
+    const { value, done } = await reader.read();
+    if (done) {
+      break;
+    }
+    buffered += decoder.decode(value, { stream: true });
+    const events = buffered.split("\n\n");
+    buffered = events.pop();
+    for (const event of events) {
+      for (const line of event.split("\n")) {
+        const data = line.startsWith("data:") ? line.slice(5).trim() : "";
+        if (!data || data === "[DONE]") {
+          continue;
+        }
+        const chunk = JSON.parse(data);
+        const delta = chunk.choices && chunk.choices[0] && chunk.choices[0].delta;
+        if (delta && delta.content) {
+          text += delta.content;
+          li.textContent = text;
+        }
+        if (chunk.usage) {
+          usage = chunk.usage;
+        }
+      }
+    }
+  }
+  return { text, usage };
+}
+
+async function send(event) {
+  event.preventDefault();
+  const content = $("input").value.trim();
+  if (!content) {
+    return;
+  }
+  const model = $("model").value.trim();
+  messages.push({ role: "user", content });
+  addEntry("user", content);
+  $("input").value = "";
+  updateEstimate();
+
+  const body = { model, messages: requestMessages() };
+  const temperature = $("temperature").value;
+  if (temperature !== "") {
+    body.temperature = Number(temperature);
+  }
+  const stream = $("stream").checked;
+  if (stream) {
+    body.stream = true;
+    body.stream_options = { include_usage: true };
+  }
+
+  const headers = { "Content-Type": "application/json" };
+  if ($("key").value) {
+    headers.Authorization = `Bearer ${$("key").value}`;
+  }
+
+  $("send").disabled = true;
+  $("status").textContent = "Waiting for the model…";
+  const started = performance.now();
+  const li = addEntry("assistant", "");
+  try {
+    const resp = await fetch("../v1/chat/completions", { method: "POST", headers, body: JSON.stringify(body) });
+    if (!resp.ok) {
+      throw new Error(`${resp.status} ${(await resp.text()).trim()}`);
+    }
+    let text;
+    let usage;
+    if ((resp.headers.get("Content-Type") || "").startsWith("text/event-stream")) {
+      ({ text, usage } = await readStream(resp, li));
+    } else {
+      const data = await resp.json();
+      text = data.choices && data.choices[0] ? data.choices[0].message.content : "";
+      usage = data.usage;
+      li.textContent = text;
+    }
+    messages.push({ role: "assistant", content: text });
+
+    const seconds = ((performance.now() - started) / 1000).toFixed(1);
+    if (usage) {
+      addMeta(li, `${usage.prompt_tokens} prompt + ${usage.completion_tokens} completion tokens${formatCost(model, usage.prompt_tokens, usage.completion_tokens)} · ${seconds}s`);
+    } else {
+      addMeta(li, `${seconds}s`);
+    }
+  } catch (err) {
+    // Keep the transcript sendable by dropping the unanswered message
+    messages.pop();
+    li.className = "error";
+    li.textContent = err.message;
+  } finally {
+    $("send").disabled = false;
+    $("status").textContent = "";
+  }
+}
+
+$("composer").addEventListener("submit", send);
+$("input").addEventListener("input", updateEstimate);
+$("model").addEventListener("input", updateEstimate);
+$("system").addEventListener("input", updateEstimate);
+$("input").addEventListener("keydown", (event) => {
+  if (event.key === "Enter" && (event.ctrlKey || event.metaKey)) {
+    $("composer").requestSubmit();
+  }
+});
+$("clear").addEventListener("click", () => {
+  messages.length = 0;
+  $("transcript").replaceChildren();
+  updateEstimate();
+});
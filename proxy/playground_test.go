@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPlaygroundHandler(t *testing.T) {
+	handler := playgroundHandler()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/playground", nil))
+	if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != "/playground/" {
+		t.Errorf("Expected a redirect to /playground/, got %d %s", w.Code, w.Header().Get("Location"))
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/playground/", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `<script src="playground.js">`) {
+		t.Fatalf("Expected the playground page, got %d", w.Code)
+	}
+	if csp := w.Header().Get("Content-Security-Policy"); !strings.Contains(csp, "default-src 'self'") {
+		t.Errorf("Expected a restrictive CSP, got %q", csp)
+	}
+
+	for _, asset := range []string{"/playground/playground.js", "/playground/playground.css"} {
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", asset, nil))
+		if w.Code != http.StatusOK || w.Body.Len() == 0 {
+			t.Errorf("Expected %s to be served, got %d", asset, w.Code)
+		}
+	}
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// pgTimeout bounds connecting and each query
+const pgTimeout = 30 * time.Second
+
+// pgConn is a minimal PostgreSQL client speaking the simple query protocol,
+// so reading a table doesn't pull in a driver. It authenticates with
+// trust, password, md5 or SCRAM-SHA-256 and returns every value as text.
+type pgConn struct {
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+// pgError is an error reported by the server
+type pgError struct {
+	Code    string
+	Message string
+}
+
+func (e *pgError) Error() string { return fmt.Sprintf("postgres: %s (%s)", e.Message, e.Code) }
+
+// pgConnect opens a connection for a postgres:// URL. sslmode is disable,
+// prefer (the default), require, which does not verify the certificate as
+// with libpq, or verify-full.
+func pgConnect(ctx context.Context, dsn, password string) (*pgConn, error) {
+	u, err := url.Parse(dsn)
+	if err != nil || (u.Scheme != "postgres" && u.Scheme != "postgresql") {
+		return nil, fmt.Errorf("invalid postgres URL")
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "5432")
+	}
+	user := u.User.Username()
+	if p, ok := u.User.Password(); ok && password == "" {
+		password = p
+	}
+	database := strings.TrimPrefix(u.Path, "/")
+	if database == "" {
+		database = user
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(pgTimeout))
+
+	c := &pgConn{conn: conn, rd: bufio.NewReader(conn)}
+	if err := c.startTLS(u.Query().Get("sslmode"), u.Hostname()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := c.startup(user, password, database); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *pgConn) Close() error {
+	c.send('X', nil)
+	return c.conn.Close()
+}
+
+func (c *pgConn) startTLS(mode, serverName string) error {
+	if mode == "disable" {
+		return nil
+	}
+	config := &tls.Config{ServerName: serverName}
+	switch mode {
+	case "", "prefer", "require":
+		config.InsecureSkipVerify = true
+	case "verify-full":
+	default:
+		return fmt.Errorf("unsupported sslmode %q", mode)
+	}
+	var request [8]byte
+	binary.BigEndian.PutUint32(request[0:], 8)
+	binary.BigEndian.PutUint32(request[4:], 80877103)
+	if _, err := c.conn.Write(request[:]); err != nil {
+		return err
+	}
+	answer, err := c.rd.ReadByte()
+	if err != nil {
+		return err
+	}
+	if answer != 'S' {
+		if mode == "" || mode == "prefer" {
+			return nil
+		}
+		return fmt.Errorf("postgres: server does not support TLS")
+	}
+	tlsConn := tls.Client(c.conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+	c.conn, c.rd = tlsConn, bufio.NewReader(tlsConn)
+	return nil
+}
+
+// send writes one message; a zero typ is the untyped startup message
+func (c *pgConn) send(typ byte, payload []byte) error {
+	msg := make([]byte, 0, 5+len(payload))
+	if typ != 0 {
+		msg = append(msg, typ)
+	}
+	msg = binary.BigEndian.AppendUint32(msg, uint32(4+len(payload)))
+	msg = append(msg, payload...)
+	_, err := c.conn.Write(msg)
+	return err
+}
+
+func (c *pgConn) receive() (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(c.rd, header[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(header[1:])
+	if n < 4 || n > 1<<30 {
+		return 0, nil, fmt.Errorf("postgres: malformed message")
+	}
+	payload := make([]byte, n-4)
+	if _, err := io.ReadFull(c.rd, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[0], payload, nil
+}
+
+// parsePGError reads the fields of an ErrorResponse
+func parsePGError(payload []byte) *pgError {
+	e := &pgError{}
+	for len(payload) > 1 {
+		field := payload[0]
+		value, rest, _ := strings.Cut(string(payload[1:]), "\x00")
+		payload = []byte(rest)
+		switch field {
+		case 'C':
+			e.Code = value
+		case 'M':
+			e.Message = value
+		}
+	}
+	return e
+}
+
+func pgString(s string) []byte { return append([]byte(s), 0) }
+
+func (c *pgConn) startup(user, password, database string) error {
+	var params []byte
+	params = binary.BigEndian.AppendUint32(params, 196608)
+	for _, kv := range [][2]string{{"user", user}, {"database", database}, {"client_encoding", "UTF8"}} {
+		params = append(params, pgString(kv[0])...)
+		params = append(params, pgString(kv[1])...)
+	}
+	params = append(params, 0)
+	if err := c.send(0, params); err != nil {
+		return err
+	}
+
+	var scram *scramClient
+	for {
+		typ, payload, err := c.receive()
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case 'E':
+			return parsePGError(payload)
+		case 'Z':
+			return nil
+		case 'R':
+			if len(payload) < 4 {
+				return fmt.Errorf("postgres: malformed authentication request")
+			}
+			code, data := binary.BigEndian.Uint32(payload), payload[4:]
+			switch code {
+			case 0:
+			case 3:
+				err = c.send('p', pgString(password))
+			case 5:
+				inner := md5.Sum([]byte(password + user))
+				outer := md5.Sum(append([]byte(hex.EncodeToString(inner[:])), data...))
+				err = c.send('p', pgString("md5"+hex.EncodeToString(outer[:])))
+			case 10:
+				if !strings.Contains(string(data), "SCRAM-SHA-256\x00") {
+					return fmt.Errorf("postgres: no supported SASL mechanism")
+				}
+				scram = newSCRAMClient(password)
+				first := scram.first()
+				msg := append(pgString("SCRAM-SHA-256"), binary.BigEndian.AppendUint32(nil, uint32(len(first)))...)
+				err = c.send('p', append(msg, first...))
+			case 11:
+				if scram == nil {
+					return fmt.Errorf("postgres: unexpected SASL challenge")
+				}
+				var final string
+				if final, err = scram.final(string(data)); err == nil {
+					err = c.send('p', []byte(final))
+				}
+			case 12:
+				if scram == nil || !scram.verify(string(data)) {
+					return fmt.Errorf("postgres: server signature does not match")
+				}
+			default:
+				return fmt.Errorf("postgres: unsupported authentication method %d", code)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Query runs one statement and returns its column names and rows. NULL is
+// returned as the empty string.
+func (c *pgConn) Query(query string) ([]string, [][]string, error) {
+	c.conn.SetDeadline(time.Now().Add(pgTimeout))
+	if err := c.send('Q', pgString(query)); err != nil {
+		return nil, nil, err
+	}
+	var columns []string
+	var rows [][]string
+	var queryErr error
+	for {
+		typ, payload, err := c.receive()
+		if err != nil {
+			return nil, nil, err
+		}
+		switch typ {
+		case 'T':
+			if len(payload) < 2 {
+				return nil, nil, fmt.Errorf("postgres: malformed row description")
+			}
+			n := int(binary.BigEndian.Uint16(payload))
+			rest := payload[2:]
+			columns = make([]string, 0, n)
+			for range n {
+				name, after, ok := strings.Cut(string(rest), "\x00")
+				if !ok || len(after) < 18 {
+					return nil, nil, fmt.Errorf("postgres: malformed row description")
+				}
+				columns = append(columns, name)
+				rest = []byte(after[18:])
+			}
+		case 'D':
+			row, err := parseDataRow(payload)
+			if err != nil {
+				return nil, nil, err
+			}
+			rows = append(rows, row)
+		case 'E':
+			queryErr = parsePGError(payload)
+		case 'Z':
+			return columns, rows, queryErr
+		}
+	}
+}
+
+func parseDataRow(payload []byte) ([]string, error) {
+	if len(payload) < 2 {
+		return nil, fmt.Errorf("postgres: malformed data row")
+	}
+	n := int(binary.BigEndian.Uint16(payload))
+	rest := payload[2:]
+	row := make([]string, n)
+	for i := range row {
+		if len(rest) < 4 {
+			return nil, fmt.Errorf("postgres: malformed data row")
+		}
+		size := int32(binary.BigEndian.Uint32(rest))
+		rest = rest[4:]
+		if size < 0 {
+			continue
+		}
+		if int(size) > len(rest) {
+			return nil, fmt.Errorf("postgres: malformed data row")
+		}
+		row[i], rest = string(rest[:size]), rest[size:]
+	}
+	return row, nil
+}
+
+// pgIdentifier quotes a possibly schema-qualified name
+func pgIdentifier(name string) string {
+	parts := strings.Split(name, ".")
+	for i, part := range parts {
+		parts[i] = `"` + strings.ReplaceAll(part, `"`, `""`) + `"`
+	}
+	return strings.Join(parts, ".")
+}
+
+// pgLiteral quotes a string, assuming standard_conforming_strings, the
+// default since PostgreSQL 9.1
+func pgLiteral(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
+
+// scramClient runs the client side of a SCRAM-SHA-256 exchange (RFC 7677)
+type scramClient struct {
+	password    string
+	nonce       string
+	firstBare   string
+	authMessage string
+	salted      []byte
+}
+
+func newSCRAMClient(password string) *scramClient {
+	nonce := make([]byte, 18)
+	rand.Read(nonce)
+	return &scramClient{password: password, nonce: base64.RawStdEncoding.EncodeToString(nonce)}
+}
+
+func (sc *scramClient) first() string {
+	// The user name is taken from the startup message, so it is left empty
+	sc.firstBare = "n=,r=" + sc.nonce
+	return "n,," + sc.firstBare
+}
+
+func (sc *scramClient) final(serverFirst string) (string, error) {
+	var nonce, salt string
+	var iterations int
+	for _, attr := range strings.Split(serverFirst, ",") {
+		key, value, _ := strings.Cut(attr, "=")
+		switch key {
+		case "r":
+			nonce = value
+		case "s":
+			salt = value
+		case "i":
+			fmt.Sscan(value, &iterations)
+		}
+	}
+	saltBytes, err := base64.StdEncoding.DecodeString(salt)
+	if err != nil || !strings.HasPrefix(nonce, sc.nonce) || iterations <= 0 {
+		return "", fmt.Errorf("postgres: invalid SCRAM challenge")
+	}
+	sc.salted, err = pbkdf2.Key(sha256.New, sc.password, saltBytes, iterations, sha256.Size)
+	if err != nil {
+		return "", err
+	}
+	withoutProof := "c=biws,r=" + nonce
+	sc.authMessage = sc.firstBare + "," + serverFirst + "," + withoutProof
+	clientKey := hmacSHA256(sc.salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	proof := hmacSHA256(storedKey[:], sc.authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	return withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof), nil
+}
+
+// verify checks the server signature, proving the server knows the password
+func (sc *scramClient) verify(serverFinal string) bool {
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(serverFinal, "v="))
+	if err != nil || sc.salted == nil {
+		return false
+	}
+	return hmac.Equal(signature, hmacSHA256(hmacSHA256(sc.salted, "Server Key"), sc.authMessage))
+}
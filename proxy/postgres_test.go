@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakePostgres implements just enough of the PostgreSQL protocol for the
+// connector's queries against one table, asking for a cleartext password
+type fakePostgres struct {
+	ln       net.Listener
+	password string
+
+	mu      sync.Mutex
+	rows    map[string][]string // id -> version, title, content
+	queries []string
+}
+
+func startFakePostgres(t *testing.T, password string) *fakePostgres {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	pg := &fakePostgres{ln: ln, password: password, rows: map[string][]string{}}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go pg.serve(conn)
+		}
+	}()
+	return pg
+}
+
+func (pg *fakePostgres) url() string {
+	return "postgres://reader@" + pg.ln.Addr().String() + "/docs"
+}
+
+func (pg *fakePostgres) set(id string, values ...string) {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+	if values == nil {
+		delete(pg.rows, id)
+		return
+	}
+	pg.rows[id] = values
+}
+
+func writePG(w io.Writer, typ byte, payload []byte) {
+	msg := append([]byte{typ}, binary.BigEndian.AppendUint32(nil, uint32(4+len(payload)))...)
+	w.Write(append(msg, payload...))
+}
+
+func pgRowDescription(columns ...string) []byte {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(len(columns)))
+	for _, c := range columns {
+		payload = append(payload, pgString(c)...)
+		payload = append(payload, make([]byte, 18)...)
+	}
+	return payload
+}
+
+func pgDataRow(values ...*string) []byte {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(len(values)))
+	for _, v := range values {
+		if v == nil {
+			payload = binary.BigEndian.AppendUint32(payload, 0xFFFFFFFF)
+			continue
+		}
+		payload = binary.BigEndian.AppendUint32(payload, uint32(len(*v)))
+		payload = append(payload, *v...)
+	}
+	return payload
+}
+
+var fetchWhere = regexp.MustCompile(`= '((?:[^']|'')*)'$`)
+
+func (pg *fakePostgres) serve(conn net.Conn) {
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	readUntyped := func() []byte {
+		var n uint32
+		if binary.Read(rd, binary.BigEndian, &n) != nil || n < 4 {
+			return nil
+		}
+		payload := make([]byte, n-4)
+		io.ReadFull(rd, payload)
+		return payload
+	}
+	startup := readUntyped()
+	if len(startup) >= 4 && binary.BigEndian.Uint32(startup) == 80877103 {
+		conn.Write([]byte{'N'})
+		startup = readUntyped()
+	}
+	if startup == nil {
+		return
+	}
+	writePG(conn, 'R', binary.BigEndian.AppendUint32(nil, 3))
+	if typ, _ := rd.ReadByte(); typ != 'p' {
+		return
+	}
+	if password := strings.TrimSuffix(string(readUntyped()), "\x00"); password != pg.password {
+		writePG(conn, 'E', []byte("SFATAL\x00C28P01\x00Mpassword authentication failed\x00\x00"))
+		return
+	}
+	writePG(conn, 'R', binary.BigEndian.AppendUint32(nil, 0))
+	writePG(conn, 'S', append(pgString("server_version"), pgString("16.0")...))
+	writePG(conn, 'Z', []byte{'I'})
+
+	for {
+		typ, err := rd.ReadByte()
+		if err != nil || typ == 'X' {
+			return
+		}
+		query := strings.TrimSuffix(string(readUntyped()), "\x00")
+		pg.mu.Lock()
+		pg.queries = append(pg.queries, query)
+		switch {
+		case strings.Contains(query, "missing_table"):
+			writePG(conn, 'E', []byte("SERROR\x00C42P01\x00Mrelation does not exist\x00\x00"))
+		case strings.Contains(query, " WHERE "+`"id"::text`):
+			id := strings.ReplaceAll(fetchWhere.FindStringSubmatch(query)[1], "''", "'")
+			writePG(conn, 'T', pgRowDescription("content"))
+			if row, ok := pg.rows[id]; ok {
+				writePG(conn, 'D', pgDataRow(&row[2]))
+			}
+			writePG(conn, 'C', pgString("SELECT 1"))
+		default:
+			writePG(conn, 'T', pgRowDescription("id", "updated_at", "title"))
+			ids := make([]string, 0, len(pg.rows))
+			for id := range pg.rows {
+				ids = append(ids, id)
+			}
+			sort.Strings(ids)
+			for _, id := range ids {
+				row := pg.rows[id]
+				var title *string
+				if row[1] != "" {
+					title = &row[1]
+				}
+				writePG(conn, 'D', pgDataRow(&id, &row[0], title))
+			}
+			writePG(conn, 'C', pgString("SELECT"))
+		}
+		pg.mu.Unlock()
+		writePG(conn, 'Z', []byte{'I'})
+	}
+}
+
+func TestPGConn_Query(t *testing.T) {
+	pg := startFakePostgres(t, "s3cret")
+	pg.set("1", "v1", "", "Hello")
+
+	if _, err := pgConnect(context.Background(), pg.url(), "wrong"); err == nil || !strings.Contains(err.Error(), "password authentication failed") {
+		t.Errorf("Expected the authentication error, got %v", err)
+	}
+
+	conn, err := pgConnect(context.Background(), pg.url(), "s3cret")
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	columns, rows, err := conn.Query("SELECT id, updated_at, title FROM docs")
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	if strings.Join(columns, ",") != "id,updated_at,title" {
+		t.Errorf("Expected the column names, got %v", columns)
+	}
+	if len(rows) != 1 || rows[0][0] != "1" || rows[0][1] != "v1" || rows[0][2] != "" {
+		t.Errorf("Expected one row with a NULL title, got %q", rows)
+	}
+
+	// An error ends the query but not the connection
+	if _, _, err := conn.Query("SELECT * FROM missing_table"); err == nil || !strings.Contains(err.Error(), "42P01") {
+		t.Errorf("Expected the server error, got %v", err)
+	}
+	if _, rows, err := conn.Query("SELECT id FROM docs"); err != nil || len(rows) != 1 {
+		t.Errorf("Expected the connection to stay usable, got %v", err)
+	}
+}
+
+func TestPGConnect_InvalidURL(t *testing.T) {
+	for _, dsn := range []string{"mysql://localhost/db", "postgres://localhost/db?sslmode=allow"} {
+		if _, err := pgConnect(context.Background(), dsn, ""); err == nil {
+			t.Errorf("Expected an error for %s", dsn)
+		}
+	}
+}
+
+func TestPGQuoting(t *testing.T) {
+	if got := pgIdentifier(`public.my "docs"`); got != `"public"."my ""docs"""` {
+		t.Errorf("Expected a quoted identifier, got %s", got)
+	}
+	if got := pgLiteral("it's"); got != "'it''s'" {
+		t.Errorf("Expected a quoted literal, got %s", got)
+	}
+}
+
+// The exchange of RFC 7677, section 3
+func TestSCRAMClient(t *testing.T) {
+	sc := &scramClient{password: "pencil", nonce: "rOprNGfwEbeRWgbNEkqO"}
+	sc.first()
+	sc.firstBare = "n=user,r=" + sc.nonce
+	final, err := sc.final("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if want := "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="; final != want {
+		t.Errorf("Expected %s, got %s", want, final)
+	}
+	if !sc.verify("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=") {
+		t.Errorf("Expected the server signature to verify")
+	}
+	if sc.verify("v=AAAA") {
+		t.Errorf("Expected a wrong server signature to fail")
+	}
+	if _, err := sc.final("r=someoneelse,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"); err == nil {
+		t.Errorf("Expected an error for a nonce not extending the client's")
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Post-processors are named transformations of the reply a request can ask
+// for in its post_process extension, run in order by the proxy so clients
+// don't each implement them. Those taking an argument are written as
+// "name:arg", e.g. "max_sentences:2".
+const (
+	PostStripFences   = "strip_fences"
+	PostExtractJSON   = "extract_json"
+	PostMaxSentences  = "max_sentences"
+	PostLowercaseKeys = "lowercase_keys"
+)
+
+// postProcessor transforms the content of a reply
+type postProcessor struct {
+	name  string
+	apply func(content string) (string, error)
+}
+
+// parsePostProcessors checks the post-processors of a request
+func parsePostProcessors(names []string) ([]postProcessor, error) {
+	processors := make([]postProcessor, 0, len(names))
+	for _, spec := range names {
+		name, arg, hasArg := strings.Cut(spec, ":")
+		p := postProcessor{name: spec}
+		switch name {
+		case PostStripFences:
+			p.apply = func(content string) (string, error) { return stripCodeFence(content), nil }
+		case PostExtractJSON:
+			p.apply = extractJSONObject
+		case PostLowercaseKeys:
+			p.apply = func(content string) (string, error) {
+				out, err := lowercaseKeys([]byte(content))
+				return string(out), err
+			}
+		case PostMaxSentences:
+			n, err := strconv.Atoi(arg)
+			if !hasArg || err != nil || n < 1 {
+				return nil, fmt.Errorf("post-processor %s needs a positive count, e.g. %s:3", name, name)
+			}
+			p.apply = func(content string) (string, error) { return firstSentences(content, n), nil }
+		default:
+			return nil, fmt.Errorf("unknown post-processor %q", spec)
+		}
+		if hasArg && name != PostMaxSentences {
+			return nil, fmt.Errorf("post-processor %s takes no argument", name)
+		}
+		processors = append(processors, p)
+	}
+	return processors, nil
+}
+
+// postProcess runs the processors over the content of every choice. A
+// processor that fails leaves the content as it was, and the error is
+// reported in the metadata.
+func postProcess(resp *ChatCompletionResponse, processors []postProcessor) *ChatCompletionResponse {
+	if len(processors) == 0 {
+		return resp
+	}
+	out := *resp
+	out.Choices = append([]Choice(nil), resp.Choices...)
+	var errs []string
+	for i := range out.Choices {
+		// Replies with only tool calls have nothing to process
+		if out.Choices[i].Message.Content == "" {
+			continue
+		}
+		for _, p := range processors {
+			content, err := p.apply(out.Choices[i].Message.Content)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("choice %d: %s: %v", i, p.name, err))
+				continue
+			}
+			out.Choices[i].Message.Content = content
+		}
+	}
+	if len(errs) > 0 {
+		out.Metadata = withMetadata(out.Metadata)
+		out.Metadata.PostProcessErrors = errs
+	}
+	return &out
+}
+
+// extractJSONObject returns the first JSON object in content, e.g. out of
+// prose around it
+func extractJSONObject(content string) (string, error) {
+	data := []byte(content)
+	for i := bytes.IndexByte(data, '{'); i >= 0; {
+		if end, err := skipValue(data, i); err == nil && json.Valid(data[i:end]) {
+			return content[i:end], nil
+		}
+		next := bytes.IndexByte(data[i+1:], '{')
+		if next < 0 {
+			break
+		}
+		i += 1 + next
+	}
+	return "", fmt.Errorf("no JSON object found")
+}
+
+// sentenceEnd matches the end of a sentence and the space after it.
+// Abbreviations like "e.g." end a sentence too.
+var sentenceEnd = regexp.MustCompile(`[.!?]+["'”’)\]]*(\s+|$)`)
+
+// firstSentences trims content to its first n sentences
+func firstSentences(content string, n int) string {
+	content = strings.TrimSpace(content)
+	ends := sentenceEnd.FindAllStringSubmatchIndex(content, n)
+	if len(ends) < n {
+		return content
+	}
+	// Keep the punctuation, drop the space after it
+	return content[:ends[n-1][2]]
+}
+
+// lowercaseKeys returns the JSON value in data with the keys of all its
+// objects in lower case, keeping their order and the values as they are
+func lowercaseKeys(data []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(bytes.TrimSpace(data)))
+	dec.UseNumber()
+	var out bytes.Buffer
+	if err := copyLowercased(dec, &out); err != nil {
+		return nil, fmt.Errorf("the reply is not valid JSON: %v", err)
+	}
+	if _, err := dec.Token(); err == nil {
+		return nil, fmt.Errorf("the reply is more than one JSON value")
+	}
+	return out.Bytes(), nil
+}
+
+func copyLowercased(dec *json.Decoder, out *bytes.Buffer) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	delim, ok := tok.(json.Delim)
+	if !ok {
+		value, err := json.Marshal(tok)
+		out.Write(value)
+		return err
+	}
+	seen := make(map[string]bool)
+	out.WriteRune(rune(delim))
+	for i := 0; dec.More(); i++ {
+		if i > 0 {
+			out.WriteByte(',')
+		}
+		if delim == '{' {
+			tok, err := dec.Token()
+			if err != nil {
+				return err
+			}
+			key := strings.ToLower(tok.(string))
+			if seen[key] {
+				return fmt.Errorf("keys collide as %q", key)
+			}
+			seen[key] = true
+			name, _ := json.Marshal(key)
+			out.Write(name)
+			out.WriteByte(':')
+		}
+		if err := copyLowercased(dec, out); err != nil {
+			return err
+		}
+	}
+	// The closing delimiter
+	end, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	out.WriteRune(rune(end.(json.Delim)))
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestProxyServer_PostProcess(t *testing.T) {
+	client := &summarizingClient{reply: "Sure! Here it is:\n```json\n{\"Name\": \"Ada\", \"Tags\": {\"Role\": \"Engineer\"}, \"n\": 1.50}\n```\nAnything else?"}
+	server := NewProxyServer(client)
+
+	body := `{"model": "gpt-4o-mini", "messages": [{"role": "user", "content": "Hi"}], "post_process": ["extract_json", "lowercase_keys"]}`
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewBufferString(body))
+	w := httptest.NewRecorder()
+	server.handleChatCompletions(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var resp ChatCompletionResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if want := `{"name":"Ada","tags":{"role":"Engineer"},"n":1.50}`; resp.Choices[0].Message.Content != want {
+		t.Errorf("Expected %s, got %q", want, resp.Choices[0].Message.Content)
+	}
+	if resp.Metadata != nil {
+		t.Errorf("Expected no metadata, got %+v", resp.Metadata)
+	}
+	if client.requests[0].PostProcess != nil {
+		t.Errorf("Expected post_process not to be sent upstream, got %v", client.requests[0].PostProcess)
+	}
+
+	// A failing post-processor leaves the reply as it is
+	client.reply = "No JSON here."
+	req = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewBufferString(body))
+	w = httptest.NewRecorder()
+	server.handleChatCompletions(w, req)
+	resp = ChatCompletionResponse{}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Choices[0].Message.Content != "No JSON here." || resp.Metadata == nil || len(resp.Metadata.PostProcessErrors) != 2 {
+		t.Errorf("Expected the reply unchanged with two errors, got %+v", resp)
+	}
+}
+
+func TestProxyServer_PostProcessUnknown(t *testing.T) {
+	server := NewProxyServer(&summarizingClient{})
+	for _, processors := range []string{`["uppercase"]`, `["max_sentences"]`, `["max_sentences:0"]`, `["strip_fences:1"]`} {
+		body := `{"model": "gpt-4o-mini", "messages": [{"role": "user", "content": "Hi"}], "post_process": ` + processors + `}`
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewBufferString(body))
+		w := httptest.NewRecorder()
+		server.handleChatCompletions(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status code %d for %s, got %d", http.StatusBadRequest, processors, w.Code)
+		}
+	}
+}
+
+func TestPostProcessors(t *testing.T) {
+	tests := []struct {
+		processor string
+		content   string
+		want      string
+	}{
+		{"strip_fences", "```json\n{\"a\": 1}\n```", `{"a": 1}`},
+		{"extract_json", `The {broken one, then {"a": {"b": "}"}} and more`, `{"a": {"b": "}"}}`},
+		{"max_sentences:2", "One. Two! Three? Four.", "One. Two!"},
+		{"max_sentences:2", `He said "hi." Then left. Done.`, `He said "hi." Then left.`},
+		{"max_sentences:3", "Only one", "Only one"},
+		{"lowercase_keys", `[{"A": [1, {"B": null}]}, "X"]`, `[{"a":[1,{"b":null}]},"X"]`},
+	}
+	for _, tt := range tests {
+		processors, err := parsePostProcessors([]string{tt.processor})
+		if err != nil {
+			t.Fatalf("Expected %s to be valid, got %v", tt.processor, err)
+		}
+		got, err := processors[0].apply(tt.content)
+		if err != nil || got != tt.want {
+			t.Errorf("%s(%q): expected %q, got %q (%v)", tt.processor, tt.content, tt.want, got, err)
+		}
+	}
+
+	processors, _ := parsePostProcessors([]string{"lowercase_keys"})
+	for _, content := range []string{`{"Key": 1, "key": 2}`, `{"a": 1} {"b": 2}`, "not json"} {
+		if _, err := processors[0].apply(content); err == nil {
+			t.Errorf("Expected an error for %s", content)
+		} else if strings.Contains(content, "Key") && !strings.Contains(err.Error(), "collide") {
+			t.Errorf("Expected a collision error, got %v", err)
+		}
+	}
+}
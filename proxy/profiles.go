@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// A Profile is one of several isolated servers run by a single process,
+// each on its own port with its own upstream key, client keys and policies.
+// Env holds the settings of the profile; anything it does not set is read
+// from the process environment, so shared settings are only set once.
+type Profile struct {
+	Name string            `json:"name"`
+	Env  map[string]string `json:"env"`
+}
+
+// getenv looks a setting up in the profile before the process environment
+func (p Profile) getenv(name string) string {
+	if v, ok := p.Env[name]; ok {
+		return v
+	}
+	return os.Getenv(name)
+}
+
+// listenAddress is where a server configured by getenv listens:
+// PROXY_LISTEN_ADDRESS, or else PORT, 8080 by default, on every interface
+func listenAddress(getenv func(string) string) string {
+	if address := getenv("PROXY_LISTEN_ADDRESS"); address != "" {
+		return address
+	}
+	port := getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+	return ":" + port
+}
+
+// wildcardHost reports whether a listen address host is every interface
+func wildcardHost(host string) bool {
+	return host == "" || host == "0.0.0.0" || host == "::"
+}
+
+// writtenPath is a file or directory a server writes to, with the setting
+// that names it
+type writtenPath struct {
+	setting, path string
+}
+
+// writtenPaths are the files and directories a server configured by getenv
+// writes to, defaults included
+func writtenPaths(getenv func(string) string) []writtenPath {
+	var paths []writtenPath
+	add := func(setting, fallback string) {
+		path := getenv(setting)
+		if path == "" {
+			path = fallback
+		}
+		if path != "" {
+			paths = append(paths, writtenPath{setting: setting, path: filepath.Clean(path)})
+		}
+	}
+	if sink := getenv("PROXY_USAGE_SINK"); sink != "" {
+		add("PROXY_WAL_DIR", "data/usage-wal")
+		if file := usageSinkFile(sink); file != "" {
+			add("PROXY_USAGE_SINK", file)
+		}
+	}
+	add("PROXY_AGENT_RUNS_DIR", "")
+	add("PROXY_KEYS_STORE_FILE", "")
+	if getenv("PROXY_PRICING_FILE") != "" {
+		add("PROXY_COSTS_FILE", "data/costs.json")
+	}
+	if getenv("PROXY_ANALYTICS_FILE") != "off" {
+		add("PROXY_ANALYTICS_FILE", "data/analytics.json")
+	}
+	add("PROXY_AUDIT_DIR", "")
+	add("PROXY_MIRROR_DIR", "")
+	add("PROXY_QUARANTINE_DIR", "")
+	if getenv("PROXY_RECORDING_MODE") == RecordingRecord {
+		add("PROXY_RECORDINGS_DIR", defaultRecordingsDir)
+	}
+	add("PROXY_TERMS_DIR", "")
+	return paths
+}
+
+// loadProfiles reads a JSON list of profiles. Profiles must not listen on
+// the same address, or write to the same file or directory: stores such as
+// that of PROXY_KEYS_STORE_FILE are rewritten whole, so one profile would
+// erase what another saved. Settings are resolved as the servers will see
+// them, defaults and those of each profile's PROXY_CONFIG_FILE included.
+func loadProfiles(path string) ([]Profile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read profiles file: %w", err)
+	}
+	var profiles []Profile
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		return nil, fmt.Errorf("failed to parse profiles file: %w", err)
+	}
+	if len(profiles) == 0 {
+		return nil, fmt.Errorf("profiles file %s defines no profiles", path)
+	}
+	names := make(map[string]bool)
+	// claimed are the profile and setting writing to each path
+	type claim struct{ profile, setting string }
+	claimed := make(map[string]claim)
+	// addresses are the hosts listened on by port and profile; a port taken
+	// on every interface clashes with any other use of it
+	addresses := make(map[string]map[string]string)
+	for _, p := range profiles {
+		if p.Name == "" {
+			return nil, fmt.Errorf("every profile needs a name")
+		}
+		if names[p.Name] {
+			return nil, fmt.Errorf("duplicate profile %s", p.Name)
+		}
+		names[p.Name] = true
+		getenv, _, err := configEnv(p.getenv)
+		if err != nil {
+			return nil, fmt.Errorf("profile %s: %w", p.Name, err)
+		}
+		address := listenAddress(getenv)
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, fmt.Errorf("profile %s: invalid listen address %q", p.Name, address)
+		}
+		for other, otherProfile := range addresses[port] {
+			if other == host || wildcardHost(other) || wildcardHost(host) {
+				return nil, fmt.Errorf("profiles %s and %s both listen on port %s", otherProfile, p.Name, port)
+			}
+		}
+		if addresses[port] == nil {
+			addresses[port] = make(map[string]string)
+		}
+		addresses[port][host] = p.Name
+		for _, written := range writtenPaths(getenv) {
+			if other, ok := claimed[written.path]; ok && other.profile != p.Name {
+				return nil, fmt.Errorf("profiles %s and %s both write to %s (%s, %s); give each profile its own", other.profile, p.Name, written.path, other.setting, written.setting)
+			}
+			claimed[written.path] = claim{profile: p.Name, setting: written.setting}
+		}
+	}
+	return profiles, nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeProfiles(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "profiles.json")
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadProfiles(t *testing.T) {
+	t.Setenv("PROXY_TOOL_MAX_ROUNDS", "3")
+	t.Setenv("PORT", "")
+	t.Setenv("PROXY_ANALYTICS_FILE", "off")
+	profiles, err := loadProfiles(writeProfiles(t, `[
+		{"name": "public", "env": {"PORT": "8081", "OPENAI_API_KEY": "sk-public"}},
+		{"name": "internal", "env": {"OPENAI_API_KEY": "sk-internal", "PROXY_TOOL_MAX_ROUNDS": "8"}}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(profiles) != 2 {
+		t.Fatalf("got %d profiles, want 2", len(profiles))
+	}
+	public, internal := profiles[0], profiles[1]
+	if listenAddress(public.getenv) != ":8081" || listenAddress(internal.getenv) != ":8080" {
+		t.Errorf("addresses = %s, %s", listenAddress(public.getenv), listenAddress(internal.getenv))
+	}
+	if public.getenv("OPENAI_API_KEY") != "sk-public" || internal.getenv("OPENAI_API_KEY") != "sk-internal" {
+		t.Error("profiles do not keep their own upstream keys")
+	}
+	if public.getenv("PROXY_TOOL_MAX_ROUNDS") != "3" || internal.getenv("PROXY_TOOL_MAX_ROUNDS") != "8" {
+		t.Error("unset settings should come from the process environment")
+	}
+}
+
+func TestLoadProfiles_Invalid(t *testing.T) {
+	t.Setenv("PORT", "")
+	t.Setenv("PROXY_USAGE_SINK", "")
+	t.Setenv("PROXY_ANALYTICS_FILE", "off")
+	t.Setenv("PROXY_LISTEN_ADDRESS", "")
+	t.Setenv("PROXY_CONFIG_FILE", "")
+	config := filepath.Join(t.TempDir(), "proxy.toml")
+	os.WriteFile(config, []byte("listen = \"127.0.0.1:8081\"\n"), 0o644)
+	for name, data := range map[string]string{
+		"shared address": `[{"name": "a", "env": {"PORT": "8081"}}, {"name": "b", "env": {"PROXY_LISTEN_ADDRESS": "127.0.0.1:8081"}}]`,
+		"shared listen":  `[{"name": "a", "env": {"PROXY_LISTEN_ADDRESS": "127.0.0.1:8081"}}, {"name": "b", "env": {"PROXY_CONFIG_FILE": "` + config + `"}}]`,
+		"empty":          `[]`,
+		"unnamed":        `[{"env": {"PORT": "8081"}}]`,
+		"duplicate name": `[{"name": "a", "env": {"PORT": "8081"}}, {"name": "a", "env": {"PORT": "8082"}}]`,
+		"shared port":    `[{"name": "a"}, {"name": "b"}]`,
+		"shared wal":     `[{"name": "a", "env": {"PORT": "8081", "PROXY_USAGE_SINK": "http://c"}}, {"name": "b", "env": {"PORT": "8082", "PROXY_USAGE_SINK": "http://c"}}]`,
+		"shared runs":    `[{"name": "a", "env": {"PORT": "8081", "PROXY_AGENT_RUNS_DIR": "runs"}}, {"name": "b", "env": {"PORT": "8082", "PROXY_AGENT_RUNS_DIR": "./runs"}}]`,
+		"malformed":      `{"name": "a"}`,
+	} {
+		if _, err := loadProfiles(writeProfiles(t, data)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestLoadProfiles_ListenAddresses(t *testing.T) {
+	t.Setenv("PORT", "")
+	t.Setenv("PROXY_LISTEN_ADDRESS", "")
+	t.Setenv("PROXY_CONFIG_FILE", "")
+	t.Setenv("PROXY_ANALYTICS_FILE", "off")
+	// The same port on different interfaces is no conflict
+	_, err := loadProfiles(writeProfiles(t, `[
+		{"name": "public", "env": {"PROXY_LISTEN_ADDRESS": "10.0.0.1:8080"}},
+		{"name": "internal", "env": {"PROXY_LISTEN_ADDRESS": "127.0.0.1:8080"}}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadProfiles_WrittenPaths(t *testing.T) {
+	t.Setenv("PORT", "")
+	t.Setenv("PROXY_LISTEN_ADDRESS", "")
+	t.Setenv("PROXY_CONFIG_FILE", "")
+	t.Setenv("PROXY_ANALYTICS_FILE", "")
+	t.Setenv("PROXY_PRICING_FILE", "")
+	t.Setenv("PROXY_RECORDING_MODE", "")
+	for name, data := range map[string]string{
+		"keys store":         `[{"name": "a", "env": {"PORT": "8081", "PROXY_ANALYTICS_FILE": "a.json", "PROXY_KEYS_STORE_FILE": "keys.json"}}, {"name": "b", "env": {"PORT": "8082", "PROXY_ANALYTICS_FILE": "b.json", "PROXY_KEYS_STORE_FILE": "./keys.json"}}]`,
+		"default analytics":  `[{"name": "a", "env": {"PORT": "8081"}}, {"name": "b", "env": {"PORT": "8082"}}]`,
+		"default costs":      `[{"name": "a", "env": {"PORT": "8081", "PROXY_ANALYTICS_FILE": "off", "PROXY_PRICING_FILE": "prices.json"}}, {"name": "b", "env": {"PORT": "8082", "PROXY_ANALYTICS_FILE": "off", "PROXY_PRICING_FILE": "prices.json"}}]`,
+		"audit and mirror":   `[{"name": "a", "env": {"PORT": "8081", "PROXY_ANALYTICS_FILE": "off", "PROXY_AUDIT_DIR": "logs"}}, {"name": "b", "env": {"PORT": "8082", "PROXY_ANALYTICS_FILE": "off", "PROXY_MIRROR_DIR": "logs"}}]`,
+		"usage sink file":    `[{"name": "a", "env": {"PORT": "8081", "PROXY_ANALYTICS_FILE": "off", "PROXY_USAGE_SINK": "usage.jsonl", "PROXY_WAL_DIR": "wal-a"}}, {"name": "b", "env": {"PORT": "8082", "PROXY_ANALYTICS_FILE": "off", "PROXY_USAGE_SINK": "usage.jsonl", "PROXY_WAL_DIR": "wal-b"}}]`,
+		"default recordings": `[{"name": "a", "env": {"PORT": "8081", "PROXY_ANALYTICS_FILE": "off", "PROXY_RECORDING_MODE": "record"}}, {"name": "b", "env": {"PORT": "8082", "PROXY_ANALYTICS_FILE": "off", "PROXY_RECORDING_MODE": "record"}}]`,
+	} {
+		_, err := loadProfiles(writeProfiles(t, data))
+		if err == nil || !strings.Contains(err.Error(), "both write to") {
+			t.Errorf("%s: expected the shared path to be refused, got %v", name, err)
+		}
+	}
+
+	// Replaying recordings only reads them
+	_, err := loadProfiles(writeProfiles(t, `[
+		{"name": "a", "env": {"PORT": "8081", "PROXY_ANALYTICS_FILE": "a.json", "PROXY_KEYS_STORE_FILE": "a-keys.json", "PROXY_RECORDING_MODE": "replay"}},
+		{"name": "b", "env": {"PORT": "8082", "PROXY_ANALYTICS_FILE": "b.json", "PROXY_KEYS_STORE_FILE": "b-keys.json", "PROXY_RECORDING_MODE": "replay"}}
+	]`))
+	if err != nil {
+		t.Errorf("profiles with paths of their own should load: %v", err)
+	}
+}
+
+func TestServerFromEnv_Profiles(t *testing.T) {
+	t.Setenv("OPENAI_API_KEY", "")
+	t.Setenv("OPENAI_API_KEY_FILE", "")
+	strict := Profile{Name: "strict", Env: map[string]string{"OPENAI_API_KEY": "sk-strict", "PROXY_TOOL_CALL_VALIDATION": ToolCallsValidate, "PROXY_PLAYGROUND": "off"}}
+	open := Profile{Name: "open", Env: map[string]string{"OPENAI_API_KEY": "sk-open"}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	a, err := serverFromEnv(ctx, strict.getenv, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := serverFromEnv(ctx, open.getenv, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.client.(*RealOpenAIClient).apiKey() != "sk-strict" || b.client.(*RealOpenAIClient).apiKey() != "sk-open" {
+		t.Error("profiles share an upstream key")
+	}
+	if a.toolCallValidation != ToolCallsValidate || b.toolCallValidation == ToolCallsValidate {
+		t.Error("profiles share their tool call validation")
+	}
+	if a.playground || !b.playground {
+		t.Error("profiles share the playground setting")
+	}
+
+	missing := Profile{Name: "missing"}
+	if _, err := serverFromEnv(ctx, missing.getenv, nil); err == nil || !strings.Contains(err.Error(), "OPENAI_API_KEY") {
+		t.Errorf("expected a missing key error, got %v", err)
+	}
+}
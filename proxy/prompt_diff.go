@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// errBadVariant is wrapped by errors in the definition of a variant
+var errBadVariant = errors.New("invalid variant")
+
+// PromptVariant is one side of a prompt diff: a model, or a version of a
+// virtual model, with the prompt templates to send it
+type PromptVariant struct {
+	Model string `json:"model"`
+	// Version picks an earlier version of a virtual model instead of the
+	// current one
+	Version int `json:"version,omitempty"`
+	// System and Prompt are Go templates executed with .Input and .Vars.
+	// Prompt defaults to {{.Input}}.
+	System      string   `json:"system,omitempty"`
+	Prompt      string   `json:"prompt,omitempty"`
+	Temperature *float64 `json:"temperature,omitempty"`
+	MaxTokens   *int     `json:"max_tokens,omitempty"`
+}
+
+// PromptDiffRequest is the body of /v1/prompts/diff
+type PromptDiffRequest struct {
+	Input     string         `json:"input"`
+	Variables map[string]any `json:"variables,omitempty"`
+	A         PromptVariant  `json:"a"`
+	B         PromptVariant  `json:"b"`
+	// Judge is the model comparing the outputs, by default
+	// PROXY_PROMPT_DIFF_JUDGE or else the model of A
+	Judge string `json:"judge,omitempty"`
+	// Criteria tells the judge what matters, e.g. "accuracy and brevity"
+	Criteria string `json:"criteria,omitempty"`
+}
+
+// PromptVariantResult is what one variant produced
+type PromptVariantResult struct {
+	// Model is the upstream model the variant was sent to
+	Model     string `json:"model"`
+	System    string `json:"system,omitempty"`
+	Prompt    string `json:"prompt"`
+	Output    string `json:"output"`
+	Usage     Usage  `json:"usage"`
+	LatencyMS int64  `json:"latency_ms"`
+}
+
+// PromptCritique is the judge's comparison of the two outputs
+type PromptCritique struct {
+	Model       string   `json:"model"`
+	Summary     string   `json:"summary"`
+	Differences []string `json:"differences"`
+	// Preferred is "a", "b" or "tie"
+	Preferred string `json:"preferred"`
+	Usage     Usage  `json:"usage"`
+}
+
+type PromptDiffResponse struct {
+	A        PromptVariantResult `json:"a"`
+	B        PromptVariantResult `json:"b"`
+	Critique PromptCritique      `json:"critique"`
+	Usage    Usage               `json:"usage"`
+}
+
+// promptCritiqueSchema is what the judge must reply with
+const promptCritiqueSchema = `{
+	"type": "object",
+	"properties": {
+		"summary": {"type": "string"},
+		"differences": {"type": "array", "items": {"type": "string"}},
+		"preferred": {"enum": ["a", "b", "tie"]}
+	},
+	"required": ["summary", "differences", "preferred"]
+}`
+
+const promptJudgePrompt = "You help engineer prompts by comparing the outputs of two variants, A and B, for the same input. List the differences that matter between the outputs, such as content, accuracy, tone, format and length, and attribute them to the differences between the prompts or models where you can. Then say which output is better, or whether it is a tie, with a one-paragraph summary."
+
+// promptData is what the templates of a variant are executed with
+type promptData struct {
+	Input string
+	Vars  map[string]any
+}
+
+// render executes the templates of a variant
+func (v PromptVariant) render(data promptData) (system, prompt string, err error) {
+	if v.Prompt == "" {
+		v.Prompt = "{{.Input}}"
+	}
+	for _, t := range []struct {
+		name string
+		text string
+		out  *string
+	}{{"system", v.System, &system}, {"prompt", v.Prompt, &prompt}} {
+		tmpl, err := template.New(t.name).Option("missingkey=error").Funcs(pipelineFuncs).Parse(t.text)
+		if err != nil {
+			return "", "", fmt.Errorf("%w: invalid %s template: %v", errBadVariant, t.name, err)
+		}
+		var b strings.Builder
+		if err := tmpl.Execute(&b, data); err != nil {
+			return "", "", fmt.Errorf("%w: failed to render %s template: %v", errBadVariant, t.name, err)
+		}
+		*t.out = b.String()
+	}
+	return system, prompt, nil
+}
+
+// runPromptVariant renders a variant and sends it upstream, charging the
+// tokens to key
+func (s *ProxyServer) runPromptVariant(ctx context.Context, v PromptVariant, data promptData, key *ClientKey, tenant string) (PromptVariantResult, error) {
+	var result PromptVariantResult
+	system, prompt, err := v.render(data)
+	if err != nil {
+		return result, err
+	}
+	result.System, result.Prompt = system, prompt
+
+	req := ChatCompletionRequest{Model: v.Model, Temperature: v.Temperature, MaxTokens: v.MaxTokens}
+	if system != "" {
+		req.Messages = append(req.Messages, Message{Role: "system", Content: system})
+	}
+	req.Messages = append(req.Messages, Message{Role: "user", Content: prompt})
+	if v.Version > 0 {
+		vm, ok := s.modelHistory.Version(v.Model, v.Version)
+		if !ok {
+			return result, fmt.Errorf("%w: virtual model %s has no version %d", errBadVariant, v.Model, v.Version)
+		}
+		if err := s.applyVirtualModel(&req, vm, tenant, "prompt_diff"); err != nil {
+			return result, err
+		}
+		req.Model = s.resolveModel(req.Model, tenant)
+	} else if err := s.expandModel(&req, tenant, "prompt_diff"); err != nil {
+		return result, err
+	}
+	result.Model = req.Model
+
+	event := newUsageEvent(key, "prompt_diff", req.Model)
+	resp, err := s.chatCompletion(ctx, req)
+	event.LatencyMS = time.Since(event.Time).Milliseconds()
+	result.LatencyMS = event.LatencyMS
+	if err != nil {
+		event.Status = http.StatusInternalServerError
+		s.recordUsage(event)
+		return result, fmt.Errorf("completion failed: %w", err)
+	}
+	s.recordCompletion(key, event, resp.Usage)
+	result.Usage = resp.Usage
+	if len(resp.Choices) > 0 {
+		result.Output = resp.Choices[0].Message.Content
+	}
+	return result, nil
+}
+
+// critiquePrompts asks the judge to compare the results of both variants
+func (s *ProxyServer) critiquePrompts(ctx context.Context, req PromptDiffRequest, a, b PromptVariantResult, key *ClientKey, tenant string) (PromptCritique, error) {
+	var user strings.Builder
+	fmt.Fprintf(&user, "Input:\n%s\n", req.Input)
+	for _, v := range []struct {
+		name    string
+		variant PromptVariant
+		result  PromptVariantResult
+	}{{"A", req.A, a}, {"B", req.B, b}} {
+		fmt.Fprintf(&user, "\n## Variant %s\nModel: %s", v.name, v.variant.Model)
+		if v.variant.Version > 0 {
+			fmt.Fprintf(&user, " (version %d)", v.variant.Version)
+		}
+		if v.result.System != "" {
+			fmt.Fprintf(&user, "\nSystem prompt:\n%s", v.result.System)
+		}
+		fmt.Fprintf(&user, "\nPrompt:\n%s\nOutput:\n%s\n", v.result.Prompt, v.result.Output)
+	}
+	system := promptJudgePrompt
+	if req.Criteria != "" {
+		system += "\n\nJudge them on: " + req.Criteria
+	}
+	temperature := 0.0
+	chatReq := ChatCompletionRequest{
+		Model:       req.Judge,
+		Messages:    []Message{{Role: "system", Content: system}, {Role: "user", Content: user.String()}},
+		Temperature: &temperature,
+		ResponseFormat: &ResponseFormat{Type: "json_schema", JSONSchema: &JSONSchemaFormat{
+			Name:   "prompt_critique",
+			Schema: json.RawMessage(promptCritiqueSchema),
+		}},
+	}
+	if err := s.expandModel(&chatReq, tenant, "prompt_diff"); err != nil {
+		return PromptCritique{}, err
+	}
+
+	critique := PromptCritique{Model: chatReq.Model}
+	event := newUsageEvent(key, "prompt_diff", chatReq.Model)
+	resp, err := s.createCompletion(ctx, chatReq)
+	event.LatencyMS = time.Since(event.Time).Milliseconds()
+	if err != nil {
+		event.Status = http.StatusInternalServerError
+		s.recordUsage(event)
+		return critique, fmt.Errorf("critique failed: %w", err)
+	}
+	s.recordCompletion(key, event, resp.Usage)
+	critique.Usage = resp.Usage
+	if len(resp.Choices) == 0 {
+		return critique, fmt.Errorf("critique failed: upstream returned no choices")
+	}
+	// A reply that still does not follow the schema is kept as the summary
+	content := resp.Choices[0].Message.Content
+	if err := json.Unmarshal([]byte(stripCodeFence(content)), &critique); err != nil || critique.Preferred == "" {
+		critique.Summary, critique.Differences, critique.Preferred = strings.TrimSpace(content), nil, ""
+	}
+	critique.Model, critique.Usage = chatReq.Model, resp.Usage
+	return critique, nil
+}
+
+// handlePromptDiff runs the same input through two variants in parallel and
+// has a judge model compare the outputs
+func (s *ProxyServer) handlePromptDiff(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req PromptDiffRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON in request body", http.StatusBadRequest)
+		return
+	}
+	if req.A.Model == "" || req.B.Model == "" {
+		http.Error(w, "Both variants a and b need a model", http.StatusBadRequest)
+		return
+	}
+	if req.Judge == "" {
+		req.Judge = s.promptDiffJudge
+	}
+	if req.Judge == "" {
+		req.Judge = req.A.Model
+	}
+	key := clientKeyFromContext(r.Context())
+	var tenant string
+	if key != nil {
+		tenant = key.Tenant
+		for _, model := range []string{req.A.Model, req.B.Model, req.Judge} {
+			if !key.AllowsModel(model) {
+				http.Error(w, fmt.Sprintf("API key is not allowed to use model %s", model), http.StatusForbidden)
+				return
+			}
+		}
+	}
+
+	data := promptData{Input: req.Input, Vars: req.Variables}
+	if data.Vars == nil {
+		data.Vars = map[string]any{}
+	}
+	var (
+		resp   PromptDiffResponse
+		errs   [2]error
+		wg     sync.WaitGroup
+		sides  = [2]*PromptVariantResult{&resp.A, &resp.B}
+		inputs = [2]PromptVariant{req.A, req.B}
+	)
+	for i := range sides {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			*sides[i], errs[i] = s.runPromptVariant(r.Context(), inputs[i], data, key, tenant)
+		}()
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			log.Printf("Prompt diff failed: variant %c: %v", 'a'+i, err)
+			http.Error(w, fmt.Sprintf("Variant %c failed: %v", 'a'+i, err), promptDiffStatus(err))
+			return
+		}
+	}
+
+	critique, err := s.critiquePrompts(r.Context(), req, resp.A, resp.B, key, tenant)
+	if err != nil {
+		log.Printf("Prompt diff failed: %v", err)
+		http.Error(w, err.Error(), promptDiffStatus(err))
+		return
+	}
+	resp.Critique = critique
+	for _, u := range []Usage{resp.A.Usage, resp.B.Usage, critique.Usage} {
+		resp.Usage.PromptTokens += u.PromptTokens
+		resp.Usage.CompletionTokens += u.CompletionTokens
+		resp.Usage.TotalTokens += u.TotalTokens
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// promptDiffStatus is the status code to answer a failed diff with
+func promptDiffStatus(err error) int {
+	switch {
+	case errors.Is(err, errModelNotAllowed):
+		return http.StatusForbidden
+	case errors.Is(err, errGuardrailBlocked), errors.Is(err, errBadVariant):
+		return http.StatusBadRequest
+	default:
+		return http.StatusBadGateway
+	}
+}
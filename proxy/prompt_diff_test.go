@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// promptDiffClient answers with the model and first message it got, and as
+// the judge with critique
+type promptDiffClient struct {
+	mu       sync.Mutex
+	critique string
+	requests []ChatCompletionRequest
+}
+
+func (m *promptDiffClient) CreateChatCompletion(req ChatCompletionRequest) (*ChatCompletionResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests = append(m.requests, req)
+	resp := *createTestChatCompletionResponse()
+	resp.Choices = append([]Choice(nil), resp.Choices...)
+	resp.Choices[0].Message.Content = req.Model + ": " + req.Messages[0].Content
+	if req.Model == "judge" {
+		resp.Choices[0].Message.Content = m.critique
+	}
+	return &resp, nil
+}
+
+func promptDiff(server *ProxyServer, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/v1/prompts/diff", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	server.handlePromptDiff(w, req)
+	return w
+}
+
+func TestProxyServer_PromptDiff(t *testing.T) {
+	server, mux := newTestModelServer()
+	adminRequest(mux, "PUT", "/admin/models/support", `{"model": "gpt-4o", "system": "Be formal."}`, nil)
+	adminRequest(mux, "PUT", "/admin/models/support", `{"model": "gpt-4o-mini", "system": "Be casual."}`, nil)
+	client := &promptDiffClient{critique: "```json\n{\"summary\": \"B is shorter.\", \"differences\": [\"tone\"], \"preferred\": \"b\"}\n```"}
+	server.client = client
+	server.promptDiffJudge = "judge"
+
+	w := promptDiff(server, `{"input": "Where is my order?", "variables": {"customer": "Ann"},
+		"a": {"model": "support", "version": 1, "prompt": "{{.Vars.customer}} asks: {{.Input}}"},
+		"b": {"model": "support", "prompt": "{{.Vars.customer}} asks: {{.Input}}"},
+		"criteria": "tone"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var resp PromptDiffResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.A.Model != "gpt-4o" || resp.A.Output != "gpt-4o: Be formal." || resp.A.Prompt != "Ann asks: Where is my order?" {
+		t.Errorf("Expected version 1 for a, got %+v", resp.A)
+	}
+	if resp.B.Model != "gpt-4o-mini" || resp.B.Output != "gpt-4o-mini: Be casual." {
+		t.Errorf("Expected the current version for b, got %+v", resp.B)
+	}
+	if resp.Critique.Preferred != "b" || resp.Critique.Summary != "B is shorter." || len(resp.Critique.Differences) != 1 || resp.Critique.Model != "judge" {
+		t.Errorf("Expected the judge's critique, got %+v", resp.Critique)
+	}
+	judged := client.requests[2]
+	if judged.Model != "judge" || !strings.Contains(judged.Messages[0].Content, "Judge them on: tone") ||
+		!strings.Contains(judged.Messages[1].Content, "## Variant A\nModel: support (version 1)") || !strings.Contains(judged.Messages[1].Content, "Output:\ngpt-4o-mini: Be casual.") {
+		t.Errorf("Expected both variants in the judge's prompt, got %+v", judged.Messages)
+	}
+	if resp.Usage.TotalTokens != 3*32 {
+		t.Errorf("Expected the usage of three calls, got %+v", resp.Usage)
+	}
+}
+
+func TestProxyServer_PromptDiffUnstructuredCritique(t *testing.T) {
+	server := NewProxyServer(&promptDiffClient{critique: "Both are fine."})
+	w := promptDiff(server, `{"input": "Hi", "a": {"model": "gpt-4o", "system": "One"}, "b": {"model": "gpt-4o", "system": "Two"}, "judge": "judge"}`)
+	var resp PromptDiffResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Critique.Summary != "Both are fine." || resp.Critique.Preferred != "" {
+		t.Errorf("Expected the raw critique as summary, got %+v", resp.Critique)
+	}
+}
+
+func TestProxyServer_PromptDiffErrors(t *testing.T) {
+	server := NewProxyServer(&promptDiffClient{})
+	for _, body := range []string{
+		`{"input": "Hi", "a": {"model": "gpt-4o"}}`,
+		`{"input": "Hi", "a": {"model": "gpt-4o", "prompt": "{{.Vars.missing}}"}, "b": {"model": "gpt-4o"}}`,
+		`{"input": "Hi", "a": {"model": "gpt-4o", "version": 2}, "b": {"model": "gpt-4o"}}`,
+	} {
+		if w := promptDiff(server, body); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status code %d for %s, got %d: %s", http.StatusBadRequest, body, w.Code, w.Body.String())
+		}
+	}
+}
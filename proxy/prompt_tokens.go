@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+)
+
+// Much of what fills a model's context window is added by the proxy, not
+// sent by the client: rewrite rules and virtual models add system prompts,
+// sessions add history, retrieval adds context. POST /v1/tokenize/chat
+// takes a chat completion request, prepares it as the proxy would without
+// sending it, and answers with the tokens of each message and component.
+
+// Prompt components messages are counted under
+const (
+	PromptSystem       = "system"
+	PromptRewrite      = "rewrite"
+	PromptVirtualModel = "virtual_model"
+	PromptRAG          = "rag"
+	PromptHistory      = "history"
+	PromptLatest       = "latest"
+	PromptTools        = "tools"
+	// PromptOverhead is what every reply is primed with
+	PromptOverhead = "overhead"
+)
+
+// OpenAI frames every message, and primes the reply, with a few tokens
+const (
+	tokensPerMessage = 3
+	tokensPerName    = 1
+	tokensPerReply   = 3
+)
+
+// PromptTokensResponse is the breakdown of the tokens of a request
+type PromptTokensResponse struct {
+	Model         string `json:"model"`
+	UpstreamModel string `json:"upstream_model"`
+	Encoding      string `json:"encoding,omitempty"`
+	// Estimated is set when the model has no tokenizer, and counts are
+	// estimated from the length of the text
+	Estimated   bool                  `json:"estimated,omitempty"`
+	TotalTokens int                   `json:"total_tokens"`
+	Components  map[string]int        `json:"components"`
+	Messages    []PromptTokensMessage `json:"messages"`
+}
+
+// PromptTokensMessage is the tokens of one message, framing included, and
+// their share of the request's
+type PromptTokensMessage struct {
+	Index     int     `json:"index"`
+	Role      string  `json:"role"`
+	Component string  `json:"component"`
+	Tokens    int     `json:"tokens"`
+	Share     float64 `json:"share"`
+}
+
+// tokenCounter returns a function counting the tokens of text for model,
+// and the encoding it uses, or estimates four bytes to a token when the
+// model has no tokenizer
+func (s *ProxyServer) tokenCounter(model string) (func(string) int, string) {
+	estimate := func(text string) int { return (len(text) + 3) / 4 }
+	name, ok := encodingForModel(model)
+	if !ok {
+		return estimate, ""
+	}
+	e, err := s.tokenizers.get(name)
+	if err != nil {
+		return estimate, ""
+	}
+	return func(text string) int {
+		tokens, err := e.encode(text)
+		if err != nil {
+			return estimate(text)
+		}
+		return len(tokens)
+	}, e.name
+}
+
+// insertComponents marks n messages inserted at i as of component
+func insertComponents(components []string, i, n int, component string) []string {
+	if n <= 0 {
+		return components
+	}
+	return slices.Insert(components, i, slices.Repeat([]string{component}, n)...)
+}
+
+func (s *ProxyServer) handlePromptTokens(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+	key := clientKeyFromContext(r.Context())
+	var tenant string
+	if key != nil {
+		tenant = key.Tenant
+	}
+
+	// The rewrite rules of chat completions apply first, each prepending
+	// its system prompt
+	rewritten := 0
+	if rules := s.rewriteRules("/v1/chat/completions", tenant); len(rules) > 0 {
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.UseNumber()
+		var doc map[string]any
+		if dec.Decode(&doc) == nil && doc != nil {
+			for _, rule := range rules {
+				if slices.Contains(rule.rewrite(doc), "system prompt") {
+					rewritten++
+				}
+			}
+			body, _ = json.Marshal(doc)
+		}
+	}
+	var req ChatCompletionRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, "Invalid JSON in request body", http.StatusBadRequest)
+		return
+	}
+	components := make([]string, len(req.Messages))
+	for i := range rewritten {
+		components[i] = PromptRewrite
+	}
+
+	sent := len(req.Messages)
+	if _, _, err := s.sessionMessages(&req, key); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	components = insertComponents(components, 0, len(req.Messages)-sent, PromptHistory)
+	if req.Model == "" {
+		http.Error(w, "Model field is required", http.StatusBadRequest)
+		return
+	}
+	if len(req.Messages) == 0 {
+		http.Error(w, "Messages field is required and cannot be empty", http.StatusBadRequest)
+		return
+	}
+	if key != nil && !key.AllowsModel(req.Model) {
+		http.Error(w, fmt.Sprintf("API key is not allowed to use model %s", req.Model), http.StatusForbidden)
+		return
+	}
+	requested := req.Model
+	sent = len(req.Messages)
+	if err := s.expandModel(&req, tenant, "chat.completions"); err != nil {
+		http.Error(w, err.Error(), expandModelStatus(err))
+		return
+	}
+	components = insertComponents(components, 0, len(req.Messages)-sent, PromptVirtualModel)
+	if _, err := s.offerBuiltinTools(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Retrieved context goes ahead of the last user message
+	last := -1
+	for i, m := range req.Messages {
+		if m.Role == "user" {
+			last = i
+		}
+	}
+	sent = len(req.Messages)
+	if _, err := s.augment(&req, key); err != nil {
+		http.Error(w, fmt.Sprintf("Retrieval failed: %v", err), augmentStatus(err))
+		return
+	}
+	components = insertComponents(components, max(last, 0), len(req.Messages)-sent, PromptRAG)
+
+	// What is left is what the client sent
+	latest := len(req.Messages)
+	for i, m := range req.Messages {
+		if components[i] == "" && m.Role == "user" {
+			latest = i
+		}
+	}
+	for i, m := range req.Messages {
+		switch {
+		case components[i] != "":
+		case m.Role == "system" || m.Role == "developer":
+			components[i] = PromptSystem
+		case i >= latest:
+			components[i] = PromptLatest
+		default:
+			components[i] = PromptHistory
+		}
+	}
+
+	count, encoding := s.tokenCounter(req.Model)
+	resp := PromptTokensResponse{
+		Model:         requested,
+		UpstreamModel: req.Model,
+		Encoding:      encoding,
+		Estimated:     encoding == "",
+		Components:    map[string]int{PromptOverhead: tokensPerReply},
+		Messages:      make([]PromptTokensMessage, len(req.Messages)),
+	}
+	resp.TotalTokens = tokensPerReply
+	for i, m := range req.Messages {
+		tokens := tokensPerMessage + count(m.Role) + count(m.Content)
+		if m.Name != "" {
+			tokens += count(m.Name) + tokensPerName
+		}
+		if len(m.ToolCalls) > 0 || m.FunctionCall != nil {
+			calls, _ := json.Marshal(struct {
+				ToolCalls    []ToolCall        `json:"tool_calls,omitempty"`
+				FunctionCall *ToolCallFunction `json:"function_call,omitempty"`
+			}{m.ToolCalls, m.FunctionCall})
+			tokens += count(string(calls))
+		}
+		resp.Messages[i] = PromptTokensMessage{Index: i, Role: m.Role, Component: components[i], Tokens: tokens}
+		resp.Components[components[i]] += tokens
+		resp.TotalTokens += tokens
+	}
+	if len(req.Tools) > 0 || len(req.Functions) > 0 {
+		// Tools reach the model in a format of OpenAI's own, which their
+		// JSON approximates
+		tools, _ := json.Marshal(struct {
+			Tools     []Tool         `json:"tools,omitempty"`
+			Functions []ToolFunction `json:"functions,omitempty"`
+		}{req.Tools, req.Functions})
+		resp.Components[PromptTools] = count(string(tools))
+		resp.TotalTokens += resp.Components[PromptTools]
+	}
+	for i := range resp.Messages {
+		resp.Messages[i].Share = math.Round(float64(resp.Messages[i].Tokens)/float64(resp.TotalTokens)*1000) / 1000
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func promptTokensRequest(handler http.Handler, body string) (*httptest.ResponseRecorder, PromptTokensResponse) {
+	req := httptest.NewRequest(http.MethodPost, "/v1/tokenize/chat", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	var resp PromptTokensResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return w, resp
+}
+
+func TestProxyServer_PromptTokens(t *testing.T) {
+	client := &recordingOpenAIClient{MockOpenAIClient: MockOpenAIClient{response: createTestChatCompletionResponse()}}
+	server := NewProxyServer(client)
+	server.tokenizers = newTokenizers(writeVocabulary(t))
+	server.virtualModels.Put("support", VirtualModel{ID: "support", Model: "gpt-4-turbo", System: "hello world"})
+	server.rewrites = []RewriteRule{{Name: "policy", Path: "/v1/chat/completions", System: "hello"}}
+
+	w, resp := promptTokensRequest(server.Handler(), `{"model": "support", "messages": [
+		{"role": "system", "content": "hello"},
+		{"role": "user", "content": "hello"},
+		{"role": "assistant", "content": "hello world"},
+		{"role": "user", "content": "hello world hello"}
+	]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if client.last.Model != "" {
+		t.Error("Expected nothing to be sent upstream")
+	}
+	if resp.Model != "support" || resp.UpstreamModel != "gpt-4-turbo" || resp.Encoding != "cl100k_base" || resp.Estimated {
+		t.Errorf("Expected the tokenizer of the upstream model, got %+v", resp)
+	}
+	want := []struct {
+		component string
+		tokens    int
+	}{
+		// Framing, the role and the content; "system" and "user" are
+		// spelled byte by byte in the test vocabulary
+		{PromptVirtualModel, 3 + 6 + 2},
+		{PromptRewrite, 3 + 6 + 1},
+		{PromptSystem, 3 + 6 + 1},
+		{PromptHistory, 3 + 4 + 1},
+		{PromptHistory, 3 + 9 + 2},
+		{PromptLatest, 3 + 4 + 4},
+	}
+	if len(resp.Messages) != len(want) {
+		t.Fatalf("Expected %d messages, got %+v", len(want), resp.Messages)
+	}
+	total := tokensPerReply
+	for i, m := range resp.Messages {
+		if m.Component != want[i].component || m.Tokens != want[i].tokens {
+			t.Errorf("Message %d: expected %s with %d tokens, got %+v", i, want[i].component, want[i].tokens, m)
+		}
+		total += m.Tokens
+	}
+	if resp.TotalTokens != total || resp.Components[PromptHistory] != 22 || resp.Components[PromptOverhead] != tokensPerReply {
+		t.Errorf("Expected the components to add up to %d, got %d %v", total, resp.TotalTokens, resp.Components)
+	}
+}
+
+func TestProxyServer_PromptTokensEstimated(t *testing.T) {
+	server := NewProxyServer(&MockOpenAIClient{})
+	w, resp := promptTokensRequest(server.Handler(), `{"model": "claude-sonnet-4", "tools": [{"type": "function", "function": {"name": "lookup"}}], "messages": [{"role": "user", "content": "How many tokens is this?"}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if !resp.Estimated || resp.Encoding != "" || resp.Messages[0].Tokens != 3+1+6 || resp.Components[PromptTools] == 0 {
+		t.Errorf("Expected estimated counts with the tools, got %+v", resp)
+	}
+
+	w, _ = promptTokensRequest(server.Handler(), `{"model": "gpt-4o", "messages": []}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 without messages, got %d", w.Code)
+	}
+}
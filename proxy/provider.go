@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Chat completions can be served by other providers than OpenAI behind the
+// same OpenAI-compatible endpoint. Providers claim models by name, after
+// routing rules have rewritten them; requests for models no provider claims
+// go to OpenAI. Azure OpenAI and Ollama speak the OpenAI format already and
+// only differ in URLs and authentication, while Anthropic requests and
+// replies are translated.
+
+// Provider types
+const (
+	ProviderOpenAI    = "openai"
+	ProviderAzure     = "azure"
+	ProviderOllama    = "ollama"
+	ProviderAnthropic = "anthropic"
+)
+
+// Provider configures an upstream other than the default OpenAI one
+type Provider struct {
+	Name string `json:"name"`
+	// Type is openai, for other OpenAI-compatible servers, azure, ollama or
+	// anthropic
+	Type string `json:"type"`
+	// Models are the models served by the provider. A trailing "*" matches
+	// a prefix. Azure providers serve the models of their deployments by
+	// default.
+	Models  []string `json:"models,omitempty"`
+	BaseURL string   `json:"base_url,omitempty"`
+	// APIKeyEnv names the environment variable holding the provider's key
+	APIKeyEnv string `json:"api_key_env,omitempty"`
+	// APIVersion and Deployments are Azure's: the API version requests are
+	// made with and the deployment serving each model
+	APIVersion  string            `json:"api_version,omitempty"`
+	Deployments map[string]string `json:"deployments,omitempty"`
+	// MaxTokens is sent to Anthropic, which requires it, when the request
+	// does not set max_tokens. It defaults to 4096.
+	MaxTokens int `json:"max_tokens,omitempty"`
+	// Quirks adapt requests to what the provider accepts
+	Quirks *ProviderQuirks `json:"quirks,omitempty"`
+}
+
+// chatBackend is an upstream serving chat completions
+type chatBackend interface {
+	contextOpenAIClient
+	rawOpenAIClient
+	streamingOpenAIClient
+}
+
+type routedProvider struct {
+	name    string
+	models  []string
+	backend chatBackend
+	quirks  *ProviderQuirks
+}
+
+// providerRouter sends each request to the provider serving its model
+type providerRouter struct {
+	providers []routedProvider
+	// fallback serves the models no provider claims
+	fallback *RealOpenAIClient
+	// fallbacks are the models requests fail over to
+	fallbacks []fallbackChain
+	// license, once it stops allowing providers, sends every model to the
+	// fallback
+	license *license
+}
+
+// backend returns the upstream of model
+func (p *providerRouter) backend(model string) chatBackend {
+	return p.route(model).backend
+}
+
+// route returns the provider serving model
+func (p *providerRouter) route(model string) routedProvider {
+	if len(p.providers) > 0 && !p.license.Allows(LicensedProviders) {
+		return routedProvider{name: ProviderOpenAI, backend: p.fallback}
+	}
+	for _, provider := range p.providers {
+		if matchAny(provider.models, model) {
+			return provider
+		}
+	}
+	return routedProvider{name: ProviderOpenAI, backend: p.fallback}
+}
+
+func (p *providerRouter) CreateChatCompletion(req ChatCompletionRequest) (*ChatCompletionResponse, error) {
+	return p.CreateChatCompletionContext(context.Background(), req)
+}
+
+func (p *providerRouter) CreateEmbeddings(req EmbeddingRequest) (*EmbeddingResponse, error) {
+	return p.CreateEmbeddingsContext(context.Background(), req)
+}
+
+func (p *providerRouter) CreateEmbeddingsContext(ctx context.Context, req EmbeddingRequest) (*EmbeddingResponse, error) {
+	backend := p.backend(req.Model)
+	if client, ok := backend.(contextEmbeddingsClient); ok {
+		return client.CreateEmbeddingsContext(ctx, req)
+	}
+	client, ok := backend.(embeddingsClient)
+	if !ok {
+		return nil, fmt.Errorf("embeddings are not supported for model %s", req.Model)
+	}
+	return client.CreateEmbeddings(req)
+}
+
+func (p *providerRouter) Rerank(req RerankRequest) (*RerankResponse, error) {
+	return p.fallback.Rerank(req)
+}
+
+// scanModel returns the model of an encoded request
+func scanModel(body []byte) string {
+	var model string
+	scanObject(body, func(key []byte, start, end int) bool {
+		if string(key) != "model" {
+			return true
+		}
+		model, _ = jsonStringValue(body[start:end])
+		return false
+	})
+	return model
+}
+
+// azureBackend sends each model to its Azure OpenAI deployment
+type azureBackend struct {
+	deployments map[string]*RealOpenAIClient
+}
+
+func (a *azureBackend) deployment(model string) (*RealOpenAIClient, error) {
+	client, ok := a.deployments[model]
+	if !ok {
+		return nil, fmt.Errorf("no Azure OpenAI deployment for model %s", model)
+	}
+	return client, nil
+}
+
+func (a *azureBackend) CreateChatCompletionContext(ctx context.Context, req ChatCompletionRequest) (*ChatCompletionResponse, error) {
+	client, err := a.deployment(req.Model)
+	if err != nil {
+		return nil, err
+	}
+	return client.CreateChatCompletionContext(ctx, req)
+}
+
+func (a *azureBackend) CreateChatCompletionRaw(ctx context.Context, body []byte, out *bytes.Buffer) error {
+	client, err := a.deployment(scanModel(body))
+	if err != nil {
+		return err
+	}
+	return client.CreateChatCompletionRaw(ctx, body, out)
+}
+
+func (a *azureBackend) CreateChatCompletionStream(ctx context.Context, body []byte) (io.ReadCloser, error) {
+	client, err := a.deployment(scanModel(body))
+	if err != nil {
+		return nil, err
+	}
+	return client.CreateChatCompletionStream(ctx, body)
+}
+
+func (a *azureBackend) CreateEmbeddings(req EmbeddingRequest) (*EmbeddingResponse, error) {
+	client, err := a.deployment(req.Model)
+	if err != nil {
+		return nil, err
+	}
+	return client.CreateEmbeddings(req)
+}
+
+// newBackend creates the upstream of a provider, with its key read through
+// getenv and the quarantine, retries and recordings of fallback
+func (p Provider) newBackend(getenv func(string) string, fallback *RealOpenAIClient) (chatBackend, error) {
+	recorder, _ := fallback.HTTPClient.Transport.(*recordings)
+	var apiKey string
+	if p.APIKeyEnv != "" {
+		if apiKey = getenv(p.APIKeyEnv); apiKey == "" {
+			return nil, fmt.Errorf("provider %s: %s is not set", p.Name, p.APIKeyEnv)
+		}
+	}
+	openAI := func(baseURL string) *RealOpenAIClient {
+		client := NewRealOpenAIClient(apiKey)
+		client.BaseURL = strings.TrimSuffix(baseURL, "/")
+		client.Quarantine = fallback.Quarantine
+		client.Retry = fallback.Retry
+		if recorder != nil {
+			client.HTTPClient.Transport = recorder.wrap(client.HTTPClient.Transport)
+		}
+		return client
+	}
+	switch p.Type {
+	case ProviderOpenAI:
+		if p.BaseURL == "" {
+			return nil, fmt.Errorf("provider %s: base_url is required", p.Name)
+		}
+		return openAI(p.BaseURL), nil
+	case ProviderOllama:
+		baseURL := p.BaseURL
+		if baseURL == "" {
+			baseURL = "http://localhost:11434"
+		}
+		// Ollama serves the OpenAI API under /v1
+		return openAI(strings.TrimSuffix(baseURL, "/") + "/v1"), nil
+	case ProviderAzure:
+		if p.BaseURL == "" || p.APIVersion == "" || len(p.Deployments) == 0 {
+			return nil, fmt.Errorf("provider %s: base_url, api_version and deployments are required", p.Name)
+		}
+		azure := &azureBackend{deployments: make(map[string]*RealOpenAIClient)}
+		for model, deployment := range p.Deployments {
+			client := openAI(strings.TrimSuffix(p.BaseURL, "/") + "/openai/deployments/" + deployment)
+			client.APIVersion = p.APIVersion
+			azure.deployments[model] = client
+		}
+		return azure, nil
+	case ProviderAnthropic:
+		client := newAnthropicClient(apiKey)
+		if p.BaseURL != "" {
+			client.BaseURL = strings.TrimSuffix(p.BaseURL, "/")
+		}
+		if p.MaxTokens > 0 {
+			client.MaxTokens = p.MaxTokens
+		}
+		if recorder != nil {
+			client.HTTPClient.Transport = recorder.wrap(client.HTTPClient.Transport)
+		}
+		return client, nil
+	}
+	return nil, fmt.Errorf("provider %s: unknown type %q, expected openai, azure, ollama or anthropic", p.Name, p.Type)
+}
+
+// providerRouterFromEnv reads the providers of PROXY_PROVIDERS_FILE, a JSON
+// list tried in order, in front of fallback, and the fallbacks of
+// PROXY_FALLBACKS. It returns nil without either.
+func providerRouterFromEnv(fallback *RealOpenAIClient, getenv func(string) string) (*providerRouter, error) {
+	fallbacks, err := fallbacksFromEnv(getenv)
+	if err != nil {
+		return nil, err
+	}
+	path := getenv("PROXY_PROVIDERS_FILE")
+	if path == "" {
+		if len(fallbacks) == 0 {
+			return nil, nil
+		}
+		return &providerRouter{fallback: fallback, fallbacks: fallbacks}, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read providers file: %w", err)
+	}
+	var providers []Provider
+	if err := json.Unmarshal(data, &providers); err != nil {
+		return nil, fmt.Errorf("failed to parse providers file: %w", err)
+	}
+	router := &providerRouter{fallback: fallback, fallbacks: fallbacks}
+	for _, p := range providers {
+		if p.Name == "" {
+			return nil, fmt.Errorf("providers require a name")
+		}
+		backend, err := p.newBackend(getenv, fallback)
+		if err != nil {
+			return nil, err
+		}
+		if p.Quirks != nil {
+			if err := p.Quirks.validate(); err != nil {
+				return nil, fmt.Errorf("provider %s: %w", p.Name, err)
+			}
+		}
+		models := p.Models
+		if len(models) == 0 {
+			for model := range p.Deployments {
+				models = append(models, model)
+			}
+		}
+		if len(models) == 0 {
+			return nil, fmt.Errorf("provider %s serves no models", p.Name)
+		}
+		router.providers = append(router.providers, routedProvider{name: p.Name, models: models, backend: backend, quirks: p.Quirks})
+	}
+	return router, nil
+}
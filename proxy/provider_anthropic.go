@@ -0,0 +1,485 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// anthropicClient serves chat completions with the Anthropic Messages API,
+// translating OpenAI requests and replies, streamed or not
+type anthropicClient struct {
+	APIKey  string
+	BaseURL string
+	// Version is sent in the anthropic-version header
+	Version string
+	// MaxTokens is sent for requests without max_tokens
+	MaxTokens  int
+	HTTPClient *http.Client
+}
+
+func newAnthropicClient(apiKey string) *anthropicClient {
+	return &anthropicClient{
+		APIKey:     apiKey,
+		BaseURL:    "https://api.anthropic.com/v1",
+		Version:    "2023-06-01",
+		MaxTokens:  4096,
+		HTTPClient: &http.Client{Transport: upstreamTransport},
+	}
+}
+
+type anthropicRequest struct {
+	Model       string               `json:"model"`
+	System      string               `json:"system,omitempty"`
+	Messages    []anthropicMessage   `json:"messages"`
+	MaxTokens   int                  `json:"max_tokens"`
+	Temperature *float64             `json:"temperature,omitempty"`
+	TopP        *float64             `json:"top_p,omitempty"`
+	Stream      bool                 `json:"stream,omitempty"`
+	Tools       []anthropicTool      `json:"tools,omitempty"`
+	ToolChoice  *anthropicToolChoice `json:"tool_choice,omitempty"`
+	Metadata    *anthropicMetadata   `json:"metadata,omitempty"`
+}
+
+// anthropicMetadata carries the user field of OpenAI requests
+type anthropicMetadata struct {
+	UserID string `json:"user_id"`
+}
+
+type anthropicMessage struct {
+	Role    string           `json:"role"`
+	Content []anthropicBlock `json:"content"`
+}
+
+// anthropicBlock is a content block of any type: text, tool_use or
+// tool_result
+type anthropicBlock struct {
+	Type      string          `json:"type"`
+	Text      string          `json:"text,omitempty"`
+	ID        string          `json:"id,omitempty"`
+	Name      string          `json:"name,omitempty"`
+	Input     json.RawMessage `json:"input,omitempty"`
+	ToolUseID string          `json:"tool_use_id,omitempty"`
+	Content   string          `json:"content,omitempty"`
+	// Source is the image of an image block
+	Source *anthropicImageSource `json:"source,omitempty"`
+}
+
+// anthropicImageSource is an image by URL or, for data: URLs, its
+// base64-encoded data
+type anthropicImageSource struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type,omitempty"`
+	Data      string `json:"data,omitempty"`
+	URL       string `json:"url,omitempty"`
+}
+
+// anthropicImage translates an image_url part into an image block
+func anthropicImage(image *ImageURL) anthropicBlock {
+	if data, ok := strings.CutPrefix(image.URL, "data:"); ok {
+		if mediaType, encoded, ok := strings.Cut(data, ";base64,"); ok {
+			return anthropicBlock{Type: "image", Source: &anthropicImageSource{Type: "base64", MediaType: mediaType, Data: encoded}}
+		}
+	}
+	return anthropicBlock{Type: "image", Source: &anthropicImageSource{Type: "url", URL: image.URL}}
+}
+
+type anthropicTool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	InputSchema json.RawMessage `json:"input_schema"`
+}
+
+type anthropicToolChoice struct {
+	Type string `json:"type"`
+	Name string `json:"name,omitempty"`
+}
+
+type anthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+type anthropicResponse struct {
+	ID         string           `json:"id"`
+	Model      string           `json:"model"`
+	Content    []anthropicBlock `json:"content"`
+	StopReason string           `json:"stop_reason"`
+	Usage      anthropicUsage   `json:"usage"`
+}
+
+type anthropicError struct {
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// anthropicFinishReasons maps stop reasons to OpenAI finish reasons
+var anthropicFinishReasons = map[string]string{
+	"end_turn":      "stop",
+	"stop_sequence": "stop",
+	"max_tokens":    "length",
+	"tool_use":      "tool_calls",
+}
+
+// toAnthropic translates an OpenAI request. System messages become the
+// system prompt, tool results user turns, and consecutive turns of the same
+// role are merged, as Anthropic expects.
+func (c *anthropicClient) toAnthropic(req ChatCompletionRequest) anthropicRequest {
+	out := anthropicRequest{Model: req.Model, MaxTokens: c.MaxTokens, TopP: req.TopP}
+	if req.User != "" {
+		out.Metadata = &anthropicMetadata{UserID: req.User}
+	}
+	if req.MaxTokens != nil {
+		out.MaxTokens = *req.MaxTokens
+	}
+	if req.Temperature != nil {
+		// Anthropic temperatures range from 0 to 1 instead of 0 to 2
+		temperature := min(*req.Temperature, 1)
+		out.Temperature = &temperature
+	}
+	var system []string
+	for _, m := range req.Messages {
+		var role string
+		var blocks []anthropicBlock
+		switch m.Role {
+		case "system", "developer":
+			system = append(system, m.Content)
+			continue
+		case "tool":
+			role = "user"
+			blocks = append(blocks, anthropicBlock{Type: "tool_result", ToolUseID: m.ToolCallID, Content: m.Content})
+		default:
+			role = m.Role
+			// Of the parts, Anthropic takes text and images; audio and
+			// parts of other types are left out
+			for _, part := range m.Parts {
+				switch {
+				case part.Type == PartText && part.Text != "":
+					blocks = append(blocks, anthropicBlock{Type: "text", Text: part.Text})
+				case part.Type == PartImageURL && part.ImageURL != nil:
+					blocks = append(blocks, anthropicImage(part.ImageURL))
+				}
+			}
+			if m.Parts == nil && m.Content != "" {
+				blocks = append(blocks, anthropicBlock{Type: "text", Text: m.Content})
+			}
+			for _, call := range m.ToolCalls {
+				input := json.RawMessage(call.Function.Arguments)
+				if !json.Valid(input) {
+					input = json.RawMessage("{}")
+				}
+				blocks = append(blocks, anthropicBlock{Type: "tool_use", ID: call.ID, Name: call.Function.Name, Input: input})
+			}
+		}
+		if n := len(out.Messages); n > 0 && out.Messages[n-1].Role == role {
+			out.Messages[n-1].Content = append(out.Messages[n-1].Content, blocks...)
+			continue
+		}
+		out.Messages = append(out.Messages, anthropicMessage{Role: role, Content: blocks})
+	}
+	out.System = strings.Join(system, "\n\n")
+
+	for _, tool := range req.Tools {
+		schema := tool.Function.Parameters
+		if len(schema) == 0 {
+			schema = json.RawMessage(`{"type":"object","properties":{}}`)
+		}
+		out.Tools = append(out.Tools, anthropicTool{Name: tool.Function.Name, Description: tool.Function.Description, InputSchema: schema})
+	}
+	if len(req.ToolChoice) > 0 {
+		var mode string
+		var named struct {
+			Function struct {
+				Name string `json:"name"`
+			} `json:"function"`
+		}
+		switch {
+		case json.Unmarshal(req.ToolChoice, &mode) == nil:
+			switch mode {
+			case "auto":
+				out.ToolChoice = &anthropicToolChoice{Type: "auto"}
+			case "required":
+				out.ToolChoice = &anthropicToolChoice{Type: "any"}
+			case "none":
+				out.Tools = nil
+			}
+		case json.Unmarshal(req.ToolChoice, &named) == nil && named.Function.Name != "":
+			out.ToolChoice = &anthropicToolChoice{Type: "tool", Name: named.Function.Name}
+		}
+	}
+	return out
+}
+
+// fromAnthropic translates a reply
+func fromAnthropic(resp anthropicResponse) *ChatCompletionResponse {
+	msg := Message{Role: "assistant"}
+	for _, block := range resp.Content {
+		switch block.Type {
+		case "text":
+			msg.Content += block.Text
+		case "tool_use":
+			msg.ToolCalls = append(msg.ToolCalls, ToolCall{
+				ID:       block.ID,
+				Type:     "function",
+				Function: ToolCallFunction{Name: block.Name, Arguments: string(block.Input)},
+			})
+		}
+	}
+	return &ChatCompletionResponse{
+		ID:      resp.ID,
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   resp.Model,
+		Choices: []Choice{{Message: msg, FinishReason: anthropicFinishReasons[resp.StopReason]}},
+		Usage: Usage{
+			PromptTokens:     resp.Usage.InputTokens,
+			CompletionTokens: resp.Usage.OutputTokens,
+			TotalTokens:      resp.Usage.InputTokens + resp.Usage.OutputTokens,
+		},
+	}
+}
+
+// send posts a translated request to the messages API and returns the
+// response once its status is 200
+func (c *anthropicClient) send(ctx context.Context, req anthropicRequest) (*http.Response, error) {
+	jsonData, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", c.BaseURL+"/messages", bytes.NewReader(jsonData))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("x-api-key", c.APIKey)
+	httpReq.Header.Set("anthropic-version", c.Version)
+	if echo := debugEchoFromContext(ctx); echo != nil {
+		echo.capture(httpReq, jsonData)
+		return nil, errUpstreamEchoed
+	}
+
+	sp := traceUpstream(httpReq)
+	resp, err := c.HTTPClient.Do(httpReq)
+	endUpstream(sp, resp, err)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read response: %w", err)
+		}
+		var errorResp anthropicError
+		if err := json.Unmarshal(body, &errorResp); err != nil || errorResp.Error.Message == "" {
+			return nil, fmt.Errorf("API error (status %d): %s", resp.StatusCode, body)
+		}
+		return nil, fmt.Errorf("API error: %s", errorResp.Error.Message)
+	}
+	return resp, nil
+}
+
+func (c *anthropicClient) CreateChatCompletion(req ChatCompletionRequest) (*ChatCompletionResponse, error) {
+	return c.CreateChatCompletionContext(context.Background(), req)
+}
+
+func (c *anthropicClient) CreateChatCompletionContext(ctx context.Context, req ChatCompletionRequest) (*ChatCompletionResponse, error) {
+	resp, err := c.send(ctx, c.toAnthropic(req))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var reply anthropicResponse
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+	return fromAnthropic(reply), nil
+}
+
+// CreateChatCompletionRaw decodes body, since it has to be translated anyway
+func (c *anthropicClient) CreateChatCompletionRaw(ctx context.Context, body []byte, out *bytes.Buffer) error {
+	var req ChatCompletionRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return fmt.Errorf("failed to unmarshal request: %w", err)
+	}
+	resp, err := c.CreateChatCompletionContext(ctx, req)
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(out).Encode(resp)
+}
+
+// CreateChatCompletionStream translates the events of an Anthropic stream
+// into chat.completion.chunk events as they arrive
+func (c *anthropicClient) CreateChatCompletionStream(ctx context.Context, body []byte) (io.ReadCloser, error) {
+	var req ChatCompletionRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal request: %w", err)
+	}
+	areq := c.toAnthropic(req)
+	areq.Stream = true
+	resp, err := c.send(ctx, areq)
+	if err != nil {
+		return nil, err
+	}
+	includeUsage := req.StreamOptions != nil && req.StreamOptions.IncludeUsage
+	pr, pw := io.Pipe()
+	go func() {
+		defer resp.Body.Close()
+		pw.CloseWithError(translateAnthropicStream(pw, resp.Body, req.Model, includeUsage))
+	}()
+	return pr, nil
+}
+
+type chatCompletionChunk struct {
+	ID      string        `json:"id"`
+	Object  string        `json:"object"`
+	Created int64         `json:"created"`
+	Model   string        `json:"model"`
+	Choices []chunkChoice `json:"choices"`
+	Usage   *Usage        `json:"usage,omitempty"`
+}
+
+type chunkChoice struct {
+	Index        int        `json:"index"`
+	Delta        chunkDelta `json:"delta"`
+	FinishReason *string    `json:"finish_reason"`
+}
+
+type chunkDelta struct {
+	Role      string          `json:"role,omitempty"`
+	Content   string          `json:"content,omitempty"`
+	ToolCalls []chunkToolCall `json:"tool_calls,omitempty"`
+}
+
+type chunkToolCall struct {
+	Index    int           `json:"index"`
+	ID       string        `json:"id,omitempty"`
+	Type     string        `json:"type,omitempty"`
+	Function chunkFunction `json:"function"`
+}
+
+type chunkFunction struct {
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments"`
+}
+
+// anthropicEvent is the data of any event of an Anthropic stream
+type anthropicEvent struct {
+	Type         string            `json:"type"`
+	Index        int               `json:"index"`
+	Message      anthropicResponse `json:"message"`
+	ContentBlock anthropicBlock    `json:"content_block"`
+	Delta        struct {
+		Type        string `json:"type"`
+		Text        string `json:"text"`
+		PartialJSON string `json:"partial_json"`
+		StopReason  string `json:"stop_reason"`
+	} `json:"delta"`
+	Usage anthropicUsage `json:"usage"`
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// translateAnthropicStream writes the events of an Anthropic stream to w as
+// chat.completion.chunk events ending with "data: [DONE]", with a last
+// chunk carrying the usage if includeUsage is set
+func translateAnthropicStream(w io.Writer, stream io.Reader, model string, includeUsage bool) error {
+	chunk := chatCompletionChunk{Object: "chat.completion.chunk", Created: time.Now().Unix(), Model: model}
+	var usage Usage
+	// toolIndex numbers the tool_use blocks by content block index
+	toolIndex := make(map[int]int)
+	emit := func(delta chunkDelta, finish *string) error {
+		chunk.Choices = []chunkChoice{{Delta: delta, FinishReason: finish}}
+		data, err := json.Marshal(chunk)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "data: %s\n\n", data)
+		return err
+	}
+
+	in := bufio.NewReader(stream)
+	for {
+		line, err := in.ReadBytes('\n')
+		if payload, ok := bytes.CutPrefix(bytes.TrimSpace(line), []byte("data:")); ok {
+			var event anthropicEvent
+			if err := json.Unmarshal(bytes.TrimSpace(payload), &event); err != nil {
+				return fmt.Errorf("failed to unmarshal event: %w", err)
+			}
+			var emitErr error
+			switch event.Type {
+			case "message_start":
+				chunk.ID = event.Message.ID
+				if event.Message.Model != "" {
+					chunk.Model = event.Message.Model
+				}
+				usage.PromptTokens = event.Message.Usage.InputTokens
+				emitErr = emit(chunkDelta{Role: "assistant"}, nil)
+			case "content_block_start":
+				if event.ContentBlock.Type == "tool_use" {
+					index := len(toolIndex)
+					toolIndex[event.Index] = index
+					emitErr = emit(chunkDelta{ToolCalls: []chunkToolCall{{
+						Index: index, ID: event.ContentBlock.ID, Type: "function",
+						Function: chunkFunction{Name: event.ContentBlock.Name},
+					}}}, nil)
+				}
+			case "content_block_delta":
+				switch event.Delta.Type {
+				case "text_delta":
+					emitErr = emit(chunkDelta{Content: event.Delta.Text}, nil)
+				case "input_json_delta":
+					emitErr = emit(chunkDelta{ToolCalls: []chunkToolCall{{
+						Index: toolIndex[event.Index], Function: chunkFunction{Arguments: event.Delta.PartialJSON},
+					}}}, nil)
+				}
+			case "message_delta":
+				usage.CompletionTokens = event.Usage.OutputTokens
+				if event.Delta.StopReason != "" {
+					finish := anthropicFinishReasons[event.Delta.StopReason]
+					emitErr = emit(chunkDelta{}, &finish)
+				}
+			case "error":
+				var resp ErrorResponse
+				resp.Error.Message = event.Error.Message
+				resp.Error.Type = event.Error.Type
+				data, _ := json.Marshal(resp)
+				_, emitErr = fmt.Fprintf(w, "data: %s\n\n", data)
+			}
+			if emitErr != nil {
+				return emitErr
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if includeUsage {
+		usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+		chunk.Choices = []chunkChoice{}
+		chunk.Usage = &usage
+		data, err := json.Marshal(chunk)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "data: [DONE]\n\n")
+	return err
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAnthropicClient_TranslatesRequestAndReply(t *testing.T) {
+	var got anthropicRequest
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/messages" || r.Header.Get("x-api-key") != "sk-ant" || r.Header.Get("anthropic-version") == "" {
+			t.Errorf("Unexpected request %s %v", r.URL.Path, r.Header)
+		}
+		json.NewDecoder(r.Body).Decode(&got)
+		fmt.Fprint(w, `{"id": "msg_1", "model": "claude-sonnet-4", "stop_reason": "tool_use",
+			"content": [{"type": "text", "text": "Checking."}, {"type": "tool_use", "id": "toolu_1", "name": "weather", "input": {"city": "Paris"}}],
+			"usage": {"input_tokens": 10, "output_tokens": 5}}`)
+	}))
+	defer api.Close()
+	client := newAnthropicClient("sk-ant")
+	client.BaseURL = api.URL
+
+	temperature := 1.5
+	req := ChatCompletionRequest{
+		Model:       "claude-sonnet-4",
+		Temperature: &temperature,
+		Messages: []Message{
+			{Role: "system", Content: "Be brief."},
+			{Role: "user", Content: "Weather in Paris?"},
+			{Role: "assistant", ToolCalls: []ToolCall{{ID: "toolu_0", Type: "function", Function: ToolCallFunction{Name: "weather", Arguments: `{"city":"Paris"}`}}}},
+			{Role: "tool", ToolCallID: "toolu_0", Content: "Sunny"},
+			{Role: "user", Content: "And tomorrow?"},
+		},
+		Tools:      []Tool{{Type: "function", Function: ToolFunction{Name: "weather", Parameters: json.RawMessage(`{"type":"object"}`)}}},
+		ToolChoice: json.RawMessage(`"required"`),
+	}
+	resp, err := client.CreateChatCompletion(req)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if got.System != "Be brief." || got.MaxTokens != 4096 || *got.Temperature != 1 {
+		t.Errorf("Unexpected system, max_tokens or temperature: %+v", got)
+	}
+	if len(got.Messages) != 3 || got.Messages[2].Role != "user" || len(got.Messages[2].Content) != 2 {
+		t.Fatalf("Expected the tool result and next question merged into one user turn, got %+v", got.Messages)
+	}
+	if got.Messages[1].Content[0].Type != "tool_use" || got.Messages[2].Content[0].ToolUseID != "toolu_0" {
+		t.Errorf("Unexpected tool turns %+v", got.Messages)
+	}
+	if len(got.Tools) != 1 || got.ToolChoice == nil || got.ToolChoice.Type != "any" {
+		t.Errorf("Unexpected tools %+v and choice %+v", got.Tools, got.ToolChoice)
+	}
+
+	choice := resp.Choices[0]
+	if choice.Message.Content != "Checking." || choice.FinishReason != "tool_calls" {
+		t.Errorf("Unexpected choice %+v", choice)
+	}
+	if len(choice.Message.ToolCalls) != 1 || choice.Message.ToolCalls[0].Function.Arguments != `{"city": "Paris"}` {
+		t.Errorf("Unexpected tool calls %+v", choice.Message.ToolCalls)
+	}
+	if resp.Usage != (Usage{PromptTokens: 10, CompletionTokens: 5, TotalTokens: 15}) {
+		t.Errorf("Unexpected usage %+v", resp.Usage)
+	}
+}
+
+func TestAnthropicClient_Error(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprint(w, `{"type": "error", "error": {"type": "rate_limit_error", "message": "Slow down"}}`)
+	}))
+	defer api.Close()
+	client := newAnthropicClient("sk-ant")
+	client.BaseURL = api.URL
+
+	_, err := client.CreateChatCompletion(createTestChatCompletionRequest())
+	if err == nil || err.Error() != "API error: Slow down" {
+		t.Errorf("Expected the Anthropic error message, got %v", err)
+	}
+}
+
+func TestTranslateAnthropicStream(t *testing.T) {
+	events := strings.Join([]string{
+		`event: message_start`,
+		`data: {"type": "message_start", "message": {"id": "msg_1", "model": "claude-sonnet-4", "usage": {"input_tokens": 10, "output_tokens": 1}}}`,
+		``,
+		`event: content_block_start`,
+		`data: {"type": "content_block_start", "index": 0, "content_block": {"type": "text", "text": ""}}`,
+		``,
+		`data: {"type": "content_block_delta", "index": 0, "delta": {"type": "text_delta", "text": "Hello"}}`,
+		``,
+		`data: {"type": "content_block_start", "index": 1, "content_block": {"type": "tool_use", "id": "toolu_1", "name": "weather", "input": {}}}`,
+		``,
+		`data: {"type": "content_block_delta", "index": 1, "delta": {"type": "input_json_delta", "partial_json": "{\"city\""}}`,
+		``,
+		`event: ping`,
+		`data: {"type": "ping"}`,
+		``,
+		`data: {"type": "message_delta", "delta": {"stop_reason": "tool_use"}, "usage": {"output_tokens": 7}}`,
+		``,
+		`data: {"type": "message_stop"}`,
+		``,
+	}, "\n")
+
+	var out bytes.Buffer
+	if err := translateAnthropicStream(&out, strings.NewReader(events), "claude", true); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	var chunks []chatCompletionChunk
+	for _, line := range strings.Split(out.String(), "\n") {
+		payload, ok := strings.CutPrefix(line, "data: ")
+		if !ok || payload == "[DONE]" {
+			continue
+		}
+		var chunk chatCompletionChunk
+		if err := json.Unmarshal([]byte(payload), &chunk); err != nil {
+			t.Fatalf("Invalid chunk %s: %v", payload, err)
+		}
+		chunks = append(chunks, chunk)
+	}
+	if !strings.HasSuffix(out.String(), "data: [DONE]\n\n") {
+		t.Errorf("Expected the stream to end with [DONE], got %q", out.String())
+	}
+	if len(chunks) != 6 {
+		t.Fatalf("Expected 6 chunks, got %d: %s", len(chunks), out.String())
+	}
+	if chunks[0].ID != "msg_1" || chunks[0].Object != "chat.completion.chunk" || chunks[0].Choices[0].Delta.Role != "assistant" {
+		t.Errorf("Unexpected first chunk %+v", chunks[0])
+	}
+	if chunks[1].Choices[0].Delta.Content != "Hello" {
+		t.Errorf("Expected the text delta, got %+v", chunks[1])
+	}
+	if call := chunks[2].Choices[0].Delta.ToolCalls[0]; call.ID != "toolu_1" || call.Function.Name != "weather" {
+		t.Errorf("Expected the tool call to start, got %+v", call)
+	}
+	if call := chunks[3].Choices[0].Delta.ToolCalls[0]; call.Index != 0 || call.Function.Arguments != `{"city"` {
+		t.Errorf("Expected the arguments delta, got %+v", call)
+	}
+	if finish := chunks[4].Choices[0].FinishReason; finish == nil || *finish != "tool_calls" {
+		t.Errorf("Expected finish reason tool_calls, got %v", finish)
+	}
+	if usage := chunks[5].Usage; usage == nil || *usage != (Usage{PromptTokens: 10, CompletionTokens: 7, TotalTokens: 17}) {
+		t.Errorf("Unexpected usage %+v", usage)
+	}
+}
+
+func TestToAnthropic_ContentParts(t *testing.T) {
+	var m Message
+	json.Unmarshal([]byte(visionMessage), &m)
+	m.Parts = append(m.Parts, ContentPart{Type: PartImageURL, ImageURL: &ImageURL{URL: "data:image/png;base64,iVBORw0KGgo="}})
+	got := newAnthropicClient("sk-ant").toAnthropic(ChatCompletionRequest{Model: "claude-sonnet-4", Messages: []Message{m}})
+
+	if len(got.Messages) != 1 || len(got.Messages[0].Content) != 3 {
+		t.Fatalf("Expected the text and both images, without audio or files, got %+v", got.Messages)
+	}
+	blocks := got.Messages[0].Content
+	if blocks[0].Type != "text" || blocks[0].Text != "What is this?" {
+		t.Errorf("Unexpected text block %+v", blocks[0])
+	}
+	if src := blocks[1].Source; blocks[1].Type != "image" || src == nil || src.Type != "url" || src.URL != "https://example.com/cat.png" {
+		t.Errorf("Expected an image by URL, got %+v", blocks[1])
+	}
+	if src := blocks[2].Source; src == nil || src.Type != "base64" || src.MediaType != "image/png" || src.Data != "iVBORw0KGgo=" {
+		t.Errorf("Expected the data URL as base64 data, got %+v", blocks[2])
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// OpenAI-compatible servers differ in what they accept: some reject a
+// temperature of 0, some require max_tokens, some cap the messages of a
+// conversation or refuse parameters they do not know. A provider's quirks
+// rewrite requests on their way to it, so one client payload works
+// whichever backend a model is routed to.
+
+// ProviderQuirks adapt requests to what a provider accepts
+type ProviderQuirks struct {
+	// MinTemperature raises lower temperatures, e.g. 0.01 for providers
+	// rejecting 0, and MaxTemperature caps higher ones
+	MinTemperature *float64 `json:"min_temperature,omitempty"`
+	MaxTemperature *float64 `json:"max_temperature,omitempty"`
+	// MaxTokens is sent when the request does not set max_tokens
+	MaxTokens int `json:"max_tokens,omitempty"`
+	// MaxMessages keeps the system messages and the latest others of longer
+	// conversations
+	MaxMessages int `json:"max_messages,omitempty"`
+	// DropParams are removed from requests and RenameParams renamed, e.g.
+	// {"max_tokens": "max_completion_tokens"}, after the other quirks apply
+	DropParams   []string          `json:"drop_params,omitempty"`
+	RenameParams map[string]string `json:"rename_params,omitempty"`
+}
+
+func (q *ProviderQuirks) validate() error {
+	if q.MinTemperature != nil && q.MaxTemperature != nil && *q.MinTemperature > *q.MaxTemperature {
+		return fmt.Errorf("min_temperature is above max_temperature")
+	}
+	if q.MaxTokens < 0 || q.MaxMessages < 0 {
+		return fmt.Errorf("max_tokens and max_messages must not be negative")
+	}
+	return nil
+}
+
+// apply rewrites an encoded chat completion request
+func (q *ProviderQuirks) apply(body []byte) ([]byte, error) {
+	var req map[string]json.RawMessage
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, fmt.Errorf("failed to parse request: %w", err)
+	}
+	if v, ok := req["temperature"]; ok && string(v) != "null" {
+		var temperature float64
+		if err := json.Unmarshal(v, &temperature); err == nil {
+			if q.MinTemperature != nil && temperature < *q.MinTemperature {
+				temperature = *q.MinTemperature
+			}
+			if q.MaxTemperature != nil && temperature > *q.MaxTemperature {
+				temperature = *q.MaxTemperature
+			}
+			req["temperature"], _ = json.Marshal(temperature)
+		}
+	}
+	if v, ok := req["max_tokens"]; q.MaxTokens > 0 && (!ok || string(v) == "null") {
+		req["max_tokens"], _ = json.Marshal(q.MaxTokens)
+	}
+	if q.MaxMessages > 0 {
+		var messages []json.RawMessage
+		if err := json.Unmarshal(req["messages"], &messages); err == nil && len(messages) > q.MaxMessages {
+			req["messages"], _ = json.Marshal(trimMessages(messages, q.MaxMessages))
+		}
+	}
+	for _, name := range q.DropParams {
+		delete(req, name)
+	}
+	for from, to := range q.RenameParams {
+		if v, ok := req[from]; ok {
+			delete(req, from)
+			req[to] = v
+		}
+	}
+	return json.Marshal(req)
+}
+
+// trimMessages drops the oldest messages other than system messages until
+// at most limit remain, keeping at least the last one. Tool results left
+// without the call they answer are dropped as well.
+func trimMessages(messages []json.RawMessage, limit int) []json.RawMessage {
+	others := 0
+	for _, m := range messages {
+		if !isSystemRole(messageRole(m)) {
+			others++
+		}
+	}
+	drop := min(len(messages)-limit, others-1)
+	trimming := drop > 0
+	kept := make([]json.RawMessage, 0, len(messages))
+	for _, m := range messages {
+		role := messageRole(m)
+		switch {
+		case isSystemRole(role):
+		case drop > 0:
+			drop--
+			continue
+		case trimming && role == "tool":
+			continue
+		default:
+			trimming = false
+		}
+		kept = append(kept, m)
+	}
+	return kept
+}
+
+func isSystemRole(role string) bool {
+	return role == "system" || role == "developer"
+}
+
+// messageRole returns the role of an encoded message
+func messageRole(message []byte) string {
+	var role string
+	scanObject(message, func(key []byte, start, end int) bool {
+		if string(key) != "role" {
+			return true
+		}
+		role, _ = jsonStringValue(message[start:end])
+		return false
+	})
+	return role
+}
+
+// createWithQuirks sends a typed request through the raw path of backend,
+// since quirks may rename parameters ChatCompletionRequest does not have
+func createWithQuirks(ctx context.Context, backend chatBackend, quirks *ProviderQuirks, req ChatCompletionRequest) (*ChatCompletionResponse, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+	if body, err = quirks.apply(body); err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	if err := backend.CreateChatCompletionRaw(ctx, body, &out); err != nil {
+		return nil, err
+	}
+	var resp ChatCompletionResponse
+	if err := json.Unmarshal(out.Bytes(), &resp); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+	return &resp, nil
+}
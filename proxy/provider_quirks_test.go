@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestProviderQuirks_Apply(t *testing.T) {
+	low, high := 0.01, 1.0
+	quirks := &ProviderQuirks{
+		MinTemperature: &low,
+		MaxTemperature: &high,
+		MaxTokens:      1024,
+		MaxMessages:    5,
+		DropParams:     []string{"seed"},
+		RenameParams:   map[string]string{"max_tokens": "max_completion_tokens"},
+	}
+	body, err := quirks.apply([]byte(`{"model": "m", "temperature": 0, "seed": 7, "messages": [
+		{"role": "system", "content": "Be brief"},
+		{"role": "user", "content": "one"},
+		{"role": "assistant", "tool_calls": [{"id": "c1"}]},
+		{"role": "tool", "tool_call_id": "c1", "content": "42"},
+		{"role": "user", "content": "two"},
+		{"role": "assistant", "content": "three"},
+		{"role": "user", "content": "four"}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var req struct {
+		Temperature         float64 `json:"temperature"`
+		MaxCompletionTokens int     `json:"max_completion_tokens"`
+		MaxTokens           *int    `json:"max_tokens"`
+		Seed                *int    `json:"seed"`
+		Messages            []struct {
+			Content string `json:"content"`
+		} `json:"messages"`
+	}
+	json.Unmarshal(body, &req)
+	if req.Temperature != 0.01 || req.MaxCompletionTokens != 1024 || req.MaxTokens != nil || req.Seed != nil {
+		t.Errorf("Expected the quirks to apply, got %s", body)
+	}
+	var contents []string
+	for _, m := range req.Messages {
+		contents = append(contents, m.Content)
+	}
+	if want := []string{"Be brief", "two", "three", "four"}; !reflect.DeepEqual(contents, want) {
+		t.Errorf("Expected messages %v, got %v", want, contents)
+	}
+
+	body, _ = quirks.apply([]byte(`{"temperature": 1.5, "max_tokens": 10, "messages": []}`))
+	if !strings.Contains(string(body), `"temperature":1`) || !strings.Contains(string(body), `"max_completion_tokens":10`) {
+		t.Errorf("Expected the temperature capped and max_tokens kept, got %s", body)
+	}
+}
+
+func TestTrimMessages_DropsOrphanedToolResults(t *testing.T) {
+	messages := []json.RawMessage{
+		json.RawMessage(`{"role": "assistant", "tool_calls": [{"id": "c1"}]}`),
+		json.RawMessage(`{"role": "tool", "tool_call_id": "c1"}`),
+		json.RawMessage(`{"role": "user", "content": "next"}`),
+	}
+	kept := trimMessages(messages, 2)
+	if len(kept) != 1 || messageRole(kept[0]) != "user" {
+		t.Errorf("Expected only the user message to remain, got %s", kept)
+	}
+}
+
+func TestProviderRouter_AppliesQuirks(t *testing.T) {
+	var bodies []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		json.NewEncoder(w).Encode(createTestChatCompletionResponse())
+	}))
+	defer upstream.Close()
+	path := writeProvidersFile(t, `[{"name": "local", "type": "openai", "base_url": "`+upstream.URL+`", "models": ["llama*"],
+		"quirks": {"min_temperature": 0.01, "max_tokens": 512}}]`)
+	fallback := NewRealOpenAIClient("sk-openai")
+	fallback.BaseURL = upstream.URL
+	router, err := providerRouterFromEnv(fallback, func(name string) string {
+		if name == "PROXY_PROVIDERS_FILE" {
+			return path
+		}
+		return ""
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewProxyServer(router)
+
+	for _, model := range []string{"llama3", "gpt-4o"} {
+		body := `{"model": "` + model + `", "temperature": 0, "messages": [{"role": "user", "content": "Hi"}]}`
+		w := httptest.NewRecorder()
+		server.handleChatCompletions(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected status code %d, got %d: %s", model, http.StatusOK, w.Code, w.Body.String())
+		}
+	}
+	if len(bodies) != 2 {
+		t.Fatalf("Expected 2 upstream requests, got %d", len(bodies))
+	}
+	if !strings.Contains(bodies[0], `"temperature":0.01`) || !strings.Contains(bodies[0], `"max_tokens":512`) {
+		t.Errorf("Expected the provider's quirks to apply, got %s", bodies[0])
+	}
+	if strings.Contains(bodies[1], "0.01") || strings.Contains(bodies[1], "512") {
+		t.Errorf("Expected OpenAI requests to be left alone, got %s", bodies[1])
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// recordingUpstream answers chat completions and remembers the last request
+// and its body
+type recordingUpstream struct {
+	*httptest.Server
+	last *http.Request
+	body string
+}
+
+func newRecordingUpstream(t *testing.T) *recordingUpstream {
+	t.Helper()
+	u := &recordingUpstream{}
+	u.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u.last = r
+		body, _ := io.ReadAll(r.Body)
+		u.body = string(body)
+		json.NewEncoder(w).Encode(createTestChatCompletionResponse())
+	}))
+	t.Cleanup(u.Close)
+	return u
+}
+
+func writeProvidersFile(t *testing.T, providers string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "providers.json")
+	if err := os.WriteFile(path, []byte(providers), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestProviderRouter_RoutesByModel(t *testing.T) {
+	openai, azure, ollama := newRecordingUpstream(t), newRecordingUpstream(t), newRecordingUpstream(t)
+	path := writeProvidersFile(t, `[
+		{"name": "azure", "type": "azure", "base_url": "`+azure.URL+`", "api_key_env": "AZURE_KEY", "api_version": "2024-06-01", "deployments": {"gpt-4o": "prod-gpt4o"}},
+		{"name": "local", "type": "ollama", "base_url": "`+ollama.URL+`", "models": ["llama3*"]}
+	]`)
+	env := map[string]string{"PROXY_PROVIDERS_FILE": path, "AZURE_KEY": "azure-secret"}
+	fallback := NewRealOpenAIClient("sk-openai")
+	fallback.BaseURL = openai.URL
+	router, err := providerRouterFromEnv(fallback, func(name string) string { return env[name] })
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	server := NewProxyServer(router)
+
+	send := func(model string) {
+		t.Helper()
+		body := `{"model": "` + model + `", "messages": [{"role": "user", "content": "Hi"}]}`
+		w := httptest.NewRecorder()
+		server.handleChatCompletions(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected status code %d, got %d: %s", model, http.StatusOK, w.Code, w.Body.String())
+		}
+	}
+
+	send("gpt-4o")
+	if azure.last == nil || azure.last.URL.Path != "/openai/deployments/prod-gpt4o/chat/completions" {
+		t.Fatalf("Expected gpt-4o to go to its Azure deployment, got %v", azure.last)
+	}
+	if azure.last.URL.Query().Get("api-version") != "2024-06-01" || azure.last.Header.Get("api-key") != "azure-secret" {
+		t.Errorf("Expected Azure authentication, got %s and %v", azure.last.URL.RawQuery, azure.last.Header)
+	}
+
+	send("llama3.1:8b")
+	if ollama.last == nil || ollama.last.URL.Path != "/v1/chat/completions" || ollama.last.Header.Get("Authorization") != "" {
+		t.Errorf("Expected llama3 to go to Ollama without a key, got %v", ollama.last)
+	}
+
+	send("gpt-4o-mini")
+	if openai.last == nil || openai.last.Header.Get("Authorization") != "Bearer sk-openai" {
+		t.Errorf("Expected other models to go to OpenAI, got %v", openai.last)
+	}
+}
+
+func TestProviderRouterFromEnv_Errors(t *testing.T) {
+	tests := []struct {
+		name      string
+		providers string
+		want      string
+	}{
+		{"unknown type", `[{"name": "x", "type": "bedrock", "models": ["*"]}]`, "unknown type"},
+		{"missing key", `[{"name": "claude", "type": "anthropic", "api_key_env": "ANTHROPIC_API_KEY", "models": ["claude-*"]}]`, "ANTHROPIC_API_KEY is not set"},
+		{"no models", `[{"name": "local", "type": "ollama"}]`, "serves no models"},
+		{"azure without deployments", `[{"name": "azure", "type": "azure", "base_url": "https://x", "api_version": "v"}]`, "deployments are required"},
+		{"inverted temperatures", `[{"name": "local", "type": "ollama", "models": ["*"], "quirks": {"min_temperature": 1, "max_temperature": 0.5}}]`, "min_temperature is above"},
+	}
+	for _, tt := range tests {
+		path := writeProvidersFile(t, tt.providers)
+		getenv := func(name string) string {
+			if name == "PROXY_PROVIDERS_FILE" {
+				return path
+			}
+			return ""
+		}
+		if _, err := providerRouterFromEnv(NewRealOpenAIClient("sk"), getenv); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: expected error containing %q, got %v", tt.name, tt.want, err)
+		}
+	}
+}
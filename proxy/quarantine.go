@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Some OpenAI-compatible upstreams answer 200 with bodies the API never
+// returns: truncated JSON, HTML error pages or fields of the wrong type.
+// Replies are checked against the schema of their endpoint before they are
+// decoded or passed through; a malformed one is quarantined for debugging
+// and the request retried once.
+
+var (
+	usageSchema = `{"type": ["object", "null"], "properties": {
+		"prompt_tokens": {"type": "integer"},
+		"completion_tokens": {"type": "integer"},
+		"total_tokens": {"type": "integer"}
+	}}`
+	chatCompletionSchema = mustCompileJSONSchema(`{
+		"type": "object",
+		"required": ["choices"],
+		"properties": {
+			"id": {"type": ["string", "null"]},
+			"model": {"type": ["string", "null"]},
+			"created": {"type": ["integer", "null"]},
+			"choices": {"type": "array", "items": {
+				"type": "object",
+				"required": ["message"],
+				"properties": {
+					"index": {"type": "integer"},
+					"finish_reason": {"type": ["string", "null"]},
+					"message": {"type": "object", "properties": {
+						"role": {"type": ["string", "null"]},
+						"content": {"type": ["string", "null"]},
+						"tool_calls": {"type": ["array", "null"], "items": {
+							"type": "object",
+							"required": ["function"],
+							"properties": {
+								"id": {"type": "string"},
+								"type": {"type": "string"},
+								"function": {"type": "object", "properties": {
+									"name": {"type": "string"},
+									"arguments": {"type": "string"}
+								}}
+							}
+						}}
+					}}
+				}
+			}},
+			"usage": ` + usageSchema + `
+		}
+	}`)
+	embeddingsSchema = mustCompileJSONSchema(`{
+		"type": "object",
+		"required": ["data"],
+		"properties": {
+			"model": {"type": ["string", "null"]},
+			"data": {"type": "array", "items": {
+				"type": "object",
+				"required": ["embedding"],
+				"properties": {
+					"index": {"type": "integer"},
+					"embedding": {"type": ["array", "string"], "items": {"type": "number"}}
+				}
+			}},
+			"usage": ` + usageSchema + `
+		}
+	}`)
+	rerankSchema = mustCompileJSONSchema(`{
+		"type": "object",
+		"required": ["results"],
+		"properties": {
+			"results": {"type": "array", "items": {
+				"type": "object",
+				"required": ["index", "relevance_score"],
+				"properties": {
+					"index": {"type": "integer", "minimum": 0},
+					"relevance_score": {"type": "number"},
+					"document": {"type": ["object", "null"], "properties": {"text": {"type": "string"}}}
+				}
+			}},
+			"usage": ` + usageSchema + `
+		}
+	}`)
+)
+
+func mustCompileJSONSchema(schema string) *compiledSchema {
+	c, err := compileJSONSchema([]byte(schema))
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// malformedResponseError is returned when an upstream reply is still
+// malformed after the retry
+type malformedResponseError struct {
+	path string
+	err  error
+}
+
+func (e *malformedResponseError) Error() string {
+	return fmt.Sprintf("upstream returned a malformed %s response: %v", e.path, e.err)
+}
+
+func (e *malformedResponseError) Unwrap() error { return e.err }
+
+// QuarantinedResponse is a malformed upstream reply kept for debugging
+type QuarantinedResponse struct {
+	Time    time.Time `json:"time"`
+	Path    string    `json:"path"`
+	Reason  string    `json:"reason"`
+	Payload string    `json:"payload"`
+}
+
+// quarantinePayloadLimit bounds the payloads kept in memory; files keep
+// them whole
+const quarantinePayloadLimit = 64 << 10
+
+// responseQuarantine keeps the latest malformed replies in memory and,
+// with a directory, writes every one of them to a file of its own
+type responseQuarantine struct {
+	dir string
+	max int
+
+	mu      sync.Mutex
+	entries []QuarantinedResponse
+}
+
+func newResponseQuarantine(dir string, max int) *responseQuarantine {
+	return &responseQuarantine{dir: dir, max: max}
+}
+
+// quarantineFromEnv configures the quarantine from PROXY_QUARANTINE_DIR and
+// PROXY_QUARANTINE_MAX, how many replies are kept in memory
+func quarantineFromEnv(getenv func(string) string) (*responseQuarantine, error) {
+	dir, max := getenv("PROXY_QUARANTINE_DIR"), 100
+	if v := getenv("PROXY_QUARANTINE_MAX"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid PROXY_QUARANTINE_MAX %q", v)
+		}
+		max = n
+	}
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, fmt.Errorf("invalid PROXY_QUARANTINE_DIR %q: %v", dir, err)
+		}
+	}
+	return newResponseQuarantine(dir, max), nil
+}
+
+// Add quarantines a copy of payload. Failing to write it is logged, since
+// the request it belongs to has already failed for a better reason.
+func (q *responseQuarantine) Add(path string, payload []byte, reason error) {
+	if q == nil {
+		return
+	}
+	entry := QuarantinedResponse{Time: time.Now().UTC(), Path: path, Reason: reason.Error(), Payload: string(payload)}
+	log.Printf("Quarantined malformed upstream %s response: %v", path, reason)
+	if q.dir != "" {
+		data, _ := json.Marshal(entry)
+		name := filepath.Join(q.dir, fmt.Sprintf("%d.json", entry.Time.UnixNano()))
+		if err := os.WriteFile(name, data, 0o644); err != nil {
+			log.Printf("Failed to write quarantined response: %v", err)
+		}
+	}
+	if len(entry.Payload) > quarantinePayloadLimit {
+		entry.Payload = entry.Payload[:quarantinePayloadLimit]
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.entries = append(q.entries, entry)
+	if over := len(q.entries) - q.max; over > 0 {
+		q.entries = append([]QuarantinedResponse(nil), q.entries[over:]...)
+	}
+}
+
+// List returns the quarantined replies kept in memory, oldest first
+func (q *responseQuarantine) List() []QuarantinedResponse {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]QuarantinedResponse{}, q.entries...)
+}
+
+// upstreamErrorStatus is the status code for a failed upstream call
+func upstreamErrorStatus(err error) int {
+	var malformed *malformedResponseError
+	var apiErr *upstreamAPIError
+	switch {
+	case errors.As(err, &malformed):
+		return http.StatusBadGateway
+	case errors.Is(err, context.Canceled):
+		return statusClientClosedRequest
+	case errors.As(err, &apiErr) && apiErr.deterministic():
+		return apiErr.Status
+	}
+	return http.StatusInternalServerError
+}
+
+// writeUpstreamError answers a failed upstream call. Malformed replies get
+// a 502 and cancelled requests a 499, with OpenAI-style error bodies
+// clients can tell apart from their own mistakes. Errors the request itself
+// caused, such as an unknown model, are passed on as the upstream sent them.
+func writeUpstreamError(w http.ResponseWriter, err error) {
+	status := upstreamErrorStatus(err)
+	var resp ErrorResponse
+	resp.Error.Message = err.Error()
+	var apiErr *upstreamAPIError
+	switch {
+	case errors.As(err, &apiErr) && apiErr.deterministic():
+		resp = apiErr.Response
+	case status == http.StatusBadGateway:
+		resp.Error.Type = "upstream_error"
+		resp.Error.Code = "malformed_upstream_response"
+	case status == statusClientClosedRequest:
+		resp.Error.Message = "The request was cancelled"
+		resp.Error.Type = "cancelled"
+		resp.Error.Code = "request_cancelled"
+	default:
+		http.Error(w, fmt.Sprintf("OpenAI API error: %v", err), status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
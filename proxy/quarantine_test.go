@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// flakyUpstream answers the first bad requests with body and valid chat
+// completions afterwards
+func flakyUpstream(t *testing.T, bad int32, body string) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var calls atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) <= bad {
+			w.Write([]byte(body))
+			return
+		}
+		json.NewEncoder(w).Encode(createTestChatCompletionResponse())
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream, &calls
+}
+
+func TestRealOpenAIClient_RetriesMalformedResponse(t *testing.T) {
+	upstream, calls := flakyUpstream(t, 1, `{"choices": [{"message": "hello"}]}`)
+	client := NewRealOpenAIClient("sk-test")
+	client.BaseURL = upstream.URL
+	client.Quarantine = newResponseQuarantine(t.TempDir(), 10)
+
+	resp, err := client.CreateChatCompletion(createTestChatCompletionRequest())
+	if err != nil {
+		t.Fatalf("Expected the retry to succeed, got %v", err)
+	}
+	if len(resp.Choices) != 1 || calls.Load() != 2 {
+		t.Errorf("Unexpected response %+v after %d calls", resp, calls.Load())
+	}
+	quarantined := client.Quarantine.List()
+	if len(quarantined) != 1 || quarantined[0].Path != "/chat/completions" || !strings.Contains(quarantined[0].Payload, "hello") {
+		t.Fatalf("Unexpected quarantine %+v", quarantined)
+	}
+	files, _ := os.ReadDir(client.Quarantine.dir)
+	if len(files) != 1 {
+		t.Errorf("Expected 1 quarantine file, got %d", len(files))
+	}
+}
+
+func TestProxyServer_MalformedUpstreamResponse(t *testing.T) {
+	for _, body := range []string{`<html>Bad gateway</html>`, `{"choices": [{"message": {"content": 42}}]}`, `{"id": "x"}`} {
+		upstream, calls := flakyUpstream(t, 2, body)
+		client := NewRealOpenAIClient("sk-test")
+		client.BaseURL = upstream.URL
+		server := NewProxyServer(client)
+		client.Quarantine = server.quarantine
+
+		for _, mustDecode := range []bool{false, true} {
+			req := createTestChatCompletionRequest()
+			if mustDecode {
+				req.PostProcess = []string{PostStripFences}
+			}
+			data, _ := json.Marshal(req)
+			calls.Store(0)
+			w := httptest.NewRecorder()
+			server.handleChatCompletions(w, httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewReader(data)))
+			if w.Code != http.StatusBadGateway {
+				t.Fatalf("%s: expected status 502, got %d: %s", body, w.Code, w.Body.String())
+			}
+			var resp ErrorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Error.Code != "malformed_upstream_response" {
+				t.Errorf("%s: unexpected error body %s", body, w.Body.String())
+			}
+		}
+		if n := len(server.quarantine.List()); n != 4 {
+			t.Errorf("%s: expected 4 quarantined responses, got %d", body, n)
+		}
+	}
+}
+
+func TestResponseQuarantine_KeepsLatest(t *testing.T) {
+	q := newResponseQuarantine("", 2)
+	for _, payload := range []string{"a", "b", "c"} {
+		q.Add("/rerank", []byte(payload), os.ErrInvalid)
+	}
+	list := q.List()
+	if len(list) != 2 || list[0].Payload != "b" || list[1].Payload != "c" {
+		t.Errorf("Unexpected quarantine %+v", list)
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ragChunkChars is the size chunks of a document are cut to, in bytes
+const ragChunkChars = 1000
+
+// errRetrievalUnsupported is returned for retrieval requests when the
+// upstream client has no embeddings API
+var errRetrievalUnsupported = errors.New("retrieval requires an upstream that supports embeddings")
+
+// RAGDocument is a document of a knowledge base. It is cut into chunks that
+// are embedded when the document is stored.
+type RAGDocument struct {
+	ID     string `json:"id"`
+	Title  string `json:"title,omitempty"`
+	Source string `json:"source,omitempty"`
+	Text   string `json:"text"`
+	// Chunks is the number of chunks, set by the proxy
+	Chunks int `json:"chunks"`
+	// Connector is the connector that indexed the document, at Version of
+	// its source
+	Connector string `json:"connector,omitempty"`
+	Version   string `json:"version,omitempty"`
+	// EmbeddingModel is the model the chunks were embedded with, set by
+	// the proxy
+	EmbeddingModel string `json:"embedding_model,omitempty"`
+
+	chunks []ragChunk
+}
+
+type ragChunk struct {
+	text   string
+	vector []float64
+	// terms counts the keyword terms of the chunk, of which there are
+	// length in total
+	terms  map[string]int
+	length int
+}
+
+// RAGOptions is the "rag" extension of a chat completion request, which
+// turns on retrieval augmentation for it
+type RAGOptions struct {
+	// KnowledgeBase is the knowledge base searched, "default" if unset
+	KnowledgeBase string `json:"knowledge_base,omitempty"`
+	// TopK is how many chunks are injected at most (default 4)
+	TopK int `json:"top_k,omitempty"`
+	// MinScore is the cosine similarity below which chunks are left out
+	MinScore float64 `json:"min_score,omitempty"`
+	// InlineCitations asks the model to mark the sources it uses with
+	// their number, e.g. [1]
+	InlineCitations bool `json:"inline_citations,omitempty"`
+	// Retrieval overrides the retrieval mode of the knowledge base: vector,
+	// keyword or hybrid
+	Retrieval string `json:"retrieval,omitempty"`
+}
+
+// Citation is a chunk injected into a request, returned in the response
+// metadata so UIs can show sources
+type Citation struct {
+	// Index is the number the chunk was given in the prompt, as in [1]
+	Index         int     `json:"index"`
+	KnowledgeBase string  `json:"knowledge_base"`
+	Document      string  `json:"document"`
+	Title         string  `json:"title,omitempty"`
+	Source        string  `json:"source,omitempty"`
+	Chunk         int     `json:"chunk"`
+	Score         float64 `json:"score"`
+	Text          string  `json:"text"`
+	// Cited reports whether the reply carries the chunk's marker, with
+	// inline citations
+	Cited bool `json:"cited,omitempty"`
+}
+
+// chunkDocument cuts text into the chunks that are embedded
+func chunkDocument(text string) []string {
+	return splitText(text, ragChunkChars)
+}
+
+// splitText cuts text into chunks of at most size bytes, keeping paragraphs
+// together where they fit and otherwise cutting at the end of a sentence or
+// word
+func splitText(text string, size int) []string {
+	var chunks []string
+	var current strings.Builder
+	flush := func() {
+		if s := strings.TrimSpace(current.String()); s != "" {
+			chunks = append(chunks, s)
+		}
+		current.Reset()
+	}
+	for _, paragraph := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n\n") {
+		paragraph = strings.TrimSpace(paragraph)
+		if paragraph == "" {
+			continue
+		}
+		if current.Len() > 0 && current.Len()+2+len(paragraph) > size {
+			flush()
+		}
+		for len(paragraph) > size {
+			cut := strings.LastIndexAny(paragraph[:size], ".!?\n ")
+			if cut <= 0 {
+				cut = size - 1
+				for cut > 0 && paragraph[cut+1]&0xC0 == 0x80 {
+					cut--
+				}
+			}
+			current.WriteString(paragraph[:cut+1])
+			flush()
+			paragraph = strings.TrimSpace(paragraph[cut+1:])
+		}
+		if current.Len() > 0 {
+			current.WriteString("\n\n")
+		}
+		current.WriteString(paragraph)
+	}
+	flush()
+	return chunks
+}
+
+// embed returns the embeddings of texts with an embedding model, and the
+// model that made them as the upstream reports it, which may name a
+// specific version of the model asked for
+func (s *ProxyServer) embed(model string, texts []string) ([][]float64, string, Usage, error) {
+	client, ok := s.client.(embeddingsClient)
+	if !ok {
+		return nil, "", Usage{}, errRetrievalUnsupported
+	}
+	resp, err := client.CreateEmbeddings(EmbeddingRequest{Model: model, Input: texts})
+	if err != nil {
+		return nil, "", Usage{}, err
+	}
+	vectors := make([][]float64, len(texts))
+	for _, e := range resp.Data {
+		if e.Index >= 0 && e.Index < len(vectors) {
+			vectors[e.Index] = e.Embedding
+		}
+	}
+	for i, vector := range vectors {
+		if vector == nil {
+			return nil, "", Usage{}, fmt.Errorf("no embedding returned for input %d", i)
+		}
+	}
+	if resp.Model != "" {
+		model = resp.Model
+	}
+	return vectors, model, resp.Usage, nil
+}
+
+func cosineSimilarity(a, b []float64) float64 {
+	if len(a) != len(b) {
+		return 0
+	}
+	var dot, na, nb float64
+	for i := range a {
+		dot += a[i] * b[i]
+		na += a[i] * a[i]
+		nb += b[i] * b[i]
+	}
+	if na == 0 || nb == 0 {
+		return 0
+	}
+	return dot / math.Sqrt(na*nb)
+}
+
+// augment injects the chunks relevant to the last user message of a request
+// asking for retrieval, ahead of that message, and returns them. The rag
+// extension is removed from req so it is not sent upstream.
+func (s *ProxyServer) augment(req *ChatCompletionRequest, key *ClientKey) ([]Citation, error) {
+	opts := req.RAG
+	req.RAG = nil
+	if opts == nil {
+		return nil, nil
+	}
+	last := -1
+	for i, m := range req.Messages {
+		if m.Role == "user" {
+			last = i
+		}
+	}
+	if last < 0 || strings.TrimSpace(req.Messages[last].Content) == "" {
+		return nil, nil
+	}
+
+	var tenant string
+	if key != nil {
+		tenant = key.Tenant
+	}
+	if !s.featureEnabled(FeatureRAG, "chat.completions", tenant) {
+		return nil, fmt.Errorf("%w: retrieval augmentation is not available to this tenant yet", errFeatureDisabled)
+	}
+	kb, err := s.knowledgeBaseFor(opts.KnowledgeBase, tenant)
+	if err != nil {
+		return nil, err
+	}
+	citations, err := s.search(key, kb, req.Messages[last].Content, *opts)
+	if err != nil || len(citations) == 0 {
+		return nil, err
+	}
+
+	var b strings.Builder
+	b.WriteString("Use the following sources to answer when they are relevant.")
+	if opts.InlineCitations {
+		b.WriteString(" Cite every source you use with its number in square brackets, e.g. [1].")
+	}
+	b.WriteString("\n\n" + sourcesText(citations))
+	messages := append([]Message(nil), req.Messages[:last]...)
+	messages = append(messages, Message{Role: "system", Content: b.String()})
+	req.Messages = append(messages, req.Messages[last:]...)
+	return citations, nil
+}
+
+// search returns the chunks of kb most relevant to query, accounting for
+// embedding the query as an embeddings usage event of key
+func (s *ProxyServer) search(key *ClientKey, kb KnowledgeBase, query string, opts RAGOptions) ([]Citation, error) {
+	config := s.retrievalConfig(kb)
+	if opts.Retrieval != "" {
+		config.Mode = opts.Retrieval
+	}
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	event := newUsageEvent(key, "embeddings", s.embeddingModel(kb))
+	citations, usage, err := s.retrieve(kb, query, opts, config)
+	event.LatencyMS = time.Since(event.Time).Milliseconds()
+	if err != nil {
+		if !errors.Is(err, errRetrievalUnsupported) {
+			event.Status = http.StatusInternalServerError
+			s.recordUsage(event)
+		}
+		return nil, err
+	}
+	if config.usesVectors() {
+		s.recordCompletion(key, event, usage)
+	}
+	return citations, nil
+}
+
+// sourcesText numbers the chunks found for a prompt, as in "[1] Title"
+// followed by the text
+func sourcesText(citations []Citation) string {
+	var b strings.Builder
+	for i, c := range citations {
+		if i > 0 {
+			b.WriteString("\n\n")
+		}
+		fmt.Fprintf(&b, "[%d]", c.Index)
+		if c.Title != "" {
+			b.WriteString(" " + c.Title)
+		}
+		b.WriteString("\n" + c.Text)
+	}
+	return b.String()
+}
+
+// augmentStatus is the status code to answer a failed augment with
+func augmentStatus(err error) int {
+	switch {
+	case errors.Is(err, errRetrievalUnsupported):
+		return http.StatusNotImplemented
+	case errors.Is(err, errBadRetrieval):
+		return http.StatusBadRequest
+	case errors.Is(err, errEmbeddingModelMismatch):
+		return http.StatusConflict
+	case errors.Is(err, errFeatureDisabled):
+		return http.StatusForbidden
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+var citationMarker = regexp.MustCompile(`\[(\d+)\]`)
+
+// withCitations returns resp with the injected chunks in its metadata. With
+// inline citations, those the reply marks are flagged as cited.
+func withCitations(resp *ChatCompletionResponse, citations []Citation, inline bool) *ChatCompletionResponse {
+	out := *resp
+	out.Metadata = withMetadata(out.Metadata)
+	out.Metadata.Citations = append([]Citation(nil), citations...)
+	if inline && len(out.Choices) > 0 {
+		for _, m := range citationMarker.FindAllStringSubmatch(out.Choices[0].Message.Content, -1) {
+			if n, err := strconv.Atoi(m[1]); err == nil && n >= 1 && n <= len(citations) {
+				out.Metadata.Citations[n-1].Cited = true
+			}
+		}
+	}
+	return &out
+}
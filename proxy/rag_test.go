@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// ragClient embeds texts as counts of a few topic words and answers chat
+// completions with reply. Embeddings are reported as made by served, if
+// set.
+type ragClient struct {
+	recordingOpenAIClient
+	reply  string
+	models []string
+	served string
+}
+
+func (m *ragClient) CreateEmbeddings(req EmbeddingRequest) (*EmbeddingResponse, error) {
+	m.models = append(m.models, req.Model)
+	resp := &EmbeddingResponse{Object: "list", Model: req.Model}
+	if m.served != "" {
+		resp.Model = m.served
+	}
+	for i, in := range req.Input {
+		in = strings.ToLower(in)
+		vector := []float64{0.01}
+		for _, word := range []string{"refund", "shipping", "password"} {
+			vector = append(vector, float64(strings.Count(in, word)))
+		}
+		resp.Data = append(resp.Data, Embedding{Index: i, Embedding: vector})
+		resp.Usage.PromptTokens += len(strings.Fields(in))
+	}
+	resp.Usage.TotalTokens = resp.Usage.PromptTokens
+	return resp, nil
+}
+
+func (m *ragClient) CreateChatCompletion(req ChatCompletionRequest) (*ChatCompletionResponse, error) {
+	m.last = req
+	resp := *createTestChatCompletionResponse()
+	resp.Choices = append([]Choice(nil), resp.Choices...)
+	resp.Choices[0].Message.Content = m.reply
+	return &resp, nil
+}
+
+func newRAGServer(t *testing.T, reply string) (*ProxyServer, *ragClient) {
+	t.Helper()
+	client := &ragClient{reply: reply}
+	server := NewProxyServer(client)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/knowledge-bases/{id}", server.adminKnowledgeBaseHandler().ServeHTTP)
+	mux.HandleFunc("/admin/knowledge-bases/{kb}/documents/{id}", server.handleAdminKnowledgeBaseDocuments)
+	if w := adminRequest(mux, http.MethodPut, "/admin/knowledge-bases/default", `{}`, nil); w.Code != http.StatusCreated {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	for id, body := range map[string]string{
+		"refunds":  `{"title": "Refund policy", "source": "https://example.com/refunds", "text": "Refunds are paid within 14 days.\n\nA refund needs the receipt."}`,
+		"shipping": `{"title": "Shipping", "text": "Shipping takes 3 days."}`,
+	} {
+		w := adminRequest(mux, http.MethodPut, "/admin/knowledge-bases/default/documents/"+id, body, nil)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("Expected status code %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+		}
+	}
+	return server, client
+}
+
+func TestProxyServer_RAGCitations(t *testing.T) {
+	server, client := newRAGServer(t, "You get it back within 14 days [1].")
+
+	w := chatRequestAs(server, nil, `{"model": "gpt-4o", "messages": [{"role": "system", "content": "Be brief."}, {"role": "user", "content": "How do I get a refund?"}],
+		"rag": {"top_k": 2, "min_score": 0.5, "inline_citations": true}}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var resp ChatCompletionResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Metadata == nil || len(resp.Metadata.Citations) != 1 {
+		t.Fatalf("Expected one citation above the minimum score, got %+v", resp.Metadata)
+	}
+	c := resp.Metadata.Citations[0]
+	if c.Index != 1 || c.Document != "refunds" || c.Source != "https://example.com/refunds" || !c.Cited {
+		t.Errorf("Expected the cited refund policy, got %+v", c)
+	}
+	if !strings.Contains(c.Text, "Refunds are paid") {
+		t.Errorf("Expected the chunk text, got %q", c.Text)
+	}
+
+	sent := client.last
+	if sent.RAG != nil {
+		t.Error("Expected the rag extension to be removed before forwarding")
+	}
+	if len(sent.Messages) != 3 || sent.Messages[1].Role != "system" || sent.Messages[2].Role != "user" {
+		t.Fatalf("Expected the sources ahead of the user message, got %+v", sent.Messages)
+	}
+	if context := sent.Messages[1].Content; !strings.Contains(context, "[1] Refund policy") || !strings.Contains(context, "square brackets") {
+		t.Errorf("Expected numbered sources and citation instructions, got %q", context)
+	}
+}
+
+func TestProxyServer_RAGWithoutMatches(t *testing.T) {
+	server, client := newRAGServer(t, "Hello")
+
+	w := chatRequestAs(server, nil, `{"model": "gpt-4o", "messages": [{"role": "user", "content": "Reset my password"}], "rag": {"min_score": 0.5}}`)
+	var resp ChatCompletionResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Metadata != nil {
+		t.Errorf("Expected no citations, got %+v", resp.Metadata)
+	}
+	if len(client.last.Messages) != 1 {
+		t.Errorf("Expected the request unchanged, got %+v", client.last.Messages)
+	}
+}
+
+func TestProxyServer_RAGUnsupported(t *testing.T) {
+	server := NewProxyServer(&MockOpenAIClient{response: createTestChatCompletionResponse()})
+	server.knowledgeBases.Put("default", KnowledgeBase{ID: "default", docs: newRegistry[RAGDocument](), stats: &knowledgeBaseStats{}})
+	w := chatRequestAs(server, nil, `{"model": "gpt-4o", "messages": [{"role": "user", "content": "Hi"}], "rag": {}}`)
+	if w.Code != http.StatusNotImplemented {
+		t.Errorf("Expected status code %d, got %d", http.StatusNotImplemented, w.Code)
+	}
+}
+
+func TestChunkDocument(t *testing.T) {
+	long := strings.Repeat("word ", 300)
+	chunks := chunkDocument("First.\n\nSecond.\n\n" + long)
+	if len(chunks) != 3 {
+		t.Fatalf("Expected 3 chunks, got %d", len(chunks))
+	}
+	if chunks[0] != "First.\n\nSecond." {
+		t.Errorf("Expected short paragraphs to be kept together, got %q", chunks[0])
+	}
+	for _, chunk := range chunks {
+		if len(chunk) > ragChunkChars {
+			t.Errorf("Expected chunks of at most %d bytes, got %d", ragChunkChars, len(chunk))
+		}
+	}
+	if len(chunkDocument(" \n\n ")) != 0 {
+		t.Error("Expected no chunks for blank text")
+	}
+}
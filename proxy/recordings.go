@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Integration tests against the proxy should not pay for completions or
+// fail when the model words a reply differently. With PROXY_RECORDING_MODE
+// set to record, every upstream reply is saved in PROXY_RECORDINGS_DIR
+// under a hash of its request; set to replay, upstream requests are
+// answered from those files and never sent, so CI runs are deterministic
+// and free. A request without a recording fails in replay mode rather than
+// reaching the API.
+
+// Recording modes
+const (
+	RecordingRecord = "record"
+	RecordingReplay = "replay"
+)
+
+// defaultRecordingsDir is where recordings are kept by default
+const defaultRecordingsDir = "data/recordings"
+
+// unrecordedHeaders are the response headers left out of recordings
+var unrecordedHeaders = map[string]bool{"Date": true, "Set-Cookie": true, "Content-Length": true, "Connection": true, "Transfer-Encoding": true}
+
+// Recording is an upstream request and the reply it got
+type Recording struct {
+	Request  RecordedMessage `json:"request"`
+	Response RecordedMessage `json:"response"`
+}
+
+// RecordedMessage is one side of a recording. Its body is kept in Body if
+// it is JSON, else in Text, such as the events of a streamed reply.
+type RecordedMessage struct {
+	Method  string            `json:"method,omitempty"`
+	URL     string            `json:"url,omitempty"`
+	Status  int               `json:"status,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    json.RawMessage   `json:"body,omitempty"`
+	Text    string            `json:"text,omitempty"`
+}
+
+func (m *RecordedMessage) setBody(body []byte) {
+	if json.Valid(body) {
+		m.Body = json.RawMessage(bytes.TrimSpace(body))
+	} else {
+		m.Text = string(body)
+	}
+}
+
+// body returns the body of a message, with JSON compacted again after
+// being indented in the recording
+func (m RecordedMessage) body() []byte {
+	if m.Body != nil {
+		var buf bytes.Buffer
+		if json.Compact(&buf, m.Body) == nil {
+			return buf.Bytes()
+		}
+		return m.Body
+	}
+	return []byte(m.Text)
+}
+
+// recordings records upstream replies or replays them, as a transport
+type recordings struct {
+	dir  string
+	mode string
+	next http.RoundTripper
+}
+
+// recordingsFromEnv reads PROXY_RECORDING_MODE and PROXY_RECORDINGS_DIR, or
+// returns nil if no mode is set
+func recordingsFromEnv(getenv func(string) string) (*recordings, error) {
+	mode := getenv("PROXY_RECORDING_MODE")
+	switch mode {
+	case "":
+		return nil, nil
+	case RecordingRecord, RecordingReplay:
+	default:
+		return nil, fmt.Errorf("invalid PROXY_RECORDING_MODE %q, expected record or replay", mode)
+	}
+	dir := getenv("PROXY_RECORDINGS_DIR")
+	if dir == "" {
+		dir = defaultRecordingsDir
+	}
+	if mode == RecordingRecord {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, fmt.Errorf("invalid PROXY_RECORDINGS_DIR %q: %v", dir, err)
+		}
+	}
+	return &recordings{dir: dir, mode: mode}, nil
+}
+
+// wrap returns the recordings as a transport in front of next
+func (rs *recordings) wrap(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	wrapped := *rs
+	wrapped.next = next
+	return &wrapped
+}
+
+// recordingKey is the hash a request is recorded under: of its method, URL
+// and body, with JSON bodies compared by value so the order of members and
+// spacing do not matter. Credentials are left out, so recordings made with
+// one key replay with any.
+func recordingKey(method, url string, body []byte) string {
+	var v any
+	if json.Unmarshal(body, &v) != nil {
+		v = string(body)
+	}
+	return cacheKey(struct {
+		Method, URL string
+		Body        any
+	}{method, url, v})
+}
+
+func (rs *recordings) path(key string) string {
+	return filepath.Join(rs.dir, key+".json")
+}
+
+func (rs *recordings) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = io.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	key := recordingKey(req.Method, req.URL.String(), body)
+
+	if rs.mode == RecordingReplay {
+		data, err := os.ReadFile(rs.path(key))
+		if err != nil {
+			return nil, fmt.Errorf("no recording of %s %s in %s (%s.json)", req.Method, req.URL, rs.dir, key)
+		}
+		var rec Recording
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return nil, fmt.Errorf("invalid recording %s: %w", rs.path(key), err)
+		}
+		header := http.Header{}
+		for name, value := range rec.Response.Headers {
+			header.Set(name, value)
+		}
+		replayed := rec.Response.body()
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", rec.Response.Status, http.StatusText(rec.Response.Status)),
+			StatusCode:    rec.Response.Status,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        header,
+			Body:          io.NopCloser(bytes.NewReader(replayed)),
+			ContentLength: int64(len(replayed)),
+			Request:       req,
+		}, nil
+	}
+
+	resp, err := rs.next.RoundTrip(req)
+	// Rate limits and server errors pass, and would fail every replay
+	if err != nil || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		return resp, err
+	}
+	rec := Recording{
+		Request:  RecordedMessage{Method: req.Method, URL: req.URL.String()},
+		Response: RecordedMessage{Status: resp.StatusCode, Headers: map[string]string{}},
+	}
+	rec.Request.setBody(body)
+	for name, values := range resp.Header {
+		if !unrecordedHeaders[name] {
+			rec.Response.Headers[name] = strings.Join(values, ", ")
+		}
+	}
+	save := func(body []byte) {
+		rec.Response.setBody(body)
+		if err := rs.save(key, rec); err != nil {
+			log.Printf("Failed to save recording: %v", err)
+		}
+	}
+	// Streams are saved once relayed to the end; other replies, which
+	// decoders need not read to the end, are read at once
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		resp.Body = &recordingBody{ReadCloser: resp.Body, save: save}
+		return resp, nil
+	}
+	data, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	save(data)
+	resp.Body = io.NopCloser(bytes.NewReader(data))
+	return resp, nil
+}
+
+// save writes a recording, replacing any earlier one at once
+func (rs *recordings) save(key string, rec Recording) error {
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(rs.dir, key+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), rs.path(key))
+}
+
+// recordingBody keeps a copy of a stream as it is read and saves it once
+// read to the end. Streams abandoned halfway, such as by clients leaving,
+// are not saved.
+type recordingBody struct {
+	io.ReadCloser
+	buf   bytes.Buffer
+	save  func([]byte)
+	saved bool
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.buf.Write(p[:n])
+	if err == io.EOF && !b.saved {
+		b.saved = true
+		b.save(b.buf.Bytes())
+	}
+	return n, err
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func recordingsFor(t *testing.T, mode, dir string) *recordings {
+	t.Helper()
+	rs, err := recordingsFromEnv(func(name string) string {
+		return map[string]string{"PROXY_RECORDING_MODE": mode, "PROXY_RECORDINGS_DIR": dir}[name]
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rs
+}
+
+func recordedChat(t *testing.T, rs *recordings, baseURL, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	client := NewRealOpenAIClient("sk-test")
+	client.BaseURL = baseURL
+	client.HTTPClient.Transport = rs.wrap(client.HTTPClient.Transport)
+	server := NewProxyServer(client)
+	server.submissions = nil
+	w := httptest.NewRecorder()
+	server.Handler().ServeHTTP(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body)))
+	return w
+}
+
+func TestRecordings_RecordThenReplay(t *testing.T) {
+	upstream := newRecordingUpstream(t)
+	dir := t.TempDir()
+	chat := `{"model": "gpt-4o", "messages": [{"role": "user", "content": "Hi"}]}`
+
+	recorded := recordedChat(t, recordingsFor(t, RecordingRecord, dir), upstream.URL, chat)
+	if recorded.Code != http.StatusOK || upstream.last == nil {
+		t.Fatalf("Expected the request to go upstream, got %d %s", recorded.Code, recorded.Body.String())
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	if len(files) != 1 {
+		t.Fatalf("Expected one recording, got %v", files)
+	}
+	if data, _ := os.ReadFile(files[0]); strings.Contains(string(data), "sk-test") {
+		t.Error("Expected the upstream key to be left out of the recording")
+	}
+
+	upstream.last = nil
+	replayed := recordedChat(t, recordingsFor(t, RecordingReplay, dir), upstream.URL, chat)
+	if replayed.Code != http.StatusOK || strings.TrimSpace(replayed.Body.String()) != strings.TrimSpace(recorded.Body.String()) {
+		t.Errorf("Expected the recorded reply, got %d %s", replayed.Code, replayed.Body.String())
+	}
+	if upstream.last != nil {
+		t.Error("Expected nothing to be sent upstream when replaying")
+	}
+
+	// Requests never recorded fail instead of going upstream
+	missed := recordedChat(t, recordingsFor(t, RecordingReplay, dir), upstream.URL, `{"model": "gpt-4o", "messages": [{"role": "user", "content": "Bye"}]}`)
+	if missed.Code == http.StatusOK || !strings.Contains(missed.Body.String(), "no recording") || upstream.last != nil {
+		t.Errorf("Expected a missing recording to fail, got %d %s", missed.Code, missed.Body.String())
+	}
+}
+
+func TestRecordings_Streams(t *testing.T) {
+	const events = "data: {\"choices\": []}\n\ndata: [DONE]\n\n"
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, events)
+	}))
+	defer upstream.Close()
+	dir := t.TempDir()
+	for _, mode := range []string{RecordingRecord, RecordingReplay} {
+		req, _ := http.NewRequest("POST", upstream.URL, strings.NewReader(`{"stream": true}`))
+		resp, err := recordingsFor(t, mode, dir).wrap(nil).RoundTrip(req)
+		if err != nil {
+			t.Fatalf("%s: %v", mode, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != events || resp.Header.Get("Content-Type") != "text/event-stream" {
+			t.Errorf("%s: expected the events, got %q", mode, body)
+		}
+	}
+}
+
+func TestRecordings_SkipsFailures(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error": {"message": "overloaded"}}`, http.StatusServiceUnavailable)
+	}))
+	defer upstream.Close()
+	dir := t.TempDir()
+	req, _ := http.NewRequest("POST", upstream.URL, strings.NewReader(`{}`))
+	resp, err := recordingsFor(t, RecordingRecord, dir).wrap(nil).RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.json")); len(files) != 0 {
+		t.Errorf("Expected server errors not to be recorded, got %v", files)
+	}
+}
+
+func TestRecordingKey(t *testing.T) {
+	url := "https://api.openai.com/v1/chat/completions"
+	a := recordingKey("POST", url, []byte(`{"model": "gpt-4o", "temperature": 0}`))
+	if b := recordingKey("POST", url, []byte(`{"temperature":0,"model":"gpt-4o"}`)); a != b {
+		t.Error("Expected the order of members and spacing not to matter")
+	}
+	if b := recordingKey("POST", url, []byte(`{"model": "gpt-4o", "temperature": 1}`)); a == b {
+		t.Error("Expected different bodies to be recorded apart")
+	}
+	if b := recordingKey("GET", url, nil); a == b {
+		t.Error("Expected different methods to be recorded apart")
+	}
+}
+
+func TestServerFromEnv_Replay(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	env := map[string]string{"PROXY_RECORDING_MODE": "replay", "PROXY_RECORDINGS_DIR": t.TempDir(), "PROXY_ANALYTICS_FILE": "off"}
+	server, err := serverFromEnv(ctx, func(name string) string { return env[name] }, nil)
+	if err != nil {
+		t.Fatalf("Expected replay to need no upstream key, got %v", err)
+	}
+	if _, ok := server.client.(*RealOpenAIClient).HTTPClient.Transport.(*recordings); !ok {
+		t.Error("Expected upstream requests to be replayed")
+	}
+	env["PROXY_RECORDING_MODE"] = "playback"
+	if _, err := serverFromEnv(ctx, func(name string) string { return env[name] }, nil); err == nil {
+		t.Error("Expected an error for an unknown mode")
+	}
+}
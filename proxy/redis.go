@@ -0,0 +1,338 @@
+//go:build !edge && !wasip1
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redisClient is a minimal RESP2 client covering the handful of commands
+// the proxy needs, so Redis support doesn't pull in a dependency. It keeps
+// one connection and reconnects after any error.
+type redisClient struct {
+	addr     string
+	password string
+
+	mu   sync.Mutex
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+// redisError is an error reply sent by the server
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+func newRedisClient(addr, password string) *redisClient {
+	return &redisClient{addr: addr, password: password}
+}
+
+func (c *redisClient) connect(ctx context.Context) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return err
+	}
+	c.conn = conn
+	c.rd = bufio.NewReader(conn)
+	if c.password != "" {
+		if _, err := c.roundTrip(ctx, "AUTH", c.password); err != nil {
+			c.close()
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *redisClient) close() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+// Do sends one command and returns its reply: string, int64, nil, or
+// []any for arrays. Error replies are returned as redisError.
+func (c *redisClient) Do(ctx context.Context, args ...string) (any, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		if err := c.connect(ctx); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := c.roundTrip(ctx, args...)
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		c.close()
+	}
+	return reply, err
+}
+
+func (c *redisClient) roundTrip(ctx context.Context, args ...string) (any, error) {
+	replies, err := c.pipeline(ctx, [][]string{args})
+	if err != nil {
+		return nil, err
+	}
+	if err, ok := replies[0].(error); ok {
+		return nil, err
+	}
+	return replies[0], nil
+}
+
+// Pipeline sends several commands in one round trip on the same connection
+// and returns their replies in order; error replies are returned in place
+// as redisError values.
+func (c *redisClient) Pipeline(ctx context.Context, cmds ...[]string) ([]any, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		if err := c.connect(ctx); err != nil {
+			return nil, err
+		}
+	}
+	replies, err := c.pipeline(ctx, cmds)
+	if err != nil {
+		c.close()
+	}
+	return replies, err
+}
+
+func (c *redisClient) pipeline(ctx context.Context, cmds [][]string) ([]any, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(5 * time.Second)
+	}
+	c.conn.SetDeadline(deadline)
+
+	var buf []byte
+	for _, args := range cmds {
+		buf = append(buf, "*"+strconv.Itoa(len(args))+"\r\n"...)
+		for _, arg := range args {
+			buf = append(buf, "$"+strconv.Itoa(len(arg))+"\r\n"...)
+			buf = append(buf, arg...)
+			buf = append(buf, "\r\n"...)
+		}
+	}
+	if _, err := c.conn.Write(buf); err != nil {
+		return nil, err
+	}
+
+	replies := make([]any, len(cmds))
+	for i := range replies {
+		reply, err := readRESP(c.rd)
+		var replyErr redisError
+		if err != nil && !errors.As(err, &replyErr) {
+			return nil, err
+		}
+		if err != nil {
+			reply = replyErr
+		}
+		replies[i] = reply
+	}
+	return replies, nil
+}
+
+// readRESP parses one RESP2 value
+func readRESP(rd *bufio.Reader) (any, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	kind, payload := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return payload, nil
+	case '-':
+		return nil, redisError(payload)
+	case ':':
+		return strconv.ParseInt(payload, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(rd, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = readRESP(rd); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("redis: unknown reply type %q", kind)
+	}
+}
+
+// Lua scripts that only touch the lease if the caller still holds it
+const (
+	redisRenewScript   = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("PEXPIRE", KEYS[1], ARGV[2]) end return 0`
+	redisReleaseScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) end return 0`
+)
+
+// redisLocker implements Locker with SET NX PX, the usual single-instance
+// Redis lock. Renewals and releases check ownership atomically in Lua.
+type redisLocker struct {
+	client *redisClient
+	prefix string
+}
+
+func newRedisLocker(client *redisClient) *redisLocker {
+	return &redisLocker{client: client, prefix: "vibethon:lock:"}
+}
+
+func (l *redisLocker) Acquire(ctx context.Context, name, holder string, ttl time.Duration) (bool, error) {
+	key := l.prefix + name
+	ms := strconv.FormatInt(ttl.Milliseconds(), 10)
+
+	renewed, err := l.client.Do(ctx, "EVAL", redisRenewScript, "1", key, holder, ms)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := renewed.(int64); n == 1 {
+		return true, nil
+	}
+
+	reply, err := l.client.Do(ctx, "SET", key, holder, "NX", "PX", ms)
+	if err != nil {
+		return false, err
+	}
+	return reply == "OK", nil
+}
+
+func (l *redisLocker) Release(ctx context.Context, name, holder string) error {
+	_, err := l.client.Do(ctx, "EVAL", redisReleaseScript, "1", l.prefix+name, holder)
+	return err
+}
+
+// redisCluster routes each command to the node serving its key's hash slot,
+// learning the slot map from MOVED redirects. Against a standalone server
+// it simply talks to the seed address.
+type redisCluster struct {
+	seed     string
+	password string
+
+	mu    sync.Mutex
+	nodes map[string]*redisClient
+	slots map[uint16]string
+}
+
+func newRedisCluster(seed, password string) *redisCluster {
+	return &redisCluster{
+		seed:     seed,
+		password: password,
+		nodes:    make(map[string]*redisClient),
+		slots:    make(map[uint16]string),
+	}
+}
+
+func (c *redisCluster) node(slot uint16) *redisClient {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	addr, ok := c.slots[slot]
+	if !ok {
+		addr = c.seed
+	}
+	return c.nodeAt(addr)
+}
+
+// nodeAt returns the client for addr. Callers must hold c.mu.
+func (c *redisCluster) nodeAt(addr string) *redisClient {
+	client, ok := c.nodes[addr]
+	if !ok {
+		client = newRedisClient(addr, c.password)
+		c.nodes[addr] = client
+	}
+	return client
+}
+
+// Do runs a command whose first key is key, following up to a few
+// MOVED/ASK redirects while the cluster is resharding
+func (c *redisCluster) Do(ctx context.Context, key string, args ...string) (any, error) {
+	slot := redisKeySlot(key)
+	client := c.node(slot)
+	for attempt := 0; ; attempt++ {
+		reply, err := client.Do(ctx, args...)
+		var replyErr redisError
+		if attempt >= 3 || !errors.As(err, &replyErr) {
+			return reply, err
+		}
+		fields := strings.Fields(string(replyErr))
+		if len(fields) != 3 || (fields[0] != "MOVED" && fields[0] != "ASK") {
+			return reply, err
+		}
+
+		c.mu.Lock()
+		client = c.nodeAt(fields[2])
+		if fields[0] == "MOVED" {
+			c.slots[slot] = fields[2]
+		}
+		c.mu.Unlock()
+		if fields[0] == "ASK" {
+			replies, err := client.Pipeline(ctx, []string{"ASKING"}, args)
+			if err != nil {
+				return nil, err
+			}
+			if err, ok := replies[1].(error); ok {
+				return nil, err
+			}
+			return replies[1], nil
+		}
+	}
+}
+
+// redisKeySlot computes the Redis Cluster hash slot of key, honoring
+// {hash tags}
+func redisKeySlot(key string) uint16 {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return crc16(key) % 16384
+}
+
+// crc16 is the CRC-16/XMODEM checksum Redis Cluster uses for key slots
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for b := 0; b < 8; b++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,225 @@
+//go:build !edge && !wasip1
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis implements just enough of the Redis protocol for the proxy's
+// commands, backed by a map
+type fakeRedis struct {
+	mu      sync.Mutex
+	values  map[string]string
+	expires map[string]time.Time
+	ln      net.Listener
+	// movedTo makes the server redirect every command, like a cluster node
+	// that does not own the key's slot
+	movedTo string
+}
+
+func startFakeRedis(t *testing.T) *fakeRedis {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	r := &fakeRedis{values: map[string]string{}, expires: map[string]time.Time{}, ln: ln}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(conn)
+		}
+	}()
+	return r
+}
+
+func (r *fakeRedis) addr() string { return r.ln.Addr().String() }
+
+func (r *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	for {
+		cmd, err := readRESP(rd)
+		if err != nil {
+			return
+		}
+		items := cmd.([]any)
+		args := make([]string, len(items))
+		for i, item := range items {
+			args[i] = item.(string)
+		}
+		fmt.Fprint(conn, r.exec(args))
+	}
+}
+
+func (r *fakeRedis) get(key string) (string, bool) {
+	if exp, ok := r.expires[key]; ok && time.Now().After(exp) {
+		delete(r.values, key)
+		delete(r.expires, key)
+	}
+	v, ok := r.values[key]
+	return v, ok
+}
+
+func (r *fakeRedis) exec(args []string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.movedTo != "" {
+		return fmt.Sprintf("-MOVED %d %s\r\n", redisKeySlot(args[len(args)-1]), r.movedTo)
+	}
+	switch args[0] {
+	case "SET":
+		if _, exists := r.get(args[1]); exists && len(args) > 3 && args[3] == "NX" {
+			return "$-1\r\n"
+		}
+		r.values[args[1]] = args[2]
+		if len(args) > 5 && args[4] == "PX" {
+			ms, _ := strconv.Atoi(args[5])
+			r.expires[args[1]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		}
+		return "+OK\r\n"
+	case "GET":
+		v, ok := r.get(args[1])
+		if !ok {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+	case "EVAL":
+		if args[1] == redisIncrExpireScript {
+			v, _ := r.get(args[3])
+			n, _ := strconv.ParseInt(v, 10, 64)
+			delta, _ := strconv.ParseInt(args[4], 10, 64)
+			ms, _ := strconv.Atoi(args[5])
+			r.values[args[3]] = strconv.FormatInt(n+delta, 10)
+			r.expires[args[3]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+			return fmt.Sprintf(":%d\r\n", n+delta)
+		}
+		key, holder := args[3], args[4]
+		if v, ok := r.get(key); !ok || v != holder {
+			return ":0\r\n"
+		}
+		switch args[1] {
+		case redisRenewScript:
+			ms, _ := strconv.Atoi(args[5])
+			r.expires[key] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		case redisReleaseScript:
+			delete(r.values, key)
+			delete(r.expires, key)
+		}
+		return ":1\r\n"
+	default:
+		return "-ERR unknown command\r\n"
+	}
+}
+
+func TestRedisClient_Do(t *testing.T) {
+	server := startFakeRedis(t)
+	client := newRedisClient(server.addr(), "")
+	ctx := context.Background()
+
+	if reply, err := client.Do(ctx, "SET", "k", "v"); err != nil || reply != "OK" {
+		t.Fatalf("Expected OK, got %v, %v", reply, err)
+	}
+	if reply, err := client.Do(ctx, "GET", "k"); err != nil || reply != "v" {
+		t.Errorf("Expected v, got %v, %v", reply, err)
+	}
+	if reply, err := client.Do(ctx, "GET", "missing"); err != nil || reply != nil {
+		t.Errorf("Expected nil reply, got %v, %v", reply, err)
+	}
+	if _, err := client.Do(ctx, "FLUSHALL"); err == nil {
+		t.Error("Expected error reply for unknown command")
+	}
+	// The connection stays usable after an error reply
+	if reply, err := client.Do(ctx, "GET", "k"); err != nil || reply != "v" {
+		t.Errorf("Expected v after error reply, got %v, %v", reply, err)
+	}
+}
+
+func TestRedisLocker(t *testing.T) {
+	server := startFakeRedis(t)
+	locker := newRedisLocker(newRedisClient(server.addr(), ""))
+	ctx := context.Background()
+
+	if ok, err := locker.Acquire(ctx, "jobs", "a", time.Minute); err != nil || !ok {
+		t.Fatalf("Expected a to acquire the lock, got %v, %v", ok, err)
+	}
+	if ok, _ := locker.Acquire(ctx, "jobs", "b", time.Minute); ok {
+		t.Error("Expected b not to acquire a held lock")
+	}
+	if ok, _ := locker.Acquire(ctx, "jobs", "a", time.Minute); !ok {
+		t.Error("Expected a to renew its own lock")
+	}
+
+	// Releasing someone else's lock is a no-op
+	locker.Release(ctx, "jobs", "b")
+	if ok, _ := locker.Acquire(ctx, "jobs", "b", time.Minute); ok {
+		t.Error("Expected lock to survive a release by a non-holder")
+	}
+
+	locker.Release(ctx, "jobs", "a")
+	if ok, _ := locker.Acquire(ctx, "jobs", "b", time.Minute); !ok {
+		t.Error("Expected b to acquire the lock after a released it")
+	}
+}
+
+func TestRedisLocker_Expiry(t *testing.T) {
+	server := startFakeRedis(t)
+	locker := newRedisLocker(newRedisClient(server.addr(), ""))
+	ctx := context.Background()
+
+	locker.Acquire(ctx, "jobs", "a", 20*time.Millisecond)
+	time.Sleep(40 * time.Millisecond)
+	if ok, _ := locker.Acquire(ctx, "jobs", "b", time.Minute); !ok {
+		t.Error("Expected b to acquire an expired lock")
+	}
+}
+
+func TestRedisKeySlot(t *testing.T) {
+	if got := crc16("123456789"); got != 0x31C3 {
+		t.Errorf("Expected CRC16 0x31C3, got %#x", got)
+	}
+	if got := redisKeySlot("foo"); got != 12182 {
+		t.Errorf("Expected slot 12182 for foo, got %d", got)
+	}
+	if redisKeySlot("{user1000}.following") != redisKeySlot("{user1000}.followers") {
+		t.Error("Expected keys with the same hash tag to share a slot")
+	}
+	if redisKeySlot("{}.a") != crc16("{}.a")%16384 {
+		t.Error("Expected empty hash tags to be ignored")
+	}
+}
+
+func TestRedisCluster_FollowsMoved(t *testing.T) {
+	owner := startFakeRedis(t)
+	seed := startFakeRedis(t)
+	seed.movedTo = owner.addr()
+
+	cluster := newRedisCluster(seed.addr(), "")
+	ctx := context.Background()
+	if _, err := cluster.Do(ctx, "k", "SET", "k", "v"); err != nil {
+		t.Fatalf("Expected redirected SET to succeed, got %v", err)
+	}
+	if owner.values["k"] != "v" {
+		t.Error("Expected the value to be stored on the owning node")
+	}
+
+	// The slot map is cached, so the seed is not asked again
+	seed.mu.Lock()
+	seed.movedTo = "127.0.0.1:1"
+	seed.mu.Unlock()
+	if reply, err := cluster.Do(ctx, "k", "GET", "k"); err != nil || reply != "v" {
+		t.Errorf("Expected v from the cached node, got %v, %v", reply, err)
+	}
+}
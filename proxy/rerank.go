@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Rerank backends, chosen with PROXY_RERANK_BACKEND
+const (
+	// The upstream serves a Cohere-style /rerank endpoint
+	RerankAPI = "api"
+	// Each document is scored by a chat model, for upstreams that are only
+	// OpenAI-compatible
+	RerankChat = "chat"
+)
+
+// rerankChatConcurrency caps the scoring requests one rerank sends at once
+const rerankChatConcurrency = 8
+
+// RerankRequest mirrors Cohere's rerank request
+type RerankRequest struct {
+	Model           string          `json:"model"`
+	Query           string          `json:"query"`
+	Documents       RerankDocuments `json:"documents"`
+	TopN            int             `json:"top_n,omitempty"`
+	ReturnDocuments bool            `json:"return_documents,omitempty"`
+}
+
+// RerankDocuments accepts documents as strings or as {"text": ...} objects
+// and always encodes them as strings
+type RerankDocuments []string
+
+func (d *RerankDocuments) UnmarshalJSON(data []byte) error {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("documents must be an array")
+	}
+	docs := make(RerankDocuments, len(raw))
+	for i, item := range raw {
+		if err := json.Unmarshal(item, &docs[i]); err == nil {
+			continue
+		}
+		var object struct {
+			Text string `json:"text"`
+		}
+		if err := json.Unmarshal(item, &object); err != nil {
+			return fmt.Errorf("documents must be strings or objects with text")
+		}
+		docs[i] = object.Text
+	}
+	*d = docs
+	return nil
+}
+
+type RerankResult struct {
+	Index          int             `json:"index"`
+	RelevanceScore float64         `json:"relevance_score"`
+	Document       *RerankDocument `json:"document,omitempty"`
+}
+
+type RerankDocument struct {
+	Text string `json:"text"`
+}
+
+type RerankResponse struct {
+	ID      string         `json:"id,omitempty"`
+	Model   string         `json:"model,omitempty"`
+	Results []RerankResult `json:"results"`
+	Usage   Usage          `json:"usage"`
+}
+
+// rerankClient is implemented by upstream clients that support a rerank API
+type rerankClient interface {
+	Rerank(req RerankRequest) (*RerankResponse, error)
+}
+
+func (c *RealOpenAIClient) Rerank(req RerankRequest) (*RerankResponse, error) {
+	jsonData, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+	body := getBuffer()
+	defer putBuffer(body)
+	if err := c.postValidated(context.Background(), "/rerank", jsonData, rerankSchema, body); err != nil {
+		return nil, err
+	}
+
+	var rerankResp RerankResponse
+	if err := json.Unmarshal(body.Bytes(), &rerankResp); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+	return &rerankResp, nil
+}
+
+var relevanceScore = regexp.MustCompile(`\d+(?:\.\d+)?`)
+
+// rerankWithChat scores every document with a chat completion asking the
+// model how relevant it is to the query, as a cross-encoder would. Replies
+// without a number score 0.
+func (s *ProxyServer) rerankWithChat(ctx context.Context, req RerankRequest) (*RerankResponse, error) {
+	temperature, maxTokens := 0.0, 5
+	results := make([]RerankResult, len(req.Documents))
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		usage    Usage
+		firstErr error
+	)
+	sem := make(chan struct{}, rerankChatConcurrency)
+	for i, doc := range req.Documents {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			resp, err := s.chatCompletion(ctx, ChatCompletionRequest{
+				Model: req.Model,
+				Messages: []Message{
+					{Role: "system", Content: "You judge how relevant a document is to a search query. Reply with a single integer from 0 (unrelated) to 100 (fully answers the query) and nothing else."},
+					{Role: "user", Content: fmt.Sprintf("Query: %s\n\nDocument: %s", req.Query, doc)},
+				},
+				Temperature: &temperature,
+				MaxTokens:   &maxTokens,
+			})
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+			usage.PromptTokens += resp.Usage.PromptTokens
+			usage.CompletionTokens += resp.Usage.CompletionTokens
+			usage.TotalTokens += resp.Usage.TotalTokens
+			results[i] = RerankResult{Index: i}
+			if len(resp.Choices) > 0 {
+				if score, err := strconv.ParseFloat(relevanceScore.FindString(resp.Choices[0].Message.Content), 64); err == nil {
+					results[i].RelevanceScore = min(score, 100) / 100
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return &RerankResponse{Model: req.Model, Results: results, Usage: usage}, nil
+}
+
+func (s *ProxyServer) handleRerank(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	client, ok := s.client.(rerankClient)
+	if s.rerankBackend == RerankAPI && !ok {
+		http.Error(w, "Reranking is not supported by the upstream client", http.StatusNotImplemented)
+		return
+	}
+
+	buf, err := readBody(r.Body, r.ContentLength)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+	defer putBuffer(buf)
+
+	var req RerankRequest
+	if err := json.Unmarshal(buf.Bytes(), &req); err != nil {
+		http.Error(w, "Invalid JSON in request body", http.StatusBadRequest)
+		return
+	}
+	if req.Model == "" {
+		http.Error(w, "Model field is required", http.StatusBadRequest)
+		return
+	}
+	if req.Query == "" {
+		http.Error(w, "Query field is required", http.StatusBadRequest)
+		return
+	}
+	if len(req.Documents) == 0 {
+		http.Error(w, "Documents field is required and cannot be empty", http.StatusBadRequest)
+		return
+	}
+	if req.TopN < 0 {
+		http.Error(w, "top_n cannot be negative", http.StatusBadRequest)
+		return
+	}
+	key := clientKeyFromContext(r.Context())
+	if key != nil && !key.AllowsModel(req.Model) {
+		http.Error(w, fmt.Sprintf("API key is not allowed to use model %s", req.Model), http.StatusForbidden)
+		return
+	}
+	var tenant string
+	if key != nil {
+		tenant = key.Tenant
+	}
+	req.Model = s.resolveModel(req.Model, tenant)
+
+	event := newUsageEvent(key, "rerank", req.Model)
+	var resp *RerankResponse
+	if s.rerankBackend == RerankChat {
+		resp, err = s.rerankWithChat(r.Context(), req)
+	} else {
+		resp, err = client.Rerank(req)
+	}
+	event.LatencyMS = time.Since(event.Time).Milliseconds()
+	if err != nil {
+		log.Printf("OpenAI API error: %v", err)
+		event.Status = upstreamErrorStatus(err)
+		s.recordUsage(event)
+		writeUpstreamError(w, err)
+		return
+	}
+	s.recordCompletion(key, event, resp.Usage)
+
+	// Both backends get the same ordering, truncation and documents, whatever
+	// the upstream returned
+	results := make([]RerankResult, 0, len(resp.Results))
+	for _, result := range resp.Results {
+		if result.Index < 0 || result.Index >= len(req.Documents) {
+			continue
+		}
+		result.Document = nil
+		if req.ReturnDocuments {
+			result.Document = &RerankDocument{Text: req.Documents[result.Index]}
+		}
+		results = append(results, result)
+	}
+	sort.SliceStable(results, func(i, j int) bool { return results[i].RelevanceScore > results[j].RelevanceScore })
+	if req.TopN > 0 && len(results) > req.TopN {
+		results = results[:req.TopN]
+	}
+	resp.Results = results
+	if resp.Model == "" {
+		resp.Model = req.Model
+	}
+
+	out := getBuffer()
+	defer putBuffer(out)
+	if err := json.NewEncoder(out).Encode(resp); err != nil {
+		log.Printf("Failed to encode response: %v", err)
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(out.Bytes())
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// mockRerankClient returns results in document order, scoring each
+// document by its length, plus an index out of range
+type mockRerankClient struct {
+	MockOpenAIClient
+	last RerankRequest
+	err  error
+}
+
+func (m *mockRerankClient) Rerank(req RerankRequest) (*RerankResponse, error) {
+	m.last = req
+	if m.err != nil {
+		return nil, m.err
+	}
+	resp := &RerankResponse{ID: "rr-1", Usage: Usage{TotalTokens: 10}}
+	for i, doc := range req.Documents {
+		resp.Results = append(resp.Results, RerankResult{Index: i, RelevanceScore: float64(len(doc)) / 100})
+	}
+	resp.Results = append(resp.Results, RerankResult{Index: 99, RelevanceScore: 1})
+	return resp, nil
+}
+
+// scoringChatClient answers relevance prompts with the score of the first
+// word of the document found in scores
+type scoringChatClient struct {
+	mu     sync.Mutex
+	scores map[string]string
+	calls  int
+}
+
+func (m *scoringChatClient) CreateChatCompletion(req ChatCompletionRequest) (*ChatCompletionResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls++
+	_, doc, _ := strings.Cut(req.Messages[1].Content, "Document: ")
+	resp := *createTestChatCompletionResponse()
+	resp.Choices = append([]Choice(nil), resp.Choices...)
+	resp.Choices[0].Message.Content = m.scores[strings.Fields(doc)[0]]
+	return &resp, nil
+}
+
+func rerank(server *ProxyServer, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/v1/rerank", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	server.handleRerank(w, req)
+	return w
+}
+
+func TestRerankDocuments_UnmarshalJSON(t *testing.T) {
+	var req RerankRequest
+	if err := json.Unmarshal([]byte(`{"documents": ["a", {"text": "b"}]}`), &req); err != nil || len(req.Documents) != 2 || req.Documents[1] != "b" {
+		t.Errorf("Expected strings and objects, got %v (%v)", req.Documents, err)
+	}
+	if err := json.Unmarshal([]byte(`{"documents": [1]}`), &req); err == nil {
+		t.Error("Expected an error for numbers")
+	}
+}
+
+func TestProxyServer_HandleRerank_API(t *testing.T) {
+	client := &mockRerankClient{}
+	server := NewProxyServer(client)
+
+	w := rerank(server, `{"model": "rerank-v3", "query": "capital of France", "documents": ["Paris", {"text": "Berlin is big"}, "Rome"], "top_n": 2, "return_documents": true}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var resp RerankResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if len(resp.Results) != 2 {
+		t.Fatalf("Expected top 2 results, got %+v", resp.Results)
+	}
+	if resp.Results[0].Index != 1 || resp.Results[0].Document == nil || resp.Results[0].Document.Text != "Berlin is big" {
+		t.Errorf("Expected the best document first with its text, got %+v", resp.Results[0])
+	}
+	if resp.Results[1].Index != 0 {
+		t.Errorf("Expected Paris second, got index %d", resp.Results[1].Index)
+	}
+	if resp.Model != "rerank-v3" || resp.Usage.TotalTokens != 10 {
+		t.Errorf("Expected the model and usage, got %q and %+v", resp.Model, resp.Usage)
+	}
+	if client.last.Query != "capital of France" || len(client.last.Documents) != 3 {
+		t.Errorf("Expected the request to be forwarded, got %+v", client.last)
+	}
+}
+
+func TestProxyServer_HandleRerank_Chat(t *testing.T) {
+	client := &scoringChatClient{scores: map[string]string{"Paris": "95", "Berlin": "Score: 12", "Rome": "no idea"}}
+	server := NewProxyServer(client)
+	server.rerankBackend = RerankChat
+
+	w := rerank(server, `{"model": "gpt-4o-mini", "query": "capital of France", "documents": ["Berlin", "Paris", "Rome"]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var resp RerankResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if len(resp.Results) != 3 || resp.Results[0].Index != 1 || resp.Results[0].RelevanceScore != 0.95 {
+		t.Fatalf("Expected Paris first with 0.95, got %+v", resp.Results)
+	}
+	if resp.Results[1].RelevanceScore != 0.12 || resp.Results[2].RelevanceScore != 0 {
+		t.Errorf("Expected 0.12 and 0 for the rest, got %+v", resp.Results[1:])
+	}
+	if resp.Results[0].Document != nil {
+		t.Error("Expected no documents without return_documents")
+	}
+	if client.calls != 3 || resp.Usage.TotalTokens != 96 {
+		t.Errorf("Expected one scoring call per document with usage summed, got %d calls and %+v", client.calls, resp.Usage)
+	}
+}
+
+func TestProxyServer_HandleRerank_Errors(t *testing.T) {
+	server := NewProxyServer(&MockOpenAIClient{})
+	if w := rerank(server, `{"model": "m", "query": "q", "documents": ["a"]}`); w.Code != http.StatusNotImplemented {
+		t.Errorf("Expected status code %d without a rerank API, got %d", http.StatusNotImplemented, w.Code)
+	}
+
+	server = NewProxyServer(&mockRerankClient{})
+	for _, body := range []string{
+		`{"query": "q", "documents": ["a"]}`,
+		`{"model": "m", "documents": ["a"]}`,
+		`{"model": "m", "query": "q", "documents": []}`,
+		`{"model": "m", "query": "q", "documents": ["a"], "top_n": -1}`,
+		`not json`,
+	} {
+		if w := rerank(server, body); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status code %d for %s, got %d", http.StatusBadRequest, body, w.Code)
+		}
+	}
+
+	server = NewProxyServer(&mockRerankClient{err: errors.New("boom")})
+	if w := rerank(server, `{"model": "m", "query": "q", "documents": ["a"]}`); w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected status code %d, got %d", http.StatusInternalServerError, w.Code)
+	}
+}
+
+func TestRealOpenAIClient_Rerank(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/rerank" || r.Header.Get("Authorization") != "Bearer sk-test" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var req RerankRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		json.NewEncoder(w).Encode(RerankResponse{Model: req.Model, Results: []RerankResult{{Index: 0, RelevanceScore: 0.7}}})
+	}))
+	defer upstream.Close()
+
+	client := NewRealOpenAIClient("sk-test")
+	client.BaseURL = upstream.URL
+	resp, err := client.Rerank(RerankRequest{Model: "m", Query: "q", Documents: RerankDocuments{"a"}})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(resp.Results) != 1 || resp.Results[0].RelevanceScore != 0.7 {
+		t.Errorf("Unexpected response %+v", resp)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"runtime/metrics"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// cgroupLimits are the CPU and memory limits of the container the proxy runs
+// in. Zero means unlimited or unknown.
+type cgroupLimits struct {
+	CPUs        float64
+	MemoryBytes int64
+}
+
+// readCgroupLimits reads the limits of the current cgroup under root
+// (normally /sys/fs/cgroup), supporting both cgroup v2 and v1 layouts
+func readCgroupLimits(root string) cgroupLimits {
+	var limits cgroupLimits
+
+	// cgroup v2: "max 100000" or "<quota> <period>"
+	if fields := readFields(filepath.Join(root, "cpu.max")); len(fields) == 2 && fields[0] != "max" {
+		quota, err1 := strconv.ParseFloat(fields[0], 64)
+		period, err2 := strconv.ParseFloat(fields[1], 64)
+		if err1 == nil && err2 == nil && period > 0 {
+			limits.CPUs = quota / period
+		}
+	} else if quota, period := readInt(filepath.Join(root, "cpu", "cpu.cfs_quota_us")), readInt(filepath.Join(root, "cpu", "cpu.cfs_period_us")); quota > 0 && period > 0 {
+		limits.CPUs = float64(quota) / float64(period)
+	}
+
+	if fields := readFields(filepath.Join(root, "memory.max")); len(fields) == 1 {
+		if n, err := strconv.ParseInt(fields[0], 10, 64); err == nil {
+			limits.MemoryBytes = n
+		}
+	} else if n := readInt(filepath.Join(root, "memory", "memory.limit_in_bytes")); n > 0 && n < math.MaxInt64/2 {
+		// v1 reports "unlimited" as a huge page-aligned number
+		limits.MemoryBytes = n
+	}
+	return limits
+}
+
+func readFields(path string) []string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	return strings.Fields(string(data))
+}
+
+func readInt(path string) int64 {
+	fields := readFields(path)
+	if len(fields) != 1 {
+		return 0
+	}
+	n, _ := strconv.ParseInt(fields[0], 10, 64)
+	return n
+}
+
+// applyRuntimeLimits sizes GOMAXPROCS to the CPU quota and sets a soft
+// memory limit at memoryRatio of the memory limit, so the GC works harder
+// before the kernel OOM-kills the container. Explicit GOMAXPROCS and
+// GOMEMLIMIT settings win. It returns the memory limit in effect, or zero.
+func applyRuntimeLimits(limits cgroupLimits, memoryRatio float64) int64 {
+	if limits.CPUs > 0 && os.Getenv("GOMAXPROCS") == "" {
+		procs := max(1, int(math.Floor(limits.CPUs)))
+		runtime.GOMAXPROCS(procs)
+		log.Printf("Set GOMAXPROCS to %d to match the CPU quota of %.2f", procs, limits.CPUs)
+	}
+	if limits.MemoryBytes <= 0 {
+		return 0
+	}
+	if os.Getenv("GOMEMLIMIT") == "" {
+		soft := int64(float64(limits.MemoryBytes) * memoryRatio)
+		debug.SetMemoryLimit(soft)
+		log.Printf("Set soft memory limit to %d bytes (%.0f%% of %d)", soft, memoryRatio*100, limits.MemoryBytes)
+	}
+	return limits.MemoryBytes
+}
+
+// memoryGuard sheds load when the process gets close to its memory limit.
+// Usage is sampled in the background so the check on the request path is a
+// single atomic load.
+type memoryGuard struct {
+	threshold int64
+	usage     func() int64
+	shedding  atomic.Bool
+}
+
+func newMemoryGuard(threshold int64) *memoryGuard {
+	return &memoryGuard{threshold: threshold, usage: processMemory}
+}
+
+// processMemory is the memory the Go runtime holds from the OS, excluding
+// heap returned to it
+func processMemory() int64 {
+	samples := []metrics.Sample{
+		{Name: "/memory/classes/total:bytes"},
+		{Name: "/memory/classes/heap/released:bytes"},
+	}
+	metrics.Read(samples)
+	return int64(samples[0].Value.Uint64() - samples[1].Value.Uint64())
+}
+
+// check samples memory usage and updates the shedding state
+func (g *memoryGuard) check() {
+	usage := g.usage()
+	shedding := usage >= g.threshold
+	if g.shedding.Swap(shedding) != shedding {
+		if shedding {
+			log.Printf("Memory usage %d bytes is above %d, shedding load", usage, g.threshold)
+		} else {
+			log.Printf("Memory usage %d bytes is back below %d, accepting requests", usage, g.threshold)
+		}
+	}
+}
+
+// Run samples memory usage every interval until ctx is cancelled
+func (g *memoryGuard) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			g.check()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Shedding reports whether new requests should be refused
+func (g *memoryGuard) Shedding() bool {
+	return g.shedding.Load()
+}
+
+// withLoadShedding refuses requests with 503 while memory usage is near the
+// limit, so a burst degrades into retries instead of an OOM kill that drops
+// every in-flight request
+func (s *ProxyServer) withLoadShedding(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.memory != nil && s.memory.Shedding() {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Server is overloaded, retry later", http.StatusServiceUnavailable)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// ratioFromEnv parses a ratio in (0, 1] from the environment
+func ratioFromEnv(name string, def float64) float64 {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	ratio, err := strconv.ParseFloat(v, 64)
+	if err != nil || ratio <= 0 || ratio > 1 {
+		log.Fatalf("Invalid %s %q, expected a ratio between 0 and 1", name, v)
+	}
+	return ratio
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeCgroupFile(t *testing.T, root, name, content string) {
+	t.Helper()
+	path := filepath.Join(root, name)
+	os.MkdirAll(filepath.Dir(path), 0o755)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("Failed to write %s: %v", name, err)
+	}
+}
+
+func TestReadCgroupLimits_V2(t *testing.T) {
+	root := t.TempDir()
+	writeCgroupFile(t, root, "cpu.max", "250000 100000\n")
+	writeCgroupFile(t, root, "memory.max", "536870912\n")
+
+	limits := readCgroupLimits(root)
+	if limits.CPUs != 2.5 {
+		t.Errorf("Expected 2.5 CPUs, got %v", limits.CPUs)
+	}
+	if limits.MemoryBytes != 512<<20 {
+		t.Errorf("Expected 512 MiB, got %d", limits.MemoryBytes)
+	}
+}
+
+func TestReadCgroupLimits_V2Unlimited(t *testing.T) {
+	root := t.TempDir()
+	writeCgroupFile(t, root, "cpu.max", "max 100000\n")
+	writeCgroupFile(t, root, "memory.max", "max\n")
+
+	if limits := readCgroupLimits(root); limits != (cgroupLimits{}) {
+		t.Errorf("Expected no limits, got %+v", limits)
+	}
+}
+
+func TestReadCgroupLimits_V1(t *testing.T) {
+	root := t.TempDir()
+	writeCgroupFile(t, root, "cpu/cpu.cfs_quota_us", "50000\n")
+	writeCgroupFile(t, root, "cpu/cpu.cfs_period_us", "100000\n")
+	writeCgroupFile(t, root, "memory/memory.limit_in_bytes", "268435456\n")
+
+	limits := readCgroupLimits(root)
+	if limits.CPUs != 0.5 {
+		t.Errorf("Expected 0.5 CPUs, got %v", limits.CPUs)
+	}
+	if limits.MemoryBytes != 256<<20 {
+		t.Errorf("Expected 256 MiB, got %d", limits.MemoryBytes)
+	}
+}
+
+func TestReadCgroupLimits_V1Unlimited(t *testing.T) {
+	root := t.TempDir()
+	writeCgroupFile(t, root, "cpu/cpu.cfs_quota_us", "-1\n")
+	writeCgroupFile(t, root, "cpu/cpu.cfs_period_us", "100000\n")
+	writeCgroupFile(t, root, "memory/memory.limit_in_bytes", "9223372036854771712\n")
+
+	if limits := readCgroupLimits(root); limits != (cgroupLimits{}) {
+		t.Errorf("Expected no limits, got %+v", limits)
+	}
+}
+
+func TestMemoryGuard_Check(t *testing.T) {
+	usage := int64(100)
+	guard := &memoryGuard{threshold: 1000, usage: func() int64 { return usage }}
+
+	guard.check()
+	if guard.Shedding() {
+		t.Error("Expected no shedding below the threshold")
+	}
+	usage = 1000
+	guard.check()
+	if !guard.Shedding() {
+		t.Error("Expected shedding at the threshold")
+	}
+	usage = 500
+	guard.check()
+	if guard.Shedding() {
+		t.Error("Expected shedding to stop once usage drops")
+	}
+}
+
+func TestProxyServer_WithLoadShedding(t *testing.T) {
+	server := NewProxyServer(&MockOpenAIClient{})
+	server.memory = &memoryGuard{threshold: 1, usage: func() int64 { return 2 }}
+	handler := server.withLoadShedding(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("POST", "/v1/chat/completions", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status code %d before sampling, got %d", http.StatusOK, w.Code)
+	}
+
+	server.memory.check()
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("POST", "/v1/chat/completions", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status code %d, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("Expected a Retry-After header")
+	}
+}
+
+func TestProcessMemory(t *testing.T) {
+	if processMemory() <= 0 {
+		t.Error("Expected a positive memory usage")
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Retrieval modes
+const (
+	RetrievalVector  = "vector"
+	RetrievalKeyword = "keyword"
+	RetrievalHybrid  = "hybrid"
+)
+
+// Fusion methods combining keyword and vector rankings in hybrid mode
+const (
+	// Reciprocal rank fusion, which only looks at ranks
+	FusionRRF = "rrf"
+	// A weighted sum of the min-max normalized scores
+	FusionWeighted = "weighted"
+)
+
+// BM25 parameters, and k of reciprocal rank fusion, at their usual values
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+	rrfK   = 60
+)
+
+// What retrieval does with documents embedded by another model than the
+// query, whose similarities to it mean nothing
+const (
+	// Refuse the query until the knowledge base is reindexed
+	MismatchReject = "reject"
+	// Embed the documents again with the query's model first
+	MismatchReembed = "reembed"
+)
+
+// errEmbeddingModelMismatch is wrapped by errors for queries embedded by
+// another model than the documents searched
+var errEmbeddingModelMismatch = errors.New("embedding model mismatch")
+
+// errBadRetrieval is wrapped by errors for retrieval settings that are not
+// valid
+var errBadRetrieval = errors.New("invalid retrieval settings")
+
+// RetrievalConfig is how chunks relevant to a query are found
+type RetrievalConfig struct {
+	// Mode is vector (default), keyword (BM25) or hybrid
+	Mode string `json:"mode,omitempty"`
+	// Fusion is rrf (default) or weighted, for hybrid mode
+	Fusion string `json:"fusion,omitempty"`
+	// VectorWeight is the share of the vector score with weighted fusion,
+	// from 0 to 1 (default 0.5)
+	VectorWeight *float64 `json:"vector_weight,omitempty"`
+}
+
+// validate checks the config and fills in the defaults
+func (c *RetrievalConfig) validate() error {
+	switch c.Mode {
+	case "":
+		c.Mode = RetrievalVector
+	case RetrievalVector, RetrievalKeyword, RetrievalHybrid:
+	default:
+		return fmt.Errorf("%w: unknown retrieval mode %q", errBadRetrieval, c.Mode)
+	}
+	switch c.Fusion {
+	case "":
+		c.Fusion = FusionRRF
+	case FusionRRF, FusionWeighted:
+	default:
+		return fmt.Errorf("%w: unknown fusion %q", errBadRetrieval, c.Fusion)
+	}
+	if w := c.VectorWeight; w != nil && (*w < 0 || *w > 1) {
+		return fmt.Errorf("%w: vector_weight must be between 0 and 1", errBadRetrieval)
+	}
+	return nil
+}
+
+// usesVectors reports whether queries need to be embedded
+func (c RetrievalConfig) usesVectors() bool {
+	return c.Mode != RetrievalKeyword
+}
+
+// keywordTerms splits text into lowercase words for BM25
+func keywordTerms(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// termCounts counts the keyword terms of a chunk when it is stored
+func termCounts(text string) (map[string]int, int) {
+	terms := keywordTerms(text)
+	counts := make(map[string]int, len(terms))
+	for _, term := range terms {
+		counts[term]++
+	}
+	return counts, len(terms)
+}
+
+// bm25Scores scores every chunk against the query terms. Document
+// frequencies are computed over the chunks given, so scores are relative
+// to what is searched.
+func bm25Scores(query string, chunks []*ragChunk) []float64 {
+	scores := make([]float64, len(chunks))
+	if len(chunks) == 0 {
+		return scores
+	}
+	var total int
+	for _, chunk := range chunks {
+		total += chunk.length
+	}
+	avgLength := float64(total) / float64(len(chunks))
+	seen := make(map[string]bool)
+	for _, term := range keywordTerms(query) {
+		if seen[term] {
+			continue
+		}
+		seen[term] = true
+		df := 0
+		for _, chunk := range chunks {
+			if chunk.terms[term] > 0 {
+				df++
+			}
+		}
+		if df == 0 {
+			continue
+		}
+		idf := math.Log(1 + (float64(len(chunks))-float64(df)+0.5)/(float64(df)+0.5))
+		for i, chunk := range chunks {
+			tf := float64(chunk.terms[term])
+			if tf == 0 {
+				continue
+			}
+			norm := 1 - bm25B
+			if avgLength > 0 {
+				norm += bm25B * float64(chunk.length) / avgLength
+			}
+			scores[i] += idf * tf * (bm25K1 + 1) / (tf + bm25K1*norm)
+		}
+	}
+	return scores
+}
+
+// rankBy returns the indexes of the candidates that pass keep, or all of
+// them if keep is nil, best first
+func rankBy(scores []float64, keep func(float64) bool) []int {
+	var ranked []int
+	for i, score := range scores {
+		if keep == nil || keep(score) {
+			ranked = append(ranked, i)
+		}
+	}
+	sort.SliceStable(ranked, func(a, b int) bool { return scores[ranked[a]] > scores[ranked[b]] })
+	return ranked
+}
+
+// fuse combines the vector and keyword rankings of hybrid retrieval into
+// one score per candidate. Candidates in neither ranking score 0.
+func fuse(config RetrievalConfig, vector, keyword []float64, vectorRanked, keywordRanked []int) []float64 {
+	fused := make([]float64, len(vector))
+	if config.Fusion == FusionRRF {
+		for rank, i := range vectorRanked {
+			fused[i] += 1 / float64(rrfK+rank+1)
+		}
+		for rank, i := range keywordRanked {
+			fused[i] += 1 / float64(rrfK+rank+1)
+		}
+		return fused
+	}
+	weight := 0.5
+	if config.VectorWeight != nil {
+		weight = *config.VectorWeight
+	}
+	normalize := func(scores []float64, ranked []int) map[int]float64 {
+		out := make(map[int]float64, len(ranked))
+		if len(ranked) == 0 {
+			return out
+		}
+		hi, lo := scores[ranked[0]], scores[ranked[len(ranked)-1]]
+		for _, i := range ranked {
+			out[i] = 1
+			if hi > lo {
+				out[i] = (scores[i] - lo) / (hi - lo)
+			}
+		}
+		return out
+	}
+	v, k := normalize(vector, vectorRanked), normalize(keyword, keywordRanked)
+	for i := range fused {
+		fused[i] = weight*v[i] + (1-weight)*k[i]
+	}
+	return fused
+}
+
+// retrieve returns the chunks most relevant to query, best first, with the
+// score of the retrieval mode: cosine similarity, BM25 or the fused score.
+// min_score applies to the cosine similarity of the vector ranking.
+func (s *ProxyServer) retrieve(kb KnowledgeBase, query string, opts RAGOptions, config RetrievalConfig) ([]Citation, Usage, error) {
+	var usage Usage
+	var queryVector []float64
+	docs := kb.docs.List()
+	if config.usesVectors() {
+		vectors, model, u, err := s.embed(s.embeddingModel(kb), []string{query})
+		if err != nil {
+			return nil, Usage{}, err
+		}
+		usage, queryVector = u, vectors[0]
+		if docs, err = s.matchEmbeddingModel(kb, docs, model); err != nil {
+			return nil, Usage{}, err
+		}
+	}
+
+	type candidate struct {
+		doc   *RAGDocument
+		index int
+	}
+	var candidates []candidate
+	var chunks []*ragChunk
+	for d := range docs {
+		for i := range docs[d].chunks {
+			candidates = append(candidates, candidate{&docs[d], i})
+			chunks = append(chunks, &docs[d].chunks[i])
+		}
+	}
+
+	var vector, keyword []float64
+	var vectorRanked, keywordRanked []int
+	if config.usesVectors() {
+		vector = make([]float64, len(chunks))
+		for i, chunk := range chunks {
+			vector[i] = cosineSimilarity(queryVector, chunk.vector)
+		}
+		vectorRanked = rankBy(vector, func(score float64) bool { return score >= opts.MinScore })
+	}
+	if config.Mode != RetrievalVector {
+		keyword = bm25Scores(query, chunks)
+		keywordRanked = rankBy(keyword, func(score float64) bool { return score > 0 })
+	}
+
+	scores, ranked := vector, vectorRanked
+	switch config.Mode {
+	case RetrievalKeyword:
+		scores, ranked = keyword, keywordRanked
+	case RetrievalHybrid:
+		scores = fuse(config, vector, keyword, vectorRanked, keywordRanked)
+		ranked = rankBy(scores, nil)
+		ranked = slices.DeleteFunc(ranked, func(i int) bool {
+			return !slices.Contains(vectorRanked, i) && !slices.Contains(keywordRanked, i)
+		})
+	}
+
+	topK := opts.TopK
+	if topK <= 0 {
+		topK = 4
+	}
+	if len(ranked) > topK {
+		ranked = ranked[:topK]
+	}
+	found := make([]Citation, len(ranked))
+	for n, i := range ranked {
+		c := candidates[i]
+		found[n] = Citation{
+			Index:         n + 1,
+			KnowledgeBase: kb.ID,
+			Document:      c.doc.ID,
+			Title:         c.doc.Title,
+			Source:        c.doc.Source,
+			Chunk:         c.index,
+			Score:         scores[i],
+			Text:          c.doc.chunks[c.index].text,
+		}
+	}
+	return found, usage, nil
+}
+
+// matchEmbeddingModel returns docs if they were all embedded with model,
+// the one the query was embedded with. Otherwise it fails or, with
+// PROXY_RAG_MODEL_MISMATCH=reembed, embeds the others again with the
+// knowledge base's model and stores them.
+func (s *ProxyServer) matchEmbeddingModel(kb KnowledgeBase, docs []RAGDocument, model string) ([]RAGDocument, error) {
+	var stale []int
+	for i, doc := range docs {
+		if len(doc.chunks) > 0 && doc.EmbeddingModel != model {
+			stale = append(stale, i)
+		}
+	}
+	if len(stale) == 0 {
+		return docs, nil
+	}
+	first := docs[stale[0]]
+	if s.ragModelMismatch != MismatchReembed {
+		return nil, fmt.Errorf("%w: %d documents of knowledge base %s, such as %s, were embedded with %s but the query with %s; reindex the knowledge base",
+			errEmbeddingModelMismatch, len(stale), kb.ID, first.ID, first.EmbeddingModel, model)
+	}
+	for _, i := range stale {
+		indexed, err := s.indexDocument(kb, docs[i])
+		if err != nil {
+			return nil, fmt.Errorf("document %s: %w", docs[i].ID, err)
+		}
+		if indexed.EmbeddingModel != model {
+			return nil, fmt.Errorf("%w: document %s was embedded again with %s but the query with %s",
+				errEmbeddingModelMismatch, indexed.ID, indexed.EmbeddingModel, model)
+		}
+		docs[i] = indexed
+		kb.docs.Put(indexed.ID, indexed)
+	}
+	kb.stats.touch(false)
+	return docs, nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestBM25Scores(t *testing.T) {
+	var chunks []*ragChunk
+	for _, text := range []string{
+		"The refund is paid to the card used for the order.",
+		"Refund, refund, refund: refunds are our favourite topic.",
+		"Shipping takes three days.",
+	} {
+		terms, length := termCounts(text)
+		chunks = append(chunks, &ragChunk{text: text, terms: terms, length: length})
+	}
+	scores := bm25Scores("refund card", chunks)
+	if scores[2] != 0 {
+		t.Errorf("Expected no score without matching terms, got %v", scores[2])
+	}
+	if scores[0] <= scores[1] {
+		t.Errorf("Expected the rare term to outweigh repetition, got %v", scores)
+	}
+	if ranked := rankBy(scores, func(s float64) bool { return s > 0 }); len(ranked) != 2 || ranked[0] != 0 {
+		t.Errorf("Expected chunks 0 and 1 ranked, got %v", ranked)
+	}
+}
+
+func TestFuse(t *testing.T) {
+	vector := []float64{0.9, 0.5, 0.1}
+	keyword := []float64{0, 2, 4}
+	vectorRanked, keywordRanked := []int{0, 1}, []int{2, 1}
+
+	rrf := fuse(RetrievalConfig{Fusion: FusionRRF}, vector, keyword, vectorRanked, keywordRanked)
+	if rrf[1] <= rrf[0] || rrf[1] <= rrf[2] {
+		t.Errorf("Expected the chunk in both rankings to win with RRF, got %v", rrf)
+	}
+
+	weight := 0.8
+	weighted := fuse(RetrievalConfig{Fusion: FusionWeighted, VectorWeight: &weight}, vector, keyword, vectorRanked, keywordRanked)
+	if math.Abs(weighted[0]-0.8) > 1e-9 || math.Abs(weighted[2]-0.2) > 1e-9 {
+		t.Errorf("Expected normalized scores weighted 0.8 and 0.2, got %v", weighted)
+	}
+}
+
+func TestRetrievalConfig_Validate(t *testing.T) {
+	config := RetrievalConfig{}
+	if err := config.validate(); err != nil || config.Mode != RetrievalVector || config.Fusion != FusionRRF {
+		t.Errorf("Expected the defaults to be filled in, got %+v (%v)", config, err)
+	}
+	weight := 1.5
+	for _, config := range []RetrievalConfig{{Mode: "fuzzy"}, {Fusion: "max"}, {VectorWeight: &weight}} {
+		if err := config.validate(); !errors.Is(err, errBadRetrieval) {
+			t.Errorf("Expected %+v to be invalid, got %v", config, err)
+		}
+	}
+}
+
+func TestProxyServer_HybridRetrieval(t *testing.T) {
+	server, _ := newRAGServer(t, "Hello")
+	body := `{"model": "gpt-4o", "messages": [{"role": "user", "content": "Where is my receipt?"}], "rag": {"min_score": 0.5, "retrieval": "%s"}}`
+	citations := func(mode string) []Citation {
+		w := chatRequestAs(server, nil, fmt.Sprintf(body, mode))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status code %d for %s, got %d: %s", http.StatusOK, mode, w.Code, w.Body.String())
+		}
+		var resp ChatCompletionResponse
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		if resp.Metadata == nil {
+			return nil
+		}
+		return resp.Metadata.Citations
+	}
+
+	if got := citations(RetrievalVector); len(got) != 0 {
+		t.Errorf("Expected vector retrieval to miss the keyword, got %+v", got)
+	}
+	for _, mode := range []string{RetrievalKeyword, RetrievalHybrid} {
+		got := citations(mode)
+		if len(got) != 1 || got[0].Document != "refunds" || got[0].Score <= 0 {
+			t.Errorf("Expected %s retrieval to find the refund policy, got %+v", mode, got)
+		}
+	}
+
+	w := chatRequestAs(server, nil, fmt.Sprintf(body, "fuzzy"))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d for an unknown mode, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestProxyServer_RetrievalEmbeddingModelMismatch(t *testing.T) {
+	server, client := newRAGServer(t, "Hello")
+	kb, _ := server.knowledgeBases.Get("default")
+	if doc, _ := kb.docs.Get("refunds"); doc.EmbeddingModel != "text-embedding-3-small" {
+		t.Fatalf("Expected the document tagged with its embedding model, got %q", doc.EmbeddingModel)
+	}
+	body := `{"model": "gpt-4o", "messages": [{"role": "user", "content": "How do I get a refund?"}], "rag": {"min_score": 0.5}}`
+
+	// The upstream now embeds with a newer version of the model
+	client.served = "text-embedding-3-small-v2"
+	w := chatRequestAs(server, nil, body)
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "reindex") {
+		t.Fatalf("Expected status code %d asking for a reindex, got %d: %s", http.StatusConflict, w.Code, w.Body.String())
+	}
+	if w := chatRequestAs(server, nil, strings.Replace(body, `"min_score"`, `"retrieval": "keyword", "min_score"`, 1)); w.Code != http.StatusOK {
+		t.Errorf("Expected keyword retrieval to work without vectors, got %d: %s", w.Code, w.Body.String())
+	}
+
+	server.ragModelMismatch = MismatchReembed
+	w = chatRequestAs(server, nil, body)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var resp ChatCompletionResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Metadata == nil || len(resp.Metadata.Citations) != 1 || resp.Metadata.Citations[0].Document != "refunds" {
+		t.Errorf("Expected the refund policy found after embedding it again, got %+v", resp.Metadata)
+	}
+	if view := kb.view(); view.EmbeddingModels["text-embedding-3-small-v2"] != 2 || len(view.EmbeddingModels) != 1 {
+		t.Errorf("Expected both documents embedded with the new version, got %v", view.EmbeddingModels)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Upstreams shed load with 429s and fail over with 502s and 503s, and most
+// such failures are gone a moment later. Requests answered with 429 or a
+// 5xx are sent again after a delay that doubles with every attempt, half of
+// it random so that replicas retrying the same outage do not do so in
+// step, or after what the upstream asks for in Retry-After. Responses to
+// requests that needed retries say how many upstream requests were made in
+// X-Upstream-Attempts.
+
+const upstreamAttemptsHeader = "X-Upstream-Attempts"
+
+// RetryPolicy is how requests the upstream failed are retried. The zero
+// value does not retry.
+type RetryPolicy struct {
+	// Retries is how often a request is sent again at most
+	Retries int
+	// Delay is the wait before the first retry, doubled for each one after
+	Delay time.Duration
+	// MaxDelay caps the wait; a request the upstream asks to retry later
+	// than that is not retried
+	MaxDelay time.Duration
+}
+
+// retryPolicyFromEnv configures retries from PROXY_UPSTREAM_RETRIES (default
+// 2), PROXY_UPSTREAM_RETRY_DELAY (default 500ms) and
+// PROXY_UPSTREAM_RETRY_MAX_DELAY (default 20s)
+func retryPolicyFromEnv(getenv func(string) string) (RetryPolicy, error) {
+	p := RetryPolicy{Retries: 2, Delay: 500 * time.Millisecond, MaxDelay: 20 * time.Second}
+	if v := getenv("PROXY_UPSTREAM_RETRIES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return p, fmt.Errorf("invalid PROXY_UPSTREAM_RETRIES %q", v)
+		}
+		p.Retries = n
+	}
+	for name, d := range map[string]*time.Duration{
+		"PROXY_UPSTREAM_RETRY_DELAY":     &p.Delay,
+		"PROXY_UPSTREAM_RETRY_MAX_DELAY": &p.MaxDelay,
+	} {
+		if v := getenv(name); v != "" {
+			parsed, err := time.ParseDuration(v)
+			if err != nil || parsed <= 0 {
+				return p, fmt.Errorf("invalid %s %q", name, v)
+			}
+			*d = parsed
+		}
+	}
+	return p, nil
+}
+
+// retryableStatus reports whether a response with status may succeed when
+// the request is sent again
+func retryableStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+// backoff returns how long to wait before retrying a request that got resp
+// on its attempt'th retry, counting from 0, or false if it is not retried
+func (p RetryPolicy) backoff(attempt int, resp *http.Response, now time.Time) (time.Duration, bool) {
+	if attempt >= p.Retries || !retryableStatus(resp.StatusCode) {
+		return 0, false
+	}
+	if after, ok := retryAfter(resp.Header.Get("Retry-After"), now); ok {
+		if p.MaxDelay > 0 && after > p.MaxDelay {
+			return 0, false
+		}
+		return after, true
+	}
+	d := p.Delay << attempt
+	if p.MaxDelay > 0 && (d > p.MaxDelay || d <= 0) {
+		d = p.MaxDelay
+	}
+	return d/2 + rand.N(d/2+1), true
+}
+
+// retryAfter parses a Retry-After header, in seconds or as an HTTP date
+func retryAfter(v string, now time.Time) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(v); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(v); err == nil {
+		return max(0, at.Sub(now)), true
+	}
+	return 0, false
+}
+
+// send posts jsonData to path, retrying as the client's policy says, and
+// returns the last response. prepare, if set, adjusts each request before
+// it is sent.
+func (c *RealOpenAIClient) send(ctx context.Context, path string, jsonData []byte, prepare func(*http.Request)) (*http.Response, error) {
+	timeline := timelineFromContext(ctx)
+	// switches counts the requests sent again at once with another key of
+	// the pool
+	switches := 0
+	for attempt := 0; ; attempt++ {
+		// jsonData may be a pooled buffer, so the transport must not read
+		// it after we return
+		reqBody := newDetachableReader(jsonData)
+		defer reqBody.Detach()
+		httpReq, err := c.newRequest(ctx, path, reqBody, len(jsonData))
+		if err != nil {
+			return nil, err
+		}
+		if prepare != nil {
+			prepare(httpReq)
+		}
+		if echo := debugEchoFromContext(ctx); echo != nil {
+			echo.capture(httpReq, jsonData)
+			return nil, errUpstreamEchoed
+		}
+		pooled := c.pooledKey(ctx)
+		if pooled != nil {
+			c.authorize(httpReq, pooled.key)
+		}
+
+		timeline.upstreamAttempt(attempt > 0 || switches > 0)
+		sp := traceUpstream(httpReq)
+		resp, err := c.HTTPClient.Do(httpReq)
+		endUpstream(sp, resp, err)
+		if err != nil {
+			if pooled != nil {
+				c.Keys.release(pooled)
+			}
+			return nil, fmt.Errorf("failed to send request: %w", err)
+		}
+		if pooled != nil {
+			if c.Keys.observe(pooled, resp) && switches < len(c.Keys.keys)-1 {
+				resp.Body.Close()
+				c.Keys.release(pooled)
+				timeline.Addf(TimelineRetried, "upstream status %d, retrying with another key", resp.StatusCode)
+				switches++
+				attempt--
+				continue
+			}
+			resp.Body = &releasingBody{ReadCloser: resp.Body, release: func() { c.Keys.release(pooled) }}
+		}
+		wait, ok := c.Retry.backoff(attempt, resp, time.Now())
+		if !ok {
+			return resp, nil
+		}
+		resp.Body.Close()
+		timeline.Addf(TimelineRetried, "upstream status %d, retrying in %v", resp.StatusCode, wait.Round(time.Millisecond))
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, fmt.Errorf("failed to send request: %w", ctx.Err())
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	policy := RetryPolicy{Retries: 3, Delay: 100 * time.Millisecond, MaxDelay: 10 * time.Second}
+	response := func(status int, retryAfter string) *http.Response {
+		resp := &http.Response{StatusCode: status, Header: http.Header{}}
+		if retryAfter != "" {
+			resp.Header.Set("Retry-After", retryAfter)
+		}
+		return resp
+	}
+
+	for attempt, want := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond} {
+		d, ok := policy.backoff(attempt, response(http.StatusServiceUnavailable, ""), now)
+		if !ok || d < want/2 || d > want {
+			t.Errorf("Attempt %d: expected a wait between %v and %v, got %v %v", attempt, want/2, want, d, ok)
+		}
+	}
+	if _, ok := policy.backoff(3, response(http.StatusServiceUnavailable, ""), now); ok {
+		t.Error("Expected no retry once the retries are used up")
+	}
+	if _, ok := policy.backoff(0, response(http.StatusBadRequest, ""), now); ok {
+		t.Error("Expected client errors not to be retried")
+	}
+
+	tests := []struct {
+		retryAfter string
+		want       time.Duration
+		ok         bool
+	}{
+		{"2", 2 * time.Second, true},
+		{now.Add(5 * time.Second).Format(http.TimeFormat), 5 * time.Second, true},
+		{"60", 0, false},
+	}
+	for _, tt := range tests {
+		d, ok := policy.backoff(0, response(http.StatusTooManyRequests, tt.retryAfter), now)
+		if d != tt.want || ok != tt.ok {
+			t.Errorf("Retry-After %q: expected %v %v, got %v %v", tt.retryAfter, tt.want, tt.ok, d, ok)
+		}
+	}
+}
+
+func TestRetryPolicyFromEnv(t *testing.T) {
+	policy, err := retryPolicyFromEnv(func(string) string { return "" })
+	if err != nil || policy.Retries != 2 || policy.Delay != 500*time.Millisecond {
+		t.Errorf("Expected the defaults, got %+v %v", policy, err)
+	}
+	env := map[string]string{"PROXY_UPSTREAM_RETRIES": "0", "PROXY_UPSTREAM_RETRY_MAX_DELAY": "1m"}
+	policy, err = retryPolicyFromEnv(func(name string) string { return env[name] })
+	if err != nil || policy.Retries != 0 || policy.MaxDelay != time.Minute {
+		t.Errorf("Expected the configured policy, got %+v %v", policy, err)
+	}
+	if _, err := retryPolicyFromEnv(func(name string) string {
+		if name == "PROXY_UPSTREAM_RETRY_DELAY" {
+			return "soon"
+		}
+		return ""
+	}); err == nil {
+		t.Error("Expected an invalid delay to be rejected")
+	}
+}
+
+func TestProxyServer_RetriesUpstreamFailures(t *testing.T) {
+	var calls atomic.Int32
+	failures := int32(2)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) <= failures {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprint(w, `{"error":{"message":"slow down","type":"requests"}}`)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(createTestChatCompletionResponse())
+	}))
+	defer api.Close()
+
+	client := NewRealOpenAIClient("sk-upstream")
+	client.BaseURL = api.URL
+	client.Retry = RetryPolicy{Retries: 2, Delay: time.Millisecond}
+	server := NewProxyServer(client)
+	server.keys = createTestKeyStore(t)
+	server.submissions = nil
+	handler := server.Handler()
+	do := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "gpt-4o", "messages": [{"role": "user", "content": "Hi"}]}`))
+		req.Header.Set("Authorization", "Bearer sk-full")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do()
+	if w.Code != http.StatusOK || w.Header().Get(upstreamAttemptsHeader) != "3" {
+		t.Fatalf("Expected success after two retries, got %d %q", w.Code, w.Header().Get(upstreamAttemptsHeader))
+	}
+	timeline, _ := server.timelines.Get(w.Header().Get(requestIDHeader))
+	retries := 0
+	for _, event := range timeline.snapshot().Events {
+		if event.Event == TimelineRetried {
+			retries++
+		}
+	}
+	if retries != 2 {
+		t.Errorf("Expected two retries on the timeline, got %d", retries)
+	}
+
+	calls.Store(0)
+	failures = 10
+	w = do()
+	if w.Code == http.StatusOK || !strings.Contains(w.Body.String(), "slow down") || w.Header().Get(upstreamAttemptsHeader) != "3" {
+		t.Errorf("Expected the last failure after all retries, got %d %q %s", w.Code, w.Header().Get(upstreamAttemptsHeader), w.Body.String())
+	}
+
+	calls.Store(100)
+	if w := do(); w.Header().Get(upstreamAttemptsHeader) != "" {
+		t.Errorf("Expected no attempts header without retries, got %q", w.Header().Get(upstreamAttemptsHeader))
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Policies every client app should follow, such as which model "fast"
+// means, how many tokens a reply may take or the system prompt of the
+// organization, are kept in one place instead of in each app. The rules of
+// PROXY_REWRITES_FILE rewrite the body of requests to a route before
+// anything else reads it, in the order of the file.
+
+// RewriteRule rewrites the requests to a route
+type RewriteRule struct {
+	Name string `json:"name"`
+	// Path is the route the rule applies to, with a trailing * matching
+	// any, by default /v1/chat/completions
+	Path string `json:"path,omitempty"`
+	// Tenant, if set, limits the rule to that tenant's keys
+	Tenant string `json:"tenant,omitempty"`
+	// Aliases map the models clients ask for to the ones requests are sent
+	// for, e.g. "fast" to "gpt-4o-mini"
+	Aliases map[string]string `json:"aliases,omitempty"`
+	// Models, if set, limits the parameters and system prompt of the rule
+	// to requests for these models, after aliasing, with a trailing *
+	// matching any
+	Models []string `json:"models,omitempty"`
+	// MaxTokens and Temperature clamp or inject parameters
+	MaxTokens   *ParameterRewrite `json:"max_tokens,omitempty"`
+	Temperature *ParameterRewrite `json:"temperature,omitempty"`
+	// System is sent as the first message, ahead of any the client sends
+	System string `json:"system,omitempty"`
+}
+
+// ParameterRewrite bounds a numeric parameter of requests, and sets it on
+// requests without one
+type ParameterRewrite struct {
+	Default *float64 `json:"default,omitempty"`
+	Min     *float64 `json:"min,omitempty"`
+	Max     *float64 `json:"max,omitempty"`
+}
+
+// apply returns the value a parameter is rewritten to, and whether it is
+// set at all
+func (p *ParameterRewrite) apply(value float64, set bool) (float64, bool) {
+	if !set {
+		if p.Default == nil {
+			return 0, false
+		}
+		value = *p.Default
+	}
+	if p.Min != nil && value < *p.Min {
+		value = *p.Min
+	}
+	if p.Max != nil && value > *p.Max {
+		value = *p.Max
+	}
+	return value, true
+}
+
+// loadRewrites reads the rewrite rules of a JSON file
+func loadRewrites(path string) ([]RewriteRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rewrites file: %w", err)
+	}
+	var rules []RewriteRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("failed to parse rewrites file: %w", err)
+	}
+	for i, rule := range rules {
+		if rule.Name == "" {
+			return nil, fmt.Errorf("rewrite rule requires a name")
+		}
+		if rule.Path == "" {
+			rules[i].Path = "/v1/chat/completions"
+		}
+		for _, p := range []*ParameterRewrite{rule.MaxTokens, rule.Temperature} {
+			if p != nil && p.Min != nil && p.Max != nil && *p.Min > *p.Max {
+				return nil, fmt.Errorf("rewrite rule %s: min is above max", rule.Name)
+			}
+		}
+	}
+	return rules, nil
+}
+
+// rewrite applies the rule to a request body, returning what it changed
+func (rule RewriteRule) rewrite(doc map[string]any) []string {
+	var changes []string
+	model, _ := doc["model"].(string)
+	if alias, ok := rule.Aliases[model]; ok {
+		doc["model"] = alias
+		changes = append(changes, fmt.Sprintf("model %s→%s", model, alias))
+		model = alias
+	}
+	if len(rule.Models) > 0 && !matchAny(rule.Models, model) {
+		return changes
+	}
+	// Newer models take max_completion_tokens instead
+	maxTokens := "max_tokens"
+	if _, ok := doc["max_completion_tokens"]; ok {
+		maxTokens = "max_completion_tokens"
+	}
+	for _, param := range []struct {
+		name    string
+		rewrite *ParameterRewrite
+		integer bool
+	}{{maxTokens, rule.MaxTokens, true}, {"temperature", rule.Temperature, false}} {
+		if param.rewrite == nil {
+			continue
+		}
+		old, set := doc[param.name].(json.Number)
+		value, err := old.Float64()
+		if set && err != nil {
+			continue
+		}
+		value, set = param.rewrite.apply(value, set)
+		if !set {
+			continue
+		}
+		rewritten := json.Number(strconv.FormatFloat(value, 'f', -1, 64))
+		if param.integer {
+			rewritten = json.Number(strconv.FormatInt(int64(value), 10))
+		}
+		if rewritten != old {
+			doc[param.name] = rewritten
+			if old == "" {
+				old = "unset"
+			}
+			changes = append(changes, fmt.Sprintf("%s %s→%s", param.name, old, rewritten))
+		}
+	}
+	if messages, ok := doc["messages"].([]any); ok && rule.System != "" {
+		system := map[string]any{"role": "system", "content": rule.System}
+		doc["messages"] = append([]any{system}, messages...)
+		changes = append(changes, "system prompt")
+	}
+	return changes
+}
+
+// rewriteRules returns the rewrite rules of a route for a tenant's keys
+func (s *ProxyServer) rewriteRules(path, tenant string) []RewriteRule {
+	var rules []RewriteRule
+	for _, rule := range s.rewrites {
+		if matchAny([]string{rule.Path}, path) && (rule.Tenant == "" || rule.Tenant == tenant) {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// withRewrites applies the rewrite rules of the route to request bodies
+func (s *ProxyServer) withRewrites(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var tenant string
+		if key := clientKeyFromContext(r.Context()); key != nil {
+			tenant = key.Tenant
+		}
+		rules := s.rewriteRules(r.URL.Path, tenant)
+		if len(rules) == 0 {
+			next(w, r)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.UseNumber()
+		var doc map[string]any
+		if dec.Decode(&doc) != nil || doc == nil {
+			// The handler reports the body as invalid
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			next(w, r)
+			return
+		}
+
+		timeline := timelineFromContext(r.Context())
+		rewritten := false
+		for _, rule := range rules {
+			if changes := rule.rewrite(doc); len(changes) > 0 {
+				rewritten = true
+				s.metrics.rewrites.Add(1, rule.Name)
+				timeline.Addf(TimelineRewritten, "%s: %s", rule.Name, strings.Join(changes, ", "))
+			}
+		}
+		if rewritten {
+			var out bytes.Buffer
+			enc := json.NewEncoder(&out)
+			enc.SetEscapeHTML(false)
+			if err := enc.Encode(doc); err == nil {
+				body = out.Bytes()
+			}
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+		next(w, r)
+	}
+}
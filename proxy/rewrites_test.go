@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeRewritesFile(t *testing.T, rules string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "rewrites.json")
+	if err := os.WriteFile(path, []byte(rules), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadRewrites(t *testing.T) {
+	rules, err := loadRewrites(writeRewritesFile(t, `[{"name": "aliases", "aliases": {"fast": "gpt-4o-mini"}}]`))
+	if err != nil || len(rules) != 1 || rules[0].Path != "/v1/chat/completions" {
+		t.Errorf("Expected the rule for chat completions, got %+v and %v", rules, err)
+	}
+	for _, invalid := range []string{
+		`[{"aliases": {"fast": "gpt-4o-mini"}}]`,
+		`[{"name": "budget", "max_tokens": {"min": 100, "max": 10}}]`,
+		`{"name": "aliases"}`,
+	} {
+		if _, err := loadRewrites(writeRewritesFile(t, invalid)); err == nil {
+			t.Errorf("Expected an error for %s", invalid)
+		}
+	}
+}
+
+func TestRewriteRule_Rewrite(t *testing.T) {
+	low, high, def := 0.0, 1.0, 512.0
+	maxTokens := 4096.0
+	rule := RewriteRule{
+		Name:        "policy",
+		Aliases:     map[string]string{"fast": "gpt-4o-mini"},
+		Models:      []string{"gpt-4o*"},
+		MaxTokens:   &ParameterRewrite{Default: &def, Max: &maxTokens},
+		Temperature: &ParameterRewrite{Min: &low, Max: &high},
+		System:      "Be brief.",
+	}
+	tests := []struct {
+		name, body, want string
+	}{
+		{"aliased and defaulted", `{"model": "fast", "messages": [{"role": "user", "content": "Hi"}]}`,
+			`{"max_tokens":512,"messages":[{"content":"Be brief.","role":"system"},{"content":"Hi","role":"user"}],"model":"gpt-4o-mini"}`},
+		{"clamped", `{"model": "gpt-4o", "max_tokens": 10000, "temperature": 1.5, "messages": []}`,
+			`{"max_tokens":4096,"messages":[{"content":"Be brief.","role":"system"}],"model":"gpt-4o","temperature":1}`},
+		{"max_completion_tokens", `{"model": "gpt-4o", "max_completion_tokens": 100, "temperature": 0.2}`,
+			`{"max_completion_tokens":100,"model":"gpt-4o","temperature":0.2}`},
+		{"other models", `{"model": "o1", "max_tokens": 10000, "messages": []}`,
+			`{"max_tokens":10000,"messages":[],"model":"o1"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dec := json.NewDecoder(strings.NewReader(tt.body))
+			dec.UseNumber()
+			var doc map[string]any
+			if err := dec.Decode(&doc); err != nil {
+				t.Fatal(err)
+			}
+			rule.rewrite(doc)
+			if got, _ := json.Marshal(doc); string(got) != tt.want {
+				t.Errorf("Expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestProxyServer_Rewrites(t *testing.T) {
+	client := &recordingOpenAIClient{MockOpenAIClient: MockOpenAIClient{response: createTestChatCompletionResponse()}}
+	server := NewProxyServer(client)
+	server.keys = createTestKeyStore(t)
+	server.submissions = nil
+	var err error
+	server.rewrites, err = loadRewrites(writeRewritesFile(t, `[
+		{"name": "aliases", "aliases": {"fast": "gpt-4o-mini"}},
+		{"name": "budget", "models": ["gpt-4o*"], "max_tokens": {"max": 256}},
+		{"name": "acme", "tenant": "acme", "system": "Acme policy."},
+		{"name": "embeddings", "path": "/v1/embeddings", "aliases": {"fast": "text-embedding-3-small"}}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "fast", "max_tokens": 1000, "messages": [{"role": "user", "content": "Hi"}]}`))
+	req.Header.Set("Authorization", "Bearer sk-full")
+	w := httptest.NewRecorder()
+	server.Handler().ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	sent := client.last
+	if sent.Model != "gpt-4o-mini" || sent.MaxTokens == nil || *sent.MaxTokens != 256 {
+		t.Errorf("Expected the alias and the bounded max_tokens, got %s %v", sent.Model, sent.MaxTokens)
+	}
+	if len(sent.Messages) != 1 {
+		t.Errorf("Expected the rule of another tenant not to apply, got %+v", sent.Messages)
+	}
+}
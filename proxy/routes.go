@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// RoutingRule rewrites the model of matching requests before they are
+// forwarded upstream. Model may end in "*" to match a prefix; rules with a
+// Tenant only apply to that tenant's keys. Higher priorities are tried first.
+type RoutingRule struct {
+	ID          string `json:"id"`
+	Priority    int    `json:"priority,omitempty"`
+	Model       string `json:"model"`
+	Tenant      string `json:"tenant,omitempty"`
+	TargetModel string `json:"target_model"`
+	// Flag names a string flag of the external flag service picking the
+	// target model, for experiments. TargetModel is used when the service
+	// has no answer or is unavailable.
+	Flag string `json:"flag,omitempty"`
+}
+
+func (rule RoutingRule) Matches(model, tenant string) bool {
+	if rule.Tenant != "" && rule.Tenant != tenant {
+		return false
+	}
+	return matchAny([]string{rule.Model}, model)
+}
+
+// resolveModel returns the model a request should be sent to after applying
+// the first matching routing rule
+func (s *ProxyServer) resolveModel(model, tenant string) string {
+	rules := s.routes.List()
+	sort.SliceStable(rules, func(i, j int) bool { return rules[i].Priority > rules[j].Priority })
+	for _, rule := range rules {
+		if rule.Matches(model, tenant) {
+			if rule.Flag != "" && s.flagProvider != nil {
+				if target, ok := flagString(s.flagProvider, rule.Flag, flagTarget{Tenant: tenant, Model: model}); ok {
+					return target
+				}
+			}
+			return rule.TargetModel
+		}
+	}
+	return model
+}
+
+// loadRoutes reads a JSON list of routing rules into the registry, for
+// deployments that cannot keep what the admin API sets, such as edge ones
+func (s *ProxyServer) loadRoutes(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read routes file: %w", err)
+	}
+	var rules []RoutingRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return fmt.Errorf("failed to parse routes file: %w", err)
+	}
+	for _, rule := range rules {
+		if rule.ID == "" || rule.Model == "" || rule.TargetModel == "" {
+			return fmt.Errorf("routing rule %q requires id, model and target_model", rule.ID)
+		}
+		s.routes.Put(rule.ID, rule)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Mock client that remembers the last request it was sent
+type recordingOpenAIClient struct {
+	MockOpenAIClient
+	last ChatCompletionRequest
+}
+
+func (m *recordingOpenAIClient) CreateChatCompletion(req ChatCompletionRequest) (*ChatCompletionResponse, error) {
+	m.last = req
+	return m.MockOpenAIClient.CreateChatCompletion(req)
+}
+
+func TestProxyServer_ResolveModel(t *testing.T) {
+	server := NewProxyServer(&MockOpenAIClient{})
+	server.routes.Put("legacy", RoutingRule{ID: "legacy", Model: "gpt-3.5*", TargetModel: "gpt-4o-mini"})
+	server.routes.Put("acme", RoutingRule{ID: "acme", Model: "gpt-3.5*", Tenant: "acme", TargetModel: "gpt-4o", Priority: 10})
+
+	tests := []struct {
+		model  string
+		tenant string
+		want   string
+	}{
+		{"gpt-3.5-turbo", "", "gpt-4o-mini"},
+		{"gpt-3.5-turbo", "acme", "gpt-4o"},
+		{"gpt-3.5-turbo", "other", "gpt-4o-mini"},
+		{"gpt-4o", "", "gpt-4o"},
+	}
+	for _, tt := range tests {
+		if got := server.resolveModel(tt.model, tt.tenant); got != tt.want {
+			t.Errorf("resolveModel(%s, %s): expected %s, got %s", tt.model, tt.tenant, tt.want, got)
+		}
+	}
+}
+
+func TestProxyServer_HandleChatCompletions_RoutingRule(t *testing.T) {
+	mockClient := &recordingOpenAIClient{MockOpenAIClient: MockOpenAIClient{response: createTestChatCompletionResponse()}}
+	server := NewProxyServer(mockClient)
+	server.routes.Put("legacy", RoutingRule{ID: "legacy", Model: "gpt-3.5-turbo", TargetModel: "gpt-4o-mini"})
+
+	jsonData, _ := json.Marshal(createTestChatCompletionRequest())
+	req := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewBuffer(jsonData))
+	w := httptest.NewRecorder()
+	server.handleChatCompletions(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	if mockClient.last.Model != "gpt-4o-mini" {
+		t.Errorf("Expected request to be routed to gpt-4o-mini, got %s", mockClient.last.Model)
+	}
+}
+
+func TestProxyServer_LoadRoutes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "routes.json")
+	os.WriteFile(path, []byte(`[{"id": "legacy", "model": "gpt-3.5*", "target_model": "gpt-4o-mini"}]`), 0o644)
+	server := NewProxyServer(&MockOpenAIClient{})
+	if err := server.loadRoutes(path); err != nil {
+		t.Fatal(err)
+	}
+	if got := server.resolveModel("gpt-3.5-turbo", ""); got != "gpt-4o-mini" {
+		t.Errorf("Expected the loaded rule to route, got %s", got)
+	}
+	os.WriteFile(path, []byte(`[{"id": "broken", "model": "gpt-4o"}]`), 0o644)
+	if err := server.loadRoutes(path); err == nil {
+		t.Error("Expected a rule without a target to be rejected")
+	}
+}
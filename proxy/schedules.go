@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Schedule is a prompt sent on a cron schedule, with the completion
+// delivered to a webhook, e.g. a daily summary posted to Slack
+type Schedule struct {
+	ID string `json:"id"`
+	// Cron is a five-field cron expression or a macro such as @daily,
+	// evaluated in Timezone (UTC by default)
+	Cron     string `json:"cron"`
+	Timezone string `json:"timezone,omitempty"`
+	Model    string `json:"model"`
+	// System and Prompt are Go templates executed with the run's .Time and
+	// .ScheduleID, e.g. {{.Time.Format "Monday, January 2"}}
+	System string `json:"system,omitempty"`
+	Prompt string `json:"prompt"`
+	// Tenant is charged for the tokens and selects tenant routing rules
+	Tenant  string `json:"tenant,omitempty"`
+	Webhook string `json:"webhook"`
+	// Format of the webhook body: "json" (default), "slack" for Slack and
+	// compatible incoming webhooks, or "text"
+	Format string `json:"format,omitempty"`
+	Paused bool   `json:"paused,omitempty"`
+}
+
+// parse checks the schedule and returns its cron expression and templates
+func (sc Schedule) parse() (*cronExpr, *template.Template, error) {
+	if sc.Model == "" || sc.Prompt == "" || sc.Webhook == "" {
+		return nil, nil, fmt.Errorf("schedule requires model, prompt and webhook")
+	}
+	if !strings.HasPrefix(sc.Webhook, "http://") && !strings.HasPrefix(sc.Webhook, "https://") {
+		return nil, nil, fmt.Errorf("webhook must be an http(s) URL")
+	}
+	switch sc.Format {
+	case "", "json", "slack", "text":
+	default:
+		return nil, nil, fmt.Errorf("format must be json, slack or text")
+	}
+	loc := time.UTC
+	if sc.Timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(sc.Timezone); err != nil {
+			return nil, nil, fmt.Errorf("unknown timezone %q", sc.Timezone)
+		}
+	}
+	cron, err := parseCron(sc.Cron, loc)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid cron: %w", err)
+	}
+	tmpl, err := template.New("prompt").Option("missingkey=error").Parse(sc.Prompt)
+	if err == nil {
+		_, err = tmpl.New("system").Parse(sc.System)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid template: %w", err)
+	}
+	return cron, tmpl, nil
+}
+
+// ScheduleRun is the outcome of one run of a schedule
+type ScheduleRun struct {
+	ScheduleID string    `json:"schedule_id"`
+	Time       time.Time `json:"time"`
+	Model      string    `json:"model"`
+	Content    string    `json:"content"`
+	Usage      Usage     `json:"usage"`
+}
+
+// scheduleState is what the scheduler remembers about a schedule's runs
+type scheduleState struct {
+	Runs      int       `json:"runs"`
+	LastRun   time.Time `json:"last_run,omitempty"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// scheduler runs the schedules that came due since its previous tick. It
+// is driven by a singleton job so only the leader replica runs prompts.
+type scheduler struct {
+	client *http.Client
+	now    func() time.Time
+
+	mu     sync.Mutex
+	last   time.Time
+	states map[string]scheduleState
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{
+		client: &http.Client{Timeout: 30 * time.Second},
+		now:    time.Now,
+		states: make(map[string]scheduleState),
+	}
+}
+
+func (sc *scheduler) state(id string) scheduleState {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.states[id]
+}
+
+func (sc *scheduler) finish(id string, at time.Time, err error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	state := sc.states[id]
+	state.Runs++
+	state.LastRun = at.UTC()
+	state.LastError = ""
+	if err != nil {
+		state.LastError = err.Error()
+	}
+	sc.states[id] = state
+}
+
+// runDueSchedules runs every schedule with a cron time in the interval
+// since the previous tick. A schedule that came due several times in the
+// interval, e.g. while the replica was not leader, runs once.
+func (s *ProxyServer) runDueSchedules(ctx context.Context) error {
+	now := s.scheduler.now()
+	s.scheduler.mu.Lock()
+	last := s.scheduler.last
+	s.scheduler.last = now
+	s.scheduler.mu.Unlock()
+	if last.IsZero() {
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var failed []string
+	for _, sched := range s.schedules.List() {
+		cron, _, err := sched.parse()
+		if err != nil || sched.Paused {
+			continue
+		}
+		due := cron.Next(last)
+		if due.IsZero() || due.After(now) {
+			continue
+		}
+		wg.Add(1)
+		go func(sched Schedule) {
+			defer wg.Done()
+			if _, err := s.runSchedule(ctx, sched, due); err != nil {
+				mu.Lock()
+				failed = append(failed, fmt.Sprintf("%s: %v", sched.ID, err))
+				mu.Unlock()
+			}
+		}(sched)
+	}
+	wg.Wait()
+	if len(failed) > 0 {
+		return fmt.Errorf("%d schedules failed: %s", len(failed), strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// runSchedule renders the schedule's prompt for at, sends it upstream and
+// delivers the completion to the webhook
+func (s *ProxyServer) runSchedule(ctx context.Context, sched Schedule, at time.Time) (*ScheduleRun, error) {
+	run, err := s.completeSchedule(sched, at)
+	if err == nil {
+		err = s.scheduler.deliver(ctx, sched, run)
+	}
+	s.scheduler.finish(sched.ID, at, err)
+	return run, err
+}
+
+func (s *ProxyServer) completeSchedule(sched Schedule, at time.Time) (*ScheduleRun, error) {
+	cron, tmpl, err := sched.parse()
+	if err != nil {
+		return nil, err
+	}
+	data := map[string]any{"Time": at.In(cron.loc), "ScheduleID": sched.ID}
+	var prompt, system strings.Builder
+	if err := tmpl.ExecuteTemplate(&prompt, "prompt", data); err != nil {
+		return nil, fmt.Errorf("failed to render prompt: %w", err)
+	}
+	if err := tmpl.ExecuteTemplate(&system, "system", data); err != nil {
+		return nil, fmt.Errorf("failed to render system prompt: %w", err)
+	}
+
+	req := ChatCompletionRequest{Model: sched.Model}
+	if system.Len() > 0 {
+		req.Messages = append(req.Messages, Message{Role: "system", Content: system.String()})
+	}
+	req.Messages = append(req.Messages, Message{Role: "user", Content: prompt.String()})
+	if err := s.filterRequest(&req, "schedule "+sched.ID); err != nil {
+		return nil, err
+	}
+	if err := s.expandModel(&req, sched.Tenant, "schedules"); err != nil {
+		return nil, err
+	}
+
+	event := newUsageEvent(nil, "schedules", req.Model)
+	event.KeyID, event.Tenant = "schedule:"+sched.ID, sched.Tenant
+	resp, err := s.client.CreateChatCompletion(req)
+	event.LatencyMS = time.Since(event.Time).Milliseconds()
+	if err != nil {
+		event.Status = http.StatusInternalServerError
+		s.recordUsage(event)
+		return nil, fmt.Errorf("completion failed: %w", err)
+	}
+	if sched.Tenant != "" {
+		s.limiter.RecordTokens("tenant:"+sched.Tenant, resp.Usage.TotalTokens)
+	}
+	s.recordCompletion(nil, event, resp.Usage)
+
+	run := &ScheduleRun{ScheduleID: sched.ID, Time: at.UTC(), Model: resp.Model, Usage: resp.Usage}
+	if len(resp.Choices) > 0 {
+		run.Content = resp.Choices[0].Message.Content
+	}
+	return run, nil
+}
+
+// deliver POSTs the run to the schedule's webhook in its format
+func (sc *scheduler) deliver(ctx context.Context, sched Schedule, run *ScheduleRun) error {
+	var body []byte
+	contentType := "application/json"
+	switch sched.Format {
+	case "slack":
+		body, _ = json.Marshal(map[string]string{"text": run.Content})
+	case "text":
+		body, contentType = []byte(run.Content), "text/plain; charset=utf-8"
+	default:
+		body, _ = json.Marshal(run)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sched.Webhook, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("webhook failed: %w", err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	resp, err := sc.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("webhook failed: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// scheduleView is a schedule as returned by the admin API, with its next
+// run time and the outcome of its runs on this replica
+type scheduleView struct {
+	Schedule
+	scheduleState
+	NextRun *time.Time `json:"next_run,omitempty"`
+}
+
+func (s *ProxyServer) viewSchedule(sched Schedule) any {
+	view := scheduleView{Schedule: sched, scheduleState: s.scheduler.state(sched.ID)}
+	if cron, _, err := sched.parse(); err == nil && !sched.Paused {
+		if next := cron.Next(s.scheduler.now()); !next.IsZero() {
+			next = next.UTC()
+			view.NextRun = &next
+		}
+	}
+	return view
+}
+
+func (s *ProxyServer) listSchedules() []any {
+	schedules := s.schedules.List()
+	views := make([]any, 0, len(schedules))
+	for _, sched := range schedules {
+		views = append(views, s.viewSchedule(sched))
+	}
+	return views
+}
+
+func (s *ProxyServer) adminScheduleHandler() http.Handler {
+	return resourceHandler[Schedule]{
+		lock: s.schedules.lockWrites,
+		get: func(id string) (Schedule, string, bool) {
+			sched, ok := s.schedules.Get(id)
+			return sched, etagFor(sched), ok
+		},
+		put: func(id string, sched Schedule, _ *Schedule) (bool, error) {
+			if sched.ID != "" && sched.ID != id {
+				return false, fmt.Errorf("id in body does not match id in path")
+			}
+			sched.ID = id
+			if _, _, err := sched.parse(); err != nil {
+				return false, err
+			}
+			return s.schedules.Put(id, sched), nil
+		},
+		remove: s.schedules.Delete,
+		view:   s.viewSchedule,
+	}
+}
+
+// handleAdminRunSchedule runs a schedule immediately, whether or not it is
+// paused, and returns the delivered completion
+func (s *ProxyServer) handleAdminRunSchedule(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sched, ok := s.schedules.Get(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	run, err := s.runSchedule(r.Context(), sched, s.scheduler.now())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Schedule failed: %v", err), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(run)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// webhookRecorder collects the bodies POSTed to it
+type webhookRecorder struct {
+	*httptest.Server
+	bodies []string
+}
+
+func newWebhookRecorder(t *testing.T) *webhookRecorder {
+	rec := &webhookRecorder{}
+	rec.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		rec.bodies = append(rec.bodies, string(body))
+	}))
+	t.Cleanup(rec.Close)
+	return rec
+}
+
+func TestSchedule_Parse(t *testing.T) {
+	valid := Schedule{Cron: "@daily", Model: "gpt-4o", Prompt: "Summarize {{.Time.Format \"2006-01-02\"}}", Webhook: "https://hooks.example.com/x"}
+	if _, _, err := valid.parse(); err != nil {
+		t.Errorf("Expected a valid schedule, got %v", err)
+	}
+
+	invalid := []func(s *Schedule){
+		func(s *Schedule) { s.Cron = "daily" },
+		func(s *Schedule) { s.Prompt = "" },
+		func(s *Schedule) { s.Prompt = "{{.Time" },
+		func(s *Schedule) { s.Webhook = "ftp://example.com" },
+		func(s *Schedule) { s.Format = "xml" },
+		func(s *Schedule) { s.Timezone = "Mars/Olympus" },
+	}
+	for i, mutate := range invalid {
+		s := valid
+		mutate(&s)
+		if _, _, err := s.parse(); err == nil {
+			t.Errorf("Case %d: expected %+v to be invalid", i, s)
+		}
+	}
+}
+
+func TestProxyServer_RunDueSchedules(t *testing.T) {
+	hook := newWebhookRecorder(t)
+	client := &recordingOpenAIClient{MockOpenAIClient: MockOpenAIClient{response: createTestChatCompletionResponse()}}
+	server := NewProxyServer(client)
+	now := time.Date(2024, 5, 15, 8, 59, 50, 0, time.UTC)
+	server.scheduler.now = func() time.Time { return now }
+	server.schedules.Put("daily", Schedule{
+		ID:      "daily",
+		Cron:    "0 9 * * *",
+		Model:   "gpt-3.5-turbo",
+		System:  "You write status reports.",
+		Prompt:  `Summarize {{.Time.Format "January 2"}}`,
+		Webhook: hook.URL,
+		Format:  "slack",
+	})
+	server.schedules.Put("paused", Schedule{ID: "paused", Cron: "* * * * *", Model: "gpt-4o", Prompt: "x", Webhook: hook.URL, Paused: true})
+
+	// The first tick only sets the starting point
+	server.runDueSchedules(context.Background())
+	now = now.Add(5 * time.Second)
+	server.runDueSchedules(context.Background())
+	if len(hook.bodies) != 0 {
+		t.Fatalf("Expected nothing to run before 9:00, got %v", hook.bodies)
+	}
+
+	now = now.Add(15 * time.Second)
+	if err := server.runDueSchedules(context.Background()); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(hook.bodies) != 1 || !strings.Contains(hook.bodies[0], `"text":"Hello!`) {
+		t.Fatalf("Expected one Slack message, got %v", hook.bodies)
+	}
+	if len(client.last.Messages) != 2 || client.last.Messages[1].Content != "Summarize May 15" {
+		t.Errorf("Unexpected messages %+v", client.last.Messages)
+	}
+
+	now = now.Add(15 * time.Second)
+	server.runDueSchedules(context.Background())
+	if len(hook.bodies) != 1 {
+		t.Errorf("Expected the schedule to run once, got %d runs", len(hook.bodies))
+	}
+	if state := server.scheduler.state("daily"); state.Runs != 1 || state.LastError != "" {
+		t.Errorf("Unexpected state %+v", state)
+	}
+}
+
+func TestProxyServer_RunScheduleFailure(t *testing.T) {
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer hook.Close()
+	server := NewProxyServer(&MockOpenAIClient{response: createTestChatCompletionResponse()})
+	sched := Schedule{ID: "s", Cron: "@hourly", Model: "gpt-4o", Prompt: "x", Webhook: hook.URL}
+
+	if _, err := server.runSchedule(context.Background(), sched, time.Now()); err == nil || !strings.Contains(err.Error(), "status 500") {
+		t.Errorf("Expected a webhook error, got %v", err)
+	}
+	if state := server.scheduler.state("s"); state.Runs != 1 || state.LastError == "" {
+		t.Errorf("Expected the failure to be recorded, got %+v", state)
+	}
+}
+
+func TestProxyServer_RunScheduleContentFilters(t *testing.T) {
+	hook := newWebhookRecorder(t)
+	client := &recordingOpenAIClient{MockOpenAIClient: MockOpenAIClient{response: createTestChatCompletionResponse()}}
+	server := NewProxyServer(client)
+	server.contentFilters = []ContentFilter{{Name: "secrets", Pattern: `sk-[a-z0-9]+`, Action: FilterBlock}}
+	server.contentFilters[0].compile()
+	sched := Schedule{ID: "s", Cron: "@hourly", Model: "gpt-4o", Prompt: "Rotate sk-abc123", Webhook: hook.URL}
+
+	if _, err := server.runSchedule(context.Background(), sched, time.Now()); err == nil || !strings.Contains(err.Error(), "secrets") {
+		t.Errorf("Expected the prompt to be blocked, got %v", err)
+	}
+	if client.last.Model != "" || len(hook.bodies) != 0 {
+		t.Error("Expected the blocked prompt not to go upstream")
+	}
+}
+
+func TestAdmin_Schedules(t *testing.T) {
+	hook := newWebhookRecorder(t)
+	server := NewProxyServer(&MockOpenAIClient{response: createTestChatCompletionResponse()})
+	mux := http.NewServeMux()
+	mux.Handle("/admin/schedules/{id}", server.adminScheduleHandler())
+	mux.HandleFunc("/admin/schedules/{id}/run", server.handleAdminRunSchedule)
+
+	body := `{"cron": "0 9 * * mon", "model": "gpt-4o", "prompt": "Weekly digest", "webhook": "` + hook.URL + `"}`
+	w := adminRequest(mux, "PUT", "/admin/schedules/weekly", body, nil)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	var view struct {
+		ID      string    `json:"id"`
+		NextRun time.Time `json:"next_run"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &view)
+	if view.ID != "weekly" || view.NextRun.Weekday() != time.Monday {
+		t.Errorf("Unexpected schedule %s", w.Body.String())
+	}
+
+	w = adminRequest(mux, "PUT", "/admin/schedules/bad", `{"cron": "0 9 * *", "model": "gpt-4o", "prompt": "x", "webhook": "`+hook.URL+`"}`, nil)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	w = adminRequest(mux, "POST", "/admin/schedules/weekly/run", "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var run ScheduleRun
+	json.Unmarshal([]byte(hook.bodies[0]), &run)
+	if run.ScheduleID != "weekly" || run.Usage.TotalTokens != 32 {
+		t.Errorf("Unexpected webhook body %s", hook.bodies[0])
+	}
+}
@@ -0,0 +1,152 @@
+//go:build !wasip1
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// main listens on the port of every profile until the process is told to
+// stop, then drains. Builds for WASI have a main of their own, since they
+// cannot listen.
+func main() {
+	// Offline tooling runs instead of the server
+	if runOfflineCommand(os.Args[1:]) {
+		return
+	}
+
+	// Size the runtime to the container's cgroup limits and shed load when
+	// memory gets close to the limit. Both apply to the whole process.
+	var memory *memoryGuard
+	limits := readCgroupLimits("/sys/fs/cgroup")
+	if memoryLimit := applyRuntimeLimits(limits, ratioFromEnv("PROXY_MEMORY_LIMIT_RATIO", 0.9)); memoryLimit > 0 {
+		memory = newMemoryGuard(int64(float64(memoryLimit) * ratioFromEnv("PROXY_SHED_MEMORY_RATIO", 0.95)))
+		go memory.Run(context.Background(), 100*time.Millisecond)
+	}
+
+	// One process can serve several profiles, each configured like a proxy
+	// of its own; without a profiles file it serves the environment alone
+	profiles := []Profile{{}}
+	if path := os.Getenv("PROXY_PROFILES_FILE"); path != "" {
+		var err error
+		if profiles, err = loadProfiles(path); err != nil {
+			log.Fatal(err)
+		}
+	}
+	shutdown, err := shutdownSettingsFromEnv(os.Getenv)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Background work outlives the listeners, until requests are drained
+	background, stopBackground := context.WithCancel(context.Background())
+	failed := make(chan error, len(profiles))
+	var servers []*ProxyServer
+	var listeners []*http.Server
+	for _, profile := range profiles {
+		server, err := serverFromEnv(background, profile.getenv, memory)
+		if err != nil {
+			if profile.Name != "" {
+				log.Fatalf("Profile %s: %v", profile.Name, err)
+			}
+			log.Fatal(err)
+		}
+		servers = append(servers, server)
+		_, port, _ := net.SplitHostPort(server.address)
+		logEndpoints(profile.Name, port, server.playground)
+		listener := server.HTTPServer(server.address)
+		listeners = append(listeners, listener)
+		go func() {
+			if err := listener.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				failed <- err
+			}
+		}()
+	}
+	go reloadOnHangup(servers)
+
+	stop := make(chan os.Signal, 2)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+	select {
+	case err := <-failed:
+		log.Fatal("Server failed to start:", err)
+	case sig := <-stop:
+		log.Printf("Got %v, draining requests in flight for up to %v", sig, shutdown.timeout)
+	}
+	drainAll(servers, listeners, shutdown, stop)
+	stopBackground()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, server := range servers {
+		server.flush(ctx)
+	}
+	log.Printf("Shut down")
+}
+
+// drainAll drains every server at once, cutting off the requests left when
+// the shutdown timeout runs out or another signal arrives on stop
+func drainAll(servers []*ProxyServer, listeners []*http.Server, shutdown shutdownSettings, stop <-chan os.Signal) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdown.delay+shutdown.timeout)
+	defer cancel()
+	go func() {
+		select {
+		case sig := <-stop:
+			log.Printf("Got %v again, cutting off requests in flight", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	done := make(chan struct{})
+	for i, server := range servers {
+		go func() {
+			if err := server.drain(ctx, listeners[i], shutdown.delay); err != nil {
+				log.Printf("Cut off requests still in flight on %s: %v", server.address, err)
+			}
+			done <- struct{}{}
+		}()
+	}
+	for range servers {
+		<-done
+	}
+}
+
+// reloadOnHangup reloads the config files of servers whenever the process
+// gets SIGHUP
+func reloadOnHangup(servers []*ProxyServer) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	for range hangup {
+		for _, server := range servers {
+			server.ReloadConfig()
+		}
+	}
+}
+
+// logEndpoints logs where a server listens, naming its profile if it has one
+func logEndpoints(profile, port string, playground bool) {
+	if profile != "" {
+		log.Printf("Starting OpenAI proxy server for profile %s on port %s", profile, port)
+	} else {
+		log.Printf("Starting OpenAI proxy server on port %s", port)
+	}
+	log.Printf("Chat completions endpoint: http://localhost:%s/v1/chat/completions", port)
+	log.Printf("Embeddings endpoint: http://localhost:%s/v1/embeddings", port)
+	log.Printf("Rerank endpoint: http://localhost:%s/v1/rerank", port)
+	log.Printf("Summarize endpoint: http://localhost:%s/v1/summarize", port)
+	log.Printf("Translate endpoint: http://localhost:%s/v1/translate", port)
+	log.Printf("Dedupe endpoint: http://localhost:%s/v1/dedupe", port)
+	log.Printf("Prompt diff endpoint: http://localhost:%s/v1/prompts/diff", port)
+	log.Printf("Tokenize endpoints: http://localhost:%s/v1/tokenize and /v1/detokenize", port)
+	log.Printf("Pipelines endpoint: http://localhost:%s/v1/pipelines/{name}/run", port)
+	log.Printf("Agent runs endpoints: http://localhost:%s/v1/agents/runs/{id} and /v1/agents/runs/{id}/replay", port)
+	log.Printf("Health check endpoint: http://localhost:%s/health", port)
+	if playground {
+		log.Printf("Playground: http://localhost:%s/playground/", port)
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http/cgi"
+	"os"
+)
+
+// WASI has no sockets to listen on. Edge runtimes that run WASI modules
+// per request, such as Spin and wasmtime's WAGI hosts, pass the request the
+// way CGI does: in the environment and on stdin, with the reply written to
+// stdout. Each invocation configures a server from the environment and
+// serves one request with it, so state such as rate-limit counters and
+// what the admin API changes lasts one request; client keys, routing rules
+// and feature flags come from the files the configuration names.
+func main() {
+	if runOfflineCommand(os.Args[1:]) {
+		return
+	}
+	server, err := serverFromEnv(context.Background(), os.Getenv, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := cgi.Serve(server.Handler()); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Session is the conversation history the proxy keeps on behalf of a
+// client that cannot send it along itself, such as a chat bot
+type Session struct {
+	ID       string    `json:"id"`
+	Messages []Message `json:"messages"`
+	Updated  time.Time `json:"updated"`
+	// Parent is the session this one was forked from, and ForkedAt how many
+	// of the parent's messages it started with
+	Parent   string `json:"parent,omitempty"`
+	ForkedAt int    `json:"forked_at,omitempty"`
+	// Drafts are the replies regenerated away, oldest first, by the index
+	// of the message that replaced them
+	Drafts map[int][]Message `json:"drafts,omitempty"`
+}
+
+// sessionDrafts is how many replies regenerated away a session keeps for
+// each of its messages
+const sessionDrafts = 5
+
+var errSessionNotFound = errors.New("session not found")
+
+// sessionStore holds sessions in memory. Each keeps its most recent
+// messages only, and sessions idle for longer than the TTL are dropped.
+type sessionStore struct {
+	maxMessages int
+	ttl         time.Duration
+	now         func() time.Time
+
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+func newSessionStore(maxMessages int, ttl time.Duration) *sessionStore {
+	return &sessionStore{maxMessages: maxMessages, ttl: ttl, now: time.Now, sessions: make(map[string]*Session)}
+}
+
+// History returns a copy of the session's messages, oldest first
+func (s *sessionStore) History(id string) []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[id]
+	if !ok {
+		return nil
+	}
+	return append([]Message(nil), session.Messages...)
+}
+
+// Append adds messages to the session, creating it if needed, and trims the
+// oldest ones beyond the limit. Trimming never leaves a reply at the start
+// without the message it answered.
+func (s *sessionStore) Append(id string, messages ...Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[id]
+	if !ok {
+		session = &Session{ID: id}
+		s.sessions[id] = session
+	}
+	session.Messages = append(session.Messages, messages...)
+	if excess := len(session.Messages) - s.maxMessages; excess > 0 {
+		for excess < len(session.Messages) && session.Messages[excess].Role != "user" {
+			excess++
+		}
+		session.Messages = append([]Message(nil), session.Messages[excess:]...)
+		session.Drafts = shiftDrafts(session.Drafts, excess, len(session.Messages))
+	}
+	session.Updated = s.now().UTC()
+}
+
+// shiftDrafts renumbers drafts after the first n messages were dropped,
+// keeping those of the messages below limit
+func shiftDrafts(drafts map[int][]Message, n, limit int) map[int][]Message {
+	var shifted map[int][]Message
+	for index, replies := range drafts {
+		if index-n >= 0 && index-n < limit {
+			if shifted == nil {
+				shifted = make(map[int][]Message)
+			}
+			shifted[index-n] = replies
+		}
+	}
+	return shifted
+}
+
+// Regenerate replaces the session's last reply with reply, keeping the one
+// replaced as a draft. A session that does not end with a reply gets reply
+// added.
+func (s *sessionStore) Regenerate(id string, reply Message) {
+	s.mu.Lock()
+	last := -1
+	if session, ok := s.sessions[id]; ok && len(session.Messages) > 0 && session.Messages[len(session.Messages)-1].Role == "assistant" {
+		last = len(session.Messages) - 1
+		if session.Drafts == nil {
+			session.Drafts = make(map[int][]Message)
+		}
+		drafts := append(session.Drafts[last], session.Messages[last])
+		session.Drafts[last] = drafts[max(0, len(drafts)-sessionDrafts):]
+		session.Messages[last] = reply
+		session.Updated = s.now().UTC()
+	}
+	s.mu.Unlock()
+	if last < 0 {
+		s.Append(id, reply)
+	}
+}
+
+// SelectDraft makes draft n of the session's last reply the reply again,
+// keeping the reply it replaces as a draft in its place
+func (s *sessionStore) SelectDraft(id string, n int) (Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[id]
+	if !ok {
+		return Session{}, errSessionNotFound
+	}
+	last := len(session.Messages) - 1
+	drafts := session.Drafts[last]
+	if n < 0 || n >= len(drafts) {
+		return Session{}, fmt.Errorf("the last message of the session has %d drafts", len(drafts))
+	}
+	session.Messages[last], drafts[n] = drafts[n], session.Messages[last]
+	session.Updated = s.now().UTC()
+	return session.copy(), nil
+}
+
+// Reset forgets the session
+func (s *sessionStore) Reset(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, id)
+}
+
+// RemoveExpired drops sessions idle for longer than the TTL and returns how
+// many there were
+func (s *sessionStore) RemoveExpired() int {
+	cutoff := s.now().Add(-s.ttl)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	removed := 0
+	for id, session := range s.sessions {
+		if session.Updated.Before(cutoff) {
+			delete(s.sessions, id)
+			removed++
+		}
+	}
+	return removed
+}
+
+// Get returns a copy of the session
+func (s *sessionStore) Get(id string) (Session, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[id]
+	if !ok {
+		return Session{}, false
+	}
+	return session.copy(), true
+}
+
+// copy returns a copy of the session that shares nothing with it
+func (s *Session) copy() Session {
+	copied := *s
+	copied.Messages = append([]Message(nil), s.Messages...)
+	copied.Drafts = nil
+	for index, replies := range s.Drafts {
+		if copied.Drafts == nil {
+			copied.Drafts = make(map[int][]Message)
+		}
+		copied.Drafts[index] = append([]Message(nil), replies...)
+	}
+	return copied
+}
+
+// Fork starts session id as a branch of parent, with the parent's messages
+// before index at. The parent stays as it is.
+func (s *sessionStore) Fork(parent, id string, at int) (Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.sessions[parent]
+	if !ok {
+		return Session{}, errSessionNotFound
+	}
+	if at < 0 || at > len(p.Messages) {
+		return Session{}, fmt.Errorf("message index must be between 0 and %d", len(p.Messages))
+	}
+	if _, exists := s.sessions[id]; exists {
+		return Session{}, fmt.Errorf("session %s already exists", id)
+	}
+	now := s.now().UTC()
+	fork := p.copy()
+	session := &Session{ID: id, Messages: fork.Messages[:at], Updated: now, Parent: parent, ForkedAt: at, Drafts: shiftDrafts(fork.Drafts, 0, at)}
+	s.sessions[id] = session
+	p.Updated = now
+	return session.copy(), nil
+}
+
+// Branches returns copies of the sessions forked from id ordered by ID
+func (s *sessionStore) Branches(id string) []Session {
+	var branches []Session
+	for _, session := range s.List() {
+		if session.Parent == id {
+			branches = append(branches, session)
+		}
+	}
+	return branches
+}
+
+// List returns copies of all sessions ordered by ID
+func (s *sessionStore) List() []Session {
+	s.mu.Lock()
+	ids := make([]string, 0, len(s.sessions))
+	for id := range s.sessions {
+		ids = append(ids, id)
+	}
+	s.mu.Unlock()
+	sort.Strings(ids)
+
+	sessions := make([]Session, 0, len(ids))
+	for _, id := range ids {
+		if session, ok := s.Get(id); ok {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions
+}
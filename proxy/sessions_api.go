@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Clients can keep their conversations in the proxy as well. A chat
+// completion with "session": "<name>" is sent with the history of the
+// session before its messages, and its messages and the reply are added to
+// the session, so each request only carries what is new. For "edit and
+// regenerate", a session can be forked at any of its messages: the branch
+// starts with the messages before it, and the next request to the branch
+// carries the edited message, or no message to regenerate the reply.
+// A request without messages to a session ending with a reply regenerates
+// that reply in place: the session keeps the last few replies it replaced
+// as drafts, so a UI can offer the previous one back. Sessions belong to
+// the client key that started them.
+
+// clientSessionID is the ID in the session store of a client's session
+func clientSessionID(key *ClientKey, name string) string {
+	owner := ""
+	if key != nil {
+		owner = key.ID
+	}
+	return "api:" + owner + ":" + name
+}
+
+// clientSession is a session as its client sees it, by its own name
+func clientSession(key *ClientKey, session Session) Session {
+	prefix := clientSessionID(key, "")
+	session.ID = strings.TrimPrefix(session.ID, prefix)
+	session.Parent = strings.TrimPrefix(session.Parent, prefix)
+	return session
+}
+
+// ForkRequest is the body of POST /v1/sessions/{id}/fork
+type ForkRequest struct {
+	// MessageIndex is the message the branch replaces: the branch starts
+	// with the messages before it
+	MessageIndex int `json:"message_index"`
+	// ID names the branch. It is generated when left out.
+	ID string `json:"id,omitempty"`
+}
+
+// handleGetSession serves GET /v1/sessions/{id}
+func (s *ProxyServer) handleGetSession(w http.ResponseWriter, r *http.Request) {
+	key := clientKeyFromContext(r.Context())
+	session, ok := s.sessions.Get(clientSessionID(key, r.PathValue("id")))
+	if !ok {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(clientSession(key, session))
+}
+
+// handleForkSession serves POST /v1/sessions/{id}/fork
+func (s *ProxyServer) handleForkSession(w http.ResponseWriter, r *http.Request) {
+	var req ForkRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON in request body", http.StatusBadRequest)
+		return
+	}
+	if req.ID == "" {
+		suffix, err := randomHex(4)
+		if err != nil {
+			http.Error(w, "Failed to generate session id", http.StatusInternalServerError)
+			return
+		}
+		req.ID = r.PathValue("id") + "-" + suffix
+	}
+	key := clientKeyFromContext(r.Context())
+	session, err := s.sessions.Fork(clientSessionID(key, r.PathValue("id")), clientSessionID(key, req.ID), req.MessageIndex)
+	if errors.Is(err, errSessionNotFound) {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(clientSession(key, session))
+}
+
+// SelectDraftRequest is the body of POST /v1/sessions/{id}/drafts/select
+type SelectDraftRequest struct {
+	// Draft is the index of a draft of the session's last reply, oldest
+	// first
+	Draft int `json:"draft"`
+}
+
+// handleSelectDraft serves POST /v1/sessions/{id}/drafts/select, bringing
+// back a draft of the session's last reply
+func (s *ProxyServer) handleSelectDraft(w http.ResponseWriter, r *http.Request) {
+	var req SelectDraftRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON in request body", http.StatusBadRequest)
+		return
+	}
+	key := clientKeyFromContext(r.Context())
+	session, err := s.sessions.SelectDraft(clientSessionID(key, r.PathValue("id")), req.Draft)
+	if errors.Is(err, errSessionNotFound) {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(clientSession(key, session))
+}
+
+// handleSessionBranches serves GET /v1/sessions/{id}/branches
+func (s *ProxyServer) handleSessionBranches(w http.ResponseWriter, r *http.Request) {
+	key := clientKeyFromContext(r.Context())
+	id := clientSessionID(key, r.PathValue("id"))
+	if _, ok := s.sessions.Get(id); !ok {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	branches := []Session{}
+	for _, branch := range s.sessions.Branches(id) {
+		branches = append(branches, clientSession(key, branch))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"object": "list", "data": branches})
+}
+
+// sessionMessages prepends the history of the request's session to its
+// messages, returning the session's ID and the messages the client sent
+func (s *ProxyServer) sessionMessages(req *ChatCompletionRequest, key *ClientKey) (string, []Message, error) {
+	if req.Session == "" {
+		return "", nil, nil
+	}
+	id := clientSessionID(key, req.Session)
+	history := s.sessions.History(id)
+	if len(history) == 0 && len(req.Messages) == 0 {
+		return "", nil, fmt.Errorf("session %s has no messages to go on from", req.Session)
+	}
+	sent := req.Messages
+	if len(sent) == 0 && history[len(history)-1].Role == "assistant" {
+		history = history[:len(history)-1]
+		if len(history) == 0 {
+			return "", nil, fmt.Errorf("session %s has no messages to go on from", req.Session)
+		}
+	}
+	req.Messages = append(history, req.Messages...)
+	return id, sent, nil
+}
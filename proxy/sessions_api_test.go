@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestProxyServer_SessionBranching(t *testing.T) {
+	client := &scriptedOpenAIClient{replies: []string{"Paris", "Lyon", "Marseille"}}
+	server := NewProxyServer(client)
+	server.keys = createTestKeyStore(t)
+	server.completions.size = 100
+	server.submissions = nil
+	handler := server.Handler()
+
+	send := func(method, path, secret, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+secret)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := send("POST", "/v1/chat/completions", "sk-full", `{"model": "gpt-4o", "session": "trip", "messages": [{"role": "user", "content": "Capital of France?"}]}`); w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	// Regenerate the reply on a branch that ends before it
+	w := send("POST", "/v1/sessions/trip/fork", "sk-full", `{"message_index": 1, "id": "retry"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	w = send("POST", "/v1/chat/completions", "sk-full", `{"model": "gpt-4o", "temperature": 0, "session": "retry", "messages": []}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if sent := client.requests[1].Messages; len(sent) != 1 || sent[0].Content != "Capital of France?" {
+		t.Errorf("Expected the branch's history to be sent, got %+v", sent)
+	}
+
+	var session Session
+	json.Unmarshal(send("GET", "/v1/sessions/retry", "sk-full", "").Body.Bytes(), &session)
+	if session.ID != "retry" || session.Parent != "trip" || len(session.Messages) != 2 || session.Messages[1].Content != "Lyon" {
+		t.Errorf("Expected the regenerated reply on the branch, got %+v", session)
+	}
+	json.Unmarshal(send("GET", "/v1/sessions/trip", "sk-full", "").Body.Bytes(), &session)
+	if len(session.Messages) != 2 || session.Messages[1].Content != "Paris" {
+		t.Errorf("Expected the original session to keep its reply, got %+v", session)
+	}
+
+	var branches struct {
+		Data []Session `json:"data"`
+	}
+	json.Unmarshal(send("GET", "/v1/sessions/trip/branches", "sk-full", "").Body.Bytes(), &branches)
+	if len(branches.Data) != 1 || branches.Data[0].ID != "retry" {
+		t.Errorf("Expected the branch to be listed, got %+v", branches.Data)
+	}
+
+	// Sessions belong to the key that started them
+	if w := send("GET", "/v1/sessions/trip", "sk-mini", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected other keys not to see the session, got %d", w.Code)
+	}
+	if w := send("POST", "/v1/sessions/trip/fork", "sk-full", `{"message_index": 5}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an out of range fork to fail, got %d", w.Code)
+	}
+	if w := send("POST", "/v1/chat/completions", "sk-full", `{"model": "gpt-4o", "session": "empty", "messages": []}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an empty session without messages to fail, got %d", w.Code)
+	}
+	if conflict := server.streamConflict(&ChatCompletionRequest{Session: "trip"}); conflict != "session" {
+		t.Errorf("Expected sessions not to be streamed, got %q", conflict)
+	}
+}
+
+func TestProxyServer_SessionDrafts(t *testing.T) {
+	client := &scriptedOpenAIClient{replies: []string{"Paris", "Lyon", "Marseille"}}
+	server := NewProxyServer(client)
+	server.keys = createTestKeyStore(t)
+	server.submissions = nil
+	handler := server.Handler()
+
+	send := func(method, path, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer sk-full")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	send("POST", "/v1/chat/completions", `{"model": "gpt-4o", "session": "trip", "messages": [{"role": "user", "content": "Capital of France?"}]}`)
+	for i := 0; i < 2; i++ {
+		if w := send("POST", "/v1/chat/completions", `{"model": "gpt-4o", "session": "trip", "messages": []}`); w.Code != http.StatusOK {
+			t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+	}
+	if sent := client.requests[2].Messages; len(sent) != 1 || sent[0].Content != "Capital of France?" {
+		t.Errorf("Expected the reply to be regenerated without the previous one, got %+v", sent)
+	}
+
+	var session Session
+	json.Unmarshal(send("GET", "/v1/sessions/trip", "").Body.Bytes(), &session)
+	if len(session.Messages) != 2 || session.Messages[1].Content != "Marseille" {
+		t.Fatalf("Expected the last regenerated reply, got %+v", session.Messages)
+	}
+	if drafts := session.Drafts[1]; len(drafts) != 2 || drafts[0].Content != "Paris" || drafts[1].Content != "Lyon" {
+		t.Errorf("Expected the replaced replies as drafts, got %+v", session.Drafts)
+	}
+
+	w := send("POST", "/v1/sessions/trip/drafts/select", `{"draft": 0}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	json.Unmarshal(w.Body.Bytes(), &session)
+	if session.Messages[1].Content != "Paris" || session.Drafts[1][0].Content != "Marseille" {
+		t.Errorf("Expected the first draft back in place of the reply, got %+v", session)
+	}
+	if w := send("POST", "/v1/sessions/trip/drafts/select", `{"draft": 2}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a missing draft to fail, got %d", w.Code)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestSessionStore_TrimsHistory(t *testing.T) {
+	store := newSessionStore(3, time.Hour)
+	store.Append("c", Message{Role: "user", Content: "1"}, Message{Role: "assistant", Content: "a1"})
+	store.Append("c", Message{Role: "user", Content: "2"}, Message{Role: "assistant", Content: "a2"})
+
+	// Keeping the last three would start with a reply, so only two remain
+	history := store.History("c")
+	if len(history) != 2 || history[0].Content != "2" || history[1].Content != "a2" {
+		t.Errorf("Unexpected history %+v", history)
+	}
+
+	history[0].Content = "changed"
+	if store.History("c")[0].Content != "2" {
+		t.Error("Expected History to return a copy")
+	}
+
+	store.Reset("c")
+	if history := store.History("c"); len(history) != 0 {
+		t.Errorf("Expected an empty history after reset, got %+v", history)
+	}
+}
+
+func TestSessionStore_RemoveExpired(t *testing.T) {
+	now := time.Now()
+	store := newSessionStore(10, time.Hour)
+	store.now = func() time.Time { return now }
+	store.Append("old", Message{Role: "user", Content: "hi"})
+	now = now.Add(50 * time.Minute)
+	store.Append("new", Message{Role: "user", Content: "hi"})
+	now = now.Add(20 * time.Minute)
+
+	if removed := store.RemoveExpired(); removed != 1 {
+		t.Errorf("Expected 1 expired session, got %d", removed)
+	}
+	if store.History("old") != nil || store.History("new") == nil {
+		t.Error("Expected only the idle session to be removed")
+	}
+}
+
+func TestSessionStore_Fork(t *testing.T) {
+	store := newSessionStore(10, time.Hour)
+	store.Append("c", Message{Role: "user", Content: "1"}, Message{Role: "assistant", Content: "a1"}, Message{Role: "user", Content: "2"})
+
+	branch, err := store.Fork("c", "c-edit", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(branch.Messages) != 2 || branch.Parent != "c" || branch.ForkedAt != 2 {
+		t.Errorf("Expected a branch with the first two messages, got %+v", branch)
+	}
+	store.Append("c-edit", Message{Role: "user", Content: "2b"})
+	if history := store.History("c"); len(history) != 3 || history[2].Content != "2" {
+		t.Errorf("Expected the parent to stay as it was, got %+v", history)
+	}
+	if branches := store.Branches("c"); len(branches) != 1 || branches[0].ID != "c-edit" {
+		t.Errorf("Expected one branch, got %+v", branches)
+	}
+
+	if _, err := store.Fork("c", "c-edit", 0); err == nil {
+		t.Error("Expected forking onto an existing session to fail")
+	}
+	if _, err := store.Fork("c", "c-far", 4); err == nil {
+		t.Error("Expected forking beyond the last message to fail")
+	}
+	if _, err := store.Fork("missing", "x", 0); err != errSessionNotFound {
+		t.Errorf("Expected errSessionNotFound, got %v", err)
+	}
+}
+
+func TestSessionStore_Regenerate(t *testing.T) {
+	store := newSessionStore(4, time.Hour)
+	store.Append("c", Message{Role: "user", Content: "1"}, Message{Role: "assistant", Content: "a1"})
+	for i := 0; i < sessionDrafts+2; i++ {
+		store.Regenerate("c", Message{Role: "assistant", Content: fmt.Sprintf("b%d", i)})
+	}
+	session, _ := store.Get("c")
+	drafts := session.Drafts[1]
+	if len(drafts) != sessionDrafts || drafts[0].Content != "b1" || session.Messages[1].Content != fmt.Sprintf("b%d", sessionDrafts+1) {
+		t.Fatalf("Expected the last %d replaced replies as drafts, got %+v", sessionDrafts, session)
+	}
+
+	// Drafts follow their message when older messages are trimmed, and
+	// go with it
+	store.Append("c", Message{Role: "user", Content: "2"}, Message{Role: "assistant", Content: "a2"})
+	store.Append("c", Message{Role: "user", Content: "3"})
+	session, _ = store.Get("c")
+	if len(session.Drafts) != 0 {
+		t.Errorf("Expected the drafts to go with their message, got %+v", session.Drafts)
+	}
+	store.Regenerate("c", Message{Role: "assistant", Content: "a3"})
+	store.Regenerate("c", Message{Role: "assistant", Content: "b3"})
+	store.Append("c", Message{Role: "user", Content: "4"}, Message{Role: "assistant", Content: "a4"})
+	session, _ = store.Get("c")
+	if len(session.Messages) != 4 || session.Messages[1].Content != "b3" || len(session.Drafts[1]) != 1 || session.Drafts[1][0].Content != "a3" {
+		t.Errorf("Expected the drafts renumbered with their message, got %+v", session)
+	}
+}
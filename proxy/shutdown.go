@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// A deploy replaces the process while completions, which can take a minute
+// or more, are still generating. On SIGTERM or SIGINT the process drains
+// instead of exiting at once: the health check answers 503 so load
+// balancers stop sending it requests, after PROXY_SHUTDOWN_DELAY the
+// listeners close, and requests in flight and bot bridge replies run to the
+// end for up to PROXY_SHUTDOWN_TIMEOUT, when those left are cut off. A second signal
+// cuts them off at once.
+
+// defaultShutdownTimeout is how long requests in flight get to finish
+const defaultShutdownTimeout = 2 * time.Minute
+
+// shutdownSettings are how the process drains
+type shutdownSettings struct {
+	// delay is how long the health check reports draining before the
+	// listeners close, for load balancers to notice
+	delay   time.Duration
+	timeout time.Duration
+}
+
+// shutdownSettingsFromEnv reads PROXY_SHUTDOWN_DELAY (default 0) and
+// PROXY_SHUTDOWN_TIMEOUT (default 2m)
+func shutdownSettingsFromEnv(getenv func(string) string) (shutdownSettings, error) {
+	settings := shutdownSettings{timeout: defaultShutdownTimeout}
+	for name, d := range map[string]*time.Duration{
+		"PROXY_SHUTDOWN_DELAY":   &settings.delay,
+		"PROXY_SHUTDOWN_TIMEOUT": &settings.timeout,
+	} {
+		if v := getenv(name); v != "" {
+			parsed, err := time.ParseDuration(v)
+			if err != nil || parsed < 0 {
+				return shutdownSettings{}, fmt.Errorf("invalid %s %q", name, v)
+			}
+			*d = parsed
+		}
+	}
+	return settings, nil
+}
+
+// drain stops srv from taking requests and waits for those in flight, and
+// for bot bridge replies whose webhook has already returned, until ctx is
+// done, then closes their connections. The health check reports the server
+// draining from the start, and live feeds, which would never finish, end
+// when the listeners close.
+func (s *ProxyServer) drain(ctx context.Context, srv *http.Server, delay time.Duration) error {
+	s.draining.Store(true)
+	select {
+	case <-time.After(delay):
+	case <-ctx.Done():
+	}
+	s.tail.Close()
+	err := srv.Shutdown(ctx)
+	if err != nil {
+		srv.Close()
+		return err
+	}
+	replied := make(chan struct{})
+	go func() {
+		s.bridgeReplies.Wait()
+		close(replied)
+	}()
+	select {
+	case <-replied:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("bot bridge replies still pending: %w", ctx.Err())
+	}
+}
+
+// flush saves state and exports spans the background jobs would have
+// later and finishes the mirror file, once the last requests are done
+func (s *ProxyServer) flush(ctx context.Context) {
+	if s.costs != nil {
+		if err := s.costs.Save(ctx); err != nil {
+			log.Printf("Failed to save costs: %v", err)
+		}
+	}
+	if s.tracer != nil {
+		if err := s.tracer.Export(ctx); err != nil {
+			log.Printf("Failed to export traces: %v", err)
+		}
+	}
+	if s.mirror != nil {
+		if err := s.mirror.Close(); err != nil {
+			log.Printf("Failed to close mirror file: %v", err)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestShutdownSettingsFromEnv(t *testing.T) {
+	settingsFrom := func(env map[string]string) (shutdownSettings, error) {
+		return shutdownSettingsFromEnv(func(name string) string { return env[name] })
+	}
+	settings, err := settingsFrom(nil)
+	if err != nil || settings.delay != 0 || settings.timeout != defaultShutdownTimeout {
+		t.Errorf("Expected the defaults, got %+v and %v", settings, err)
+	}
+	settings, err = settingsFrom(map[string]string{"PROXY_SHUTDOWN_DELAY": "5s", "PROXY_SHUTDOWN_TIMEOUT": "30s"})
+	if err != nil || settings.delay != 5*time.Second || settings.timeout != 30*time.Second {
+		t.Errorf("Expected a 5s delay and 30s timeout, got %+v and %v", settings, err)
+	}
+	if _, err := settingsFrom(map[string]string{"PROXY_SHUTDOWN_TIMEOUT": "-1s"}); err == nil {
+		t.Error("Expected an error for a negative timeout")
+	}
+}
+
+func TestProxyServer_DrainFinishesRequestsInFlight(t *testing.T) {
+	server := NewProxyServer(&MockOpenAIClient{response: createTestChatCompletionResponse()})
+	started, release := make(chan struct{}), make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		io.WriteString(w, "done")
+	})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(listener)
+	url := "http://" + listener.Addr().String()
+
+	reply := make(chan string, 1)
+	go func() {
+		resp, err := http.Get(url + "/slow")
+		if err != nil {
+			reply <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		reply <- string(body)
+	}()
+	<-started
+
+	drained := make(chan error, 1)
+	go func() { drained <- server.drain(context.Background(), srv, 0) }()
+	time.Sleep(50 * time.Millisecond)
+	w := httptest.NewRecorder()
+	server.handleHealth(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected the health check to fail while draining, got %d", w.Code)
+	}
+	if _, err := http.Get(url + "/slow"); err == nil {
+		t.Error("Expected new connections to be refused while draining")
+	}
+	select {
+	case err := <-drained:
+		t.Fatalf("Expected the drain to wait for the request in flight, got %v", err)
+	default:
+	}
+
+	close(release)
+	if got := <-reply; got != "done" {
+		t.Errorf("Expected the request in flight to finish, got %q", got)
+	}
+	if err := <-drained; err != nil {
+		t.Errorf("Expected a clean drain, got %v", err)
+	}
+}
+
+func TestProxyServer_DrainCutsOffAtDeadline(t *testing.T) {
+	server := NewProxyServer(&MockOpenAIClient{response: createTestChatCompletionResponse()})
+	started := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+	})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(listener)
+	go http.Get("http://" + listener.Addr().String() + "/slow")
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := server.drain(ctx, srv, 0); err == nil {
+		t.Error("Expected the drain to report the request it cut off")
+	}
+}
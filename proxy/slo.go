@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// SLO indicators
+const (
+	// Requests that do not fail with a 5xx status
+	IndicatorAvailability = "availability"
+	// Requests whose total upstream latency is within the threshold
+	IndicatorLatency = "latency"
+	// Requests whose first token arrives within the threshold; for
+	// responses that are not streamed that is the total latency
+	IndicatorTTFT = "ttft"
+)
+
+// maxSLOWindowDays bounds the history kept per SLO, one bucket per minute
+const maxSLOWindowDays = 30
+
+// SLO is a service level objective such as "99% of requests get their first
+// token within 5s over 30 days"
+type SLO struct {
+	ID          string  `json:"id"`
+	Name        string  `json:"name,omitempty"`
+	Indicator   string  `json:"indicator"`
+	ThresholdMS int64   `json:"threshold_ms,omitempty"`
+	Objective   float64 `json:"objective"`
+	WindowDays  int     `json:"window_days,omitempty"`
+	// Endpoint and Model restrict the SLO to matching requests; Model may
+	// end in * to match a prefix
+	Endpoint string `json:"endpoint,omitempty"`
+	Model    string `json:"model,omitempty"`
+}
+
+func (o SLO) validate() error {
+	switch o.Indicator {
+	case IndicatorAvailability:
+	case IndicatorLatency, IndicatorTTFT:
+		if o.ThresholdMS <= 0 {
+			return fmt.Errorf("%s SLO requires threshold_ms", o.Indicator)
+		}
+	default:
+		return fmt.Errorf("indicator must be one of %s, %s or %s", IndicatorAvailability, IndicatorLatency, IndicatorTTFT)
+	}
+	if o.Objective <= 0 || o.Objective >= 1 {
+		return fmt.Errorf("objective must be between 0 and 1, e.g. 0.99")
+	}
+	if o.WindowDays < 0 || o.WindowDays > maxSLOWindowDays {
+		return fmt.Errorf("window_days must be between 1 and %d", maxSLOWindowDays)
+	}
+	return nil
+}
+
+func (o SLO) window() time.Duration {
+	if o.WindowDays == 0 {
+		return maxSLOWindowDays * 24 * time.Hour
+	}
+	return time.Duration(o.WindowDays) * 24 * time.Hour
+}
+
+// classify reports whether event counts towards the SLO and whether it was
+// good
+func (o SLO) classify(event UsageEvent) (applies, good bool) {
+	if o.Endpoint != "" && o.Endpoint != event.Endpoint {
+		return false, false
+	}
+	if o.Model != "" && !matchAny([]string{o.Model}, event.Model) {
+		return false, false
+	}
+	switch o.Indicator {
+	case IndicatorAvailability:
+		return true, event.Status < 500
+	case IndicatorLatency:
+		return true, event.Status < 500 && event.LatencyMS <= o.ThresholdMS
+	case IndicatorTTFT:
+		ttft := event.TimeToFirstTokenMS
+		if ttft == 0 {
+			ttft = event.LatencyMS
+		}
+		return true, event.Status < 500 && ttft <= o.ThresholdMS
+	}
+	return false, false
+}
+
+// Burn-rate windows and thresholds of the usual multiwindow alerting: an
+// alert fires only if both the long and the short window burn too fast, so
+// it starts quickly and stops quickly once the problem is gone. A burn rate
+// of 14.4 over an hour spends 2% of a 30-day budget; 6 over six hours, 5%.
+var sloAlertRules = []struct {
+	severity    string
+	long, short time.Duration
+	burnRate    float64
+}{
+	{"page", time.Hour, 5 * time.Minute, 14.4},
+	{"ticket", 6 * time.Hour, 30 * time.Minute, 6},
+}
+
+var sloBurnWindows = []struct {
+	name string
+	d    time.Duration
+}{
+	{"5m", 5 * time.Minute},
+	{"30m", 30 * time.Minute},
+	{"1h", time.Hour},
+	{"6h", 6 * time.Hour},
+}
+
+// SLOStatus is the state of one SLO over its window
+type SLOStatus struct {
+	SLO   SLO   `json:"slo"`
+	Total int64 `json:"total"`
+	Good  int64 `json:"good"`
+	// Compliance is the fraction of good requests, 1 without traffic
+	Compliance float64 `json:"compliance"`
+	// ErrorBudgetRemaining is the fraction of allowed bad requests not yet
+	// spent; it goes negative once the SLO is violated
+	ErrorBudgetRemaining float64            `json:"error_budget_remaining"`
+	BurnRates            map[string]float64 `json:"burn_rates"`
+	Alert                string             `json:"alert,omitempty"`
+}
+
+// sloTracker counts good and total requests per SLO in one-minute buckets
+type sloTracker struct {
+	now func() time.Time
+
+	mu      sync.Mutex
+	windows map[string]*sloWindow
+}
+
+type sloWindow struct {
+	slo     SLO
+	buckets []sloBucket
+}
+
+type sloBucket struct {
+	minute int64
+	good   int64
+	total  int64
+}
+
+func newSLOTracker() *sloTracker {
+	return &sloTracker{now: time.Now, windows: make(map[string]*sloWindow)}
+}
+
+// windowFor returns the counts of slo, starting over if its definition
+// changed. Callers must hold t.mu.
+func (t *sloTracker) windowFor(slo SLO) *sloWindow {
+	w, ok := t.windows[slo.ID]
+	if !ok || w.slo != slo {
+		w = &sloWindow{slo: slo, buckets: make([]sloBucket, int(slo.window()/time.Minute))}
+		t.windows[slo.ID] = w
+	}
+	return w
+}
+
+// Record counts event against every SLO it applies to
+func (t *sloTracker) Record(slos []SLO, event UsageEvent) {
+	if len(slos) == 0 {
+		return
+	}
+	minute := t.now().Unix() / 60
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, slo := range slos {
+		applies, good := slo.classify(event)
+		if !applies {
+			continue
+		}
+		w := t.windowFor(slo)
+		b := &w.buckets[minute%int64(len(w.buckets))]
+		if b.minute != minute {
+			*b = sloBucket{minute: minute}
+		}
+		b.total++
+		if good {
+			b.good++
+		}
+	}
+}
+
+// counts sums the buckets of the last d. Callers must hold t.mu.
+func (w *sloWindow) counts(now time.Time, d time.Duration) (good, total int64) {
+	minute := now.Unix() / 60
+	n := min(int64(d/time.Minute), int64(len(w.buckets)))
+	for m := minute - n + 1; m <= minute; m++ {
+		b := w.buckets[m%int64(len(w.buckets))]
+		if b.minute == m {
+			good += b.good
+			total += b.total
+		}
+	}
+	return good, total
+}
+
+// burnRate is how fast the error budget is spent: 1 means exactly at the
+// rate that uses it up by the end of the window
+func burnRate(good, total int64, objective float64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return (float64(total-good) / float64(total)) / (1 - objective)
+}
+
+// Status computes the status of every SLO
+func (t *sloTracker) Status(slos []SLO) []SLOStatus {
+	now := t.now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// Forget SLOs that have been deleted
+	defined := make(map[string]bool, len(slos))
+	for _, slo := range slos {
+		defined[slo.ID] = true
+	}
+	for id := range t.windows {
+		if !defined[id] {
+			delete(t.windows, id)
+		}
+	}
+
+	statuses := make([]SLOStatus, 0, len(slos))
+	for _, slo := range slos {
+		w := t.windowFor(slo)
+		good, total := w.counts(now, slo.window())
+		status := SLOStatus{SLO: slo, Total: total, Good: good, Compliance: 1, ErrorBudgetRemaining: 1, BurnRates: make(map[string]float64)}
+		if total > 0 {
+			status.Compliance = float64(good) / float64(total)
+			status.ErrorBudgetRemaining = 1 - burnRate(good, total, slo.Objective)
+		}
+		for _, bw := range sloBurnWindows {
+			g, n := w.counts(now, bw.d)
+			status.BurnRates[bw.name] = burnRate(g, n, slo.Objective)
+		}
+		for _, rule := range sloAlertRules {
+			lg, ln := w.counts(now, rule.long)
+			sg, sn := w.counts(now, rule.short)
+			if burnRate(lg, ln, slo.Objective) >= rule.burnRate && burnRate(sg, sn, slo.Objective) >= rule.burnRate {
+				status.Alert = rule.severity
+				break
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// evaluateSLOs raises and resolves burn-rate alerts. It runs as a
+// per-replica job since every replica counts its own traffic.
+func (s *ProxyServer) evaluateSLOs(ctx context.Context) error {
+	for _, status := range s.sloTracker.Status(s.slos.List()) {
+		name := "slo:" + status.SLO.ID
+		if status.Alert == "" {
+			s.alerts.Resolve(ctx, name)
+			continue
+		}
+		s.alerts.Fire(ctx, Alert{
+			Name:     name,
+			Severity: status.Alert,
+			Summary: fmt.Sprintf("SLO %s is burning its error budget %.1fx too fast (1h), %.0f%% of the budget left",
+				status.SLO.ID, status.BurnRates["1h"], status.ErrorBudgetRemaining*100),
+			Labels: map[string]string{"slo": status.SLO.ID, "indicator": status.SLO.Indicator},
+		})
+	}
+	return nil
+}
+
+func (s *ProxyServer) adminSLOHandler() http.Handler {
+	return resourceHandler[SLO]{
+		lock: s.slos.lockWrites,
+		get: func(id string) (SLO, string, bool) {
+			slo, ok := s.slos.Get(id)
+			return slo, etagFor(slo), ok
+		},
+		put: func(id string, slo SLO, _ *SLO) (bool, error) {
+			if slo.ID != "" && slo.ID != id {
+				return false, fmt.Errorf("id in body does not match id in path")
+			}
+			slo.ID = id
+			if err := slo.validate(); err != nil {
+				return false, err
+			}
+			return s.slos.Put(id, slo), nil
+		},
+		remove: s.slos.Delete,
+		view:   func(slo SLO) any { return slo },
+	}
+}
+
+// sloSamples exports SLO state as gauges
+func (s *ProxyServer) sloSamples() []gaugeSample {
+	var samples []gaugeSample
+	for _, status := range s.sloTracker.Status(s.slos.List()) {
+		samples = append(samples, gaugeSample{
+			metric: "vibethon_slo_error_budget_remaining",
+			labels: []string{"slo", status.SLO.ID},
+			value:  status.ErrorBudgetRemaining,
+		})
+		for _, bw := range sloBurnWindows {
+			samples = append(samples, gaugeSample{
+				metric: "vibethon_slo_burn_rate",
+				labels: []string{"slo", status.SLO.ID, "window", bw.name},
+				value:  status.BurnRates[bw.name],
+			})
+		}
+	}
+	return samples
+}
+
+// handleAdminSLOStatus reports every SLO's compliance, remaining error
+// budget and burn rates
+func (s *ProxyServer) handleAdminSLOStatus(w http.ResponseWriter, r *http.Request) {
+	handleAdminList("slos", func() []SLOStatus { return s.sloTracker.Status(s.slos.List()) })(w, r)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestSLOTracker(now *time.Time) *sloTracker {
+	t := newSLOTracker()
+	t.now = func() time.Time { return *now }
+	return t
+}
+
+func TestSLO_Classify(t *testing.T) {
+	latency := SLO{Indicator: IndicatorLatency, ThresholdMS: 1000, Model: "gpt-4*"}
+	tests := []struct {
+		slo     SLO
+		event   UsageEvent
+		applies bool
+		good    bool
+	}{
+		{latency, UsageEvent{Model: "gpt-4o", Status: 200, LatencyMS: 800}, true, true},
+		{latency, UsageEvent{Model: "gpt-4o", Status: 200, LatencyMS: 1500}, true, false},
+		{latency, UsageEvent{Model: "gpt-4o", Status: 500, LatencyMS: 10}, true, false},
+		{latency, UsageEvent{Model: "gpt-3.5-turbo", Status: 200}, false, false},
+		{SLO{Indicator: IndicatorAvailability}, UsageEvent{Status: 429}, true, true},
+		{SLO{Indicator: IndicatorAvailability}, UsageEvent{Status: 502}, true, false},
+		{SLO{Indicator: IndicatorTTFT, ThresholdMS: 500}, UsageEvent{Status: 200, LatencyMS: 3000, TimeToFirstTokenMS: 200}, true, true},
+		{SLO{Indicator: IndicatorTTFT, ThresholdMS: 500}, UsageEvent{Status: 200, LatencyMS: 3000}, true, false},
+		{SLO{Indicator: IndicatorAvailability, Endpoint: "embeddings"}, UsageEvent{Endpoint: "chat.completions"}, false, false},
+	}
+	for i, tt := range tests {
+		applies, good := tt.slo.classify(tt.event)
+		if applies != tt.applies || good != tt.good {
+			t.Errorf("Case %d: expected (%v, %v), got (%v, %v)", i, tt.applies, tt.good, applies, good)
+		}
+	}
+}
+
+func TestSLO_Validate(t *testing.T) {
+	invalid := []SLO{
+		{Indicator: "throughput", Objective: 0.99},
+		{Indicator: IndicatorLatency, Objective: 0.99},
+		{Indicator: IndicatorAvailability, Objective: 1},
+		{Indicator: IndicatorAvailability, Objective: 0.99, WindowDays: 90},
+	}
+	for _, slo := range invalid {
+		if slo.validate() == nil {
+			t.Errorf("Expected %+v to be invalid", slo)
+		}
+	}
+	if err := (SLO{Indicator: IndicatorTTFT, ThresholdMS: 5000, Objective: 0.99}).validate(); err != nil {
+		t.Errorf("Expected a valid SLO, got %v", err)
+	}
+}
+
+func TestSLOTracker_BudgetAndBurnRate(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	tracker := newTestSLOTracker(&now)
+	slo := SLO{ID: "avail", Indicator: IndicatorAvailability, Objective: 0.99, WindowDays: 1}
+	slos := []SLO{slo}
+
+	// 2% errors two hours ago, then clean traffic
+	now = now.Add(-2 * time.Hour)
+	for i := 0; i < 100; i++ {
+		status := 200
+		if i < 2 {
+			status = 500
+		}
+		tracker.Record(slos, UsageEvent{Status: status})
+	}
+	now = now.Add(2 * time.Hour)
+	for i := 0; i < 100; i++ {
+		tracker.Record(slos, UsageEvent{Status: 200})
+	}
+
+	status := tracker.Status(slos)[0]
+	if status.Total != 200 || status.Good != 198 {
+		t.Fatalf("Expected 198/200 good, got %d/%d", status.Good, status.Total)
+	}
+	// 1% errors over the window spends exactly the whole budget
+	if math.Abs(status.ErrorBudgetRemaining) > 1e-9 {
+		t.Errorf("Expected no error budget left, got %v", status.ErrorBudgetRemaining)
+	}
+	if status.BurnRates["1h"] != 0 || math.Abs(status.BurnRates["6h"]-1) > 1e-9 {
+		t.Errorf("Expected burn rates of 0 (1h) and 1 (6h), got %v", status.BurnRates)
+	}
+	if status.Alert != "" {
+		t.Errorf("Expected no alert, got %s", status.Alert)
+	}
+}
+
+func TestSLOTracker_FastBurnPages(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	tracker := newTestSLOTracker(&now)
+	slos := []SLO{{ID: "avail", Indicator: IndicatorAvailability, Objective: 0.99}}
+
+	// Half of all requests failing burns the budget 50x too fast
+	for i := 0; i < 100; i++ {
+		tracker.Record(slos, UsageEvent{Status: 200 + 300*(i%2)})
+	}
+	if status := tracker.Status(slos)[0]; status.Alert != "page" {
+		t.Errorf("Expected a page alert, got %q (burn rates %v)", status.Alert, status.BurnRates)
+	}
+}
+
+func TestSLOTracker_ResetsOnChange(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	tracker := newTestSLOTracker(&now)
+	slo := SLO{ID: "lat", Indicator: IndicatorLatency, ThresholdMS: 100, Objective: 0.9}
+	tracker.Record([]SLO{slo}, UsageEvent{Status: 200, LatencyMS: 50})
+
+	slo.ThresholdMS = 200
+	if status := tracker.Status([]SLO{slo})[0]; status.Total != 0 {
+		t.Errorf("Expected counts to start over after the SLO changed, got %d", status.Total)
+	}
+}
+
+func TestProxyServer_EvaluateSLOs(t *testing.T) {
+	var notified []Alert
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert Alert
+		json.NewDecoder(r.Body).Decode(&alert)
+		notified = append(notified, alert)
+	}))
+	defer webhook.Close()
+
+	server := NewProxyServer(&MockOpenAIClient{})
+	server.alerts.webhook = webhook.URL
+	server.slos.Put("avail", SLO{ID: "avail", Indicator: IndicatorAvailability, Objective: 0.99})
+	for i := 0; i < 10; i++ {
+		server.recordUsage(UsageEvent{Endpoint: "chat.completions", Status: 500})
+	}
+
+	server.evaluateSLOs(context.Background())
+	server.evaluateSLOs(context.Background())
+	if len(notified) != 1 || notified[0].Name != "slo:avail" || notified[0].Severity != "page" {
+		t.Fatalf("Expected one page notification, got %+v", notified)
+	}
+	if active := server.alerts.Active(); len(active) != 1 {
+		t.Errorf("Expected 1 active alert, got %d", len(active))
+	}
+
+	server.slos.Delete("avail")
+	server.evaluateSLOs(context.Background())
+	if len(notified) != 1 {
+		t.Errorf("Expected deleted SLOs not to notify again, got %+v", notified)
+	}
+}
+
+func TestProxyServer_AdminSLOs(t *testing.T) {
+	server := NewProxyServer(&MockOpenAIClient{})
+	handler := server.adminSLOHandler()
+
+	body := `{"indicator": "ttft", "threshold_ms": 5000, "objective": 0.99}`
+	req := httptest.NewRequest("PUT", "/admin/slos/ttft", strings.NewReader(body))
+	req.SetPathValue("id", "ttft")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+
+	req = httptest.NewRequest("PUT", "/admin/slos/bad", strings.NewReader(`{"indicator": "ttft", "objective": 0.99}`))
+	req.SetPathValue("id", "bad")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d for a missing threshold, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	server.handleAdminSLOStatus(w, httptest.NewRequest("GET", "/admin/slo-status", nil))
+	if !strings.Contains(w.Body.String(), `"error_budget_remaining":1`) {
+		t.Errorf("Expected a full error budget, got %s", w.Body.String())
+	}
+}
+
+func TestProxyServer_SLOMetrics(t *testing.T) {
+	server := NewProxyServer(&MockOpenAIClient{})
+	server.slos.Put("avail", SLO{ID: "avail", Indicator: IndicatorAvailability, Objective: 0.99})
+
+	var buf bytes.Buffer
+	server.metrics.registry.Write(&buf)
+	for _, want := range []string{
+		"# TYPE vibethon_slo_burn_rate gauge\n",
+		`vibethon_slo_burn_rate{slo="avail",window="1h"} 0`,
+		`vibethon_slo_error_budget_remaining{slo="avail"} 1`,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", want, buf.String())
+		}
+	}
+}
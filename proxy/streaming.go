@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Chat completions with "stream": true are answered with the server-sent
+// events of the upstream as they arrive, each chat.completion.chunk flushed
+// to the client at once. The stream always ends with "data: [DONE]", and a
+// client that disconnects abandons the upstream call.
+
+// streamingOpenAIClient is implemented by clients that can forward a
+// streamed chat completion as the upstream sends it
+type streamingOpenAIClient interface {
+	// CreateChatCompletionStream sends body, which asks for a stream, and
+	// returns the server-sent events of the reply. Cancelling ctx ends
+	// the stream.
+	CreateChatCompletionStream(ctx context.Context, body []byte) (io.ReadCloser, error)
+}
+
+func (c *RealOpenAIClient) CreateChatCompletionStream(ctx context.Context, jsonData []byte) (io.ReadCloser, error) {
+	// Only failures before the stream starts are retried
+	resp, err := c.send(ctx, "/chat/completions", jsonData, func(httpReq *http.Request) {
+		httpReq.Header.Set("Accept", "text/event-stream")
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read response: %w", err)
+		}
+		return nil, apiError(resp.StatusCode, body)
+	}
+	return resp.Body, nil
+}
+
+// streamConflict names the member of a decoded request asking for a proxy
+// feature that needs the whole reply, so cannot be streamed, if there is one
+func (s *ProxyServer) streamConflict(req *ChatCompletionRequest) string {
+	switch {
+	case len(req.PostProcess) > 0:
+		return "post_process"
+	case len(req.BuiltinTools) > 0:
+		return "builtin_tools"
+	case req.Session != "":
+		return "session"
+	case req.ResponseFormat != nil && proxyOnlyFormat(req.ResponseFormat):
+		return "response_format"
+	}
+	return ""
+}
+
+// streamChatCompletion sends body upstream and relays the events of the
+// reply to w. Usage is accounted for when the upstream reports it, i.e.
+// when the request sets stream_options.include_usage. Spend is recorded
+// from that usage, so with pricing configured the proxy asks for it itself
+// and keeps the usage chunk from clients that did not.
+func (s *ProxyServer) streamChatCompletion(w http.ResponseWriter, r *http.Request, client streamingOpenAIClient, body []byte, key *ClientKey, model string) {
+	dropUsage := false
+	if s.costs != nil && key != nil {
+		body, dropUsage = includeStreamUsage(body)
+	}
+	timeline := timelineFromContext(r.Context())
+	ctx, done := s.inflight.Start(r.Context(), timeline.id(), key)
+	defer done()
+	event := newUsageEvent(key, "chat.completions", model)
+	timer := s.metrics.newStreamTimer(model, s.upstream)
+	stream, err := client.CreateChatCompletionStream(ctx, body)
+	if err != nil {
+		event.LatencyMS = time.Since(event.Time).Milliseconds()
+		log.Printf("OpenAI API error: %v", err)
+		event.Status = upstreamErrorStatus(err)
+		s.recordUsage(event)
+		writeUpstreamError(w, err)
+		return
+	}
+	defer stream.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Keep reverse proxies such as nginx from buffering the events
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+	flush := func() error {
+		if err := rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			return err
+		}
+		return nil
+	}
+	flush()
+
+	usage, err := relayEvents(w, stream, dropUsage, func() {
+		timeline.Add(TimelineFirstToken, "")
+	}, func() {
+		if event.TimeToFirstTokenMS == 0 {
+			event.TimeToFirstTokenMS = max(time.Since(event.Time).Milliseconds(), 1)
+		}
+		timer.Token()
+	}, flush)
+	event.LatencyMS = time.Since(event.Time).Milliseconds()
+	if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		log.Printf("Streaming chat completion failed: %v", err)
+		event.Status = upstreamErrorStatus(err)
+		event.PromptTokens, event.CompletionTokens, event.TotalTokens = usage.PromptTokens, usage.CompletionTokens, usage.TotalTokens
+		s.recordUsage(event)
+		// The status is sent already, so a client still listening, e.g. one
+		// whose request was cancelled from elsewhere, learns of the failure
+		// from an error event
+		if r.Context().Err() == nil {
+			writeStreamError(w, err)
+			flush()
+		}
+		return
+	}
+	s.recordCompletion(key, event, usage)
+}
+
+// includeStreamUsage sets stream_options.include_usage on a streamed
+// request body, and reports whether it had to
+func includeStreamUsage(body []byte) ([]byte, bool) {
+	options := map[string]any{}
+	scanObject(body, func(key []byte, start, end int) bool {
+		if string(key) != "stream_options" {
+			return true
+		}
+		json.Unmarshal(body[start:end], &options)
+		return false
+	})
+	if options["include_usage"] == true {
+		return body, false
+	}
+	options["include_usage"] = true
+	raw, _ := json.Marshal(options)
+	return setJSONRawMember(body, "stream_options", raw), true
+}
+
+// usageOnlyChunk reports whether a chunk is the one carrying the usage of
+// the stream, which has no choices
+func usageOnlyChunk(payload []byte) bool {
+	usageOnly := true
+	scanObject(payload, func(key []byte, start, end int) bool {
+		if string(key) == "choices" {
+			usageOnly = !jsonArrayNonEmpty(payload[start:end])
+			return false
+		}
+		return true
+	})
+	return usageOnly
+}
+
+// contentChunk reports whether a chunk carries generated content, text or
+// tool call arguments, rather than only a role, a finish reason or usage
+func contentChunk(payload []byte) bool {
+	if !bytes.Contains(payload, []byte(`"delta"`)) {
+		return false
+	}
+	var chunk chatCompletionChunk
+	if json.Unmarshal(payload, &chunk) != nil {
+		return false
+	}
+	for _, choice := range chunk.Choices {
+		if choice.Delta.Content != "" || len(choice.Delta.ToolCalls) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// relayEvents copies the server-sent events in stream to w, calling flush
+// at the end of every event, first at the first data line and token at
+// every content chunk, and returns the usage reported by the last chunk
+// that carries one. With dropUsage the event of the usage-only chunk is not
+// copied. A stream the upstream ends without "data: [DONE]" gets one
+// appended.
+func relayEvents(w io.Writer, stream io.Reader, dropUsage bool, first, token func(), flush func() error) (Usage, error) {
+	var usage Usage
+	in := bufio.NewReader(stream)
+	// inEvent is whether lines were written since the last blank one, and
+	// dropping whether those of the current event are skipped
+	sawData, sawDone, inEvent, dropping := false, false, false, false
+	for {
+		line, err := in.ReadBytes('\n')
+		if len(line) > 0 {
+			if payload, ok := bytes.CutPrefix(bytes.TrimRight(line, "\r\n"), []byte("data:")); ok {
+				payload = bytes.TrimSpace(payload)
+				if !sawData {
+					sawData = true
+					first()
+				}
+				if string(payload) == "[DONE]" {
+					sawDone = true
+				} else {
+					if contentChunk(payload) {
+						token()
+					}
+					if bytes.Contains(payload, []byte(`"usage"`)) {
+						if u := scanUsage(payload); u != (Usage{}) {
+							usage = u
+							dropping = dropUsage && usageOnlyChunk(payload)
+						}
+					}
+				}
+			}
+			if dropping {
+				dropping = len(bytes.TrimSpace(line)) > 0
+			} else {
+				if line[len(line)-1] != '\n' {
+					line = append(line, '\n')
+				}
+				if _, werr := w.Write(line); werr != nil {
+					return usage, werr
+				}
+				inEvent = len(bytes.TrimSpace(line)) > 0
+				if !inEvent {
+					if ferr := flush(); ferr != nil {
+						return usage, ferr
+					}
+				}
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return usage, err
+		}
+	}
+	if !sawDone {
+		done := "data: [DONE]\n\n"
+		if inEvent {
+			done = "\n" + done
+		}
+		if _, err := io.WriteString(w, done); err != nil {
+			return usage, err
+		}
+	}
+	return usage, flush()
+}
+
+// writeStreamError ends a stream with an error event, in the shape of the
+// error bodies of writeUpstreamError
+func writeStreamError(w io.Writer, err error) {
+	var resp ErrorResponse
+	resp.Error.Message = err.Error()
+	resp.Error.Type = "upstream_error"
+	if upstreamErrorStatus(err) == statusClientClosedRequest {
+		resp.Error.Message = "The request was cancelled"
+		resp.Error.Type = "cancelled"
+		resp.Error.Code = "request_cancelled"
+	}
+	data, _ := json.Marshal(resp)
+	fmt.Fprintf(w, "data: %s\n\n", data)
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testChunk = `{"id":"chatcmpl-1","object":"chat.completion.chunk","choices":[{"index":0,"delta":{"content":"Hi"}}]}`
+
+// newStreamingProxy serves a proxy whose upstream is the handler upstream
+func newStreamingProxy(t *testing.T, upstream http.HandlerFunc) (*ProxyServer, *httptest.Server) {
+	t.Helper()
+	api := httptest.NewServer(upstream)
+	t.Cleanup(api.Close)
+	client := NewRealOpenAIClient("sk-upstream")
+	client.BaseURL = api.URL
+	server := NewProxyServer(client)
+	server.keys = createTestKeyStore(t)
+	proxy := httptest.NewServer(server.Handler())
+	t.Cleanup(proxy.Close)
+	return server, proxy
+}
+
+func postStream(t *testing.T, url, body string) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest("POST", url+"/v1/chat/completions", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer sk-full")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	return resp
+}
+
+func TestProxyServer_StreamChatCompletion_RelaysEvents(t *testing.T) {
+	// The upstream holds the rest of the stream back until the client has
+	// seen the first chunk, which it only can if the proxy flushes it
+	firstSeen := make(chan struct{})
+	server, proxy := newStreamingProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept") != "text/event-stream" {
+			t.Errorf("Expected the upstream to be asked for a stream")
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprintf(w, "data: %s\n\n", testChunk)
+		w.(http.Flusher).Flush()
+		select {
+		case <-firstSeen:
+		case <-time.After(5 * time.Second):
+			t.Error("The first chunk was not flushed to the client")
+		}
+		fmt.Fprint(w, `data: {"id":"chatcmpl-1","object":"chat.completion.chunk","choices":[],"usage":{"prompt_tokens":5,"completion_tokens":2,"total_tokens":7}}`+"\n\n")
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	})
+
+	resp := postStream(t, proxy.URL, `{"model":"gpt-4o","messages":[{"role":"user","content":"Hi"}],"stream":true,"stream_options":{"include_usage":true}}`)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Expected an event stream, got %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	in := bufio.NewReader(resp.Body)
+	line, err := in.ReadString('\n')
+	if err != nil || line != "data: "+testChunk+"\n" {
+		t.Fatalf("Expected the first chunk, got %q (%v)", line, err)
+	}
+	close(firstSeen)
+	var rest bytes.Buffer
+	rest.ReadFrom(in)
+	if !strings.HasSuffix(rest.String(), "data: [DONE]\n\n") || strings.Count(rest.String(), "[DONE]") != 1 {
+		t.Errorf("Expected the stream to end with one [DONE], got %q", rest.String())
+	}
+
+	_, tokens := server.limiter.windowKeys("full")
+	if got := server.limiter.counters.Get(tokens); got != 7 {
+		t.Errorf("Expected the streamed usage to be recorded, got %d tokens", got)
+	}
+}
+
+func TestProxyServer_StreamChatCompletion_CountsAgainstBudget(t *testing.T) {
+	server, proxy := newStreamingProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		var req ChatCompletionRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.StreamOptions == nil || !req.StreamOptions.IncludeUsage {
+			t.Error("Expected the upstream to be asked for usage")
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprintf(w, "data: %s\n\n", testChunk)
+		fmt.Fprint(w, `data: {"id":"chatcmpl-1","object":"chat.completion.chunk","choices":[],"usage":{"prompt_tokens":5,"completion_tokens":2,"total_tokens":7}}`+"\n\n")
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	})
+	server.keys, _ = NewKeyStore([]ClientKey{{ID: "full", Key: "sk-full", MonthlyBudget: 0.005}})
+	server.costs = newTestCostLedger(t)
+
+	body := `{"model":"gpt-3.5-turbo","messages":[{"role":"user","content":"Hi"}],"stream":true}`
+	resp := postStream(t, proxy.URL, body)
+	var out bytes.Buffer
+	out.ReadFrom(resp.Body)
+	resp.Body.Close()
+	if want := "data: " + testChunk + "\n\ndata: [DONE]\n\n"; out.String() != want {
+		t.Errorf("Expected the usage chunk to be kept from the client, got %q", out.String())
+	}
+	if spent := server.costs.Spent("full"); spent <= 0.005 {
+		t.Errorf("Expected the stream to be charged, got $%v", spent)
+	}
+	resp = postStream(t, proxy.URL, body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusPaymentRequired {
+		t.Errorf("Expected the key to be over budget, got %d", resp.StatusCode)
+	}
+}
+
+func TestProxyServer_StreamChatCompletion_TimesTokens(t *testing.T) {
+	server, proxy := newStreamingProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, `data: {"id":"chatcmpl-1","object":"chat.completion.chunk","choices":[{"index":0,"delta":{"role":"assistant"}}]}`+"\n\n")
+		w.(http.Flusher).Flush()
+		time.Sleep(20 * time.Millisecond)
+		for i := 0; i < 3; i++ {
+			fmt.Fprintf(w, "data: %s\n\n", testChunk)
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	})
+	sink := &memorySink{}
+	queue, _ := openWALQueue(t.TempDir(), sink, 1<<20)
+	defer queue.Close()
+	server.usage = queue
+
+	resp := postStream(t, proxy.URL, `{"model":"gpt-4o","messages":[{"role":"user","content":"Hi"}],"stream":true}`)
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	key := seriesKey([]string{"gpt-4o", server.upstream})
+	if ttft := server.metrics.timeToFirstToken.summaries()[key]; ttft.Count != 1 || ttft.Mean < 0.02 {
+		t.Errorf("Expected one TTFT observation after the role chunk, got %+v", ttft)
+	}
+	if itl := server.metrics.interTokenDelay.summaries()[key]; itl.Count != 2 {
+		t.Errorf("Expected two inter-token observations, got %+v", itl)
+	}
+	queue.deliver(context.Background())
+	var event UsageEvent
+	if len(sink.events) == 1 {
+		json.Unmarshal([]byte(sink.events[0]), &event)
+	}
+	if event.TimeToFirstTokenMS < 20 || event.TimeToFirstTokenMS > event.LatencyMS {
+		t.Errorf("Expected the usage event to carry the TTFT, got %v", sink.events)
+	}
+}
+
+func TestProxyServer_StreamChatCompletion_CancelsUpstreamOnDisconnect(t *testing.T) {
+	abandoned := make(chan struct{})
+	_, proxy := newStreamingProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprintf(w, "data: %s\n\n", testChunk)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+		close(abandoned)
+	})
+
+	resp := postStream(t, proxy.URL, `{"model":"gpt-4o","messages":[{"role":"user","content":"Write a novel"}],"stream":true}`)
+	if _, err := bufio.NewReader(resp.Body).ReadString('\n'); err != nil {
+		t.Fatalf("Expected the first chunk, got %v", err)
+	}
+	resp.Body.Close()
+
+	select {
+	case <-abandoned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the upstream call to be abandoned when the client went away")
+	}
+}
+
+func TestProxyServer_StreamChatCompletion_UpstreamError(t *testing.T) {
+	_, proxy := newStreamingProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprint(w, `{"error":{"message":"rate limit exceeded","type":"requests"}}`)
+	})
+
+	resp := postStream(t, proxy.URL, `{"model":"gpt-4o","messages":[{"role":"user","content":"Hi"}],"stream":true}`)
+	defer resp.Body.Close()
+	var body bytes.Buffer
+	body.ReadFrom(resp.Body)
+	if resp.StatusCode != http.StatusInternalServerError || !strings.Contains(body.String(), "rate limit exceeded") {
+		t.Errorf("Expected the upstream error before any event, got %d %s", resp.StatusCode, body.String())
+	}
+}
+
+func TestProxyServer_StreamChatCompletion_RejectsPostProcessing(t *testing.T) {
+	_, proxy := newStreamingProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Expected no upstream call")
+	})
+
+	resp := postStream(t, proxy.URL, `{"model":"gpt-4o","messages":[{"role":"user","content":"Hi"}],"stream":true,"post_process":["trim"]}`)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status code %d, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+func TestRelayEvents_EndsWithDone(t *testing.T) {
+	var out bytes.Buffer
+	firsts, tokens := 0, 0
+	usage, err := relayEvents(&out, strings.NewReader("data: "+testChunk), false, func() { firsts++ }, func() { tokens++ }, func() error { return nil })
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	want := "data: " + testChunk + "\n\ndata: [DONE]\n\n"
+	if out.String() != want {
+		t.Errorf("Expected %q, got %q", want, out.String())
+	}
+	if firsts != 1 || tokens != 1 || usage != (Usage{}) {
+		t.Errorf("Expected one first chunk, one token and no usage, got %d, %d and %+v", firsts, tokens, usage)
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ResponseFormat is the response_format of a chat completion request.
+// Besides OpenAI's text, json_object and json_schema types the proxy
+// understands "regex", "xml" and "yaml", which it always enforces itself.
+type ResponseFormat struct {
+	Type string `json:"type"`
+	// JSONSchema is the schema of json_schema replies, and optionally of
+	// yaml ones
+	JSONSchema *JSONSchemaFormat `json:"json_schema,omitempty"`
+	// Pattern is the regular expression the whole reply must match, for
+	// the regex type
+	Pattern string `json:"pattern,omitempty"`
+	// Root is the name the document element must have, for the xml type
+	Root string `json:"root,omitempty"`
+}
+
+// JSONSchemaFormat names the schema replies must follow
+type JSONSchemaFormat struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Schema      json.RawMessage `json:"schema,omitempty"`
+	Strict      *bool           `json:"strict,omitempty"`
+}
+
+// ResponseMetadata is what the proxy adds to a completion about how it was
+// produced
+type ResponseMetadata struct {
+	// OutputRetries is how many times the model was asked again because its
+	// reply did not match the requested format
+	OutputRetries int `json:"output_retries,omitempty"`
+	// OutputError describes why the final reply still does not match
+	OutputError string `json:"output_error,omitempty"`
+	// CompletionRetries is how many times a reply that was empty or cut off
+	// was retried, and CompletionRetryReason what was wrong with it
+	CompletionRetries     int    `json:"completion_retries,omitempty"`
+	CompletionRetryReason string `json:"completion_retry_reason,omitempty"`
+	// Continuations is how many times the model was asked to go on with a
+	// reply cut off by max_tokens
+	Continuations int `json:"continuations,omitempty"`
+	// RepairedToolCalls counts tool calls whose arguments the model fixed
+	// on request
+	RepairedToolCalls int `json:"repaired_tool_calls,omitempty"`
+	// ToolCallErrors lists tool calls whose arguments do not match the
+	// function's parameters
+	ToolCallErrors []string `json:"tool_call_errors,omitempty"`
+	// Citations are the retrieved chunks injected into the request
+	Citations []Citation `json:"citations,omitempty"`
+	// PostProcessErrors lists the post-processors that failed and left the
+	// reply as it was
+	PostProcessErrors []string `json:"post_process_errors,omitempty"`
+	// ToolRuns are the calls to builtin tools the proxy answered
+	ToolRuns []ToolRun `json:"tool_runs,omitempty"`
+	// ToolError says why the proxy stopped answering builtin tool calls
+	ToolError string `json:"tool_error,omitempty"`
+	// AgentRunID is the run recorded for /v1/agents/runs/{id}
+	AgentRunID string `json:"agent_run_id,omitempty"`
+}
+
+// Structured output modes, chosen with PROXY_STRUCTURED_OUTPUT
+const (
+	// The upstream enforces response_format itself
+	StructuredOutputNative = "native"
+	// Replies are validated and retried, response_format is still sent
+	StructuredOutputCheck = "check"
+	// response_format is replaced by instructions for upstreams that do not
+	// support it, and replies are validated and retried
+	StructuredOutputEmulate = "emulate"
+)
+
+// outputCheck validates a reply and returns it normalized, e.g. without a
+// Markdown code fence around the JSON. For formats other than JSON it also
+// returns the reply parsed into JSON.
+type outputCheck func(content string) (string, json.RawMessage, error)
+
+// proxyOnlyFormat reports whether no upstream supports a response format
+// type, so the proxy always enforces it by emulation
+func proxyOnlyFormat(format *ResponseFormat) bool {
+	switch format.Type {
+	case "regex", "xml", "yaml":
+		return true
+	}
+	return false
+}
+
+// newOutputCheck returns the check for a response format, or nil if any
+// reply is fine
+func newOutputCheck(format *ResponseFormat) (outputCheck, error) {
+	if format == nil {
+		return nil, nil
+	}
+	switch format.Type {
+	case "", "text":
+		return nil, nil
+	case "json_object":
+		return func(content string) (string, json.RawMessage, error) {
+			content = stripCodeFence(content)
+			var object map[string]json.RawMessage
+			if err := json.Unmarshal([]byte(content), &object); err != nil {
+				return content, nil, fmt.Errorf("the reply is not a JSON object")
+			}
+			return content, nil, nil
+		}, nil
+	case "json_schema":
+		if format.JSONSchema == nil || len(format.JSONSchema.Schema) == 0 {
+			return nil, fmt.Errorf("response_format json_schema requires a schema")
+		}
+		schema, err := compileJSONSchema(format.JSONSchema.Schema)
+		if err != nil {
+			return nil, err
+		}
+		return func(content string) (string, json.RawMessage, error) {
+			content = stripCodeFence(content)
+			return content, nil, schema.Validate([]byte(content))
+		}, nil
+	case "regex":
+		re, err := regexp.Compile(`^(?:` + format.Pattern + `)$`)
+		if format.Pattern == "" || err != nil {
+			return nil, fmt.Errorf("response_format regex requires a valid pattern")
+		}
+		return func(content string) (string, json.RawMessage, error) {
+			content = strings.TrimSpace(content)
+			if !re.MatchString(content) {
+				return content, nil, fmt.Errorf("the reply does not match the pattern %s", format.Pattern)
+			}
+			return content, nil, nil
+		}, nil
+	case "xml":
+		if format.JSONSchema != nil {
+			return nil, fmt.Errorf("response_format xml does not take a json_schema")
+		}
+		return func(content string) (string, json.RawMessage, error) {
+			content = stripCodeFence(content)
+			value, err := xmlValue(content, format.Root)
+			if err != nil {
+				return content, nil, err
+			}
+			parsed, err := json.Marshal(value)
+			return content, parsed, err
+		}, nil
+	case "yaml":
+		var schema *compiledSchema
+		if format.JSONSchema != nil && len(format.JSONSchema.Schema) > 0 {
+			var err error
+			if schema, err = compileJSONSchema(format.JSONSchema.Schema); err != nil {
+				return nil, err
+			}
+		}
+		return func(content string) (string, json.RawMessage, error) {
+			content = stripCodeFence(content)
+			value, err := yamlValue(content)
+			if err != nil {
+				return content, nil, fmt.Errorf("the reply is not valid YAML: %v", err)
+			}
+			parsed, err := json.Marshal(value)
+			if err == nil && schema != nil {
+				err = schema.Validate(parsed)
+			}
+			return content, parsed, err
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown response_format type %q", format.Type)
+	}
+}
+
+// stripCodeFence returns the inside of a reply wrapped in a Markdown code
+// block, which models often do with JSON even when told not to
+func stripCodeFence(content string) string {
+	trimmed := strings.TrimSpace(content)
+	if !strings.HasPrefix(trimmed, "```") || !strings.HasSuffix(trimmed, "```") || len(trimmed) < 6 {
+		return trimmed
+	}
+	inner := trimmed[3 : len(trimmed)-3]
+	// Drop the language tag, e.g. ```json
+	if i := strings.IndexByte(inner, '\n'); i >= 0 && !strings.ContainsAny(inner[:i], "{[\"") {
+		inner = inner[i+1:]
+	}
+	return strings.TrimSpace(inner)
+}
+
+// formatInstructions tells the model in words what response_format would
+// have enforced
+func formatInstructions(format *ResponseFormat) string {
+	switch format.Type {
+	case "json_object":
+		return "Respond with a single JSON object only, without any other text or code fences."
+	case "json_schema":
+		return fmt.Sprintf("Respond with a single JSON value only, without any other text or code fences. It must be valid against this JSON Schema:\n%s", format.JSONSchema.Schema)
+	case "regex":
+		return fmt.Sprintf("Respond with text matching this regular expression exactly, without any other text: %s", format.Pattern)
+	case "xml":
+		text := "Respond with a single well-formed XML document only, without any other text or code fences."
+		if format.Root != "" {
+			text += fmt.Sprintf(" Its root element must be <%s>.", format.Root)
+		}
+		return text
+	case "yaml":
+		text := "Respond with a single YAML document only, without any other text or code fences. Use block style and quote strings that could be mistaken for numbers, booleans or null."
+		if format.JSONSchema != nil && len(format.JSONSchema.Schema) > 0 {
+			text += fmt.Sprintf(" Read as JSON, it must be valid against this JSON Schema:\n%s", format.JSONSchema.Schema)
+		}
+		return text
+	}
+	return ""
+}
+
+// createCompletion sends req upstream. When it asks for a response format
+// the proxy enforces, each reply is validated and the model is asked again
+// with the validation error, up to the configured number of retries; the
+// usage of every attempt is added up. A reply still invalid after the last
+// retry is returned with the error in its metadata, a valid XML or YAML one
+// with its parsed form in the message. Retries are recorded on the timeline
+// of the request in ctx.
+func (s *ProxyServer) createCompletion(ctx context.Context, req ChatCompletionRequest) (*ChatCompletionResponse, error) {
+	format := req.ResponseFormat
+	emulate := format != nil && (s.structuredOutput == StructuredOutputEmulate || proxyOnlyFormat(format))
+	if format == nil || (s.structuredOutput == StructuredOutputNative && !emulate) {
+		return s.chatCompletion(ctx, req)
+	}
+	check, err := newOutputCheck(format)
+	if err != nil {
+		return nil, err
+	}
+	if check == nil {
+		return s.chatCompletion(ctx, req)
+	}
+	if emulate {
+		req.ResponseFormat = nil
+		req.Messages = append(append([]Message(nil), req.Messages...), Message{Role: "system", Content: formatInstructions(format)})
+	}
+
+	var usage Usage
+	for attempt := 0; ; attempt++ {
+		resp, err := s.chatCompletion(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		usage.PromptTokens += resp.Usage.PromptTokens
+		usage.CompletionTokens += resp.Usage.CompletionTokens
+		usage.TotalTokens += resp.Usage.TotalTokens
+		if len(resp.Choices) == 0 {
+			return resp, nil
+		}
+
+		reply := resp.Choices[0].Message.Content
+		content, parsed, checkErr := check(reply)
+		if checkErr == nil || attempt == s.outputRetries {
+			out := *resp
+			out.Usage = usage
+			out.Choices = append([]Choice(nil), resp.Choices...)
+			out.Choices[0].Message.Content = content
+			if checkErr == nil {
+				out.Choices[0].Message.Parsed = parsed
+			}
+			out.Metadata = &ResponseMetadata{OutputRetries: attempt}
+			if checkErr != nil {
+				out.Metadata.OutputError = checkErr.Error()
+			}
+			return &out, nil
+		}
+		timelineFromContext(ctx).Addf(TimelineRetried, "invalid structured output: %v", checkErr)
+		req.Messages = append(append([]Message(nil), req.Messages...),
+			Message{Role: "assistant", Content: reply},
+			Message{Role: "user", Content: fmt.Sprintf("Your reply is invalid: %v. Reply again with the corrected answer only.", checkErr)},
+		)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// Mock client answering with one reply after the other
+type scriptedOpenAIClient struct {
+	replies  []string
+	requests []ChatCompletionRequest
+}
+
+func (m *scriptedOpenAIClient) CreateChatCompletion(req ChatCompletionRequest) (*ChatCompletionResponse, error) {
+	m.requests = append(m.requests, req)
+	reply := m.replies[min(len(m.requests), len(m.replies))-1]
+	resp := createTestChatCompletionResponse()
+	resp.Choices[0].Message.Content = reply
+	return resp, nil
+}
+
+const personSchemaRequest = `{"model": "gpt-4o", "messages": [{"role": "user", "content": "Who?"}],
+	"response_format": {"type": "json_schema", "json_schema": {"name": "person", "schema": {"type": "object", "properties": {"name": {"type": "string"}}, "required": ["name"]}}}}`
+
+func TestProxyServer_StructuredOutputRetry(t *testing.T) {
+	client := &scriptedOpenAIClient{replies: []string{`{"nom": "Ann"}`, "```json\n{\"name\": \"Ann\"}\n```"}}
+	server := NewProxyServer(client)
+	server.structuredOutput = StructuredOutputCheck
+
+	w := chatRequestAs(server, nil, personSchemaRequest)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var resp ChatCompletionResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Choices[0].Message.Content != `{"name": "Ann"}` {
+		t.Errorf("Expected the fenced JSON to be unwrapped, got %q", resp.Choices[0].Message.Content)
+	}
+	if resp.Metadata == nil || resp.Metadata.OutputRetries != 1 || resp.Metadata.OutputError != "" {
+		t.Errorf("Expected one retry in the metadata, got %+v", resp.Metadata)
+	}
+	if resp.Usage.TotalTokens != 64 {
+		t.Errorf("Expected the usage of both attempts, got %d", resp.Usage.TotalTokens)
+	}
+
+	if len(client.requests) != 2 {
+		t.Fatalf("Expected two upstream requests, got %d", len(client.requests))
+	}
+	if client.requests[0].ResponseFormat == nil {
+		t.Error("Expected response_format to be forwarded in check mode")
+	}
+	retry := client.requests[1].Messages
+	if len(retry) != 3 || retry[1].Content != `{"nom": "Ann"}` || !strings.Contains(retry[2].Content, `missing the required property "name"`) {
+		t.Errorf("Expected the retry to quote the validation error, got %+v", retry)
+	}
+}
+
+func TestProxyServer_StructuredOutputEmulate(t *testing.T) {
+	client := &scriptedOpenAIClient{replies: []string{"not json"}}
+	server := NewProxyServer(client)
+	server.structuredOutput = StructuredOutputEmulate
+	server.outputRetries = 1
+
+	w := chatRequestAs(server, nil, personSchemaRequest)
+	var resp ChatCompletionResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Metadata == nil || resp.Metadata.OutputRetries != 1 || !strings.Contains(resp.Metadata.OutputError, "not valid JSON") {
+		t.Errorf("Expected the final error in the metadata, got %+v", resp.Metadata)
+	}
+	first := client.requests[0]
+	if first.ResponseFormat != nil {
+		t.Error("Expected response_format to be removed in emulate mode")
+	}
+	if last := first.Messages[len(first.Messages)-1]; last.Role != "system" || !strings.Contains(last.Content, `"required": ["name"]`) {
+		t.Errorf("Expected the schema in the instructions, got %+v", last)
+	}
+}
+
+func TestProxyServer_StructuredOutputRegex(t *testing.T) {
+	client := &scriptedOpenAIClient{replies: []string{"Maybe", " yes "}}
+	server := NewProxyServer(client)
+
+	w := chatRequestAs(server, nil, `{"model": "gpt-4o", "messages": [{"role": "user", "content": "Ok?"}], "response_format": {"type": "regex", "pattern": "yes|no"}}`)
+	var resp ChatCompletionResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Choices[0].Message.Content != "yes" || resp.Metadata.OutputRetries != 1 {
+		t.Errorf("Expected a matching reply after one retry, got %q, %+v", resp.Choices[0].Message.Content, resp.Metadata)
+	}
+	if client.requests[0].ResponseFormat != nil {
+		t.Error("Expected the regex format never to be sent upstream")
+	}
+}
+
+func TestProxyServer_StructuredOutputNative(t *testing.T) {
+	client := &scriptedOpenAIClient{replies: []string{"anything"}}
+	server := NewProxyServer(client)
+	chatRequestAs(server, nil, personSchemaRequest)
+	if len(client.requests) != 1 || client.requests[0].ResponseFormat == nil {
+		t.Errorf("Expected a single forwarded request, got %+v", client.requests)
+	}
+
+	mock := &rawMockOpenAIClient{MockOpenAIClient: MockOpenAIClient{response: createTestChatCompletionResponse()}}
+	server = NewProxyServer(mock)
+	chatRequestAs(server, nil, personSchemaRequest)
+	if mock.lastRaw == nil {
+		t.Error("Expected native mode to keep the passthrough path")
+	}
+
+	server = NewProxyServer(client)
+	for _, format := range []string{`{"type": "json_schema"}`, `{"type": "regex", "pattern": "("}`, `{"type": "toml"}`, `{"type": "xml", "json_schema": {"name": "x"}}`} {
+		w := chatRequestAs(server, nil, `{"model": "gpt-4o", "messages": [{"role": "user", "content": "Hi"}], "response_format": `+format+`}`)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status code %d for %s, got %d", http.StatusBadRequest, format, w.Code)
+		}
+	}
+}
+
+func TestStripCodeFence(t *testing.T) {
+	tests := map[string]string{
+		"```json\n{\"a\": 1}\n```": `{"a": 1}`,
+		"```\n[1]\n```":            "[1]",
+		"```{\"a\": 1}```":         `{"a": 1}`,
+		"  {\"a\": 1}  ":           `{"a": 1}`,
+	}
+	for in, want := range tests {
+		if got := stripCodeFence(in); got != want {
+			t.Errorf("stripCodeFence(%q): expected %q, got %q", in, want, got)
+		}
+	}
+}
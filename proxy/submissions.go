@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A UI bug or an impatient double-click can send the same request twice in
+// quick succession and pay for it twice. A request whose key, path and body
+// match one still in flight, or one answered successfully within the
+// window, is collapsed into it: it waits for the first one and gets the
+// same reply, without going upstream. Clients that do mean to send the same
+// request twice, e.g. for two samples, opt out with X-Allow-Duplicate.
+
+const (
+	allowDuplicateHeader = "X-Allow-Duplicate"
+	duplicateOfHeader    = "X-Duplicate-Of"
+)
+
+// submission is a request others identical to it can be collapsed into
+type submission struct {
+	requestID string
+	done      chan struct{}
+
+	// The reply, complete once done is closed
+	status int
+	header http.Header
+	body   bytes.Buffer
+}
+
+// submissionGuard remembers the latest submissions by key, path and body
+type submissionGuard struct {
+	window time.Duration
+
+	mu     sync.Mutex
+	recent map[string]*submission
+}
+
+func newSubmissionGuard(window time.Duration) *submissionGuard {
+	return &submissionGuard{window: window, recent: make(map[string]*submission)}
+}
+
+// begin returns the submission to collapse a request with id into, or
+// registers the request as a new one when first is true
+func (g *submissionGuard) begin(fingerprint, id string) (sub *submission, first bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if sub, ok := g.recent[fingerprint]; ok {
+		return sub, false
+	}
+	sub = &submission{requestID: id, done: make(chan struct{})}
+	g.recent[fingerprint] = sub
+	return sub, true
+}
+
+// finish publishes the reply of a submission. Successful ones are kept for
+// the window; a failed one is forgotten at once, so retrying it works.
+func (g *submissionGuard) finish(fingerprint string, sub *submission) {
+	close(sub.done)
+	forget := func() {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		if g.recent[fingerprint] == sub {
+			delete(g.recent, fingerprint)
+		}
+	}
+	if sub.status < 200 || sub.status >= 300 {
+		forget()
+		return
+	}
+	time.AfterFunc(g.window, forget)
+}
+
+// submissionRecorder copies the reply of a submission as it is written
+type submissionRecorder struct {
+	http.ResponseWriter
+	sub *submission
+}
+
+func (w *submissionRecorder) WriteHeader(status int) {
+	if w.sub.status == 0 {
+		w.sub.status = status
+		w.sub.header = w.Header().Clone()
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *submissionRecorder) Write(b []byte) (int, error) {
+	if w.sub.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.sub.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *submissionRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// withDuplicateGuard collapses duplicate submissions of an authenticated
+// key. It must run inside withAuth.
+func (s *ProxyServer) withDuplicateGuard(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := clientKeyFromContext(r.Context())
+		if s.submissions == nil || key == nil || strings.EqualFold(r.Header.Get(allowDuplicateHeader), "true") {
+			next(w, r)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+
+		h := sha256.New()
+		fmt.Fprintf(h, "%s\x00%s\x00", key.ID, r.URL.Path)
+		h.Write(body)
+		fingerprint := hex.EncodeToString(h.Sum(nil))
+
+		timeline := timelineFromContext(r.Context())
+		sub, first := s.submissions.begin(fingerprint, timeline.id())
+		if first {
+			rec := &submissionRecorder{ResponseWriter: w, sub: sub}
+			defer func() {
+				if sub.status == 0 {
+					sub.status = http.StatusOK
+				}
+				s.submissions.finish(fingerprint, sub)
+			}()
+			next(rec, r)
+			return
+		}
+
+		select {
+		case <-sub.done:
+		case <-r.Context().Done():
+			return
+		}
+		timeline.Add(TimelineCollapsed, sub.requestID)
+		for name, values := range sub.header {
+			if name != requestIDHeader {
+				w.Header()[name] = values
+			}
+		}
+		if sub.requestID != "" {
+			w.Header().Set(duplicateOfHeader, sub.requestID)
+		}
+		w.WriteHeader(sub.status)
+		w.Write(sub.body.Bytes())
+	}
+}
+
+// submissionGuardFromEnv configures the window of PROXY_DUPLICATE_WINDOW,
+// 2s by default. A window of 0 disables the guard.
+func submissionGuardFromEnv(getenv func(string) string) (*submissionGuard, error) {
+	window := 2 * time.Second
+	if v := getenv("PROXY_DUPLICATE_WINDOW"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid PROXY_DUPLICATE_WINDOW %q", v)
+		}
+		window = d
+	}
+	if window == 0 {
+		return nil, nil
+	}
+	return newSubmissionGuard(window), nil
+}
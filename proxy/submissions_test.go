@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// gatedOpenAIClient holds every request until release is closed
+type gatedOpenAIClient struct {
+	MockOpenAIClient
+	calls   atomic.Int32
+	release chan struct{}
+}
+
+func (m *gatedOpenAIClient) CreateChatCompletion(req ChatCompletionRequest) (*ChatCompletionResponse, error) {
+	m.calls.Add(1)
+	<-m.release
+	return m.MockOpenAIClient.CreateChatCompletion(req)
+}
+
+func newSubmissionTestServer(t *testing.T, client OpenAIClient) http.Handler {
+	t.Helper()
+	server := NewProxyServer(client)
+	store, _ := NewKeyStore([]ClientKey{{ID: "app", Key: "sk-app"}, {ID: "other", Key: "sk-other"}})
+	server.keys = store
+	return server.Handler()
+}
+
+func submit(handler http.Handler, token string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "gpt-4o", "messages": [{"role": "user", "content": "Buy now"}]}`))
+	req.Header.Set("Authorization", "Bearer "+token)
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func TestProxyServer_CollapsesDuplicateSubmissions(t *testing.T) {
+	client := &gatedOpenAIClient{MockOpenAIClient: MockOpenAIClient{response: createTestChatCompletionResponse()}, release: make(chan struct{})}
+	handler := newSubmissionTestServer(t, client)
+
+	var wg sync.WaitGroup
+	replies := make([]*httptest.ResponseRecorder, 3)
+	for i, token := range []string{"sk-app", "sk-app", "sk-other"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			replies[i] = submit(handler, token, nil)
+		}()
+		// Let the first request get in flight before its duplicate
+		time.Sleep(20 * time.Millisecond)
+	}
+	close(client.release)
+	wg.Wait()
+
+	if n := client.calls.Load(); n != 2 {
+		t.Errorf("Expected one upstream call per key, got %d", n)
+	}
+	for i, w := range replies {
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "chatcmpl") {
+			t.Errorf("Reply %d: unexpected %d %s", i, w.Code, w.Body.String())
+		}
+	}
+	if original := replies[0].Header().Get(requestIDHeader); replies[1].Header().Get(duplicateOfHeader) != original {
+		t.Errorf("Expected the duplicate to name %s, got %q", original, replies[1].Header().Get(duplicateOfHeader))
+	}
+
+	// Right after, the reply is still served; opting out goes upstream
+	if w := submit(handler, "sk-app", nil); w.Header().Get(duplicateOfHeader) == "" {
+		t.Error("Expected a duplicate within the window to be collapsed")
+	}
+	submit(handler, "sk-app", map[string]string{allowDuplicateHeader: "true"})
+	if n := client.calls.Load(); n != 3 {
+		t.Errorf("Expected the opted out request to go upstream, got %d calls", n)
+	}
+}
+
+func TestProxyServer_DuplicateOfFailedSubmission(t *testing.T) {
+	client := &MockOpenAIClient{shouldError: true, error: errors.New("upstream unavailable")}
+	handler := newSubmissionTestServer(t, client)
+	submit(handler, "sk-app", nil)
+	client.shouldError, client.response = false, createTestChatCompletionResponse()
+	if w := submit(handler, "sk-app", nil); w.Code != http.StatusOK || w.Header().Get(duplicateOfHeader) != "" {
+		t.Errorf("Expected a retry of a failed request to go upstream, got %d", w.Code)
+	}
+}
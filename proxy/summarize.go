@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Summarization limits. Chunk sizes are in bytes; a document cut into more
+// than summarizeMaxChunks chunks is refused rather than run up a bill.
+const (
+	summarizeChunkSize   = 12000
+	summarizeMinChunk    = 500
+	summarizeMaxChunks   = 256
+	summarizeMaxPasses   = 8
+	summarizeConcurrency = 8
+)
+
+// SummarizeRequest is the body of /v1/summarize
+type SummarizeRequest struct {
+	// Model writes the final summary
+	Model    string `json:"model"`
+	Document string `json:"document"`
+	// ChunkModel summarizes the chunks, by default PROXY_SUMMARIZE_CHUNK_MODEL
+	// or else Model. A small, cheap model is usually enough.
+	ChunkModel string `json:"chunk_model,omitempty"`
+	// ChunkSize is the size chunks are cut to, in bytes (default 12000)
+	ChunkSize int `json:"chunk_size,omitempty"`
+	// Instructions are added to every prompt, e.g. the focus or length of
+	// the summary
+	Instructions string `json:"instructions,omitempty"`
+	MaxTokens    *int   `json:"max_tokens,omitempty"`
+}
+
+type SummarizeResponse struct {
+	Model   string `json:"model"`
+	Summary string `json:"summary"`
+	// Chunks is how many chunks the document was cut into, and Passes how
+	// many rounds of merging their summaries took
+	Chunks int   `json:"chunks"`
+	Passes int   `json:"passes"`
+	Usage  Usage `json:"usage"`
+}
+
+const (
+	summarizeChunkPrompt = "Summarize the following part of a longer document. Keep the facts, figures, names and conclusions that matter, and do not mention that the text is only a part."
+	summarizeMergePrompt = "The following are summaries of consecutive parts of one document, in order. Merge them into one summary of the whole document, without repeating yourself or mentioning the parts."
+	summarizeWholePrompt = "Summarize the following document."
+)
+
+// summarizer runs the upstream calls of one summarization. Every call is
+// charged to key like a chat completion of its model, so the chunks are
+// priced as the cheap model's.
+type summarizer struct {
+	s *ProxyServer
+	// ctx is that of the request, so its upstream key is used and the
+	// calls are abandoned with it
+	ctx    context.Context
+	key    *ClientKey
+	tenant string
+	req    SummarizeRequest
+
+	mu    sync.Mutex
+	usage Usage
+}
+
+// complete summarizes text with model and the given instructions
+func (sm *summarizer) complete(model, system, text string) (string, error) {
+	if sm.req.Instructions != "" {
+		system += "\n\n" + sm.req.Instructions
+	}
+	temperature := 0.0
+	req := ChatCompletionRequest{
+		Model:       model,
+		Messages:    []Message{{Role: "system", Content: system}, {Role: "user", Content: text}},
+		Temperature: &temperature,
+		MaxTokens:   sm.req.MaxTokens,
+	}
+	if err := sm.s.expandModel(&req, sm.tenant, "summarize"); err != nil {
+		return "", err
+	}
+
+	event := newUsageEvent(sm.key, "summarize", req.Model)
+	resp, err := sm.s.chatCompletion(sm.ctx, req)
+	event.LatencyMS = time.Since(event.Time).Milliseconds()
+	if err != nil {
+		event.Status = http.StatusInternalServerError
+		sm.s.recordUsage(event)
+		return "", fmt.Errorf("completion failed: %w", err)
+	}
+	sm.s.recordCompletion(sm.key, event, resp.Usage)
+	sm.mu.Lock()
+	sm.usage.PromptTokens += resp.Usage.PromptTokens
+	sm.usage.CompletionTokens += resp.Usage.CompletionTokens
+	sm.usage.TotalTokens += resp.Usage.TotalTokens
+	sm.mu.Unlock()
+	if len(resp.Choices) == 0 {
+		return "", fmt.Errorf("upstream returned no choices")
+	}
+	return strings.TrimSpace(resp.Choices[0].Message.Content), nil
+}
+
+// completeAll summarizes texts in parallel, keeping their order
+func (sm *summarizer) completeAll(model, system string, texts []string) ([]string, error) {
+	out := make([]string, len(texts))
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	sem := make(chan struct{}, summarizeConcurrency)
+	for i, text := range texts {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			summary, err := sm.complete(model, system, text)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+			out[i] = summary
+		}()
+	}
+	wg.Wait()
+	return out, firstErr
+}
+
+// summarize maps the chunks to summaries with the chunk model, then merges
+// them with the final model. Summaries that do not fit in one chunk together
+// are merged in groups first, for as many rounds as it takes.
+func (sm *summarizer) summarize(chunks []string, chunkSize int) (*SummarizeResponse, error) {
+	resp := &SummarizeResponse{Model: sm.req.Model, Chunks: len(chunks)}
+	if len(chunks) == 1 {
+		summary, err := sm.complete(sm.req.Model, summarizeWholePrompt, chunks[0])
+		resp.Summary = summary
+		return resp, err
+	}
+
+	summaries, err := sm.completeAll(sm.req.ChunkModel, summarizeChunkPrompt, chunks)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		resp.Passes++
+		merged := strings.Join(summaries, "\n\n")
+		if len(merged) <= chunkSize || len(summaries) == 1 {
+			summary, err := sm.complete(sm.req.Model, summarizeMergePrompt, merged)
+			resp.Summary = summary
+			return resp, err
+		}
+		if resp.Passes > summarizeMaxPasses {
+			return nil, fmt.Errorf("summaries do not get shorter, use a larger chunk_size")
+		}
+		groups := splitText(merged, chunkSize)
+		if len(groups) >= len(summaries) {
+			// Every summary is about a chunk long on its own, so they are
+			// shortened one by one
+			groups = summaries
+		}
+		if summaries, err = sm.completeAll(sm.req.ChunkModel, summarizeMergePrompt, groups); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (s *ProxyServer) handleSummarize(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	buf, err := readBody(r.Body, r.ContentLength)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+	defer putBuffer(buf)
+
+	var req SummarizeRequest
+	if err := json.Unmarshal(buf.Bytes(), &req); err != nil {
+		http.Error(w, "Invalid JSON in request body", http.StatusBadRequest)
+		return
+	}
+	if req.Model == "" {
+		http.Error(w, "Model field is required", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(req.Document) == "" {
+		http.Error(w, "Document field is required", http.StatusBadRequest)
+		return
+	}
+	chunkSize := req.ChunkSize
+	if chunkSize == 0 {
+		chunkSize = summarizeChunkSize
+	}
+	if chunkSize < summarizeMinChunk {
+		http.Error(w, fmt.Sprintf("chunk_size must be at least %d", summarizeMinChunk), http.StatusBadRequest)
+		return
+	}
+	chunks := splitText(req.Document, chunkSize)
+	if len(chunks) > summarizeMaxChunks {
+		http.Error(w, fmt.Sprintf("Document is too large: it would take more than %d chunks", summarizeMaxChunks), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if req.ChunkModel == "" {
+		req.ChunkModel = s.summarizeChunkModel
+	}
+	if req.ChunkModel == "" {
+		req.ChunkModel = req.Model
+	}
+	key := clientKeyFromContext(r.Context())
+	var tenant string
+	if key != nil {
+		tenant = key.Tenant
+		for _, model := range []string{req.Model, req.ChunkModel} {
+			if !key.AllowsModel(model) {
+				http.Error(w, fmt.Sprintf("API key is not allowed to use model %s", model), http.StatusForbidden)
+				return
+			}
+		}
+	}
+
+	sm := &summarizer{s: s, ctx: r.Context(), key: key, tenant: tenant, req: req}
+	resp, err := sm.summarize(chunks, chunkSize)
+	if err != nil {
+		log.Printf("Summarization failed: %v", err)
+		http.Error(w, fmt.Sprintf("Summarization failed: %v", err), expandModelStatus(err))
+		return
+	}
+	resp.Usage = sm.usage
+
+	out := getBuffer()
+	defer putBuffer(out)
+	if err := json.NewEncoder(out).Encode(resp); err != nil {
+		log.Printf("Failed to encode response: %v", err)
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(out.Bytes())
+}
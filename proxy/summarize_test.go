@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// summarizingClient answers the final model with "final" and every other
+// model with its reply, recording the requests
+type summarizingClient struct {
+	mu       sync.Mutex
+	reply    string
+	requests []ChatCompletionRequest
+}
+
+func (m *summarizingClient) CreateChatCompletion(req ChatCompletionRequest) (*ChatCompletionResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests = append(m.requests, req)
+	resp := *createTestChatCompletionResponse()
+	resp.Choices = append([]Choice(nil), resp.Choices...)
+	resp.Choices[0].Message.Content = m.reply
+	if req.Model == "gpt-4o" {
+		resp.Choices[0].Message.Content = " final\n"
+	}
+	return &resp, nil
+}
+
+// callsTo counts the requests for model
+func (m *summarizingClient) callsTo(model string) int {
+	n := 0
+	for _, req := range m.requests {
+		if req.Model == model {
+			n++
+		}
+	}
+	return n
+}
+
+func summarizeAs(server *ProxyServer, key *ClientKey, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/v1/summarize", strings.NewReader(body))
+	if key != nil {
+		req = req.WithContext(context.WithValue(req.Context(), clientKeyContextKey, key))
+	}
+	w := httptest.NewRecorder()
+	server.handleSummarize(w, req)
+	return w
+}
+
+// summarizeBody asks to summarize n paragraphs of about 600 bytes in
+// chunks of 1000
+func summarizeBody(n int, extra string) string {
+	paragraphs := make([]string, n)
+	for i := range paragraphs {
+		paragraphs[i] = strings.Repeat("All work and no play. ", 27)
+	}
+	document, _ := json.Marshal(strings.Join(paragraphs, "\n\n"))
+	return `{"model": "gpt-4o", "chunk_model": "gpt-4o-mini", "chunk_size": 1000, "document": ` + string(document) + extra + `}`
+}
+
+func TestProxyServer_Summarize(t *testing.T) {
+	client := &summarizingClient{reply: "A summary."}
+	server := NewProxyServer(client)
+
+	w := summarizeAs(server, nil, summarizeBody(5, `, "instructions": "Be brief."`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var resp SummarizeResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Summary != "final" || resp.Chunks != 5 || resp.Passes != 1 {
+		t.Errorf("Expected one merge of five chunk summaries, got %+v", resp)
+	}
+	if client.callsTo("gpt-4o-mini") != 5 || client.callsTo("gpt-4o") != 1 {
+		t.Errorf("Expected the chunks to go to the chunk model, got %d requests", len(client.requests))
+	}
+	final := client.requests[len(client.requests)-1]
+	if final.Model != "gpt-4o" || strings.Count(final.Messages[1].Content, "A summary.") != 5 {
+		t.Errorf("Expected the summaries to be merged by the final model, got %+v", final)
+	}
+	for _, req := range client.requests {
+		if !strings.HasSuffix(req.Messages[0].Content, "\n\nBe brief.") {
+			t.Errorf("Expected the instructions in every prompt, got %q", req.Messages[0].Content)
+		}
+	}
+	if resp.Usage.TotalTokens != 6*32 {
+		t.Errorf("Expected the usage of all six calls, got %+v", resp.Usage)
+	}
+}
+
+func TestProxyServer_SummarizeSinglePass(t *testing.T) {
+	client := &summarizingClient{}
+	server := NewProxyServer(client)
+
+	w := summarizeAs(server, nil, `{"model": "gpt-4o", "document": "A short note."}`)
+	var resp SummarizeResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Summary != "final" || resp.Chunks != 1 || resp.Passes != 0 || len(client.requests) != 1 {
+		t.Errorf("Expected a single call to the final model, got %+v", resp)
+	}
+}
+
+func TestProxyServer_SummarizeMergesInRounds(t *testing.T) {
+	// Every summary is as long as half a chunk, so five of them take two
+	// rounds of merging before they fit
+	client := &summarizingClient{reply: strings.Repeat("Summary. ", 50)}
+	server := NewProxyServer(client)
+	server.summarizeChunkModel = "gpt-4o-mini"
+
+	w := summarizeAs(server, nil, strings.Replace(summarizeBody(5, ""), `"chunk_model": "gpt-4o-mini", `, "", 1))
+	var resp SummarizeResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Summary != "final" || resp.Passes != 3 {
+		t.Fatalf("Expected three passes, got %+v", resp)
+	}
+	if client.callsTo("gpt-4o-mini") != 5+3+2 || client.callsTo("gpt-4o") != 1 {
+		t.Errorf("Expected the default chunk model to merge the groups, got %d requests", len(client.requests))
+	}
+}
+
+func TestProxyServer_SummarizeErrors(t *testing.T) {
+	server := NewProxyServer(&summarizingClient{})
+	for body, status := range map[string]int{
+		`{"document": "x"}`:                                      http.StatusBadRequest,
+		`{"model": "gpt-4o", "document": " "}`:                   http.StatusBadRequest,
+		`{"model": "gpt-4o", "document": "x", "chunk_size": 10}`: http.StatusBadRequest,
+		`{"model": "gpt-4o", "document": "` + strings.Repeat("x", 501*summarizeMaxChunks) + `", "chunk_size": 500}`: http.StatusRequestEntityTooLarge,
+	} {
+		if w := summarizeAs(server, nil, body); w.Code != status {
+			t.Errorf("Expected status code %d, got %d: %s", status, w.Code, w.Body.String())
+		}
+	}
+
+	key := &ClientKey{ID: "app", Scopes: KeyScopes{Models: []string{"gpt-4o"}}}
+	if w := summarizeAs(server, key, summarizeBody(2, "")); w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "gpt-4o-mini") {
+		t.Errorf("Expected the chunk model to need the key's scope, got %d: %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// GET /admin/tail streams a line for every request to a model as it
+// finishes, like kubectl logs -f for the traffic of the proxy: who sent it,
+// the model, the status, the latency and the tokens. The feed never carries
+// bodies or client addresses, so it is safe to watch over a shoulder. It
+// only sees the requests of the replica it is connected to.
+
+const (
+	// tailBuffer is how many events a slow client can fall behind before
+	// events are dropped for it
+	tailBuffer = 256
+	// tailKeepAlive is how often an idle feed sends a comment, so proxies
+	// in between do not close it
+	tailKeepAlive = 15 * time.Second
+)
+
+// TailEvent is a request in the live feed
+type TailEvent struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id,omitempty"`
+	KeyID     string    `json:"key_id,omitempty"`
+	Tenant    string    `json:"tenant,omitempty"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Model     string    `json:"model,omitempty"`
+	Status    int       `json:"status"`
+	LatencyMS int64     `json:"latency_ms"`
+	Usage     Usage     `json:"usage"`
+}
+
+// tailEventFrom returns the event of an audit record, leaving out what the
+// feed does not show
+func tailEventFrom(rec AuditRecord) TailEvent {
+	return TailEvent{
+		Time:      rec.Time,
+		RequestID: rec.RequestID,
+		KeyID:     rec.KeyID,
+		Tenant:    rec.Tenant,
+		Method:    rec.Method,
+		Path:      rec.Path,
+		Model:     rec.Model,
+		Status:    rec.Status,
+		LatencyMS: rec.LatencyMS,
+		Usage:     rec.Usage,
+	}
+}
+
+// tailSubscriber is a client of the feed
+type tailSubscriber struct {
+	tenant, model string
+	events        chan TailEvent
+	// dropped counts the events the client was too slow for
+	dropped int
+}
+
+// requestTail passes events to the clients watching the feed
+type requestTail struct {
+	mu          sync.Mutex
+	subscribers map[*tailSubscriber]bool
+	// done is closed when the server drains, ending every feed
+	done chan struct{}
+	once sync.Once
+}
+
+func newRequestTail() *requestTail {
+	return &requestTail{subscribers: map[*tailSubscriber]bool{}, done: make(chan struct{})}
+}
+
+// Active reports whether anyone is watching, so requests are only recorded
+// for the feed when someone is
+func (t *requestTail) Active() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.subscribers) > 0
+}
+
+// Publish passes the event to the clients it matches, dropping it for
+// those that are behind rather than waiting for them
+func (t *requestTail) Publish(event TailEvent) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for sub := range t.subscribers {
+		if (sub.tenant != "" && sub.tenant != event.Tenant) || (sub.model != "" && sub.model != event.Model) {
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default:
+			sub.dropped++
+		}
+	}
+}
+
+func (t *requestTail) subscribe(tenant, model string) *tailSubscriber {
+	sub := &tailSubscriber{tenant: tenant, model: model, events: make(chan TailEvent, tailBuffer)}
+	t.mu.Lock()
+	t.subscribers[sub] = true
+	t.mu.Unlock()
+	return sub
+}
+
+func (t *requestTail) unsubscribe(sub *tailSubscriber) {
+	t.mu.Lock()
+	delete(t.subscribers, sub)
+	t.mu.Unlock()
+}
+
+// takeDropped returns and resets the events the subscriber missed
+func (t *requestTail) takeDropped(sub *tailSubscriber) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := sub.dropped
+	sub.dropped = 0
+	return n
+}
+
+// Close ends every feed, for the server to drain
+func (t *requestTail) Close() {
+	t.once.Do(func() { close(t.done) })
+}
+
+// handleAdminTail streams the requests of ?tenant= and ?model=, or all of
+// them, as server-sent events until the client disconnects
+func (s *ProxyServer) handleAdminTail(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	sub := s.tail.subscribe(query.Get("tenant"), query.Get("model"))
+	defer s.tail.unsubscribe(sub)
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	rc.Flush()
+	keepAlive := time.NewTicker(tailKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case event := <-sub.events:
+			if n := s.tail.takeDropped(sub); n > 0 {
+				fmt.Fprintf(w, "event: dropped\ndata: {\"count\":%d}\n\n", n)
+			}
+			data, _ := json.Marshal(event)
+			fmt.Fprintf(w, "event: request\ndata: %s\n\n", data)
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			return
+		case <-s.tail.done:
+			return
+		}
+		if rc.Flush() != nil {
+			return
+		}
+	}
+}
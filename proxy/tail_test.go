@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequestTail_Publish(t *testing.T) {
+	tail := newRequestTail()
+	if tail.Active() {
+		t.Error("Expected no one to watch a new feed")
+	}
+	all := tail.subscribe("", "")
+	acme := tail.subscribe("acme", "")
+	if !tail.Active() {
+		t.Error("Expected the feed to be watched")
+	}
+	tail.Publish(TailEvent{Tenant: "globex", Model: "gpt-4o"})
+	tail.Publish(TailEvent{Tenant: "acme", Model: "gpt-4o"})
+	if len(all.events) != 2 || len(acme.events) != 1 {
+		t.Errorf("Expected 2 events for all and 1 for acme, got %d and %d", len(all.events), len(acme.events))
+	}
+
+	// A client that falls behind misses events rather than holding up
+	// requests
+	for i := 0; i < tailBuffer+5; i++ {
+		tail.Publish(TailEvent{Tenant: "acme"})
+	}
+	if got := tail.takeDropped(acme); got != 6 {
+		t.Errorf("Expected 6 dropped events, got %d", got)
+	}
+	tail.unsubscribe(all)
+	tail.unsubscribe(acme)
+	if tail.Active() {
+		t.Error("Expected no one to watch the feed after unsubscribing")
+	}
+}
+
+func TestProxyServer_AdminTail(t *testing.T) {
+	server := NewProxyServer(&MockOpenAIClient{response: createTestChatCompletionResponse()})
+	server.keys = createTestKeyStore(t)
+	server.submissions = nil
+	ts := httptest.NewServer(server.Handler())
+	defer ts.Close()
+
+	req, _ := http.NewRequest("GET", ts.URL+"/admin/tail?model=gpt-4o-mini", nil)
+	req.Header.Set("Authorization", "Bearer sk-admin-ro")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Expected an event stream, got %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	for _, model := range []string{"gpt-4o", "gpt-4o-mini"} {
+		req, _ := http.NewRequest("POST", ts.URL+"/v1/chat/completions", strings.NewReader(`{"model": "`+model+`", "messages": [{"role": "user", "content": "My email is jane@example.com"}]}`))
+		req.Header.Set("Authorization", "Bearer sk-full")
+		r, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Body.Close()
+	}
+
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+	var event TailEvent
+	for event.Model == "" {
+		select {
+		case line := <-lines:
+			if data, ok := strings.CutPrefix(line, "data: "); ok {
+				if strings.Contains(data, "jane@example.com") {
+					t.Errorf("Expected no bodies in the feed, got %s", data)
+				}
+				json.Unmarshal([]byte(data), &event)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("Expected a request in the feed")
+		}
+	}
+	if event.Model != "gpt-4o-mini" || event.KeyID != "full" || event.Status != http.StatusOK || event.Usage.TotalTokens == 0 {
+		t.Errorf("Expected the gpt-4o-mini request of key full, got %+v", event)
+	}
+
+	// Draining ends the feed
+	server.tail.Close()
+	for range lines {
+	}
+}
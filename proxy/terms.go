@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Deployments with terms of use can require every key to be acknowledged
+// before it works. An admin generates a link for a key and hands it to its
+// owner, who reads the terms and accepts them on a page served by the
+// proxy; until then requests with the key are refused. Acknowledgements are
+// kept for compliance audits, and publishing a new terms version requires
+// every key to accept again.
+
+// termsLinkTTL is how long acknowledgement links work
+const termsLinkTTL = 7 * 24 * time.Hour
+
+// TermsAcknowledgement records that the owner of a key accepted a version
+// of the terms
+type TermsAcknowledgement struct {
+	KeyID      string    `json:"key_id"`
+	Tenant     string    `json:"tenant,omitempty"`
+	Version    string    `json:"version"`
+	AcceptedBy string    `json:"accepted_by"`
+	AcceptedAt time.Time `json:"accepted_at"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+}
+
+// termsGate enforces the acknowledgement of the current terms version
+type termsGate struct {
+	version string
+	text    string
+	// secret signs the acknowledgement links, so any replica can check them
+	secret []byte
+	// path is the file acknowledgements are appended to, if any
+	path string
+	// publicURL is where clients reach the proxy, for links
+	publicURL string
+
+	mu       sync.Mutex
+	records  []TermsAcknowledgement
+	accepted map[string]bool
+	// loaded is the size of the file when it was last read
+	loaded int64
+}
+
+// termsGateFromEnv enables the gate when PROXY_TERMS_VERSION is set. The
+// terms are read from PROXY_TERMS_FILE, links signed with
+// PROXY_TERMS_SECRET, random by default, and acknowledgements appended to
+// acknowledgements.jsonl in PROXY_TERMS_DIR.
+func termsGateFromEnv(getenv func(string) string) (*termsGate, error) {
+	version := getenv("PROXY_TERMS_VERSION")
+	if version == "" {
+		return nil, nil
+	}
+	path := getenv("PROXY_TERMS_FILE")
+	if path == "" {
+		return nil, fmt.Errorf("PROXY_TERMS_FILE is required with PROXY_TERMS_VERSION")
+	}
+	text, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read terms file: %w", err)
+	}
+	g := &termsGate{
+		version:   version,
+		text:      string(text),
+		secret:    []byte(getenv("PROXY_TERMS_SECRET")),
+		publicURL: strings.TrimSuffix(getenv("PROXY_PUBLIC_URL"), "/"),
+		accepted:  make(map[string]bool),
+	}
+	if len(g.secret) == 0 {
+		g.secret = make([]byte, 32)
+		rand.Read(g.secret)
+	}
+	if dir := getenv("PROXY_TERMS_DIR"); dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, fmt.Errorf("invalid PROXY_TERMS_DIR %q: %v", dir, err)
+		}
+		g.path = filepath.Join(dir, "acknowledgements.jsonl")
+		if err := g.reload(); err != nil {
+			return nil, err
+		}
+	}
+	return g, nil
+}
+
+// reload reads the acknowledgements other replicas appended to the file
+// since it was last read. The caller holds g.mu, or no one else has g yet.
+func (g *termsGate) reload() error {
+	info, err := os.Stat(g.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil || info.Size() == g.loaded {
+		return err
+	}
+	data, err := os.ReadFile(g.path)
+	if err != nil {
+		return fmt.Errorf("failed to read acknowledgements: %w", err)
+	}
+	var records []TermsAcknowledgement
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		var record TermsAcknowledgement
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return fmt.Errorf("failed to parse acknowledgements: %w", err)
+		}
+		records = append(records, record)
+	}
+	g.records = records
+	g.accepted = make(map[string]bool)
+	for _, record := range records {
+		if record.Version == g.version {
+			g.accepted[record.KeyID] = true
+		}
+	}
+	g.loaded = int64(len(data))
+	return nil
+}
+
+// Allows reports whether key may be used. Admin keys are exempt so they can
+// hand out links, and temporary tokens count as their parent.
+func (g *termsGate) Allows(key *ClientKey) bool {
+	if g == nil || key.Scopes.Admin != AdminNone {
+		return true
+	}
+	id := key.ID
+	if key.Parent != "" {
+		id = key.Parent
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.accepted[id] && g.path != "" {
+		if err := g.reload(); err != nil {
+			log.Print(err)
+		}
+	}
+	return g.accepted[id]
+}
+
+// Accept records an acknowledgement
+func (g *termsGate) Accept(record TermsAcknowledgement) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.path != "" {
+		data, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		f, err := os.OpenFile(g.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(append(data, '\n'))
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+		g.loaded += int64(len(data) + 1)
+	}
+	g.records = append(g.records, record)
+	if record.Version == g.version {
+		g.accepted[record.KeyID] = true
+	}
+	return nil
+}
+
+// List returns the acknowledgements of every version, oldest first
+func (g *termsGate) List() []TermsAcknowledgement {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.path != "" {
+		if err := g.reload(); err != nil {
+			log.Print(err)
+		}
+	}
+	return append([]TermsAcknowledgement{}, g.records...)
+}
+
+// Link returns a signed token for the owner of key id to accept the
+// current version with, valid until expires
+func (g *termsGate) Link(id string, expires time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(id + "\n" + g.version + "\n" + strconv.FormatInt(expires.Unix(), 10)))
+	return payload + "." + g.sign(payload)
+}
+
+func (g *termsGate) sign(payload string) string {
+	mac := hmac.New(sha256.New, g.secret)
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verify returns the key ID of a link token that is valid for the current
+// version
+func (g *termsGate) verify(token string, now time.Time) (string, bool) {
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(g.sign(payload))) {
+		return "", false
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return "", false
+	}
+	parts := strings.Split(string(data), "\n")
+	if len(parts) != 3 || parts[1] != g.version {
+		return "", false
+	}
+	expires, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil || now.Unix() >= expires {
+		return "", false
+	}
+	return parts[0], true
+}
+
+// handleAdminTermsLink serves POST /admin/keys/{id}/terms-link
+func (s *ProxyServer) handleAdminTermsLink(w http.ResponseWriter, r *http.Request) {
+	key := s.keys.Get(r.PathValue("id"))
+	if key == nil || key.Parent != "" {
+		http.Error(w, "Key not found", http.StatusNotFound)
+		return
+	}
+	expires := time.Now().Add(termsLinkTTL).UTC()
+	base := s.terms.publicURL
+	if base == "" {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		base = scheme + "://" + r.Host
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"key_id":     key.ID,
+		"version":    s.terms.version,
+		"url":        base + "/terms/" + s.terms.Link(key.ID, expires),
+		"expires_at": expires,
+	})
+}
+
+var termsPage = template.Must(template.New("terms").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head><meta charset="utf-8"><title>Terms of use</title></head>
+<body style="font-family: sans-serif; max-width: 48em; margin: 2em auto">
+<h1>Terms of use, version {{.Version}}</h1>
+<pre style="white-space: pre-wrap">{{.Text}}</pre>
+{{if .Accepted}}<p><strong>Thank you. The terms are accepted for key {{.KeyID}}.</strong></p>
+{{else}}<form method="post">
+<p><label>Your name or email <input name="accepted_by" required></label></p>
+<p><label><input type="checkbox" name="accept" value="yes" required> I accept these terms for key {{.KeyID}}</label></p>
+<p><button type="submit">Accept</button></p>
+</form>{{end}}
+</body>
+</html>
+`))
+
+// handleTerms serves the acknowledgement page of a link: GET shows the
+// terms and POST accepts them
+func (s *ProxyServer) handleTerms(w http.ResponseWriter, r *http.Request) {
+	id, ok := s.terms.verify(r.PathValue("token"), time.Now())
+	key := s.keys.Get(id)
+	if !ok || key == nil {
+		http.Error(w, "This link is invalid or has expired", http.StatusNotFound)
+		return
+	}
+	page := struct {
+		Version, Text, KeyID string
+		Accepted             bool
+	}{Version: s.terms.version, Text: s.terms.text, KeyID: key.ID}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		acceptedBy := strings.TrimSpace(r.PostFormValue("accepted_by"))
+		if r.PostFormValue("accept") != "yes" || acceptedBy == "" {
+			http.Error(w, "Accepting the terms requires a name and the checkbox", http.StatusBadRequest)
+			return
+		}
+		record := TermsAcknowledgement{
+			KeyID:      key.ID,
+			Tenant:     key.Tenant,
+			Version:    s.terms.version,
+			AcceptedBy: acceptedBy,
+			AcceptedAt: time.Now().UTC(),
+			RemoteAddr: r.RemoteAddr,
+			UserAgent:  r.UserAgent(),
+		}
+		if err := s.terms.Accept(record); err != nil {
+			log.Printf("Failed to record terms acknowledgement of key %s: %v", key.ID, err)
+			http.Error(w, "Failed to record the acknowledgement", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Key %s accepted terms version %s", key.ID, s.terms.version)
+		page.Accepted = true
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; form-action 'self'; frame-ancestors 'none'")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	termsPage.Execute(w, page)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestTermsGate(t *testing.T, dir, version string) *termsGate {
+	t.Helper()
+	termsFile := filepath.Join(t.TempDir(), "terms.txt")
+	os.WriteFile(termsFile, []byte("Do not <script>misuse</script> the models."), 0o600)
+	env := map[string]string{
+		"PROXY_TERMS_VERSION": version,
+		"PROXY_TERMS_FILE":    termsFile,
+		"PROXY_TERMS_SECRET":  "secret",
+		"PROXY_TERMS_DIR":     dir,
+	}
+	g, err := termsGateFromEnv(func(name string) string { return env[name] })
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	return g
+}
+
+func TestTermsGate_AcknowledgementFlow(t *testing.T) {
+	dir := t.TempDir()
+	server := NewProxyServer(&MockOpenAIClient{response: createTestChatCompletionResponse()})
+	server.keys = createTestKeyStore(t)
+	server.terms = newTestTermsGate(t, dir, "2026-01")
+	handler := server.Handler()
+
+	chat := func() int {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "gpt-4o", "messages": [{"role": "user", "content": "Hi"}]}`))
+		req.Header.Set("Authorization", "Bearer sk-full")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+	if code := chat(); code != http.StatusForbidden {
+		t.Fatalf("Expected the key to be refused before accepting the terms, got %d", code)
+	}
+
+	req := httptest.NewRequest("POST", "/admin/keys/full/terms-link", nil)
+	req.Header.Set("Authorization", "Bearer sk-admin-rw")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	var link struct {
+		URL string `json:"url"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &link); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Expected a link, got %d %s", w.Code, w.Body.String())
+	}
+	u, _ := url.Parse(link.URL)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", u.Path, nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "&lt;script&gt;") {
+		t.Fatalf("Expected the escaped terms, got %d %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", u.Path+"x", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected a tampered link to be refused, got %d", w.Code)
+	}
+
+	form := url.Values{"accepted_by": {"alice@example.com"}, "accept": {"yes"}}
+	req = httptest.NewRequest("POST", u.Path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the terms to be accepted, got %d %s", w.Code, w.Body.String())
+	}
+	if code := chat(); code != http.StatusOK {
+		t.Errorf("Expected the key to work once the terms are accepted, got %d", code)
+	}
+
+	// Another replica sharing the directory sees the acknowledgement, and a
+	// new version has to be accepted again
+	replica := newTestTermsGate(t, dir, "2026-01")
+	if !replica.Allows(&ClientKey{ID: "full"}) || !replica.Allows(&ClientKey{ID: "full-tmp-1", Parent: "full"}) {
+		t.Error("Expected the key and its tokens to be allowed on another replica")
+	}
+	records := replica.List()
+	if len(records) != 1 || records[0].AcceptedBy != "alice@example.com" || records[0].Version != "2026-01" {
+		t.Errorf("Unexpected acknowledgements %+v", records)
+	}
+	updated := newTestTermsGate(t, dir, "2026-02")
+	if updated.Allows(&ClientKey{ID: "full"}) {
+		t.Error("Expected a new terms version to require a new acknowledgement")
+	}
+	if _, ok := updated.verify(strings.TrimPrefix(u.Path, "/terms/"), time.Now()); ok {
+		t.Error("Expected links of an older version to be refused")
+	}
+}
+
+func TestTermsGate_Verify(t *testing.T) {
+	g := newTestTermsGate(t, "", "v1")
+	now := time.Now()
+	token := g.Link("full", now.Add(time.Hour))
+	if id, ok := g.verify(token, now); !ok || id != "full" {
+		t.Errorf("Expected the link to be valid for full, got %q %v", id, ok)
+	}
+	if _, ok := g.verify(token, now.Add(2*time.Hour)); ok {
+		t.Error("Expected an expired link to be refused")
+	}
+	if !g.Allows(&ClientKey{ID: "ops", Scopes: KeyScopes{Admin: AdminRead}}) {
+		t.Error("Expected admin keys to be exempt")
+	}
+}
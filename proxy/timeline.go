@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Every request to the API gets an ID, taken from its X-Request-ID header
+// or generated, and echoed back in the reply. What the proxy does with the
+// request is recorded on a timeline under that ID, so a slow or failed
+// request can be replayed step by step from the admin API.
+
+// The events of a request timeline
+const (
+	TimelineReceived  = "received"
+	TimelineValidated = "validated"
+	TimelineRouted    = "routed"
+	TimelineRetried   = "retried"
+	// TimelineFirstToken is when the first event of a streamed reply
+	// arrived, and when the whole reply did for one that is not streamed
+	TimelineFirstToken = "first_token"
+	TimelineCompleted  = "completed"
+	// TimelineCancelled is when the request was cancelled through the API
+	TimelineCancelled = "cancelled"
+	// TimelineCollapsed is when a duplicate submission got the reply of the
+	// request in its detail
+	TimelineCollapsed = "collapsed"
+	// TimelinePaced is when the request of a batch tenant was held back for
+	// the wait in its detail
+	TimelinePaced = "paced"
+	// TimelineQueued is when the request got an upstream slot after waiting
+	// for the time in its detail
+	TimelineQueued = "queued"
+	// TimelineFailedOver is when the upstream of a model failed and the
+	// request was tried with the next model of its fallbacks
+	TimelineFailedOver = "failed_over"
+	// TimelineFiltered is when content filters matched the request, with
+	// what they did in the detail
+	TimelineFiltered = "filtered"
+	// TimelineRewritten is when rewrite rules or the default model changed
+	// the request, with what they changed in the detail
+	TimelineRewritten = "rewritten"
+	// TimelineDeprecated is when a deprecated model was replaced, with the
+	// model and its replacement in the detail
+	TimelineDeprecated = "deprecated"
+	// TimelineCanned is when a canned answer was served, named in the
+	// detail
+	TimelineCanned = "canned"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// clientRequestID matches the request IDs clients may choose; others are
+// replaced with a generated one
+var clientRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// TimelineEvent is one step in the handling of a request
+type TimelineEvent struct {
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+	// OffsetMS is the time since the request was received
+	OffsetMS float64 `json:"offset_ms"`
+	Detail   string  `json:"detail,omitempty"`
+}
+
+// RequestTimeline is the ordered events of one request. Status is 0 while
+// the request is in flight.
+type RequestTimeline struct {
+	RequestID string          `json:"request_id"`
+	Method    string          `json:"method"`
+	Path      string          `json:"path"`
+	KeyID     string          `json:"key_id,omitempty"`
+	Tenant    string          `json:"tenant,omitempty"`
+	Status    int             `json:"status,omitempty"`
+	Events    []TimelineEvent `json:"events"`
+}
+
+// requestTimeline records the timeline of a request in flight. Its methods
+// do nothing on a nil timeline, so handlers called outside the API, such as
+// by bridges and schedules, need not check for one.
+type requestTimeline struct {
+	mu       sync.Mutex
+	start    time.Time
+	timeline RequestTimeline
+	// attempts counts the upstream requests made, and retried is whether
+	// any of them was a retry
+	attempts int
+	retried  bool
+	// servedBy is the provider and model that served a request with
+	// fallbacks
+	servedBy string
+}
+
+func newRequestTimeline(id string, r *http.Request) *requestTimeline {
+	t := &requestTimeline{start: time.Now(), timeline: RequestTimeline{RequestID: id, Method: r.Method, Path: r.URL.Path}}
+	t.Add(TimelineReceived, "")
+	return t
+}
+
+// Add appends an event to the timeline
+func (t *requestTimeline) Add(event, detail string) {
+	if t == nil {
+		return
+	}
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.timeline.Events = append(t.timeline.Events, TimelineEvent{
+		Event:    event,
+		Time:     now.UTC(),
+		OffsetMS: float64(now.Sub(t.start).Microseconds()) / 1000,
+		Detail:   detail,
+	})
+}
+
+// Addf appends an event with a formatted detail
+func (t *requestTimeline) Addf(event, format string, args ...any) {
+	if t == nil {
+		return
+	}
+	t.Add(event, fmt.Sprintf(format, args...))
+}
+
+// setKey records who made the request once it is authenticated
+func (t *requestTimeline) setKey(key *ClientKey) {
+	if t == nil || key == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.timeline.KeyID, t.timeline.Tenant = key.ID, key.Tenant
+}
+
+func (t *requestTimeline) complete(status int) {
+	t.Add(TimelineCompleted, strconv.Itoa(status))
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.timeline.Status = status
+}
+
+// upstreamAttempt counts an upstream request made for the request
+func (t *requestTimeline) upstreamAttempt(retry bool) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.attempts++
+	t.retried = t.retried || retry
+}
+
+// setServedBy records what served a request with fallbacks
+func (t *requestTimeline) setServedBy(servedBy string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.servedBy = servedBy
+}
+
+// served returns what served a request with fallbacks, or ""
+func (t *requestTimeline) served() string {
+	if t == nil {
+		return ""
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.servedBy
+}
+
+// retriedAttempts returns the upstream requests made if any was a retry,
+// or 0
+func (t *requestTimeline) retriedAttempts() int {
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.retried {
+		return 0
+	}
+	return t.attempts
+}
+
+// id is the ID of the request, or "" without a timeline
+func (t *requestTimeline) id() string {
+	if t == nil {
+		return ""
+	}
+	return t.timeline.RequestID
+}
+
+// elapsed is the time since the request was received, or 0 without a
+// timeline
+func (t *requestTimeline) elapsed() time.Duration {
+	if t == nil {
+		return 0
+	}
+	return time.Since(t.start)
+}
+
+// snapshot copies the timeline so far
+func (t *requestTimeline) snapshot() RequestTimeline {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := t.timeline
+	out.Events = append([]TimelineEvent(nil), t.timeline.Events...)
+	return out
+}
+
+const timelineContextKey contextKey = clientKeyContextKey + 1
+
+// timelineFromContext returns the timeline of a request, or nil when it is
+// not recorded
+func timelineFromContext(ctx context.Context) *requestTimeline {
+	t, _ := ctx.Value(timelineContextKey).(*requestTimeline)
+	return t
+}
+
+// statusRecorder remembers the status code a handler answered with
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	// timeline, if set, has its retried upstream attempts reported in the
+	// response headers
+	timeline *requestTimeline
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+		w.reportAttempts()
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+		w.reportAttempts()
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusRecorder) reportAttempts() {
+	if attempts := w.timeline.retriedAttempts(); attempts > 0 {
+		w.Header().Set(upstreamAttemptsHeader, strconv.Itoa(attempts))
+	}
+	if servedBy := w.timeline.served(); servedBy != "" {
+		w.Header().Set(servedByHeader, servedBy)
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, e.g. to
+// flush streamed replies
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// withTimeline assigns the request its ID and records its timeline in the
+// server's recent timelines, where it is visible while in flight, and in
+// its trace, if requests are traced
+func (s *ProxyServer) withTimeline(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !clientRequestID.MatchString(id) {
+			buf := make([]byte, 12)
+			rand.Read(buf)
+			id = "req_" + hex.EncodeToString(buf)
+		}
+		w.Header().Set(requestIDHeader, id)
+		timeline := newRequestTimeline(id, r)
+		s.timelines.Put(id, timeline)
+
+		ctx, sp := s.tracer.startRequest(r)
+		rec := &statusRecorder{ResponseWriter: w, timeline: timeline}
+		next(rec, r.WithContext(context.WithValue(ctx, timelineContextKey, timeline)))
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		timeline.complete(rec.status)
+		traceRequest(sp, timeline, rec.status, rec.Header().Get("Content-Type") == "text/event-stream")
+	}
+}
+
+// handleAdminRequestTimeline returns the timeline of a recent request
+func (s *ProxyServer) handleAdminRequestTimeline(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	timeline, ok := s.timelines.Get(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "Request not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(timeline.snapshot())
+}
+
+// timelinesFromEnv sizes the recent timelines from PROXY_TIMELINE_MAX
+func timelinesFromEnv(getenv func(string) string) (*lruCache[*requestTimeline], error) {
+	max := 1000
+	if v := getenv("PROXY_TIMELINE_MAX"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid PROXY_TIMELINE_MAX %q", v)
+		}
+		max = n
+	}
+	return newLRUCache[*requestTimeline](max, 0), nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// timelineOf fetches the timeline of a request from the admin API
+func timelineOf(t *testing.T, server *ProxyServer, id string) RequestTimeline {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/requests/{id}/timeline", server.handleAdminRequestTimeline)
+	w := adminRequest(mux, http.MethodGet, "/admin/requests/"+id+"/timeline", "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var timeline RequestTimeline
+	json.Unmarshal(w.Body.Bytes(), &timeline)
+	return timeline
+}
+
+func eventNames(timeline RequestTimeline) string {
+	var names []string
+	for _, event := range timeline.Events {
+		names = append(names, event.Event)
+	}
+	return strings.Join(names, ",")
+}
+
+func TestProxyServer_RequestTimeline(t *testing.T) {
+	server := NewProxyServer(&MockOpenAIClient{response: createTestChatCompletionResponse()})
+	server.routes.Put("cheap", RoutingRule{ID: "cheap", Model: "gpt-4o", TargetModel: "gpt-4o-mini"})
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "gpt-4o", "messages": [{"role": "user", "content": "Hi"}]}`))
+	req.Header.Set(requestIDHeader, "trace-42")
+	w := httptest.NewRecorder()
+	server.Handler().ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Header().Get(requestIDHeader) != "trace-42" {
+		t.Fatalf("Expected status 200 with the request ID echoed, got %d %q", w.Code, w.Header().Get(requestIDHeader))
+	}
+
+	timeline := timelineOf(t, server, "trace-42")
+	if got := eventNames(timeline); got != "received,validated,routed,first_token,completed" {
+		t.Errorf("Unexpected events %s", got)
+	}
+	if timeline.Status != http.StatusOK || timeline.Path != "/v1/chat/completions" || timeline.Events[2].Detail != "gpt-4o -> gpt-4o-mini" {
+		t.Errorf("Unexpected timeline %+v", timeline)
+	}
+	for i := 1; i < len(timeline.Events); i++ {
+		if timeline.Events[i].OffsetMS < timeline.Events[i-1].OffsetMS {
+			t.Errorf("Events out of order: %+v", timeline.Events)
+		}
+	}
+}
+
+func TestProxyServer_RequestTimeline_Retries(t *testing.T) {
+	server := NewProxyServer(&scriptedOpenAIClient{replies: []string{`{"nom": "Ann"}`, `{"name": "Ann"}`}})
+	server.structuredOutput = StructuredOutputCheck
+	w := httptest.NewRecorder()
+	server.Handler().ServeHTTP(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(personSchemaRequest)))
+
+	id := w.Header().Get(requestIDHeader)
+	if !strings.HasPrefix(id, "req_") {
+		t.Fatalf("Expected a generated request ID, got %q", id)
+	}
+	timeline := timelineOf(t, server, id)
+	if got := eventNames(timeline); got != "received,validated,routed,retried,first_token,completed" {
+		t.Errorf("Unexpected events %s", got)
+	}
+}
+
+func TestProxyServer_RequestTimeline_Rejected(t *testing.T) {
+	server := NewProxyServer(&MockOpenAIClient{})
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"messages": []}`))
+	req.Header.Set(requestIDHeader, "not a valid id")
+	w := httptest.NewRecorder()
+	server.Handler().ServeHTTP(w, req)
+
+	id := w.Header().Get(requestIDHeader)
+	if id == "not a valid id" {
+		t.Fatal("Expected an invalid request ID to be replaced")
+	}
+	timeline := timelineOf(t, server, id)
+	if got := eventNames(timeline); got != "received,completed" || timeline.Status != http.StatusBadRequest {
+		t.Errorf("Unexpected timeline %+v", timeline)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/requests/{id}/timeline", server.handleAdminRequestTimeline)
+	if w := adminRequest(mux, http.MethodGet, "/admin/requests/unknown/timeline", "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d, got %d", http.StatusNotFound, w.Code)
+	}
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// errNoTokenizer is returned for models without a known encoding, or whose
+// vocabulary is not installed
+var errNoTokenizer = errors.New("no tokenizer available")
+
+// encodings are the byte-pair encodings of OpenAI's models, loaded from the
+// .tiktoken vocabulary files tiktoken itself downloads. Each splits text
+// into pieces with its own pattern before merging bytes. Go's regexp has no
+// lookahead, so the pattern's final \s+(?!\S) branch is emulated in split.
+var encodings = map[string]struct {
+	pattern  *regexp.Regexp
+	specials map[int]string
+}{
+	"cl100k_base": {
+		pattern:  regexp.MustCompile(`'(?i:[sdmt]|ll|ve|re)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}{1,3}| ?[^\s\p{L}\p{N}]+[\r\n]*|\s*[\r\n]|(\s+)`),
+		specials: map[int]string{100257: "<|endoftext|>", 100258: "<|fim_prefix|>", 100259: "<|fim_middle|>", 100260: "<|fim_suffix|>", 100276: "<|endofprompt|>"},
+	},
+	"o200k_base": {
+		pattern: regexp.MustCompile(strings.Join([]string{
+			`[^\r\n\p{L}\p{N}]?[\p{Lu}\p{Lt}\p{Lm}\p{Lo}\p{M}]*[\p{Ll}\p{Lm}\p{Lo}\p{M}]+(?i:'s|'t|'re|'ve|'m|'ll|'d)?`,
+			`[^\r\n\p{L}\p{N}]?[\p{Lu}\p{Lt}\p{Lm}\p{Lo}\p{M}]+[\p{Ll}\p{Lm}\p{Lo}\p{M}]*(?i:'s|'t|'re|'ve|'m|'ll|'d)?`,
+			`\p{N}{1,3}`,
+			` ?[^\s\p{L}\p{N}]+[\r\n/]*`,
+			`\s*[\r\n]+`,
+			`(\s+)`,
+		}, "|")),
+		specials: map[int]string{199999: "<|endoftext|>", 200018: "<|endofprompt|>"},
+	},
+}
+
+// modelEncodings maps model name prefixes to their encoding, most specific
+// first
+var modelEncodings = []struct{ prefix, encoding string }{
+	{"gpt-4o", "o200k_base"},
+	{"chatgpt-4o", "o200k_base"},
+	{"gpt-4.1", "o200k_base"},
+	{"gpt-4.5", "o200k_base"},
+	{"gpt-5", "o200k_base"},
+	{"o1", "o200k_base"},
+	{"o3", "o200k_base"},
+	{"o4", "o200k_base"},
+	{"gpt-4", "cl100k_base"},
+	{"gpt-3.5", "cl100k_base"},
+	{"text-embedding-3", "cl100k_base"},
+	{"text-embedding-ada-002", "cl100k_base"},
+}
+
+// encodingForModel returns the encoding of a model family
+func encodingForModel(model string) (string, bool) {
+	for _, m := range modelEncodings {
+		if strings.HasPrefix(model, m.prefix) {
+			return m.encoding, true
+		}
+	}
+	return "", false
+}
+
+// bpeEncoding is a loaded vocabulary
+type bpeEncoding struct {
+	name     string
+	pattern  *regexp.Regexp
+	ranks    map[string]int
+	tokens   map[int]string
+	specials map[int]string
+}
+
+// loadEncoding reads a vocabulary in tiktoken's format: a base64 token and
+// its rank per line
+func loadEncoding(name, path string) (*bpeEncoding, error) {
+	spec, ok := encodings[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown encoding %s", name)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	e := &bpeEncoding{name: name, pattern: spec.pattern, ranks: make(map[string]int), tokens: make(map[int]string), specials: spec.specials}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		token, rank, ok := strings.Cut(strings.TrimSpace(scanner.Text()), " ")
+		if !ok {
+			if token == "" {
+				continue
+			}
+			return nil, fmt.Errorf("%s:%d: expected a token and a rank", path, line)
+		}
+		b, err := base64.StdEncoding.DecodeString(token)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		id, err := strconv.Atoi(rank)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid rank %q", path, line, rank)
+		}
+		e.ranks[string(b)] = id
+		e.tokens[id] = string(b)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// split cuts text into the pieces the encoding merges separately
+func (e *bpeEncoding) split(text string) []string {
+	var pieces []string
+	for len(text) > 0 {
+		m := e.pattern.FindStringSubmatchIndex(text)
+		if m == nil {
+			// Every character matches one of the branches, but never loop
+			// on a piece that did not
+			pieces = append(pieces, text)
+			break
+		}
+		start, end := m[0], m[1]
+		if m[2] >= 0 && end < len(text) {
+			// \s+(?!\S) gives back the last space before a word, so that
+			// the word carries it, unless that would leave nothing
+			if _, size := utf8.DecodeLastRuneInString(text[start:end]); end-size > start {
+				end -= size
+			}
+		}
+		if start > 0 {
+			pieces = append(pieces, text[:start])
+		}
+		pieces = append(pieces, text[start:end])
+		text = text[end:]
+	}
+	return pieces
+}
+
+// encode returns the tokens of text. Special tokens are not recognized: a
+// text containing "<|endoftext|>" is encoded as the characters it is.
+func (e *bpeEncoding) encode(text string) ([]int, error) {
+	var ids []int
+	for _, piece := range e.split(text) {
+		if id, ok := e.ranks[piece]; ok {
+			ids = append(ids, id)
+			continue
+		}
+		// Merge the adjacent pair with the lowest rank until none is left
+		bounds := make([]int, len(piece)+1)
+		for i := range bounds {
+			bounds[i] = i
+		}
+		for {
+			best, bestRank := -1, math.MaxInt
+			for i := 0; i+2 < len(bounds); i++ {
+				if rank, ok := e.ranks[piece[bounds[i]:bounds[i+2]]]; ok && rank < bestRank {
+					best, bestRank = i, rank
+				}
+			}
+			if best < 0 {
+				break
+			}
+			bounds = append(bounds[:best+1], bounds[best+2:]...)
+		}
+		for i := 0; i+1 < len(bounds); i++ {
+			id, ok := e.ranks[piece[bounds[i]:bounds[i+1]]]
+			if !ok {
+				return nil, fmt.Errorf("byte %q is not in the %s vocabulary", piece[bounds[i]:bounds[i+1]], e.name)
+			}
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// token returns the bytes of a token, special or not
+func (e *bpeEncoding) token(id int) (string, bool) {
+	if s, ok := e.tokens[id]; ok {
+		return s, true
+	}
+	s, ok := e.specials[id]
+	return s, ok
+}
+
+// tokenizers loads the vocabularies in dir, named <encoding>.tiktoken, the
+// first time a model needs them
+type tokenizers struct {
+	dir string
+
+	mu     sync.Mutex
+	loaded map[string]*bpeEncoding
+}
+
+func newTokenizers(dir string) *tokenizers {
+	return &tokenizers{dir: dir, loaded: make(map[string]*bpeEncoding)}
+}
+
+// get returns the encoding by name. A vocabulary that fails to load is
+// tried again on the next call, so one installed later is picked up.
+func (t *tokenizers) get(name string) (*bpeEncoding, error) {
+	if _, ok := encodings[name]; !ok {
+		return nil, fmt.Errorf("unknown encoding %s", name)
+	}
+	if t.dir == "" {
+		return nil, fmt.Errorf("%w: PROXY_TOKENIZER_DIR is not set", errNoTokenizer)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if e, ok := t.loaded[name]; ok {
+		return e, nil
+	}
+	e, err := loadEncoding(name, filepath.Join(t.dir, name+".tiktoken"))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errNoTokenizer, err)
+	}
+	log.Printf("Loaded tokenizer %s with %d tokens", name, len(e.ranks))
+	t.loaded[name] = e
+	return e, nil
+}
+
+// TokenizeRequest is the body of /v1/tokenize. The encoding is that of the
+// model's family unless named.
+type TokenizeRequest struct {
+	Model    string `json:"model,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Text     string `json:"text"`
+	// ReturnStrings adds the text of every token
+	ReturnStrings bool `json:"return_strings,omitempty"`
+}
+
+type TokenizeResponse struct {
+	Model    string   `json:"model,omitempty"`
+	Encoding string   `json:"encoding"`
+	Tokens   []int    `json:"tokens"`
+	Count    int      `json:"count"`
+	Strings  []string `json:"strings,omitempty"`
+}
+
+// DetokenizeRequest is the body of /v1/detokenize
+type DetokenizeRequest struct {
+	Model    string `json:"model,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Tokens   []int  `json:"tokens"`
+}
+
+type DetokenizeResponse struct {
+	Model    string `json:"model,omitempty"`
+	Encoding string `json:"encoding"`
+	Text     string `json:"text"`
+}
+
+// encodingFor returns the encoding a tokenize request asks for. Virtual
+// models and aliases count as the model they are served by.
+func (s *ProxyServer) encodingFor(r *http.Request, model, name string) (*bpeEncoding, error) {
+	if name == "" {
+		if model == "" {
+			return nil, fmt.Errorf("model or encoding is required")
+		}
+		var tenant string
+		if key := clientKeyFromContext(r.Context()); key != nil {
+			tenant = key.Tenant
+		}
+		var ok bool
+		if name, ok = encodingForModel(s.resolveModel(model, tenant)); !ok {
+			return nil, fmt.Errorf("%w for model %s", errNoTokenizer, model)
+		}
+	}
+	return s.tokenizers.get(name)
+}
+
+// tokenizerStatus is the status code to answer a failed tokenization with
+func tokenizerStatus(err error) int {
+	if errors.Is(err, errNoTokenizer) {
+		return http.StatusNotImplemented
+	}
+	return http.StatusBadRequest
+}
+
+func (s *ProxyServer) handleTokenize(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req TokenizeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON in request body", http.StatusBadRequest)
+		return
+	}
+	e, err := s.encodingFor(r, req.Model, req.Encoding)
+	if err != nil {
+		http.Error(w, err.Error(), tokenizerStatus(err))
+		return
+	}
+	tokens, err := e.encode(req.Text)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp := TokenizeResponse{Model: req.Model, Encoding: e.name, Tokens: tokens, Count: len(tokens)}
+	if resp.Tokens == nil {
+		resp.Tokens = []int{}
+	}
+	if req.ReturnStrings {
+		for _, id := range tokens {
+			token, _ := e.token(id)
+			resp.Strings = append(resp.Strings, token)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *ProxyServer) handleDetokenize(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req DetokenizeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON in request body", http.StatusBadRequest)
+		return
+	}
+	e, err := s.encodingFor(r, req.Model, req.Encoding)
+	if err != nil {
+		http.Error(w, err.Error(), tokenizerStatus(err))
+		return
+	}
+	var b strings.Builder
+	for _, id := range req.Tokens {
+		token, ok := e.token(id)
+		if !ok {
+			http.Error(w, fmt.Sprintf("Unknown token %d", id), http.StatusBadRequest)
+			return
+		}
+		b.WriteString(token)
+	}
+	text := b.String()
+	if !utf8.ValidString(text) {
+		// Tokens can end in the middle of a character
+		text = strings.ToValidUTF8(text, string(unicode.ReplacementChar))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(DetokenizeResponse{Model: req.Model, Encoding: e.name, Text: text})
+}
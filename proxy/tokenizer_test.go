@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeVocabulary writes a cl100k_base.tiktoken of all bytes and a few
+// merges spelling "hello" and " world"
+func writeVocabulary(t *testing.T) string {
+	t.Helper()
+	var b strings.Builder
+	for i := 0; i < 256; i++ {
+		fmt.Fprintf(&b, "%s %d\n", base64.StdEncoding.EncodeToString([]byte{byte(i)}), i)
+	}
+	for i, token := range []string{"ll", "he", "hell", "hello", " w", "or", " wor", "ld", " world"} {
+		fmt.Fprintf(&b, "%s %d\n", base64.StdEncoding.EncodeToString([]byte(token)), 256+i)
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "cl100k_base.tiktoken"), []byte(b.String()), 0o644); err != nil {
+		t.Fatalf("Failed to write vocabulary: %v", err)
+	}
+	return dir
+}
+
+func tokenizerRequest(handler http.HandlerFunc, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/v1/tokenize", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	handler(w, req)
+	return w
+}
+
+func TestProxyServer_Tokenize(t *testing.T) {
+	server := NewProxyServer(&MockOpenAIClient{})
+	server.tokenizers = newTokenizers(writeVocabulary(t))
+
+	w := tokenizerRequest(server.handleTokenize, `{"model": "gpt-4-turbo", "text": "hello worlds hellos", "return_strings": true}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var resp TokenizeResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if want := []int{259, 264, 's', ' ', 259, 's'}; !reflect.DeepEqual(resp.Tokens, want) || resp.Count != 6 || resp.Encoding != "cl100k_base" {
+		t.Errorf("Expected tokens %v, got %+v", want, resp)
+	}
+	if want := []string{"hello", " world", "s", " ", "hello", "s"}; !reflect.DeepEqual(resp.Strings, want) {
+		t.Errorf("Expected strings %q, got %q", want, resp.Strings)
+	}
+
+	w = tokenizerRequest(server.handleDetokenize, `{"encoding": "cl100k_base", "tokens": [259, 264, 100257, 226]}`)
+	var detok DetokenizeResponse
+	json.Unmarshal(w.Body.Bytes(), &detok)
+	if detok.Text != "hello world<|endoftext|>�" {
+		t.Errorf("Expected the text with the special token, got %q", detok.Text)
+	}
+}
+
+func TestProxyServer_TokenizeErrors(t *testing.T) {
+	server := NewProxyServer(&MockOpenAIClient{})
+	if w := tokenizerRequest(server.handleTokenize, `{"model": "gpt-4", "text": "hi"}`); w.Code != http.StatusNotImplemented {
+		t.Errorf("Expected status code %d without vocabularies, got %d", http.StatusNotImplemented, w.Code)
+	}
+	server.tokenizers = newTokenizers(writeVocabulary(t))
+	for body, status := range map[string]int{
+		`{"text": "hi"}`:                      http.StatusBadRequest,
+		`{"encoding": "p50k", "text": "hi"}`:  http.StatusBadRequest,
+		`{"model": "llama-3", "text": "hi"}`:  http.StatusNotImplemented,
+		`{"model": "gpt-4o", "text": "hi"}`:   http.StatusNotImplemented,
+		`{"model": "gpt-4", "tokens": [1e9]}`: http.StatusBadRequest,
+	} {
+		handler := server.handleTokenize
+		if strings.Contains(body, "tokens") {
+			handler = server.handleDetokenize
+		}
+		if w := tokenizerRequest(handler, body); w.Code != status {
+			t.Errorf("Expected status code %d for %s, got %d: %s", status, body, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestBPEEncoding_Split(t *testing.T) {
+	for name, cases := range map[string]map[string][]string{
+		"cl100k_base": {
+			"I'm  fine\n\n ok": {"I", "'m", " ", " fine", "\n\n", " ok"},
+			"12345 apples  ":   {"123", "45", " apples", "  "},
+			"HelloWorld's 日本語": {"HelloWorld", "'s", " 日本語"},
+		},
+		"o200k_base": {
+			"HelloWorld's":   {"Hello", "World's"},
+			"path/to\n\n  x": {"path", "/to", "\n\n", " ", " x"},
+			"x = 1234;\r\n":  {"x", " =", " ", "123", "4", ";\r\n"},
+		},
+	} {
+		e := &bpeEncoding{name: name, pattern: encodings[name].pattern}
+		for text, want := range cases {
+			if got := e.split(text); !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: expected %q for %q, got %q", name, want, text, got)
+			}
+		}
+	}
+}
+
+func TestEncodingForModel(t *testing.T) {
+	for model, want := range map[string]string{"gpt-4o-mini": "o200k_base", "gpt-4-0613": "cl100k_base", "o3-mini": "o200k_base", "text-embedding-3-small": "cl100k_base"} {
+		if got, _ := encodingForModel(model); got != want {
+			t.Errorf("Expected %s for %s, got %s", want, model, got)
+		}
+	}
+	if _, ok := encodingForModel("claude-3"); ok {
+		t.Error("Expected no encoding for another vendor's model")
+	}
+}
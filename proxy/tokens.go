@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Bounds on the lifetime of temporary tokens
+const (
+	defaultTokenTTL = time.Hour
+	maxTokenTTL     = 7 * 24 * time.Hour
+)
+
+// MintTokenRequest asks for a short-lived token derived from an existing key
+type MintTokenRequest struct {
+	TTLSeconds int       `json:"ttl_seconds,omitempty"`
+	Name       string    `json:"name,omitempty"`
+	Limits     KeyLimits `json:"limits"`
+}
+
+// MintTokenResponse carries the newly minted token. The secret is only ever
+// returned here.
+type MintTokenResponse struct {
+	ID        string    `json:"id"`
+	Key       string    `json:"key"`
+	Parent    string    `json:"parent"`
+	Limits    KeyLimits `json:"limits"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func randomHex(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// handleMintToken creates a temporary key with boosted limits for a load test
+// or demo. The token inherits its parent's scopes, so it can never do more
+// than the parent, only do it faster, and it stops working by itself once it
+// expires; the parent key's own limits are never touched.
+func (s *ProxyServer) handleMintToken(w http.ResponseWriter, r *http.Request) {
+	parent := s.keys.Get(r.PathValue("id"))
+	if parent == nil {
+		http.Error(w, "Key not found", http.StatusNotFound)
+		return
+	}
+	if parent.Parent != "" {
+		http.Error(w, "Cannot mint a token from a temporary token", http.StatusBadRequest)
+		return
+	}
+
+	var req MintTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON in request body", http.StatusBadRequest)
+		return
+	}
+	ttl := defaultTokenTTL
+	if req.TTLSeconds != 0 {
+		ttl = time.Duration(req.TTLSeconds) * time.Second
+	}
+	if ttl <= 0 || ttl > maxTokenTTL {
+		http.Error(w, fmt.Sprintf("ttl_seconds must be between 1 and %d", int(maxTokenTTL.Seconds())), http.StatusBadRequest)
+		return
+	}
+
+	suffix, err := randomHex(4)
+	if err != nil {
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+	secret, err := randomHex(24)
+	if err != nil {
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+
+	expiresAt := time.Now().Add(ttl).UTC()
+	token := ClientKey{
+		ID:        parent.ID + "-tmp-" + suffix,
+		Key:       "sk-tmp-" + secret,
+		Name:      req.Name,
+		Tenant:    parent.Tenant,
+		Scopes:    parent.Scopes,
+		Limits:    req.Limits,
+		Upstream:  parent.Upstream,
+		Parent:    parent.ID,
+		ExpiresAt: &expiresAt,
+	}
+	if err := s.keys.Add(token); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	log.Printf("Minted temporary token %s for key %s, expires %s", token.ID, parent.ID, expiresAt.Format(time.RFC3339))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(MintTokenResponse{
+		ID:        token.ID,
+		Key:       token.Key,
+		Parent:    token.Parent,
+		Limits:    token.Limits,
+		ExpiresAt: expiresAt,
+	})
+}
+
+// sweepExpiredKeys drops expired temporary keys; their rate limit counters
+// expire on their own. It runs as a per-replica job since every replica
+// holds its own keys.
+func (s *ProxyServer) sweepExpiredKeys(ctx context.Context) error {
+	for _, id := range s.keys.RemoveExpired(time.Now()) {
+		log.Printf("Temporary token %s expired", id)
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func mintTestToken(t *testing.T, server *ProxyServer, parent string, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest("POST", "/admin/keys/"+parent+"/tokens", bytes.NewBufferString(body))
+	req.SetPathValue("id", parent)
+	w := httptest.NewRecorder()
+	server.handleMintToken(w, req)
+	return w
+}
+
+func TestProxyServer_HandleMintToken(t *testing.T) {
+	server := NewProxyServer(&MockOpenAIClient{})
+	server.keys = createTestKeyStore(t)
+
+	w := mintTestToken(t, server, "mini-only", `{"ttl_seconds": 600, "limits": {"requests_per_minute": 1000}}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+
+	var resp MintTokenResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if resp.Parent != "mini-only" {
+		t.Errorf("Expected parent mini-only, got %s", resp.Parent)
+	}
+	if time.Until(resp.ExpiresAt) > 10*time.Minute || time.Until(resp.ExpiresAt) < 9*time.Minute {
+		t.Errorf("Expected token to expire in about 10 minutes, got %s", resp.ExpiresAt)
+	}
+
+	token := server.keys.Lookup(resp.Key)
+	if token == nil {
+		t.Fatal("Expected minted token to authenticate")
+	}
+	if token.Limits.RequestsPerMinute != 1000 {
+		t.Errorf("Expected boosted limit of 1000 rpm, got %d", token.Limits.RequestsPerMinute)
+	}
+	if token.AllowsModel("gpt-4o") {
+		t.Error("Expected token to inherit the parent's model scope")
+	}
+}
+
+func TestProxyServer_HandleMintToken_Errors(t *testing.T) {
+	server := NewProxyServer(&MockOpenAIClient{})
+	server.keys = createTestKeyStore(t)
+
+	if w := mintTestToken(t, server, "missing", `{}`); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d for unknown key, got %d", http.StatusNotFound, w.Code)
+	}
+	if w := mintTestToken(t, server, "full", `not json`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d for invalid JSON, got %d", http.StatusBadRequest, w.Code)
+	}
+	if w := mintTestToken(t, server, "full", `{"ttl_seconds": 99999999}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d for excessive ttl, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	w := mintTestToken(t, server, "full", `{}`)
+	var resp MintTokenResponse
+	json.NewDecoder(w.Body).Decode(&resp)
+	if w := mintTestToken(t, server, resp.ID, `{}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d when minting from a temporary token, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestKeyStore_ExpiredTokens(t *testing.T) {
+	store := createTestKeyStore(t)
+	expired := time.Now().Add(-time.Second)
+	if err := store.Add(ClientKey{ID: "old", Key: "sk-old", Parent: "full", ExpiresAt: &expired}); err != nil {
+		t.Fatalf("Failed to add key: %v", err)
+	}
+
+	if store.Lookup("sk-old") != nil {
+		t.Error("Expected expired token to be rejected")
+	}
+
+	removed := store.RemoveExpired(time.Now())
+	if len(removed) != 1 || removed[0] != "old" {
+		t.Errorf("Expected expired token to be removed, got %v", removed)
+	}
+	if store.Get("old") != nil {
+		t.Error("Expected expired token to be gone from the store")
+	}
+	if store.Lookup("sk-full") == nil {
+		t.Error("Expected permanent keys to be kept")
+	}
+}
+
+func TestProxyServer_MintedTokenKeepsTenantLimits(t *testing.T) {
+	server := NewProxyServer(&MockOpenAIClient{})
+	server.keys, _ = NewKeyStore([]ClientKey{{ID: "acme-web", Key: "sk-acme", Tenant: "acme"}})
+	server.tenants.Put("acme", Tenant{ID: "acme", Limits: KeyLimits{RequestsPerMinute: 1}})
+	handler := server.withAuth(func(w http.ResponseWriter, r *http.Request) {})
+
+	w := mintTestToken(t, server, "acme-web", `{"limits": {"requests_per_minute": 1000}}`)
+	var resp MintTokenResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	for i, secret := range []string{"sk-acme", resp.Key} {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+		req.Header.Set("Authorization", "Bearer "+secret)
+		w := httptest.NewRecorder()
+		handler(w, req)
+		if want := []int{http.StatusOK, http.StatusTooManyRequests}[i]; w.Code != want {
+			t.Errorf("Request %d: expected status code %d, got %d", i, want, w.Code)
+		}
+	}
+}
+
+func TestProxyServer_WithAuth_RateLimit(t *testing.T) {
+	server := NewProxyServer(&MockOpenAIClient{})
+	store, _ := NewKeyStore([]ClientKey{{ID: "slow", Key: "sk-slow", Limits: KeyLimits{RequestsPerMinute: 1}}})
+	server.keys = store
+	handler := server.withAuth(func(w http.ResponseWriter, r *http.Request) {})
+
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+		req.Header.Set("Authorization", "Bearer sk-slow")
+		w := httptest.NewRecorder()
+		handler(w, req)
+		if w.Code != want {
+			t.Errorf("Request %d: expected status code %d, got %d", i, want, w.Code)
+		}
+	}
+}
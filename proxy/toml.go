@@ -0,0 +1,384 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// parseTOML parses the subset of TOML config files need: tables, arrays of
+// tables, dotted keys, and values that are strings, integers, floats,
+// booleans, arrays or inline tables. Dates and multi-line strings are not
+// supported. Tables are map[string]any, arrays []any, and integers int64.
+func parseTOML(data string) (map[string]any, error) {
+	p := &tomlParser{data: data, line: 1}
+	root := make(map[string]any)
+	current := root
+	// defined are the tables declared with a header, which must not be
+	// declared twice
+	defined := make(map[string]bool)
+	for {
+		p.skipBlank()
+		if p.eof() {
+			return root, nil
+		}
+		var err error
+		switch {
+		case strings.HasPrefix(p.rest(), "[["):
+			p.pos += 2
+			current, err = p.arrayTableHeader(root)
+		case p.peek() == '[':
+			p.pos++
+			current, err = p.tableHeader(root, defined)
+		default:
+			err = p.keyValue(current)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := p.endOfLine(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+type tomlParser struct {
+	data string
+	pos  int
+	line int
+}
+
+func (p *tomlParser) errorf(format string, args ...any) error {
+	return fmt.Errorf("line %d: %s", p.line, fmt.Sprintf(format, args...))
+}
+
+func (p *tomlParser) eof() bool    { return p.pos >= len(p.data) }
+func (p *tomlParser) rest() string { return p.data[p.pos:] }
+
+func (p *tomlParser) peek() byte {
+	if p.eof() {
+		return 0
+	}
+	return p.data[p.pos]
+}
+
+// skipSpace skips spaces and tabs
+func (p *tomlParser) skipSpace() {
+	for !p.eof() && (p.peek() == ' ' || p.peek() == '\t') {
+		p.pos++
+	}
+}
+
+// skipBlank skips whitespace, newlines and comments
+func (p *tomlParser) skipBlank() {
+	for !p.eof() {
+		switch p.peek() {
+		case ' ', '\t', '\r':
+			p.pos++
+		case '\n':
+			p.pos++
+			p.line++
+		case '#':
+			for !p.eof() && p.peek() != '\n' {
+				p.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+// endOfLine expects nothing but a comment before the next line
+func (p *tomlParser) endOfLine() error {
+	p.skipSpace()
+	if p.peek() == '#' {
+		for !p.eof() && p.peek() != '\n' {
+			p.pos++
+		}
+	}
+	if p.peek() == '\r' {
+		p.pos++
+	}
+	if !p.eof() && p.peek() != '\n' {
+		return p.errorf("unexpected %q after value", p.peek())
+	}
+	return nil
+}
+
+// key parses a dotted key of bare and quoted parts
+func (p *tomlParser) key() ([]string, error) {
+	var parts []string
+	for {
+		p.skipSpace()
+		var part string
+		switch c := p.peek(); {
+		case c == '"' || c == '\'':
+			s, err := p.str()
+			if err != nil {
+				return nil, err
+			}
+			part = s
+		default:
+			start := p.pos
+			for !p.eof() && isBareKeyChar(p.peek()) {
+				p.pos++
+			}
+			if start == p.pos {
+				return nil, p.errorf("expected a key")
+			}
+			part = p.data[start:p.pos]
+		}
+		parts = append(parts, part)
+		p.skipSpace()
+		if p.peek() != '.' {
+			return parts, nil
+		}
+		p.pos++
+	}
+}
+
+func isBareKeyChar(c byte) bool {
+	return c == '_' || c == '-' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+// table returns the table at path below t, creating tables on the way. The
+// last table of an array of tables stands for the array.
+func (p *tomlParser) table(t map[string]any, path []string) (map[string]any, error) {
+	for _, name := range path {
+		switch v := t[name].(type) {
+		case nil:
+			next := make(map[string]any)
+			t[name] = next
+			t = next
+		case map[string]any:
+			t = v
+		case []any:
+			last, ok := v[len(v)-1].(map[string]any)
+			if !ok {
+				return nil, p.errorf("%s is not a table", name)
+			}
+			t = last
+		default:
+			return nil, p.errorf("%s is not a table", name)
+		}
+	}
+	return t, nil
+}
+
+func (p *tomlParser) tableHeader(root map[string]any, defined map[string]bool) (map[string]any, error) {
+	path, err := p.key()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek() != ']' {
+		return nil, p.errorf("expected ] after table name")
+	}
+	p.pos++
+	name := strings.Join(path, "\x00")
+	if defined[name] {
+		return nil, p.errorf("table %s is defined twice", strings.Join(path, "."))
+	}
+	defined[name] = true
+	return p.table(root, path)
+}
+
+func (p *tomlParser) arrayTableHeader(root map[string]any) (map[string]any, error) {
+	path, err := p.key()
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(p.rest(), "]]") {
+		return nil, p.errorf("expected ]] after array of tables name")
+	}
+	p.pos += 2
+	parent, err := p.table(root, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	name := path[len(path)-1]
+	array, ok := parent[name].([]any)
+	if parent[name] != nil && !ok {
+		return nil, p.errorf("%s is not an array of tables", strings.Join(path, "."))
+	}
+	t := make(map[string]any)
+	parent[name] = append(array, t)
+	return t, nil
+}
+
+// keyValue parses key = value into t
+func (p *tomlParser) keyValue(t map[string]any) error {
+	path, err := p.key()
+	if err != nil {
+		return err
+	}
+	if p.peek() != '=' {
+		return p.errorf("expected = after key %s", strings.Join(path, "."))
+	}
+	p.pos++
+	p.skipSpace()
+	v, err := p.value()
+	if err != nil {
+		return err
+	}
+	parent, err := p.table(t, path[:len(path)-1])
+	if err != nil {
+		return err
+	}
+	name := path[len(path)-1]
+	if _, ok := parent[name]; ok {
+		return p.errorf("key %s is defined twice", strings.Join(path, "."))
+	}
+	parent[name] = v
+	return nil
+}
+
+func (p *tomlParser) value() (any, error) {
+	switch c := p.peek(); {
+	case c == '"' || c == '\'':
+		return p.str()
+	case c == '[':
+		return p.array()
+	case c == '{':
+		return p.inlineTable()
+	case strings.HasPrefix(p.rest(), "true"):
+		p.pos += 4
+		return true, nil
+	case strings.HasPrefix(p.rest(), "false"):
+		p.pos += 5
+		return false, nil
+	}
+	start := p.pos
+	for !p.eof() && strings.IndexByte("+-0123456789_.eExobabcdefABCDEFinf", p.peek()) >= 0 {
+		p.pos++
+	}
+	token := strings.ReplaceAll(p.data[start:p.pos], "_", "")
+	if token == "" {
+		return nil, p.errorf("expected a value")
+	}
+	if n, err := strconv.ParseInt(token, 0, 64); err == nil {
+		return n, nil
+	}
+	if f, err := strconv.ParseFloat(token, 64); err == nil {
+		return f, nil
+	}
+	return nil, p.errorf("invalid value %q", token)
+}
+
+// str parses a basic or literal string
+func (p *tomlParser) str() (string, error) {
+	quote := p.peek()
+	if strings.HasPrefix(p.rest(), strings.Repeat(string(quote), 3)) {
+		return "", p.errorf("multi-line strings are not supported")
+	}
+	p.pos++
+	var b strings.Builder
+	for {
+		if p.eof() || p.peek() == '\n' {
+			return "", p.errorf("unterminated string")
+		}
+		c := p.peek()
+		p.pos++
+		switch {
+		case c == quote:
+			return b.String(), nil
+		case c == '\\' && quote == '"':
+			if err := p.escape(&b); err != nil {
+				return "", err
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+}
+
+func (p *tomlParser) escape(b *strings.Builder) error {
+	if p.eof() {
+		return p.errorf("unterminated string")
+	}
+	c := p.peek()
+	p.pos++
+	switch c {
+	case '"', '\\':
+		b.WriteByte(c)
+	case 'n':
+		b.WriteByte('\n')
+	case 't':
+		b.WriteByte('\t')
+	case 'r':
+		b.WriteByte('\r')
+	case 'b':
+		b.WriteByte('\b')
+	case 'f':
+		b.WriteByte('\f')
+	case 'u', 'U':
+		size := 4
+		if c == 'U' {
+			size = 8
+		}
+		if p.pos+size > len(p.data) {
+			return p.errorf("invalid unicode escape")
+		}
+		code, err := strconv.ParseUint(p.data[p.pos:p.pos+size], 16, 32)
+		if err != nil || !utf8.ValidRune(rune(code)) {
+			return p.errorf("invalid unicode escape")
+		}
+		p.pos += size
+		b.WriteRune(rune(code))
+	default:
+		return p.errorf("invalid escape \\%c", c)
+	}
+	return nil
+}
+
+// array parses an array, which may span lines
+func (p *tomlParser) array() ([]any, error) {
+	p.pos++
+	values := []any{}
+	for {
+		p.skipBlank()
+		if p.peek() == ']' {
+			p.pos++
+			return values, nil
+		}
+		v, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+		p.skipBlank()
+		switch p.peek() {
+		case ',':
+			p.pos++
+		case ']':
+		default:
+			return nil, p.errorf("expected , or ] in array")
+		}
+	}
+}
+
+// inlineTable parses an inline table, which must be on one line
+func (p *tomlParser) inlineTable() (map[string]any, error) {
+	p.pos++
+	t := make(map[string]any)
+	p.skipSpace()
+	if p.peek() == '}' {
+		p.pos++
+		return t, nil
+	}
+	for {
+		if err := p.keyValue(t); err != nil {
+			return nil, err
+		}
+		p.skipSpace()
+		switch p.peek() {
+		case ',':
+			p.pos++
+		case '}':
+			p.pos++
+			return t, nil
+		default:
+			return nil, p.errorf("expected , or } in inline table")
+		}
+	}
+}
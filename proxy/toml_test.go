@@ -0,0 +1,70 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseTOML(t *testing.T) {
+	doc, err := parseTOML(`# Proxy settings
+listen = ":8080"   # all interfaces
+"quoted key" = 'C:\path'
+
+[upstream]
+timeout = "60s"
+retries = 1_000
+ratio = 0.5
+enabled = true
+
+[env]
+TAGS = [
+  "a",
+  "b\tc",  # trailing comma
+]
+
+[[keys]]
+id = "alice"
+limits = { requests_per_minute = 60, tokens_per_minute = 40000 }
+
+[[keys]]
+id = "bob"
+scopes.models = ["gpt-4o*"]
+
+[keys.extra]
+note = "\u00e9"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{
+		"listen":     ":8080",
+		"quoted key": `C:\path`,
+		"upstream":   map[string]any{"timeout": "60s", "retries": int64(1000), "ratio": 0.5, "enabled": true},
+		"env":        map[string]any{"TAGS": []any{"a", "b\tc"}},
+		"keys": []any{
+			map[string]any{"id": "alice", "limits": map[string]any{"requests_per_minute": int64(60), "tokens_per_minute": int64(40000)}},
+			map[string]any{"id": "bob", "scopes": map[string]any{"models": []any{"gpt-4o*"}}, "extra": map[string]any{"note": "é"}},
+		},
+	}
+	if !reflect.DeepEqual(doc, want) {
+		t.Errorf("Expected %#v, got %#v", want, doc)
+	}
+}
+
+func TestParseTOML_Errors(t *testing.T) {
+	for _, data := range []string{
+		`key = `,
+		`key = "unterminated`,
+		`key = "a" "b"`,
+		"key = 1\nkey = 2",
+		"[a]\n[a]",
+		`key = """multi"""`,
+		`key = nope`,
+		`= 1`,
+		`[table`,
+	} {
+		if _, err := parseTOML(data); err == nil {
+			t.Errorf("Expected %q to be rejected", data)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+)
+
+// Tool is a function the model may call, as declared in a request
+type Tool struct {
+	Type     string       `json:"type"`
+	Function ToolFunction `json:"function"`
+}
+
+// ToolFunction declares a function and the JSON schema of its arguments
+type ToolFunction struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+	Strict      *bool           `json:"strict,omitempty"`
+}
+
+// ToolCall is a call the model asks the client to make
+type ToolCall struct {
+	ID       string           `json:"id"`
+	Type     string           `json:"type"`
+	Function ToolCallFunction `json:"function"`
+}
+
+// ToolCallFunction names the function called and its encoded arguments
+type ToolCallFunction struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+// Tool call validation modes, chosen with PROXY_TOOL_CALL_VALIDATION
+const (
+	ToolCallsUnchecked = "off"
+	// Invalid arguments are reported in the response metadata
+	ToolCallsValidate = "validate"
+	// Invalid arguments are sent back to the model once to be fixed, and
+	// reported if they are still invalid
+	ToolCallsRepair = "repair"
+)
+
+// validateToolMessages checks the tool declarations and the tool turns of
+// a conversation, so malformed ones are rejected before going upstream
+func validateToolMessages(req ChatCompletionRequest) error {
+	for i, tool := range req.Tools {
+		if tool.Type != "function" || tool.Function.Name == "" {
+			return fmt.Errorf("tools[%d] must be a function with a name", i)
+		}
+	}
+	for i, fn := range req.Functions {
+		if fn.Name == "" {
+			return fmt.Errorf("functions[%d] must have a name", i)
+		}
+	}
+	for i, m := range req.Messages {
+		switch m.Role {
+		case "tool":
+			if m.ToolCallID == "" {
+				return fmt.Errorf("messages[%d] with role tool must have a tool_call_id", i)
+			}
+		case "function":
+			if m.Name == "" {
+				return fmt.Errorf("messages[%d] with role function must have a name", i)
+			}
+		}
+		for j, call := range m.ToolCalls {
+			if call.ID == "" || call.Function.Name == "" {
+				return fmt.Errorf("messages[%d].tool_calls[%d] must have an id and a function name", i, j)
+			}
+		}
+	}
+	return nil
+}
+
+// checkArguments validates a tool call against the declared tools
+func checkArguments(call ToolCall, schemas map[string]*compiledSchema) error {
+	schema, ok := schemas[call.Function.Name]
+	if !ok {
+		return fmt.Errorf("unknown function %q", call.Function.Name)
+	}
+	args := call.Function.Arguments
+	if args == "" {
+		args = "{}"
+	}
+	if schema == nil {
+		if !json.Valid([]byte(args)) {
+			return fmt.Errorf("arguments are not valid JSON")
+		}
+		return nil
+	}
+	return schema.Validate([]byte(args))
+}
+
+// checkToolCalls validates the arguments of the tool calls in resp against
+// the parameter schemas declared in req. In repair mode each invalid call
+// gets one follow-up completion asking the model to fix its arguments, and
+// the usage of those is added to resp. Calls still invalid are listed in
+// the metadata, so clients do not have to trust them blindly.
+func (s *ProxyServer) checkToolCalls(ctx context.Context, req ChatCompletionRequest, resp *ChatCompletionResponse) *ChatCompletionResponse {
+	if s.toolCallValidation == ToolCallsUnchecked || len(req.Tools) == 0 {
+		return resp
+	}
+	schemas := make(map[string]*compiledSchema, len(req.Tools))
+	for _, tool := range req.Tools {
+		// Without a usable schema the arguments only need to be JSON
+		var schema *compiledSchema
+		if len(tool.Function.Parameters) > 0 {
+			var err error
+			if schema, err = compileJSONSchema(tool.Function.Parameters); err != nil {
+				log.Printf("Not validating calls to %s against its schema: %v", tool.Function.Name, err)
+			}
+		}
+		schemas[tool.Function.Name] = schema
+	}
+
+	out := *resp
+	out.Choices = append([]Choice(nil), resp.Choices...)
+	var errs []string
+	for i := range out.Choices {
+		calls := append([]ToolCall(nil), out.Choices[i].Message.ToolCalls...)
+		for j, call := range calls {
+			err := checkArguments(call, schemas)
+			if err != nil && s.toolCallValidation == ToolCallsRepair {
+				var usage Usage
+				calls[j], usage, err = s.repairToolCall(ctx, req, call, err, schemas)
+				out.Usage.PromptTokens += usage.PromptTokens
+				out.Usage.CompletionTokens += usage.CompletionTokens
+				out.Usage.TotalTokens += usage.TotalTokens
+				if err == nil {
+					out.Metadata = withMetadata(out.Metadata)
+					out.Metadata.RepairedToolCalls++
+				}
+			}
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s (%s): %v", call.ID, call.Function.Name, err))
+			}
+		}
+		out.Choices[i].Message.ToolCalls = calls
+	}
+	if len(errs) > 0 {
+		out.Metadata = withMetadata(out.Metadata)
+		out.Metadata.ToolCallErrors = errs
+	}
+	return &out
+}
+
+// withMetadata returns a copy of m to modify, or new metadata
+func withMetadata(m *ResponseMetadata) *ResponseMetadata {
+	if m == nil {
+		return &ResponseMetadata{}
+	}
+	copied := *m
+	return &copied
+}
+
+// repairToolCall asks the model to fix the arguments of one call and
+// returns the call with them if they are valid now
+func (s *ProxyServer) repairToolCall(ctx context.Context, req ChatCompletionRequest, call ToolCall, invalid error, schemas map[string]*compiledSchema) (ToolCall, Usage, error) {
+	var parameters json.RawMessage
+	for _, tool := range req.Tools {
+		if tool.Function.Name == call.Function.Name {
+			parameters = tool.Function.Parameters
+		}
+	}
+	if parameters == nil {
+		// Unknown functions cannot be repaired
+		return call, Usage{}, invalid
+	}
+	repair := ChatCompletionRequest{
+		Model: req.Model,
+		Messages: []Message{
+			{Role: "system", Content: "You correct the JSON arguments of function calls. Reply with the corrected arguments as a single JSON object only, without any other text or code fences."},
+			{Role: "user", Content: fmt.Sprintf("Function: %s\nParameter schema: %s\nArguments: %s\nProblem: %v", call.Function.Name, parameters, call.Function.Arguments, invalid)},
+		},
+	}
+	resp, err := s.chatCompletion(ctx, repair)
+	if err != nil {
+		return call, Usage{}, fmt.Errorf("%v, and the repair failed: %w", invalid, err)
+	}
+	if len(resp.Choices) == 0 {
+		return call, resp.Usage, invalid
+	}
+	repaired := call
+	repaired.Function.Arguments = stripCodeFence(resp.Choices[0].Message.Content)
+	if err := checkArguments(repaired, schemas); err != nil {
+		return call, resp.Usage, fmt.Errorf("%v, still invalid after repair", invalid)
+	}
+	return repaired, resp.Usage, nil
+}
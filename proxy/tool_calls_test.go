@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// toolCallClient answers requests declaring tools with a call to
+// get_weather, and any other request, such as a repair, with repair
+type toolCallClient struct {
+	arguments string
+	repair    string
+	requests  []ChatCompletionRequest
+}
+
+func (m *toolCallClient) CreateChatCompletion(req ChatCompletionRequest) (*ChatCompletionResponse, error) {
+	m.requests = append(m.requests, req)
+	resp := *createTestChatCompletionResponse()
+	resp.Choices = append([]Choice(nil), resp.Choices...)
+	if len(req.Tools) == 0 {
+		resp.Choices[0].Message = Message{Role: "assistant", Content: m.repair}
+		return &resp, nil
+	}
+	resp.Choices[0].Message = Message{Role: "assistant", ToolCalls: []ToolCall{{
+		ID:       "call_1",
+		Type:     "function",
+		Function: ToolCallFunction{Name: "get_weather", Arguments: m.arguments},
+	}}}
+	return &resp, nil
+}
+
+const weatherToolRequest = `{"model": "gpt-4o", "messages": [{"role": "user", "content": "Weather in Oslo?"}],
+	"tools": [{"type": "function", "function": {"name": "get_weather", "parameters": {"type": "object", "properties": {"city": {"type": "string"}, "unit": {"enum": ["c", "f"]}}, "required": ["city"], "additionalProperties": false}}}]}`
+
+func toolCallResponse(t *testing.T, server *ProxyServer) ChatCompletionResponse {
+	t.Helper()
+	w := chatRequestAs(server, nil, weatherToolRequest)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var resp ChatCompletionResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return resp
+}
+
+func TestProxyServer_ToolCallValidation(t *testing.T) {
+	client := &toolCallClient{arguments: `{"city": "Oslo", "unit": "k"}`}
+	server := NewProxyServer(client)
+	server.toolCallValidation = ToolCallsValidate
+
+	resp := toolCallResponse(t, server)
+	if resp.Metadata == nil || len(resp.Metadata.ToolCallErrors) != 1 {
+		t.Fatalf("Expected one tool call error in the metadata, got %+v", resp.Metadata)
+	}
+	if err := resp.Metadata.ToolCallErrors[0]; !strings.Contains(err, "call_1 (get_weather)") || !strings.Contains(err, "/unit") {
+		t.Errorf("Expected the error to name the call and the argument, got %q", err)
+	}
+	if len(client.requests) != 1 {
+		t.Errorf("Expected no repair in validate mode, got %d upstream requests", len(client.requests))
+	}
+	if len(client.requests[0].Tools) != 1 {
+		t.Error("Expected the tools to be forwarded")
+	}
+}
+
+func TestProxyServer_ToolCallRepair(t *testing.T) {
+	client := &toolCallClient{arguments: `{"town": "Oslo"}`, repair: "```json\n{\"city\": \"Oslo\"}\n```"}
+	server := NewProxyServer(client)
+	server.toolCallValidation = ToolCallsRepair
+
+	resp := toolCallResponse(t, server)
+	if resp.Metadata == nil || resp.Metadata.RepairedToolCalls != 1 || len(resp.Metadata.ToolCallErrors) != 0 {
+		t.Fatalf("Expected one repaired call in the metadata, got %+v", resp.Metadata)
+	}
+	if args := resp.Choices[0].Message.ToolCalls[0].Function.Arguments; args != `{"city": "Oslo"}` {
+		t.Errorf("Expected the repaired arguments, got %q", args)
+	}
+	if resp.Usage.TotalTokens != 64 {
+		t.Errorf("Expected the usage of the repair to be added, got %d", resp.Usage.TotalTokens)
+	}
+	if len(client.requests) != 2 || !strings.Contains(client.requests[1].Messages[1].Content, `"required": ["city"]`) {
+		t.Errorf("Expected a repair request with the parameter schema, got %+v", client.requests)
+	}
+}
+
+func TestProxyServer_ToolCallRepairFails(t *testing.T) {
+	client := &toolCallClient{arguments: `{"town": "Oslo"}`, repair: `{"town": "Oslo"}`}
+	server := NewProxyServer(client)
+	server.toolCallValidation = ToolCallsRepair
+
+	resp := toolCallResponse(t, server)
+	if resp.Metadata == nil || resp.Metadata.RepairedToolCalls != 0 || len(resp.Metadata.ToolCallErrors) != 1 {
+		t.Fatalf("Expected the call to be reported as invalid, got %+v", resp.Metadata)
+	}
+	if !strings.Contains(resp.Metadata.ToolCallErrors[0], "still invalid after repair") {
+		t.Errorf("Expected the failed repair to be reported, got %q", resp.Metadata.ToolCallErrors[0])
+	}
+	if args := resp.Choices[0].Message.ToolCalls[0].Function.Arguments; args != `{"town": "Oslo"}` {
+		t.Errorf("Expected the original arguments to be kept, got %q", args)
+	}
+}
+
+func TestProxyServer_ToolCallUnchecked(t *testing.T) {
+	client := &toolCallClient{arguments: `not json`}
+	server := NewProxyServer(client)
+
+	resp := toolCallResponse(t, server)
+	if resp.Metadata != nil {
+		t.Errorf("Expected no metadata with validation off, got %+v", resp.Metadata)
+	}
+	if args := resp.Choices[0].Message.ToolCalls[0].Function.Arguments; args != "not json" {
+		t.Errorf("Expected the arguments untouched, got %q", args)
+	}
+}
+
+func TestCheckArguments(t *testing.T) {
+	schemas := map[string]*compiledSchema{"free": nil}
+	tests := []struct {
+		call ToolCall
+		want string
+	}{
+		{ToolCall{Function: ToolCallFunction{Name: "free", Arguments: `{"any": 1}`}}, ""},
+		{ToolCall{Function: ToolCallFunction{Name: "free"}}, ""},
+		{ToolCall{Function: ToolCallFunction{Name: "free", Arguments: `{`}}, "not valid JSON"},
+		{ToolCall{Function: ToolCallFunction{Name: "delete_all", Arguments: `{}`}}, `unknown function "delete_all"`},
+	}
+	for _, tt := range tests {
+		err := checkArguments(tt.call, schemas)
+		if tt.want == "" && err != nil {
+			t.Errorf("Expected %s to be valid, got %v", tt.call.Function.Arguments, err)
+		}
+		if tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)) {
+			t.Errorf("Expected an error containing %q, got %v", tt.want, err)
+		}
+	}
+}
+
+func TestProxyServer_ToolCallingRoundTrip(t *testing.T) {
+	reply := createTestChatCompletionResponse()
+	reply.Choices[0] = Choice{
+		Message: Message{Role: "assistant", ToolCalls: []ToolCall{
+			{ID: "call_1", Type: "function", Function: ToolCallFunction{Name: "get_weather", Arguments: `{"city":"Paris"}`}},
+			{ID: "call_2", Type: "function", Function: ToolCallFunction{Name: "get_weather", Arguments: `{"city":"Rome"}`}},
+		}},
+		FinishReason: "tool_calls",
+	}
+	recorder := &requestRecorder{OpenAIClient: &MockOpenAIClient{response: reply}}
+	server := NewProxyServer(recorder)
+
+	body := `{"model": "gpt-4o", "parallel_tool_calls": true, "tool_choice": {"type": "function", "function": {"name": "get_weather"}},
+		"tools": [{"type": "function", "function": {"name": "get_weather", "parameters": {"type": "object"}}}],
+		"functions": [{"name": "legacy"}], "function_call": "auto",
+		"messages": [
+			{"role": "user", "content": "Weather in Paris and Rome?"},
+			{"role": "assistant", "content": null, "tool_calls": [{"id": "call_0", "type": "function", "function": {"name": "get_weather", "arguments": "{}"}}]},
+			{"role": "tool", "tool_call_id": "call_0", "content": "Sunny"},
+			{"role": "function", "name": "legacy", "content": "ok"}
+		]}`
+	w := httptest.NewRecorder()
+	server.handleChatCompletions(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	sent, _ := json.Marshal(recorder.last)
+	for _, want := range []string{
+		`"parallel_tool_calls":true`,
+		`"tool_choice":{"type":"function","function":{"name":"get_weather"}}`,
+		`"functions":[{"name":"legacy"}]`,
+		`"function_call":"auto"`,
+		`{"role":"assistant","tool_calls":[{"id":"call_0"`,
+		`"content":null}`,
+		`{"role":"tool","content":"Sunny","tool_call_id":"call_0"}`,
+		`{"role":"function","content":"ok","name":"legacy"}`,
+	} {
+		if !strings.Contains(string(sent), want) {
+			t.Errorf("Expected the upstream request to contain %s, got %s", want, sent)
+		}
+	}
+
+	var resp struct {
+		Choices []struct {
+			Message struct {
+				Content   *string    `json:"content"`
+				ToolCalls []ToolCall `json:"tool_calls"`
+			} `json:"message"`
+			FinishReason string `json:"finish_reason"`
+		} `json:"choices"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	choice := resp.Choices[0]
+	if choice.FinishReason != "tool_calls" || choice.Message.Content != nil || len(choice.Message.ToolCalls) != 2 || choice.Message.ToolCalls[1].ID != "call_2" {
+		t.Errorf("Expected both tool calls with null content, got %s", w.Body.String())
+	}
+}
+
+func TestValidateToolMessages(t *testing.T) {
+	tests := []struct {
+		name string
+		req  ChatCompletionRequest
+		want string
+	}{
+		{"tool result without call ID", ChatCompletionRequest{Messages: []Message{{Role: "tool", Content: "Sunny"}}}, "tool_call_id"},
+		{"function message without name", ChatCompletionRequest{Messages: []Message{{Role: "function", Content: "ok"}}}, "must have a name"},
+		{"call without ID", ChatCompletionRequest{Messages: []Message{{Role: "assistant", ToolCalls: []ToolCall{{Function: ToolCallFunction{Name: "f"}}}}}}, "tool_calls[0]"},
+		{"tool without name", ChatCompletionRequest{Tools: []Tool{{Type: "function"}}}, "tools[0]"},
+		{"valid", ChatCompletionRequest{Tools: []Tool{{Type: "function", Function: ToolFunction{Name: "f"}}}, Messages: []Message{{Role: "tool", ToolCallID: "call_1"}}}, ""},
+	}
+	for _, tt := range tests {
+		err := validateToolMessages(tt.req)
+		if tt.want == "" && err != nil {
+			t.Errorf("%s: expected no error, got %v", tt.name, err)
+		}
+		if tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)) {
+			t.Errorf("%s: expected an error containing %q, got %v", tt.name, tt.want, err)
+		}
+	}
+}
+
+func TestProxyServer_ValidatesToolMessagesOnPassthrough(t *testing.T) {
+	upstream := newRecordingUpstream(t)
+	client := NewRealOpenAIClient("sk-test")
+	client.BaseURL = upstream.URL
+	server := NewProxyServer(client)
+	server.submissions = nil
+
+	for _, body := range []string{
+		`{"model":"gpt-4o","messages":[{"role":"user","content":"Hi"}],"tools":[{"type":"function","function":{}}]}`,
+		`{"model":"gpt-4o","messages":[{"role":"user","content":"Hi"}],"functions":[{"parameters":{}}]}`,
+		`{"model":"gpt-4o","messages":[{"role":"tool","content":"Sunny"}]}`,
+		`{"model":"gpt-4o","messages":[{"role":"assistant","content":null,"tool_calls":[{"type":"function","function":{"name":"f","arguments":"{}"}}]}]}`,
+	} {
+		w := httptest.NewRecorder()
+		server.Handler().ServeHTTP(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body)))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected %s to be rejected, got %d", body, w.Code)
+		}
+	}
+	if upstream.body != "" {
+		t.Errorf("Expected nothing to go upstream, got %s", upstream.body)
+	}
+
+	body := `{"model":"gpt-4o","messages":[{"role":"assistant","content":null,"tool_calls":[{"id":"call_1","type":"function","function":{"name":"f","arguments":"{}"}}]},{"role":"tool","tool_call_id":"call_1","content":"Sunny"}]}`
+	w := httptest.NewRecorder()
+	server.Handler().ServeHTTP(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body)))
+	if w.Code != http.StatusOK || upstream.body != body {
+		t.Errorf("Expected valid tool turns to be forwarded as they are, got %d %s", w.Code, upstream.body)
+	}
+}
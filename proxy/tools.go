@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// builtinTool is a tool the proxy runs itself. A chat completion offers it
+// to the model with the builtin_tools extension, and the proxy answers the
+// model's calls to it and asks again, so the client only sees the final
+// reply.
+type builtinTool interface {
+	// definition declares the tool to the model under name
+	definition(name string) ToolFunction
+	// call runs the tool with the arguments the model passed and returns
+	// what the model gets to see
+	call(ctx context.Context, arguments string) (string, error)
+}
+
+// ToolRun is a call to a builtin tool answered by the proxy
+type ToolRun struct {
+	// Round counts the replies of the model, from 1 for the first
+	Round      int    `json:"round"`
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	Arguments  string `json:"arguments"`
+	Output     string `json:"output,omitempty"`
+	Error      string `json:"error,omitempty"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+// offerBuiltinTools declares the builtin tools a request asks for next to
+// its own and returns them by name
+func (s *ProxyServer) offerBuiltinTools(req *ChatCompletionRequest) (map[string]builtinTool, error) {
+	if len(req.BuiltinTools) == 0 {
+		return nil, nil
+	}
+	offered := make(map[string]builtinTool, len(req.BuiltinTools))
+	for _, name := range req.BuiltinTools {
+		tool, ok := s.builtinTools[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown builtin tool %q", name)
+		}
+		offered[name] = tool
+	}
+	tools := make([]Tool, 0, len(req.Tools)+len(offered))
+	for _, tool := range req.Tools {
+		if _, ok := offered[tool.Function.Name]; ok {
+			return nil, fmt.Errorf("tool %s is both declared and builtin", tool.Function.Name)
+		}
+		tools = append(tools, tool)
+	}
+	for _, name := range req.BuiltinTools {
+		tools = append(tools, Tool{Type: "function", Function: offered[name].definition(name)})
+	}
+	req.Tools = tools
+	req.BuiltinTools = nil
+	return offered, nil
+}
+
+// runAgent sends req upstream, answers the calls of the model to builtin
+// tools with their results and asks it again, until it replies without
+// calling one or toolMaxRounds is reached. A reply that also calls one of
+// the client's tools is returned as it is, since the client has to answer
+// those. The usage of every reply is added up, the calls are listed in the
+// metadata and every step is recorded in run.
+func (s *ProxyServer) runAgent(ctx context.Context, req ChatCompletionRequest, offered map[string]builtinTool, run *AgentRun) (*ChatCompletionResponse, error) {
+	start := time.Now()
+	defer func() { run.DurationMS = time.Since(start).Milliseconds() }()
+	req.Messages = append([]Message(nil), req.Messages...)
+	var runs []ToolRun
+	var stopped string
+	for round := 1; ; round++ {
+		resp, err := s.createCompletion(ctx, req)
+		if err != nil {
+			run.Outcome, run.Error = AgentFailed, err.Error()
+			return nil, err
+		}
+		run.Usage.PromptTokens += resp.Usage.PromptTokens
+		run.Usage.CompletionTokens += resp.Usage.CompletionTokens
+		run.Usage.TotalTokens += resp.Usage.TotalTokens
+		step := AgentStep{Round: round, Model: resp.Model, Usage: resp.Usage}
+		if len(resp.Choices) > 0 {
+			step.Reply, step.FinishReason = resp.Choices[0].Message, resp.Choices[0].FinishReason
+		}
+
+		switch {
+		case len(step.Reply.ToolCalls) == 0:
+			run.Outcome = AgentCompleted
+		case !callsBuiltinOnly(step.Reply.ToolCalls, offered):
+			run.Outcome = AgentClientTools
+		case round > s.toolMaxRounds:
+			run.Outcome = AgentMaxRounds
+			stopped = fmt.Sprintf("stopped after %d rounds of builtin tool calls", s.toolMaxRounds)
+		}
+		if run.Outcome != "" {
+			run.Steps = append(run.Steps, step)
+			out := *resp
+			out.Usage = run.Usage
+			out.Metadata = withMetadata(out.Metadata)
+			out.Metadata.ToolRuns = runs
+			out.Metadata.ToolError = stopped
+			out.Metadata.AgentRunID = run.ID
+			return &out, nil
+		}
+
+		req.Messages = append(req.Messages, step.Reply)
+		for _, call := range step.Reply.ToolCalls {
+			toolRun := s.callBuiltinTool(ctx, offered[call.Function.Name], call)
+			toolRun.Round = round
+			step.ToolRuns = append(step.ToolRuns, toolRun)
+			content := toolRun.Output
+			if toolRun.Error != "" {
+				content = "Error: " + toolRun.Error
+			}
+			req.Messages = append(req.Messages, Message{Role: "tool", ToolCallID: call.ID, Content: content})
+		}
+		runs = append(runs, step.ToolRuns...)
+		run.Steps = append(run.Steps, step)
+	}
+}
+
+// callsBuiltinOnly reports whether there are calls and all are to builtin
+// tools
+func callsBuiltinOnly(calls []ToolCall, offered map[string]builtinTool) bool {
+	for _, call := range calls {
+		if _, ok := offered[call.Function.Name]; !ok {
+			return false
+		}
+	}
+	return len(calls) > 0
+}
+
+// callBuiltinTool runs one call. Failures are reported to the model rather
+// than failing the request, so it can correct itself.
+func (s *ProxyServer) callBuiltinTool(ctx context.Context, tool builtinTool, call ToolCall) ToolRun {
+	run := ToolRun{ID: call.ID, Name: call.Function.Name, Arguments: call.Function.Arguments}
+	start := time.Now()
+	output, err := tool.call(ctx, call.Function.Arguments)
+	run.DurationMS = time.Since(start).Milliseconds()
+	if err != nil {
+		log.Printf("Builtin tool %s failed: %v", run.Name, err)
+		run.Error = err.Error()
+		return run
+	}
+	run.Output = output
+	return run
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// toolLoopClient calls tool until the conversation has rounds tool
+// results, then replies with the last of them
+type toolLoopClient struct {
+	tool     string
+	rounds   int
+	requests []ChatCompletionRequest
+}
+
+func (m *toolLoopClient) CreateChatCompletion(req ChatCompletionRequest) (*ChatCompletionResponse, error) {
+	m.requests = append(m.requests, req)
+	resp := *createTestChatCompletionResponse()
+	resp.Choices = append([]Choice(nil), resp.Choices...)
+	var results []string
+	for _, msg := range req.Messages {
+		if msg.Role == "tool" {
+			results = append(results, msg.Content)
+		}
+	}
+	if len(results) >= m.rounds {
+		resp.Choices[0].Message = Message{Role: "assistant", Content: results[len(results)-1]}
+		return &resp, nil
+	}
+	resp.Choices[0].Message = Message{Role: "assistant", ToolCalls: []ToolCall{{
+		ID:       fmt.Sprintf("call_%d", len(results)+1),
+		Type:     "function",
+		Function: ToolCallFunction{Name: m.tool, Arguments: fmt.Sprintf(`{"n": %d}`, len(results)+1)},
+	}}}
+	return &resp, nil
+}
+
+// echoTool returns its arguments, or fails on n = fail
+type echoTool struct{ fail int }
+
+func (echoTool) definition(name string) ToolFunction {
+	return ToolFunction{Name: name, Parameters: json.RawMessage(`{"type": "object"}`)}
+}
+
+func (t echoTool) call(ctx context.Context, arguments string) (string, error) {
+	if arguments == fmt.Sprintf(`{"n": %d}`, t.fail) {
+		return "", fmt.Errorf("failed on purpose")
+	}
+	return "echo " + arguments, nil
+}
+
+func TestProxyServer_BuiltinTools(t *testing.T) {
+	client := &toolLoopClient{tool: "echo", rounds: 2}
+	server := NewProxyServer(client)
+	server.builtinTools["echo"] = echoTool{fail: 1}
+
+	w := chatRequestAs(server, nil, `{"model": "gpt-4o", "messages": [{"role": "user", "content": "Go"}], "builtin_tools": ["echo"]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var resp ChatCompletionResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Choices[0].Message.Content != `echo {"n": 2}` {
+		t.Errorf("Expected the reply after the tool results, got %+v", resp.Choices[0].Message)
+	}
+	if len(client.requests) != 3 || resp.Usage.TotalTokens != 96 {
+		t.Errorf("Expected 3 upstream requests with their usage added up, got %d and %+v", len(client.requests), resp.Usage)
+	}
+	if tools := client.requests[0].Tools; len(tools) != 1 || tools[0].Function.Name != "echo" || client.requests[0].BuiltinTools != nil {
+		t.Errorf("Expected the builtin tool declared upstream instead of the extension, got %+v", client.requests[0])
+	}
+	last := client.requests[2].Messages
+	if len(last) != 5 || last[2].Role != "tool" || last[2].ToolCallID != "call_1" || last[2].Content != "Error: failed on purpose" {
+		t.Errorf("Expected the calls and their results in the conversation, got %+v", last)
+	}
+	if runs := resp.Metadata.ToolRuns; len(runs) != 2 || runs[0].Error == "" || runs[1].Round != 2 || runs[1].Output != `echo {"n": 2}` {
+		t.Errorf("Expected both runs in the metadata, got %+v", runs)
+	}
+}
+
+func TestProxyServer_BuiltinToolsMaxRounds(t *testing.T) {
+	client := &toolLoopClient{tool: "echo", rounds: 10}
+	server := NewProxyServer(client)
+	server.builtinTools["echo"] = echoTool{}
+	server.toolMaxRounds = 3
+
+	w := chatRequestAs(server, nil, `{"model": "gpt-4o", "messages": [{"role": "user", "content": "Go"}], "builtin_tools": ["echo"]}`)
+	var resp ChatCompletionResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if len(client.requests) != 4 || len(resp.Metadata.ToolRuns) != 3 || !strings.Contains(resp.Metadata.ToolError, "3 rounds") {
+		t.Errorf("Expected the loop to stop after 3 rounds, got %d requests and %+v", len(client.requests), resp.Metadata)
+	}
+	if len(resp.Choices[0].Message.ToolCalls) != 1 {
+		t.Errorf("Expected the last call returned to the client, got %+v", resp.Choices[0].Message)
+	}
+}
+
+func TestProxyServer_BuiltinToolsClientCalls(t *testing.T) {
+	// Calls to the client's own tools are left to the client
+	client := &toolLoopClient{tool: "lookup", rounds: 1}
+	server := NewProxyServer(client)
+	server.builtinTools["echo"] = echoTool{}
+
+	w := chatRequestAs(server, nil, `{"model": "gpt-4o", "messages": [{"role": "user", "content": "Go"}], "builtin_tools": ["echo"],
+		"tools": [{"type": "function", "function": {"name": "lookup"}}]}`)
+	var resp ChatCompletionResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if len(client.requests) != 1 || len(resp.Choices[0].Message.ToolCalls) != 1 || len(resp.Metadata.ToolRuns) != 0 {
+		t.Errorf("Expected the call to lookup returned as is, got %+v", resp)
+	}
+}
+
+func TestProxyServer_BuiltinToolsInvalid(t *testing.T) {
+	server := NewProxyServer(&toolLoopClient{})
+	server.builtinTools["echo"] = echoTool{}
+	for _, body := range []string{
+		`{"model": "gpt-4o", "messages": [{"role": "user", "content": "Go"}], "builtin_tools": ["browser"]}`,
+		`{"model": "gpt-4o", "messages": [{"role": "user", "content": "Go"}], "builtin_tools": ["echo"], "tools": [{"type": "function", "function": {"name": "echo"}}]}`,
+	} {
+		if w := chatRequestAs(server, nil, body); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status code %d for %s, got %d", http.StatusBadRequest, body, w.Code)
+		}
+	}
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With OTEL_EXPORTER_OTLP_ENDPOINT set, every request to the API is traced
+// and its spans exported to an OpenTelemetry collector over OTLP/HTTP, so
+// the time spent in the proxy shows up in the traces of the applications
+// calling it. A request continues the trace of its traceparent header, if
+// it has one, and passes the trace on to the upstream in the same header.
+// The proxy has no dependencies, so rather than the OpenTelemetry SDK it
+// carries this much of it: W3C trace context and the JSON encoding of
+// OTLP.
+//
+// A request gets a server span, with child spans for its phases as the
+// request timeline records them (validate, route, upstream and stream or
+// write response) and a client span for each upstream call.
+
+const (
+	// traceExportInterval is how often finished spans are exported
+	traceExportInterval = 5 * time.Second
+	// maxPendingSpans bounds the spans waiting for export; older ones are
+	// dropped when the collector cannot keep up
+	maxPendingSpans   = 8192
+	traceparentHeader = "traceparent"
+)
+
+// OTLP span kinds and status codes
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+
+	spanStatusError = 2
+)
+
+// tracer records spans and exports them to an OTLP collector
+type tracer struct {
+	endpoint string
+	headers  map[string]string
+	service  string
+	// ratio is the fraction of new traces recorded; requests continuing a
+	// trace follow the sampling decision of their caller
+	ratio  float64
+	client *http.Client
+
+	mu      sync.Mutex
+	pending []otlpSpan
+	dropped int
+}
+
+// tracerFromEnv configures tracing from the standard OpenTelemetry
+// variables, or returns nil if no endpoint is set
+func tracerFromEnv(getenv func(string) string) (*tracer, error) {
+	endpoint := getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" {
+		if base := getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); base != "" {
+			endpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+		}
+	}
+	if endpoint == "" {
+		return nil, nil
+	}
+	t := &tracer{endpoint: endpoint, headers: map[string]string{}, service: "vibethon-proxy", ratio: 1, client: &http.Client{Timeout: 10 * time.Second}}
+	if v := getenv("OTEL_SERVICE_NAME"); v != "" {
+		t.service = v
+	}
+	if v := getenv("OTEL_EXPORTER_OTLP_HEADERS"); v != "" {
+		for _, pair := range strings.Split(v, ",") {
+			name, value, ok := strings.Cut(pair, "=")
+			if !ok || strings.TrimSpace(name) == "" {
+				return nil, fmt.Errorf("invalid OTEL_EXPORTER_OTLP_HEADERS %q", v)
+			}
+			t.headers[strings.TrimSpace(name)] = strings.TrimSpace(value)
+		}
+	}
+	if v := getenv("OTEL_TRACES_SAMPLER_ARG"); v != "" {
+		ratio, err := strconv.ParseFloat(v, 64)
+		if err != nil || ratio < 0 || ratio > 1 {
+			return nil, fmt.Errorf("invalid OTEL_TRACES_SAMPLER_ARG %q, expected a ratio between 0 and 1", v)
+		}
+		t.ratio = ratio
+	}
+	return t, nil
+}
+
+// span is an operation of a trace. Its methods do nothing on a nil span,
+// as requests have when tracing is off.
+type span struct {
+	tracer   *tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	sampled  bool
+
+	mu    sync.Mutex
+	data  otlpSpan
+	ended bool
+}
+
+const spanContextKey contextKey = timelineContextKey + 1
+
+// spanFromContext returns the span of ctx, or nil
+func spanFromContext(ctx context.Context) *span {
+	s, _ := ctx.Value(spanContextKey).(*span)
+	return s
+}
+
+// parseTraceparent returns the trace ID, parent span ID and sampled flag of
+// a W3C traceparent header, such as
+// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+func parseTraceparent(v string) (traceID [16]byte, parentID [8]byte, sampled bool, ok bool) {
+	parts := strings.Split(v, "-")
+	// Later versions may add fields, version 00 has none
+	if len(parts) < 4 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return traceID, parentID, false, false
+	}
+	var version, flags [1]byte
+	for _, field := range []struct {
+		dst []byte
+		src string
+	}{{version[:], parts[0]}, {traceID[:], parts[1]}, {parentID[:], parts[2]}, {flags[:], parts[3]}} {
+		if hex.DecodedLen(len(field.src)) != len(field.dst) {
+			return traceID, parentID, false, false
+		}
+		if _, err := hex.Decode(field.dst, []byte(field.src)); err != nil {
+			return traceID, parentID, false, false
+		}
+	}
+	if traceID == [16]byte{} || parentID == [8]byte{} {
+		return traceID, parentID, false, false
+	}
+	return traceID, parentID, flags[0]&1 == 1, true
+}
+
+// traceparent returns the header that continues the trace from the span
+func (sp *span) traceparent() string {
+	flags := "00"
+	if sp.sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(sp.traceID[:]) + "-" + hex.EncodeToString(sp.spanID[:]) + "-" + flags
+}
+
+// startRequest starts the server span of r, continuing the trace of its
+// traceparent header if it has one
+func (t *tracer) startRequest(r *http.Request) (context.Context, *span) {
+	if t == nil {
+		return r.Context(), nil
+	}
+	sp := &span{tracer: t}
+	var ok bool
+	if sp.traceID, sp.parentID, sp.sampled, ok = parseTraceparent(r.Header.Get(traceparentHeader)); !ok {
+		rand.Read(sp.traceID[:])
+		sp.parentID = [8]byte{}
+		sp.sampled = t.ratio >= 1 || float64(binary.BigEndian.Uint64(sp.traceID[8:])>>11)/(1<<53) < t.ratio
+	}
+	// The route of the request, such as /v1/pipelines/{name}/run, rather
+	// than its path keeps IDs out of span names
+	route := r.URL.Path
+	if r.Pattern != "" {
+		_, route, _ = strings.Cut(r.Pattern, "/")
+		route = "/" + route
+	}
+	sp.begin(r.Method+" "+route, spanKindServer, time.Now())
+	return context.WithValue(r.Context(), spanContextKey, sp), sp
+}
+
+// startSpan starts a child of the span of ctx, or returns nil if ctx has
+// none
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *span) {
+	parent := spanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	sp := parent.child(name, kind, time.Now())
+	return context.WithValue(ctx, spanContextKey, sp), sp
+}
+
+// child starts a span under sp
+func (sp *span) child(name string, kind int, start time.Time) *span {
+	c := &span{tracer: sp.tracer, traceID: sp.traceID, parentID: sp.spanID, sampled: sp.sampled}
+	c.begin(name, kind, start)
+	return c
+}
+
+func (sp *span) begin(name string, kind int, start time.Time) {
+	rand.Read(sp.spanID[:])
+	sp.data = otlpSpan{
+		TraceID:   hex.EncodeToString(sp.traceID[:]),
+		SpanID:    hex.EncodeToString(sp.spanID[:]),
+		Name:      name,
+		Kind:      kind,
+		StartTime: unixNano(start),
+	}
+	if sp.parentID != [8]byte{} {
+		sp.data.ParentSpanID = hex.EncodeToString(sp.parentID[:])
+	}
+}
+
+// SetAttr sets an attribute of the span, a string, int or bool
+func (sp *span) SetAttr(key string, value any) {
+	if sp == nil || !sp.sampled {
+		return
+	}
+	var v otlpValue
+	switch value := value.(type) {
+	case string:
+		v.String = &value
+	case int:
+		s := strconv.Itoa(value)
+		v.Int = &s
+	case bool:
+		v.Bool = &value
+	default:
+		s := fmt.Sprint(value)
+		v.String = &s
+	}
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.data.Attributes = append(sp.data.Attributes, otlpKeyValue{Key: key, Value: v})
+}
+
+// AddEvent records something that happened at a point of the span
+func (sp *span) AddEvent(name, detail string, at time.Time) {
+	if sp == nil || !sp.sampled {
+		return
+	}
+	event := otlpEvent{Name: name, Time: unixNano(at)}
+	if detail != "" {
+		event.Attributes = []otlpKeyValue{{Key: "detail", Value: otlpValue{String: &detail}}}
+	}
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.data.Events = append(sp.data.Events, event)
+}
+
+// SetError marks the span failed
+func (sp *span) SetError(message string) {
+	if sp == nil {
+		return
+	}
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.data.Status = &otlpStatus{Code: spanStatusError, Message: message}
+}
+
+// End finishes the span and queues it for export
+func (sp *span) End() {
+	sp.EndAt(time.Now())
+}
+
+// EndAt finishes the span at the given time
+func (sp *span) EndAt(end time.Time) {
+	if sp == nil || !sp.sampled {
+		return
+	}
+	sp.mu.Lock()
+	if sp.ended {
+		sp.mu.Unlock()
+		return
+	}
+	sp.ended = true
+	sp.data.EndTime = unixNano(end)
+	data := sp.data
+	sp.mu.Unlock()
+	sp.tracer.queue(data)
+}
+
+func (t *tracer) queue(data otlpSpan) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.pending) >= maxPendingSpans {
+		t.pending = t.pending[1:]
+		t.dropped++
+	}
+	t.pending = append(t.pending, data)
+}
+
+// Export sends the finished spans to the collector
+func (t *tracer) Export(ctx context.Context) error {
+	t.mu.Lock()
+	spans, dropped := t.pending, t.dropped
+	t.pending, t.dropped = nil, 0
+	t.mu.Unlock()
+	if dropped > 0 {
+		log.Printf("Dropped %d spans the collector could not take in time", dropped)
+	}
+	if len(spans) == 0 {
+		return nil
+	}
+	payload := otlpTraces{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpKeyValue{{Key: "service.name", Value: otlpValue{String: &t.service}}}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "github.com/vibethon/proxy"},
+			Spans: spans,
+		}},
+	}}}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range t.headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to export %d spans: %w", len(spans), err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("failed to export %d spans: collector returned %d", len(spans), resp.StatusCode)
+	}
+	return nil
+}
+
+// traceRequest records the phases of a finished request as children of its
+// server span, from the events of its timeline, and ends the span
+func traceRequest(sp *span, timeline *requestTimeline, status int, streamed bool) {
+	if sp == nil || !sp.sampled {
+		return
+	}
+	snap := timeline.snapshot()
+	sp.SetAttr("http.request.method", snap.Method)
+	sp.SetAttr("url.path", snap.Path)
+	sp.SetAttr("http.response.status_code", status)
+	sp.SetAttr("vibethon.request_id", snap.RequestID)
+	if snap.KeyID != "" {
+		sp.SetAttr("vibethon.key_id", snap.KeyID)
+	}
+	if snap.Tenant != "" {
+		sp.SetAttr("vibethon.tenant", snap.Tenant)
+	}
+	if status >= 500 {
+		sp.SetError(http.StatusText(status))
+	}
+
+	at := map[string]time.Time{}
+	for _, event := range snap.Events {
+		sp.AddEvent(event.Event, event.Detail, event.Time)
+		if _, ok := at[event.Event]; !ok {
+			at[event.Event] = event.Time
+		}
+	}
+	last := "write response"
+	if streamed {
+		last = "stream"
+	}
+	for _, phase := range []struct{ name, from, to string }{
+		{"validate", TimelineReceived, TimelineValidated},
+		{"route", TimelineValidated, TimelineRouted},
+		{"upstream", TimelineRouted, TimelineFirstToken},
+		{last, TimelineFirstToken, TimelineCompleted},
+	} {
+		from, ok1 := at[phase.from]
+		to, ok2 := at[phase.to]
+		if ok1 && ok2 {
+			sp.child(phase.name, spanKindInternal, from).EndAt(to)
+		}
+	}
+	sp.EndAt(at[TimelineCompleted])
+}
+
+// traceUpstream starts the client span of an upstream request and passes
+// the trace on in its traceparent header
+func traceUpstream(req *http.Request) *span {
+	_, sp := startSpan(req.Context(), "upstream "+req.Method+" "+req.URL.Path, spanKindClient)
+	if sp == nil {
+		return nil
+	}
+	req.Header.Set(traceparentHeader, sp.traceparent())
+	sp.SetAttr("http.request.method", req.Method)
+	sp.SetAttr("server.address", req.URL.Hostname())
+	sp.SetAttr("url.path", req.URL.Path)
+	return sp
+}
+
+// endUpstream ends the client span of an upstream request with its outcome
+func endUpstream(sp *span, resp *http.Response, err error) {
+	if sp == nil {
+		return
+	}
+	if err != nil {
+		sp.SetError(err.Error())
+	} else {
+		sp.SetAttr("http.response.status_code", resp.StatusCode)
+		if resp.StatusCode >= 400 {
+			sp.SetError(http.StatusText(resp.StatusCode))
+		}
+	}
+	sp.End()
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// The JSON encoding of OTLP trace exports
+
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID      string         `json:"traceId"`
+	SpanID       string         `json:"spanId"`
+	ParentSpanID string         `json:"parentSpanId,omitempty"`
+	Name         string         `json:"name"`
+	Kind         int            `json:"kind"`
+	StartTime    string         `json:"startTimeUnixNano"`
+	EndTime      string         `json:"endTimeUnixNano"`
+	Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+	Events       []otlpEvent    `json:"events,omitempty"`
+	Status       *otlpStatus    `json:"status,omitempty"`
+}
+
+type otlpEvent struct {
+	Time       string         `json:"timeUnixNano"`
+	Name       string         `json:"name"`
+	Attributes []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	String *string `json:"stringValue,omitempty"`
+	// Int is a decimal string, as OTLP encodes 64-bit integers in JSON
+	Int  *string `json:"intValue,omitempty"`
+	Bool *bool   `json:"boolValue,omitempty"`
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		header  string
+		ok      bool
+		sampled bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true, false},
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false, false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902bz-01", false, false},
+		{"", false, false},
+	}
+	for _, tt := range tests {
+		_, _, sampled, ok := parseTraceparent(tt.header)
+		if ok != tt.ok || sampled != tt.sampled {
+			t.Errorf("%q: expected ok=%v sampled=%v, got %v %v", tt.header, tt.ok, tt.sampled, ok, sampled)
+		}
+	}
+}
+
+func TestTracerFromEnv(t *testing.T) {
+	tracerFrom := func(env map[string]string) (*tracer, error) {
+		return tracerFromEnv(func(name string) string { return env[name] })
+	}
+	if tr, err := tracerFrom(nil); tr != nil || err != nil {
+		t.Errorf("Expected no tracer without an endpoint, got %v and %v", tr, err)
+	}
+	tr, err := tracerFrom(map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4318/", "OTEL_EXPORTER_OTLP_HEADERS": "x-honeycomb-team=abc, x-dataset=proxy", "OTEL_SERVICE_NAME": "llm-gateway"})
+	if err != nil || tr.endpoint != "http://collector:4318/v1/traces" || tr.headers["x-dataset"] != "proxy" || tr.service != "llm-gateway" {
+		t.Errorf("Expected the collector settings, got %+v and %v", tr, err)
+	}
+	if _, err := tracerFrom(map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4318", "OTEL_TRACES_SAMPLER_ARG": "2"}); err == nil {
+		t.Error("Expected an error for a sampling ratio above 1")
+	}
+}
+
+func TestProxyServer_Tracing(t *testing.T) {
+	var exported otlpTraces
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		json.Unmarshal(body, &exported)
+	}))
+	defer collector.Close()
+	upstream := newRecordingUpstream(t)
+	client := NewRealOpenAIClient("sk-test")
+	client.BaseURL = upstream.URL
+	server := NewProxyServer(client)
+	server.tracer, _ = tracerFromEnv(func(name string) string {
+		if name == "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT" {
+			return collector.URL
+		}
+		return ""
+	})
+
+	const traceID, parentID = "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "gpt-4o", "messages": [{"role": "user", "content": "Hi"}]}`))
+	req.Header.Set("traceparent", "00-"+traceID+"-"+parentID+"-01")
+	w := httptest.NewRecorder()
+	server.Handler().ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	sent := upstream.last.Header.Get("traceparent")
+	if !strings.HasPrefix(sent, "00-"+traceID+"-") || strings.Contains(sent, parentID) {
+		t.Errorf("Expected the trace passed on upstream from a span of the proxy, got %q", sent)
+	}
+
+	if err := server.tracer.Export(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	if len(exported.ResourceSpans) != 1 || len(exported.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("Expected one batch of spans, got %+v", exported)
+	}
+	spans := map[string]otlpSpan{}
+	for _, sp := range exported.ResourceSpans[0].ScopeSpans[0].Spans {
+		if sp.TraceID != traceID {
+			t.Errorf("Expected span %s in the trace of the request, got %s", sp.Name, sp.TraceID)
+		}
+		spans[sp.Name] = sp
+	}
+	root, ok := spans["POST /v1/chat/completions"]
+	if !ok || root.Kind != spanKindServer || root.ParentSpanID != parentID {
+		t.Fatalf("Expected a server span under the caller's span, got %+v", spans)
+	}
+	for _, name := range []string{"validate", "route", "upstream", "write response"} {
+		if sp, ok := spans[name]; !ok || sp.ParentSpanID != root.SpanID {
+			t.Errorf("Expected a %s span under the server span, got %+v", name, sp)
+		}
+	}
+	call, ok := spans["upstream POST /chat/completions"]
+	if !ok || call.Kind != spanKindClient || !strings.Contains(sent, call.SpanID) {
+		t.Errorf("Expected a client span for the upstream call, got %+v", call)
+	}
+}
+
+func TestProxyServer_TracingSamplesOut(t *testing.T) {
+	server := NewProxyServer(&MockOpenAIClient{response: createTestChatCompletionResponse()})
+	server.tracer = &tracer{endpoint: "http://collector.invalid", ratio: 0}
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "gpt-4o", "messages": [{"role": "user", "content": "Hi"}]}`))
+	server.Handler().ServeHTTP(httptest.NewRecorder(), req)
+	// The caller's decision wins over the ratio
+	req = httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "gpt-4o", "messages": [{"role": "user", "content": "Hi"}]}`))
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	server.Handler().ServeHTTP(httptest.NewRecorder(), req)
+	if got := len(server.tracer.pending); got == 0 {
+		t.Error("Expected the sampled request to be recorded")
+	}
+	for _, sp := range server.tracer.pending {
+		if sp.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Errorf("Expected only the sampled trace to be recorded, got %s", sp.TraceID)
+		}
+	}
+}
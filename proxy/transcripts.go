@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Transcript export formats
+const (
+	TranscriptMarkdown = "markdown"
+	TranscriptJSON     = "json"
+	// One {"messages": [...]} line per conversation, the chat fine-tuning
+	// format of OpenAI
+	TranscriptFineTune = "jsonl"
+)
+
+// transcriptContentTypes maps each export format to its content type and
+// file extension
+var transcriptContentTypes = map[string][2]string{
+	TranscriptMarkdown: {"text/markdown; charset=utf-8", "md"},
+	TranscriptJSON:     {"application/json", "json"},
+	TranscriptFineTune: {"application/x-ndjson", "jsonl"},
+}
+
+// writeTranscripts writes sessions in format
+func writeTranscripts(w io.Writer, format string, sessions []Session) error {
+	switch format {
+	case TranscriptJSON:
+		return json.NewEncoder(w).Encode(map[string]any{"sessions": sessions})
+	case TranscriptFineTune:
+		return writeFineTuneJSONL(w, sessions)
+	default:
+		return writeMarkdownTranscripts(w, sessions)
+	}
+}
+
+func writeMarkdownTranscripts(w io.Writer, sessions []Session) error {
+	bw := bufio.NewWriter(w)
+	for i, session := range sessions {
+		if i > 0 {
+			bw.WriteString("\n---\n\n")
+		}
+		fmt.Fprintf(bw, "## %s\n\n_Last updated %s_\n", session.ID, session.Updated.Format(time.RFC3339))
+		for _, m := range session.Messages {
+			role := m.Role
+			if role != "" {
+				role = strings.ToUpper(role[:1]) + role[1:]
+			}
+			fmt.Fprintf(bw, "\n**%s:**\n\n%s\n", role, m.Content)
+		}
+	}
+	return bw.Flush()
+}
+
+// writeFineTuneJSONL writes one training example per session. Examples must
+// end with the assistant's turn, so a trailing unanswered message is cut and
+// sessions without any answer are skipped.
+func writeFineTuneJSONL(w io.Writer, sessions []Session) error {
+	enc := json.NewEncoder(w)
+	for _, session := range sessions {
+		messages := fineTuneMessages(session.Messages)
+		if len(messages) == 0 {
+			continue
+		}
+		if err := enc.Encode(map[string][]Message{"messages": messages}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fineTuneMessages cuts the messages after the assistant's last turn, and
+// returns nothing if it never answered
+func fineTuneMessages(messages []Message) []Message {
+	for len(messages) > 0 && messages[len(messages)-1].Role != "assistant" {
+		messages = messages[:len(messages)-1]
+	}
+	return messages
+}
+
+// SessionSummary describes a session without its messages
+type SessionSummary struct {
+	ID       string    `json:"id"`
+	Messages int       `json:"messages"`
+	Updated  time.Time `json:"updated"`
+}
+
+func (s *ProxyServer) listSessions() []SessionSummary {
+	sessions := s.sessions.List()
+	summaries := make([]SessionSummary, 0, len(sessions))
+	for _, session := range sessions {
+		summaries = append(summaries, SessionSummary{ID: session.ID, Messages: len(session.Messages), Updated: session.Updated})
+	}
+	return summaries
+}
+
+// handleAdminExportSessions exports one session, or every session when the
+// path has no ID, in the format given by ?format= (markdown by default).
+// ?prefix= narrows a full export to sessions whose ID starts with it, e.g.
+// "slack:", and ?anonymize= hashes session IDs and redacts PII (see
+// newAnonymizer).
+func (s *ProxyServer) handleAdminExportSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = TranscriptMarkdown
+	}
+	contentType, ok := transcriptContentTypes[format]
+	if !ok {
+		http.Error(w, "format must be markdown, json or jsonl", http.StatusBadRequest)
+		return
+	}
+	anon, err := newAnonymizer(r.URL.Query().Get("anonymize"), s.anonymizeSalt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var sessions []Session
+	name := "sessions"
+	if id := r.PathValue("id"); id != "" {
+		session, ok := s.sessions.Get(id)
+		if !ok {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		sessions, name = []Session{session}, anon.SessionID(id)
+	} else {
+		prefix := r.URL.Query().Get("prefix")
+		for _, session := range s.sessions.List() {
+			if strings.HasPrefix(session.ID, prefix) {
+				sessions = append(sessions, session)
+			}
+		}
+	}
+	for i, session := range sessions {
+		sessions[i] = anon.Session(session)
+	}
+
+	// Session IDs contain characters such as ":" that do not belong in a
+	// file name
+	filename := strings.Map(func(r rune) rune {
+		if r == '-' || r == '_' || r == '.' || ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || ('0' <= r && r <= '9') {
+			return r
+		}
+		return '_'
+	}, name)
+	w.Header().Set("Content-Type", contentType[0])
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.%s"`, filename, contentType[1]))
+	writeTranscripts(w, format, sessions)
+}
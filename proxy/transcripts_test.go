@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func newTestSessionServer() (*ProxyServer, *http.ServeMux) {
+	server := NewProxyServer(&MockOpenAIClient{})
+	server.sessions.Append("slack:C1", Message{Role: "user", Content: "Hi"}, Message{Role: "assistant", Content: "Hello!"}, Message{Role: "user", Content: "Still there?"})
+	server.sessions.Append("telegram:42", Message{Role: "user", Content: "Unanswered"})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/sessions", handleAdminList("sessions", server.listSessions))
+	mux.HandleFunc("/admin/sessions/export", server.handleAdminExportSessions)
+	mux.HandleFunc("/admin/sessions/{id}/export", server.handleAdminExportSessions)
+	return server, mux
+}
+
+func TestAdmin_ExportSessionMarkdown(t *testing.T) {
+	_, mux := newTestSessionServer()
+	w := adminRequest(mux, "GET", "/admin/sessions/slack:C1/export", "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	if cd := w.Header().Get("Content-Disposition"); cd != `attachment; filename="slack_C1.md"` {
+		t.Errorf("Unexpected Content-Disposition %q", cd)
+	}
+	out := w.Body.String()
+	for _, want := range []string{"## slack:C1\n", "**User:**\n\nHi\n", "**Assistant:**\n\nHello!\n"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected markdown to contain %q, got:\n%s", want, out)
+		}
+	}
+
+	if w := adminRequest(mux, "GET", "/admin/sessions/missing/export", "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d, got %d", http.StatusNotFound, w.Code)
+	}
+	if w := adminRequest(mux, "GET", "/admin/sessions/slack:C1/export?format=csv", "", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestAdmin_ExportSessionsFineTune(t *testing.T) {
+	_, mux := newTestSessionServer()
+	w := adminRequest(mux, "GET", "/admin/sessions/export?format=jsonl", "", nil)
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Expected one training example, got %q", w.Body.String())
+	}
+	var example struct {
+		Messages []Message `json:"messages"`
+	}
+	json.Unmarshal([]byte(lines[0]), &example)
+	if len(example.Messages) != 2 || example.Messages[1].Role != "assistant" {
+		t.Errorf("Expected the example to end with the answer, got %+v", example.Messages)
+	}
+}
+
+func TestAdmin_ExportSessionsJSON(t *testing.T) {
+	_, mux := newTestSessionServer()
+	w := adminRequest(mux, "GET", "/admin/sessions/export?format=json&prefix=telegram:", "", nil)
+	var resp struct {
+		Sessions []Session `json:"sessions"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if len(resp.Sessions) != 1 || resp.Sessions[0].ID != "telegram:42" {
+		t.Errorf("Expected only the Telegram session, got %s", w.Body.String())
+	}
+
+	w = adminRequest(mux, "GET", "/admin/sessions", "", nil)
+	if !strings.Contains(w.Body.String(), `{"id":"slack:C1","messages":3`) {
+		t.Errorf("Unexpected session list %s", w.Body.String())
+	}
+}
+
+func TestAdmin_ExportSessionsAnonymized(t *testing.T) {
+	server, mux := newTestSessionServer()
+	server.anonymizeSalt = "secret"
+	server.sessions.Append("slack:C1", Message{Role: "user", Content: "Mail ann@example.com"})
+	w := adminRequest(mux, "GET", "/admin/sessions/slack:C1/export?format=json&anonymize=ids,pii", "", nil)
+	var resp struct {
+		Sessions []Session `json:"sessions"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if len(resp.Sessions) != 1 {
+		t.Fatalf("Expected one session, got %s", w.Body.String())
+	}
+	session := resp.Sessions[0]
+	if !strings.HasPrefix(session.ID, "slack:anon-") || strings.Contains(w.Header().Get("Content-Disposition"), "C1") {
+		t.Errorf("Expected the session ID to be hashed, got %q and %q", session.ID, w.Header().Get("Content-Disposition"))
+	}
+	if last := session.Messages[len(session.Messages)-1].Content; last != "Mail [EMAIL]" {
+		t.Errorf("Expected PII to be redacted, got %q", last)
+	}
+
+	// The same salt gives the same pseudonym in a full export
+	w = adminRequest(mux, "GET", "/admin/sessions/export?format=json&anonymize=ids", "", nil)
+	if !strings.Contains(w.Body.String(), session.ID) {
+		t.Errorf("Expected pseudonym %s in %s", session.ID, w.Body.String())
+	}
+	if w := adminRequest(mux, "GET", "/admin/sessions/export?anonymize=names", "", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d, got %d", http.StatusBadRequest, w.Code)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func translateAs(server *ProxyServer, key *ClientKey, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/v1/translate", strings.NewReader(body))
+	if key != nil {
+		req = req.WithContext(context.WithValue(req.Context(), clientKeyContextKey, key))
+	}
+	w := httptest.NewRecorder()
+	server.handleTranslate(w, req)
+	return w
+}
+
+func TestProxyServer_Translate(t *testing.T) {
+	client := &summarizingClient{reply: " Hallo, Welt!\n"}
+	server := NewProxyServer(client)
+	server.translateModel = "gpt-4o-mini"
+
+	body := `{"text": "Hello, world!", "target_language": "de_de", "source_language": "EN", "glossary": {"world": "Welt", "Acme": "Acme"}}`
+	w := translateAs(server, nil, body)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var resp TranslateResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Text != "Hallo, Welt!" || resp.TargetLanguage != "de-DE" || resp.SourceLanguage != "en" || resp.Model != "gpt-4o-mini" || resp.Cached {
+		t.Errorf("Expected the translation into de-DE, got %+v", resp)
+	}
+	prompt := client.requests[0].Messages[0].Content
+	if !strings.Contains(prompt, "from English into German (de-DE).") || !strings.Contains(prompt, "\n- \"Acme\" → \"Acme\"\n- \"world\" → \"Welt\"") {
+		t.Errorf("Expected the languages and glossary in the prompt, got %q", prompt)
+	}
+	if client.requests[0].Messages[1].Content != "Hello, world!" {
+		t.Errorf("Expected the text as the user message, got %+v", client.requests[0].Messages)
+	}
+
+	w = translateAs(server, nil, body)
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if !resp.Cached || resp.Text != "Hallo, Welt!" || resp.Usage.TotalTokens != 0 || len(client.requests) != 1 {
+		t.Errorf("Expected the second translation from the cache, got %+v", resp)
+	}
+	// The cache is per tenant
+	translateAs(server, &ClientKey{ID: "acme-app", Tenant: "acme"}, body)
+	if len(client.requests) != 2 {
+		t.Errorf("Expected another tenant to miss the cache, got %d requests", len(client.requests))
+	}
+	// and per key for keys without a tenant
+	translateAs(server, &ClientKey{ID: "alice"}, body)
+	translateAs(server, &ClientKey{ID: "bob"}, body)
+	if len(client.requests) != 4 {
+		t.Errorf("Expected keys without a tenant not to share the cache, got %d requests", len(client.requests))
+	}
+	translateAs(server, &ClientKey{ID: "acme-web", Tenant: "acme"}, body)
+	if len(client.requests) != 4 {
+		t.Errorf("Expected keys of a tenant to share the cache, got %d requests", len(client.requests))
+	}
+}
+
+func TestProxyServer_TranslateErrors(t *testing.T) {
+	server := NewProxyServer(&summarizingClient{})
+	for _, body := range []string{
+		`{"text": "Hi", "target_language": "de"}`,
+		`{"model": "m", "target_language": "de"}`,
+		`{"model": "m", "text": "Hi"}`,
+		`{"model": "m", "text": "Hi", "target_language": "German"}`,
+		`{"model": "m", "text": "Hi", "target_language": "de", "source_language": "xx"}`,
+	} {
+		if w := translateAs(server, nil, body); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status code %d for %s, got %d", http.StatusBadRequest, body, w.Code)
+		}
+	}
+	key := &ClientKey{ID: "app", Scopes: KeyScopes{Models: []string{"gpt-4o"}}}
+	if w := translateAs(server, key, `{"model": "m", "text": "Hi", "target_language": "de"}`); w.Code != http.StatusForbidden {
+		t.Errorf("Expected status code %d, got %d", http.StatusForbidden, w.Code)
+	}
+}
+
+func TestParseLanguageTag(t *testing.T) {
+	for tag, want := range map[string]string{
+		"de":         "de",
+		"PT-br":      "pt-BR",
+		"zh-hant-tw": "zh-Hant-TW",
+		"sr_Latn":    "sr-Latn",
+		"es-419":     "es-419",
+	} {
+		if got, err := parseLanguageTag(tag); err != nil || got != want {
+			t.Errorf("Expected %s for %s, got %s (%v)", want, tag, got, err)
+		}
+	}
+	for _, tag := range []string{"", "deutsch", "xx", "de-DE-Latn", "de-D", "en-US-x-private", "zh-Hant-Hans"} {
+		if _, err := parseLanguageTag(tag); err == nil {
+			t.Errorf("Expected an error for %q", tag)
+		}
+	}
+}
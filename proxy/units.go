@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const convertToolParameters = `{
+	"type": "object",
+	"properties": {
+		"value": {"type": "number"},
+		"from": {"type": "string", "description": "The unit of value, e.g. km, lb, degF, GiB, or an ISO 4217 currency code like EUR"},
+		"to": {"type": "string", "description": "The unit to convert to, of the same kind"}
+	},
+	"required": ["value", "from", "to"]
+}`
+
+// unit is a unit of measurement: value*factor + offset is the value in the
+// base unit of its dimension. Only temperatures have an offset.
+type unit struct {
+	dimension string
+	factor    float64
+	offset    float64
+}
+
+// unitTable lists the units by dimension, the first of each dimension being
+// its base unit. Names are matched as written first, then ignoring case and
+// a plural s where that is unambiguous, so "MB" and "Mb" stay apart.
+var unitTable = []struct {
+	dimension string
+	factor    float64
+	names     []string
+}{
+	{"length", 1, []string{"m", "meter", "metre"}},
+	{"length", 1e3, []string{"km", "kilometer", "kilometre"}},
+	{"length", 1e-2, []string{"cm", "centimeter", "centimetre"}},
+	{"length", 1e-3, []string{"mm", "millimeter", "millimetre"}},
+	{"length", 1e-6, []string{"µm", "um", "micrometer", "micron"}},
+	{"length", 1e-9, []string{"nm", "nanometer"}},
+	{"length", 1609.344, []string{"mi", "mile"}},
+	{"length", 0.9144, []string{"yd", "yard"}},
+	{"length", 0.3048, []string{"ft", "foot", "feet"}},
+	{"length", 0.0254, []string{"in", "inch"}},
+	{"length", 1852, []string{"nmi", "nautical mile"}},
+
+	{"mass", 1, []string{"kg", "kilogram"}},
+	{"mass", 1e-3, []string{"g", "gram"}},
+	{"mass", 1e-6, []string{"mg", "milligram"}},
+	{"mass", 1e-9, []string{"µg", "ug", "microgram"}},
+	{"mass", 1e3, []string{"t", "tonne", "metric ton"}},
+	{"mass", 0.45359237, []string{"lb", "lbs", "pound"}},
+	{"mass", 0.028349523125, []string{"oz", "ounce"}},
+	{"mass", 6.35029318, []string{"st", "stone"}},
+
+	{"time", 1, []string{"s", "sec", "second"}},
+	{"time", 1e-3, []string{"ms", "millisecond"}},
+	{"time", 1e-6, []string{"µs", "us", "microsecond"}},
+	{"time", 1e-9, []string{"ns", "nanosecond"}},
+	{"time", 60, []string{"min", "minute"}},
+	{"time", 3600, []string{"h", "hr", "hour"}},
+	{"time", 86400, []string{"d", "day"}},
+	{"time", 604800, []string{"wk", "week"}},
+	// A Julian year of 365.25 days
+	{"time", 31557600, []string{"yr", "year"}},
+
+	{"volume", 1, []string{"m3", "m³", "cubic meter", "cubic metre"}},
+	{"volume", 1e-3, []string{"l", "L", "liter", "litre"}},
+	{"volume", 1e-6, []string{"ml", "mL", "milliliter", "millilitre", "cm3", "cm³"}},
+	{"volume", 3.785411784e-3, []string{"gal", "gallon"}},
+	{"volume", 4.54609e-3, []string{"imp gal", "imperial gallon"}},
+	{"volume", 9.46352946e-4, []string{"qt", "quart"}},
+	{"volume", 4.73176473e-4, []string{"pt", "pint"}},
+	{"volume", 2.365882365e-4, []string{"cup"}},
+	{"volume", 2.95735295625e-5, []string{"fl oz", "floz", "fluid ounce"}},
+	{"volume", 1.478676478125e-5, []string{"tbsp", "tablespoon"}},
+	{"volume", 4.92892159375e-6, []string{"tsp", "teaspoon"}},
+	{"volume", 0.028316846592, []string{"ft3", "ft³", "cubic foot", "cubic feet"}},
+
+	{"area", 1, []string{"m2", "m²", "square meter", "square metre"}},
+	{"area", 1e6, []string{"km2", "km²", "square kilometer", "square kilometre"}},
+	{"area", 1e-4, []string{"cm2", "cm²"}},
+	{"area", 1e4, []string{"ha", "hectare"}},
+	{"area", 4046.8564224, []string{"acre"}},
+	{"area", 0.09290304, []string{"ft2", "ft²", "square foot", "square feet"}},
+	{"area", 6.4516e-4, []string{"in2", "in²", "square inch"}},
+	{"area", 2589988.110336, []string{"mi2", "mi²", "square mile"}},
+
+	{"speed", 1, []string{"m/s"}},
+	{"speed", 1 / 3.6, []string{"km/h", "kph"}},
+	{"speed", 0.44704, []string{"mph", "mi/h"}},
+	{"speed", 1852.0 / 3600, []string{"kn", "kt", "knot"}},
+	{"speed", 0.3048, []string{"ft/s"}},
+
+	{"data", 1, []string{"B", "byte"}},
+	{"data", 0.125, []string{"bit"}},
+	{"data", 1e3, []string{"kB", "KB", "kilobyte"}},
+	{"data", 1e6, []string{"MB", "megabyte"}},
+	{"data", 1e9, []string{"GB", "gigabyte"}},
+	{"data", 1e12, []string{"TB", "terabyte"}},
+	{"data", 1e15, []string{"PB", "petabyte"}},
+	{"data", 1 << 10, []string{"KiB", "kibibyte"}},
+	{"data", 1 << 20, []string{"MiB", "mebibyte"}},
+	{"data", 1 << 30, []string{"GiB", "gibibyte"}},
+	{"data", 1 << 40, []string{"TiB", "tebibyte"}},
+	{"data", 125, []string{"kb", "kbit", "kilobit"}},
+	{"data", 125e3, []string{"Mb", "Mbit", "megabit"}},
+	{"data", 125e6, []string{"Gb", "Gbit", "gigabit"}},
+
+	{"energy", 1, []string{"J", "joule"}},
+	{"energy", 1e3, []string{"kJ", "kilojoule"}},
+	{"energy", 4.184, []string{"cal", "calorie"}},
+	{"energy", 4184, []string{"kcal", "kilocalorie"}},
+	{"energy", 3600, []string{"Wh", "watt hour"}},
+	{"energy", 3.6e6, []string{"kWh", "kilowatt hour"}},
+	{"energy", 1.602176634e-19, []string{"eV", "electronvolt"}},
+	{"energy", 1055.05585262, []string{"BTU", "Btu"}},
+
+	{"power", 1, []string{"W", "watt"}},
+	{"power", 1e3, []string{"kW", "kilowatt"}},
+	{"power", 1e6, []string{"MW", "megawatt"}},
+	{"power", 745.69987158227022, []string{"hp", "horsepower"}},
+
+	{"pressure", 1, []string{"Pa", "pascal"}},
+	{"pressure", 1e3, []string{"kPa", "kilopascal"}},
+	{"pressure", 1e5, []string{"bar"}},
+	{"pressure", 101325, []string{"atm", "atmosphere"}},
+	{"pressure", 6894.757293168, []string{"psi"}},
+	{"pressure", 133.322387415, []string{"mmHg"}},
+
+	{"angle", 1, []string{"rad", "radian"}},
+	{"angle", math.Pi / 180, []string{"deg", "°", "degree"}},
+}
+
+// Temperatures convert through kelvin with an offset
+var temperatureUnits = []struct {
+	unit  unit
+	names []string
+}{
+	{unit{"temperature", 1, 0}, []string{"K", "kelvin"}},
+	{unit{"temperature", 1, 273.15}, []string{"C", "°C", "degC", "celsius"}},
+	{unit{"temperature", 5.0 / 9, 273.15 - 32*5.0/9}, []string{"F", "°F", "degF", "fahrenheit"}},
+}
+
+// units holds the units by exact name, and foldedUnits by lower-case name
+// when that does not make two units the same
+var units, foldedUnits = indexUnits()
+
+func indexUnits() (map[string]unit, map[string]unit) {
+	exact := make(map[string]unit)
+	folded := make(map[string]unit)
+	ambiguous := make(map[string]bool)
+	add := func(u unit, names []string) {
+		for _, name := range names {
+			exact[name] = u
+			lower := strings.ToLower(name)
+			if other, ok := folded[lower]; ok && other != u {
+				ambiguous[lower] = true
+			}
+			folded[lower] = u
+		}
+	}
+	for _, entry := range unitTable {
+		add(unit{dimension: entry.dimension, factor: entry.factor}, entry.names)
+	}
+	for _, entry := range temperatureUnits {
+		add(entry.unit, entry.names)
+	}
+	for name := range ambiguous {
+		delete(folded, name)
+	}
+	return exact, folded
+}
+
+// lookupUnit finds a unit by name
+func lookupUnit(name string) (unit, bool) {
+	name = strings.Join(strings.Fields(name), " ")
+	if u, ok := units[name]; ok {
+		return u, true
+	}
+	lower := strings.ToLower(name)
+	if u, ok := foldedUnits[lower]; ok {
+		return u, true
+	}
+	for _, suffix := range []string{"s", "es"} {
+		if singular, ok := strings.CutSuffix(lower, suffix); ok && len(singular) > 1 {
+			if u, ok := foldedUnits[singular]; ok {
+				return u, true
+			}
+		}
+	}
+	return unit{}, false
+}
+
+// convertUnits converts value between two units of the same dimension
+func convertUnits(value float64, from, to string) (float64, error) {
+	src, ok := lookupUnit(from)
+	if !ok {
+		return 0, fmt.Errorf("unknown unit %q", from)
+	}
+	dst, ok := lookupUnit(to)
+	if !ok {
+		return 0, fmt.Errorf("unknown unit %q", to)
+	}
+	if src.dimension != dst.dimension {
+		return 0, fmt.Errorf("cannot convert %s (%s) to %s (%s)", from, src.dimension, to, dst.dimension)
+	}
+	base := value*src.factor + src.offset
+	return roundSignificant((base-dst.offset)/dst.factor, 12), nil
+}
+
+// currencyCode matches the ISO 4217 codes currencies are converted by
+var currencyCode = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// currencyRates are exchange rates loaded from a URL or file, in the format
+// of most rate APIs: {"base": "USD", "rates": {"EUR": 0.92, ...}} with an
+// optional "date". They are reloaded when older than interval, and the last
+// rates are kept if that fails.
+type currencyRates struct {
+	source   string
+	interval time.Duration
+	client   *http.Client
+	now      func() time.Time
+
+	mu      sync.Mutex
+	rates   map[string]float64
+	asOf    string
+	fetched time.Time
+}
+
+func newCurrencyRates(source string) *currencyRates {
+	return &currencyRates{source: source, interval: time.Hour, client: &http.Client{Timeout: 10 * time.Second}, now: time.Now}
+}
+
+// get returns the rates relative to any one currency, and their date
+func (c *currencyRates) get(ctx context.Context) (map[string]float64, string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.rates != nil && c.now().Sub(c.fetched) < c.interval {
+		return c.rates, c.asOf, nil
+	}
+	rates, asOf, err := c.load(ctx)
+	if err != nil {
+		if c.rates == nil {
+			return nil, "", fmt.Errorf("exchange rates are unavailable: %w", err)
+		}
+		log.Printf("Keeping the exchange rates of %s: %v", c.asOf, err)
+		// Retry on the next call after a while, not on every call
+		c.fetched = c.now().Add(time.Minute - c.interval)
+		return c.rates, c.asOf, nil
+	}
+	c.rates, c.asOf, c.fetched = rates, asOf, c.now()
+	return rates, asOf, nil
+}
+
+func (c *currencyRates) load(ctx context.Context) (map[string]float64, string, error) {
+	var data []byte
+	if strings.HasPrefix(c.source, "http://") || strings.HasPrefix(c.source, "https://") {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.source, nil)
+		if err != nil {
+			return nil, "", err
+		}
+		resp, err := c.client.Do(req)
+		if err != nil {
+			return nil, "", err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, "", fmt.Errorf("rates source returned status %d", resp.StatusCode)
+		}
+		if data, err = io.ReadAll(io.LimitReader(resp.Body, 1<<20)); err != nil {
+			return nil, "", err
+		}
+	} else {
+		var err error
+		if data, err = os.ReadFile(c.source); err != nil {
+			return nil, "", err
+		}
+	}
+	var body struct {
+		Base  string             `json:"base"`
+		Date  string             `json:"date"`
+		Rates map[string]float64 `json:"rates"`
+	}
+	if err := json.Unmarshal(data, &body); err != nil {
+		return nil, "", fmt.Errorf("invalid rates: %v", err)
+	}
+	if len(body.Rates) == 0 {
+		return nil, "", fmt.Errorf("invalid rates: no rates")
+	}
+	for code, rate := range body.Rates {
+		if rate <= 0 {
+			return nil, "", fmt.Errorf("invalid rates: %s is %v", code, rate)
+		}
+	}
+	if body.Base != "" {
+		body.Rates[body.Base] = 1
+	}
+	if body.Date == "" {
+		body.Date = c.now().UTC().Format(time.RFC3339)
+	}
+	return body.Rates, body.Date, nil
+}
+
+// unitConverter is the convert builtin tool, for units and, when rates
+// are configured, currencies
+type unitConverter struct {
+	rates *currencyRates
+}
+
+func (*unitConverter) definition(name string) ToolFunction {
+	return ToolFunction{
+		Name:        name,
+		Description: "Converts a value between units of length, mass, time, volume, area, speed, data, energy, power, pressure, angle or temperature, or between currencies by ISO 4217 code. US customary units are used for gallons, pints and cups.",
+		Parameters:  json.RawMessage(convertToolParameters),
+	}
+}
+
+func (c *unitConverter) call(ctx context.Context, arguments string) (string, error) {
+	var args struct {
+		Value *float64 `json:"value"`
+		From  string   `json:"from"`
+		To    string   `json:"to"`
+	}
+	if err := json.Unmarshal([]byte(arguments), &args); err != nil || args.Value == nil || args.From == "" || args.To == "" {
+		return "", fmt.Errorf(`arguments must be an object with "value", "from" and "to"`)
+	}
+	result := map[string]any{"from": args.From, "to": args.To}
+	// Codes like CUP can also be units, and are currencies next to another
+	if currencyCode.MatchString(args.From) && currencyCode.MatchString(args.To) {
+		_, fromUnit := lookupUnit(args.From)
+		_, toUnit := lookupUnit(args.To)
+		if !fromUnit || !toUnit {
+			value, asOf, err := c.convertCurrency(ctx, *args.Value, args.From, args.To)
+			if err != nil {
+				return "", err
+			}
+			result["value"], result["rates_as_of"] = value, asOf
+			out, err := json.Marshal(result)
+			return string(out), err
+		}
+	}
+	value, err := convertUnits(*args.Value, args.From, args.To)
+	if err != nil {
+		return "", err
+	}
+	result["value"] = value
+	out, err := json.Marshal(result)
+	return string(out), err
+}
+
+// convertCurrency converts an amount at the configured rates
+func (c *unitConverter) convertCurrency(ctx context.Context, amount float64, from, to string) (float64, string, error) {
+	if c.rates == nil {
+		return 0, "", fmt.Errorf("currency conversion is not configured")
+	}
+	rates, asOf, err := c.rates.get(ctx)
+	if err != nil {
+		return 0, "", err
+	}
+	for _, code := range []string{from, to} {
+		if _, ok := rates[code]; !ok {
+			return 0, "", fmt.Errorf("no exchange rate for %s", code)
+		}
+	}
+	return roundSignificant(amount/rates[from]*rates[to], 12), asOf, nil
+}
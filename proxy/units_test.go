@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConvertUnits(t *testing.T) {
+	tests := []struct {
+		value    float64
+		from, to string
+		want     float64
+	}{
+		{10, "km", "mi", 6.21371192237},
+		{1, "mile", "feet", 5280},
+		{12, "inches", "cm", 30.48},
+		{100, "degC", "°F", 212},
+		{-40, "F", "C", -40},
+		{0, "celsius", "kelvin", 273.15},
+		{1, "GiB", "MB", 1073.741824},
+		{100, "Mb", "MB", 12.5},
+		{1, "kWh", "kcal", 860.420650096},
+		{2, "Cups", "mL", 473.176473},
+		{90, "deg", "rad", 1.57079632679},
+		{1, "atm", "psi", 14.6959487755},
+		{3, "hrs", "minutes", 180},
+		{1, "square mile", "km2", 2.58998811034},
+	}
+	for _, tt := range tests {
+		got, err := convertUnits(tt.value, tt.from, tt.to)
+		if err != nil || got != tt.want {
+			t.Errorf("Expected %v %s = %v %s, got %v (%v)", tt.value, tt.from, tt.want, tt.to, got, err)
+		}
+	}
+	for _, units := range [][2]string{{"km", "kg"}, {"furlong", "m"}, {"mb", "kB"}} {
+		if _, err := convertUnits(1, units[0], units[1]); err == nil {
+			t.Errorf("Expected an error converting %s to %s", units[0], units[1])
+		}
+	}
+}
+
+func TestUnitConverter_Currency(t *testing.T) {
+	var requests int
+	rates := `{"base": "USD", "date": "2026-10-13", "rates": {"EUR": 0.8, "JPY": 150, "CUP": 24}}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if rates == "" {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(rates))
+	}))
+	defer server.Close()
+	c := &unitConverter{rates: newCurrencyRates(server.URL)}
+	now := time.Now()
+	c.rates.now = func() time.Time { return now }
+
+	output, err := c.call(context.Background(), `{"value": 100, "from": "EUR", "to": "JPY"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result struct {
+		Value float64 `json:"value"`
+		AsOf  string  `json:"rates_as_of"`
+	}
+	json.Unmarshal([]byte(output), &result)
+	if result.Value != 18750 || result.AsOf != "2026-10-13" {
+		t.Errorf("Expected 18750 JPY as of 2026-10-13, got %s", output)
+	}
+	// CUP is a currency next to another one, a unit next to a unit
+	if output, _ := c.call(context.Background(), `{"value": 24, "from": "CUP", "to": "USD"}`); !strings.Contains(output, `"value":1}`) {
+		t.Errorf("Expected CUP converted as a currency, got %s", output)
+	}
+	if output, _ := c.call(context.Background(), `{"value": 1, "from": "cup", "to": "tbsp"}`); !strings.Contains(output, `"value":16}`) {
+		t.Errorf("Expected cups converted as a unit, got %s", output)
+	}
+	if _, err := c.call(context.Background(), `{"value": 1, "from": "EUR", "to": "GBP"}`); err == nil {
+		t.Error("Expected an error for a currency without a rate")
+	}
+
+	// The rates are kept when they cannot be reloaded
+	rates = ""
+	now = now.Add(2 * time.Hour)
+	if _, err := c.call(context.Background(), `{"value": 1, "from": "EUR", "to": "USD"}`); err != nil || requests != 2 {
+		t.Errorf("Expected the old rates after a failed reload, got %v after %d requests", err, requests)
+	}
+	c.call(context.Background(), `{"value": 1, "from": "EUR", "to": "USD"}`)
+	if requests != 2 {
+		t.Errorf("Expected no reload right after a failed one, got %d requests", requests)
+	}
+}
+
+func TestUnitConverter_CurrencyFromFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rates.json")
+	os.WriteFile(path, []byte(`{"base": "EUR", "rates": {"USD": 1.25}}`), 0o600)
+	c := &unitConverter{rates: newCurrencyRates(path)}
+	if value, _, err := c.convertCurrency(context.Background(), 5, "USD", "EUR"); err != nil || value != 4 {
+		t.Errorf("Expected 4 EUR, got %v (%v)", value, err)
+	}
+
+	if _, _, err := (&unitConverter{}).convertCurrency(context.Background(), 1, "USD", "EUR"); err == nil || !strings.Contains(err.Error(), "not configured") {
+		t.Errorf("Expected currency conversion to need rates, got %v", err)
+	}
+}
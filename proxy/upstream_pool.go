@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The first requests after a deploy pay for TCP and TLS handshakes with the
+// upstream that later requests skip. The upstream pool opens connections
+// when the proxy starts and touches them periodically so they stay open,
+// and caches TLS sessions so connections the upstream did close resume
+// their session with a shorter handshake instead of a full one.
+
+// upstreamPool is the transport of an upstream's requests
+type upstreamPool struct {
+	name      string
+	baseURL   string
+	size      int
+	transport *http.Transport
+	metrics   *proxyMetrics
+	// network is tcp4 or tcp6 to dial one address family only, and empty
+	// to dial either
+	network string
+
+	open atomic.Int64
+}
+
+// newUpstreamPool keeps up to size idle connections to baseURL warm. It
+// resolves hostnames through dns, if set.
+func newUpstreamPool(name, baseURL string, size int, metrics *proxyMetrics, dns *dnsCache) *upstreamPool {
+	p := &upstreamPool{name: name, baseURL: baseURL, size: size, metrics: metrics}
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	dial := dialer.DialContext
+	if dns != nil {
+		dial = dns.DialContext(dialer)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if p.network != "" {
+			network = p.network
+		}
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		p.open.Add(1)
+		return &countedConn{Conn: conn, pool: p}, nil
+	}
+	transport.TLSClientConfig = &tls.Config{ClientSessionCache: tls.NewLRUClientSessionCache(64)}
+	transport.MaxIdleConnsPerHost = max(size, http.DefaultMaxIdleConnsPerHost)
+	transport.IdleConnTimeout = 5 * time.Minute
+	p.transport = transport
+	return p
+}
+
+// countedConn counts itself out of the pool's open connections
+type countedConn struct {
+	net.Conn
+	pool   *upstreamPool
+	closed sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.closed.Do(func() { c.pool.open.Add(-1) })
+	return c.Conn.Close()
+}
+
+// RoundTrip sends req, counting whether it got a new connection and how
+// the TLS handshake of a new one went
+func (p *upstreamPool) RoundTrip(req *http.Request) (*http.Response, error) {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			p.metrics.upstreamConnections.Add(1, p.name, strconv.FormatBool(info.Reused))
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			if err == nil {
+				p.metrics.tlsHandshakes.Add(1, p.name, strconv.FormatBool(state.DidResume))
+			}
+		},
+	}
+	return p.transport.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+}
+
+// Warm opens connections until the pool has size of them, by sending that
+// many HEAD requests to the upstream at once; the transport dials for each
+// request that finds no idle connection and keeps every connection it
+// dialed. Requests reuse idle connections, which keeps them from timing out.
+func (p *upstreamPool) Warm(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	errs := make(chan error, p.size)
+	for range p.size {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, err := http.NewRequestWithContext(ctx, http.MethodHead, p.baseURL, nil)
+			if err != nil {
+				errs <- err
+				return
+			}
+			resp, err := p.RoundTrip(req)
+			if err != nil {
+				errs <- err
+				return
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	if err, ok := <-errs; ok {
+		return fmt.Errorf("failed to warm connections to %s: %w", p.name, err)
+	}
+	return nil
+}
+
+// samples reports the pool for the metrics endpoint
+func (p *upstreamPool) samples() []gaugeSample {
+	return []gaugeSample{
+		{metric: "vibethon_upstream_open_connections", labels: []string{"upstream", p.name}, value: float64(p.open.Load())},
+		{metric: "vibethon_upstream_warm_connections_target", labels: []string{"upstream", p.name}, value: float64(p.size)},
+	}
+}
+
+// configureUpstream gives client a transport of its own, which keeps
+// PROXY_UPSTREAM_WARM_CONNECTIONS connections warm, 4 by default, refreshed
+// every PROXY_UPSTREAM_WARM_INTERVAL, 30s by default, dials the address
+// family of PROXY_UPSTREAM_IP_FAMILY, either by default, and resolves the
+// upstream through a DNS cache unless PROXY_DNS_CACHE is "off". Builds
+// whose upstream transport is not a socket of their own are left alone.
+func (s *ProxyServer) configureUpstream(ctx context.Context, client *RealOpenAIClient, getenv func(string) string) error {
+	size, interval := 4, 30*time.Second
+	if v := getenv("PROXY_UPSTREAM_WARM_CONNECTIONS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid PROXY_UPSTREAM_WARM_CONNECTIONS %q", v)
+		}
+		size = n
+	}
+	if v := getenv("PROXY_UPSTREAM_WARM_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid PROXY_UPSTREAM_WARM_INTERVAL %q", v)
+		}
+		interval = d
+	}
+	var network string
+	switch v := getenv("PROXY_UPSTREAM_IP_FAMILY"); v {
+	case "", "dual":
+	case "ipv4":
+		network = "tcp4"
+	case "ipv6":
+		network = "tcp6"
+	default:
+		return fmt.Errorf("invalid PROXY_UPSTREAM_IP_FAMILY %q, expected ipv4, ipv6 or dual", v)
+	}
+	dns, err := dnsCacheFromEnv(s.metrics, getenv)
+	if err != nil {
+		return err
+	}
+	if upstreamTransport != nil || runtime.GOOS == "wasip1" {
+		return nil
+	}
+
+	pool := newUpstreamPool(s.upstream, client.BaseURL, size, s.metrics, dns)
+	pool.network = network
+	client.HTTPClient.Transport = pool
+	newGaugeFunc(s.metrics.registry, map[string]string{
+		"vibethon_upstream_open_connections":        "Connections open to the upstream.",
+		"vibethon_upstream_warm_connections_target": "Connections to the upstream kept warm.",
+	}, pool.samples)
+	if dns != nil {
+		s.jobs.Add("refresh-dns", dnsRefreshInterval, false, dns.Refresh)
+	}
+	if size == 0 {
+		return nil
+	}
+	go func() {
+		if err := pool.Warm(ctx); err != nil {
+			log.Print(err)
+		}
+	}()
+	s.jobs.Add("warm-upstream-connections", interval, false, pool.Warm)
+	return nil
+}
+
+// dnsCacheFromEnv configures the DNS cache: PROXY_DNS_CACHE "off" disables
+// it, PROXY_DNS_MIN_TTL and PROXY_DNS_MAX_TTL bound the TTLs it keeps
+// addresses for, 5s and 5m by default, and PROXY_DNS_PINS pins hosts
+func dnsCacheFromEnv(metrics *proxyMetrics, getenv func(string) string) (*dnsCache, error) {
+	if getenv("PROXY_DNS_CACHE") == "off" {
+		return nil, nil
+	}
+	dns := newDNSCache(metrics)
+	for name, ttl := range map[string]*time.Duration{"PROXY_DNS_MIN_TTL": &dns.minTTL, "PROXY_DNS_MAX_TTL": &dns.maxTTL} {
+		if v := getenv(name); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				return nil, fmt.Errorf("invalid %s %q", name, v)
+			}
+			*ttl = d
+		}
+	}
+	if dns.maxTTL < dns.minTTL {
+		return nil, fmt.Errorf("PROXY_DNS_MAX_TTL %s is below PROXY_DNS_MIN_TTL %s", dns.maxTTL, dns.minTTL)
+	}
+	if v := getenv("PROXY_DNS_PINS"); v != "" {
+		pins, err := parseDNSPins(v)
+		if err != nil {
+			return nil, err
+		}
+		dns.pins = pins
+	}
+	return dns, nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestUpstreamPool_WarmsAndResumesSessions(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	m := newProxyMetrics()
+	pool := newUpstreamPool("openai", upstream.URL, 3, m, nil)
+	pool.transport.TLSClientConfig.RootCAs = upstream.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	if err := pool.Warm(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := pool.open.Load(); n != 3 {
+		t.Errorf("Expected 3 warm connections, got %d", n)
+	}
+
+	// A request after the warmup reuses a connection
+	client := &http.Client{Transport: pool}
+	resp, err := client.Get(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// Connections the upstream closed reconnect with the cached session
+	pool.transport.CloseIdleConnections()
+	if err := pool.Warm(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var out strings.Builder
+	m.registry.Write(&out)
+	for _, want := range []string{
+		`vibethon_upstream_connections_total{upstream="openai",reused="true"}`,
+		`vibethon_upstream_tls_handshakes_total{upstream="openai",resumed="false"} 3`,
+		`vibethon_upstream_tls_handshakes_total{upstream="openai",resumed="true"}`,
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", want, out.String())
+		}
+	}
+}
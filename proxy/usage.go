@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// UsageEvent is the accounting record written for every proxied request
+type UsageEvent struct {
+	Time             time.Time `json:"time"`
+	KeyID            string    `json:"key_id,omitempty"`
+	Tenant           string    `json:"tenant,omitempty"`
+	Endpoint         string    `json:"endpoint"`
+	Model            string    `json:"model"`
+	Status           int       `json:"status"`
+	PromptTokens     int       `json:"prompt_tokens"`
+	CompletionTokens int       `json:"completion_tokens"`
+	TotalTokens      int       `json:"total_tokens"`
+	LatencyMS        int64     `json:"latency_ms"`
+	// TimeToFirstTokenMS is set for streamed responses only
+	TimeToFirstTokenMS int64 `json:"ttft_ms,omitempty"`
+	// Cost is the price of the request in USD, if pricing is configured
+	Cost float64 `json:"cost,omitempty"`
+}
+
+// newUsageEvent starts an event for a request about to be sent upstream
+func newUsageEvent(key *ClientKey, endpoint, model string) UsageEvent {
+	event := UsageEvent{Time: time.Now().UTC(), Endpoint: endpoint, Model: model}
+	if key != nil {
+		event.KeyID, event.Tenant = key.ID, key.Tenant
+	}
+	return event
+}
+
+// recordCompletion accounts for a successful upstream call: tokens count
+// against the key's and tenant's limits and a usage event is queued
+func (s *ProxyServer) recordCompletion(key *ClientKey, event UsageEvent, usage Usage) {
+	if key != nil {
+		s.limiter.RecordTokens(key.ID, usage.TotalTokens)
+		if key.Tenant != "" {
+			s.limiter.RecordTokens("tenant:"+key.Tenant, usage.TotalTokens)
+			s.pacer.Record(key.Tenant, usage.TotalTokens)
+		}
+	}
+	event.Status = http.StatusOK
+	event.PromptTokens = usage.PromptTokens
+	event.CompletionTokens = usage.CompletionTokens
+	event.TotalTokens = usage.TotalTokens
+	event.Cost = s.recordCost(key, event.Model, usage)
+	s.recordUsage(event)
+}
+
+// recordUsage updates metrics and queues an accounting event. It never
+// blocks on the sink: if the queue is over its threshold the event is
+// dropped and counted.
+func (s *ProxyServer) recordUsage(event UsageEvent) {
+	s.metrics.observe(event, s.upstream)
+	if event.Status == http.StatusOK {
+		s.latencies.Observe(event.Endpoint, event.Model, event.LatencyMS)
+	}
+	s.sloTracker.Record(s.slos.List(), event)
+	s.anomalies.Record(event)
+	if s.analytics != nil && s.license.Allows(LicensedAnalytics) {
+		s.analytics.Record(event)
+	}
+	if s.usage == nil || !s.license.Allows(LicensedUsageSink) {
+		return
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Failed to encode usage event: %v", err)
+		return
+	}
+	err = s.usage.Enqueue(payload)
+	if errors.Is(err, errWALFull) {
+		// Log the first drop and then every thousandth to avoid flooding logs
+		// during an outage
+		if n := s.usage.Stats().Dropped; n == 1 || n%1000 == 0 {
+			log.Printf("Dropping usage events (%d so far): %v", n, err)
+		}
+	} else if err != nil {
+		log.Printf("Failed to queue usage event: %v", err)
+	}
+}
+
+// handleAdminUsageQueue reports the state of the usage event queue
+func (s *ProxyServer) handleAdminUsageQueue(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.usage.Stats())
+}
+
+// fileEventSink appends events as JSON lines to a local file
+type fileEventSink struct {
+	path string
+}
+
+func (s *fileEventSink) Write(ctx context.Context, events [][]byte) error {
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	for _, event := range events {
+		buf.Write(event)
+		buf.WriteByte('\n')
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// httpEventSink POSTs each batch as a JSON array to a collector, such as an
+// ingestion endpoint in front of the accounting database
+type httpEventSink struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func (s *httpEventSink) Write(ctx context.Context, events [][]byte) error {
+	body := append([]byte{'['}, bytes.Join(events, []byte{','})...)
+	body = append(body, ']')
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("usage collector returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// usageSinkFile returns the file a PROXY_USAGE_SINK target appends to, or
+// "" for targets that are URLs
+func usageSinkFile(target string) string {
+	for _, scheme := range []string{"http://", "https://", "clickhouse://"} {
+		if strings.HasPrefix(target, scheme) {
+			return ""
+		}
+	}
+	return target
+}
+
+// eventSinkFromTarget picks a sink for PROXY_USAGE_SINK: an http(s) URL, a
+// clickhouse:// URL or a file path
+func eventSinkFromTarget(target, token string) (eventSink, error) {
+	switch {
+	case usageSinkFile(target) != "":
+		return &fileEventSink{path: target}, nil
+	case strings.HasPrefix(target, "clickhouse://"):
+		return newClickHouseEventSink(target, token)
+	}
+	return &httpEventSink{url: target, token: token, client: &http.Client{Timeout: 10 * time.Second}}, nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Large deployments can ship usage events to ClickHouse for long-term
+// analytics, instead of to a collector in front of the primary store. Each
+// batch is one INSERT over ClickHouse's HTTP interface, in JSONEachRow
+// format so events are inserted as the proxy encodes them. The server is
+// asked to buffer inserts (async_insert), since batches of a lightly loaded
+// proxy are small and ClickHouse is best fed few large parts, and to wait
+// until the rows are written, so a failed write is retried from the queue.
+
+// clickHouseTable matches a table name, optionally with its database
+var clickHouseTable = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*\.)?[A-Za-z_][A-Za-z0-9_]*$`)
+
+// clickHouseEventSink inserts each batch into a ClickHouse table
+type clickHouseEventSink struct {
+	endpoint string
+	table    string
+	user     string
+	password string
+	client   *http.Client
+}
+
+// newClickHouseEventSink configures a sink from a URL of the form
+// clickhouse://[user[:password]@]host[:port]/[database.]table, on port
+// 8123 by default. A secure=true parameter connects with TLS, on port 8443
+// by default. The password can also be given as token.
+func newClickHouseEventSink(target, token string) (*clickHouseEventSink, error) {
+	u, err := url.Parse(target)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid ClickHouse URL %q", target)
+	}
+	table := strings.TrimPrefix(u.Path, "/")
+	if !clickHouseTable.MatchString(table) {
+		return nil, fmt.Errorf("invalid ClickHouse table %q, expected database.table", table)
+	}
+	scheme, port := "http", "8123"
+	if u.Query().Get("secure") == "true" {
+		scheme, port = "https", "8443"
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host += ":" + port
+	}
+	sink := &clickHouseEventSink{
+		endpoint: scheme + "://" + host + "/",
+		table:    table,
+		user:     u.User.Username(),
+		password: token,
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}
+	if password, ok := u.User.Password(); ok {
+		sink.password = password
+	}
+	return sink, nil
+}
+
+func (s *clickHouseEventSink) Write(ctx context.Context, events [][]byte) error {
+	body := append(bytes.Join(events, []byte{'\n'}), '\n')
+	sum := sha256.Sum256(body)
+
+	query := url.Values{}
+	query.Set("query", "INSERT INTO "+s.table+" FORMAT JSONEachRow")
+	query.Set("async_insert", "1")
+	query.Set("wait_for_async_insert", "1")
+	// Event times are RFC 3339 and events may gain fields the table does
+	// not have yet
+	query.Set("date_time_input_format", "best_effort")
+	query.Set("input_format_skip_unknown_fields", "1")
+	// A batch delivered again after a crash carries the same token, so
+	// tables with deduplication enabled insert it once
+	query.Set("insert_deduplication_token", hex.EncodeToString(sum[:]))
+	query.Set("async_insert_deduplicate", "1")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint+"?"+query.Encode(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if s.user != "" {
+		req.Header.Set("X-ClickHouse-User", s.user)
+	}
+	if s.password != "" {
+		req.Header.Set("X-ClickHouse-Key", s.password)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("ClickHouse returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
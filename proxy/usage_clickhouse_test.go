@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestClickHouseEventSink_InsertsBatch(t *testing.T) {
+	var query, user, password, body string
+	clickhouse := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query().Get("query")
+		user, password = r.Header.Get("X-ClickHouse-User"), r.Header.Get("X-ClickHouse-Key")
+		data, _ := io.ReadAll(r.Body)
+		body = string(data)
+		if r.URL.Query().Get("wait_for_async_insert") != "1" || r.URL.Query().Get("insert_deduplication_token") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer clickhouse.Close()
+
+	target := "clickhouse://proxy:secret@" + strings.TrimPrefix(clickhouse.URL, "http://") + "/analytics.usage_events"
+	sink, err := eventSinkFromTarget(target, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Write(context.Background(), [][]byte{[]byte(`{"a":1}`), []byte(`{"b":2}`)}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if query != "INSERT INTO analytics.usage_events FORMAT JSONEachRow" {
+		t.Errorf("Unexpected query %q", query)
+	}
+	if body != "{\"a\":1}\n{\"b\":2}\n" {
+		t.Errorf("Expected one JSON object per line, got %q", body)
+	}
+	if user != "proxy" || password != "secret" {
+		t.Errorf("Expected the URL's credentials, got %q and %q", user, password)
+	}
+}
+
+func TestClickHouseEventSink_FailsOnErrorStatus(t *testing.T) {
+	clickhouse := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Code: 60. DB::Exception: Table analytics.usage_events does not exist", http.StatusNotFound)
+	}))
+	defer clickhouse.Close()
+
+	sink, _ := eventSinkFromTarget("clickhouse://"+strings.TrimPrefix(clickhouse.URL, "http://")+"/analytics.usage_events", "")
+	if err := sink.Write(context.Background(), [][]byte{[]byte(`{}`)}); err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Errorf("Expected ClickHouse's error, got %v", err)
+	}
+}
+
+func TestEventSinkFromTarget_InvalidClickHouseTable(t *testing.T) {
+	for _, target := range []string{"clickhouse://localhost/", "clickhouse://localhost/usage; DROP TABLE users"} {
+		if _, err := eventSinkFromTarget(target, ""); err == nil {
+			t.Errorf("Expected %q to be rejected", target)
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"math/rand/v2"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// usageGroupFields are the dimensions a usage report can be grouped by
+var usageGroupFields = map[string]func(UsageEvent) string{
+	"tenant":   func(e UsageEvent) string { return e.Tenant },
+	"key":      func(e UsageEvent) string { return e.KeyID },
+	"model":    func(e UsageEvent) string { return e.Model },
+	"endpoint": func(e UsageEvent) string { return e.Endpoint },
+	"day":      func(e UsageEvent) string { return e.Time.UTC().Format("2006-01-02") },
+	"hour":     func(e UsageEvent) string { return e.Time.UTC().Format("2006-01-02T15") },
+}
+
+// UsageGroup is one row of a usage report
+type UsageGroup struct {
+	Group            map[string]string `json:"group"`
+	Requests         int64             `json:"requests"`
+	Errors           int64             `json:"errors"`
+	PromptTokens     int64             `json:"prompt_tokens"`
+	CompletionTokens int64             `json:"completion_tokens"`
+	TotalTokens      int64             `json:"total_tokens"`
+	// Keys is the number of distinct client keys in the group
+	Keys int `json:"keys"`
+
+	keys map[string]bool
+}
+
+// UsageReport aggregates usage events
+type UsageReport struct {
+	Groups []UsageGroup `json:"groups"`
+	// Suppressed counts the groups left out for covering fewer keys than
+	// the k-anonymity threshold
+	Suppressed int `json:"suppressed"`
+}
+
+// usageAggregator builds a usage report with optional anonymization
+type usageAggregator struct {
+	groupBy []string
+	anon    *anonymizer
+	// minKeys is the k-anonymity threshold: groups covering fewer distinct
+	// keys are suppressed
+	minKeys int
+	// epsilon, if positive, adds Laplace noise to every statistic for
+	// epsilon-differential privacy per statistic. Tokens are clamped per
+	// event to clampTokens, which bounds what one request can contribute.
+	epsilon     float64
+	clampTokens int64
+	// noise draws from the standard Laplace distribution
+	noise func() float64
+
+	groups map[string]*UsageGroup
+}
+
+func newUsageAggregator(groupBy []string, anon *anonymizer) *usageAggregator {
+	return &usageAggregator{groupBy: groupBy, anon: anon, noise: laplace, groups: make(map[string]*UsageGroup)}
+}
+
+// laplace samples the Laplace distribution with scale 1
+func laplace() float64 {
+	u := rand.Float64() - 0.5
+	return -math.Copysign(math.Log(1-2*math.Abs(u)), u)
+}
+
+func (a *usageAggregator) add(event UsageEvent) {
+	values := make(map[string]string, len(a.groupBy))
+	parts := make([]string, len(a.groupBy))
+	for i, field := range a.groupBy {
+		value := usageGroupFields[field](event)
+		if field == "tenant" || field == "key" {
+			value = a.anon.ID(value)
+		}
+		values[field], parts[i] = value, value
+	}
+	id := strings.Join(parts, "\x00")
+	group, ok := a.groups[id]
+	if !ok {
+		group = &UsageGroup{Group: values, keys: make(map[string]bool)}
+		a.groups[id] = group
+	}
+
+	clamp := func(n int) int64 {
+		if a.epsilon > 0 && int64(n) > a.clampTokens {
+			return a.clampTokens
+		}
+		return int64(n)
+	}
+	group.Requests++
+	if event.Status >= 400 {
+		group.Errors++
+	}
+	group.PromptTokens += clamp(event.PromptTokens)
+	group.CompletionTokens += clamp(event.CompletionTokens)
+	group.TotalTokens += clamp(event.TotalTokens)
+	group.keys[event.KeyID] = true
+}
+
+// report suppresses small groups, adds noise and orders the groups by their
+// values
+func (a *usageAggregator) report() UsageReport {
+	report := UsageReport{Groups: []UsageGroup{}}
+	for _, group := range a.groups {
+		group.Keys = len(group.keys)
+		if group.Keys < a.minKeys {
+			report.Suppressed++
+			continue
+		}
+		if a.epsilon > 0 {
+			noisy := func(n int64, sensitivity float64) int64 {
+				return max(0, int64(math.Round(float64(n)+a.noise()*sensitivity/a.epsilon)))
+			}
+			group.Requests = noisy(group.Requests, 1)
+			group.Errors = min(noisy(group.Errors, 1), group.Requests)
+			group.PromptTokens = noisy(group.PromptTokens, float64(a.clampTokens))
+			group.CompletionTokens = noisy(group.CompletionTokens, float64(a.clampTokens))
+			group.TotalTokens = noisy(group.TotalTokens, float64(a.clampTokens))
+		}
+		report.Groups = append(report.Groups, *group)
+	}
+	sort.Slice(report.Groups, func(i, j int) bool {
+		for _, field := range a.groupBy {
+			if x, y := report.Groups[i].Group[field], report.Groups[j].Group[field]; x != y {
+				return x < y
+			}
+		}
+		return false
+	})
+	return report
+}
+
+func writeUsageCSV(w io.Writer, groupBy []string, report UsageReport) error {
+	out := csv.NewWriter(w)
+	out.Write(append(append([]string(nil), groupBy...), "requests", "errors", "prompt_tokens", "completion_tokens", "total_tokens", "keys"))
+	for _, group := range report.Groups {
+		row := make([]string, 0, len(groupBy)+6)
+		for _, field := range groupBy {
+			row = append(row, group.Group[field])
+		}
+		for _, n := range []int64{group.Requests, group.Errors, group.PromptTokens, group.CompletionTokens, group.TotalTokens, int64(group.Keys)} {
+			row = append(row, strconv.FormatInt(n, 10))
+		}
+		out.Write(row)
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// readUsageEvents calls fn for each event in a JSON Lines stream, as written
+// by the file usage sink; JSON arrays of events, as POSTed to a collector,
+// are read too
+func readUsageEvents(r io.Reader, fn func(UsageEvent)) error {
+	dec := json.NewDecoder(r)
+	for {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		events := []UsageEvent{{}}
+		var err error
+		if len(raw) > 0 && raw[0] == '[' {
+			events = nil
+			err = json.Unmarshal(raw, &events)
+		} else {
+			err = json.Unmarshal(raw, &events[0])
+		}
+		if err != nil {
+			return err
+		}
+		for _, event := range events {
+			fn(event)
+		}
+	}
+}
+
+const usageUsage = `Usage: proxy usage report [flags] [file ...]
+
+Aggregates usage events from the files given, or from standard input, and
+writes one row per group.
+
+Flags:
+`
+
+// runUsageCommand runs "proxy usage <args>" and writes the report to stdout
+func runUsageCommand(args []string, stdin io.Reader, stdout io.Writer) error {
+	if len(args) == 0 || args[0] != "report" {
+		return errors.New("usage: proxy usage report [flags] [file ...]")
+	}
+	flags := flag.NewFlagSet("usage report", flag.ContinueOnError)
+	flags.SetOutput(stdout)
+	flags.Usage = func() {
+		fmt.Fprint(stdout, usageUsage)
+		flags.PrintDefaults()
+	}
+	groupBy := flags.String("group-by", "tenant,model,day", "comma-separated tenant, key, model, endpoint, day or hour")
+	format := flags.String("format", "json", "json or csv")
+	since := flags.String("since", "", "count events from this date or RFC 3339 time on")
+	until := flags.String("until", "", "count events before this date or RFC 3339 time")
+	anonymize := flags.String("anonymize", "", "ids to hash tenants and keys")
+	salt := flags.String("salt", os.Getenv("PROXY_ANONYMIZE_SALT"), "key for hashed identifiers, so they match between reports")
+	minKeys := flags.Int("k", 0, "suppress groups covering fewer distinct keys than this")
+	epsilon := flags.Float64("epsilon", 0, "add Laplace noise for this differential privacy budget per statistic")
+	clampTokens := flags.Int64("clamp-tokens", 10000, "tokens one request can contribute when -epsilon is set")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	fields := strings.Split(*groupBy, ",")
+	for i, field := range fields {
+		fields[i] = strings.TrimSpace(field)
+		if usageGroupFields[fields[i]] == nil {
+			return fmt.Errorf("cannot group by %q", field)
+		}
+	}
+	if *format != "json" && *format != "csv" {
+		return errors.New("-format must be json or csv")
+	}
+	if *epsilon < 0 || *clampTokens <= 0 {
+		return errors.New("-epsilon must not be negative and -clamp-tokens must be positive")
+	}
+	anon, err := newAnonymizer(*anonymize, *salt)
+	if err != nil {
+		return err
+	}
+	from, err := parseDatasetTime(*since)
+	if err != nil {
+		return fmt.Errorf("invalid -since: %w", err)
+	}
+	to, err := parseDatasetTime(*until)
+	if err != nil {
+		return fmt.Errorf("invalid -until: %w", err)
+	}
+
+	agg := newUsageAggregator(fields, anon)
+	agg.minKeys, agg.epsilon, agg.clampTokens = *minKeys, *epsilon, *clampTokens
+	add := func(event UsageEvent) {
+		if (from.IsZero() || !event.Time.Before(from)) && (to.IsZero() || event.Time.Before(to)) {
+			agg.add(event)
+		}
+	}
+	if flags.NArg() == 0 {
+		if err := readUsageEvents(stdin, add); err != nil {
+			return fmt.Errorf("stdin: %w", err)
+		}
+	}
+	for _, name := range flags.Args() {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		err = readUsageEvents(f, add)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	report := agg.report()
+	if *format == "csv" {
+		return writeUsageCSV(stdout, fields, report)
+	}
+	enc := json.NewEncoder(stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+const testUsageLog = `{"time":"2026-03-02T10:00:00Z","key_id":"k1","tenant":"acme","endpoint":"chat","model":"gpt-4o","status":200,"prompt_tokens":10,"completion_tokens":20,"total_tokens":30}
+{"time":"2026-03-02T11:00:00Z","key_id":"k2","tenant":"acme","endpoint":"chat","model":"gpt-4o","status":200,"prompt_tokens":5,"completion_tokens":5,"total_tokens":10}
+{"time":"2026-03-02T12:00:00Z","key_id":"k2","tenant":"acme","endpoint":"chat","model":"gpt-4o","status":502}
+[{"time":"2026-03-02T12:00:00Z","key_id":"k3","tenant":"globex","endpoint":"chat","model":"gpt-4o","status":200,"total_tokens":7}]
+{"time":"2026-03-03T12:00:00Z","key_id":"k1","tenant":"acme","endpoint":"chat","model":"gpt-4o","status":200,"total_tokens":1}
+`
+
+func runUsageReport(t *testing.T, args ...string) UsageReport {
+	t.Helper()
+	var out bytes.Buffer
+	if err := runUsageCommand(append([]string{"report"}, args...), strings.NewReader(testUsageLog), &out); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	var report UsageReport
+	if err := json.Unmarshal(out.Bytes(), &report); err != nil {
+		t.Fatalf("Invalid report %q: %v", out.String(), err)
+	}
+	return report
+}
+
+func TestUsageReport_Groups(t *testing.T) {
+	report := runUsageReport(t, "-group-by", "tenant,day", "-until", "2026-03-03")
+	if len(report.Groups) != 2 {
+		t.Fatalf("Expected two groups, got %+v", report.Groups)
+	}
+	acme := report.Groups[0]
+	if acme.Group["tenant"] != "acme" || acme.Group["day"] != "2026-03-02" {
+		t.Errorf("Unexpected first group %+v", acme.Group)
+	}
+	if acme.Requests != 3 || acme.Errors != 1 || acme.TotalTokens != 40 || acme.PromptTokens != 15 || acme.Keys != 2 {
+		t.Errorf("Unexpected totals %+v", acme)
+	}
+}
+
+func TestUsageReport_KAnonymity(t *testing.T) {
+	report := runUsageReport(t, "-group-by", "tenant", "-k", "2", "-anonymize", "ids", "-salt", "secret")
+	if len(report.Groups) != 1 || report.Suppressed != 1 {
+		t.Fatalf("Expected the single-key tenant to be suppressed, got %+v", report)
+	}
+	anon, _ := newAnonymizer("ids", "secret")
+	if tenant := report.Groups[0].Group["tenant"]; tenant != anon.ID("acme") {
+		t.Errorf("Expected the tenant to be hashed, got %q", tenant)
+	}
+}
+
+func TestUsageReport_Noise(t *testing.T) {
+	agg := newUsageAggregator([]string{"model"}, &anonymizer{})
+	agg.epsilon, agg.clampTokens = 0.5, 100
+	agg.noise = func() float64 { return 1 }
+	agg.add(UsageEvent{KeyID: "k1", Model: "gpt-4o", Status: 200, TotalTokens: 5000})
+	agg.add(UsageEvent{KeyID: "k2", Model: "gpt-4o", Status: 500})
+	group := agg.report().Groups[0]
+	// Noise of scale sensitivity/epsilon: 2 for counts, 200 for tokens
+	// clamped to 100 per request
+	if group.Requests != 4 || group.Errors != 3 || group.TotalTokens != 300 {
+		t.Errorf("Unexpected noisy totals %+v", group)
+	}
+
+	agg.noise = func() float64 { return -100 }
+	agg.groups = make(map[string]*UsageGroup)
+	agg.add(UsageEvent{KeyID: "k1", Model: "gpt-4o", Status: 200})
+	if group := agg.report().Groups[0]; group.Requests != 0 || group.TotalTokens != 0 {
+		t.Errorf("Expected noisy totals to stay positive, got %+v", group)
+	}
+}
+
+func TestUsageReport_CSV(t *testing.T) {
+	var out bytes.Buffer
+	if err := runUsageCommand([]string{"report", "-group-by", "model", "-format", "csv"}, strings.NewReader(testUsageLog), &out); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	want := "model,requests,errors,prompt_tokens,completion_tokens,total_tokens,keys\ngpt-4o,5,1,15,25,48,3\n"
+	if out.String() != want {
+		t.Errorf("Expected %q, got %q", want, out.String())
+	}
+
+	for _, args := range [][]string{{"report", "-group-by", "user"}, {"report", "-format", "xml"}, {"report", "-epsilon", "-1"}, {"export"}} {
+		if err := runUsageCommand(args, strings.NewReader(""), &bytes.Buffer{}); err == nil {
+			t.Errorf("Expected an error for %q", args)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestProxyServer_HandleChatCompletions_RecordsUsage(t *testing.T) {
+	server := NewProxyServer(&MockOpenAIClient{response: createTestChatCompletionResponse()})
+	sink := &memorySink{}
+	queue, err := openWALQueue(t.TempDir(), sink, 1<<20)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer queue.Close()
+	server.usage = queue
+
+	jsonData, _ := json.Marshal(createTestChatCompletionRequest())
+	req := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewBuffer(jsonData))
+	w := httptest.NewRecorder()
+	server.handleChatCompletions(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+
+	queue.deliver(context.Background())
+	if len(sink.events) != 1 {
+		t.Fatalf("Expected 1 usage event, got %d", len(sink.events))
+	}
+	var event UsageEvent
+	json.Unmarshal([]byte(sink.events[0]), &event)
+	want := createTestChatCompletionResponse().Usage
+	if event.Status != http.StatusOK || event.TotalTokens != want.TotalTokens || event.Model != "gpt-3.5-turbo" {
+		t.Errorf("Unexpected usage event %+v", event)
+	}
+}
+
+func TestProxyServer_HandleChatCompletions_RecordsUpstreamErrors(t *testing.T) {
+	server := NewProxyServer(&MockOpenAIClient{shouldError: true, error: errors.New("upstream down")})
+	sink := &memorySink{}
+	queue, _ := openWALQueue(t.TempDir(), sink, 1<<20)
+	defer queue.Close()
+	server.usage = queue
+
+	jsonData, _ := json.Marshal(createTestChatCompletionRequest())
+	req := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewBuffer(jsonData))
+	server.handleChatCompletions(httptest.NewRecorder(), req)
+
+	queue.deliver(context.Background())
+	if len(sink.events) != 1 || !strings.Contains(sink.events[0], `"status":500`) {
+		t.Errorf("Expected a failed request to be recorded, got %v", sink.events)
+	}
+}
+
+func TestFileEventSink_AppendsLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.jsonl")
+	sink := &fileEventSink{path: path}
+	sink.Write(context.Background(), [][]byte{[]byte(`{"a":1}`), []byte(`{"b":2}`)})
+	sink.Write(context.Background(), [][]byte{[]byte(`{"c":3}`)})
+
+	data, _ := os.ReadFile(path)
+	if string(data) != "{\"a\":1}\n{\"b\":2}\n{\"c\":3}\n" {
+		t.Errorf("Unexpected file contents %q", data)
+	}
+}
+
+func TestHTTPEventSink_PostsBatch(t *testing.T) {
+	var got []map[string]int
+	var auth string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer collector.Close()
+
+	sink, _ := eventSinkFromTarget(collector.URL, "secret")
+	if err := sink.Write(context.Background(), [][]byte{[]byte(`{"a":1}`), []byte(`{"b":2}`)}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(got) != 2 || got[1]["b"] != 2 {
+		t.Errorf("Expected a JSON array of 2 events, got %v", got)
+	}
+	if auth != "Bearer secret" {
+		t.Errorf("Expected bearer token, got %q", auth)
+	}
+}
+
+func TestHTTPEventSink_FailsOnErrorStatus(t *testing.T) {
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer collector.Close()
+
+	sink, _ := eventSinkFromTarget(collector.URL, "")
+	if err := sink.Write(context.Background(), [][]byte{[]byte(`{}`)}); err == nil {
+		t.Error("Expected an error for a 503 response")
+	}
+}
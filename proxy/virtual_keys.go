@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+)
+
+// Client keys are virtual: teammates get a key issued by the proxy rather
+// than the upstream one, and revoking it affects no one else. By default
+// every key is served with the proxy's own upstream key; a key can instead
+// name one of the upstream keys in PROXY_UPSTREAM_KEYS_FILE, so a team's
+// usage is billed to its own OpenAI project. Keys created through the admin
+// API are saved to PROXY_KEYS_STORE_FILE with their secrets hashed.
+
+const upstreamKeyContextKey contextKey = timelineContextKey + 1
+
+// upstreamKeyFromContext returns the upstream key requests are made with on
+// behalf of the client, or "" for the proxy's own
+func upstreamKeyFromContext(ctx context.Context) string {
+	key, _ := ctx.Value(upstreamKeyContextKey).(string)
+	return key
+}
+
+// upstreamKeySet holds the named upstream keys client keys can map to
+type upstreamKeySet struct {
+	mu   sync.RWMutex
+	keys map[string]string
+}
+
+// loadUpstreamKeys reads a JSON object of upstream keys by name from path
+func loadUpstreamKeys(path string) (*upstreamKeySet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read upstream keys file: %w", err)
+	}
+	set := &upstreamKeySet{}
+	if err := set.ReloadFile(data); err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+// ReloadFile replaces the upstream keys with those of a new file
+func (u *upstreamKeySet) ReloadFile(data []byte) error {
+	var keys map[string]string
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return fmt.Errorf("failed to parse upstream keys file: %w", err)
+	}
+	for name, key := range keys {
+		if key == "" {
+			return fmt.Errorf("upstream key %s is empty", name)
+		}
+	}
+	u.mu.Lock()
+	u.keys = keys
+	u.mu.Unlock()
+	return nil
+}
+
+// Get returns the upstream key with the given name
+func (u *upstreamKeySet) Get(name string) (string, bool) {
+	if u == nil {
+		return "", false
+	}
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	key, ok := u.keys[name]
+	return key, ok
+}
+
+// check returns an error if a client key cannot map to the upstream key
+// name
+func (u *upstreamKeySet) check(name string) error {
+	if name == "" {
+		return nil
+	}
+	if _, ok := u.Get(name); !ok {
+		return fmt.Errorf("unknown upstream key %q", name)
+	}
+	return nil
+}
+
+// LoadStore adds the keys saved in path, if it exists, and saves keys
+// created through the admin API there from now on. Keys of the keys file
+// take precedence over saved keys with the same ID.
+func (s *KeyStore) LoadStore(path string) error {
+	s.path = path
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read keys store: %w", err)
+	}
+	keys, err := parseKeysFile(data)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if s.Get(key.ID) != nil {
+			log.Printf("Saved client key %s is overridden by the keys file", key.ID)
+			continue
+		}
+		if err := s.Add(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Save writes the keys created through the admin API to the store file,
+// with their secrets replaced by hashes. Keys of the keys file and
+// temporary tokens are not saved.
+func (s *KeyStore) Save() error {
+	if s.path == "" {
+		return nil
+	}
+	s.mu.RLock()
+	keys := make([]ClientKey, 0, len(s.byID))
+	for _, k := range s.byID {
+		if s.fromFile[k.ID] || k.Parent != "" {
+			continue
+		}
+		stored := *k
+		stored.Key, stored.KeyHash = "", k.hash()
+		keys = append(keys, stored)
+	}
+	s.mu.RUnlock()
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID < keys[j].ID })
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// saveKeys saves the keys after a change through the admin API. The change
+// is already in effect, so a failure is logged rather than reported.
+func (s *ProxyServer) saveKeys() {
+	if err := s.keys.Save(); err != nil {
+		log.Printf("Failed to save client keys: %v", err)
+	}
+}
+
+// handleAdminCreateKey serves POST /admin/keys: it issues a key with a
+// generated secret, which is returned once and only stored hashed
+func (s *ProxyServer) handleAdminCreateKey(w http.ResponseWriter, r *http.Request) {
+	var key ClientKey
+	if err := decodeResource(r, &key); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if key.Key != "" || key.KeyHash != "" {
+		http.Error(w, "The secret of a new key is generated; use PUT /admin/keys/{id} to provision one", http.StatusBadRequest)
+		return
+	}
+	if key.Parent != "" || key.ExpiresAt != nil {
+		http.Error(w, "temporary tokens cannot be provisioned, mint them instead", http.StatusBadRequest)
+		return
+	}
+	if err := s.upstreamKeys.check(key.Upstream); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if key.ID == "" {
+		suffix, err := randomHex(4)
+		if err != nil {
+			http.Error(w, "Failed to generate key", http.StatusInternalServerError)
+			return
+		}
+		key.ID = "key-" + suffix
+	}
+	secret, err := randomHex(24)
+	if err != nil {
+		http.Error(w, "Failed to generate key", http.StatusInternalServerError)
+		return
+	}
+	key.Key = "sk-vibe-" + secret
+	if err := s.keys.Add(key); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	s.saveKeys()
+	log.Printf("Created client key %s", key.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(key)
+}
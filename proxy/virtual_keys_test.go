@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestProxyServer_CreateAndRevokeKey(t *testing.T) {
+	store := filepath.Join(t.TempDir(), "keys.json")
+	server := NewProxyServer(&MockOpenAIClient{response: createTestChatCompletionResponse()})
+	server.keys = createTestKeyStore(t)
+	if err := server.keys.LoadStore(store); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	handler := server.Handler()
+	do := func(method, path, secret, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+secret)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	chat := `{"model": "gpt-4o", "messages": [{"role": "user", "content": "Hi"}]}`
+
+	w := do("POST", "/admin/keys", "sk-admin-rw", `{"name": "Alice", "scopes": {"models": ["gpt-4o"]}}`)
+	var created ClientKey
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil || w.Code != http.StatusCreated {
+		t.Fatalf("Expected the key to be created, got %d %s", w.Code, w.Body.String())
+	}
+	if !strings.HasPrefix(created.Key, "sk-vibe-") || !strings.HasPrefix(created.ID, "key-") {
+		t.Fatalf("Expected a generated ID and secret, got %+v", created)
+	}
+	if w := do("POST", "/v1/chat/completions", created.Key, chat); w.Code != http.StatusOK {
+		t.Errorf("Expected the new key to work, got %d %s", w.Code, w.Body.String())
+	}
+
+	data, _ := os.ReadFile(store)
+	if strings.Contains(string(data), created.Key) || !strings.Contains(string(data), hashKey(created.Key)) {
+		t.Errorf("Expected the store to hold the hash of the secret only, got %s", data)
+	}
+	reloaded := createTestKeyStore(t)
+	if err := reloaded.LoadStore(store); err != nil || reloaded.Lookup(created.Key) == nil {
+		t.Errorf("Expected the saved key to survive a restart, got %v", err)
+	}
+	if w := do("GET", "/admin/keys/"+created.ID, "sk-admin-ro", ""); strings.Contains(w.Body.String(), "key_hash") {
+		t.Errorf("Expected the admin API to hide the hash, got %s", w.Body.String())
+	}
+
+	if w := do("DELETE", "/admin/keys/"+created.ID, "sk-admin-rw", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("Expected the key to be revoked, got %d %s", w.Code, w.Body.String())
+	}
+	if w := do("POST", "/v1/chat/completions", created.Key, chat); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected the revoked key to be refused, got %d", w.Code)
+	}
+	if data, _ := os.ReadFile(store); strings.Contains(string(data), created.ID) {
+		t.Errorf("Expected the revoked key to be removed from the store, got %s", data)
+	}
+}
+
+func TestProxyServer_UpstreamKeyPerClientKey(t *testing.T) {
+	var mu sync.Mutex
+	var seen []string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seen = append(seen, r.Header.Get("Authorization"))
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/embeddings" {
+			fmt.Fprint(w, `{"object":"list","data":[{"object":"embedding","index":0,"embedding":[0.1]}],"model":"text-embedding-3-small","usage":{"prompt_tokens":1,"total_tokens":1}}`)
+			return
+		}
+		json.NewEncoder(w).Encode(createTestChatCompletionResponse())
+	}))
+	defer api.Close()
+
+	client := NewRealOpenAIClient("sk-proxy")
+	client.BaseURL = api.URL
+	client.KeyOverrides = true
+	server := NewProxyServer(client)
+	server.keys = createTestKeyStore(t)
+	server.keys.Add(ClientKey{ID: "team-a", Key: "sk-team-a", Upstream: "project-a"})
+	server.keys.Add(ClientKey{ID: "team-b", Key: "sk-team-b", Upstream: "missing"})
+	server.upstreamKeys = &upstreamKeySet{keys: map[string]string{"project-a": "sk-project-a"}}
+	handler := server.Handler()
+	do := func(path, secret, body string) int {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+secret)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+	chat := `{"model": "gpt-4o", "messages": [{"role": "user", "content": "Hi"}]}`
+
+	if code := do("/v1/chat/completions", "sk-team-a", chat); code != http.StatusOK {
+		t.Fatalf("Expected the request to succeed, got %d", code)
+	}
+	if code := do("/v1/embeddings", "sk-team-a", `{"model": "text-embedding-3-small", "input": "Hi"}`); code != http.StatusOK {
+		t.Fatalf("Expected the request to succeed, got %d", code)
+	}
+	// Endpoints built on chat completions use the key's upstream key too
+	for path, body := range map[string]string{
+		"/v1/translate": `{"model": "gpt-4o", "text": "Hi", "target_language": "de"}`,
+		"/v1/summarize": `{"model": "gpt-4o", "document": "Hi"}`,
+	} {
+		if code := do(path, "sk-team-a", body); code != http.StatusOK {
+			t.Fatalf("Expected %s to succeed, got %d", path, code)
+		}
+	}
+	if code := do("/v1/chat/completions", "sk-full", chat); code != http.StatusOK {
+		t.Fatalf("Expected the request to succeed, got %d", code)
+	}
+	want := []string{"Bearer sk-project-a", "Bearer sk-project-a", "Bearer sk-project-a", "Bearer sk-project-a", "Bearer sk-proxy"}
+	if fmt.Sprint(seen) != fmt.Sprint(want) {
+		t.Errorf("Expected upstream keys %v, got %v", want, seen)
+	}
+
+	if code := do("/v1/chat/completions", "sk-team-b", chat); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected a key mapped to a missing upstream key to be refused, got %d", code)
+	}
+}
+
+func TestKeyStore_KeyHash(t *testing.T) {
+	store, err := NewKeyStore([]ClientKey{{ID: "hashed", KeyHash: hashKey("sk-secret")}})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if key := store.Lookup("sk-secret"); key == nil || key.ID != "hashed" {
+		t.Errorf("Expected a key configured by hash to authenticate, got %+v", key)
+	}
+	if _, err := NewKeyStore([]ClientKey{{ID: "bad", KeyHash: "abc"}}); err == nil {
+		t.Error("Expected a malformed key_hash to be rejected")
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// errModelNotAllowed is wrapped by errors for virtual models the caller may
+// not use
+var errModelNotAllowed = errors.New("model not allowed")
+
+// VirtualModel is a model name clients can request that expands to a real
+// model with a pinned system prompt, parameters and guardrail profile, so
+// every client using it gets the same behavior
+type VirtualModel struct {
+	// ID is the name clients put in "model", e.g. "acme-support-v2"
+	ID string `json:"id"`
+	// Model is the real model requests are sent to. Routing rules still
+	// apply to it.
+	Model string `json:"model"`
+	// Tenant, if set, limits the virtual model to that tenant's keys
+	Tenant string `json:"tenant,omitempty"`
+	// System is sent as the first message, ahead of any the client sends
+	System string `json:"system,omitempty"`
+	// Parameters set here override the client's
+	Temperature *float64 `json:"temperature,omitempty"`
+	MaxTokens   *int     `json:"max_tokens,omitempty"`
+	TopP        *float64 `json:"top_p,omitempty"`
+	// Guardrails names the guardrail profile checking the messages
+	Guardrails string `json:"guardrails,omitempty"`
+	// Flag names an object flag of the external flag service whose model,
+	// system, temperature, max_tokens and top_p override the definition,
+	// for experiments. The definition applies as is when the service has
+	// no answer or is unavailable.
+	Flag string `json:"flag,omitempty"`
+	// Version is assigned by the proxy each time the definition changes
+	Version int `json:"version,omitempty"`
+}
+
+// expandModel rewrites req for the model it asks for: a virtual model is
+// expanded to its definition, or to the version the tenant is pinned to,
+// then routing rules pick the upstream model. Client keys are checked
+// against the requested name beforehand, so a key scoped to a virtual model
+// does not need access to the model behind it.
+func (s *ProxyServer) expandModel(req *ChatCompletionRequest, tenant, endpoint string) error {
+	if vm, ok := s.virtualModels.Get(req.Model); ok {
+		if pinned, ok := s.modelHistory.Pinned(vm.ID, tenant); ok {
+			vm = pinned
+		}
+		if err := s.applyVirtualModel(req, vm, tenant, endpoint); err != nil {
+			return err
+		}
+	}
+	req.Model = s.resolveModel(req.Model, tenant)
+	return nil
+}
+
+// applyVirtualModel rewrites req for one definition of a virtual model,
+// leaving routing to the caller. Its guardrails apply unless they are not
+// rolled out to the tenant on endpoint yet.
+func (s *ProxyServer) applyVirtualModel(req *ChatCompletionRequest, vm VirtualModel, tenant, endpoint string) error {
+	if vm.Tenant != "" && vm.Tenant != tenant {
+		return fmt.Errorf("%w: virtual model %s belongs to another tenant", errModelNotAllowed, vm.ID)
+	}
+	if vm.Flag != "" && s.flagProvider != nil {
+		vm = withFlagOverrides(vm, s.flagProvider, flagTarget{Endpoint: endpoint, Tenant: tenant, Model: vm.ID})
+	}
+	messages := req.Messages
+	if vm.Guardrails != "" && s.featureEnabled(FeatureGuardrails, endpoint, tenant) {
+		profile, ok := s.guardrails.Get(vm.Guardrails)
+		if !ok {
+			return fmt.Errorf("virtual model %s uses unknown guardrail profile %s", vm.ID, vm.Guardrails)
+		}
+		var err error
+		if messages, err = profile.apply(messages); err != nil {
+			return err
+		}
+	}
+	if vm.System != "" {
+		messages = append([]Message{{Role: "system", Content: vm.System}}, messages...)
+	}
+	req.Model, req.Messages = vm.Model, messages
+	if vm.Temperature != nil {
+		req.Temperature = vm.Temperature
+	}
+	if vm.MaxTokens != nil {
+		req.MaxTokens = vm.MaxTokens
+	}
+	if vm.TopP != nil {
+		req.TopP = vm.TopP
+	}
+	return nil
+}
+
+// virtualModelOverrides are the parts of a definition a flag can change
+type virtualModelOverrides struct {
+	Model       *string  `json:"model"`
+	System      *string  `json:"system"`
+	Temperature *float64 `json:"temperature"`
+	MaxTokens   *int     `json:"max_tokens"`
+	TopP        *float64 `json:"top_p"`
+}
+
+// withFlagOverrides applies the object value of vm's flag to vm. Values
+// that are not such an object are logged and ignored.
+func withFlagOverrides(vm VirtualModel, p flagProvider, target flagTarget) VirtualModel {
+	value, ok := p.Value(vm.Flag, target)
+	if !ok || value == nil {
+		return vm
+	}
+	data, _ := json.Marshal(value)
+	var o virtualModelOverrides
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&o); err != nil {
+		log.Printf("Flag %s of virtual model %s is not a valid override: %v", vm.Flag, vm.ID, err)
+		return vm
+	}
+	if o.Model != nil && *o.Model != "" {
+		vm.Model = *o.Model
+	}
+	if o.System != nil {
+		vm.System = *o.System
+	}
+	if o.Temperature != nil {
+		vm.Temperature = o.Temperature
+	}
+	if o.MaxTokens != nil {
+		vm.MaxTokens = o.MaxTokens
+	}
+	if o.TopP != nil {
+		vm.TopP = o.TopP
+	}
+	return vm
+}
+
+// expandModelStatus is the status code to answer a failed expandModel with
+func expandModelStatus(err error) int {
+	switch {
+	case errors.Is(err, errModelNotAllowed):
+		return http.StatusForbidden
+	case errors.Is(err, errGuardrailBlocked):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// adminVirtualModelHandler manages the current definitions of virtual
+// models. Every change is numbered and logged with the admin key that made
+// it, see modelHistory.
+func (s *ProxyServer) adminVirtualModelHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		actor := adminActor(r)
+		s.virtualModelResource(actor).ServeHTTP(w, r)
+	})
+}
+
+func (s *ProxyServer) virtualModelResource(actor string) resourceHandler[VirtualModel] {
+	return resourceHandler[VirtualModel]{
+		lock: s.virtualModels.lockWrites,
+		get: func(id string) (VirtualModel, string, bool) {
+			vm, ok := s.virtualModels.Get(id)
+			return vm, etagFor(vm), ok
+		},
+		put: func(id string, vm VirtualModel, _ *VirtualModel) (bool, error) {
+			if vm.ID != "" && vm.ID != id {
+				return false, fmt.Errorf("id in body does not match id in path")
+			}
+			vm.ID = id
+			if vm.Model == "" {
+				return false, fmt.Errorf("virtual model requires model")
+			}
+			if vm.Model == id {
+				return false, fmt.Errorf("virtual model cannot expand to itself")
+			}
+			if vm.Guardrails != "" {
+				if _, ok := s.guardrails.Get(vm.Guardrails); !ok {
+					return false, fmt.Errorf("unknown guardrail profile %s", vm.Guardrails)
+				}
+			}
+			var created bool
+			s.modelHistory.commit(vm, actor, 0, func(vm VirtualModel) { created = s.virtualModels.Put(id, vm) })
+			return created, nil
+		},
+		remove: func(id string) bool {
+			return s.modelHistory.deleted(id, actor, func() bool { return s.virtualModels.Delete(id) })
+		},
+		view: func(vm VirtualModel) any { return vm },
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func chatRequestAs(server *ProxyServer, key *ClientKey, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body))
+	if key != nil {
+		req = req.WithContext(context.WithValue(req.Context(), clientKeyContextKey, key))
+	}
+	w := httptest.NewRecorder()
+	server.handleChatCompletions(w, req)
+	return w
+}
+
+func TestProxyServer_VirtualModel(t *testing.T) {
+	mockClient := &recordingOpenAIClient{MockOpenAIClient: MockOpenAIClient{response: createTestChatCompletionResponse()}}
+	server := NewProxyServer(mockClient)
+	temperature, maxTokens := 0.2, 300
+	server.virtualModels.Put("acme-support-v2", VirtualModel{ID: "acme-support-v2", Model: "gpt-3.5-turbo", Tenant: "acme", System: "You are Acme's support agent.", Temperature: &temperature, MaxTokens: &maxTokens})
+	server.routes.Put("legacy", RoutingRule{ID: "legacy", Model: "gpt-3.5*", TargetModel: "gpt-4o-mini"})
+
+	key := &ClientKey{ID: "acme-web", Tenant: "acme", Scopes: KeyScopes{Models: []string{"acme-*"}}}
+	w := chatRequestAs(server, key, `{"model": "acme-support-v2", "temperature": 1.5, "messages": [{"role": "user", "content": "My order is late"}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	last := mockClient.last
+	if last.Model != "gpt-4o-mini" {
+		t.Errorf("Expected the real model to be routed to gpt-4o-mini, got %s", last.Model)
+	}
+	if len(last.Messages) != 2 || last.Messages[0].Role != "system" || last.Messages[0].Content != "You are Acme's support agent." {
+		t.Errorf("Expected the pinned system prompt first, got %+v", last.Messages)
+	}
+	if *last.Temperature != 0.2 || *last.MaxTokens != 300 || last.TopP != nil {
+		t.Errorf("Expected pinned parameters to win, got %v %v %v", *last.Temperature, *last.MaxTokens, last.TopP)
+	}
+
+	other := &ClientKey{ID: "globex-web", Tenant: "globex"}
+	if w := chatRequestAs(server, other, `{"model": "acme-support-v2", "messages": [{"role": "user", "content": "Hi"}]}`); w.Code != http.StatusForbidden {
+		t.Errorf("Expected status code %d for another tenant, got %d", http.StatusForbidden, w.Code)
+	}
+}
+
+func TestProxyServer_VirtualModelPassthrough(t *testing.T) {
+	mockClient := &rawMockOpenAIClient{MockOpenAIClient: MockOpenAIClient{response: createTestChatCompletionResponse()}}
+	server := NewProxyServer(mockClient)
+	server.virtualModels.Put("summarizer", VirtualModel{ID: "summarizer", Model: "gpt-4o", System: "Summarize."})
+
+	if w := chatRequestAs(server, nil, `{"model": "summarizer", "messages": [{"role": "user", "content": "Text"}]}`); w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	if mockClient.lastRaw != nil {
+		t.Errorf("Expected virtual models to skip the passthrough path, got %s", mockClient.lastRaw)
+	}
+
+	chatRequestAs(server, nil, `{"model": "gpt-4o", "messages": [{"role": "user", "content": "Text"}]}`)
+	if mockClient.lastRaw == nil {
+		t.Error("Expected other models to use the passthrough path")
+	}
+}
+
+func TestAdmin_VirtualModels(t *testing.T) {
+	server := NewProxyServer(&MockOpenAIClient{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/models", handleAdminList("models", server.virtualModels.List))
+	mux.HandleFunc("/admin/models/{id}", server.adminVirtualModelHandler().ServeHTTP)
+	mux.HandleFunc("/admin/guardrails/{id}", server.adminGuardrailHandler().ServeHTTP)
+
+	if w := adminRequest(mux, "PUT", "/admin/models/acme-support-v2", `{"model": "gpt-4o", "guardrails": "strict"}`, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d for an unknown profile, got %d", http.StatusBadRequest, w.Code)
+	}
+	if w := adminRequest(mux, "PUT", "/admin/guardrails/strict", `{"redact_pii": true}`, nil); w.Code != http.StatusCreated {
+		t.Fatalf("Expected status code %d, got %d", http.StatusCreated, w.Code)
+	}
+	w := adminRequest(mux, "PUT", "/admin/models/acme-support-v2", `{"model": "gpt-4o", "system": "Be brief.", "guardrails": "strict"}`, nil)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	if w := adminRequest(mux, "GET", "/admin/models", "", nil); !strings.Contains(w.Body.String(), `"id":"acme-support-v2"`) {
+		t.Errorf("Expected the virtual model to be listed, got %s", w.Body.String())
+	}
+
+	for _, body := range []string{`{"system": "No model"}`, `{"model": "loop"}`, `{"id": "other", "model": "gpt-4o"}`} {
+		if w := adminRequest(mux, "PUT", "/admin/models/loop", body, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status code %d for %s, got %d", http.StatusBadRequest, body, w.Code)
+		}
+	}
+}
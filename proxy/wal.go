@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errWALFull is returned by Enqueue once the queue holds more undelivered
+// data than its backpressure threshold allows
+var errWALFull = errors.New("write-ahead queue is full")
+
+// Each record is framed as a 4-byte length and a 4-byte CRC-32 of the
+// payload, both big-endian, followed by the payload
+const walHeaderSize = 8
+
+// eventSink receives batches of queued events. Write must be all or
+// nothing: on error the whole batch is delivered again later.
+type eventSink interface {
+	Write(ctx context.Context, events [][]byte) error
+}
+
+// walQueue is a persistent FIFO of events backed by segment files on local
+// disk. Producers append to the newest segment and never wait for the sink;
+// a delivery loop reads batches from a persisted cursor, hands them to the
+// sink, and deletes segments once everything in them has been delivered.
+// Delivery is at-least-once: a crash between a sink write and the cursor
+// update means that batch is delivered again.
+type walQueue struct {
+	dir         string
+	sink        eventSink
+	segmentSize int64
+	// maxBytes is the backpressure threshold: beyond it new events are
+	// rejected (and counted as dropped) instead of growing the disk usage
+	maxBytes  int64
+	batchSize int
+
+	mu        sync.Mutex
+	cur       *os.File
+	curID     uint64
+	curSize   int64
+	readID    uint64
+	readOff   int64
+	pending   int64
+	dropped   int64
+	delivered int64
+	notify    chan struct{}
+}
+
+// WALStats describes the queue for monitoring
+type WALStats struct {
+	PendingBytes int64 `json:"pending_bytes"`
+	MaxBytes     int64 `json:"max_bytes"`
+	Dropped      int64 `json:"dropped"`
+	Delivered    int64 `json:"delivered"`
+}
+
+func segmentName(id uint64) string {
+	return fmt.Sprintf("%016d.wal", id)
+}
+
+// openWALQueue opens or creates a queue in dir, recovering from a previous
+// crash by truncating a torn record at the end of the newest segment
+func openWALQueue(dir string, sink eventSink, maxBytes int64) (*walQueue, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create WAL directory: %w", err)
+	}
+	q := &walQueue{
+		dir:         dir,
+		sink:        sink,
+		segmentSize: 4 << 20,
+		maxBytes:    maxBytes,
+		batchSize:   500,
+		notify:      make(chan struct{}, 1),
+	}
+
+	ids, err := q.segments()
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		ids = []uint64{1}
+	}
+	q.readID, q.readOff = ids[0], 0
+	if data, err := os.ReadFile(filepath.Join(dir, "cursor")); err == nil {
+		fields := strings.Fields(string(data))
+		if len(fields) == 2 {
+			id, err1 := strconv.ParseUint(fields[0], 10, 64)
+			off, err2 := strconv.ParseInt(fields[1], 10, 64)
+			if err1 == nil && err2 == nil && id >= ids[0] {
+				q.readID, q.readOff = id, off
+			}
+		}
+	}
+
+	q.curID = ids[len(ids)-1]
+	path := filepath.Join(dir, segmentName(q.curID))
+	valid, err := validLength(path)
+	if err != nil {
+		return nil, err
+	}
+	q.cur, err = os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open WAL segment: %w", err)
+	}
+	if err := q.cur.Truncate(valid); err != nil {
+		return nil, fmt.Errorf("failed to truncate WAL segment: %w", err)
+	}
+	if _, err := q.cur.Seek(valid, io.SeekStart); err != nil {
+		return nil, err
+	}
+	q.curSize = valid
+	q.pending = q.pendingBytes(ids)
+	return q, nil
+}
+
+// segments lists segment IDs in order
+func (q *walQueue) segments() ([]uint64, error) {
+	entries, err := os.ReadDir(q.dir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []uint64
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), ".wal")
+		if !ok {
+			continue
+		}
+		if id, err := strconv.ParseUint(name, 10, 64); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+// pendingBytes sums the undelivered bytes of the given segments
+func (q *walQueue) pendingBytes(ids []uint64) int64 {
+	var total int64
+	for _, id := range ids {
+		if id < q.readID {
+			continue
+		}
+		if info, err := os.Stat(filepath.Join(q.dir, segmentName(id))); err == nil {
+			total += info.Size()
+		}
+	}
+	return total - q.readOff
+}
+
+// validLength returns the length of the prefix of a segment made of
+// complete, uncorrupted records
+func validLength(path string) (int64, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	rd := bufio.NewReader(f)
+	var valid int64
+	for {
+		payload, err := readWALRecord(rd)
+		if err != nil {
+			return valid, nil
+		}
+		valid += walHeaderSize + int64(len(payload))
+	}
+}
+
+func readWALRecord(rd io.Reader) ([]byte, error) {
+	var header [walHeaderSize]byte
+	if _, err := io.ReadFull(rd, header[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(header[:4])
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(rd, payload); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, fmt.Errorf("corrupt WAL record")
+	}
+	return payload, nil
+}
+
+// Enqueue appends an event. It only writes to the local segment file and
+// never waits for the sink; when the backlog exceeds maxBytes the event is
+// dropped and errWALFull returned.
+func (q *walQueue) Enqueue(payload []byte) error {
+	var header [walHeaderSize]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(header[4:], crc32.ChecksumIEEE(payload))
+	buf := getBuffer()
+	defer putBuffer(buf)
+	buf.Write(header[:])
+	buf.Write(payload)
+	record := buf.Bytes()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.pending+int64(len(record)) > q.maxBytes {
+		q.dropped++
+		return errWALFull
+	}
+	if q.curSize > 0 && q.curSize+int64(len(record)) > q.segmentSize {
+		if err := q.rotate(); err != nil {
+			return err
+		}
+	}
+	if _, err := q.cur.Write(record); err != nil {
+		return fmt.Errorf("failed to append to WAL: %w", err)
+	}
+	q.curSize += int64(len(record))
+	q.pending += int64(len(record))
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// rotate seals the current segment and starts a new one. Callers must hold q.mu.
+func (q *walQueue) rotate() error {
+	if err := q.cur.Sync(); err != nil {
+		return err
+	}
+	q.cur.Close()
+	q.curID++
+	f, err := os.OpenFile(filepath.Join(q.dir, segmentName(q.curID)), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create WAL segment: %w", err)
+	}
+	q.cur, q.curSize = f, 0
+	return nil
+}
+
+// readBatch reads up to batchSize events from the cursor and returns them
+// with the cursor position just past them
+func (q *walQueue) readBatch() ([][]byte, uint64, int64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	id, off := q.readID, q.readOff
+	var batch [][]byte
+	for len(batch) < q.batchSize {
+		f, err := os.Open(filepath.Join(q.dir, segmentName(id)))
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) && id < q.curID {
+				id, off = id+1, 0
+				continue
+			}
+			return batch, id, off, err
+		}
+		if _, err := f.Seek(off, io.SeekStart); err != nil {
+			f.Close()
+			return batch, id, off, err
+		}
+		rd := bufio.NewReader(f)
+		for len(batch) < q.batchSize {
+			payload, err := readWALRecord(rd)
+			if err != nil {
+				break
+			}
+			batch = append(batch, payload)
+			off += walHeaderSize + int64(len(payload))
+		}
+		f.Close()
+		if len(batch) >= q.batchSize || id >= q.curID {
+			break
+		}
+		// The segment is sealed and fully read, continue with the next one
+		id, off = id+1, 0
+	}
+	return batch, id, off, nil
+}
+
+// commit advances the cursor after a successful delivery, persists it and
+// deletes segments that are fully delivered
+func (q *walQueue) commit(id uint64, off int64, count int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	tmp := filepath.Join(q.dir, "cursor.tmp")
+	if err := os.WriteFile(tmp, []byte(fmt.Sprintf("%d %d\n", id, off)), 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(q.dir, "cursor")); err != nil {
+		return err
+	}
+	for old := q.readID; old < id; old++ {
+		os.Remove(filepath.Join(q.dir, segmentName(old)))
+	}
+	q.readID, q.readOff = id, off
+	q.delivered += int64(count)
+
+	ids, err := q.segments()
+	if err != nil {
+		return err
+	}
+	q.pending = q.pendingBytes(ids)
+	return nil
+}
+
+// deliver sends one batch to the sink and reports how many events it sent
+func (q *walQueue) deliver(ctx context.Context) (int, error) {
+	batch, id, off, err := q.readBatch()
+	if err != nil {
+		return 0, err
+	}
+	if len(batch) == 0 {
+		return 0, nil
+	}
+	if err := q.sink.Write(ctx, batch); err != nil {
+		return 0, err
+	}
+	return len(batch), q.commit(id, off, len(batch))
+}
+
+// Run delivers queued events until ctx is cancelled, backing off while the
+// sink is failing. The current segment is fsynced every second, bounding
+// what an OS crash can lose.
+func (q *walQueue) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	backoff := time.Second
+	for {
+		n, err := q.deliver(ctx)
+		if err != nil {
+			log.Printf("Failed to deliver queued events, retrying in %s: %v", backoff, err)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return
+			}
+			backoff = min(backoff*2, time.Minute)
+			continue
+		}
+		backoff = time.Second
+		if n > 0 {
+			continue
+		}
+
+		select {
+		case <-q.notify:
+		case <-ticker.C:
+			q.mu.Lock()
+			q.cur.Sync()
+			q.mu.Unlock()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (q *walQueue) Stats() WALStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return WALStats{PendingBytes: q.pending, MaxBytes: q.maxBytes, Dropped: q.dropped, Delivered: q.delivered}
+}
+
+// Close flushes and closes the current segment
+func (q *walQueue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.cur.Sync(); err != nil {
+		return err
+	}
+	return q.cur.Close()
+}
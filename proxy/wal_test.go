@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// memorySink records delivered events and can be made to fail
+type memorySink struct {
+	mu     sync.Mutex
+	events []string
+	fail   bool
+}
+
+func (s *memorySink) Write(ctx context.Context, events [][]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fail {
+		return errors.New("sink unavailable")
+	}
+	for _, e := range events {
+		s.events = append(s.events, string(e))
+	}
+	return nil
+}
+
+func TestWALQueue_DeliversInOrder(t *testing.T) {
+	sink := &memorySink{}
+	q, err := openWALQueue(t.TempDir(), sink, 1<<20)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer q.Close()
+
+	for _, e := range []string{"a", "b", "c"} {
+		if err := q.Enqueue([]byte(e)); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+	n, err := q.deliver(context.Background())
+	if err != nil || n != 3 {
+		t.Fatalf("Expected 3 events delivered, got %d (%v)", n, err)
+	}
+	if len(sink.events) != 3 || sink.events[0] != "a" || sink.events[2] != "c" {
+		t.Errorf("Expected events a, b, c, got %v", sink.events)
+	}
+	if stats := q.Stats(); stats.PendingBytes != 0 || stats.Delivered != 3 {
+		t.Errorf("Expected empty queue after delivery, got %+v", stats)
+	}
+}
+
+func TestWALQueue_KeepsEventsWhileSinkFails(t *testing.T) {
+	sink := &memorySink{fail: true}
+	q, err := openWALQueue(t.TempDir(), sink, 1<<20)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer q.Close()
+
+	q.Enqueue([]byte("a"))
+	if _, err := q.deliver(context.Background()); err == nil {
+		t.Fatal("Expected delivery error while sink is down")
+	}
+	sink.fail = false
+	if n, err := q.deliver(context.Background()); err != nil || n != 1 {
+		t.Errorf("Expected the event to be delivered after recovery, got %d (%v)", n, err)
+	}
+}
+
+func TestWALQueue_Backpressure(t *testing.T) {
+	q, err := openWALQueue(t.TempDir(), &memorySink{}, 40)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer q.Close()
+
+	// Each record is 8 header bytes plus a 10 byte payload
+	payload := []byte("0123456789")
+	for i := 0; i < 2; i++ {
+		if err := q.Enqueue(payload); err != nil {
+			t.Fatalf("Expected event %d to be accepted, got %v", i, err)
+		}
+	}
+	if err := q.Enqueue(payload); !errors.Is(err, errWALFull) {
+		t.Errorf("Expected errWALFull, got %v", err)
+	}
+	if stats := q.Stats(); stats.Dropped != 1 {
+		t.Errorf("Expected 1 dropped event, got %d", stats.Dropped)
+	}
+
+	// Delivering frees space again
+	q.deliver(context.Background())
+	if err := q.Enqueue(payload); err != nil {
+		t.Errorf("Expected event to be accepted after delivery, got %v", err)
+	}
+}
+
+func TestWALQueue_SurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	sink := &memorySink{}
+	q, err := openWALQueue(dir, sink, 1<<20)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	q.Enqueue([]byte("delivered"))
+	q.deliver(context.Background())
+	q.Enqueue([]byte("pending"))
+	q.Close()
+
+	q, err = openWALQueue(dir, sink, 1<<20)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer q.Close()
+	q.deliver(context.Background())
+	if len(sink.events) != 2 || sink.events[1] != "pending" {
+		t.Errorf("Expected only the pending event to be redelivered, got %v", sink.events)
+	}
+}
+
+func TestWALQueue_TruncatesTornRecord(t *testing.T) {
+	dir := t.TempDir()
+	q, err := openWALQueue(dir, &memorySink{}, 1<<20)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	q.Enqueue([]byte("complete"))
+	q.Close()
+
+	// Simulate a crash in the middle of writing a record
+	f, _ := os.OpenFile(filepath.Join(dir, segmentName(1)), os.O_WRONLY|os.O_APPEND, 0)
+	f.Write([]byte{0, 0, 0, 20, 1, 2})
+	f.Close()
+
+	sink := &memorySink{}
+	q, err = openWALQueue(dir, sink, 1<<20)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer q.Close()
+	q.Enqueue([]byte("after"))
+	q.deliver(context.Background())
+	if len(sink.events) != 2 || sink.events[0] != "complete" || sink.events[1] != "after" {
+		t.Errorf("Expected torn record to be discarded, got %v", sink.events)
+	}
+}
+
+func TestWALQueue_RotatesSegments(t *testing.T) {
+	dir := t.TempDir()
+	sink := &memorySink{}
+	q, err := openWALQueue(dir, sink, 1<<20)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer q.Close()
+	q.segmentSize = 20
+
+	for _, e := range []string{"first", "second", "third"} {
+		q.Enqueue([]byte(e))
+	}
+	if ids, _ := q.segments(); len(ids) != 3 {
+		t.Fatalf("Expected 3 segments, got %v", ids)
+	}
+	q.deliver(context.Background())
+	if len(sink.events) != 3 {
+		t.Errorf("Expected events from all segments, got %v", sink.events)
+	}
+	if ids, _ := q.segments(); len(ids) != 1 {
+		t.Errorf("Expected delivered segments to be deleted, got %v", ids)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// fileWatcher polls files for content changes and invokes a reload callback
+// when they change. Kubernetes updates mounted ConfigMaps and Secrets by
+// atomically swapping a "..data" symlink, which path-based change events
+// miss, so the watcher compares content hashes instead.
+type fileWatcher struct {
+	interval time.Duration
+
+	mu    sync.Mutex
+	files []*watchedFile
+}
+
+type watchedFile struct {
+	path     string
+	hash     [sha256.Size]byte
+	onChange func(data []byte) error
+}
+
+func newFileWatcher(interval time.Duration) *fileWatcher {
+	return &fileWatcher{interval: interval}
+}
+
+// Watch registers path with the watcher. The current content is taken as the
+// baseline, so onChange is only called for later changes.
+func (w *fileWatcher) Watch(path string, onChange func(data []byte) error) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.files = append(w.files, &watchedFile{path: path, hash: sha256.Sum256(data), onChange: onChange})
+	return nil
+}
+
+// Poll checks every watched file once. A file that cannot be read (e.g. in
+// the middle of a symlink swap) is skipped until the next poll, and a failed
+// reload keeps the previous configuration in place.
+func (w *fileWatcher) Poll() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, f := range w.files {
+		data, err := os.ReadFile(f.path)
+		if err != nil {
+			log.Printf("Failed to read watched file %s: %v", f.path, err)
+			continue
+		}
+		hash := sha256.Sum256(data)
+		if bytes.Equal(hash[:], f.hash[:]) {
+			continue
+		}
+		f.hash = hash
+		if err := f.onChange(data); err != nil {
+			log.Printf("Failed to reload %s, keeping previous configuration: %v", f.path, err)
+			continue
+		}
+		log.Printf("Reloaded %s", f.path)
+	}
+}
+
+// Run polls until stop is closed
+func (w *fileWatcher) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.Poll()
+		case <-stop:
+			return
+		}
+	}
+}
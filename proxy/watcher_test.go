@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileWatcher_Poll(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "api-key")
+	os.WriteFile(path, []byte("sk-old"), 0o600)
+
+	var reloads []string
+	watcher := newFileWatcher(0)
+	err := watcher.Watch(path, func(data []byte) error {
+		reloads = append(reloads, string(data))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to watch file: %v", err)
+	}
+
+	watcher.Poll()
+	if len(reloads) != 0 {
+		t.Errorf("Expected no reload for unchanged file, got %v", reloads)
+	}
+
+	os.WriteFile(path, []byte("sk-new"), 0o600)
+	watcher.Poll()
+	watcher.Poll()
+	if len(reloads) != 1 || reloads[0] != "sk-new" {
+		t.Errorf("Expected exactly one reload with new content, got %v", reloads)
+	}
+}
+
+// Kubernetes swaps a "..data" symlink to publish new ConfigMap contents
+func TestFileWatcher_KubernetesSymlinkSwap(t *testing.T) {
+	dir := t.TempDir()
+	for _, v := range []string{"v1", "v2"} {
+		os.Mkdir(filepath.Join(dir, v), 0o755)
+		os.WriteFile(filepath.Join(dir, v, "keys.json"), []byte(v), 0o600)
+	}
+	if err := os.Symlink("v1", filepath.Join(dir, "..data")); err != nil {
+		t.Skipf("Symlinks not supported: %v", err)
+	}
+	os.Symlink(filepath.Join("..data", "keys.json"), filepath.Join(dir, "keys.json"))
+
+	var got string
+	watcher := newFileWatcher(0)
+	watcher.Watch(filepath.Join(dir, "keys.json"), func(data []byte) error {
+		got = string(data)
+		return nil
+	})
+
+	tmp := filepath.Join(dir, "..data_tmp")
+	os.Symlink("v2", tmp)
+	os.Rename(tmp, filepath.Join(dir, "..data"))
+	watcher.Poll()
+
+	if got != "v2" {
+		t.Errorf("Expected reload with v2 content, got %q", got)
+	}
+}
+
+func TestFileWatcher_FailedReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	os.WriteFile(path, []byte("one"), 0o600)
+
+	calls := 0
+	watcher := newFileWatcher(0)
+	watcher.Watch(path, func(data []byte) error {
+		calls++
+		return errors.New("invalid")
+	})
+
+	os.WriteFile(path, []byte("two"), 0o600)
+	watcher.Poll()
+	watcher.Poll()
+	if calls != 1 {
+		t.Errorf("Expected a broken file to be tried once until it changes again, got %d calls", calls)
+	}
+}